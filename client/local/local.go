@@ -15,10 +15,12 @@
 	"fmt"
 	"io"
 	"iter"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/netip"
+	"net/textproto"
 	"net/url"
 	"os/exec"
 	"runtime"
@@ -764,6 +766,72 @@ func (lc *Client) PushFile(ctx context.Context, target tailcfg.StableNodeID, siz
 	return bestError(fmt.Errorf("%s: %s", res.Status, all), all)
 }
 
+// PushDir sends the Taildrop directory tree described by manifest to target.
+//
+// The open func is called for each regular file in the manifest, in order,
+// to get its contents, which must have the size in the manifest.
+func (lc *Client) PushDir(ctx context.Context, target tailcfg.StableNodeID, manifest *apitype.TaildropManifest, open func(path string) (io.ReadCloser, error)) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeDirParts(mw, manifest, open))
+	}()
+	defer pr.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+apitype.LocalAPIHost+"/localapi/v0/file-put-dir/"+string(target), pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 200 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	all, _ := io.ReadAll(res.Body)
+	return bestError(fmt.Errorf("%s: %s", res.Status, all), all)
+}
+
+// writeDirParts writes the manifest and then the contents of each regular
+// file in it as parts to mw, for PushDir.
+func writeDirParts(mw *multipart.Writer, manifest *apitype.TaildropManifest, open func(path string) (io.ReadCloser, error)) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(manifest); err != nil {
+		return err
+	}
+	for _, e := range manifest.Entries {
+		if !e.Mode.IsRegular() {
+			continue
+		}
+		part, err := mw.CreateFormField(e.Path)
+		if err != nil {
+			return err
+		}
+		f, err := open(e.Path)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(part, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if n != e.Size {
+			return fmt.Errorf("%s: read %d bytes; want %d", e.Path, n, e.Size)
+		}
+	}
+	return mw.Close()
+}
+
 // CheckIPForwarding asks the local Tailscale daemon whether it looks like the
 // machine is properly configured to forward IP packets as a subnet router
 // or exit node.
@@ -918,6 +986,29 @@ func (lc *Client) QueryDNS(ctx context.Context, name string, queryType string) (
 	return res.Bytes, res.Resolvers, nil
 }
 
+// DNSQueryStats returns the statistics of the queries of each client of the
+// internal DNS resolver, with the n names each queried most. They're only
+// available while tailscaled is logging DNS queries.
+func (lc *Client) DNSQueryStats(ctx context.Context, n int) ([]apitype.ClientQueryStats, error) {
+	if !buildfeatures.HasDNS {
+		return nil, feature.ErrUnavailable
+	}
+	body, err := lc.get200(ctx, fmt.Sprintf("/localapi/v0/dns-queries?n=%d", n))
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]apitype.ClientQueryStats](body)
+}
+
+// FlushDNSCache removes all responses cached by the internal DNS forwarder.
+func (lc *Client) FlushDNSCache(ctx context.Context) error {
+	if !buildfeatures.HasDNS {
+		return feature.ErrUnavailable
+	}
+	_, err := lc.send(ctx, "POST", "/localapi/v0/dns-flush", http.StatusNoContent, nil)
+	return err
+}
+
 // StartLoginInteractive starts an interactive login.
 func (lc *Client) StartLoginInteractive(ctx context.Context) error {
 	_, err := lc.send(ctx, "POST", "/localapi/v0/login-interactive", http.StatusNoContent, nil)
@@ -5,6 +5,10 @@
 package apitype
 
 import (
+	"io/fs"
+	"net/netip"
+	"time"
+
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/util/ctxkey"
@@ -56,6 +60,31 @@ type WaitingFile struct {
 	Size int64
 }
 
+// TaildropManifest describes a directory tree sent with Taildrop.
+type TaildropManifest struct {
+	// Entries are the directories and regular files of the tree, with
+	// each directory before its contents. The first entry is the root
+	// directory of the tree.
+	Entries []TaildropEntry
+}
+
+// TaildropEntry is a directory or regular file in a TaildropManifest.
+type TaildropEntry struct {
+	// Path is the slash-separated path of the entry, starting with the
+	// name of the root directory, e.g. "photos/2024/beach.jpg".
+	Path string
+
+	// Mode is the type and permission bits of the entry. Only directories
+	// and regular files are allowed.
+	Mode fs.FileMode
+
+	// ModTime is the modification time of the entry.
+	ModTime time.Time
+
+	// Size is the size of a regular file, in bytes.
+	Size int64 `json:",omitempty"`
+}
+
 // SetPushDeviceTokenRequest is the body POSTed to the LocalAPI endpoint /set-device-token.
 type SetPushDeviceTokenRequest struct {
 	// PushDeviceToken is the iOS/macOS APNs device token (and any future Android equivalent).
@@ -95,6 +124,34 @@ type DNSQueryResponse struct {
 	Resolvers []*dnstype.Resolver
 }
 
+// ClientQueryStats are statistics of the DNS queries that one client sent
+// to the built-in DNS resolver, as returned by the LocalAPI.
+type ClientQueryStats struct {
+	// Client is the IP address that the queries came from.
+	Client netip.Addr
+
+	// Node is the name of the Tailscale node with the Client address, if
+	// it's known.
+	Node string `json:",omitempty"`
+
+	// Queries is the number of queries the client sent.
+	Queries int64
+
+	// LastQuery is when the client last sent a query.
+	LastQuery time.Time
+
+	// TopNames are the names the client queried most, most first.
+	// The counts are approximate once the client has queried many
+	// different names.
+	TopNames []NameCount `json:",omitempty"`
+}
+
+// NameCount is the number of DNS queries for a name.
+type NameCount struct {
+	Name  string // without a trailing dot
+	Count int64
+}
+
 // OptionalFeatures describes which optional features are enabled in the build.
 type OptionalFeatures struct {
 	// Features is the map of optional feature names to whether they are
@@ -38,8 +38,10 @@
 	"time"
 
 	"github.com/tailscale/setec/client/setec"
+	"golang.org/x/net/quic"
 	"golang.org/x/time/rate"
 	"tailscale.com/atomicfile"
+	"tailscale.com/derp/derpquic"
 	"tailscale.com/derp/derpserver"
 	"tailscale.com/metrics"
 	"tailscale.com/net/ktimeout"
@@ -59,6 +61,7 @@
 	addr        = flag.String("a", ":443", "server HTTP/HTTPS listen address, in form \":port\", \"ip:port\", or for IPv6 \"[ip]:port\". If the IP is omitted, it defaults to all interfaces. Serves HTTPS if the port is 443 and/or -certmode is manual, otherwise HTTP.")
 	httpPort    = flag.Int("http-port", 80, "The port on which to serve HTTP. Set to -1 to disable. The listener is bound to the same IP (if any) as specified in the -a flag.")
 	stunPort    = flag.Int("stun-port", 3478, "The UDP port on which to serve STUN. The listener is bound to the same IP (if any) as specified in the -a flag.")
+	quicPort    = flag.Int("quic-port", 0, "The UDP port on which to serve DERP over QUIC, with the same certificate as HTTPS, or 0 to disable. It's only served with TLS. The listener is bound to the same IP (if any) as specified in the -a flag. Clients with QUIC enabled use it if the DERP map sets DERPNode.QUICPort.")
 	configPath  = flag.String("c", "", "config file path")
 	certMode    = flag.String("certmode", "letsencrypt", "mode for getting a cert. possible options: manual, letsencrypt")
 	certDir     = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
@@ -67,13 +70,17 @@
 	runDERP     = flag.Bool("derp", true, "whether to run a DERP server. The only reason to set this false is if you're decommissioning a server but want to keep its bootstrap DNS functionality still running.")
 	flagHome    = flag.String("home", "", "what to serve at the root path. It may be left empty (the default, for a default homepage), \"blank\" for a blank page, or a URL to redirect to")
 
-	meshPSKFile     = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It must be 64 lowercase hexadecimal characters; whitespace is trimmed.")
-	meshWith        = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list. If an entry contains a slash, the second part names a hostname to be used when dialing the target.")
-	secretsURL      = flag.String("secrets-url", "", "SETEC server URL for secrets retrieval of mesh key")
-	secretPrefix    = flag.String("secrets-path-prefix", "prod/derp", "setec path prefix for \""+setecMeshKeyName+"\" secret for DERP mesh key")
-	secretsCacheDir = flag.String("secrets-cache-dir", defaultSetecCacheDir(), "directory to cache setec secrets in (required if --secrets-url is set)")
-	bootstrapDNS    = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
-	unpublishedDNS  = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list. If an entry contains a slash, the second part names a DNS record to poll for its TXT record with a `0` to `100` value for rollout percentage.")
+	meshPSKFile      = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It must be 64 lowercase hexadecimal characters; whitespace is trimmed.")
+	meshWith         = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list. If an entry contains a slash, the second part names a hostname to be used when dialing the target.")
+	meshConfig       = flag.String("mesh-config", "", "optional path to a file listing hostnames to mesh with, one per line in the --mesh-with format. It's re-read every 5 seconds, and peers are added and removed as it changes.")
+	meshDNS          = flag.String("mesh-dns", "", "optional DNS name to discover hostnames to mesh with, polled every --mesh-poll-interval. If it starts with an underscore, it's an SRV record set of their names and ports; otherwise an A/AAAA record set of their IPs, dialed with the name as hostname.")
+	meshURL          = flag.String("mesh-url", "", "optional URL returning a JSON array of hostnames to mesh with in the --mesh-with format, polled every --mesh-poll-interval")
+	meshPollInterval = flag.Duration("mesh-poll-interval", time.Minute, "how often to poll --mesh-dns and --mesh-url")
+	secretsURL       = flag.String("secrets-url", "", "SETEC server URL for secrets retrieval of mesh key")
+	secretPrefix     = flag.String("secrets-path-prefix", "prod/derp", "setec path prefix for \""+setecMeshKeyName+"\" secret for DERP mesh key")
+	secretsCacheDir  = flag.String("secrets-cache-dir", defaultSetecCacheDir(), "directory to cache setec secrets in (required if --secrets-url is set)")
+	bootstrapDNS     = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
+	unpublishedDNS   = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list. If an entry contains a slash, the second part names a DNS record to poll for its TXT record with a `0` to `100` value for rollout percentage.")
 
 	verifyClients   = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
 	verifyClientURL = flag.String("verify-client-url", "", "if non-empty, an admission controller URL for permitting client connections; see tailcfg.DERPAdmitClientRequest")
@@ -83,6 +90,7 @@
 
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+	rateLimitsPath  = flag.String("rate-limits", "", "optional path to a JSON file of per-client rate limits; see derpserver.RateLimits")
 
 	// tcpKeepAlive is intentionally long, to reduce battery cost. There is an L7 keepalive on a higher frequency schedule.
 	tcpKeepAlive = flag.Duration("tcp-keepalive-time", 10*time.Minute, "TCP keepalive time")
@@ -194,6 +202,15 @@ func main() {
 	s.SetVerifyClientURL(*verifyClientURL)
 	s.SetVerifyClientURLFailOpen(*verifyFailOpen)
 	s.SetTCPWriteTimeout(*tcpWriteTimeout)
+	if *rateLimitsPath != "" {
+		limits, err := loadRateLimits(*rateLimitsPath)
+		if err != nil {
+			log.Fatalf("rate limits: %v", err)
+		}
+		if err := s.SetRateLimits(limits); err != nil {
+			log.Fatalf("rate limits: %v", err)
+		}
+	}
 
 	var meshKey string
 	if *dev {
@@ -243,7 +260,8 @@ func main() {
 		log.Println("DERP mesh key configured")
 	}
 
-	if err := startMesh(s); err != nil {
+	mesh, err := startMesh(s)
+	if err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
 	expvar.Publish("derp", s.ExpVar())
@@ -283,6 +301,9 @@ func main() {
 	debug := tsweb.Debugger(mux)
 	debug.KV("TLS hostname", *hostname)
 	debug.KV("Mesh key", s.HasMeshKey())
+	if *quicPort > 0 {
+		debug.KV("QUIC port", *quicPort)
+	}
 	debug.Handle("check", "Consistency check", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := s.ConsistencyCheck()
 		if err != nil {
@@ -292,6 +313,9 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	if mesh != nil {
+		debug.Handle("mesh", "Mesh membership", mesh)
+	}
 	debug.Handle("set-mutex-profile-fraction", "SetMutexProfileFraction", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s := r.FormValue("rate")
 		if s == "" || r.Header.Get("Sec-Debug") != "derp" {
@@ -359,6 +383,12 @@ func main() {
 		}
 		// Disable TLS 1.0 and 1.1, which are obsolete and have security issues.
 		httpsrv.TLSConfig.MinVersion = tls.VersionTLS12
+		// The accept rate limit applies to TCP and QUIC connections
+		// together.
+		acceptLim := rate.NewLimiter(rate.Limit(*acceptConnLimit), *acceptConnBurst)
+		if *quicPort > 0 && *runDERP {
+			go serveQUIC(ctx, s, net.JoinHostPort(listenHost, fmt.Sprint(*quicPort)), httpsrv.TLSConfig, acceptLim)
+		}
 		httpsrv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.TLS != nil {
 				label := "unknown"
@@ -413,8 +443,11 @@ func main() {
 				}
 			}()
 		}
-		err = rateLimitedListenAndServeTLS(httpsrv, &lc)
+		err = rateLimitedListenAndServeTLS(httpsrv, &lc, acceptLim)
 	} else {
+		if *quicPort > 0 {
+			log.Printf("derper: not serving QUIC on port %d without TLS", *quicPort)
+		}
 		log.Printf("derper: serving on %s", *addr)
 		var ln net.Listener
 		ln, err = lc.Listen(context.Background(), "tcp", httpsrv.Addr)
@@ -454,12 +487,27 @@ func defaultMeshPSKFile() string {
 	return ""
 }
 
-func rateLimitedListenAndServeTLS(srv *http.Server, lc *net.ListenConfig) error {
+// serveQUIC serves DERP over QUIC on the UDP address addr, with the TLS
+// configuration of the HTTPS server and its accept rate limiter, until ctx
+// is done.
+func serveQUIC(ctx context.Context, s *derpserver.Server, addr string, tlsConf *tls.Config, lim *rate.Limiter) {
+	ep, err := quic.Listen("udp", addr, derpquic.Config(tlsConf))
+	if err != nil {
+		log.Fatalf("derper: QUIC: %v", err)
+	}
+	log.Printf("derper: serving DERP over QUIC on %v", ep.LocalAddr())
+	if err := s.ServeQUIC(ctx, ep, lim); err != nil && ctx.Err() == nil {
+		log.Fatalf("derper: QUIC: %v", err)
+	}
+	ep.Close(context.Background())
+}
+
+func rateLimitedListenAndServeTLS(srv *http.Server, lc *net.ListenConfig, lim *rate.Limiter) error {
 	ln, err := lc.Listen(context.Background(), "tcp", cmp.Or(srv.Addr, ":https"))
 	if err != nil {
 		return err
 	}
-	rln := newRateLimitedListener(ln, rate.Limit(*acceptConnLimit), *acceptConnBurst)
+	rln := newRateLimitedListener(ln, lim)
 	expvar.Publish("tls_listener", rln.ExpVar())
 	defer rln.Close()
 	return srv.ServeTLS(rln, "", "")
@@ -477,8 +525,8 @@ type rateLimitedListener struct {
 	lim *rate.Limiter
 }
 
-func newRateLimitedListener(ln net.Listener, limit rate.Limit, burst int) *rateLimitedListener {
-	return &rateLimitedListener{Listener: ln, lim: rate.NewLimiter(limit, burst)}
+func newRateLimitedListener(ln net.Listener, lim *rate.Limiter) *rateLimitedListener {
+	return &rateLimitedListener{Listener: ln, lim: lim}
 }
 
 func (l *rateLimitedListener) ExpVar() expvar.Var {
@@ -572,6 +620,23 @@ type templateData struct {
 </html>
 `))
 
+// loadRateLimits reads the rate limits in the JSON file fname, as
+// given by the --rate-limits flag.
+func loadRateLimits(fname string) (derpserver.RateLimits, error) {
+	var limits derpserver.RateLimits
+	f, err := os.Open(fname)
+	if err != nil {
+		return limits, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&limits); err != nil {
+		return limits, fmt.Errorf("parsing %s: %w", fname, err)
+	}
+	return limits, nil
+}
+
 // getHomeHandler returns a handler for the home page based on a flag string
 // as documented on the --home flag.
 func getHomeHandler(val string) (_ http.Handler, ok bool) {
@@ -4,54 +4,263 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/derp/derpserver"
 	"tailscale.com/net/netmon"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/set"
 )
 
-func startMesh(s *derpserver.Server) error {
-	if *meshWith == "" {
-		return nil
+// meshConfigInterval is how often the --mesh-config file is re-read.
+const meshConfigInterval = 5 * time.Second
+
+// startMesh starts meshing with the hosts of --mesh-with, and with those
+// discovered through --mesh-config, --mesh-dns and --mesh-url as they come
+// and go. It returns nil if meshing isn't configured.
+func startMesh(s *derpserver.Server) (*meshMembership, error) {
+	m := &meshMembership{
+		s:     s,
+		logf:  log.Printf,
+		peers: map[string]*meshPeer{},
+	}
+	if *meshWith != "" {
+		m.static = strings.Split(*meshWith, ",")
+		for _, hostTuple := range m.static {
+			if _, _, err := parseHostTuple(hostTuple); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if *meshConfig != "" {
+		m.sources = append(m.sources, newMeshFileSource(*meshConfig))
+	}
+	if *meshDNS != "" {
+		m.sources = append(m.sources, newMeshDNSSource(*meshDNS, net.DefaultResolver, *meshPollInterval))
+	}
+	if *meshURL != "" {
+		m.sources = append(m.sources, newMeshURLSource(*meshURL, http.DefaultClient, *meshPollInterval))
+	}
+	if len(m.static) == 0 && len(m.sources) == 0 {
+		return nil, nil
 	}
 	if !s.HasMeshKey() {
-		return errors.New("--mesh-with requires --mesh-psk-file")
+		return nil, errors.New("--mesh-with, --mesh-config, --mesh-dns and --mesh-url require --mesh-psk-file")
 	}
-	for _, hostTuple := range strings.Split(*meshWith, ",") {
-		if err := startMeshWithHost(s, hostTuple); err != nil {
-			return err
-		}
+
+	m.mu.Lock()
+	m.updateLocked()
+	m.mu.Unlock()
+	for _, src := range m.sources {
+		go m.watch(context.Background(), src)
 	}
-	return nil
+	return m, nil
 }
 
-func startMeshWithHost(s *derpserver.Server, hostTuple string) error {
-	var host string
-	var dialHost string
+// parseHostTuple parses a host in the --mesh-with format: a hostname,
+// optionally followed by a slash and a hostname to dial instead.
+func parseHostTuple(hostTuple string) (host, dialHost string, err error) {
 	hostParts := strings.Split(hostTuple, "/")
 	if len(hostParts) > 2 {
-		return fmt.Errorf("too many components in host tuple %q", hostTuple)
+		return "", "", fmt.Errorf("too many components in host tuple %q", hostTuple)
 	}
 	host = hostParts[0]
+	if host == "" {
+		return "", "", fmt.Errorf("empty host in host tuple %q", hostTuple)
+	}
 	if len(hostParts) == 2 {
 		dialHost = hostParts[1]
 	} else {
 		dialHost = hostParts[0]
 	}
+	return host, dialHost, nil
+}
+
+// meshMembership is the set of mesh peers of a server: the static ones of
+// --mesh-with, and those of its dynamic sources.
+type meshMembership struct {
+	s       *derpserver.Server
+	logf    logger.Logf
+	static  []string
+	sources []*meshSource
+
+	mu    sync.Mutex
+	peers map[string]*meshPeer // by host tuple
+}
+
+// A meshSource is a dynamic source of mesh peers.
+type meshSource struct {
+	name     string // like "dns:derp.example.com"
+	interval time.Duration
+	fetch    func(context.Context) ([]string, error) // returns host tuples
+
+	// The rest are guarded by meshMembership.mu.
+	hosts    []string // as of the last successful fetch
+	lastPoll time.Time
+	lastOK   time.Time
+	lastErr  error
+}
+
+// watch polls src until ctx is done, updating the mesh peers as its hosts
+// change.
+func (m *meshMembership) watch(ctx context.Context, src *meshSource) {
+	for {
+		m.poll(ctx, src)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(src.interval):
+		}
+	}
+}
+
+// poll fetches the hosts of src and updates the mesh peers. If the fetch
+// fails, the hosts of the previous one are kept, so that a flaky source
+// doesn't break up the mesh.
+func (m *meshMembership) poll(ctx context.Context, src *meshSource) {
+	hosts, err := src.fetch(ctx)
+	if err == nil {
+		for _, hostTuple := range hosts {
+			if _, _, err = parseHostTuple(hostTuple); err != nil {
+				break
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	src.lastPoll = time.Now()
+	if err != nil {
+		if src.lastErr == nil {
+			m.logf("mesh: %s: %v", src.name, err)
+		}
+		src.lastErr = err
+		return
+	}
+	if src.lastErr != nil {
+		m.logf("mesh: %s: recovered", src.name)
+	}
+	src.lastErr = nil
+	src.lastOK = src.lastPoll
+	src.hosts = hosts
+	m.updateLocked()
+}
+
+// updateLocked starts meshing with the hosts that were added to the static
+// list or any source, and stops meshing with those that were removed from
+// all of them.
+func (m *meshMembership) updateLocked() {
+	want := set.SetOf(m.static)
+	for _, src := range m.sources {
+		want.AddSlice(src.hosts)
+	}
+	for hostTuple, p := range m.peers {
+		if !want.Contains(hostTuple) {
+			m.logf("mesh: removing %q", hostTuple)
+			p.stop()
+			delete(m.peers, hostTuple)
+		}
+	}
+	for hostTuple := range want {
+		if _, ok := m.peers[hostTuple]; ok {
+			continue
+		}
+		p, err := startMeshWithHost(m.s, hostTuple)
+		if err != nil {
+			m.logf("mesh: adding %q: %v", hostTuple, err)
+			continue
+		}
+		m.logf("mesh: added %q", hostTuple)
+		m.peers[hostTuple] = p
+	}
+}
+
+// ServeHTTP serves the mesh membership debug page: the peers, and the
+// health of the sources they're discovered from.
+func (m *meshMembership) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	fmt.Fprintf(w, "Static: %s\n\n", strings.Join(m.static, ","))
+	for _, src := range m.sources {
+		fmt.Fprintf(w, "Source %s: %d hosts", src.name, len(src.hosts))
+		if !src.lastOK.IsZero() {
+			fmt.Fprintf(w, ", updated %v ago", time.Since(src.lastOK).Round(time.Second))
+		}
+		if src.lastErr != nil {
+			fmt.Fprintf(w, ", failing: %v", src.lastErr)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "\n%d peers:\n", len(m.peers))
+	for _, hostTuple := range slices.Sorted(maps.Keys(m.peers)) {
+		p := m.peers[hostTuple]
+		n, lastErr, lastErrAt := p.status()
+		fmt.Fprintf(w, "%s: server %s, %d clients, up %v", hostTuple, p.c.ServerPublicKey().ShortString(), n, time.Since(p.since).Round(time.Second))
+		if lastErr != nil {
+			fmt.Fprintf(w, ", last error %v ago: %v", time.Since(lastErrAt).Round(time.Second), lastErr)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// meshPeer is a mesh peer the server forwards packets to.
+type meshPeer struct {
+	c      *derphttp.Client
+	cancel context.CancelFunc
+	since  time.Time
+
+	mu        sync.Mutex
+	clients   set.Set[key.NodePublic] // connected to the peer
+	lastErr   error
+	lastErrAt time.Time
+}
+
+// stop stops meshing with p. Closing its client makes its watch loop
+// remove the packet forwarders it added before it returns.
+func (p *meshPeer) stop() {
+	p.cancel()
+	p.c.Close()
+}
+
+func (p *meshPeer) status() (clients int, lastErr error, lastErrAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients), p.lastErr, p.lastErrAt
+}
+
+func startMeshWithHost(s *derpserver.Server, hostTuple string) (*meshPeer, error) {
+	host, dialHost, err := parseHostTuple(hostTuple)
+	if err != nil {
+		return nil, err
+	}
 
 	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
 	netMon := netmon.NewStatic() // good enough for cmd/derper; no need for netns fanciness
 	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf, netMon)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c.MeshKey = s.MeshKey()
 	c.WatchConnectionChanges = true
@@ -71,9 +280,125 @@ func startMeshWithHost(s *derpserver.Server, hostTuple string) error {
 		})
 	}
 
-	add := func(m derp.PeerPresentMessage) { s.AddPacketForwarder(m.Key, c) }
-	remove := func(m derp.PeerGoneMessage) { s.RemovePacketForwarder(m.Peer, c) }
-	notifyError := func(err error) {}
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove, notifyError)
-	return nil
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &meshPeer{
+		c:       c,
+		cancel:  cancel,
+		since:   time.Now(),
+		clients: set.Set[key.NodePublic]{},
+	}
+	add := func(m derp.PeerPresentMessage) {
+		s.AddPacketForwarder(m.Key, c)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.clients.Add(m.Key)
+	}
+	remove := func(m derp.PeerGoneMessage) {
+		s.RemovePacketForwarder(m.Peer, c)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.clients.Delete(m.Peer)
+	}
+	notifyError := func(err error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.lastErr, p.lastErrAt = err, time.Now()
+	}
+	go c.RunWatchConnectionLoop(ctx, s.PublicKey(), logf, add, remove, notifyError)
+	return p, nil
+}
+
+// newMeshFileSource returns a source of the hosts listed in the file at
+// path, one per line in the --mesh-with format. Blank lines and lines
+// starting with "#" are ignored.
+func newMeshFileSource(path string) *meshSource {
+	return &meshSource{
+		name:     "file:" + path,
+		interval: meshConfigInterval,
+		fetch: func(context.Context) ([]string, error) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			var hosts []string
+			for sc := bufio.NewScanner(bytes.NewReader(b)); sc.Scan(); {
+				line := strings.TrimSpace(sc.Text())
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				hosts = append(hosts, line)
+			}
+			return hosts, nil
+		},
+	}
+}
+
+// newMeshDNSSource returns a source of the hosts found by looking up name.
+//
+// If name starts with an underscore, like "_derp._tcp.example.com", it's
+// an SRV record set of the hosts' names and ports. Otherwise it's an A and
+// AAAA record set of their IP addresses, which are dialed with name as
+// their hostname, so their certificates must be valid for it.
+func newMeshDNSSource(name string, r *net.Resolver, interval time.Duration) *meshSource {
+	return &meshSource{
+		name:     "dns:" + name,
+		interval: interval,
+		fetch: func(ctx context.Context) ([]string, error) {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			var hosts []string
+			if strings.HasPrefix(name, "_") {
+				_, srvs, err := r.LookupSRV(ctx, "", "", name)
+				if err != nil {
+					return nil, err
+				}
+				for _, srv := range srvs {
+					host := strings.TrimSuffix(srv.Target, ".")
+					if srv.Port != 443 {
+						host = net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+					}
+					hosts = append(hosts, host)
+				}
+				return hosts, nil
+			}
+			ips, err := r.LookupHost(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				hosts = append(hosts, name+"/"+ip)
+			}
+			return hosts, nil
+		},
+	}
+}
+
+// newMeshURLSource returns a source of the hosts returned by a GET of url,
+// as a JSON array of strings in the --mesh-with format.
+func newMeshURLSource(url string, hc *http.Client, interval time.Duration) *meshSource {
+	return &meshSource{
+		name:     "url:" + url,
+		interval: interval,
+		fetch: func(ctx context.Context) ([]string, error) {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				return nil, err
+			}
+			res, err := hc.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("unexpected status %v", res.Status)
+			}
+			var hosts []string
+			if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&hosts); err != nil {
+				return nil, err
+			}
+			return hosts, nil
+		},
+	}
 }
@@ -0,0 +1,131 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"tailscale.com/derp/derpserver"
+	"tailscale.com/types/key"
+)
+
+const testMeshKey = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestMeshFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mesh")
+	src := newMeshFileSource(path)
+	if _, err := src.fetch(context.Background()); err == nil {
+		t.Error("missing file: unexpected success")
+	}
+	if err := os.WriteFile(path, []byte("# Region 1.\nderp1a.example.com\n\n  derp1b.example.com/10.0.0.2  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := src.fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"derp1a.example.com", "derp1b.example.com/10.0.0.2"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("hosts = %q, want %q", hosts, want)
+	}
+}
+
+func TestMeshURLSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/members" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`["derp1a.example.com", "derp1b.example.com"]`))
+	}))
+	defer ts.Close()
+
+	hosts, err := newMeshURLSource(ts.URL+"/members", ts.Client(), 0).fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"derp1a.example.com", "derp1b.example.com"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("hosts = %q, want %q", hosts, want)
+	}
+	if _, err := newMeshURLSource(ts.URL+"/other", ts.Client(), 0).fetch(context.Background()); err == nil {
+		t.Error("404: unexpected success")
+	}
+}
+
+func TestMeshMembership(t *testing.T) {
+	s := derpserver.New(key.NewNode(), t.Logf)
+	defer s.Close()
+	if err := s.SetMeshKey(testMeshKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+	var fetchErr error
+	src := &meshSource{
+		name: "test",
+		fetch: func(context.Context) ([]string, error) {
+			return hosts, fetchErr
+		},
+	}
+	m := &meshMembership{
+		s:       s,
+		logf:    t.Logf,
+		static:  []string{"127.0.0.1:1"},
+		sources: []*meshSource{src},
+		peers:   map[string]*meshPeer{},
+	}
+	defer func() {
+		for _, p := range m.peers {
+			p.stop()
+		}
+	}()
+	wantPeers := func(want ...string) {
+		t.Helper()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if got := slices.Sorted(maps.Keys(m.peers)); !reflect.DeepEqual(got, want) {
+			t.Errorf("peers = %q, want %q", got, want)
+		}
+	}
+
+	hosts = []string{"127.0.0.1:2", "127.0.0.1:3"}
+	m.poll(context.Background(), src)
+	wantPeers("127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+
+	m.mu.Lock()
+	p2 := m.peers["127.0.0.1:2"]
+	m.mu.Unlock()
+	hosts = []string{"127.0.0.1:1", "127.0.0.1:3"}
+	m.poll(context.Background(), src)
+	wantPeers("127.0.0.1:1", "127.0.0.1:3")
+	if p2.c.Close() == nil {
+		t.Error("removed peer's client wasn't closed")
+	}
+
+	// Failures keep the last hosts.
+	hosts, fetchErr = nil, errors.New("unreachable")
+	m.poll(context.Background(), src)
+	wantPeers("127.0.0.1:1", "127.0.0.1:3")
+	if src.lastErr == nil {
+		t.Error("lastErr not set")
+	}
+	hosts, fetchErr = []string{"a/b/c"}, nil
+	m.poll(context.Background(), src)
+	wantPeers("127.0.0.1:1", "127.0.0.1:3")
+
+	hosts = nil
+	m.poll(context.Background(), src)
+	wantPeers("127.0.0.1:1")
+	if src.lastErr != nil {
+		t.Errorf("lastErr = %v after recovery", src.lastErr)
+	}
+}
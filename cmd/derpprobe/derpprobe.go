@@ -44,6 +44,7 @@ func defaultSetecCacheDir() string {
 	meshInterval       = flag.Duration("mesh-interval", 15*time.Second, "mesh probe interval")
 	stunInterval       = flag.Duration("stun-interval", 15*time.Second, "STUN probe interval")
 	tlsInterval        = flag.Duration("tls-interval", 15*time.Second, "TLS probe interval")
+	quicInterval       = flag.Duration("quic-interval", 0, "QUIC probe interval, for DERP servers with a QUIC port (0 = no QUIC probing)")
 	bwInterval         = flag.Duration("bw-interval", 0, "bandwidth probe interval (0 = no bandwidth probing)")
 	bwSize             = flag.Int64("bw-probe-size-bytes", 1_000_000, "bandwidth probe size")
 	bwTUNIPv4Address   = flag.String("bw-tun-ipv4-addr", "", "if specified, bandwidth probes will be performed over a TUN device at this address in order to exercise TCP-in-TCP in similar fashion to TCP over Tailscale via DERP; we will use a /30 subnet including this IP address")
@@ -72,6 +73,7 @@ func main() {
 		prober.WithMeshProbing(*meshInterval),
 		prober.WithSTUNProbing(*stunInterval),
 		prober.WithTLSProbing(*tlsInterval),
+		prober.WithQUICProbing(*quicInterval),
 		prober.WithQueuingDelayProbing(*qdPacketsPerSecond, *qdPacketTimeout),
 		prober.WithMeshKey(meshKey),
 	}
@@ -1,10 +1,12 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-// netlogfmt parses a stream of JSON log messages from stdin and
-// formats the network traffic logs produced by "tailscale.com/wgengine/netlog"
-// according to the schema in "tailscale.com/types/netlogtype.Message"
-// in a more humanly readable format.
+// netlogfmt parses a stream of JSON log messages from the named files
+// (or stdin, if none) and formats the network traffic logs produced by
+// "tailscale.com/wgengine/netlog" according to the schema in
+// "tailscale.com/types/netlogtype.Message" in a more humanly readable format.
+// This includes the JSON lines files written by
+// "tailscaled --netlog-export=jsonl:<path>".
 //
 // Example usage:
 //
@@ -66,17 +68,28 @@ func main() {
 	// The logic handles a stream of arbitrary JSON.
 	// So long as a JSON object seems like a network log message,
 	// then this will unmarshal and print it.
-	if err := processStream(os.Stdin); err != nil {
-		if err == io.EOF {
-			return
+	if flag.NArg() == 0 {
+		if err := processStream(os.Stdin); err != nil && err != io.EOF {
+			log.Fatalf("processStream: %v", err)
+		}
+		return
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = processStream(f)
+		f.Close()
+		if err != nil && err != io.EOF {
+			log.Fatalf("processStream(%q): %v", name, err)
 		}
-		log.Fatalf("processStream: %v", err)
 	}
 }
 
 func processStream(r io.Reader) (err error) {
 	defer try.Handle(&err)
-	dec := jsontext.NewDecoder(os.Stdin)
+	dec := jsontext.NewDecoder(r)
 	for {
 		processValue(dec)
 	}
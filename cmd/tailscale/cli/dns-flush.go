@@ -0,0 +1,38 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var dnsFlushCmd = &ffcli.Command{
+	Name:       "flush",
+	ShortUsage: "tailscale dns flush",
+	Exec:       runDNSFlush,
+	ShortHelp:  "Flush the DNS cache",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale dns flush' subcommand removes all responses of upstream
+resolvers cached by the internal DNS forwarder (100.100.100.100).
+
+The cache is also flushed automatically whenever the DNS routes change. It
+doesn't affect any cache of the operating system.
+`),
+}
+
+func runDNSFlush(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return flag.ErrHelp
+	}
+	if err := localClient.FlushDNSCache(ctx); err != nil {
+		return fmt.Errorf("failed to flush DNS cache: %w", err)
+	}
+	fmt.Println("Flushed the DNS cache.")
+	return nil
+}
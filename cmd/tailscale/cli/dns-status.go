@@ -10,6 +10,7 @@
 	"maps"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/ipn"
@@ -18,7 +19,7 @@
 
 var dnsStatusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "tailscale dns status [--all]",
+	ShortUsage: "tailscale dns status [--all] [--queries]",
 	Exec:       runDNSStatus,
 	ShortHelp:  "Print the current DNS status and configuration",
 	LongHelp: strings.TrimSpace(`
@@ -36,6 +37,10 @@
 fallback resolvers, nameservers, certificate domains, extra records, and the
 exit node filtered set.
 
+The --queries flag additionally outputs the names each client of the built-in
+DNS resolver queried most. These statistics are only kept while tailscaled is
+logging DNS queries (see its --dns-query-log flag).
+
 === Contents of the MagicDNS configuration ===
 
 The MagicDNS configuration is provided by the coordination server to the client
@@ -72,13 +77,15 @@
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("status")
 		fs.BoolVar(&dnsStatusArgs.all, "all", false, "outputs advanced debugging information")
+		fs.BoolVar(&dnsStatusArgs.queries, "queries", false, "outputs the names each client queried most")
 		return fs
 	})(),
 }
 
 // dnsStatusArgs are the arguments for the "dns status" subcommand.
 var dnsStatusArgs struct {
-	all bool
+	all     bool
+	queries bool
 }
 
 func runDNSStatus(ctx context.Context, args []string) error {
@@ -251,10 +258,42 @@ func runDNSStatus(ctx context.Context, args []string) error {
 		}
 	}
 	fmt.Print("\n")
+	if dnsStatusArgs.queries {
+		printDNSQueryStats(ctx)
+	}
 	fmt.Println("[this is a preliminary version of this command; the output format may change in the future]")
 	return nil
 }
 
+// printDNSQueryStats prints the names each client of the built-in DNS
+// resolver queried most.
+func printDNSQueryStats(ctx context.Context) {
+	fmt.Println("=== DNS queries by client ===")
+	fmt.Print("\n")
+	stats, err := localClient.DNSQueryStats(ctx, 10)
+	if err != nil {
+		fmt.Printf("  (failed to get DNS query statistics: %v)\n", err)
+		fmt.Print("\n")
+		return
+	}
+	if len(stats) == 0 {
+		fmt.Println("  (no queries yet)")
+		fmt.Print("\n")
+		return
+	}
+	for _, cs := range stats {
+		client := cs.Client.String()
+		if cs.Node != "" {
+			client = fmt.Sprintf("%s (%s)", cs.Node, cs.Client)
+		}
+		fmt.Printf("%s: %d queries, last %v ago\n", client, cs.Queries, time.Since(cs.LastQuery).Round(time.Second))
+		for _, nc := range cs.TopNames {
+			fmt.Printf("  %8d  %s\n", nc.Count, nc.Name)
+		}
+		fmt.Print("\n")
+	}
+}
+
 func fetchNetMap() (netMap *netmap.NetworkMap, err error) {
 	w, err := localClient.WatchIPNBus(context.Background(), ipn.NotifyInitialNetMap)
 	if err != nil {
@@ -22,11 +22,13 @@
 	ShortUsage: strings.Join([]string{
 		dnsStatusCmd.ShortUsage,
 		dnsQueryCmd.ShortUsage,
+		dnsFlushCmd.ShortUsage,
 	}, "\n"),
 	UsageFunc: usageFuncNoDefaultValues,
 	Subcommands: []*ffcli.Command{
 		dnsStatusCmd,
 		dnsQueryCmd,
+		dnsFlushCmd,
 
 		// TODO: implement `tailscale log` here
 
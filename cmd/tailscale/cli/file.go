@@ -12,6 +12,7 @@
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
 	"net/http"
@@ -69,7 +70,7 @@ func (c *countingReader) Read(buf []byte) (int, error) {
 
 var fileCpCmd = &ffcli.Command{
 	Name:       "cp",
-	ShortUsage: "tailscale file cp <files...> <target>:",
+	ShortUsage: "tailscale file cp [-r] <files...> <target>:",
 	ShortHelp:  "Copy file(s) to a host",
 	Exec:       runCp,
 	FlagSet: (func() *flag.FlagSet {
@@ -77,14 +78,16 @@ func (c *countingReader) Read(buf []byte) (int, error) {
 		fs.StringVar(&cpArgs.name, "name", "", "alternate filename to use, especially useful when <file> is \"-\" (stdin)")
 		fs.BoolVar(&cpArgs.verbose, "verbose", false, "verbose output")
 		fs.BoolVar(&cpArgs.targets, "targets", false, "list possible file cp targets")
+		fs.BoolVar(&cpArgs.recursive, "r", false, "copy directories and their contents")
 		return fs
 	})(),
 }
 
 var cpArgs struct {
-	name    string
-	verbose bool
-	targets bool
+	name      string
+	verbose   bool
+	targets   bool
+	recursive bool
 }
 
 func runCp(ctx context.Context, args []string) error {
@@ -159,7 +162,13 @@ func runCp(ctx context.Context, args []string) error {
 				return err
 			}
 			if fi.IsDir() {
-				return errors.New("directories not supported")
+				if !cpArgs.recursive {
+					return fmt.Errorf("%s is a directory; use -r to send directories", fileArg)
+				}
+				if err := sendDir(ctx, fileArg, target, ip, stableID); err != nil {
+					return err
+				}
+				continue
 			}
 			contentLength = fi.Size()
 			fileContents = &countingReader{Reader: io.LimitReader(f, contentLength)}
@@ -196,6 +205,111 @@ func runCp(ctx context.Context, args []string) error {
 	return nil
 }
 
+// sendDir sends the directory tree at dir to the peer stableID, which is
+// the target with Tailscale IP ip.
+func sendDir(ctx context.Context, dir, target, ip string, stableID tailcfg.StableNodeID) error {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	name := cpArgs.name
+	if name == "" {
+		name = filepath.Base(dir)
+	}
+	manifest, files, err := dirManifest(dir, name)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range manifest.Entries {
+		total += e.Size
+	}
+
+	if cpArgs.verbose {
+		log.Printf("sending directory %q (%d entries, %d bytes) to %v/%v/%v ...", name, len(manifest.Entries), total, target, ip, stableID)
+	}
+
+	// Files are opened one at a time, in order, so they can all count
+	// their progress with the same reader.
+	contents := new(countingReader)
+	open := func(path string) (io.ReadCloser, error) {
+		f, err := os.Open(files[path].localPath)
+		if err != nil {
+			return nil, err
+		}
+		contents.Reader = io.LimitReader(f, files[path].size)
+		return struct {
+			io.Reader
+			io.Closer
+		}{contents, f}, nil
+	}
+
+	var group sync.WaitGroup
+	ctxProgress, cancelProgress := context.WithCancel(ctx)
+	defer cancelProgress()
+	if isatty.IsTerminal(os.Stderr.Fd()) {
+		group.Go(func() { progressPrinter(ctxProgress, name+"/", contents.n.Load, total) })
+	}
+
+	err = localClient.PushDir(ctx, stableID, manifest, open)
+	cancelProgress()
+	group.Wait() // wait for progress printer to stop before reporting the error
+	if err != nil {
+		return err
+	}
+	if cpArgs.verbose {
+		log.Printf("sent directory %q", name)
+	}
+	return nil
+}
+
+// localFile is a regular file in a Taildrop manifest.
+type localFile struct {
+	localPath string
+	size      int64
+}
+
+// dirManifest walks the directory tree at dir, and returns its Taildrop
+// manifest with root as the name of the root directory, along with the
+// local files of its regular files, by path. Symlinks and other special
+// files are skipped with a warning.
+func dirManifest(dir, root string) (*apitype.TaildropManifest, map[string]localFile, error) {
+	manifest := new(apitype.TaildropManifest)
+	files := make(map[string]localFile)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			fmt.Fprintf(Stderr, "# skipping %s: not a regular file or directory\n", p)
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := apitype.TaildropEntry{
+			Path:    path.Join(root, filepath.ToSlash(rel)),
+			Mode:    fi.Mode() & (fs.ModeDir | fs.ModePerm),
+			ModTime: fi.ModTime(),
+		}
+		if fi.Mode().IsRegular() {
+			e.Size = fi.Size()
+			files[e.Path] = localFile{p, e.Size}
+		}
+		manifest.Entries = append(manifest.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, files, nil
+}
+
 func progressPrinter(ctx context.Context, name string, contentCount func() int64, contentLength int64) {
 	var rateValueFast, rateValueSlow tsrate.Value
 	rateValueFast.HalfLife = 1 * time.Second  // fast response for rate measurement
@@ -526,6 +640,15 @@ func receiveFile(ctx context.Context, wf apitype.WaitingFile, dir string) (targe
 		return "", 0, fmt.Errorf("opening inbox file %q: %w", wf.Name, err)
 	}
 	defer rc.Close()
+	if name := filepath.FromSlash(wf.Name); name != filepath.Base(name) {
+		// A file of a received directory tree.
+		if !filepath.IsLocal(name) {
+			return "", 0, fmt.Errorf("invalid inbox file name %q", wf.Name)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			return "", 0, err
+		}
+	}
 	f, err := openFileOrSubstitute(dir, wf.Name, getArgs.conflict)
 	if err != nil {
 		return "", 0, err
@@ -6,6 +6,7 @@
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -40,23 +41,69 @@
 	Name:       "netcheck",
 	ShortUsage: "tailscale netcheck",
 	ShortHelp:  "Print an analysis of local network conditions",
-	Exec:       runNetcheck,
+	LongHelp: strings.TrimSpace(`
+The 'tailscale netcheck' command prints an analysis of local network
+conditions: UDP connectivity, the public addresses and NAT behavior
+seen by DERP servers, port mapping services and DERP latencies.
+
+To diagnose intermittent problems, use --every to run it periodically
+and --history to record the reports in a file; the human-readable
+output then lists what changed since the previous report.
+'tailscale netcheck --history=FILE --summary' later summarizes the
+recorded reports: how often UDP was blocked, the NAT mapping varied
+by destination and the preferred DERP region changed, and when.
+
+A report saved with --format=json can be used as a --baseline to
+compare new reports against.
+`),
+	Exec: runNetcheck,
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("netcheck")
 		fs.StringVar(&netcheckArgs.format, "format", "", `output format; empty (for human-readable), "json" or "json-line"`)
 		fs.DurationVar(&netcheckArgs.every, "every", 0, "if non-zero, do an incremental report with the given frequency")
 		fs.BoolVar(&netcheckArgs.verbose, "verbose", false, "verbose logs")
+		fs.StringVar(&netcheckArgs.history, "history", "", "if non-empty, a file to record reports in, as lines of JSON")
+		fs.IntVar(&netcheckArgs.historySize, "history-size", 1440, "number of reports to keep in the --history file")
+		fs.StringVar(&netcheckArgs.baseline, "baseline", "", "if non-empty, a report saved with --format=json to compare reports against")
+		fs.BoolVar(&netcheckArgs.summary, "summary", false, "summarize the reports in the --history file instead of running a netcheck")
 		return fs
 	})(),
 }
 
 var netcheckArgs struct {
-	format  string
-	every   time.Duration
-	verbose bool
+	format      string
+	every       time.Duration
+	verbose     bool
+	history     string
+	historySize int
+	baseline    string
+	summary     bool
 }
 
 func runNetcheck(ctx context.Context, args []string) error {
+	var hist *netcheckHistory
+	if netcheckArgs.history != "" {
+		var err error
+		hist, err = openNetcheckHistory(netcheckArgs.history, netcheckArgs.historySize)
+		if err != nil {
+			return err
+		}
+	}
+	if netcheckArgs.summary {
+		if hist == nil {
+			return errors.New("--summary requires --history")
+		}
+		return runNetcheckSummary(ctx, hist)
+	}
+	var baseline *netcheck.Report
+	if netcheckArgs.baseline != "" {
+		var err error
+		baseline, err = readNetcheckReport(netcheckArgs.baseline)
+		if err != nil {
+			return err
+		}
+	}
+
 	logf := logger.WithPrefix(log.Printf, "portmap: ")
 	bus := eventbus.New()
 	defer bus.Close()
@@ -93,21 +140,14 @@ func runNetcheck(ctx context.Context, args []string) error {
 		fmt.Fprintln(Stderr, "netcheck: UDP test failure:", err)
 	}
 
-	dm, err := localClient.CurrentDERPMap(ctx)
-	noRegions := dm != nil && len(dm.Regions) == 0
-	if noRegions {
-		log.Printf("No DERP map from tailscaled; using default.")
+	dm, err := netcheckDERPMap(ctx)
+	if err != nil {
+		log.Println("Failed to fetch a DERP map, so netcheck cannot continue. Check your Internet connection.")
+		return err
 	}
-	if err != nil || noRegions {
-		hc := &http.Client{
-			Transport: tlsdial.NewTransport(),
-			Timeout:   10 * time.Second,
-		}
-		dm, err = prodDERPMap(ctx, hc)
-		if err != nil {
-			log.Println("Failed to fetch a DERP map, so netcheck cannot continue. Check your Internet connection.")
-			return err
-		}
+	var prev *netcheck.Report
+	if hist != nil {
+		prev = hist.last()
 	}
 	for {
 		t0 := time.Now()
@@ -122,6 +162,18 @@ func runNetcheck(ctx context.Context, args []string) error {
 		if err := printReport(dm, report); err != nil {
 			return err
 		}
+		if netcheckArgs.format == "" {
+			printChanges("Changes since the previous report", reportChanges(dm, prev, report), false)
+			if baseline != nil {
+				printChanges("Changes from the baseline", reportChanges(dm, baseline, report), true)
+			}
+		}
+		if hist != nil {
+			if err := hist.add(report); err != nil {
+				return fmt.Errorf("recording report: %w", err)
+			}
+		}
+		prev = report
 		if netcheckArgs.every == 0 {
 			return nil
 		}
@@ -129,6 +181,56 @@ func runNetcheck(ctx context.Context, args []string) error {
 	}
 }
 
+// netcheckDERPMap returns the DERP map of tailscaled, or the default one if
+// tailscaled isn't running or has none.
+func netcheckDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	dm, err := localClient.CurrentDERPMap(ctx)
+	noRegions := dm != nil && len(dm.Regions) == 0
+	if noRegions {
+		log.Printf("No DERP map from tailscaled; using default.")
+	}
+	if err == nil && !noRegions {
+		return dm, nil
+	}
+	hc := &http.Client{
+		Transport: tlsdial.NewTransport(),
+		Timeout:   10 * time.Second,
+	}
+	return prodDERPMap(ctx, hc)
+}
+
+// runNetcheckSummary prints a summary of the reports in hist.
+func runNetcheckSummary(ctx context.Context, hist *netcheckHistory) error {
+	reports, err := hist.reports()
+	if err != nil {
+		return err
+	}
+	// The DERP map is only used to name regions, so do without it if
+	// it's unavailable.
+	dm, err := netcheckDERPMap(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch a DERP map; showing region IDs: %v", err)
+	}
+	s := summarizeNetcheck(dm, reports)
+	var j []byte
+	switch netcheckArgs.format {
+	case "":
+		printSummary(s)
+		return nil
+	case "json":
+		j, err = json.MarshalIndent(s, "", "\t")
+	case "json-line":
+		j, err = json.Marshal(s)
+	default:
+		return fmt.Errorf("unknown output format %q", netcheckArgs.format)
+	}
+	if err != nil {
+		return err
+	}
+	Stdout.Write(append(j, '\n'))
+	return nil
+}
+
 func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	var j []byte
 	var err error
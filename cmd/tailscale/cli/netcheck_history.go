@@ -0,0 +1,282 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+)
+
+// netcheckHistory is a file of the last netcheck reports, one JSON object
+// per line, as printed by --format=json-line.
+type netcheckHistory struct {
+	path  string
+	size  int      // maximum number of reports kept
+	lines [][]byte // reports in the file, oldest first
+}
+
+// openNetcheckHistory opens the history file at path, which is created on
+// the first report if it doesn't exist, and keeps the last size reports.
+func openNetcheckHistory(path string, size int) (*netcheckHistory, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid history size %d", size)
+	}
+	h := &netcheckHistory{path: path, size: size}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for line := range bytes.Lines(b) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			h.lines = append(h.lines, line)
+		}
+	}
+	return h, nil
+}
+
+// reports returns the reports in the history, oldest first.
+func (h *netcheckHistory) reports() ([]*netcheck.Report, error) {
+	var rs []*netcheck.Report
+	for i, line := range h.lines {
+		r := new(netcheck.Report)
+		if err := json.Unmarshal(line, r); err != nil {
+			return nil, fmt.Errorf("%s: report %d: %w", h.path, i+1, err)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// last returns the most recent report in the history, or nil if there's
+// none or it's unreadable.
+func (h *netcheckHistory) last() *netcheck.Report {
+	if len(h.lines) == 0 {
+		return nil
+	}
+	r := new(netcheck.Report)
+	if json.Unmarshal(h.lines[len(h.lines)-1], r) != nil {
+		return nil
+	}
+	return r
+}
+
+// add appends r to the history file, dropping the oldest reports if it's
+// full.
+func (h *netcheckHistory) add(r *netcheck.Report) error {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	h.lines = append(h.lines, j)
+	if len(h.lines) > h.size {
+		h.lines = slices.Clone(h.lines[len(h.lines)-h.size:])
+		var buf bytes.Buffer
+		for _, line := range h.lines {
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		return atomicfile.WriteFile(h.path, buf.Bytes(), 0644)
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(j, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readNetcheckReport reads a report saved with --format=json or
+// --format=json-line.
+func readNetcheckReport(path string) (*netcheck.Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := new(netcheck.Report)
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(r); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// netcheckChange is a change of a property of netcheck reports between
+// two reports.
+type netcheckChange struct {
+	Time     time.Time // of the report with the New value
+	Property string    // "UDP", "PreferredDERP", "MappingVariesByDestIP", etc.
+	Old      string
+	New      string
+}
+
+// reportChanges returns the changes from old to new of the properties of
+// reports that matter to connectivity. It returns nil if old is nil. dm,
+// which may be nil, is used to name DERP regions.
+func reportChanges(dm *tailcfg.DERPMap, old, new *netcheck.Report) []netcheckChange {
+	if old == nil {
+		return nil
+	}
+	var changes []netcheckChange
+	add := func(property, o, n string) {
+		if o != n {
+			changes = append(changes, netcheckChange{Time: new.Now, Property: property, Old: o, New: n})
+		}
+	}
+	add("UDP", strconv.FormatBool(old.UDP), strconv.FormatBool(new.UDP))
+	add("IPv4", strconv.FormatBool(old.IPv4), strconv.FormatBool(new.IPv4))
+	add("IPv6", strconv.FormatBool(old.IPv6), strconv.FormatBool(new.IPv6))
+	add("GlobalV4", globalAddr(old.GlobalV4.Addr()), globalAddr(new.GlobalV4.Addr()))
+	add("GlobalV6", globalAddr(old.GlobalV6.Addr()), globalAddr(new.GlobalV6.Addr()))
+	add("MappingVariesByDestIP", optBool(old.MappingVariesByDestIP), optBool(new.MappingVariesByDestIP))
+	add("PortMapping", cmp.Or(portMapping(old), "none"), cmp.Or(portMapping(new), "none"))
+	add("CaptivePortal", optBool(old.CaptivePortal), optBool(new.CaptivePortal))
+	add("PreferredDERP", regionLabel(dm, old.PreferredDERP), regionLabel(dm, new.PreferredDERP))
+	return changes
+}
+
+func globalAddr(a netip.Addr) string {
+	if !a.IsValid() {
+		return "none"
+	}
+	return a.String()
+}
+
+func optBool(b opt.Bool) string {
+	if v, ok := b.Get(); ok {
+		return strconv.FormatBool(v)
+	}
+	return "unknown"
+}
+
+// regionLabel returns the code of the DERP region with the given ID in dm,
+// falling back to the ID if dm is nil or doesn't have it.
+func regionLabel(dm *tailcfg.DERPMap, id int) string {
+	if id == 0 {
+		return "none"
+	}
+	if dm != nil {
+		if r, ok := dm.Regions[id]; ok && r.RegionCode != "" {
+			return r.RegionCode
+		}
+	}
+	return fmt.Sprintf("derp%d", id)
+}
+
+// printChanges prints the changes under the heading what, or "none" if
+// there are none and printNone is set.
+func printChanges(what string, changes []netcheckChange, printNone bool) {
+	if len(changes) == 0 && !printNone {
+		return
+	}
+	printf("\n%s:\n", what)
+	if len(changes) == 0 {
+		printf("\t* none\n")
+	}
+	for _, c := range changes {
+		printf("\t* %s: %s -> %s\n", c.Property, c.Old, c.New)
+	}
+}
+
+// netcheckSummary summarizes a history of netcheck reports.
+type netcheckSummary struct {
+	Reports int
+	First   time.Time // of the oldest report
+	Last    time.Time // of the newest report
+
+	UDPBlocked            int            // reports without a UDP STUN round trip
+	MappingVariesByDestIP int            // reports where MappingVariesByDestIP
+	PreferredDERP         map[string]int // region code (or "none") to reports preferring it
+	PreferredDERPChanges  int
+	GlobalV4              map[string]int // IPv4 address (or "none") to reports with it
+
+	// Changes are the changes between consecutive reports, oldest first.
+	Changes []netcheckChange
+}
+
+func summarizeNetcheck(dm *tailcfg.DERPMap, reports []*netcheck.Report) *netcheckSummary {
+	s := &netcheckSummary{
+		Reports:       len(reports),
+		PreferredDERP: map[string]int{},
+		GlobalV4:      map[string]int{},
+	}
+	for i, r := range reports {
+		if i == 0 {
+			s.First = r.Now
+		}
+		s.Last = r.Now
+		if !r.UDP {
+			s.UDPBlocked++
+		}
+		if r.MappingVariesByDestIP.EqualBool(true) {
+			s.MappingVariesByDestIP++
+		}
+		s.PreferredDERP[regionLabel(dm, r.PreferredDERP)]++
+		s.GlobalV4[globalAddr(r.GlobalV4.Addr())]++
+		if i > 0 {
+			for _, c := range reportChanges(dm, reports[i-1], r) {
+				if c.Property == "PreferredDERP" {
+					s.PreferredDERPChanges++
+				}
+				s.Changes = append(s.Changes, c)
+			}
+		}
+	}
+	return s
+}
+
+func printSummary(s *netcheckSummary) {
+	if s.Reports == 0 {
+		printf("No reports.\n")
+		return
+	}
+	printf("\nSummary of %d reports from %v to %v:\n", s.Reports, s.First.Format(time.RFC3339), s.Last.Format(time.RFC3339))
+	printf("\t* UDP blocked: %d reports\n", s.UDPBlocked)
+	printf("\t* MappingVariesByDestIP: %d reports\n", s.MappingVariesByDestIP)
+	printf("\t* Preferred DERP (%d changes): %s\n", s.PreferredDERPChanges, countsString(s.PreferredDERP))
+	printf("\t* IPv4: %s\n", countsString(s.GlobalV4))
+	if len(s.Changes) > 0 {
+		printf("\t* Changes:\n")
+		for _, c := range s.Changes {
+			printf("\t\t- %s: %s: %s -> %s\n", c.Time.Format(time.RFC3339), c.Property, c.Old, c.New)
+		}
+	}
+}
+
+// countsString formats counts as "k1 (n1), k2 (n2)", from the most to the
+// least frequent key.
+func countsString(counts map[string]int) string {
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b string) int {
+		return cmp.Or(counts[b]-counts[a], cmp.Compare(a, b))
+	})
+	var buf bytes.Buffer
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%s (%d)", k, counts[k])
+	}
+	return buf.String()
+}
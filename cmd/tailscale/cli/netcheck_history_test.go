@@ -0,0 +1,133 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+)
+
+func TestNetcheckHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	h, err := openNetcheckHistory(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.last() != nil {
+		t.Error("new history has a last report")
+	}
+	for i := range 5 {
+		if err := h.add(&netcheck.Report{Now: t0.Add(time.Duration(i) * time.Minute), PreferredDERP: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			// Reopening continues the history.
+			if h, err = openNetcheckHistory(path, 3); err != nil {
+				t.Fatal(err)
+			}
+			if got := h.last(); got == nil || got.PreferredDERP != 2 {
+				t.Fatalf("last report after reopening = %+v, want PreferredDERP 2", got)
+			}
+		}
+	}
+
+	h, err = openNetcheckHistory(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := h.reports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, r := range reports {
+		got = append(got, r.PreferredDERP)
+	}
+	if want := []int{3, 4, 5}; !cmp.Equal(got, want) {
+		t.Errorf("reports preferring %v, want %v", got, want)
+	}
+
+	if _, err := openNetcheckHistory(path, 0); err == nil {
+		t.Error("size 0: unexpected success")
+	}
+	if err := os.WriteFile(path, []byte("{}\nnot json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if h, err = openNetcheckHistory(path, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.reports(); err == nil {
+		t.Error("corrupt history: unexpected success")
+	}
+}
+
+func TestSummarizeNetcheck(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "nyc"},
+		2: {RegionID: 2, RegionCode: "sfo"},
+	}}
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	addr := netip.MustParseAddrPort("203.0.113.1:41641")
+	report := func(min int, udp bool, derp int, varies bool) *netcheck.Report {
+		r := &netcheck.Report{
+			Now:                   t0.Add(time.Duration(min) * time.Minute),
+			UDP:                   udp,
+			IPv4:                  udp,
+			PreferredDERP:         derp,
+			MappingVariesByDestIP: opt.NewBool(varies),
+		}
+		if udp {
+			r.GlobalV4 = addr
+		}
+		return r
+	}
+	reports := []*netcheck.Report{
+		report(0, true, 1, false),
+		report(1, true, 2, false),
+		report(2, false, 2, false),
+		report(3, true, 1, true),
+		report(4, true, 3, true),
+	}
+
+	got := summarizeNetcheck(dm, reports)
+	want := &netcheckSummary{
+		Reports:               5,
+		First:                 t0,
+		Last:                  t0.Add(4 * time.Minute),
+		UDPBlocked:            1,
+		MappingVariesByDestIP: 2,
+		PreferredDERP:         map[string]int{"nyc": 2, "sfo": 2, "derp3": 1},
+		PreferredDERPChanges:  3,
+		GlobalV4:              map[string]int{"203.0.113.1": 4, "none": 1},
+		Changes: []netcheckChange{
+			{t0.Add(1 * time.Minute), "PreferredDERP", "nyc", "sfo"},
+			{t0.Add(2 * time.Minute), "UDP", "true", "false"},
+			{t0.Add(2 * time.Minute), "IPv4", "true", "false"},
+			{t0.Add(2 * time.Minute), "GlobalV4", "203.0.113.1", "none"},
+			{t0.Add(3 * time.Minute), "UDP", "false", "true"},
+			{t0.Add(3 * time.Minute), "IPv4", "false", "true"},
+			{t0.Add(3 * time.Minute), "GlobalV4", "none", "203.0.113.1"},
+			{t0.Add(3 * time.Minute), "MappingVariesByDestIP", "false", "true"},
+			{t0.Add(3 * time.Minute), "PreferredDERP", "sfo", "nyc"},
+			{t0.Add(4 * time.Minute), "PreferredDERP", "nyc", "derp3"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("summary mismatch (-want +got):\n%s", diff)
+	}
+
+	if changes := reportChanges(dm, nil, reports[0]); changes != nil {
+		t.Errorf("changes from nil = %v, want none", changes)
+	}
+}
@@ -36,7 +36,7 @@ func init() {
 					ShortUsage: "tailscale syspolicy list",
 					Exec:       runSysPolicyList,
 					ShortHelp:  "Print effective policy settings",
-					LongHelp:   "The 'tailscale syspolicy list' subcommand displays the effective policy settings and their sources (e.g., MDM or environment variables).",
+					LongHelp:   "The 'tailscale syspolicy list' subcommand displays the effective policy settings and their sources (e.g., MDM, a policy file or environment variables).",
 					FlagSet: (func() *flag.FlagSet {
 						fs := newFlagSet("syspolicy list")
 						fs.BoolVar(&syspolicyArgs.json, "json", false, "output in JSON format")
@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+)
+
+func init() {
+	migrateStateFunc := migrateState // to be addressable
+	subCommands["migrate-state"] = &migrateStateFunc
+}
+
+// migrateState copies all state from one state store to another, such as
+// from a JSON state file to a "bolt:" database or back. tailscaled must
+// not be running while it runs.
+//
+// The --from and --to arguments take the same forms as tailscaled --state.
+func migrateState(args []string) error {
+	fs := flag.NewFlagSet("migrate-state", flag.ExitOnError)
+	from := fs.String("from", "", "state store to migrate from, in the same form as --state")
+	to := fs.String("to", "", "state store to migrate to, in the same form as --state")
+	force := fs.Bool("force", false, "overwrite existing keys in the destination store")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("unexpected non-flag arguments")
+	}
+	if *from == "" || *to == "" {
+		return errors.New("both --from and --to are required")
+	}
+	if *from == *to {
+		return errors.New("--from and --to must be different")
+	}
+
+	logf := log.Printf
+	src, err := store.New(logf, *from)
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", *from, err)
+	}
+	defer closeStore(src)
+	srcExp, ok := src.(store.ExportableStore)
+	if !ok {
+		return fmt.Errorf("%q does not support exporting its state", *from)
+	}
+	dst, err := store.New(logf, *to)
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", *to, err)
+	}
+	defer closeStore(dst)
+
+	if !*force {
+		if err := checkStoreEmpty(dst, srcExp); err != nil {
+			return fmt.Errorf("%q: %w", *to, err)
+		}
+	}
+	n, err := store.CopyAll(dst, srcExp)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no state found in %q", *from)
+	}
+	fmt.Printf("migrated %d keys from %s to %s\n", n, *from, *to)
+	return nil
+}
+
+// checkStoreEmpty returns an error if dst has any of the keys in src,
+// or, if it's exportable, any keys at all.
+func checkStoreEmpty(dst ipn.StateStore, src store.ExportableStore) error {
+	if dstExp, ok := dst.(store.ExportableStore); ok {
+		for k := range dstExp.All() {
+			return fmt.Errorf("destination already has state (key %q); use --force to overwrite", k)
+		}
+		return nil
+	}
+	var keys []ipn.StateKey
+	for k := range src.All() {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if _, err := dst.ReadState(k); err == nil {
+			return fmt.Errorf("destination already has key %q; use --force to overwrite", k)
+		}
+	}
+	return nil
+}
+
+func closeStore(s ipn.StateStore) {
+	if c, ok := s.(io.Closer); ok {
+		c.Close()
+	}
+}
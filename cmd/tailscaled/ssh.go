@@ -1,9 +1,33 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-//go:build (linux || darwin || freebsd || openbsd || plan9) && !ts_omit_ssh
+//go:build ((linux && !android) || (darwin && !ios) || freebsd || openbsd || plan9) && !ts_omit_ssh
 
 package main
 
-// Force registration of tailssh with LocalBackend.
-import _ "tailscale.com/ssh/tailssh"
+import (
+	"flag"
+
+	"tailscale.com/ssh/tailssh"
+)
+
+func init() {
+	hookRegisterSSHFlags.Set(registerSSHFlags)
+	hookConfigureSSH.Set(configureSSH)
+}
+
+func registerSSHFlags() {
+	flag.StringVar(&args.sshAuthzHook, "ssh-authz-hook", "", "optional local authorization hook for Tailscale SSH: the absolute path of an executable, or an http(s) URL, that can deny or restrict what the tailnet SSH policy accepts")
+	flag.DurationVar(&args.sshAuthzHookTimeout, "ssh-authz-hook-timeout", 0, "how long the --ssh-authz-hook may take to decide (default 5s)")
+	flag.BoolVar(&args.sshAuthzHookFailOpen, "ssh-authz-hook-fail-open", false, "allow SSH requests if the --ssh-authz-hook fails, rather than deny them")
+}
+
+// configureSSH passes the SSH flags to tailssh, which registers the SSH
+// server with LocalBackend.
+func configureSSH() {
+	tailssh.SetAuthzHookConfig(tailssh.AuthzHookConfig{
+		Hook:     args.sshAuthzHook,
+		Timeout:  args.sshAuthzHookTimeout,
+		FailOpen: args.sshAuthzHookFailOpen,
+	})
+}
@@ -0,0 +1,12 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build (ts_boltstore || (linux && !android)) && !ts_omit_boltstore
+
+package main
+
+import "tailscale.com/ipn/store/boltstore"
+
+func init() {
+	boltStatePrefix = boltstore.Prefix
+}
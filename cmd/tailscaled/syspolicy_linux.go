@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !android && !ts_omit_syspolicy
+
+package main
+
+import (
+	"cmp"
+	"log"
+
+	"tailscale.com/envknob"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/setting"
+	"tailscale.com/util/syspolicy/source"
+)
+
+// defaultPolicyFilePath is the default location of the device policy file on Linux.
+// It can be overridden with the TS_POLICY_FILE environment variable,
+// which can also be set to "none" to disable the file-based policy store.
+const defaultPolicyFilePath = "/etc/tailscale/policy.json"
+
+func init() {
+	hookRegisterPolicyFile.Set(registerPolicyFile)
+}
+
+// registerPolicyFile registers a file-based policy store for the device.
+//
+// On Linux, there's no OS-provided policy store like the Windows Registry
+// or macOS configuration profiles, so fleet management tools distribute
+// policy settings as files. The store picks up changes to the file without
+// restarting tailscaled.
+func registerPolicyFile() {
+	path := cmp.Or(envknob.String("TS_POLICY_FILE"), defaultPolicyFilePath)
+	if path == "none" {
+		return
+	}
+	// Use the file path as the source name, so that "tailscale syspolicy list"
+	// reports which file each setting came from.
+	store := source.NewFilePolicyStore(path)
+	if _, err := syspolicy.RegisterStore(path, setting.DeviceScope, store); err != nil {
+		store.Close()
+		log.Printf("failed to register the policy file %s: %v", path, err)
+	}
+}
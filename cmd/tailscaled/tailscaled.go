@@ -42,6 +42,7 @@
 	"tailscale.com/logpolicy"
 	"tailscale.com/logtail"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/dnsfallback"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netns"
@@ -55,12 +56,14 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
+	"tailscale.com/util/eventbus"
 	"tailscale.com/util/osshare"
 	"tailscale.com/util/syspolicy/pkey"
 	"tailscale.com/util/syspolicy/policyclient"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/netlog"
 	"tailscale.com/wgengine/router"
 )
 
@@ -121,11 +124,18 @@ func defaultPort() uint16 {
 	statedir            string
 	socketpath          string
 	birdSocketPath      string
+	netlogExport        string // comma-separated network log exporters; see netlog.ParseExporters
+	dnsQueryLog         string // comma-separated DNS query log destinations; see dnsQueryLogConfig
+	dnsQueryLogSample   float64
 	verbose             int
 	socksAddr           string // listen address for SOCKS5 server
 	httpProxyAddr       string // listen address for HTTP proxy server
 	disableLogs         bool
 	hardwareAttestation boolFlag
+
+	sshAuthzHook         string        // local SSH authorization hook, or empty
+	sshAuthzHookTimeout  time.Duration // or zero for the default
+	sshAuthzHookFailOpen bool
 }
 
 var (
@@ -171,6 +181,16 @@ func shouldRunCLI() bool {
 	hookOutboundProxyListen        feature.Hook[func() proxyStartFunc]
 )
 
+// hookRegisterPolicyFile, if set, registers the file-based policy store
+// on platforms without an OS-provided one.
+var hookRegisterPolicyFile feature.Hook[func()]
+
+// SSH hooks
+var (
+	hookRegisterSSHFlags feature.Hook[func()]
+	hookConfigureSSH     feature.Hook[func()]
+)
+
 // proxyStartFunc is the type of the function returned by
 // outboundProxyListen, to start the servers on the Listeners
 // started by hookOutboundProxyListen.
@@ -194,7 +214,7 @@ func main() {
 	}
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, defaultPort()), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
-	flag.StringVar(&args.statepath, "state", "", "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM; use 'mem:' to not store state and register as an ephemeral node. If empty and --statedir is provided, the default is <statedir>/tailscaled.state. Default: "+paths.DefaultTailscaledStateFile())
+	flag.StringVar(&args.statepath, "state", "", stateFlagHelp())
 	if buildfeatures.HasTPM {
 		flag.Var(&args.encryptState, "encrypt-state", `encrypt the state file on disk; when not set encryption will be enabled if supported on this platform; uses TPM on Linux and Windows, on all other platforms this flag is not supported`)
 	}
@@ -203,6 +223,13 @@ func main() {
 	if buildfeatures.HasBird {
 		flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
 	}
+	if buildfeatures.HasNetLog {
+		flag.StringVar(&args.netlogExport, "netlog-export", "", "comma-separated list of local exporters of network flow logs: 'jsonl:<path>' to write JSON lines to a file, 'ipfix:<host:port>' or 'netflow9:<host:port>' to send flows to a collector, or 'prometheus:<ip:port>' to serve traffic counters on /metrics")
+	}
+	if buildfeatures.HasDNS {
+		flag.StringVar(&args.dnsQueryLog, "dns-query-log", "", "comma-separated list of destinations for logs of the queries answered by the built-in DNS resolver: 'jsonl:<path>' to append JSON lines to a file, 'eventbus' to publish them on the event bus, or 'stats' to only keep per-client statistics for 'tailscale dns status --queries'")
+		flag.Float64Var(&args.dnsQueryLogSample, "dns-query-log-sample", 1, "fraction of DNS queries to log with --dns-query-log, from 0 to 1; all queries are counted in the statistics")
+	}
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 	flag.BoolVar(&args.disableLogs, "no-logs-no-support", false, "disable log uploads; this also disables any technical support")
 	flag.StringVar(&args.confFile, "config", "", "path to config file, or 'vm:user-data' to use the VM's user-data (EC2)")
@@ -212,6 +239,9 @@ func main() {
 	if f, ok := hookRegisterOutboundProxyFlags.GetOk(); ok {
 		f()
 	}
+	if f, ok := hookRegisterSSHFlags.GetOk(); ok {
+		f()
+	}
 
 	if runtime.GOOS == "plan9" && os.Getenv("_NETSHELL_CHILD_") != "" {
 		os.Args = []string{"tailscaled", "be-child", "plan9-netshell"}
@@ -280,6 +310,10 @@ func main() {
 		}
 	}
 
+	if f, ok := hookRegisterPolicyFile.GetOk(); ok {
+		f()
+	}
+
 	if buildfeatures.HasTPM {
 		handleTPMFlags()
 	}
@@ -367,8 +401,8 @@ func ipnServerOpts() (o serverOptions) {
 
 	// If an absolute --state is provided but not --statedir, try to derive
 	// a state directory.
-	if o.VarRoot == "" && filepath.IsAbs(args.statepath) {
-		if dir := filepath.Dir(args.statepath); strings.EqualFold(filepath.Base(dir), "tailscale") {
+	if statePath := stateFilePath(args.statepath); o.VarRoot == "" && filepath.IsAbs(statePath) {
+		if dir := filepath.Dir(statePath); strings.EqualFold(filepath.Base(dir), "tailscale") {
 			o.VarRoot = dir
 		}
 	}
@@ -390,6 +424,40 @@ func ipnServerOpts() (o serverOptions) {
 	return o
 }
 
+// boltStatePrefix is the --state prefix of the bbolt-backed state store,
+// or empty if it's not linked in.
+var boltStatePrefix string
+
+// stateFlagHelp returns the help text of the --state flag, which only
+// mentions the bbolt-backed store where it's linked in.
+func stateFlagHelp() string {
+	var sb strings.Builder
+	sb.WriteString("absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM; use 'file+enc:<path>?keyfile=<keypath>' to encrypt the state file at rest; ")
+	if boltStatePrefix != "" {
+		sb.WriteString("use '" + boltStatePrefix + "<path>' to store state in a bbolt database; ")
+	}
+	sb.WriteString("use 'mem:' to not store state and register as an ephemeral node. If empty and --statedir is provided, the default is <statedir>/tailscaled.state. Default: " + paths.DefaultTailscaledStateFile())
+	return sb.String()
+}
+
+// stateFilePath returns the path of the local file in which the state store
+// given by --state keeps its state, stripping the prefixes and options of
+// the stores that keep it in a file. For other stores, it returns statePath
+// unchanged.
+func stateFilePath(statePath string) string {
+	prefixes := []string{"file+enc:", store.TPMPrefix}
+	if boltStatePrefix != "" {
+		prefixes = append(prefixes, boltStatePrefix)
+	}
+	for _, prefix := range prefixes {
+		if rest, ok := strings.CutPrefix(statePath, prefix); ok {
+			path, _, _ := strings.Cut(rest, "?") // the key source of file+enc
+			return path
+		}
+	}
+	return statePath
+}
+
 var logPol *logpolicy.Policy // or nil if not used
 var debugMux *http.ServeMux
 
@@ -410,6 +478,10 @@ func run() (err error) {
 		sys.InitialConfig = conf
 	}
 
+	if f, ok := hookConfigureSSH.GetOk(); ok {
+		f()
+	}
+
 	var netMon *netmon.Monitor
 	isWinSvc := isWindowsService()
 	if !isWinSvc {
@@ -675,9 +747,48 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 	if buildfeatures.HasTPM && args.hardwareAttestation.v {
 		lb.SetHardwareAttested()
 	}
+	if buildfeatures.HasDNS && args.dnsQueryLog != "" {
+		cfg, err := dnsQueryLogConfig(sys.Bus.Get(), lb)
+		if err != nil {
+			return nil, fmt.Errorf("--dns-query-log: %w", err)
+		}
+		if err := sys.DNSManager.Get().Resolver().SetQueryLog(cfg); err != nil {
+			return nil, fmt.Errorf("--dns-query-log: %w", err)
+		}
+	}
 	return lb, nil
 }
 
+// dnsQueryLogConfig returns the configuration of DNS query logging from the
+// --dns-query-log and --dns-query-log-sample flags. The destinations in
+// --dns-query-log are each one of:
+//
+//   - "jsonl:<path>" appends JSON lines to a file.
+//   - "eventbus" publishes resolver.QueryLogEntry events on bus.
+//   - "stats" only keeps the per-client statistics, which are kept
+//     with the other destinations too.
+func dnsQueryLogConfig(bus *eventbus.Bus, lb *ipnlocal.LocalBackend) (*resolver.QueryLogConfig, error) {
+	cfg := &resolver.QueryLogConfig{
+		SampleRate: args.dnsQueryLogSample,
+		WhoIs:      lb.DNSQueryNodeName,
+	}
+	for dest := range strings.SplitSeq(args.dnsQueryLog, ",") {
+		switch typ, arg, _ := strings.Cut(strings.TrimSpace(dest), ":"); typ {
+		case "jsonl":
+			if arg == "" || cfg.Path != "" {
+				return nil, fmt.Errorf("invalid destination %q; want one jsonl:<path>", dest)
+			}
+			cfg.Path = arg
+		case "eventbus":
+			cfg.Bus = bus
+		case "stats", "":
+		default:
+			return nil, fmt.Errorf("unknown destination %q", dest)
+		}
+	}
+	return cfg, nil
+}
+
 var hookConfigureWebClient feature.Hook[func(*ipnlocal.LocalBackend)]
 
 // createEngine tries to the wgengine.Engine based on the order of tunnels
@@ -689,16 +800,26 @@ func createEngine(logf logger.Logf, sys *tsd.System) (onlyNetstack bool, err err
 	if args.tunname == "" {
 		return false, errors.New("no --tun value specified")
 	}
+	var netLogExporters []netlog.Exporter
+	if buildfeatures.HasNetLog && args.netlogExport != "" {
+		netLogExporters, err = netlog.ParseExporters(args.netlogExport)
+		if err != nil {
+			return false, fmt.Errorf("--netlog-export: %w", err)
+		}
+	}
 	var errs []error
 	for _, name := range strings.Split(args.tunname, ",") {
 		logf("wgengine.NewUserspaceEngine(tun %q) ...", name)
-		onlyNetstack, err = tryEngine(logf, sys, name)
+		onlyNetstack, err = tryEngine(logf, sys, name, netLogExporters)
 		if err == nil {
 			return onlyNetstack, nil
 		}
 		logf("wgengine.NewUserspaceEngine(tun %q) error: %v", name, err)
 		errs = append(errs, err)
 	}
+	for _, e := range netLogExporters {
+		e.Close()
+	}
 	return false, errors.Join(errs...)
 }
 
@@ -724,16 +845,17 @@ func handleSubnetsInNetstack() bool {
 
 var tstunNew = tstun.New
 
-func tryEngine(logf logger.Logf, sys *tsd.System, name string) (onlyNetstack bool, err error) {
+func tryEngine(logf logger.Logf, sys *tsd.System, name string, netLogExporters []netlog.Exporter) (onlyNetstack bool, err error) {
 	conf := wgengine.Config{
-		ListenPort:    args.port,
-		NetMon:        sys.NetMon.Get(),
-		HealthTracker: sys.HealthTracker.Get(),
-		Metrics:       sys.UserMetricsRegistry(),
-		Dialer:        sys.Dialer.Get(),
-		SetSubsystem:  sys.Set,
-		ControlKnobs:  sys.ControlKnobs(),
-		EventBus:      sys.Bus.Get(),
+		ListenPort:      args.port,
+		NetMon:          sys.NetMon.Get(),
+		HealthTracker:   sys.HealthTracker.Get(),
+		Metrics:         sys.UserMetricsRegistry(),
+		Dialer:          sys.Dialer.Get(),
+		SetSubsystem:    sys.Set,
+		ControlKnobs:    sys.ControlKnobs(),
+		EventBus:        sys.Bus.Get(),
+		NetLogExporters: netLogExporters,
 	}
 	if f, ok := hookSetWgEnginConfigDrive.GetOk(); ok {
 		f(&conf, logf)
@@ -4,8 +4,10 @@
 package main // import "tailscale.com/cmd/tailscaled"
 
 import (
+	"path/filepath"
 	"testing"
 
+	"tailscale.com/tstest"
 	"tailscale.com/tstest/deptest"
 )
 
@@ -38,3 +40,30 @@ func TestDeps(t *testing.T) {
 		},
 	}.Check(t)
 }
+
+func TestIPNServerOptsVarRoot(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tailscale")
+	boltDir := "" // bolt: paths are only understood where the store is linked in
+	if boltStatePrefix != "" {
+		boltDir = dir
+	}
+	tests := []struct {
+		state string
+		want  string
+	}{
+		{filepath.Join(dir, "tailscaled.state"), dir},
+		{"file+enc:" + filepath.Join(dir, "tailscaled.state") + "?keyfile=/etc/tailscale-key", dir},
+		{"bolt:" + filepath.Join(dir, "tailscaled.db"), boltDir},
+		{"bolt:tailscaled.db", ""},
+		{filepath.Join(t.TempDir(), "tailscaled.state"), ""},
+		{"kube:tailscale", ""},
+		{"mem:", ""},
+	}
+	for _, tt := range tests {
+		tstest.Replace(t, &args.statedir, "")
+		tstest.Replace(t, &args.statepath, tt.state)
+		if got := ipnServerOpts().VarRoot; got != tt.want {
+			t.Errorf("--state=%s: VarRoot = %q; want %q", tt.state, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The tscast command plays back, searches and indexes asciinema session
+// recordings made by Tailscale SSH and the Kubernetes API server proxy, as
+// stored by a recorder such as tsrecorder.
+//
+// Usage:
+//
+//	tscast play [-speed 2] [-max-idle 2s] <file.cast>
+//	tscast search [-input] [-output] [-i] <regexp> <file or dir>...
+//	tscast index [-o index.json] <file or dir>...
+//
+// Directories are searched recursively for .cast files.
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/atomicfile"
+	"tailscale.com/sessionrecording/cast"
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	err := rootCmd.ParseAndRun(ctx, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tscast:", err)
+		os.Exit(1)
+	}
+}
+
+var rootCmd = &ffcli.Command{
+	Name:        "tscast",
+	ShortUsage:  "tscast <subcommand> [flags] <args>",
+	ShortHelp:   "Play back, search and index session recordings",
+	Subcommands: []*ffcli.Command{playCmd, searchCmd, indexCmd},
+	Exec: func(context.Context, []string) error {
+		return flag.ErrHelp
+	},
+}
+
+var playArgs struct {
+	speed   float64
+	maxIdle time.Duration
+}
+
+var playCmd = &ffcli.Command{
+	Name:       "play",
+	ShortUsage: "tscast play [-speed <n>] [-max-idle <duration>] <file.cast>",
+	ShortHelp:  "Replay a recording in the terminal",
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("play", flag.ExitOnError)
+		fs.Float64Var(&playArgs.speed, "speed", 1, "playback speed, relative to the original session")
+		fs.DurationVar(&playArgs.maxIdle, "max-idle", 0, "if non-zero, the longest pause between output during playback")
+		return fs
+	})(),
+	Exec: runPlay,
+}
+
+func runPlay(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	if playArgs.speed <= 0 {
+		return errors.New("-speed must be positive")
+	}
+	rec, err := cast.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	h := rec.Header
+	if h.Width > 0 && h.Height > 0 {
+		fmt.Fprintf(os.Stderr, "recorded at %dx%d\n", h.Width, h.Height)
+	}
+	err = cast.Play(ctx, os.Stdout, rec, cast.PlayOptions{
+		Speed:   playArgs.speed,
+		MaxIdle: playArgs.maxIdle,
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	if err == nil && rec.Truncated {
+		fmt.Fprintln(os.Stderr, "\r\n[recording was cut short]")
+	}
+	return err
+}
+
+var searchArgs struct {
+	input      bool
+	output     bool
+	ignoreCase bool
+}
+
+var searchCmd = &ffcli.Command{
+	Name:       "search",
+	ShortUsage: "tscast search [-input] [-output] [-i] <regexp> <file or dir>...",
+	ShortHelp:  "Search recordings for typed commands or output text",
+	LongHelp: strings.TrimSpace(`
+Search prints the lines of text that match the regular expression, typed
+into or written to the terminal during the recorded sessions. By default,
+both typed lines and output are searched.
+
+Each match is printed with its recording, the time into the session, and
+"i" for typed lines or "o" for output.
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("search", flag.ExitOnError)
+		fs.BoolVar(&searchArgs.input, "input", false, "search typed lines, such as commands")
+		fs.BoolVar(&searchArgs.output, "output", false, "search output")
+		fs.BoolVar(&searchArgs.ignoreCase, "i", false, "case-insensitive search")
+		return fs
+	})(),
+	Exec: runSearch,
+}
+
+func runSearch(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return flag.ErrHelp
+	}
+	expr := args[0]
+	if searchArgs.ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	var types []string
+	if searchArgs.input {
+		types = append(types, cast.EventInput)
+	}
+	if searchArgs.output {
+		types = append(types, cast.EventOutput)
+	}
+
+	files, err := castFiles(args[1:])
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+	var found bool
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec, err := cast.ReadFile(f)
+		if err != nil {
+			warnf("%v", err)
+			continue
+		}
+		for _, m := range rec.Search(re, types...) {
+			found = true
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f, fmtOffset(m.Time), m.Type, m.Text)
+		}
+	}
+	if !found {
+		tw.Flush()
+		return errors.New("no matches")
+	}
+	return nil
+}
+
+// fmtOffset formats the time d into a session as "+h:mm:ss".
+func fmtOffset(d time.Duration) string {
+	s := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("+%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+var indexArgs struct {
+	out string
+}
+
+var indexCmd = &ffcli.Command{
+	Name:       "index",
+	ShortUsage: "tscast index [-o <file>] <file or dir>...",
+	ShortHelp:  "Write a JSON index of recordings",
+	LongHelp: strings.TrimSpace(`
+Index writes a JSON index of the recordings, listing each recording's
+metadata in order of start time, and the recordings of each source node,
+SSH user, local user and SSH connection ID.
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("index", flag.ExitOnError)
+		fs.StringVar(&indexArgs.out, "o", "", "file to write the index to, instead of stdout")
+		return fs
+	})(),
+	Exec: runIndex,
+}
+
+func runIndex(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	files, err := castFiles(args)
+	if err != nil {
+		return err
+	}
+	type recording struct {
+		path string
+		rec  *cast.Recording
+	}
+	var recs []recording
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec, err := cast.ReadFile(f)
+		if err != nil {
+			warnf("%v", err)
+			continue
+		}
+		// Only the header and duration are indexed, so keep just the
+		// last event, rather than every recording in memory.
+		rec.Events = rec.Events[len(rec.Events)-min(len(rec.Events), 1):]
+		recs = append(recs, recording{f, rec})
+	}
+	slices.SortStableFunc(recs, func(a, b recording) int {
+		return cmp.Or(
+			cmp.Compare(a.rec.Header.Timestamp, b.rec.Header.Timestamp),
+			cmp.Compare(a.path, b.path),
+		)
+	})
+	var ix cast.Index
+	for _, r := range recs {
+		ix.Add(r.path, r.rec)
+	}
+
+	j, err := json.MarshalIndent(ix, "", "  ")
+	if err != nil {
+		return err
+	}
+	j = append(j, '\n')
+	if indexArgs.out == "" {
+		_, err = os.Stdout.Write(j)
+		return err
+	}
+	return atomicfile.WriteFile(indexArgs.out, j, 0644)
+}
+
+// castFiles returns the recording files named by args: files are returned
+// as is, and directories are searched recursively for .cast files.
+func castFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && filepath.Ext(path) == ".cast" {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func warnf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "tscast: "+format+"\n", args...)
+}
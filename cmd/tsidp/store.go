@@ -0,0 +1,477 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
+)
+
+// oidcKeysFile is where the OIDC signing keys are persisted by fileStore.
+// It supersedes oidcKeyFile, which only held a single key.
+const oidcKeysFile = "oidc-keys.json"
+
+// oidcTokensFile is where fileStore persists issued codes and tokens.
+const oidcTokensFile = "oidc-tokens.json"
+
+// idpStore persists the state of an idpServer: registered OAuth clients,
+// signing keys and issued codes and tokens.
+//
+// Implementations must be safe for concurrent use. An idpStore may be shared
+// by several tsidp replicas (see kubeStore), in which case it, not the
+// idpServer, is the source of truth for issued tokens.
+type idpStore interface {
+	// LoadClients returns all registered clients, keyed by client ID.
+	LoadClients() (map[string]*funnelClient, error)
+	// PutClient stores c, replacing any client with the same ID.
+	PutClient(c *funnelClient) error
+	// DeleteClient deletes the client with the given ID, if it exists.
+	DeleteClient(id string) error
+
+	// LoadSigningKeys returns the signing keys, oldest first.
+	// It returns an empty slice if there are none yet.
+	LoadSigningKeys() ([]*signingKey, error)
+	// SaveSigningKeys replaces the signing keys.
+	SaveSigningKeys([]*signingKey) error
+
+	// PutToken stores an issued code or token, identified by its tokenID.
+	PutToken(kind tokenKind, id string, t *storedToken) error
+	// GetToken returns the code or token with the given tokenID,
+	// or errTokenNotFound.
+	GetToken(kind tokenKind, id string) (*storedToken, error)
+	// DeleteToken deletes the code or token with the given tokenID. It
+	// returns errTokenNotFound if it did not exist, which callers use to
+	// ensure single-use codes are only redeemed once.
+	DeleteToken(kind tokenKind, id string) error
+	// DeleteExpiredTokens deletes all codes and tokens that expired
+	// before now.
+	DeleteExpiredTokens(now time.Time) error
+}
+
+// tokenKind is the kind of a code or token issued by tsidp.
+type tokenKind string
+
+const (
+	tokenKindCode    tokenKind = "code"    // authorization codes
+	tokenKindAccess  tokenKind = "access"  // access tokens for /userinfo
+	tokenKindRefresh tokenKind = "refresh" // refresh tokens for the refresh_token grant
+)
+
+var errTokenNotFound = errors.New("token not found")
+
+// tokenID returns the identifier under which the code or token tk is stored.
+// Tokens are stored hashed so that read access to the store isn't enough to
+// use them.
+func tokenID(tk string) string {
+	sum := sha256.Sum256([]byte(tk))
+	return hex.EncodeToString(sum[:])
+}
+
+// storedToken is the persisted form of an authRequest.
+type storedToken struct {
+	LocalRP     bool                   `json:"localRP,omitempty"`
+	RPNodeID    tailcfg.NodeID         `json:"rpNodeID,omitempty"`
+	FunnelRP    bool                   `json:"funnelRP,omitempty"` // the RP is the funnelClient with ClientID
+	ClientID    string                 `json:"clientID,omitempty"`
+	Nonce       string                 `json:"nonce,omitempty"`
+	RedirectURI string                 `json:"redirectURI,omitempty"`
+	RemoteUser  *apitype.WhoIsResponse `json:"remoteUser"`
+	ValidTill   time.Time              `json:"validTill"`
+
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
+}
+
+func (ar *authRequest) toStored() *storedToken {
+	return &storedToken{
+		LocalRP:     ar.localRP,
+		RPNodeID:    ar.rpNodeID,
+		FunnelRP:    ar.funnelRP != nil,
+		ClientID:    ar.clientID,
+		Nonce:       ar.nonce,
+		RedirectURI: ar.redirectURI,
+		RemoteUser:  ar.remoteUser,
+		ValidTill:   ar.validTill,
+
+		CodeChallenge:       ar.codeChallenge,
+		CodeChallengeMethod: ar.codeChallengeMethod,
+	}
+}
+
+// expired reports whether t expired before now. Tokens without an
+// expiry never expire.
+func (t *storedToken) expired(now time.Time) bool {
+	return !t.ValidTill.IsZero() && t.ValidTill.Before(now)
+}
+
+// authRequestFromStored returns the authRequest for st. It returns false
+// if st was issued to a Funnel client that no longer exists.
+func (s *idpServer) authRequestFromStored(st *storedToken) (*authRequest, bool) {
+	ar := &authRequest{
+		localRP:     st.LocalRP,
+		rpNodeID:    st.RPNodeID,
+		clientID:    st.ClientID,
+		nonce:       st.Nonce,
+		redirectURI: st.RedirectURI,
+		remoteUser:  st.RemoteUser,
+		validTill:   st.ValidTill,
+
+		codeChallenge:       st.CodeChallenge,
+		codeChallengeMethod: st.CodeChallengeMethod,
+	}
+	if st.FunnelRP {
+		s.mu.Lock()
+		ar.funnelRP = s.funnelClients[st.ClientID]
+		s.mu.Unlock()
+		if ar.funnelRP == nil {
+			return nil, false
+		}
+	}
+	return ar, true
+}
+
+// tokenMapLocked returns the in-memory map holding tokens of the given kind,
+// used when s.store is nil. s.mu must be held.
+func (s *idpServer) tokenMapLocked(kind tokenKind) *map[string]*authRequest {
+	switch kind {
+	case tokenKindCode:
+		return &s.code
+	case tokenKindAccess:
+		return &s.accessToken
+	case tokenKindRefresh:
+		return &s.refreshToken
+	}
+	panic(fmt.Sprintf("unknown token kind %q", kind))
+}
+
+// saveToken records that the code or token tk of the given kind was issued
+// for ar.
+func (s *idpServer) saveToken(kind tokenKind, tk string, ar *authRequest) error {
+	if s.store != nil {
+		return s.store.PutToken(kind, tokenID(tk), ar.toStored())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mak.Set(s.tokenMapLocked(kind), tk, ar)
+	return nil
+}
+
+// lookupToken returns the authRequest for which the code or token tk of the
+// given kind was issued, if any.
+func (s *idpServer) lookupToken(kind tokenKind, tk string) (*authRequest, bool) {
+	if s.store == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		ar, ok := (*s.tokenMapLocked(kind))[tk]
+		return ar, ok
+	}
+	st, err := s.store.GetToken(kind, tokenID(tk))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) {
+			log.Printf("error looking up %s token: %v", kind, err)
+		}
+		return nil, false
+	}
+	return s.authRequestFromStored(st)
+}
+
+// takeToken is like lookupToken, but also deletes the token so that it
+// can only be used once, even across tsidp replicas sharing a store.
+func (s *idpServer) takeToken(kind tokenKind, tk string) (*authRequest, bool) {
+	if s.store == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		m := *s.tokenMapLocked(kind)
+		ar, ok := m[tk]
+		delete(m, tk)
+		return ar, ok
+	}
+	ar, ok := s.lookupToken(kind, tk)
+	if !ok {
+		return nil, false
+	}
+	if err := s.store.DeleteToken(kind, tokenID(tk)); err != nil {
+		// If it's already gone, another request raced us and won.
+		if !errors.Is(err, errTokenNotFound) {
+			log.Printf("error deleting %s token: %v", kind, err)
+		}
+		return nil, false
+	}
+	return ar, true
+}
+
+// deleteToken deletes the code or token tk of the given kind, if it exists.
+func (s *idpServer) deleteToken(kind tokenKind, tk string) {
+	if s.store == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(*s.tokenMapLocked(kind), tk)
+		return
+	}
+	if err := s.store.DeleteToken(kind, tokenID(tk)); err != nil && !errors.Is(err, errTokenNotFound) {
+		log.Printf("error deleting %s token: %v", kind, err)
+	}
+}
+
+// deleteExpiredTokens deletes all codes and tokens that expired before now.
+func (s *idpServer) deleteExpiredTokens(now time.Time) {
+	if s.store != nil {
+		if err := s.store.DeleteExpiredTokens(now); err != nil {
+			log.Printf("error deleting expired tokens: %v", err)
+		}
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range []map[string]*authRequest{s.code, s.accessToken, s.refreshToken} {
+		for tk, ar := range m {
+			if !ar.validTill.IsZero() && ar.validTill.Before(now) {
+				delete(m, tk)
+			}
+		}
+	}
+}
+
+// fileStore is an idpStore that keeps state in JSON files in a directory.
+// It's the default store, and must only be used by a single tsidp instance.
+type fileStore struct {
+	rootPath    string
+	clientsFile string // funnelClientsFile or oauthClientsFile
+
+	mu     sync.Mutex                            // guards the clients file and tokens
+	tokens map[tokenKind]map[string]*storedToken // nil until loaded
+}
+
+// newFileStore returns a fileStore that keeps its files in rootPath. OAuth
+// clients are kept in oauthClientsFile, or in funnelClientsFile if
+// allowInsecureRegistration is set.
+func newFileStore(rootPath string, allowInsecureRegistration bool) *fileStore {
+	fs := &fileStore{rootPath: rootPath, clientsFile: oauthClientsFile}
+	if allowInsecureRegistration {
+		fs.clientsFile = funnelClientsFile
+	}
+	return fs
+}
+
+// LoadClients implements idpStore.
+func (fs *fileStore) LoadClients() (map[string]*funnelClient, error) {
+	path, err := getConfigFilePath(fs.rootPath, fs.clientsFile)
+	if err != nil {
+		return nil, err
+	}
+	var clients map[string]*funnelClient
+	if err := readJSONFile(path, &clients); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// PutClient implements idpStore.
+func (fs *fileStore) PutClient(c *funnelClient) error {
+	return fs.updateClients(func(clients map[string]*funnelClient) {
+		clients[c.ID] = c
+	})
+}
+
+// DeleteClient implements idpStore.
+func (fs *fileStore) DeleteClient(id string) error {
+	return fs.updateClients(func(clients map[string]*funnelClient) {
+		delete(clients, id)
+	})
+}
+
+// updateClients rewrites the clients file with the clients in it, as
+// modified by f.
+func (fs *fileStore) updateClients(f func(map[string]*funnelClient)) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	clients, err := fs.LoadClients()
+	if err != nil {
+		return err
+	}
+	if clients == nil {
+		clients = make(map[string]*funnelClient)
+	}
+	f(clients)
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(clients); err != nil {
+		return err
+	}
+	path, err := getConfigFilePath(fs.rootPath, fs.clientsFile)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// LoadSigningKeys implements idpStore. If there's no oidcKeysFile yet, it
+// returns the key from the legacy oidcKeyFile, if any.
+func (fs *fileStore) LoadSigningKeys() ([]*signingKey, error) {
+	path, err := getConfigFilePath(fs.rootPath, oidcKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*signingKey
+	err = readJSONFile(path, &keys)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return keys, err
+	}
+
+	legacyPath, err := getConfigFilePath(fs.rootPath, oidcKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var sk signingKey
+	if err := readJSONFile(legacyPath, &sk); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		// Match the old behavior of replacing an unreadable key.
+		log.Printf("Error unmarshaling key: %v", err)
+		return nil, nil
+	}
+	if sk.k == nil {
+		return nil, nil
+	}
+	return []*signingKey{&sk}, nil
+}
+
+// SaveSigningKeys implements idpStore.
+func (fs *fileStore) SaveSigningKeys(keys []*signingKey) error {
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	path, err := getConfigFilePath(fs.rootPath, oidcKeysFile)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b, 0600)
+}
+
+// loadTokensLocked loads the tokens file into fs.tokens, if it hasn't
+// been already. fs.mu must be held.
+func (fs *fileStore) loadTokensLocked() error {
+	if fs.tokens != nil {
+		return nil
+	}
+	path, err := getConfigFilePath(fs.rootPath, oidcTokensFile)
+	if err != nil {
+		return err
+	}
+	var tokens map[tokenKind]map[string]*storedToken
+	if err := readJSONFile(path, &tokens); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if tokens == nil {
+		tokens = make(map[tokenKind]map[string]*storedToken)
+	}
+	fs.tokens = tokens
+	return nil
+}
+
+// saveTokensLocked writes fs.tokens to the tokens file. fs.mu must be held.
+func (fs *fileStore) saveTokensLocked() error {
+	b, err := json.Marshal(fs.tokens)
+	if err != nil {
+		return err
+	}
+	path, err := getConfigFilePath(fs.rootPath, oidcTokensFile)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b, 0600)
+}
+
+// PutToken implements idpStore.
+func (fs *fileStore) PutToken(kind tokenKind, id string, t *storedToken) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.loadTokensLocked(); err != nil {
+		return err
+	}
+	m := fs.tokens[kind]
+	mak.Set(&m, id, t)
+	fs.tokens[kind] = m
+	if err := fs.saveTokensLocked(); err != nil {
+		delete(m, id)
+		return err
+	}
+	return nil
+}
+
+// GetToken implements idpStore.
+func (fs *fileStore) GetToken(kind tokenKind, id string) (*storedToken, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.loadTokensLocked(); err != nil {
+		return nil, err
+	}
+	t, ok := fs.tokens[kind][id]
+	if !ok {
+		return nil, errTokenNotFound
+	}
+	return t, nil
+}
+
+// DeleteToken implements idpStore.
+func (fs *fileStore) DeleteToken(kind tokenKind, id string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.loadTokensLocked(); err != nil {
+		return err
+	}
+	if _, ok := fs.tokens[kind][id]; !ok {
+		return errTokenNotFound
+	}
+	delete(fs.tokens[kind], id)
+	return fs.saveTokensLocked()
+}
+
+// DeleteExpiredTokens implements idpStore.
+func (fs *fileStore) DeleteExpiredTokens(now time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.loadTokensLocked(); err != nil {
+		return err
+	}
+	var changed bool
+	for _, m := range fs.tokens {
+		for id, t := range m {
+			if t.expired(now) {
+				delete(m, id)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return fs.saveTokensLocked()
+}
+
+// readJSONFile reads and unmarshals the JSON file at path into v.
+func readJSONFile(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+	"tailscale.com/util/mak"
+)
+
+// kubeStorePrefix is the --store prefix selecting a kubeStore.
+const kubeStorePrefix = "kube:"
+
+const (
+	kubeClientKeyPrefix = "client."
+	kubeSigningKeysKey  = "signing-keys"
+	kubeTokenKeyPrefix  = "token."
+)
+
+// kubeTimeout is the timeout for each Kubernetes API request.
+const kubeTimeout = 10 * time.Second
+
+// kubeMaxPutAttempts is how many times kubeStore.put tries to patch the
+// Secret, if other replicas keep changing it in between.
+const kubeMaxPutAttempts = 5
+
+// kubeStore is an idpStore that keeps state in a Kubernetes Secret, so that
+// several tsidp replicas (for instance, behind a Tailscale Service) can share
+// clients, signing keys and issued tokens.
+//
+// Signing keys are stored in a single Secret key, and each client, code or
+// token in its own key, so that replicas changing them concurrently don't
+// overwrite each other's writes. Reads always go to the API server.
+//
+// As a Secret is limited to 1 MiB, it's meant for deployments with up to a
+// few hundred concurrently valid tokens.
+type kubeStore struct {
+	client     kubeclient.Client
+	secretName string
+}
+
+// newKubeStore returns a kubeStore using the Secret with the given name in
+// the namespace tsidp is running in. The Secret is created if it doesn't
+// exist.
+func newKubeStore(secretName string) (*kubeStore, error) {
+	c, err := kubeclient.New("tsidp")
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv("TS_KUBERNETES_READ_API_SERVER_ADDRESS_FROM_ENV") == "true" {
+		c.SetURL(fmt.Sprintf("https://%s:%s", os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT_HTTPS")))
+	}
+	return &kubeStore{client: c, secretName: secretName}, nil
+}
+
+// kubeTokenKey returns the Secret key for a token of the given kind and ID.
+func kubeTokenKey(kind tokenKind, id string) string {
+	return kubeTokenKeyPrefix + string(kind) + "." + id
+}
+
+// data returns the data of the Secret, or nil if it doesn't exist.
+func (ks *kubeStore) data() (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	secret, err := ks.client.GetSecret(ctx, ks.secretName)
+	if err != nil {
+		if kubeclient.IsNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting Secret %s: %w", ks.secretName, err)
+	}
+	return secret.Data, nil
+}
+
+// get unmarshals the value of key in the Secret into v. It returns
+// errTokenNotFound if the key doesn't exist.
+func (ks *kubeStore) get(key string, v any) error {
+	data, err := ks.data()
+	if err != nil {
+		return err
+	}
+	b, ok := data[key]
+	if !ok {
+		return errTokenNotFound
+	}
+	return json.Unmarshal(b, v)
+}
+
+// put sets key in the Secret to the JSON encoding of v, creating the Secret
+// if needed.
+//
+// Patches are made with the resourceVersion of the Secret they were made
+// for as a precondition, so that a patch that would overwrite changes made
+// by another replica in between fails instead, and is retried.
+func (ks *kubeStore) put(key string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err := ks.putOnce(key, b)
+		if !isKubeStatus(err, http.StatusConflict) || attempt == kubeMaxPutAttempts {
+			return err
+		}
+	}
+}
+
+// putOnce sets key in the Secret to b, creating the Secret if needed. It
+// returns a 409 Conflict kubeapi.Status if the Secret changed while it was
+// patching it.
+func (ks *kubeStore) putOnce(key string, b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	secret, err := ks.client.GetSecret(ctx, ks.secretName)
+	if kubeclient.IsNotFoundErr(err) {
+		err = ks.client.CreateSecret(ctx, &kubeapi.Secret{
+			TypeMeta: kubeapi.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "Secret",
+			},
+			ObjectMeta: kubeapi.ObjectMeta{
+				Name: ks.secretName,
+			},
+			Data: map[string][]byte{key: b},
+		})
+		if !isKubeStatus(err, http.StatusConflict) {
+			return err
+		}
+		// Another replica created it first; patch it instead.
+		secret, err = ks.client.GetSecret(ctx, ks.secretName)
+	}
+	if err != nil {
+		return fmt.Errorf("error getting Secret %s: %w", ks.secretName, err)
+	}
+	patch := kubeclient.JSONPatch{Op: "add", Path: "/data/" + key, Value: b}
+	if len(secret.Data) == 0 {
+		// A Secret with no data has no /data field to add keys to.
+		patch = kubeclient.JSONPatch{Op: "add", Path: "/data", Value: map[string][]byte{key: b}}
+	}
+	patches := []kubeclient.JSONPatch{
+		// The API server rejects the patch with a conflict if the
+		// resourceVersion it sets isn't the current one.
+		{Op: "replace", Path: "/metadata/resourceVersion", Value: secret.ResourceVersion},
+		patch,
+	}
+	if err := ks.client.JSONPatchResource(ctx, ks.secretName, kubeclient.TypeSecrets, patches); err != nil {
+		return fmt.Errorf("error patching Secret %s: %w", ks.secretName, err)
+	}
+	return nil
+}
+
+// remove deletes keys from the Secret in a single patch. It returns
+// errTokenNotFound if any of them doesn't exist, in which case none of them
+// are removed.
+func (ks *kubeStore) remove(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	patches := make([]kubeclient.JSONPatch, 0, len(keys))
+	for _, k := range keys {
+		patches = append(patches, kubeclient.JSONPatch{Op: "remove", Path: "/data/" + k})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	err := ks.client.JSONPatchResource(ctx, ks.secretName, kubeclient.TypeSecrets, patches)
+	switch {
+	case err == nil:
+		return nil
+	case kubeclient.IsNotFoundErr(err), isKubeStatus(err, http.StatusUnprocessableEntity):
+		// Removing a missing path fails the whole patch.
+		return errTokenNotFound
+	}
+	return fmt.Errorf("error patching Secret %s: %w", ks.secretName, err)
+}
+
+func isKubeStatus(err error, code int) bool {
+	var st *kubeapi.Status
+	return errors.As(err, &st) && st.Code == code
+}
+
+// LoadClients implements idpStore.
+func (ks *kubeStore) LoadClients() (map[string]*funnelClient, error) {
+	data, err := ks.data()
+	if err != nil {
+		return nil, err
+	}
+	var clients map[string]*funnelClient
+	for k, v := range data {
+		id, ok := strings.CutPrefix(k, kubeClientKeyPrefix)
+		if !ok {
+			continue
+		}
+		var c funnelClient
+		if err := json.Unmarshal(v, &c); err != nil {
+			return nil, fmt.Errorf("error parsing client %s: %w", id, err)
+		}
+		mak.Set(&clients, id, &c)
+	}
+	return clients, nil
+}
+
+// PutClient implements idpStore.
+func (ks *kubeStore) PutClient(c *funnelClient) error {
+	return ks.put(kubeClientKeyPrefix+c.ID, c)
+}
+
+// DeleteClient implements idpStore.
+func (ks *kubeStore) DeleteClient(id string) error {
+	if err := ks.remove(kubeClientKeyPrefix + id); err != nil && !errors.Is(err, errTokenNotFound) {
+		return err
+	}
+	return nil
+}
+
+// LoadSigningKeys implements idpStore.
+func (ks *kubeStore) LoadSigningKeys() ([]*signingKey, error) {
+	var keys []*signingKey
+	if err := ks.get(kubeSigningKeysKey, &keys); err != nil && !errors.Is(err, errTokenNotFound) {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// SaveSigningKeys implements idpStore.
+func (ks *kubeStore) SaveSigningKeys(keys []*signingKey) error {
+	return ks.put(kubeSigningKeysKey, keys)
+}
+
+// PutToken implements idpStore.
+func (ks *kubeStore) PutToken(kind tokenKind, id string, t *storedToken) error {
+	return ks.put(kubeTokenKey(kind, id), t)
+}
+
+// GetToken implements idpStore.
+func (ks *kubeStore) GetToken(kind tokenKind, id string) (*storedToken, error) {
+	var t storedToken
+	if err := ks.get(kubeTokenKey(kind, id), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// DeleteToken implements idpStore.
+func (ks *kubeStore) DeleteToken(kind tokenKind, id string) error {
+	return ks.remove(kubeTokenKey(kind, id))
+}
+
+// DeleteExpiredTokens implements idpStore.
+func (ks *kubeStore) DeleteExpiredTokens(now time.Time) error {
+	data, err := ks.data()
+	if err != nil {
+		return err
+	}
+	var expired []string
+	for k, v := range data {
+		if !strings.HasPrefix(k, kubeTokenKeyPrefix) {
+			continue
+		}
+		var t storedToken
+		if err := json.Unmarshal(v, &t); err != nil {
+			log.Printf("deleting unparseable token %s: %v", k, err)
+			expired = append(expired, k)
+			continue
+		}
+		if t.expired(now) {
+			expired = append(expired, k)
+		}
+	}
+	if err := ks.remove(expired...); err != nil && !errors.Is(err, errTokenNotFound) {
+		return err
+	}
+	// If another replica deleted some of them first, the rest
+	// will be deleted next time.
+	return nil
+}
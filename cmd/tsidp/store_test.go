@@ -0,0 +1,382 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+	"tailscale.com/tailcfg"
+)
+
+// fakeKubeSecret returns a kubeclient.FakeClient backed by a single
+// in-memory Secret, which doesn't exist until it's first created. Like the
+// API server, it rejects patches that set a stale resourceVersion.
+func fakeKubeSecret(t *testing.T) *kubeclient.FakeClient {
+	t.Helper()
+	var (
+		mu     sync.Mutex
+		secret *kubeapi.Secret
+		rv     int // resourceVersion of secret
+	)
+	notFound := &kubeapi.Status{Code: http.StatusNotFound}
+	return &kubeclient.FakeClient{
+		GetSecretImpl: func(_ context.Context, name string) (*kubeapi.Secret, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if secret == nil {
+				return nil, notFound
+			}
+			s := *secret
+			s.Data = make(map[string][]byte, len(secret.Data))
+			for k, v := range secret.Data {
+				s.Data[k] = v
+			}
+			return &s, nil
+		},
+		CreateSecretImpl: func(_ context.Context, s *kubeapi.Secret) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if secret != nil {
+				return &kubeapi.Status{Code: http.StatusConflict}
+			}
+			secret = s
+			rv++
+			secret.ResourceVersion = strconv.Itoa(rv)
+			return nil
+		},
+		JSONPatchResourceImpl: func(_ context.Context, name, typ string, patches []kubeclient.JSONPatch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if secret == nil {
+				return notFound
+			}
+			data := make(map[string][]byte)
+			for k, v := range secret.Data {
+				data[k] = v
+			}
+			for _, p := range patches {
+				switch {
+				case p.Op == "replace" && p.Path == "/metadata/resourceVersion":
+					if p.Value != secret.ResourceVersion {
+						return &kubeapi.Status{Code: http.StatusConflict}
+					}
+				case p.Op == "add" && p.Path == "/data":
+					data = p.Value.(map[string][]byte)
+				case p.Op == "add":
+					data[strings.TrimPrefix(p.Path, "/data/")] = p.Value.([]byte)
+				case p.Op == "remove":
+					k := strings.TrimPrefix(p.Path, "/data/")
+					if _, ok := data[k]; !ok {
+						return &kubeapi.Status{Code: http.StatusUnprocessableEntity}
+					}
+					delete(data, k)
+				default:
+					t.Errorf("unexpected patch %+v", p)
+				}
+			}
+			secret.Data = data
+			rv++
+			secret.ResourceVersion = strconv.Itoa(rv)
+			return nil
+		},
+	}
+}
+
+func testStores(t *testing.T) map[string]func() idpStore {
+	dir := t.TempDir()
+	kc := fakeKubeSecret(t)
+	return map[string]func() idpStore{
+		"file": func() idpStore { return newFileStore(dir, false) },
+		"kube": func() idpStore { return &kubeStore{client: kc, secretName: "tsidp"} },
+	}
+}
+
+func TestIDPStore(t *testing.T) {
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			st := newStore()
+
+			// Clients.
+			if clients, err := st.LoadClients(); err != nil || len(clients) != 0 {
+				t.Fatalf("initial LoadClients = %v, %v; want empty", clients, err)
+			}
+			want := map[string]*funnelClient{
+				"c1": {ID: "c1", Secret: "s1", RedirectURI: "https://rp.example.com/cb"},
+			}
+			if err := st.PutClient(want["c1"]); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PutClient(&funnelClient{ID: "c2", RedirectURI: "https://rp2.example.com/cb"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.DeleteClient("c2"); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.DeleteClient("c2"); err != nil {
+				t.Errorf("second DeleteClient = %v; want nil", err)
+			}
+
+			// Signing keys.
+			if keys, err := st.LoadSigningKeys(); err != nil || len(keys) != 0 {
+				t.Fatalf("initial LoadSigningKeys = %v, %v; want empty", keys, err)
+			}
+			created := time.Now().Truncate(time.Second)
+			if err := st.SaveSigningKeys([]*signingKey{{k: mustGeneratePrivateKey(t), kid: 42, created: created}}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Tokens.
+			now := time.Now()
+			user := &apitype.WhoIsResponse{Node: &tailcfg.Node{ID: 7}}
+			if err := st.PutToken(tokenKindAccess, "live", &storedToken{ClientID: "c1", RemoteUser: user, ValidTill: now.Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PutToken(tokenKindAccess, "dead", &storedToken{ClientID: "c1", RemoteUser: user, ValidTill: now.Add(-time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PutToken(tokenKindCode, "code", &storedToken{ClientID: "c1", RemoteUser: user, ValidTill: now.Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.DeleteExpiredTokens(now); err != nil {
+				t.Fatal(err)
+			}
+
+			// Everything is visible to a new instance of the store,
+			// like a restarted tsidp or another replica.
+			st = newStore()
+			if clients, err := st.LoadClients(); err != nil || len(clients) != 1 || clients["c1"] == nil || *clients["c1"] != *want["c1"] {
+				t.Errorf("LoadClients = %v, %v; want %v", clients, err, want)
+			}
+			keys, err := st.LoadSigningKeys()
+			if err != nil || len(keys) != 1 || keys[0].kid != 42 || !keys[0].created.Equal(created) || !keys[0].k.Equal(mustGeneratePrivateKey(t)) {
+				t.Errorf("LoadSigningKeys = %v, %v; want key 42", keys, err)
+			}
+			if tok, err := st.GetToken(tokenKindAccess, "live"); err != nil || tok.ClientID != "c1" || tok.RemoteUser.Node.ID != 7 {
+				t.Errorf("GetToken(live) = %+v, %v", tok, err)
+			}
+			if _, err := st.GetToken(tokenKindAccess, "dead"); !errors.Is(err, errTokenNotFound) {
+				t.Errorf("GetToken(dead) error = %v; want %v", err, errTokenNotFound)
+			}
+			if _, err := st.GetToken(tokenKindAccess, "code"); !errors.Is(err, errTokenNotFound) {
+				t.Errorf("GetToken of code as access token error = %v; want %v", err, errTokenNotFound)
+			}
+			if err := st.DeleteToken(tokenKindCode, "code"); err != nil {
+				t.Errorf("DeleteToken(code) = %v", err)
+			}
+			if err := st.DeleteToken(tokenKindCode, "code"); !errors.Is(err, errTokenNotFound) {
+				t.Errorf("second DeleteToken(code) = %v; want %v", err, errTokenNotFound)
+			}
+		})
+	}
+}
+
+// TestKubeStoreConcurrentPuts tests that replicas writing to the Secret at
+// the same time don't overwrite each other's writes, even when it has no
+// data yet.
+func TestKubeStoreConcurrentPuts(t *testing.T) {
+	kc := fakeKubeSecret(t)
+	r1 := &kubeStore{client: kc, secretName: "tsidp"}
+	r2 := &kubeStore{client: kc, secretName: "tsidp"}
+
+	// Create the Secret and leave it without data.
+	if err := r1.PutClient(&funnelClient{ID: "c0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.DeleteClient("c0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Have r2 write between r1 reading and patching the Secret, once.
+	patch := kc.JSONPatchResourceImpl
+	raced := false
+	kc.JSONPatchResourceImpl = func(ctx context.Context, name, typ string, patches []kubeclient.JSONPatch) error {
+		if !raced {
+			raced = true
+			if err := r2.PutClient(&funnelClient{ID: "c2"}); err != nil {
+				t.Errorf("r2.PutClient: %v", err)
+			}
+		}
+		return patch(ctx, name, typ, patches)
+	}
+	if err := r1.PutClient(&funnelClient{ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := r1.LoadClients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 || clients["c1"] == nil || clients["c2"] == nil {
+		t.Errorf("LoadClients = %v; want c1 and c2", clients)
+	}
+}
+
+func TestFileStoreLegacySigningKey(t *testing.T) {
+	dir := t.TempDir()
+	legacy := &signingKey{k: mustGeneratePrivateKey(t), kid: 1234}
+	b, err := legacy.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, oidcKeyFile), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := newFileStore(dir, false).LoadSigningKeys()
+	if err != nil || len(keys) != 1 || keys[0].kid != legacy.kid || !keys[0].created.IsZero() {
+		t.Fatalf("LoadSigningKeys = %v, %v; want legacy key %d", keys, err, legacy.kid)
+	}
+}
+
+func TestRotatedKeys(t *testing.T) {
+	const period = 24 * time.Hour
+	now := time.Now()
+	k1 := &signingKey{kid: 1} // legacy key with no creation time
+	k2 := &signingKey{kid: 2, created: now.Add(-period - time.Hour)}
+	k3 := &signingKey{kid: 3, created: now.Add(-time.Hour)}
+
+	kids := func(keys []*signingKey) (ret []uint64) {
+		for _, k := range keys {
+			ret = append(ret, k.kid)
+		}
+		return ret
+	}
+
+	if got := rotatedKeys([]*signingKey{k1}, now, 0); len(got) != 1 || got[0] != k1 {
+		t.Errorf("rotation disabled: got kids %v; want [1]", kids(got))
+	}
+	if got := rotatedKeys([]*signingKey{k1, k2, k3}, now, period); len(got) != 3 {
+		t.Errorf("newest key is fresh: got kids %v; want [1 2 3]", kids(got))
+	}
+
+	// k2 is due for rotation. k1 was superseded by k2 more than a period
+	// ago and is dropped; k2 remains published alongside the new key.
+	got := rotatedKeys([]*signingKey{k1, k2}, now, period)
+	if len(got) != 2 || got[0] != k2 || !got[1].created.Equal(now) {
+		t.Errorf("rotation due: got kids %v; want [2 <new>]", kids(got))
+	}
+}
+
+func TestSigningKeyRotationJWKS(t *testing.T) {
+	s := &idpServer{
+		store:       newFileStore(t.TempDir(), false),
+		keyRotation: time.Hour,
+		serverURL:   "https://idp.test.ts.net",
+	}
+	old := &signingKey{k: mustGeneratePrivateKey(t), kid: 1, created: time.Now().Add(-2 * time.Hour)}
+	if err := s.store.SaveSigningKeys([]*signingKey{old}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rotateSigningKeys(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.serveJWKS(rr, httptest.NewRequest("GET", oidcJWKSPath, nil))
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(rr.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 2 || jwks.Keys[0].KeyID != "1" {
+		t.Fatalf("JWKS has %d keys (first %q); want old key 1 and the new key", len(jwks.Keys), jwks.Keys[0].KeyID)
+	}
+	newKID := jwks.Keys[1].KeyID
+
+	signer, err := s.oidcSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := jwt.Signed(signer).Claims(jwt.Claims{Subject: "x"}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jwt.ParseSigned(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parsed.Headers[0].KeyID; kid != newKID {
+		t.Errorf("token signed with kid %q; want newest key %q", kid, newKID)
+	}
+	var claims jwt.Claims
+	if err := parsed.Claims(jwks.Key(newKID)[0].Key, &claims); err != nil {
+		t.Errorf("token does not verify with published key: %v", err)
+	}
+}
+
+func TestCodeRedeemedOnceWithSharedStore(t *testing.T) {
+	kc := fakeKubeSecret(t)
+	newReplica := func() *idpServer {
+		s := setupTestServer(t, false)
+		s.store = &kubeStore{client: kc, secretName: "tsidp"}
+		return s
+	}
+	r1, r2 := newReplica(), newReplica()
+
+	ar := &authRequest{
+		localRP:     true,
+		clientID:    "client-id",
+		redirectURI: "https://rp.example.com/callback",
+		remoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 2},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		},
+		validTill: time.Now().Add(time.Minute),
+	}
+	if err := r1.saveToken(tokenKindCode, "the-code", ar); err != nil {
+		t.Fatal(err)
+	}
+
+	redeem := func(s *idpServer) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {"the-code"},
+			"redirect_uri": {"https://rp.example.com/callback"},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "127.0.0.1:12345"
+		rr := httptest.NewRecorder()
+		s.serveToken(rr, req)
+		return rr
+	}
+
+	// The code was issued by r1 but can be redeemed at r2.
+	rr := redeem(r2)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("redeeming at other replica: got %d: %s", rr.Code, rr.Body)
+	}
+	var resp oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rr := redeem(r1); rr.Code == http.StatusOK {
+		t.Fatal("code redeemed twice")
+	}
+
+	// The access token issued by r2 works at r1.
+	req := httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	rr = httptest.NewRecorder()
+	r1.serveUserInfo(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("userinfo at other replica: got %d: %s", rr.Code, rr.Body)
+	}
+}
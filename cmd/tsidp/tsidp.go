@@ -7,10 +7,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
@@ -30,6 +30,7 @@
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -79,6 +80,10 @@ type ctxConn struct{
 	flagFunnel                        = flag.Bool("funnel", false, "use Tailscale Funnel to make tsidp available on the public internet")
 	flagHostname                      = flag.String("hostname", "idp", "tsnet hostname to use instead of idp")
 	flagDir                           = flag.String("dir", "", "tsnet state directory; a default one will be created if not provided")
+	flagStore                         = flag.String("store", "", "where to keep OAuth clients, signing keys and issued tokens: empty for files in the state directory, or 'kube:<secret-name>' for a Kubernetes Secret that can be shared by several tsidp replicas")
+	flagKeyRotation                   = flag.Duration("key-rotation", 0, "if non-zero, how often to rotate the OIDC signing key; superseded keys remain published in the JWKS for another period")
+	flagTokenExchangeAudiences        = flag.String("token-exchange-audiences", "", "comma-separated audiences that tailnet workloads may get tokens for with the token exchange grant, in addition to the IDs of registered clients")
+	flagRefreshTokenTTL               = flag.Duration("refresh-token-ttl", 0, "how long issued refresh tokens are valid for, from the authentication that they're issued for; 0 disables refresh tokens")
 	flagAllowInsecureRegistrationBool opt.Bool
 	flagAllowInsecureRegistration     = opt.BoolFlag{Bool: &flagAllowInsecureRegistrationBool}
 )
@@ -198,6 +203,13 @@ func main() {
 		localTSMode:               *flagUseLocalTailscaled,
 		rootPath:                  rootPath,
 		allowInsecureRegistration: getAllowInsecureRegistration(),
+		keyRotation:               *flagKeyRotation,
+		refreshTokenTTL:           *flagRefreshTokenTTL,
+	}
+	for _, aud := range strings.Split(*flagTokenExchangeAudiences, ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			srv.tokenExchangeAudiences = append(srv.tokenExchangeAudiences, aud)
+		}
 	}
 
 	if *flagPort != 443 {
@@ -206,30 +218,32 @@ func main() {
 		srv.serverURL = fmt.Sprintf("https://%s", strings.TrimSuffix(st.Self.DNSName, "."))
 	}
 
-	// If allowInsecureRegistration is enabled, the old oidc-funnel-clients.json path is used.
-	// If allowInsecureRegistration is disabled, attempt to migrate the old path to oidc-clients.json and use this new path.
-	var clientsFilePath string
-	if !srv.allowInsecureRegistration {
-		clientsFilePath, err = migrateOAuthClients(rootPath)
+	if secretName, ok := strings.CutPrefix(*flagStore, kubeStorePrefix); ok {
+		srv.store, err = newKubeStore(secretName)
 		if err != nil {
-			log.Fatalf("could not migrate OAuth clients: %v", err)
+			log.Fatalf("could not create Kubernetes store: %v", err)
 		}
+	} else if *flagStore != "" {
+		log.Fatalf("unsupported --store %q", *flagStore)
 	} else {
-		clientsFilePath, err = getConfigFilePath(rootPath, funnelClientsFile)
-		if err != nil {
-			log.Fatalf("could not get funnel clients file path: %v", err)
+		// If allowInsecureRegistration is enabled, the old oidc-funnel-clients.json path is used.
+		// If allowInsecureRegistration is disabled, attempt to migrate the old path to oidc-clients.json and use this new path.
+		if !srv.allowInsecureRegistration {
+			if _, err := migrateOAuthClients(rootPath); err != nil {
+				log.Fatalf("could not migrate OAuth clients: %v", err)
+			}
 		}
+		srv.store = newFileStore(rootPath, srv.allowInsecureRegistration)
 	}
 
-	f, err := os.Open(clientsFilePath)
-	if err == nil {
-		if err := json.NewDecoder(f).Decode(&srv.funnelClients); err != nil {
-			log.Fatalf("could not parse %s: %v", clientsFilePath, err)
-		}
-		f.Close()
-	} else if !errors.Is(err, os.ErrNotExist) {
-		log.Fatalf("could not open %s: %v", clientsFilePath, err)
+	srv.funnelClients, err = srv.store.LoadClients()
+	if err != nil {
+		log.Fatalf("could not load OAuth clients: %v", err)
 	}
+	if err := srv.rotateSigningKeys(time.Now()); err != nil {
+		log.Fatalf("could not load signing keys: %v", err)
+	}
+	go srv.runStoreSync(ctx, storeSyncInterval)
 
 	log.Printf("Running tsidp at %s ...", srv.serverURL)
 
@@ -343,13 +357,28 @@ type idpServer struct {
 	rootPath                  string // root path, used for storing state files
 	allowInsecureRegistration bool   // If true, allow OAuth without pre-registered clients
 
-	lazyMux        lazy.SyncValue[*http.ServeMux]
-	lazySigningKey lazy.SyncValue[*signingKey]
-	lazySigner     lazy.SyncValue[jose.Signer]
+	// store persists clients, signing keys and issued tokens. If nil,
+	// as in tests, tokens are only kept in memory.
+	store       idpStore
+	keyRotation time.Duration // how often to rotate signing keys, or 0 to never
+
+	// refreshTokenTTL is how long refresh tokens are valid for. If zero,
+	// no refresh tokens are issued.
+	refreshTokenTTL time.Duration
+
+	// tokenExchangeAudiences are the audiences, other than registered
+	// client IDs, that token exchange may issue tokens for.
+	tokenExchangeAudiences []string
+
+	lazyMux lazy.SyncValue[*http.ServeMux]
+
+	keyMu       sync.Mutex
+	signingKeys []*signingKey // oldest first; the newest is used for signing
 
 	mu            sync.Mutex               // guards the fields below
-	code          map[string]*authRequest  // keyed by random hex
-	accessToken   map[string]*authRequest  // keyed by random hex
+	code          map[string]*authRequest  // keyed by random hex; only used if store is nil
+	accessToken   map[string]*authRequest  // keyed by random hex; only used if store is nil
+	refreshToken  map[string]*authRequest  // keyed by random hex; only used if store is nil
 	funnelClients map[string]*funnelClient // keyed by client ID
 }
 
@@ -381,10 +410,19 @@ type authRequest struct {
 	// remoteUser is the user who is being authenticated.
 	remoteUser *apitype.WhoIsResponse
 
-	// validTill is the time until which the token is valid.
-	// As of 2023-11-14, it is 5 minutes.
-	// TODO: add routine to delete expired tokens.
+	// validTill is the time until which the code or token is valid.
+	// As of 2023-11-14, it is 5 minutes for codes and access tokens, and
+	// refreshTokenTTL from the authorization code grant for refresh
+	// tokens, which keep it when rotated. Expired codes and tokens are
+	// deleted by runStoreSync.
 	validTill time.Time
+
+	// codeChallenge and codeChallengeMethod are the RFC 7636 PKCE
+	// code_challenge and code_challenge_method presented in the request.
+	// They're only set for codes, and are empty if the client didn't use
+	// PKCE.
+	codeChallenge       string
+	codeChallengeMethod string
 }
 
 // allowRelyingParty validates that a relying party identified either by a
@@ -473,6 +511,16 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		codeChallenge, codeChallengeMethod, err := parseCodeChallenge(uq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c.isPublic() && codeChallenge == "" {
+			http.Error(w, "tsidp: public clients must use PKCE", http.StatusBadRequest)
+			return
+		}
+
 		// Get user information
 		var remoteAddr string
 		if s.localTSMode {
@@ -483,7 +531,6 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 
 		// Check who is visiting the authorize endpoint.
 		var who *apitype.WhoIsResponse
-		var err error
 		who, err = s.lc.WhoIs(r.Context(), remoteAddr)
 		if err != nil {
 			log.Printf("Error getting WhoIs: %v", err)
@@ -498,11 +545,17 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 			redirectURI: redirectURI,
 			clientID:    clientID,
 			funnelRP:    c, // Store the validated client
+			validTill:   time.Now().Add(5 * time.Minute),
+
+			codeChallenge:       codeChallenge,
+			codeChallengeMethod: codeChallengeMethod,
 		}
 
-		s.mu.Lock()
-		mak.Set(&s.code, code, ar)
-		s.mu.Unlock()
+		if err := s.saveToken(tokenKindCode, code, ar); err != nil {
+			log.Printf("Error saving code: %v", err)
+			http.Error(w, "tsidp: could not save code", http.StatusInternalServerError)
+			return
+		}
 
 		q := make(url.Values)
 		q.Set("code", code)
@@ -522,6 +575,12 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	codeChallenge, codeChallengeMethod, err := parseCodeChallenge(uq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var remoteAddr string
 	if s.localTSMode {
 		// in local tailscaled mode, the local tailscaled is forwarding us
@@ -544,6 +603,10 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 		remoteUser:  who,
 		redirectURI: redirectURI,
 		clientID:    clientID,
+		validTill:   time.Now().Add(5 * time.Minute),
+
+		codeChallenge:       codeChallenge,
+		codeChallengeMethod: codeChallengeMethod,
 	}
 
 	if r.URL.Path == "/authorize/funnel" {
@@ -558,6 +621,10 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "tsidp: redirect_uri mismatch", http.StatusBadRequest)
 			return
 		}
+		if c.isPublic() && codeChallenge == "" {
+			http.Error(w, "tsidp: public clients must use PKCE", http.StatusBadRequest)
+			return
+		}
 		ar.funnelRP = c
 	} else if r.URL.Path == "/authorize/localhost" {
 		ar.localRP = true
@@ -570,9 +637,11 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	s.mu.Lock()
-	mak.Set(&s.code, code, ar)
-	s.mu.Unlock()
+	if err := s.saveToken(tokenKindCode, code, ar); err != nil {
+		log.Printf("Error saving code: %v", err)
+		http.Error(w, "tsidp: could not save code", http.StatusInternalServerError)
+		return
+	}
 
 	q := make(url.Values)
 	q.Set("code", code)
@@ -604,6 +673,8 @@ func (s *idpServer) newMux() *http.ServeMux {
 	}
 	mux.HandleFunc("/userinfo", s.serveUserInfo)
 	mux.HandleFunc("/token", s.serveToken)
+	mux.HandleFunc("/introspect", s.serveIntrospect)
+	mux.HandleFunc("/revoke", s.serveRevoke)
 	mux.HandleFunc("/clients/", s.serveClients)
 	mux.HandleFunc("/", s.handleUI)
 	return mux
@@ -625,9 +696,7 @@ func (s *idpServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.mu.Lock()
-	ar, ok := s.accessToken[tk]
-	s.mu.Unlock()
+	ar, ok := s.lookupToken(tokenKindAccess, tk)
 	if !ok {
 		http.Error(w, "tsidp: invalid token", http.StatusBadRequest)
 		return
@@ -635,9 +704,7 @@ func (s *idpServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 
 	if ar.validTill.Before(time.Now()) {
 		http.Error(w, "tsidp: token expired", http.StatusBadRequest)
-		s.mu.Lock()
-		delete(s.accessToken, tk)
-		s.mu.Unlock()
+		s.deleteToken(tokenKindAccess, tk)
 		return
 	}
 
@@ -846,81 +913,317 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if r.FormValue("grant_type") != "authorization_code" {
+	switch gt := r.FormValue("grant_type"); {
+	case gt == "authorization_code":
+		s.serveAuthorizationCodeGrant(w, r)
+	case gt == "refresh_token" && s.refreshTokenTTL > 0:
+		s.serveRefreshTokenGrant(w, r)
+	case gt == grantTypeTokenExchange:
+		s.serveTokenExchange(w, r)
+	default:
 		http.Error(w, "tsidp: grant_type not supported", http.StatusBadRequest)
-		return
 	}
+}
+
+func (s *idpServer) serveAuthorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
 	code := r.FormValue("code")
 	if code == "" {
 		http.Error(w, "tsidp: code is required", http.StatusBadRequest)
 		return
 	}
-	s.mu.Lock()
-	ar, ok := s.code[code]
-	if ok {
-		delete(s.code, code)
-	}
-	s.mu.Unlock()
+	ar, ok := s.takeToken(tokenKindCode, code)
 	if !ok {
 		http.Error(w, "tsidp: code not found", http.StatusBadRequest)
 		return
 	}
+	if status, err := s.authenticateClient(r, ar); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if ar.redirectURI != r.FormValue("redirect_uri") {
+		http.Error(w, "tsidp: redirect_uri mismatch", http.StatusBadRequest)
+		return
+	}
+	if err := ar.verifyCodeVerifier(r.FormValue("code_verifier")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.issueTokens(w, ar, time.Now().Add(s.refreshTokenTTL))
+}
 
-	if !s.allowInsecureRegistration {
-		// When insecure registration is NOT allowed, always validate client credentials regardless of request source
-		clientID := r.FormValue("client_id")
-		clientSecret := r.FormValue("client_secret")
-
-		// Try basic auth if form values are empty
-		if clientID == "" || clientSecret == "" {
-			if basicClientID, basicClientSecret, ok := r.BasicAuth(); ok {
-				if clientID == "" {
-					clientID = basicClientID
-				}
-				if clientSecret == "" {
-					clientSecret = basicClientSecret
-				}
-			}
-		}
+func (s *idpServer) serveRefreshTokenGrant(w http.ResponseWriter, r *http.Request) {
+	rt := r.FormValue("refresh_token")
+	if rt == "" {
+		http.Error(w, "tsidp: refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	ar, ok := s.lookupToken(tokenKindRefresh, rt)
+	if !ok {
+		http.Error(w, "tsidp: invalid refresh token", http.StatusBadRequest)
+		return
+	}
+	if ar.validTill.Before(time.Now()) {
+		http.Error(w, "tsidp: refresh token expired", http.StatusBadRequest)
+		s.deleteToken(tokenKindRefresh, rt)
+		return
+	}
+	if status, err := s.authenticateClient(r, ar); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// Refresh tokens are single use; a new one is issued with each
+	// response. Only take it once the client is authenticated, so that
+	// a bad request doesn't invalidate it.
+	if _, ok := s.takeToken(tokenKindRefresh, rt); !ok {
+		http.Error(w, "tsidp: invalid refresh token", http.StatusBadRequest)
+		return
+	}
+	// The user may have been removed, or the node deleted or expired,
+	// since they authenticated.
+	who, err := s.revalidateRemoteUser(r.Context(), ar.remoteUser)
+	if err != nil {
+		log.Printf("tsidp: not refreshing tokens: %v", err)
+		http.Error(w, "tsidp: invalid refresh token", http.StatusBadRequest)
+		return
+	}
+	ar.remoteUser = who
+	// The new refresh token expires when the one it replaces would have,
+	// so that refreshing doesn't extend the authentication.
+	s.issueTokens(w, ar, ar.validTill)
+}
 
-		if clientID == "" || clientSecret == "" {
-			http.Error(w, "tsidp: client credentials required in when insecure registration is not allowed", http.StatusUnauthorized)
-			return
-		}
+// revalidateRemoteUser checks that the node and user of who, from the
+// authentication that a refresh token was issued for, are still on the
+// tailnet. It returns the current WhoIs response for the node.
+func (s *idpServer) revalidateRemoteUser(ctx context.Context, who *apitype.WhoIsResponse) (*apitype.WhoIsResponse, error) {
+	if who == nil || who.Node == nil || len(who.Node.Addresses) == 0 {
+		return nil, errors.New("no node address to check")
+	}
+	cur, err := s.lc.WhoIs(ctx, who.Node.Addresses[0].Addr().String())
+	if err != nil {
+		return nil, fmt.Errorf("WhoIs node %v: %w", who.Node.ID, err)
+	}
+	switch {
+	case cur.Node == nil || cur.Node.ID != who.Node.ID:
+		return nil, fmt.Errorf("node %v no longer exists", who.Node.ID)
+	case cur.Node.IsTagged() || cur.Node.User != who.Node.User:
+		return nil, fmt.Errorf("node %v no longer belongs to user %v", who.Node.ID, who.Node.User)
+	case cur.Node.Expired:
+		return nil, fmt.Errorf("node %v is expired", who.Node.ID)
+	}
+	return cur, nil
+}
 
-		// Validate against the stored auth request
-		if ar.clientID != clientID {
-			http.Error(w, "tsidp: client_id mismatch", http.StatusBadRequest)
-			return
-		}
+// RFC 8693 token exchange grant and token types.
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
 
-		// Validate client credentials against stored clients
-		if ar.funnelRP == nil {
-			http.Error(w, "tsidp: no client information found", http.StatusBadRequest)
-			return
-		}
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+)
 
-		clientIDcmp := subtle.ConstantTimeCompare([]byte(clientID), []byte(ar.funnelRP.ID))
-		clientSecretcmp := subtle.ConstantTimeCompare([]byte(clientSecret), []byte(ar.funnelRP.Secret))
-		if clientIDcmp != 1 || clientSecretcmp != 1 {
-			http.Error(w, "tsidp: invalid client credentials", http.StatusUnauthorized)
+// jwtTypeAccessToken is the JWT "typ" header of access tokens issued by
+// token exchange, from RFC 9068, so that they can't be mistaken for ID
+// tokens.
+const jwtTypeAccessToken = "at+jwt"
+
+// tokenExchangeResponse is an RFC 8693 token exchange response.
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+}
+
+// serveTokenExchange implements the RFC 8693 token exchange grant, for
+// workloads on the tailnet to get a token asserting their identity to other
+// services without a browser flow.
+//
+// The subject is the tailnet identity of the caller, from WhoIs, rather
+// than a subject_token. The issued token is an RFC 9068 JWT access token
+// restricted to the requested audiences, which must be registered client
+// IDs or in tokenExchangeAudiences. It has the same tailscaleClaims and
+// capRule extra claims as ID tokens, and the audiences verify it with the
+// JWKS. Tagged nodes, which are the usual workloads, get tokens for the
+// node, with its stable ID as the subject and its tags in the tags claim.
+func (s *idpServer) serveTokenExchange(w http.ResponseWriter, r *http.Request) {
+	if isFunnelRequest(r) {
+		http.Error(w, "tsidp: token exchange is only available on the tailnet", http.StatusUnauthorized)
+		return
+	}
+	if r.FormValue("subject_token") != "" || r.FormValue("actor_token") != "" {
+		http.Error(w, "tsidp: subject_token and actor_token are not supported; the subject is the calling node", http.StatusBadRequest)
+		return
+	}
+	// RFC 8693 has both audience (logical names) and resource (URIs)
+	// parameters; both become audiences of the token.
+	aud := append(jwt.Audience{}, r.Form["audience"]...)
+	aud = append(aud, r.Form["resource"]...)
+	if len(aud) == 0 {
+		http.Error(w, "tsidp: audience is required", http.StatusBadRequest)
+		return
+	}
+	for _, a := range aud {
+		if !s.isTokenExchangeAudience(a) {
+			http.Error(w, fmt.Sprintf("tsidp: audience %q not allowed", a), http.StatusBadRequest)
 			return
 		}
+	}
+	issuedTokenType := r.FormValue("requested_token_type")
+	switch issuedTokenType {
+	case "":
+		issuedTokenType = tokenTypeAccessToken
+	case tokenTypeAccessToken, tokenTypeJWT:
+	default:
+		http.Error(w, "tsidp: unsupported requested_token_type", http.StatusBadRequest)
+		return
+	}
+
+	var remoteAddr string
+	if s.localTSMode {
+		remoteAddr = r.Header.Get("X-Forwarded-For")
 	} else {
+		remoteAddr = r.RemoteAddr
+	}
+	who, err := s.lc.WhoIs(r.Context(), remoteAddr)
+	if err != nil {
+		log.Printf("Error getting WhoIs: %v", err)
+		http.Error(w, "tsidp: could not identify caller", http.StatusForbidden)
+		return
+	}
+
+	signer, err := s.signer(jwtTypeAccessToken)
+	if err != nil {
+		log.Printf("Error getting signer: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	tsClaims := newTailscaleClaims(who, jwt.Claims{
+		Audience:  aud,
+		Expiry:    jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		ID:        rands.HexString(32),
+		IssuedAt:  jwt.NewNumericDate(now),
+		Issuer:    s.serverURL,
+		NotBefore: jwt.NewNumericDate(now),
+	})
+
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, tailcfg.PeerCapabilityTsIDP)
+	if err != nil {
+		log.Printf("tsidp: failed to unmarshal capability: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tsClaimsWithExtra, err := withExtraClaims(tsClaims, rules)
+	if err != nil {
+		log.Printf("tsidp: failed to merge extra claims: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := jwt.Signed(signer).Claims(tsClaimsWithExtra).CompactSerialize()
+	if err != nil {
+		log.Printf("Error getting token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokenExchangeResponse{
+		AccessToken:     token,
+		IssuedTokenType: issuedTokenType,
+		TokenType:       "Bearer",
+		ExpiresIn:       5 * 60,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// isTokenExchangeAudience reports whether token exchange may issue tokens
+// for aud, a registered client ID or one of s.tokenExchangeAudiences.
+func (s *idpServer) isTokenExchangeAudience(aud string) bool {
+	if slices.Contains(s.tokenExchangeAudiences, aud) {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.funnelClients[aud]
+	return ok
+}
+
+// clientCredentials returns the client_id and client_secret of r, from the
+// form or, if either is missing there, from HTTP Basic authentication.
+func clientCredentials(r *http.Request) (clientID, clientSecret string) {
+	clientID = r.FormValue("client_id")
+	clientSecret = r.FormValue("client_secret")
+
+	// Try basic auth if form values are empty
+	if clientID == "" || clientSecret == "" {
+		if basicClientID, basicClientSecret, ok := r.BasicAuth(); ok {
+			if clientID == "" {
+				clientID = basicClientID
+			}
+			if clientSecret == "" {
+				clientSecret = basicClientSecret
+			}
+		}
+	}
+	return clientID, clientSecret
+}
+
+// authenticateClient checks that r comes from the relying party that the
+// code or token for ar was issued to. If not, it returns an error and the
+// HTTP status code to respond with.
+func (s *idpServer) authenticateClient(r *http.Request, ar *authRequest) (int, error) {
+	if s.allowInsecureRegistration {
 		// Original behavior when insecure registration is allowed
 		// Only checks ClientID and Client Secret when over funnel.
 		// Local connections are allowed and tailnet connections only check matching nodeIDs.
 		if err := ar.allowRelyingParty(r, s.lc); err != nil {
 			log.Printf("Error allowing relying party: %v", err)
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
+			return http.StatusForbidden, err
 		}
+		return 0, nil
 	}
 
-	if ar.redirectURI != r.FormValue("redirect_uri") {
-		http.Error(w, "tsidp: redirect_uri mismatch", http.StatusBadRequest)
-		return
+	// When insecure registration is NOT allowed, always validate client credentials regardless of request source
+	clientID, clientSecret := clientCredentials(r)
+	if clientID == "" {
+		return http.StatusUnauthorized, errors.New("tsidp: client credentials required in when insecure registration is not allowed")
+	}
+
+	// Validate against the stored auth request
+	if ar.clientID != clientID {
+		return http.StatusBadRequest, errors.New("tsidp: client_id mismatch")
 	}
+
+	// Validate client credentials against stored clients
+	if ar.funnelRP == nil {
+		return http.StatusBadRequest, errors.New("tsidp: no client information found")
+	}
+	if ar.funnelRP.isPublic() {
+		// Public clients have no secret. Their codes are bound to the
+		// client with PKCE instead.
+		if clientSecret != "" {
+			return http.StatusUnauthorized, errors.New("tsidp: invalid client credentials")
+		}
+		return 0, nil
+	}
+	if clientSecret == "" {
+		return http.StatusUnauthorized, errors.New("tsidp: client credentials required in when insecure registration is not allowed")
+	}
+
+	clientIDcmp := subtle.ConstantTimeCompare([]byte(clientID), []byte(ar.funnelRP.ID))
+	clientSecretcmp := subtle.ConstantTimeCompare([]byte(clientSecret), []byte(ar.funnelRP.Secret))
+	if clientIDcmp != 1 || clientSecretcmp != 1 {
+		return http.StatusUnauthorized, errors.New("tsidp: invalid client credentials")
+	}
+	return 0, nil
+}
+
+// issueTokens responds to a successful token request for ar with a new ID
+// token and access token and, if refresh tokens are enabled, a new refresh
+// token valid until refreshValidTill.
+func (s *idpServer) issueTokens(w http.ResponseWriter, ar *authRequest, refreshValidTill time.Time) {
 	signer, err := s.oidcSigner()
 	if err != nil {
 		log.Printf("Error getting signer: %v", err)
@@ -929,37 +1232,21 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 	}
 	jti := rands.HexString(32)
 	who := ar.remoteUser
-
-	// TODO(maisem): not sure if this is the right thing to do
-	userName, _, _ := strings.Cut(ar.remoteUser.UserProfile.LoginName, "@")
-	n := who.Node.View()
-	if n.IsTagged() {
+	if who.Node.IsTagged() {
 		http.Error(w, "tsidp: tagged nodes not supported", http.StatusBadRequest)
 		return
 	}
 
 	now := time.Now()
-	_, tcd, _ := strings.Cut(n.Name(), ".")
-	tsClaims := tailscaleClaims{
-		Claims: jwt.Claims{
-			Audience:  jwt.Audience{ar.clientID},
-			Expiry:    jwt.NewNumericDate(now.Add(5 * time.Minute)),
-			ID:        jti,
-			IssuedAt:  jwt.NewNumericDate(now),
-			Issuer:    s.serverURL,
-			NotBefore: jwt.NewNumericDate(now),
-			Subject:   n.User().String(),
-		},
-		Nonce:     ar.nonce,
-		Key:       n.Key(),
-		Addresses: n.Addresses(),
-		NodeID:    n.ID(),
-		NodeName:  n.Name(),
-		Tailnet:   tcd,
-		UserID:    n.User(),
-		Email:     who.UserProfile.LoginName,
-		UserName:  userName,
-	}
+	tsClaims := newTailscaleClaims(who, jwt.Claims{
+		Audience:  jwt.Audience{ar.clientID},
+		Expiry:    jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		ID:        jti,
+		IssuedAt:  jwt.NewNumericDate(now),
+		Issuer:    s.serverURL,
+		NotBefore: jwt.NewNumericDate(now),
+	})
+	tsClaims.Nonce = ar.nonce
 	if ar.localRP {
 		tsClaims.Issuer = s.loopbackURL
 	}
@@ -986,23 +1273,254 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The PKCE challenge only applied to redeeming the code.
+	ar.codeChallenge, ar.codeChallengeMethod = "", ""
+
 	at := rands.HexString(32)
-	s.mu.Lock()
 	ar.validTill = now.Add(5 * time.Minute)
-	mak.Set(&s.accessToken, at, ar)
-	s.mu.Unlock()
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(oidcTokenResponse{
+	if err := s.saveToken(tokenKindAccess, at, ar); err != nil {
+		log.Printf("Error saving access token: %v", err)
+		http.Error(w, "tsidp: could not save access token", http.StatusInternalServerError)
+		return
+	}
+	resp := oidcTokenResponse{
 		AccessToken: at,
 		TokenType:   "Bearer",
 		ExpiresIn:   5 * 60,
 		IDToken:     token,
-	}); err != nil {
+	}
+
+	if s.refreshTokenTTL > 0 {
+		rt := rands.HexString(32)
+		rar := *ar
+		// ID tokens issued on refresh don't carry the nonce of the
+		// original authentication request.
+		rar.nonce = ""
+		rar.validTill = refreshValidTill
+		if err := s.saveToken(tokenKindRefresh, rt, &rar); err != nil {
+			log.Printf("Error saving refresh token: %v", err)
+			http.Error(w, "tsidp: could not save refresh token", http.StatusInternalServerError)
+			return
+		}
+		resp.RefreshToken = rt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// PKCE code challenge methods, as defined in RFC 7636.
+const (
+	codeChallengeMethodPlain = "plain"
+	codeChallengeMethodS256  = "S256"
+)
+
+// parseCodeChallenge returns the RFC 7636 PKCE code_challenge and
+// code_challenge_method of the authorization request with query q. They're
+// empty if the client isn't using PKCE.
+func parseCodeChallenge(q url.Values) (challenge, method string, err error) {
+	challenge = q.Get("code_challenge")
+	method = q.Get("code_challenge_method")
+	if challenge == "" {
+		if method != "" {
+			return "", "", errors.New("tsidp: code_challenge_method without code_challenge")
+		}
+		return "", "", nil
+	}
+	switch method {
+	case "":
+		// RFC 7636, section 4.3: defaults to "plain" if not present.
+		method = codeChallengeMethodPlain
+	case codeChallengeMethodPlain, codeChallengeMethodS256:
+	default:
+		return "", "", fmt.Errorf("tsidp: unsupported code_challenge_method %q", method)
+	}
+	if !validPKCEString(challenge) {
+		return "", "", errors.New("tsidp: invalid code_challenge")
+	}
+	return challenge, method, nil
+}
+
+// validPKCEString reports whether v is a syntactically valid PKCE
+// code_verifier, or code_challenge (which has the same syntax): 43 to 128
+// characters from the unreserved URI characters. See RFC 7636, section 4.1.
+func validPKCEString(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+	for _, c := range []byte(v) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// verifyCodeVerifier checks the PKCE code_verifier presented when redeeming
+// the code issued for ar against the code_challenge presented when it was
+// requested.
+func (ar *authRequest) verifyCodeVerifier(verifier string) error {
+	if ar.codeChallenge == "" {
+		if verifier != "" {
+			// Per OAuth 2.1, reject rather than ignore this, so that an
+			// attacker can't strip the challenge from the authorization
+			// request and still redeem the code.
+			return errors.New("tsidp: code_verifier without code_challenge")
+		}
+		return nil
+	}
+	if !validPKCEString(verifier) {
+		return errors.New("tsidp: invalid code_verifier")
+	}
+	want := verifier
+	if ar.codeChallengeMethod == codeChallengeMethodS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		want = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(ar.codeChallenge)) != 1 {
+		return errors.New("tsidp: code_verifier mismatch")
+	}
+	return nil
+}
+
+// tokenKindsForHint returns the kinds of token to look for given an RFC 7009
+// or RFC 7662 token_type_hint, most likely first.
+func tokenKindsForHint(hint string) []tokenKind {
+	if hint == "refresh_token" {
+		return []tokenKind{tokenKindRefresh, tokenKindAccess}
+	}
+	return []tokenKind{tokenKindAccess, tokenKindRefresh}
+}
+
+// introspectionResponse is an RFC 7662 token introspection response.
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+}
+
+// serveIntrospect implements RFC 7662 token introspection, so that resource
+// servers such as API gateways can check access and refresh tokens issued by
+// tsidp. Callers must authenticate as a registered client with a secret.
+func (s *idpServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isConfidentialClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tsidp"`)
+		http.Error(w, "tsidp: invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+	tk := r.FormValue("token")
+	if tk == "" {
+		http.Error(w, "tsidp: token is required", http.StatusBadRequest)
+		return
+	}
+
+	var resp introspectionResponse
+	now := time.Now()
+	for _, kind := range tokenKindsForHint(r.FormValue("token_type_hint")) {
+		ar, ok := s.lookupToken(kind, tk)
+		if !ok {
+			continue
+		}
+		if ar.validTill.Before(now) {
+			break
+		}
+		if !s.allowInsecureRegistration {
+			// As in serveUserInfo, tokens of deleted clients are no
+			// longer valid.
+			s.mu.Lock()
+			_, clientExists := s.funnelClients[ar.clientID]
+			s.mu.Unlock()
+			if !clientExists {
+				break
+			}
+		}
+		resp = introspectionResponse{
+			Active:   true,
+			ClientID: ar.clientID,
+			Exp:      ar.validTill.Unix(),
+			Sub:      ar.remoteUser.Node.User.String(),
+			Aud:      ar.clientID,
+			Iss:      s.serverURL,
+		}
+		if kind == tokenKindAccess {
+			resp.TokenType = "Bearer"
+		}
+		if ar.localRP {
+			resp.Iss = s.loopbackURL
+		}
+		if up := ar.remoteUser.UserProfile; up != nil {
+			resp.Username = up.LoginName
+		}
+		break
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// isConfidentialClient reports whether r carries the credentials of a
+// registered client that has a secret.
+func (s *idpServer) isConfidentialClient(r *http.Request) bool {
+	clientID, clientSecret := clientCredentials(r)
+	if clientID == "" || clientSecret == "" {
+		return false
+	}
+	s.mu.Lock()
+	c, ok := s.funnelClients[clientID]
+	s.mu.Unlock()
+	if !ok || c.isPublic() {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(clientSecret), []byte(c.Secret)) == 1
+}
+
+// serveRevoke implements RFC 7009 token revocation. Clients may revoke the
+// access and refresh tokens issued to them. Revoking a refresh token doesn't
+// revoke access tokens previously issued with it, which expire within
+// minutes anyway.
+func (s *idpServer) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tk := r.FormValue("token")
+	if tk == "" {
+		http.Error(w, "tsidp: token is required", http.StatusBadRequest)
+		return
+	}
+	for _, kind := range tokenKindsForHint(r.FormValue("token_type_hint")) {
+		ar, ok := s.lookupToken(kind, tk)
+		if !ok {
+			continue
+		}
+		if status, err := s.authenticateClient(r, ar); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		s.deleteToken(kind, tk)
+		break
+	}
+	// Per RFC 7009, section 2.2, unknown and already invalid tokens
+	// aren't an error.
+	w.WriteHeader(http.StatusOK)
+}
+
 type oidcTokenResponse struct {
 	IDToken      string `json:"id_token"`
 	TokenType    string `json:"token_type"`
@@ -1016,49 +1534,118 @@ type oidcTokenResponse struct {
 	oidcConfigPath = "/.well-known/openid-configuration"
 )
 
+// oidcSigner returns a signer for ID tokens, using the newest signing key.
 func (s *idpServer) oidcSigner() (jose.Signer, error) {
-	return s.lazySigner.GetErr(func() (jose.Signer, error) {
-		sk, err := s.oidcPrivateKey()
-		if err != nil {
-			return nil, err
-		}
-		return jose.NewSigner(jose.SigningKey{
-			Algorithm: jose.RS256,
-			Key:       sk.k,
-		}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
-			jose.HeaderType: "JWT",
-			"kid":           fmt.Sprint(sk.kid),
-		}})
-	})
+	return s.signer("JWT")
 }
 
-func (s *idpServer) oidcPrivateKey() (*signingKey, error) {
-	return s.lazySigningKey.GetErr(func() (*signingKey, error) {
-		keyPath, err := getConfigFilePath(s.rootPath, oidcKeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("could not get OIDC key file path: %w", err)
+// signer returns a signer for JWTs with the "typ" header typ, with the
+// current signing key.
+func (s *idpServer) signer(typ string) (jose.Signer, error) {
+	keys := s.currentSigningKeys()
+	sk := keys[len(keys)-1]
+	return jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       sk.k,
+	}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
+		jose.HeaderType: typ,
+		"kid":           fmt.Sprint(sk.kid),
+	}})
+}
+
+// currentSigningKeys returns the current signing keys, oldest first.
+// The returned slice must not be modified.
+func (s *idpServer) currentSigningKeys() []*signingKey {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if len(s.signingKeys) == 0 {
+		// Keys weren't loaded from a store, as in tests.
+		// Use an ephemeral key.
+		s.signingKeys = []*signingKey{newSigningKey(time.Now())}
+	}
+	return s.signingKeys
+}
+
+// rotateSigningKeys reloads the signing keys from s.store, generating the
+// first key if there are none, and rotates them if needed (see rotatedKeys).
+func (s *idpServer) rotateSigningKeys(now time.Time) error {
+	keys, err := s.store.LoadSigningKeys()
+	if err != nil {
+		return err
+	}
+	if rotated := rotatedKeys(keys, now, s.keyRotation); !slices.Equal(rotated, keys) {
+		if err := s.store.SaveSigningKeys(rotated); err != nil {
+			return err
 		}
-		var sk signingKey
-		b, err := os.ReadFile(keyPath)
-		if err == nil {
-			if err := sk.UnmarshalJSON(b); err == nil {
-				return &sk, nil
-			} else {
-				log.Printf("Error unmarshaling key: %v", err)
-			}
+		if len(keys) > 0 {
+			log.Printf("rotated OIDC signing key; now using kid %d", rotated[len(rotated)-1].kid)
 		}
-		id, k := mustGenRSAKey(2048)
-		sk.k = k
-		sk.kid = id
-		b, err = sk.MarshalJSON()
-		if err != nil {
-			log.Fatalf("Error marshaling key: %v", err)
+		// Read back what was saved: if another replica sharing the store
+		// rotated at the same time, only one of the new keys won.
+		if keys, err = s.store.LoadSigningKeys(); err != nil {
+			return err
 		}
-		if err := os.WriteFile(keyPath, b, 0600); err != nil {
-			log.Fatalf("Error writing key: %v", err)
+	}
+	if len(keys) == 0 {
+		return errors.New("no signing keys in store")
+	}
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	s.signingKeys = keys
+	return nil
+}
+
+// rotatedKeys returns keys, oldest first, as they should be at now when
+// rotating every period. If keys is empty, it returns a new key.
+//
+// If period is positive and the newest key is at least period old, a new key
+// is added. Keys superseded at least period ago are dropped; until then,
+// they remain published in the JWKS so tokens they signed can be verified.
+func rotatedKeys(keys []*signingKey, now time.Time, period time.Duration) []*signingKey {
+	if len(keys) == 0 {
+		return []*signingKey{newSigningKey(now)}
+	}
+	if period <= 0 || now.Sub(keys[len(keys)-1].created) < period {
+		return keys
+	}
+	keys = append(slices.Clip(keys), newSigningKey(now))
+	var kept []*signingKey
+	for i, sk := range keys {
+		// keys[i] was superseded when keys[i+1] was created.
+		if i == len(keys)-1 || now.Sub(keys[i+1].created) < period {
+			kept = append(kept, sk)
 		}
-		return &sk, nil
-	})
+	}
+	return kept
+}
+
+// storeSyncInterval is how often runStoreSync runs.
+const storeSyncInterval = time.Minute
+
+// runStoreSync periodically reloads the clients and signing keys from
+// s.store, which other tsidp replicas may have changed, rotates the signing
+// keys and deletes expired tokens, until ctx is done.
+func (s *idpServer) runStoreSync(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if clients, err := s.store.LoadClients(); err != nil {
+				log.Printf("Error reloading OAuth clients: %v", err)
+			} else {
+				s.mu.Lock()
+				s.funnelClients = clients
+				s.mu.Unlock()
+			}
+			if err := s.rotateSigningKeys(now); err != nil {
+				log.Printf("Error rotating signing keys: %v", err)
+			}
+			s.deleteExpiredTokens(now)
+		}
+	}
 }
 
 func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
@@ -1067,25 +1654,18 @@ func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	sk, err := s.oidcPrivateKey()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var jwks jose.JSONWebKeySet
+	for _, sk := range s.currentSigningKeys() {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{
+			Key:       sk.k.Public(),
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+			KeyID:     fmt.Sprint(sk.kid),
+		})
 	}
-	// TODO(maisem): maybe only marshal this once and reuse?
-	// TODO(maisem): implement key rotation.
 	je := json.NewEncoder(w)
 	je.SetIndent("", "  ")
-	if err := je.Encode(jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{
-			{
-				Key:       sk.k.Public(),
-				Algorithm: string(jose.RS256),
-				Use:       "sig",
-				KeyID:     fmt.Sprint(sk.kid),
-			},
-		},
-	}); err != nil {
+	if err := je.Encode(jwks); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -1103,6 +1683,10 @@ type openIDProviderMetadata struct {
 	SubjectTypesSupported            views.Slice[string] `json:"subject_types_supported"`
 	ClaimsSupported                  views.Slice[string] `json:"claims_supported"`
 	IDTokenSigningAlgValuesSupported views.Slice[string] `json:"id_token_signing_alg_values_supported"`
+	GrantTypesSupported              views.Slice[string] `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported    views.Slice[string] `json:"code_challenge_methods_supported"`
+	IntrospectionEndpoint            string              `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint               string              `json:"revocation_endpoint,omitempty"`
 	// TODO(maisem): maybe add other fields?
 	// Currently we fill out the REQUIRED fields, scopes_supported and claims_supported.
 }
@@ -1115,6 +1699,7 @@ type tailscaleClaims struct {
 	NodeID     tailcfg.NodeID            `json:"nid"`             // the stable node ID
 	NodeName   string                    `json:"node"`            // name of the node
 	Tailnet    string                    `json:"tailnet"`         // tailnet (like tail-scale.ts.net)
+	Tags       []string                  `json:"tags,omitempty"`  // the ACL tags of the node, if tagged
 
 	// Email is the "emailish" value with an '@' sign. It might not be a valid email.
 	Email  string         `json:"email,omitempty"` // user emailish (like "alice@github" or "bob@example.com")
@@ -1126,6 +1711,35 @@ type tailscaleClaims struct {
 	UserName string `json:"username,omitempty"`
 }
 
+// newTailscaleClaims returns the claims about the node and user of who, along
+// with the registered claims. The subject is the user or, for tagged nodes,
+// which don't belong to a user, the node's stable ID.
+func newTailscaleClaims(who *apitype.WhoIsResponse, claims jwt.Claims) tailscaleClaims {
+	n := who.Node.View()
+	_, tcd, _ := strings.Cut(n.Name(), ".")
+	tc := tailscaleClaims{
+		Claims:    claims,
+		Key:       n.Key(),
+		Addresses: n.Addresses(),
+		NodeID:    n.ID(),
+		NodeName:  n.Name(),
+		Tailnet:   tcd,
+	}
+	if n.IsTagged() {
+		tc.Subject = string(n.StableID())
+		tc.Tags = n.Tags().AsSlice()
+		return tc
+	}
+
+	// TODO(maisem): not sure if this is the right thing to do
+	userName, _, _ := strings.Cut(who.UserProfile.LoginName, "@")
+	tc.Subject = n.User().String()
+	tc.UserID = n.User()
+	tc.Email = who.UserProfile.LoginName
+	tc.UserName = userName
+	return tc
+}
+
 var (
 	openIDSupportedClaims = views.SliceOf([]string{
 		// Standard claims, these correspond to fields in jwt.Claims.
@@ -1148,6 +1762,9 @@ type tailscaleClaims struct {
 	// The algo used for signing. The OpenID spec says "The algorithm RS256 MUST be included."
 	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
 	openIDSupportedSigningAlgos = views.SliceOf([]string{string(jose.RS256)})
+
+	// The RFC 7636 PKCE code challenge methods we support.
+	openIDSupportedCodeChallengeMethods = views.SliceOf([]string{codeChallengeMethodS256, codeChallengeMethodPlain})
 )
 
 func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
@@ -1201,6 +1818,12 @@ func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	grantTypes := []string{"authorization_code"}
+	if s.refreshTokenTTL > 0 {
+		grantTypes = append(grantTypes, "refresh_token")
+	}
+	grantTypes = append(grantTypes, grantTypeTokenExchange)
+
 	w.Header().Set("Content-Type", "application/json")
 	je := json.NewEncoder(w)
 	je.SetIndent("", "  ")
@@ -1215,6 +1838,10 @@ func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
 		SubjectTypesSupported:            openIDSupportedSubjectTypes,
 		ClaimsSupported:                  openIDSupportedClaims,
 		IDTokenSigningAlgValuesSupported: openIDSupportedSigningAlgos,
+		GrantTypesSupported:              views.SliceOf(grantTypes),
+		CodeChallengeMethodsSupported:    openIDSupportedCodeChallengeMethods,
+		IntrospectionEndpoint:            rpEndpoint + "/introspect",
+		RevocationEndpoint:               rpEndpoint + "/revoke",
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -1229,6 +1856,13 @@ type funnelClient struct {
 	RedirectURI string `json:"redirect_uri"`
 }
 
+// isPublic reports whether c is a public client, such as a CLI tool or a
+// single-page app, that can't keep a secret. Public clients have no secret
+// and must use PKCE.
+func (c *funnelClient) isPublic() bool {
+	return c.Secret == ""
+}
+
 // /clients is a privileged endpoint that allows the visitor to create new
 // Funnel-capable OIDC clients, so it is only accessible over the tailnet.
 func (s *idpServer) serveClients(w http.ResponseWriter, r *http.Request) {
@@ -1284,21 +1918,18 @@ func (s *idpServer) serveNewClient(w http.ResponseWriter, r *http.Request) {
 	}
 	clientID := rands.HexString(32)
 	clientSecret := rands.HexString(64)
+	if r.FormValue("public") == "true" {
+		clientSecret = ""
+	}
 	newClient := funnelClient{
 		ID:          clientID,
 		Secret:      clientSecret,
 		Name:        r.FormValue("name"),
 		RedirectURI: redirectURI,
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	mak.Set(&s.funnelClients, clientID, &newClient)
-	if err := s.storeFunnelClientsLocked(); err != nil {
+	if err := s.putFunnelClient(&newClient); err != nil {
 		log.Printf("could not write funnel clients db: %v", err)
 		http.Error(w, "tsidp: could not write funnel clients to db", http.StatusInternalServerError)
-		// delete the new client to avoid inconsistent state between memory
-		// and disk
-		delete(s.funnelClients, clientID)
 		return
 	}
 	json.NewEncoder(w).Encode(newClient)
@@ -1329,50 +1960,58 @@ func (s *idpServer) serveDeleteClient(w http.ResponseWriter, r *http.Request, cl
 		return
 	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.funnelClients == nil {
-		http.Error(w, "tsidp: client not found", http.StatusNotFound)
-		return
-	}
-	if _, ok := s.funnelClients[clientID]; !ok {
+	_, ok := s.funnelClients[clientID]
+	s.mu.Unlock()
+	if !ok {
 		http.Error(w, "tsidp: client not found", http.StatusNotFound)
 		return
 	}
-	deleted := s.funnelClients[clientID]
-	delete(s.funnelClients, clientID)
-	if err := s.storeFunnelClientsLocked(); err != nil {
+	if err := s.deleteFunnelClient(clientID); err != nil {
 		log.Printf("could not write funnel clients db: %v", err)
 		http.Error(w, "tsidp: could not write funnel clients to db", http.StatusInternalServerError)
-		// restore the deleted value to avoid inconsistent state between memory
-		// and disk
-		s.funnelClients[clientID] = deleted
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// storeFunnelClientsLocked writes the current mapping of OIDC client ID/secret
-// pairs for RPs that access the IDP. When insecure registration is NOT allowed, uses oauth-clients.json;
-// otherwise uses oidc-funnel-clients.json. s.mu must be held while calling this.
-func (s *idpServer) storeFunnelClientsLocked() error {
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(s.funnelClients); err != nil {
-		return err
+// clientStore returns the store for OIDC clients of RPs that access the IDP:
+// s.store or, if nil, a fileStore in s.rootPath. The fileStore uses
+// oauth-clients.json when insecure registration is NOT allowed, and
+// oidc-funnel-clients.json otherwise.
+func (s *idpServer) clientStore() idpStore {
+	if s.store != nil {
+		return s.store
 	}
+	return newFileStore(s.rootPath, s.allowInsecureRegistration)
+}
 
-	var clientsFilePath string
-	var err error
-	if !s.allowInsecureRegistration {
-		clientsFilePath, err = getConfigFilePath(s.rootPath, oauthClientsFile)
-	} else {
-		clientsFilePath, err = getConfigFilePath(s.rootPath, funnelClientsFile)
+// putFunnelClient stores c, replacing any client with the same ID, and then
+// adds it to s.funnelClients. Clients in s.funnelClients must not be
+// modified in place; put a modified copy instead.
+//
+// s.mu must not be held, as the store may do network IO.
+func (s *idpServer) putFunnelClient(c *funnelClient) error {
+	if err := s.clientStore().PutClient(c); err != nil {
+		return fmt.Errorf("putFunnelClient: %w", err)
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mak.Set(&s.funnelClients, c.ID, c)
+	return nil
+}
 
-	if err != nil {
-		return fmt.Errorf("storeFunnelClientsLocked: %v", err)
+// deleteFunnelClient deletes the client with the given ID from the store
+// and then from s.funnelClients.
+//
+// s.mu must not be held, as the store may do network IO.
+func (s *idpServer) deleteFunnelClient(id string) error {
+	if err := s.clientStore().DeleteClient(id); err != nil {
+		return fmt.Errorf("deleteFunnelClient: %w", err)
 	}
-
-	return os.WriteFile(clientsFilePath, buf.Bytes(), 0600)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.funnelClients, id)
+	return nil
 }
 
 const (
@@ -1406,13 +2045,21 @@ func readUint64(r io.Reader) (uint64, error) {
 // rsaPrivateKeyJSONWrapper is the the JSON serialization
 // format used by RSAPrivateKey.
 type rsaPrivateKeyJSONWrapper struct {
-	Key string
-	ID  uint64
+	Key     string
+	ID      uint64
+	Created time.Time `json:",omitzero"`
 }
 
 type signingKey struct {
-	k   *rsa.PrivateKey
-	kid uint64
+	k       *rsa.PrivateKey
+	kid     uint64
+	created time.Time // zero for keys created before key rotation was supported
+}
+
+// newSigningKey returns a new signing key created at now.
+func newSigningKey(now time.Time) *signingKey {
+	kid, k := mustGenRSAKey(2048)
+	return &signingKey{k: k, kid: kid, created: now}
 }
 
 func (sk *signingKey) MarshalJSON() ([]byte, error) {
@@ -1422,8 +2069,9 @@ func (sk *signingKey) MarshalJSON() ([]byte, error) {
 	}
 	bts := pem.EncodeToMemory(&b)
 	return json.Marshal(rsaPrivateKeyJSONWrapper{
-		Key: base64.URLEncoding.EncodeToString(bts),
-		ID:  sk.kid,
+		Key:     base64.URLEncoding.EncodeToString(bts),
+		ID:      sk.kid,
+		Created: sk.created,
 	})
 }
 
@@ -1446,6 +2094,7 @@ func (sk *signingKey) UnmarshalJSON(b []byte) error {
 	}
 	sk.k = k
 	sk.kid = wrapper.ID
+	sk.created = wrapper.Created
 	return nil
 }
 
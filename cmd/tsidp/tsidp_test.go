@@ -19,6 +19,8 @@
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -41,6 +43,7 @@
 	"gopkg.in/square/go-jose.v2/jwt"
 	"tailscale.com/client/local"
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/memnet"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/opt"
@@ -94,16 +97,6 @@ func mustMarshalJSON(t *testing.T, v any) tailcfg.RawMessage {
 	privateKeyMu sync.Mutex
 )
 
-func oidcTestingSigner(t *testing.T) jose.Signer {
-	t.Helper()
-	privKey := mustGeneratePrivateKey(t)
-	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: privKey}, nil)
-	if err != nil {
-		t.Fatalf("failed to create signer: %v", err)
-	}
-	return sig
-}
-
 func oidcTestingPublicKey(t *testing.T) *rsa.PublicKey {
 	t.Helper()
 	privKey := mustGeneratePrivateKey(t)
@@ -1023,17 +1016,14 @@ func TestFunnelClientsPersistence(t *testing.T) {
 		// Test strict mode uses oauth-clients.json
 		srv1 := setupTestServer(t, true)
 		srv1.rootPath = tmpDir
-		srv1.funnelClients["oauth-client"] = &funnelClient{
+
+		// Test putFunnelClient in strict mode
+		err := srv1.putFunnelClient(&funnelClient{
 			ID:          "oauth-client",
 			Secret:      "oauth-secret",
 			Name:        "OAuth Client",
 			RedirectURI: "https://oauth.example.com/callback",
-		}
-
-		// Test storeFunnelClientsLocked in strict mode
-		srv1.mu.Lock()
-		err := srv1.storeFunnelClientsLocked()
-		srv1.mu.Unlock()
+		})
 
 		if err != nil {
 			t.Fatalf("failed to store clients in strict mode: %v", err)
@@ -1058,17 +1048,14 @@ func TestFunnelClientsPersistence(t *testing.T) {
 		// Test non-strict mode uses oidc-funnel-clients.json
 		srv1 := setupTestServer(t, false)
 		srv1.rootPath = tmpDir
-		srv1.funnelClients["funnel-client"] = &funnelClient{
+
+		// Test putFunnelClient in non-strict mode
+		err := srv1.putFunnelClient(&funnelClient{
 			ID:          "funnel-client",
 			Secret:      "funnel-secret",
 			Name:        "Funnel Client",
 			RedirectURI: "https://funnel.example.com/callback",
-		}
-
-		// Test storeFunnelClientsLocked in non-strict mode
-		srv1.mu.Lock()
-		err := srv1.storeFunnelClientsLocked()
-		srv1.mu.Unlock()
+		})
 
 		if err != nil {
 			t.Fatalf("failed to store clients in non-strict mode: %v", err)
@@ -1103,6 +1090,7 @@ func setupTestServerWithClient(t *testing.T, strictMode bool, lc *local.Client)
 		allowInsecureRegistration: !strictMode,
 		code:                      make(map[string]*authRequest),
 		accessToken:               make(map[string]*authRequest),
+		refreshToken:              make(map[string]*authRequest),
 		funnelClients:             make(map[string]*funnelClient),
 		serverURL:                 "https://test.ts.net",
 		rootPath:                  t.TempDir(),
@@ -1117,8 +1105,8 @@ func setupTestServerWithClient(t *testing.T, strictMode bool, lc *local.Client)
 		RedirectURI: "https://rp.example.com/callback",
 	}
 
-	// Inject a working signer for token tests
-	srv.lazySigner.Set(oidcTestingSigner(t))
+	// Inject a working signing key for token tests
+	srv.signingKeys = []*signingKey{{k: mustGeneratePrivateKey(t), kid: 1}}
 
 	return srv
 }
@@ -2061,3 +2049,605 @@ func TestServeUserInfoWithClientValidation(t *testing.T) {
 		})
 	}
 }
+
+// testRemoteUser returns the WhoIs response of a test user on an untagged
+// node.
+func testRemoteUser() *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			ID:   123,
+			Name: "test-node.test.ts.net.",
+			User: 456,
+		},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:   "alice@example.com",
+			DisplayName: "Alice Example",
+		},
+		CapMap: tailcfg.PeerCapMap{},
+	}
+}
+
+// postForm sends a form POST to handler h, with HTTP Basic client
+// credentials if clientID is non-empty.
+func postForm(t *testing.T, h http.HandlerFunc, path string, form url.Values, clientID, clientSecret string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "127.0.0.1:12345"
+	if clientID != "" {
+		req.SetBasicAuth(clientID, clientSecret)
+	}
+	rr := httptest.NewRecorder()
+	h(rr, req)
+	return rr
+}
+
+func decodeTokenResponse(t *testing.T, rr *httptest.ResponseRecorder) oidcTokenResponse {
+	t.Helper()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token request: got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal token response: %v", err)
+	}
+	return resp
+}
+
+func TestParseCodeChallenge(t *testing.T) {
+	challenge := strings.Repeat("a", 43)
+	tests := []struct {
+		name       string
+		query      url.Values
+		wantMethod string
+		wantErr    bool
+	}{
+		{name: "no PKCE", query: url.Values{}},
+		{name: "S256", query: url.Values{"code_challenge": {challenge}, "code_challenge_method": {"S256"}}, wantMethod: "S256"},
+		{name: "plain", query: url.Values{"code_challenge": {challenge}, "code_challenge_method": {"plain"}}, wantMethod: "plain"},
+		{name: "default method is plain", query: url.Values{"code_challenge": {challenge}}, wantMethod: "plain"},
+		{name: "unsupported method", query: url.Values{"code_challenge": {challenge}, "code_challenge_method": {"S512"}}, wantErr: true},
+		{name: "method without challenge", query: url.Values{"code_challenge_method": {"S256"}}, wantErr: true},
+		{name: "challenge too short", query: url.Values{"code_challenge": {"abc"}, "code_challenge_method": {"S256"}}, wantErr: true},
+		{name: "challenge with invalid characters", query: url.Values{"code_challenge": {strings.Repeat("a", 42) + "="}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, method, err := parseCodeChallenge(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCodeChallenge error = %v; wantErr %v", err, tt.wantErr)
+			}
+			if method != tt.wantMethod {
+				t.Errorf("method = %q; want %q", method, tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestServeTokenPKCE(t *testing.T) {
+	const verifier = "dBjftJeZ4CVP-mJ0kRCDs2dOs4XsBhDjaJr0x7hb7nA"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		challenge string
+		method    string
+		verifier  string
+		public    bool
+		wantCode  int
+	}{
+		{name: "S256", challenge: challenge, method: "S256", verifier: verifier, wantCode: http.StatusOK},
+		{name: "S256 wrong verifier", challenge: challenge, method: "S256", verifier: strings.Repeat("x", 43), wantCode: http.StatusBadRequest},
+		{name: "S256 missing verifier", challenge: challenge, method: "S256", wantCode: http.StatusBadRequest},
+		{name: "plain", challenge: verifier, method: "plain", verifier: verifier, wantCode: http.StatusOK},
+		{name: "verifier without challenge", verifier: verifier, wantCode: http.StatusBadRequest},
+		{name: "public client", challenge: challenge, method: "S256", verifier: verifier, public: true, wantCode: http.StatusOK},
+		{name: "public client wrong verifier", challenge: challenge, method: "S256", verifier: strings.Repeat("x", 43), public: true, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := setupTestServer(t, true)
+			c := srv.funnelClients["test-client"]
+			secret := c.Secret
+			if tt.public {
+				c.Secret = ""
+				secret = ""
+			}
+			srv.code["the-code"] = &authRequest{
+				clientID:            c.ID,
+				redirectURI:         c.RedirectURI,
+				remoteUser:          testRemoteUser(),
+				funnelRP:            c,
+				validTill:           time.Now().Add(5 * time.Minute),
+				codeChallenge:       tt.challenge,
+				codeChallengeMethod: tt.method,
+			}
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {"the-code"},
+				"redirect_uri":  {c.RedirectURI},
+				"client_id":     {c.ID},
+				"code_verifier": {tt.verifier},
+			}
+			if secret != "" {
+				form.Set("client_secret", secret)
+			}
+			rr := postForm(t, srv.serveToken, "/token", form, "", "")
+			if rr.Code != tt.wantCode {
+				t.Errorf("got %d, want %d: %s", rr.Code, tt.wantCode, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthorizePublicClientRequiresPKCE(t *testing.T) {
+	srv := setupTestServer(t, true)
+	srv.funnelClients["public-client"] = &funnelClient{
+		ID:          "public-client",
+		RedirectURI: "https://app.example.com/callback",
+	}
+	q := url.Values{
+		"client_id":    {"public-client"},
+		"redirect_uri": {"https://app.example.com/callback"},
+	}
+	req := httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil)
+	rr := httptest.NewRecorder()
+	srv.authorize(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "PKCE") {
+		t.Errorf("got %d %q; want 400 requiring PKCE", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	remoteUser := testRemoteUser()
+	remoteUser.Node.Addresses = []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}
+	whoIs := map[string]*apitype.WhoIsResponse{"100.64.0.1": remoteUser}
+	srv := setupTestServerWithClient(t, true, fakeLocalClient(t, whoIs))
+	srv.refreshTokenTTL = time.Hour
+	c := srv.funnelClients["test-client"]
+	srv.code["the-code"] = &authRequest{
+		clientID:    c.ID,
+		nonce:       "nonce123",
+		redirectURI: c.RedirectURI,
+		remoteUser:  remoteUser,
+		funnelRP:    c,
+		validTill:   time.Now().Add(5 * time.Minute),
+	}
+	resp := decodeTokenResponse(t, postForm(t, srv.serveToken, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"the-code"},
+		"redirect_uri": {c.RedirectURI},
+	}, c.ID, c.Secret))
+	if resp.RefreshToken == "" {
+		t.Fatal("no refresh token issued")
+	}
+
+	refresh := func(rt, clientID, clientSecret string) *httptest.ResponseRecorder {
+		return postForm(t, srv.serveToken, "/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {rt},
+		}, clientID, clientSecret)
+	}
+
+	// A request with bad client credentials fails without using up the
+	// refresh token.
+	if rr := refresh(resp.RefreshToken, c.ID, "wrong-secret"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("refresh with wrong secret: got %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	resp2 := decodeTokenResponse(t, refresh(resp.RefreshToken, c.ID, c.Secret))
+	if resp2.RefreshToken == "" || resp2.RefreshToken == resp.RefreshToken {
+		t.Errorf("refresh token not rotated: got %q", resp2.RefreshToken)
+	}
+	if resp2.AccessToken == "" || resp2.AccessToken == resp.AccessToken {
+		t.Errorf("no new access token: got %q", resp2.AccessToken)
+	}
+	tok, err := jwt.ParseSigned(resp2.IDToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims tailscaleClaims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "userid:456" || claims.Nonce != "" {
+		t.Errorf("refreshed ID token has sub %q, nonce %q; want userid:456 and no nonce", claims.Subject, claims.Nonce)
+	}
+
+	// The old refresh token can't be used again.
+	if rr := refresh(resp.RefreshToken, c.ID, c.Secret); rr.Code != http.StatusBadRequest {
+		t.Errorf("reusing refresh token: got %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	// Rotated refresh tokens keep the expiry of the original one.
+	srv.mu.Lock()
+	origExpiry := time.Now().Add(10 * time.Minute)
+	srv.refreshToken[resp2.RefreshToken].validTill = origExpiry
+	srv.mu.Unlock()
+	resp2 = decodeTokenResponse(t, refresh(resp2.RefreshToken, c.ID, c.Secret))
+	srv.mu.Lock()
+	if got := srv.refreshToken[resp2.RefreshToken].validTill; !got.Equal(origExpiry) {
+		t.Errorf("rotated refresh token valid till %v; want %v", got, origExpiry)
+	}
+	srv.mu.Unlock()
+
+	// Once the node's user changes, the refresh token is rejected, and
+	// can't be used again.
+	whoIs["100.64.0.1"] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 123, User: 999},
+		UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"},
+	}
+	if rr := refresh(resp2.RefreshToken, c.ID, c.Secret); rr.Code != http.StatusBadRequest {
+		t.Errorf("refresh for changed user: got %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	whoIs["100.64.0.1"] = remoteUser
+	if rr := refresh(resp2.RefreshToken, c.ID, c.Secret); rr.Code != http.StatusBadRequest {
+		t.Errorf("refresh after rejection: got %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	srv.code["the-code-2"] = &authRequest{
+		clientID:    c.ID,
+		redirectURI: c.RedirectURI,
+		remoteUser:  remoteUser,
+		funnelRP:    c,
+		validTill:   time.Now().Add(5 * time.Minute),
+	}
+	resp2 = decodeTokenResponse(t, postForm(t, srv.serveToken, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"the-code-2"},
+		"redirect_uri": {c.RedirectURI},
+	}, c.ID, c.Secret))
+
+	// Expired refresh tokens are rejected.
+	srv.mu.Lock()
+	srv.refreshToken[resp2.RefreshToken].validTill = time.Now().Add(-time.Second)
+	srv.mu.Unlock()
+	if rr := refresh(resp2.RefreshToken, c.ID, c.Secret); rr.Code != http.StatusBadRequest {
+		t.Errorf("expired refresh token: got %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	// With refresh tokens disabled, none are issued or accepted.
+	srv.refreshTokenTTL = 0
+	srv.code["another-code"] = &authRequest{
+		clientID:    c.ID,
+		redirectURI: c.RedirectURI,
+		remoteUser:  testRemoteUser(),
+		funnelRP:    c,
+		validTill:   time.Now().Add(5 * time.Minute),
+	}
+	resp3 := decodeTokenResponse(t, postForm(t, srv.serveToken, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"another-code"},
+		"redirect_uri": {c.RedirectURI},
+	}, c.ID, c.Secret))
+	if resp3.RefreshToken != "" {
+		t.Errorf("refresh token issued while disabled")
+	}
+	if rr := refresh("anything", c.ID, c.Secret); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "grant_type not supported") {
+		t.Errorf("refresh_token grant while disabled: got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	srv := setupTestServer(t, true)
+	c := srv.funnelClients["test-client"]
+	srv.funnelClients["gateway"] = &funnelClient{ID: "gateway", Secret: "gateway-secret"}
+	srv.funnelClients["public-client"] = &funnelClient{ID: "public-client"}
+	ar := &authRequest{
+		clientID:   c.ID,
+		remoteUser: testRemoteUser(),
+		funnelRP:   c,
+		validTill:  time.Now().Add(5 * time.Minute),
+	}
+	srv.accessToken["access"] = ar
+	srv.refreshToken["refresh"] = ar
+	srv.accessToken["expired"] = &authRequest{
+		clientID:   c.ID,
+		remoteUser: testRemoteUser(),
+		funnelRP:   c,
+		validTill:  time.Now().Add(-time.Minute),
+	}
+
+	introspect := func(token, hint, clientID, clientSecret string) (*httptest.ResponseRecorder, introspectionResponse) {
+		form := url.Values{"token": {token}}
+		if hint != "" {
+			form.Set("token_type_hint", hint)
+		}
+		rr := postForm(t, srv.serveIntrospect, "/introspect", form, clientID, clientSecret)
+		var resp introspectionResponse
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr, resp
+	}
+
+	for _, tc := range []struct{ id, secret string }{
+		{"", ""},
+		{"gateway", "wrong-secret"},
+		{"public-client", ""},
+	} {
+		if rr, _ := introspect("access", "", tc.id, tc.secret); rr.Code != http.StatusUnauthorized {
+			t.Errorf("introspect as %q: got %d, want %d", tc.id, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	_, resp := introspect("access", "", "gateway", "gateway-secret")
+	want := introspectionResponse{
+		Active:    true,
+		ClientID:  c.ID,
+		Username:  "alice@example.com",
+		TokenType: "Bearer",
+		Exp:       ar.validTill.Unix(),
+		Sub:       "userid:456",
+		Aud:       c.ID,
+		Iss:       srv.serverURL,
+	}
+	if resp != want {
+		t.Errorf("access token: got %+v, want %+v", resp, want)
+	}
+
+	_, resp = introspect("refresh", "refresh_token", "gateway", "gateway-secret")
+	if !resp.Active || resp.TokenType != "" {
+		t.Errorf("refresh token: got %+v, want active with no token_type", resp)
+	}
+
+	for _, tk := range []string{"expired", "unknown"} {
+		if _, resp := introspect(tk, "", "gateway", "gateway-secret"); resp != (introspectionResponse{}) {
+			t.Errorf("%s token: got %+v, want inactive", tk, resp)
+		}
+	}
+
+	// Tokens of deleted clients are inactive.
+	delete(srv.funnelClients, c.ID)
+	if _, resp := introspect("access", "", "gateway", "gateway-secret"); resp.Active {
+		t.Errorf("token of deleted client is active")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	srv := setupTestServer(t, true)
+	c := srv.funnelClients["test-client"]
+	other := &funnelClient{ID: "other-client", Secret: "other-secret"}
+	srv.funnelClients[other.ID] = other
+	ar := &authRequest{
+		clientID:   c.ID,
+		remoteUser: testRemoteUser(),
+		funnelRP:   c,
+		validTill:  time.Now().Add(time.Hour),
+	}
+	srv.accessToken["access"] = ar
+	srv.refreshToken["refresh"] = ar
+
+	revoke := func(token, hint, clientID, clientSecret string) int {
+		form := url.Values{"token": {token}}
+		if hint != "" {
+			form.Set("token_type_hint", hint)
+		}
+		return postForm(t, srv.serveRevoke, "/revoke", form, clientID, clientSecret).Code
+	}
+
+	// Other clients can't revoke the token.
+	if code := revoke("refresh", "refresh_token", other.ID, other.Secret); code == http.StatusOK {
+		t.Error("revoked another client's token")
+	}
+	if _, ok := srv.refreshToken["refresh"]; !ok {
+		t.Fatal("refresh token revoked by another client")
+	}
+
+	if code := revoke("refresh", "refresh_token", c.ID, c.Secret); code != http.StatusOK {
+		t.Errorf("revoking refresh token: got %d", code)
+	}
+	if _, ok := srv.refreshToken["refresh"]; ok {
+		t.Error("refresh token not revoked")
+	}
+	// The hint is only a hint.
+	if code := revoke("access", "refresh_token", c.ID, c.Secret); code != http.StatusOK {
+		t.Errorf("revoking access token: got %d", code)
+	}
+	if _, ok := srv.accessToken["access"]; ok {
+		t.Error("access token not revoked")
+	}
+
+	// Revoking unknown or already revoked tokens succeeds.
+	if code := revoke("access", "", c.ID, c.Secret); code != http.StatusOK {
+		t.Errorf("revoking revoked token: got %d", code)
+	}
+	if code := revoke("", "", c.ID, c.Secret); code != http.StatusBadRequest {
+		t.Errorf("revoking without token: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestServeOpenIDConfig(t *testing.T) {
+	for _, refresh := range []bool{true, false} {
+		srv := setupTestServer(t, true)
+		if refresh {
+			srv.refreshTokenTTL = time.Hour
+		}
+		rr := httptest.NewRecorder()
+		srv.serveOpenIDConfig(rr, httptest.NewRequest("GET", oidcConfigPath, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", rr.Code, rr.Body.String())
+		}
+		var md struct {
+			GrantTypes            []string `json:"grant_types_supported"`
+			CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+			IntrospectionEndpoint string   `json:"introspection_endpoint"`
+			RevocationEndpoint    string   `json:"revocation_endpoint"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &md); err != nil {
+			t.Fatal(err)
+		}
+		wantGrants := []string{"authorization_code"}
+		if refresh {
+			wantGrants = append(wantGrants, "refresh_token")
+		}
+		wantGrants = append(wantGrants, "urn:ietf:params:oauth:grant-type:token-exchange")
+		if !reflect.DeepEqual(md.GrantTypes, wantGrants) {
+			t.Errorf("grant_types_supported = %v; want %v", md.GrantTypes, wantGrants)
+		}
+		if want := []string{"S256", "plain"}; !reflect.DeepEqual(md.CodeChallengeMethods, want) {
+			t.Errorf("code_challenge_methods_supported = %v; want %v", md.CodeChallengeMethods, want)
+		}
+		if md.IntrospectionEndpoint != "https://test.ts.net/introspect" {
+			t.Errorf("introspection_endpoint = %q", md.IntrospectionEndpoint)
+		}
+		if md.RevocationEndpoint != "https://test.ts.net/revoke" {
+			t.Errorf("revocation_endpoint = %q", md.RevocationEndpoint)
+		}
+	}
+}
+
+// fakeLocalClient returns a local.Client whose WhoIs responses come from
+// whoIs, keyed by remote address.
+func fakeLocalClient(t *testing.T, whoIs map[string]*apitype.WhoIsResponse) *local.Client {
+	t.Helper()
+	ln := memnet.Listen("local-tailscaled.sock:80")
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/whois" {
+			t.Errorf("unexpected LocalAPI request %q", r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		who, ok := whoIs[r.URL.Query().Get("addr")]
+		if !ok {
+			http.Error(w, "no match for IP:port", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(who)
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return &local.Client{Dial: ln.Dial}
+}
+
+func TestTokenExchange(t *testing.T) {
+	const (
+		userAddr   = "100.64.0.1:1234"
+		taggedAddr = "100.64.0.2:1234"
+	)
+	user := testRemoteUser()
+	user.Node.StableID = "nStable123"
+	user.CapMap = tailcfg.PeerCapMap{
+		tailcfg.PeerCapabilityTsIDP: {
+			mustMarshalJSON(t, capRule{ExtraClaims: map[string]any{"role": "batch"}}),
+		},
+	}
+	taggedNode := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			ID:       789,
+			StableID: "nStable789",
+			Name:     "worker.test.ts.net.",
+			User:     tailcfg.UserID(1),
+			Tags:     []string{"tag:worker"},
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+	srv := setupTestServerWithClient(t, true, fakeLocalClient(t, map[string]*apitype.WhoIsResponse{
+		userAddr:   user,
+		taggedAddr: taggedNode,
+	}))
+	srv.tokenExchangeAudiences = []string{"billing", "https://api.example.com"}
+
+	exchange := func(remoteAddr string, form url.Values) *httptest.ResponseRecorder {
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		srv.serveToken(rr, req)
+		return rr
+	}
+	verify := func(rr *httptest.ResponseRecorder) (tokenExchangeResponse, map[string]any) {
+		t.Helper()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp tokenExchangeResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		tok, err := jwt.ParseSigned(resp.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ := tok.Headers[0].ExtraHeaders[jose.HeaderType]; typ != "at+jwt" {
+			t.Errorf("typ = %v; want at+jwt", typ)
+		}
+		var claims map[string]any
+		if err := tok.Claims(srv.signingKeys[0].k.Public(), &claims); err != nil {
+			t.Fatalf("token does not verify: %v", err)
+		}
+		return resp, claims
+	}
+
+	resp, claims := verify(exchange(userAddr, url.Values{
+		"audience": {"billing"},
+		"resource": {"https://api.example.com"},
+	}))
+	if resp.IssuedTokenType != "urn:ietf:params:oauth:token-type:access_token" || resp.TokenType != "Bearer" || resp.ExpiresIn != 300 {
+		t.Errorf("response = %+v", resp)
+	}
+	want := map[string]any{
+		"sub":   "userid:456",
+		"aud":   []any{"billing", "https://api.example.com"},
+		"iss":   "https://test.ts.net",
+		"nid":   float64(123),
+		"node":  "test-node.test.ts.net.",
+		"email": "alice@example.com",
+		"role":  "batch",
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(claims[k], v) {
+			t.Errorf("claim %q = %#v; want %#v", k, claims[k], v)
+		}
+	}
+	if v, ok := claims["nonce"]; ok {
+		t.Errorf("unexpected claim nonce = %v", v)
+	}
+
+	// Registered clients are allowed audiences too.
+	_, claims = verify(exchange(userAddr, url.Values{"audience": {"test-client"}}))
+	if !reflect.DeepEqual(claims["aud"], []any{"test-client"}) {
+		t.Errorf("aud = %v; want test-client", claims["aud"])
+	}
+
+	// Tagged nodes get tokens for the node, with its tags.
+	_, claims = verify(exchange(taggedAddr, url.Values{"audience": {"billing"}}))
+	want = map[string]any{
+		"sub":  "nStable789",
+		"aud":  []any{"billing"},
+		"nid":  float64(789),
+		"node": "worker.test.ts.net.",
+		"tags": []any{"tag:worker"},
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(claims[k], v) {
+			t.Errorf("tagged claim %q = %#v; want %#v", k, claims[k], v)
+		}
+	}
+	for _, k := range []string{"email", "uid", "username"} {
+		if v, ok := claims[k]; ok {
+			t.Errorf("unexpected tagged claim %s = %v", k, v)
+		}
+	}
+
+	for _, tt := range []struct {
+		name       string
+		remoteAddr string
+		form       url.Values
+		wantCode   int
+	}{
+		{"no audience", userAddr, url.Values{}, http.StatusBadRequest},
+		{"unknown audience", userAddr, url.Values{"audience": {"billing", "other"}}, http.StatusBadRequest},
+		{"subject_token", userAddr, url.Values{"audience": {"billing"}, "subject_token": {"x"}}, http.StatusBadRequest},
+		{"id token", userAddr, url.Values{"audience": {"billing"}, "requested_token_type": {"urn:ietf:params:oauth:token-type:id_token"}}, http.StatusBadRequest},
+		{"unsupported token type", userAddr, url.Values{"audience": {"billing"}, "requested_token_type": {"urn:ietf:params:oauth:token-type:saml2"}}, http.StatusBadRequest},
+		{"unknown caller", "100.64.0.3:1234", url.Values{"audience": {"billing"}}, http.StatusForbidden},
+	} {
+		if rr := exchange(tt.remoteAddr, tt.form); rr.Code != tt.wantCode {
+			t.Errorf("%s: got %d, want %d: %s", tt.name, rr.Code, tt.wantCode, rr.Body.String())
+		}
+	}
+}
@@ -126,15 +126,7 @@ func (s *idpServer) handleNewClient(w http.ResponseWriter, r *http.Request) {
 			RedirectURI: redirectURI,
 		}
 
-		s.mu.Lock()
-		if s.funnelClients == nil {
-			s.funnelClients = make(map[string]*funnelClient)
-		}
-		s.funnelClients[clientID] = &newClient
-		err := s.storeFunnelClientsLocked()
-		s.mu.Unlock()
-
-		if err != nil {
+		if err := s.putFunnelClient(&newClient); err != nil {
 			log.Printf("could not write funnel clients db: %v", err)
 			s.renderFormError(w, baseData, "Failed to save client")
 			return
@@ -182,17 +174,8 @@ func (s *idpServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 		action := r.FormValue("action")
 
 		if action == "delete" {
-			s.mu.Lock()
-			delete(s.funnelClients, clientID)
-			err := s.storeFunnelClientsLocked()
-			s.mu.Unlock()
-
-			if err != nil {
+			if err := s.deleteFunnelClient(clientID); err != nil {
 				log.Printf("could not write funnel clients db: %v", err)
-				s.mu.Lock()
-				s.funnelClients[clientID] = client
-				s.mu.Unlock()
-
 				baseData := createEditBaseData(client, client.Name, client.RedirectURI)
 				s.renderFormError(w, baseData, "Failed to delete client. Please try again.")
 				return
@@ -204,10 +187,9 @@ func (s *idpServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 
 		if action == "regenerate_secret" {
 			newSecret := rands.HexString(64)
-			s.mu.Lock()
-			s.funnelClients[clientID].Secret = newSecret
-			err := s.storeFunnelClientsLocked()
-			s.mu.Unlock()
+			updated := *client
+			updated.Secret = newSecret
+			err := s.putFunnelClient(&updated)
 
 			baseData := createEditBaseData(client, client.Name, client.RedirectURI)
 			baseData.HasSecret = true
@@ -237,13 +219,10 @@ func (s *idpServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		s.mu.Lock()
-		s.funnelClients[clientID].Name = name
-		s.funnelClients[clientID].RedirectURI = redirectURI
-		err := s.storeFunnelClientsLocked()
-		s.mu.Unlock()
-
-		if err != nil {
+		updated := *client
+		updated.Name = name
+		updated.RedirectURI = redirectURI
+		if err := s.putFunnelClient(&updated); err != nil {
 			log.Printf("could not write funnel clients db: %v", err)
 			s.renderFormError(w, baseData, "Failed to update client")
 			return
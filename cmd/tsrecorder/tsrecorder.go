@@ -0,0 +1,151 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The tsrecorder command is a session recorder for Tailscale SSH and the
+// Kubernetes API server proxy. It joins the tailnet with tsnet, receives
+// session recordings and events, and stores them in a local directory or an
+// S3-compatible object store.
+//
+// Point SSH recording at it with the "recorder" field of SSH rules in the
+// tailnet policy file, using the tag it is run with, such as:
+//
+//	"recorder": ["tag:recorder"]
+//
+// Recordings and events can be listed and fetched with the API on
+// --api-port, which tailnet access controls should restrict to those who
+// review recordings.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"tailscale.com/hostinfo"
+	"tailscale.com/sessionrecording/recorder"
+	"tailscale.com/tsnet"
+)
+
+var (
+	flagVerbose    = flag.Bool("verbose", false, "be verbose")
+	flagHostname   = flag.String("hostname", "recorder", "tsnet hostname")
+	flagDir        = flag.String("dir", "", "tsnet state directory; a default one will be created if not provided")
+	flagPort       = flag.Int("port", 80, "port to accept recordings on")
+	flagAPIPort    = flag.Int("api-port", 8080, "port to serve the API for listing and fetching recordings on; 0 disables it")
+	flagDst        = flag.String("dst", "", "where to store recordings and events: a local directory, or s3://<bucket>[/<prefix>] for an S3-compatible object store; defaults to the recordings directory of the tsnet state directory")
+	flagS3Endpoint = flag.String("s3-endpoint", "https://s3.amazonaws.com", "base URL of the S3-compatible object store, for s3:// --dst; credentials are read from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN")
+	flagS3Region   = flag.String("s3-region", "us-east-1", "region of the S3-compatible object store")
+	flagMaxAge     = flag.Duration("max-age", 0, "if non-zero, how long to keep recordings and events before deleting them")
+)
+
+func main() {
+	flag.Parse()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	hostinfo.SetApp("tsrecorder")
+	ts := &tsnet.Server{
+		Hostname: *flagHostname,
+		Dir:      *flagDir,
+	}
+	if *flagVerbose {
+		ts.Logf = log.Printf
+	}
+	defer ts.Close()
+	if _, err := ts.Up(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := newStore(*flagDst, ts.GetRootPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &recorder.Server{
+		Store:  store,
+		MaxAge: *flagMaxAge,
+	}
+	go srv.RunRetention(ctx)
+
+	ln, err := ts.Listen("tcp", fmt.Sprintf(":%d", *flagPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	if *flagAPIPort != 0 {
+		apiLn, err := ts.Listen("tcp", fmt.Sprintf(":%d", *flagAPIPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			<-ctx.Done()
+			apiLn.Close()
+		}()
+		go func() {
+			err := http.Serve(apiLn, srv.APIHandler())
+			if ctx.Err() == nil {
+				log.Fatalf("serving API: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("tsrecorder accepting recordings on port %d, storing them in %s", *flagPort, storeName(*flagDst, store))
+	if err := srv.Serve(ln); err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
+
+// newStore returns the recorder.Store for the --dst flag value dst.
+func newStore(dst, rootPath string) (recorder.Store, error) {
+	if dst == "" {
+		return &recorder.DirStore{Dir: filepath.Join(rootPath, "recordings")}, nil
+	}
+	if !strings.HasPrefix(dst, "s3://") {
+		return &recorder.DirStore{Dir: dst}, nil
+	}
+	u, err := url.Parse(dst)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid --dst %q: no bucket", dst)
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("s3:// --dst requires $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+	return &recorder.S3Store{
+		Endpoint:    *flagS3Endpoint,
+		Bucket:      u.Host,
+		Prefix:      prefix,
+		Region:      *flagS3Region,
+		Credentials: creds,
+	}, nil
+}
+
+func storeName(dst string, s recorder.Store) string {
+	if ds, ok := s.(*recorder.DirStore); ok {
+		return ds.Dir
+	}
+	return dst
+}
@@ -7,6 +7,8 @@
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"expvar"
@@ -18,11 +20,14 @@
 	"testing"
 	"time"
 
+	"golang.org/x/net/quic"
 	"tailscale.com/derp"
+	"tailscale.com/derp/derpquic"
 	"tailscale.com/derp/derpserver"
 	"tailscale.com/disco"
 	"tailscale.com/metrics"
 	"tailscale.com/net/memnet"
+	"tailscale.com/tstest/tlstest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/must"
@@ -503,6 +508,78 @@ func TestSendFreeze(t *testing.T) {
 	}
 }
 
+func TestSendRecvQUIC(t *testing.T) {
+	s := derpserver.New(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ep, err := quic.Listen("udp", "127.0.0.1:0", derpquic.Config(tlstest.Derper.ServerTLSConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// Close without waiting for the clients to acknowledge it.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ep.Close(ctx)
+	}()
+	go s.ServeQUIC(ctx, ep, nil)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(tlstest.TestRootCA())
+	var clients []*Client
+	var conns []*derpquic.Conn
+	for i := range 2 {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc, err := derpquic.Dial(ctx, pc, "udp", ep.LocalAddr().String(), &tls.Config{RootCAs: roots, ServerName: string(tlstest.Derper)})
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		defer nc.Close()
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := derp.NewClient(key.NewNode(), nc, brw, t.Logf)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		waitConnect(t, c)
+		clients = append(clients, c)
+		conns = append(conns, nc)
+	}
+
+	for _, msg := range []string{"hello over QUIC", strings.Repeat("x", derp.MaxPacketSize)} {
+		if err := clients[0].Send(clients[1].PublicKey(), []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		conns[1].SetReadDeadline(time.Now().Add(10 * time.Second))
+		for {
+			m, err := clients[1].Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p, ok := m.(derp.ReceivedPacket); ok {
+				if p.Source != clients[0].PublicKey() || string(p.Data) != msg {
+					t.Errorf("got %d bytes from %v, want %d bytes from %v", len(p.Data), p.Source, len(msg), clients[0].PublicKey())
+				}
+				break
+			}
+		}
+	}
+
+	// A wrong server name fails verification.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc, err := derpquic.Dial(ctx, pc, "udp", ep.LocalAddr().String(), &tls.Config{RootCAs: roots, ServerName: "other.tstest"}); err == nil {
+		nc.Close()
+		t.Error("dial with wrong server name: unexpected success")
+	}
+}
+
 type testServer struct {
 	s    *derpserver.Server
 	ln   net.Listener
@@ -72,6 +72,14 @@ type Client struct {
 	// In either case, additional timeouts may be added to the base context.
 	BaseContext func() context.Context
 
+	// ForceQUIC, if true, makes the client connect to region DERP nodes
+	// only over QUIC, without falling back to TCP. It's for probers and
+	// tests. Otherwise, QUIC is tried first when a node advertises a
+	// QUICPort, unless it recently failed or TS_DEBUG_DISABLE_DERP_QUIC is
+	// set, and TCP is used if it fails.
+	// Either way, QUIC requires the binary to link feature/derpquic.
+	ForceQUIC bool
+
 	privateKey key.NodePrivate
 	logf       logger.Logf
 	netMon     *netmon.Monitor // always non-nil
@@ -98,7 +106,9 @@ type Client struct {
 	closed       bool
 	netConn      io.Closer
 	client       *derp.Client
-	connGen      int // incremented once per new connection; valid values are >0
+	usingQUIC    bool      // whether client is over QUIC
+	quicFailedAt time.Time // when connecting over QUIC last failed, or zero
+	connGen      int       // incremented once per new connection; valid values are >0
 	serverPubKey key.NodePublic
 	tlsState     *tls.ConnectionState
 	pingOut      map[derp.PingMessage]chan<- bool // chan to send to on pong
@@ -420,12 +430,31 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		c.serverPubKey = derpClient.ServerPublicKey()
 		c.client = derpClient
 		c.netConn = conn
+		c.usingQUIC = false
 		c.connGen++
 		return c.client, c.connGen, nil
 	case c.url != nil:
 		c.logf("%s: connecting to %v", caller, c.url)
 		tcpConn, err = c.dialURL(ctx)
 	default:
+		if qnode := c.quicNodeLocked(reg); qnode != nil || c.ForceQUIC {
+			if qnode == nil {
+				if !HookDialQUIC.IsSet() {
+					return nil, 0, fmt.Errorf("QUIC: %w", feature.ErrUnavailable)
+				}
+				return nil, 0, errors.New("no nodes support QUIC")
+			}
+			c.logf("%s: connecting to derp-%d (%v) over QUIC", caller, reg.RegionID, reg.RegionCode)
+			client, err := c.connectQUICLocked(ctx, qnode)
+			if err == nil {
+				return client, c.connGen, nil
+			}
+			if c.ForceQUIC {
+				return nil, 0, err
+			}
+			c.logf("%s: QUIC to derp-%d failed, falling back to TCP: %v", caller, reg.RegionID, err)
+			c.quicFailedAt = c.clock.Now()
+		}
 		c.logf("%s: connecting to derp-%d (%v)", caller, reg.RegionID, reg.RegionCode)
 		tcpConn, node, err = c.dialRegion(ctx, reg)
 		idealNodeInRegion = err == nil && reg.Nodes[0] == node
@@ -574,6 +603,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	c.client = derpClient
 	c.netConn = tcpConn
 	c.tlsState = tlsState
+	c.usingQUIC = false
 	c.connGen++
 
 	localAddr, _ := c.client.LocalAddr()
@@ -648,6 +678,12 @@ func (c *Client) dialRegion(ctx context.Context, reg *tailcfg.DERPRegion) (net.C
 }
 
 func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
+	return tls.Client(nc, c.tlsConfig(node))
+}
+
+// tlsConfig returns the TLS configuration to connect to node, which may be
+// nil to connect to c.url.
+func (c *Client) tlsConfig(node *tailcfg.DERPNode) *tls.Config {
 	tlsConf := tlsdial.Config(c.HealthTracker, c.TLSConfig)
 	// node is allowed to be nil here, tlsServerName falls back to using the URL
 	// if node is nil.
@@ -665,7 +701,7 @@ func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
 			}
 		}
 	}
-	return tls.Client(nc, tlsConf)
+	return tlsConf
 }
 
 // DialRegionTLS returns a TLS connection to a DERP node in the given region.
@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derphttp
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/envknob"
+	"tailscale.com/feature"
+	"tailscale.com/feature/buildfeatures"
+	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
+)
+
+// disableDERPQUIC is a kill switch that stops region clients from trying
+// to connect to DERP nodes over QUIC, even if they advertise a QUICPort.
+// Client.ForceQUIC overrides it.
+var disableDERPQUIC = envknob.RegisterBool("TS_DEBUG_DISABLE_DERP_QUIC")
+
+// QUICConn is a DERP connection over QUIC, as returned by [HookDialQUIC].
+type QUICConn interface {
+	net.Conn
+	ConnectionState() tls.ConnectionState
+}
+
+// HookDialQUIC is a hook for feature/derpquic to register
+// [derpquic.Dial], so that clients can connect to DERP nodes over QUIC
+// without every binary linking a QUIC implementation.
+//
+// [derpquic.Dial]: https://pkg.go.dev/tailscale.com/derp/derpquic#Dial
+var HookDialQUIC feature.Hook[func(ctx context.Context, pc net.PacketConn, network, addr string, tlsConf *tls.Config) (QUICConn, error)]
+
+const (
+	// quicConnectTimeout is how long to try connecting over QUIC before
+	// falling back to TCP. It's short, as QUIC is only an optimization
+	// and UDP may well be blocked.
+	quicConnectTimeout = 3 * time.Second
+
+	// quicRetryInterval is how long to wait after connecting over QUIC
+	// failed before trying it again, rather than going straight to TCP.
+	quicRetryInterval = 10 * time.Minute
+)
+
+// UsingQUIC reports whether the client is connected over QUIC.
+func (c *Client) UsingQUIC() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client != nil && c.usingQUIC
+}
+
+// quicNodeLocked returns the node of reg to try connecting to over QUIC,
+// or nil if QUIC shouldn't be tried.
+func (c *Client) quicNodeLocked(reg *tailcfg.DERPRegion) *tailcfg.DERPNode {
+	if !buildfeatures.HasDERPQUIC || !HookDialQUIC.IsSet() || !c.useHTTPS() {
+		return nil
+	}
+	if !c.ForceQUIC && disableDERPQUIC() {
+		return nil
+	}
+	if !c.ForceQUIC && !c.quicFailedAt.IsZero() && c.clock.Since(c.quicFailedAt) < quicRetryInterval {
+		return nil
+	}
+	if c.dialer != nil || netns.IsSOCKSDialer(netns.NewDialer(c.logf, c.netMon)) {
+		// QUIC can't go through custom dialers or SOCKS proxies.
+		return nil
+	}
+	for _, n := range reg.Nodes {
+		if !n.STUNOnly && n.QUICPort > 0 && !c.useProxyForNode(n) {
+			return n
+		}
+	}
+	return nil
+}
+
+// useProxyForNode reports whether TCP connections to n go through an HTTP
+// proxy, in which case connecting to it over QUIC, which would bypass the
+// proxy, isn't tried.
+func (c *Client) useProxyForNode(n *tailcfg.DERPNode) bool {
+	if !buildfeatures.HasUseProxy {
+		return false
+	}
+	proxyFromEnv, ok := feature.HookProxyFromEnvironment.GetOk()
+	if !ok {
+		return false
+	}
+	proxyURL, err := proxyFromEnv(&http.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "https", Host: c.tlsServerName(n), Path: "/"},
+	})
+	return err == nil && proxyURL != nil
+}
+
+// dialQUIC connects to n over QUIC, trying IPv4 and then IPv6 (both as
+// applicable), from UDP sockets in the logical network namespace that
+// doesn't route back into Tailscale.
+func (c *Client) dialQUIC(ctx context.Context, n *tailcfg.DERPNode) (QUICConn, error) {
+	type attempt struct{ network, host string }
+	var attempts []attempt
+	if shouldDialProto(n.IPv4, netip.Addr.Is4) {
+		attempts = append(attempts, attempt{"udp4", cmp.Or(n.IPv4, n.HostName)})
+	}
+	if shouldDialProto(n.IPv6, netip.Addr.Is6) {
+		attempts = append(attempts, attempt{"udp6", cmp.Or(n.IPv6, n.HostName)})
+	}
+	if c.preferIPv6() && len(attempts) == 2 {
+		attempts[0], attempts[1] = attempts[1], attempts[0]
+	}
+	if len(attempts) == 0 {
+		return nil, errors.New("both IPv4 and IPv6 are explicitly disabled for node")
+	}
+
+	// Give each address family an equal share of the time left, so that
+	// a blackholed one doesn't prevent trying the other.
+	var firstErr error
+	for i, a := range attempts {
+		actx := ctx
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			actx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(attempts)-i))
+			defer cancel()
+		}
+		nc, err := c.dialQUICAddr(actx, a.network, net.JoinHostPort(a.host, fmt.Sprint(n.QUICPort)), n)
+		if err == nil {
+			return nc, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// dialQUICAddr connects to n at addr, on the given "udp4" or "udp6" network,
+// over QUIC.
+func (c *Client) dialQUICAddr(ctx context.Context, network, addr string, n *tailcfg.DERPNode) (QUICConn, error) {
+	pc, err := netns.Listener(c.logf, c.netMon).ListenPacket(ctx, network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	return HookDialQUIC.Get()(ctx, pc, network, addr, c.tlsConfig(n))
+}
+
+// connectQUICLocked connects to node over QUIC. On success, it makes the
+// connection the current one, like connect.
+func (c *Client) connectQUICLocked(ctx context.Context, node *tailcfg.DERPNode) (*derp.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, quicConnectTimeout)
+	defer cancel()
+
+	nc, err := c.dialQUIC(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	// Force close the connection if the DERP handshake takes too long.
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	derpClient, err := derp.NewClient(c.privateKey, nc, brw, c.logf,
+		derp.MeshKey(c.MeshKey),
+		derp.CanAckPings(c.canAckPings),
+		derp.IsProber(c.IsProber),
+	)
+	if err == nil && c.preferred {
+		err = derpClient.NotePreferred(true)
+	}
+	if err == nil && c.WatchConnectionChanges {
+		err = derpClient.WatchConnectionChanges()
+	}
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	cs := nc.ConnectionState()
+	c.serverPubKey = derpClient.ServerPublicKey()
+	c.client = derpClient
+	c.netConn = nc
+	c.tlsState = &cs
+	c.usingQUIC = true
+	c.connGen++
+
+	localAddr, _ := derpClient.LocalAddr()
+	c.atomicState.Store(ConnectedState{
+		Connected: true,
+		LocalAddr: localAddr,
+	})
+	return derpClient, nil
+}
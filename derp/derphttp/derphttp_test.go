@@ -22,14 +22,18 @@
 	"testing/synctest"
 	"time"
 
+	"golang.org/x/net/quic"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/derp/derpquic"
 	"tailscale.com/derp/derpserver"
+	_ "tailscale.com/feature/derpquic"
 	"tailscale.com/net/memnet"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netx"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
+	"tailscale.com/tstest/tlstest"
 	"tailscale.com/types/key"
 )
 
@@ -562,6 +566,143 @@ func TestNotifyError(t *testing.T) {
 	}
 }
 
+func TestRegionClientQUIC(t *testing.T) {
+	serverPrivateKey := key.NewNode()
+	s := derpserver.New(serverPrivateKey, t.Logf)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ep, err := quic.Listen("udp", "127.0.0.1:0", derpquic.Config(tlstest.Derper.ServerTLSConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ep.Close(ctx)
+	}()
+	go s.ServeQUIC(ctx, ep, nil)
+
+	node := &tailcfg.DERPNode{
+		Name:             "1a",
+		RegionID:         1,
+		HostName:         string(tlstest.Derper),
+		IPv4:             "127.0.0.1",
+		QUICPort:         int(ep.LocalAddr().Port()),
+		InsecureForTests: true,
+	}
+	region := &tailcfg.DERPRegion{RegionID: 1, RegionCode: "test", Nodes: []*tailcfg.DERPNode{node}}
+	c := derphttp.NewRegionClient(key.NewNode(), t.Logf, netmon.NewStatic(), func() *tailcfg.DERPRegion {
+		return region
+	})
+	defer c.Close()
+	c.ForceQUIC = true
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !c.UsingQUIC() {
+		t.Error("UsingQUIC = false")
+	}
+	if got, want := c.ServerPublicKey(), serverPrivateKey.Public(); got != want {
+		t.Errorf("server key = %v, want %v", got, want)
+	}
+
+	// With QUIC forced, nodes without a QUIC port aren't dialed at all.
+	tcpOnly := &tailcfg.DERPRegion{RegionID: 2, RegionCode: "tcp", Nodes: []*tailcfg.DERPNode{{
+		Name:     "2a",
+		RegionID: 2,
+		HostName: string(tlstest.Derper),
+		IPv4:     "127.0.0.1",
+	}}}
+	c2 := derphttp.NewRegionClient(key.NewNode(), t.Logf, netmon.NewStatic(), func() *tailcfg.DERPRegion {
+		return tcpOnly
+	})
+	defer c2.Close()
+	c2.ForceQUIC = true
+	if err := c2.Connect(ctx); err == nil {
+		t.Error("connecting to a region without QUIC: unexpected success")
+	}
+}
+
+// TestRegionClientQUICAdvertised tests that clients connect over QUIC to
+// nodes that advertise a QUICPort, without ForceQUIC.
+func TestRegionClientQUICAdvertised(t *testing.T) {
+	s := derpserver.New(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ep, err := quic.Listen("udp", "127.0.0.1:0", derpquic.Config(tlstest.Derper.ServerTLSConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ep.Close(ctx)
+	}()
+	go s.ServeQUIC(ctx, ep, nil)
+
+	node := &tailcfg.DERPNode{
+		Name:             "1a",
+		RegionID:         1,
+		HostName:         string(tlstest.Derper),
+		IPv4:             "127.0.0.1",
+		QUICPort:         int(ep.LocalAddr().Port()),
+		InsecureForTests: true,
+	}
+	c := derphttp.NewRegionClient(key.NewNode(), t.Logf, netmon.NewStatic(), func() *tailcfg.DERPRegion {
+		return &tailcfg.DERPRegion{RegionID: 1, RegionCode: "test", Nodes: []*tailcfg.DERPNode{node}}
+	})
+	defer c.Close()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !c.UsingQUIC() {
+		t.Error("UsingQUIC = false")
+	}
+}
+
+func TestRegionClientQUICIPv6(t *testing.T) {
+	s := derpserver.New(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ep, err := quic.Listen("udp6", "[::1]:0", derpquic.Config(tlstest.Derper.ServerTLSConfig()))
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ep.Close(ctx)
+	}()
+	go s.ServeQUIC(ctx, ep, nil)
+
+	node := &tailcfg.DERPNode{
+		Name:             "1a",
+		RegionID:         1,
+		HostName:         string(tlstest.Derper),
+		IPv4:             "none",
+		IPv6:             "::1",
+		QUICPort:         int(ep.LocalAddr().Port()),
+		InsecureForTests: true,
+	}
+	c := derphttp.NewRegionClient(key.NewNode(), t.Logf, netmon.NewStatic(), func() *tailcfg.DERPRegion {
+		return &tailcfg.DERPRegion{RegionID: 1, RegionCode: "test", Nodes: []*tailcfg.DERPNode{node}}
+	})
+	defer c.Close()
+	c.ForceQUIC = true
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !c.UsingQUIC() {
+		t.Error("UsingQUIC = false")
+	}
+}
+
 var liveNetworkTest = flag.Bool("live-net-tests", false, "run live network tests")
 
 func TestManualDial(t *testing.T) {
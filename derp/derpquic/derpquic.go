@@ -0,0 +1,208 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package derpquic implements the QUIC transport of DERP connections.
+//
+// A DERP connection over QUIC is a single bidirectional stream, opened by
+// the server once the QUIC handshake is done, which carries the same
+// frames (including the server key and client info frames that
+// authenticate the connection) as a DERP connection over TLS over TCP.
+// There's no HTTP upgrade: the ALPN protocol identifies the connection as
+// DERP.
+package derpquic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// ALPN is the ALPN protocol of DERP connections over QUIC.
+const ALPN = "tailscale-derp"
+
+const (
+	// keepAlivePeriod is how often to send QUIC keep-alives. It's
+	// shorter than the DERP keep-alive so NAT mappings for the UDP
+	// flow don't expire.
+	keepAlivePeriod = 25 * time.Second
+
+	// maxIdleTimeout is how long an idle connection is kept.
+	maxIdleTimeout = 2 * time.Minute
+)
+
+// Config returns the QUIC configuration of a DERP client or server, with
+// a clone of tlsConf set to negotiate ALPN.
+func Config(tlsConf *tls.Config) *quic.Config {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{ALPN}
+	tlsConf.MinVersion = tls.VersionTLS13
+	return &quic.Config{
+		TLSConfig:       tlsConf,
+		KeepAlivePeriod: keepAlivePeriod,
+		MaxIdleTimeout:  maxIdleTimeout,
+	}
+}
+
+// Conn is a DERP connection over QUIC. It implements net.Conn, so it can
+// be used as a derp.Conn by DERP clients and servers.
+type Conn struct {
+	qc *quic.Conn
+	st *quic.Stream
+	ep *quic.Endpoint // or nil if not owned by the Conn
+
+	mu          sync.Mutex
+	readCancel  context.CancelFunc // or nil
+	writeCancel context.CancelFunc // or nil
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// Dial dials the DERP server at addr, a UDP "host:port", over QUIC from
+// pc, and waits for it to open the DERP stream. network is the network of
+// addr, "udp", "udp4" or "udp6". tlsConf is used to verify the server; see
+// Config.
+//
+// Dial takes ownership of pc, which is closed along with the returned Conn,
+// or if Dial fails. Callers can create pc with a netns-aware
+// net.ListenConfig, so that DERP connections don't route through
+// Tailscale.
+func Dial(ctx context.Context, pc net.PacketConn, network, addr string, tlsConf *tls.Config) (*Conn, error) {
+	ep, err := quic.NewEndpoint(pc, nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	qc, err := ep.Dial(ctx, network, addr, Config(tlsConf))
+	if err != nil {
+		go ep.Close(context.Background())
+		return nil, err
+	}
+	st, err := qc.AcceptStream(ctx)
+	if err != nil {
+		qc.Abort(nil)
+		go ep.Close(context.Background())
+		return nil, err
+	}
+	c := NewConn(qc, st)
+	c.ep = ep
+	return c, nil
+}
+
+// Accept opens the DERP stream of qc, a new connection accepted by a DERP
+// server.
+func Accept(ctx context.Context, qc *quic.Conn) (*Conn, error) {
+	st, err := qc.NewStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(qc, st), nil
+}
+
+// NewConn returns a DERP connection over the stream st of qc.
+func NewConn(qc *quic.Conn, st *quic.Stream) *Conn {
+	return &Conn{qc: qc, st: st}
+}
+
+// QUICConn returns the underlying QUIC connection.
+func (c *Conn) QUICConn() *quic.Conn { return c.qc }
+
+// ConnectionState returns the TLS state of the connection.
+func (c *Conn) ConnectionState() tls.ConnectionState { return c.qc.ConnectionState() }
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.st.Read(b)
+	if err != nil && err != io.EOF && c.peerClosed() {
+		err = io.EOF
+	}
+	return n, mapErr(err)
+}
+
+// peerClosed reports whether the peer closed the connection without an
+// error, which is the QUIC equivalent of a TCP FIN.
+func (c *Conn) peerClosed() bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return c.qc.Wait(ctx) == nil
+}
+
+// Write writes b to the stream and flushes it. DERP clients and servers
+// buffer their writes, so each Write is a batch of frames to send.
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.st.Write(b)
+	if err == nil {
+		err = c.st.Flush()
+	}
+	return n, mapErr(err)
+}
+
+// mapErr maps the errors of operations canceled by a read or write
+// deadline to os.ErrDeadlineExceeded, as returned by other net.Conns.
+func mapErr(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// Close closes the connection without waiting for the peer to acknowledge
+// it, and the endpoint it was dialed from, if any.
+func (c *Conn) Close() error {
+	c.qc.Abort(nil)
+	if c.ep != nil {
+		go c.ep.Close(context.Background())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readCancel != nil {
+		c.readCancel()
+	}
+	if c.writeCancel != nil {
+		c.writeCancel()
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return net.UDPAddrFromAddrPort(c.qc.LocalAddr()) }
+func (c *Conn) RemoteAddr() net.Addr { return net.UDPAddrFromAddrPort(c.qc.RemoteAddr()) }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.st.SetReadContext(deadlineContext(t, &c.readCancel))
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.st.SetWriteContext(deadlineContext(t, &c.writeCancel))
+	return nil
+}
+
+// deadlineContext returns a context done at t, or never if t is zero,
+// replacing the previous one, whose cancel func is in *cancel.
+func deadlineContext(t time.Time, cancel *context.CancelFunc) context.Context {
+	if *cancel != nil {
+		(*cancel)()
+		*cancel = nil
+	}
+	if t.IsZero() {
+		return context.Background()
+	}
+	ctx, cf := context.WithDeadline(context.Background(), t)
+	*cancel = cf
+	return ctx
+}
@@ -150,6 +150,8 @@ type Server struct {
 	gotPing                    expvar.Int // number of ping frames from client
 	sentPong                   expvar.Int // number of pong frames enqueued to client
 	accepts                    expvar.Int
+	acceptsQUIC                expvar.Int
+	rejectsQUIC                expvar.Int // over the QUIC accept rate limit
 	curClients                 expvar.Int
 	curClientsNotIdeal         expvar.Int
 	curHomeClients             expvar.Int // ones with preferred
@@ -163,6 +165,7 @@ type Server struct {
 	multiForwarderDeleted      expvar.Int
 	removePktForwardOther      expvar.Int
 	sclientWriteTimeouts       expvar.Int
+	framesRateLimited          expvar.Int       // number of frames delayed by rate limits
 	avgQueueDuration           *uint64          // In milliseconds; accessed atomically
 	tcpRtt                     metrics.LabelMap // histogram
 	meshUpdateBatchSize        *metrics.Histogram
@@ -177,6 +180,8 @@ type Server struct {
 	verifyClientsURL         string
 	verifyClientsURLFailOpen bool
 
+	rateLimits RateLimits // static after SetRateLimits
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[derp.Conn]chan struct{} // chan is closed when conn closes
@@ -197,6 +202,10 @@ type Server struct {
 	// maps from netip.AddrPort to a client's public key
 	keyOfAddr map[netip.AddrPort]key.NodePublic
 
+	// rateLimiters are the rate limiters of the connected clients'
+	// keys and IP addresses.
+	rateLimiters map[rateLimiterKey]*rateLimiter
+
 	// Sets the client send queue depth for the server.
 	perClientSendQueueDepth int
 
@@ -438,6 +447,7 @@ func genDroppedCounters() {
 		dropReasonQueueTail,
 		dropReasonWriteError,
 		dropReasonDupClient,
+		dropReasonRateLimited,
 	}
 
 	for _, dr := range dropReasons {
@@ -708,6 +718,7 @@ func (s *Server) registerClient(c *sclient) {
 		s.clientsMesh[c.key] = nil // just for varz of total users in cluster
 	}
 	s.keyOfAddr[c.remoteIPPort] = c.key
+	s.addRateLimitersLocked(c)
 	s.curClients.Add(1)
 	if c.isNotIdealConn {
 		s.curClientsNotIdeal.Add(1)
@@ -736,6 +747,7 @@ func (s *Server) broadcastPeerStateChangeLocked(peer key.NodePublic, ipPort neti
 func (s *Server) unregisterClient(c *sclient) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.removeRateLimitersLocked(c)
 
 	set, ok := s.clients[c.key]
 	if !ok {
@@ -922,7 +934,8 @@ func (s *Server) accept(ctx context.Context, nc derp.Conn, brw *bufio.ReadWriter
 	}
 
 	remoteIPPort, _ := netip.ParseAddrPort(remoteAddr)
-	if err := s.verifyClient(ctx, clientKey, clientInfo, remoteIPPort.Addr()); err != nil {
+	verified, err := s.verifyClient(ctx, clientKey, clientInfo, remoteIPPort.Addr())
+	if err != nil {
 		return fmt.Errorf("client %v rejected: %v", clientKey, err)
 	}
 
@@ -948,6 +961,7 @@ func (s *Server) accept(ctx context.Context, nc derp.Conn, brw *bufio.ReadWriter
 		sendPongCh:     make(chan [8]byte, 1),
 		peerGone:       make(chan peerGoneMsg),
 		canMesh:        s.isMeshPeer(clientInfo),
+		verified:       verified,
 		isNotIdealConn: IdealNodeContextKey.Value(ctx) != "",
 		peerGoneLim:    rate.NewLimiter(rate.Every(time.Second), 3),
 	}
@@ -1020,6 +1034,9 @@ func (c *sclient) run(ctx context.Context) error {
 			return fmt.Errorf("client %s: readFrameHeader: %w", c.key.ShortString(), err)
 		}
 		c.s.noteClientActivity(c)
+		if err := c.waitFrameLimit(ctx); err != nil {
+			return nil
+		}
 		switch ft {
 		case derp.FrameNotePreferred:
 			err = c.handleFrameNotePreferred(ft, fl)
@@ -1181,6 +1198,10 @@ func (c *sclient) handleFrameSendPacket(ft derp.FrameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %v: recvPacket: %v", c.key, err)
 	}
+	if !c.allowPacket(len(contents)) {
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		return nil
+	}
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -1249,6 +1270,7 @@ type dropReasonKindLabels struct {
 	dropReasonQueueTail        dropReason = "queue_tail"          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError       dropReason = "write_error"         // OS write() failed
 	dropReasonDupClient        dropReason = "dup_client"          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited      dropReason = "rate_limited"        // the sender is over its byte rate limit
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1368,27 +1390,30 @@ func (s *Server) isMeshPeer(info *derp.ClientInfo) bool {
 
 // verifyClient checks whether the client is allowed to connect to the derper,
 // depending on how & whether the server's been configured to verify.
-func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, info *derp.ClientInfo, clientIP netip.Addr) error {
+// It reports whether the client was verified, rather than being allowed
+// without verification.
+func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, info *derp.ClientInfo, clientIP netip.Addr) (verified bool, _ error) {
 	if s.isMeshPeer(info) {
 		// Trusted mesh peer. No need to verify further. In fact, verifying
 		// further wouldn't work: it's not part of the tailnet so tailscaled and
 		// likely the admission control URL wouldn't know about it.
-		return nil
+		return true, nil
 	}
 
 	// tailscaled-based verification:
 	if s.verifyClientsLocalTailscaled {
 		_, err := s.localClient.WhoIsNodeKey(ctx, clientKey)
 		if err == local.ErrPeerNotFound {
-			return fmt.Errorf("peer %v not authorized (not found in local tailscaled)", clientKey)
+			return false, fmt.Errorf("peer %v not authorized (not found in local tailscaled)", clientKey)
 		}
 		if err != nil {
 			if strings.Contains(err.Error(), "invalid 'addr' parameter") {
 				// Issue 12617
-				return errors.New("tailscaled version is too old (out of sync with derper binary)")
+				return false, errors.New("tailscaled version is too old (out of sync with derper binary)")
 			}
-			return fmt.Errorf("failed to query local tailscaled status for %v: %w", clientKey, err)
+			return false, fmt.Errorf("failed to query local tailscaled status for %v: %w", clientKey, err)
 		}
+		verified = true
 	}
 
 	// admission controller-based verification:
@@ -1401,34 +1426,34 @@ func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, inf
 			Source:     clientIP,
 		})
 		if err != nil {
-			return err
+			return false, err
 		}
 		req, err := http.NewRequestWithContext(ctx, "POST", s.verifyClientsURL, bytes.NewReader(jreq))
 		if err != nil {
-			return err
+			return false, err
 		}
 		res, err := http.DefaultClient.Do(req)
 		if err != nil {
 			if s.verifyClientsURLFailOpen {
 				s.logf("admission controller unreachable; allowing client %v", clientKey)
-				return nil
+				return false, nil
 			}
-			return err
+			return false, err
 		}
 		defer res.Body.Close()
 		if res.StatusCode != 200 {
-			return fmt.Errorf("admission controller: %v", res.Status)
+			return false, fmt.Errorf("admission controller: %v", res.Status)
 		}
 		var jres tailcfg.DERPAdmitClientResponse
 		if err := json.NewDecoder(io.LimitReader(res.Body, 4<<10)).Decode(&jres); err != nil {
-			return err
+			return false, err
 		}
 		if !jres.Allow {
-			return fmt.Errorf("admission controller: %v/%v not allowed", clientKey, clientIP)
+			return false, fmt.Errorf("admission controller: %v/%v not allowed", clientKey, clientIP)
 		}
-		// TODO(bradfitz): add policy for configurable bandwidth rate per client?
+		verified = true
 	}
-	return nil
+	return verified, nil
 }
 
 func (s *Server) sendServerKey(lw *lazyBufioWriter) error {
@@ -1629,6 +1654,7 @@ type sclient struct {
 	peerGone       chan peerGoneMsg // write request that a peer is not at this server (not used by mesh peers)
 	meshUpdate     chan struct{}    // write request to write peerStateChange
 	canMesh        bool             // clientInfo had correct mesh token for inter-region routing
+	verified       bool             // the client was verified when admitted (see Server.verifyClient)
 	isNotIdealConn bool             // client indicated it is not its ideal node in the region
 	isDup          atomic.Bool      // whether more than 1 sclient for key is connected
 	isDisabled     atomic.Bool      // whether sends to this peer are disabled due to active/active dups
@@ -1655,6 +1681,12 @@ type sclient struct {
 	// client that it's trying to establish a direct connection
 	// through us with a peer we have no record of.
 	peerGoneLim *rate.Limiter
+
+	// keyLimiter and ipLimiter are the rate limiters of the client's
+	// key and IP address, or nil if it isn't rate limited. They're set
+	// by registerClient.
+	keyLimiter, ipLimiter       *rateLimiter
+	keyLimiterKey, ipLimiterKey rateLimiterKey
 }
 
 func (c *sclient) presentFlags() derp.PeerPresentFlags {
@@ -2192,6 +2224,8 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_current_dup_client_conns", &s.dupClientConns)
 	m.Set("counter_total_dup_client_conns", &s.dupClientConnTotal)
 	m.Set("accepts", &s.accepts)
+	m.Set("accepts_quic", &s.acceptsQUIC)
+	m.Set("counter_rejected_quic_connections", &s.rejectsQUIC)
 	m.Set("bytes_received", &s.bytesRecv)
 	m.Set("bytes_sent", &s.bytesSent)
 	m.Set("counter_packets_received_kind", &s.packetsRecvByKind)
@@ -2210,6 +2244,8 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
 	m.Set("sclient_write_timeouts", &s.sclientWriteTimeouts)
+	m.Set("counter_rate_limited_frames", &s.framesRateLimited)
+	m.Set("gauge_rate_limiters", s.expVarFunc(func() any { return len(s.rateLimiters) }))
 	m.Set("average_queue_duration_ms", expvar.Func(func() any {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
@@ -2281,7 +2317,7 @@ func (s *Server) checkVerifyClientsLocalTailscaled() error {
 		IsProber: true,
 	}
 	clientIP := netip.IPv6Loopback()
-	if err := s.verifyClient(ctx, status.Self.PublicKey, info, clientIP); err != nil {
+	if _, err := s.verifyClient(ctx, status.Self.PublicKey, info, clientIP); err != nil {
 		return fmt.Errorf("verifyClient for self nodekey: %w", err)
 	}
 	return nil
@@ -2296,6 +2332,12 @@ type BytesSentRecv struct {
 	Recv uint64
 	// Key is the public key of the client which sent/received these bytes.
 	Key key.NodePublic
+
+	// RateLimitedFrames and RateLimitedPackets are the total number of
+	// frames from the client's key delayed, and of its packets dropped,
+	// by its rate limits (see RateLimits).
+	RateLimitedFrames  int64 `json:",omitempty"`
+	RateLimitedPackets int64 `json:",omitempty"`
 }
 
 // parseSSOutput parses the output from the specific call to ss in ServeDebugTraffic.
@@ -2349,6 +2391,7 @@ func (s *Server) ServeDebugTraffic(w http.ResponseWriter, r *http.Request) {
 			if prev.Sent < next.Sent || prev.Recv < next.Recv {
 				if pkey, ok := s.keyOfAddr[k]; ok {
 					next.Key = pkey
+					next.RateLimitedFrames, next.RateLimitedPackets = s.rateLimitStatsLocked(pkey)
 					if err := enc.Encode(next); err != nil {
 						s.mu.Unlock()
 						return
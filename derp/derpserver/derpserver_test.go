@@ -13,6 +13,7 @@
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"reflect"
 	"strconv"
@@ -25,6 +26,7 @@
 	"golang.org/x/time/rate"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derpconst"
+	"tailscale.com/tstest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
@@ -605,6 +607,114 @@ func TestServerDupClients(t *testing.T) {
 	})
 }
 
+func TestRateLimits(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	s := New(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.clock = clock
+	if err := s.SetRateLimits(RateLimits{
+		Verified: ClientRateLimits{
+			PerKey: RateLimit{BytesPerSecond: 2 * derp.MaxPacketSize},
+		},
+		Unverified: ClientRateLimits{
+			PerKey: RateLimit{FramesPerSecond: 1},
+			PerIP:  RateLimit{BytesPerSecond: 1000},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRateLimits(RateLimits{Verified: ClientRateLimits{PerKey: RateLimit{BytesPerSecond: 1, ByteBurst: 1}}}); err == nil {
+		t.Error("byte burst less than a packet: unexpected success")
+	}
+
+	newClient := func(ip string, verified, mesh bool) *sclient {
+		c := &sclient{
+			s:            s,
+			key:          key.NewNode().Public(),
+			remoteIPPort: netip.AddrPortFrom(netip.MustParseAddr(ip), 1234),
+			verified:     verified,
+			canMesh:      mesh,
+			logf:         t.Logf,
+		}
+		s.registerClient(c)
+		return c
+	}
+
+	// Verified clients have their own byte budget per key.
+	v1 := newClient("192.0.2.1", true, false)
+	v2 := newClient("192.0.2.1", true, false)
+	for _, c := range []*sclient{v1, v2} {
+		for i := range 2 {
+			if !c.allowPacket(derp.MaxPacketSize) {
+				t.Fatalf("verified packet %d dropped", i)
+			}
+		}
+	}
+	if v1.allowPacket(derp.MaxPacketSize) {
+		t.Error("verified packet over the limit allowed")
+	}
+	clock.Advance(time.Second)
+	if !v1.allowPacket(derp.MaxPacketSize) {
+		t.Error("verified packet dropped after refill")
+	}
+
+	// Unverified clients at the same IP share its byte budget.
+	u1 := newClient("192.0.2.1", false, false)
+	u2 := newClient("192.0.2.1", false, false)
+	if !u1.allowPacket(derp.MaxPacketSize) {
+		t.Fatal("first unverified packet dropped")
+	}
+	if u2.allowPacket(1) {
+		t.Error("unverified packet over the IP's limit allowed")
+	}
+
+	// Mesh peers aren't limited.
+	m := newClient("192.0.2.1", false, true)
+	for range 10 {
+		if !m.allowPacket(derp.MaxPacketSize) {
+			t.Fatal("mesh peer packet dropped")
+		}
+	}
+
+	// Unverified clients' frames are delayed beyond one per second.
+	ctx := t.Context()
+	if err := u1.waitFrameLimit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- u1.waitFrameLimit(ctx) }()
+	select {
+	case err := <-done:
+		t.Fatalf("second frame not delayed (err %v)", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := s.framesRateLimited.Value(); got != 1 {
+		t.Errorf("framesRateLimited = %d, want 1", got)
+	}
+
+	s.mu.Lock()
+	frames, packets := s.rateLimitStatsLocked(u1.key)
+	n := len(s.rateLimiters)
+	s.mu.Unlock()
+	if frames != 1 || packets != 0 {
+		t.Errorf("u1 stats = %d frames, %d packets; want 1, 0", frames, packets)
+	}
+	// Limiters for v1, v2, u1, u2 and the unverified IP.
+	if n != 5 {
+		t.Errorf("%d rate limiters, want 5", n)
+	}
+	for _, c := range []*sclient{v1, v2, u1, u2, m} {
+		s.unregisterClient(c)
+	}
+	if n := len(s.rateLimiters); n != 0 {
+		t.Errorf("%d rate limiters after all clients left, want 0", n)
+	}
+}
+
 func TestLimiter(t *testing.T) {
 	rl := rate.NewLimiter(rate.Every(time.Minute), 100)
 	for i := range 200 {
@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpserver
+
+import (
+	"bufio"
+	"context"
+	"time"
+
+	"golang.org/x/net/quic"
+	xrate "golang.org/x/time/rate"
+	"tailscale.com/derp/derpquic"
+)
+
+// ServeQUIC serves DERP connections over QUIC accepted on ep, until ep is
+// closed or ctx is done. ep must have been created with a configuration
+// from derpquic.Config.
+//
+// If lim is non-nil, connections accepted over its rate are closed
+// immediately, like those over the accept limit of a TCP listener. It may
+// be shared with the TCP listener, to limit the rate of both.
+func (s *Server) ServeQUIC(ctx context.Context, ep *quic.Endpoint, lim *xrate.Limiter) error {
+	for {
+		qc, err := ep.Accept(ctx)
+		if err != nil {
+			return err
+		}
+		if lim != nil && !lim.Allow() {
+			s.rejectsQUIC.Add(1)
+			qc.Abort(nil)
+			continue
+		}
+		s.acceptsQUIC.Add(1)
+		go s.serveQUICConn(ctx, qc)
+	}
+}
+
+func (s *Server) serveQUICConn(ctx context.Context, qc *quic.Conn) {
+	openCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	nc, err := derpquic.Accept(openCtx, qc)
+	if err != nil {
+		s.logf("derp: %v: opening QUIC stream: %v", qc.RemoteAddr(), err)
+		qc.Abort(nil)
+		return
+	}
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	s.Accept(ctx, nc, brw, qc.RemoteAddr().String())
+}
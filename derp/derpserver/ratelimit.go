@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpserver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	xrate "golang.org/x/time/rate"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// RateLimit is a pair of token bucket limits on the traffic of a client,
+// or of all the clients at an IP address. Zero rates mean unlimited.
+type RateLimit struct {
+	// FramesPerSecond and FrameBurst limit the rate at which frames are
+	// read from the client. Once it's over the limit, the server stops
+	// reading from its connection until it's back under it.
+	FramesPerSecond float64 `json:",omitempty"`
+	FrameBurst      int     `json:",omitempty"` // default: FramesPerSecond, rounded up
+
+	// BytesPerSecond and ByteBurst limit the bytes of the packets the
+	// client sends that the server forwards, whether to a client connected
+	// to it or to a mesh peer. Packets over the limit are dropped.
+	BytesPerSecond float64 `json:",omitempty"`
+	ByteBurst      int     `json:",omitempty"` // default and minimum: derp.MaxPacketSize, or BytesPerSecond if more
+}
+
+// ClientRateLimits are the rate limits of a class of clients.
+type ClientRateLimits struct {
+	PerKey RateLimit `json:",omitempty"` // for each client node key
+	PerIP  RateLimit `json:",omitempty"` // for all the clients at each source IP address
+}
+
+// RateLimits are the rate limits of the clients of a Server. Mesh peers
+// aren't limited, as the packets they forward were already limited by the
+// server they were sent to.
+type RateLimits struct {
+	// Verified are the limits of the clients admitted after verification
+	// (see SetVerifyClient and SetVerifyClientURL).
+	Verified ClientRateLimits `json:",omitempty"`
+
+	// Unverified are the limits of the clients admitted without
+	// verification: all of them if verification is disabled, and those
+	// admitted because the admission controller was unreachable.
+	Unverified ClientRateLimits `json:",omitempty"`
+}
+
+func (l RateLimit) check() error {
+	if l.FramesPerSecond < 0 || l.BytesPerSecond < 0 || l.FrameBurst < 0 || l.ByteBurst < 0 {
+		return fmt.Errorf("negative limit")
+	}
+	if l.ByteBurst != 0 && l.ByteBurst < derp.MaxPacketSize {
+		return fmt.Errorf("byte burst %d is less than the maximum packet size %d", l.ByteBurst, derp.MaxPacketSize)
+	}
+	return nil
+}
+
+func (l ClientRateLimits) isZero() bool { return l == ClientRateLimits{} }
+
+// SetRateLimits sets the rate limits of clients. It must be called before
+// serving begins.
+func (s *Server) SetRateLimits(limits RateLimits) error {
+	for _, l := range []RateLimit{limits.Verified.PerKey, limits.Verified.PerIP, limits.Unverified.PerKey, limits.Unverified.PerIP} {
+		if err := l.check(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimits = limits
+	return nil
+}
+
+// rateLimiterKey is the key of a rateLimiter in Server.rateLimiters. Only
+// one of key and ip is set.
+type rateLimiterKey struct {
+	key      key.NodePublic
+	ip       netip.Addr
+	verified bool
+}
+
+// rateLimiter enforces a RateLimit for the connections of one node key or
+// source IP address.
+type rateLimiter struct {
+	frames *xrate.Limiter // or nil if unlimited
+	bytes  *xrate.Limiter // or nil if unlimited
+	refs   int            // connections using it; guarded by Server.mu
+
+	framesDelayed  atomic.Int64
+	packetsDropped atomic.Int64
+}
+
+func newRateLimiter(l RateLimit) *rateLimiter {
+	rl := &rateLimiter{}
+	if l.FramesPerSecond > 0 {
+		burst := l.FrameBurst
+		if burst == 0 {
+			burst = int(math.Ceil(l.FramesPerSecond))
+		}
+		rl.frames = xrate.NewLimiter(xrate.Limit(l.FramesPerSecond), burst)
+	}
+	if l.BytesPerSecond > 0 {
+		burst := l.ByteBurst
+		if burst == 0 {
+			burst = max(derp.MaxPacketSize, int(math.Ceil(l.BytesPerSecond)))
+		}
+		rl.bytes = xrate.NewLimiter(xrate.Limit(l.BytesPerSecond), burst)
+	}
+	return rl
+}
+
+// addRateLimitersLocked sets the rate limiters of the new client c,
+// creating them if it's the first connection of its key or IP address.
+func (s *Server) addRateLimitersLocked(c *sclient) {
+	if c.canMesh {
+		return
+	}
+	verified := c.verified
+	limits := s.rateLimits.Unverified
+	if verified {
+		limits = s.rateLimits.Verified
+	}
+	if limits.isZero() {
+		return
+	}
+	get := func(k rateLimiterKey, l RateLimit) *rateLimiter {
+		if l == (RateLimit{}) {
+			return nil
+		}
+		rl, ok := s.rateLimiters[k]
+		if !ok {
+			rl = newRateLimiter(l)
+			if s.rateLimiters == nil {
+				s.rateLimiters = map[rateLimiterKey]*rateLimiter{}
+			}
+			s.rateLimiters[k] = rl
+		}
+		rl.refs++
+		return rl
+	}
+	c.keyLimiter = get(rateLimiterKey{key: c.key, verified: verified}, limits.PerKey)
+	c.keyLimiterKey = rateLimiterKey{key: c.key, verified: verified}
+	if ip := c.remoteIPPort.Addr(); ip.IsValid() {
+		c.ipLimiter = get(rateLimiterKey{ip: ip, verified: verified}, limits.PerIP)
+		c.ipLimiterKey = rateLimiterKey{ip: ip, verified: verified}
+	}
+}
+
+// removeRateLimitersLocked releases the rate limiters of the disconnected
+// client c, deleting those no other client uses.
+func (s *Server) removeRateLimitersLocked(c *sclient) {
+	put := func(k rateLimiterKey, rl *rateLimiter) {
+		if rl == nil {
+			return
+		}
+		if rl.refs--; rl.refs == 0 {
+			delete(s.rateLimiters, k)
+		}
+	}
+	put(c.keyLimiterKey, c.keyLimiter)
+	put(c.ipLimiterKey, c.ipLimiter)
+}
+
+// waitFrameLimit waits until c may send another frame, if it's over its
+// frame rate limits.
+func (c *sclient) waitFrameLimit(ctx context.Context) error {
+	if c.keyLimiter == nil && c.ipLimiter == nil {
+		return nil
+	}
+	now := c.s.clock.Now()
+	var delay time.Duration
+	var limited *rateLimiter
+	for _, rl := range []*rateLimiter{c.keyLimiter, c.ipLimiter} {
+		if rl == nil || rl.frames == nil {
+			continue
+		}
+		if d := rl.frames.ReserveN(now, 1).DelayFrom(now); d > delay {
+			delay, limited = d, rl
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+	limited.framesDelayed.Add(1)
+	c.s.framesRateLimited.Add(1)
+	tc, timer := c.s.clock.NewTimer(delay)
+	defer tc.Stop()
+	select {
+	case <-timer:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// allowPacket reports whether c may send a packet of n bytes under its
+// byte rate limits, and takes the tokens for it if so.
+func (c *sclient) allowPacket(n int) bool {
+	if c.keyLimiter == nil && c.ipLimiter == nil {
+		return true
+	}
+	now := c.s.clock.Now()
+	var taken []*xrate.Reservation
+	for _, rl := range []*rateLimiter{c.keyLimiter, c.ipLimiter} {
+		if rl == nil || rl.bytes == nil {
+			continue
+		}
+		r := rl.bytes.ReserveN(now, n)
+		if r.OK() && r.DelayFrom(now) == 0 {
+			taken = append(taken, r)
+			continue
+		}
+		// Over the limit. Return the tokens taken by this and any
+		// earlier limiter, so the packet isn't charged for.
+		r.CancelAt(now)
+		for _, r := range taken {
+			r.CancelAt(now)
+		}
+		rl.packetsDropped.Add(1)
+		return false
+	}
+	return true
+}
+
+// rateLimitStatsLocked returns the number of frames delayed and packets dropped
+// by the per-key rate limiter of k, if it has one.
+func (s *Server) rateLimitStatsLocked(k key.NodePublic) (framesDelayed, packetsDropped int64) {
+	for _, verified := range []bool{false, true} {
+		if rl, ok := s.rateLimiters[rateLimiterKey{key: k, verified: verified}]; ok {
+			framesDelayed += rl.framesDelayed.Load()
+			packetsDropped += rl.packetsDropped.Load()
+		}
+	}
+	return framesDelayed, packetsDropped
+}
@@ -0,0 +1,8 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build (ts_boltstore || (linux && !android)) && !ts_omit_boltstore
+
+package condregister
+
+import _ "tailscale.com/ipn/store/boltstore"
@@ -0,0 +1,25 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package derpquic registers support for connecting to DERP servers over
+// QUIC.
+package derpquic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/derp/derpquic"
+	"tailscale.com/feature"
+)
+
+func init() {
+	feature.Register("derpquic")
+	derphttp.HookDialQUIC.Set(dialQUIC)
+}
+
+func dialQUIC(ctx context.Context, pc net.PacketConn, network, addr string, tlsConf *tls.Config) (derphttp.QUICConn, error) {
+	return derpquic.Dial(ctx, pc, network, addr, tlsConf)
+}
@@ -118,6 +118,7 @@ type FeatureMeta struct {
 		Desc: "Bird BGP integration",
 		Deps: []FeatureTag{"advertiseroutes"},
 	},
+	"boltstore": {Sym: "BoltStore", Desc: "bbolt database state store (bolt:)"},
 	"c2n": {
 		Sym:                  "C2N",
 		Desc:                 "Control-to-node (C2N) support",
@@ -147,9 +148,11 @@ type FeatureMeta struct {
 		Desc: "portmapper debug support",
 		Deps: []FeatureTag{"portmapper"},
 	},
+	"derpquic":         {Sym: "DERPQUIC", Desc: "Connecting to DERP servers over QUIC"},
 	"desktop_sessions": {Sym: "DesktopSessions", Desc: "Desktop sessions support"},
 	"doctor":           {Sym: "Doctor", Desc: "Diagnose possible issues with Tailscale and its host environment"},
 	"drive":            {Sym: "Drive", Desc: "Tailscale Drive (file server) support"},
+	"encstore":         {Sym: "EncStore", Desc: "Encrypted-at-rest state file store (file+enc:)"},
 	"gro": {
 		Sym:  "GRO",
 		Desc: "Generic Receive Offload support (performance)",
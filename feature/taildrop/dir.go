@@ -0,0 +1,249 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+	"tailscale.com/util/set"
+	"tailscale.com/version/distro"
+)
+
+// A directory tree is sent by first sending its [apitype.TaildropManifest]
+// to the peerAPI /v0/put-dir/ endpoint, which is passed to
+// [manager.PutDirManifest]. Then each of its regular files is PUT as usual,
+// named by its slash-separated path, which [manager.PutFile] only accepts
+// for files in a manifest from the same client. Once the last file is
+// received, the modes and modification times of the directories are set.
+
+const (
+	// maxManifestEntries is the maximum number of files and directories
+	// of a directory transfer.
+	maxManifestEntries = 100_000
+
+	// maxManifestSize is the maximum size of a JSON-encoded manifest.
+	maxManifestSize = 64 << 20
+
+	// maxPathLen and maxPathDepth are the maximum length and number of
+	// elements of the path of a file in a directory transfer.
+	maxPathLen   = 4096
+	maxPathDepth = 64
+
+	// permMask limits the permission bits of received files and
+	// directories, which are never group or world writable.
+	permMask = 0o755
+)
+
+// incomingDir is a directory tree being received.
+type incomingDir struct {
+	dir string // subdirectory of the inbox that the tree is stored in, if any
+
+	mu        sync.Mutex
+	entries   map[string]apitype.TaildropEntry // by path
+	dirs      []apitype.TaildropEntry          // in manifest order
+	remaining set.Set[string]                  // paths of files not received yet
+}
+
+// validatePath reports whether p is a valid slash-separated path for a file
+// or directory in a directory transfer: every element must be a valid base
+// name.
+func validatePath(p string) error {
+	if len(p) > maxPathLen || strings.Count(p, "/") >= maxPathDepth {
+		return ErrInvalidFileName
+	}
+	for elem := range strings.SplitSeq(p, "/") {
+		if err := validateBaseName(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateManifest checks that man describes a valid directory tree, and
+// returns the name of its root directory.
+func validateManifest(man *apitype.TaildropManifest) (root string, err error) {
+	if len(man.Entries) == 0 {
+		return "", fmt.Errorf("%w: no entries", ErrInvalidManifest)
+	}
+	if len(man.Entries) > maxManifestEntries {
+		return "", fmt.Errorf("%w: more than %d entries", ErrInvalidManifest, maxManifestEntries)
+	}
+	root = man.Entries[0].Path
+	if !man.Entries[0].Mode.IsDir() {
+		return "", fmt.Errorf("%w: first entry is not a directory", ErrInvalidManifest)
+	}
+	if err := validateBaseName(root); err != nil {
+		return "", err
+	}
+	dirs := set.Of(root)
+	seen := make(set.Set[string], len(man.Entries))
+	for _, e := range man.Entries {
+		if err := validatePath(e.Path); err != nil {
+			return "", err
+		}
+		if seen.Contains(e.Path) {
+			return "", fmt.Errorf("%w: duplicate entry %q", ErrInvalidManifest, e.Path)
+		}
+		seen.Add(e.Path)
+		if e.Path != root && !dirs.Contains(path.Dir(e.Path)) {
+			return "", fmt.Errorf("%w: %q is not in a preceding directory", ErrInvalidManifest, e.Path)
+		}
+		switch {
+		case e.Mode.IsDir():
+			dirs.Add(e.Path)
+		case e.Mode.IsRegular():
+			if e.Size < 0 {
+				return "", fmt.Errorf("%w: %q has negative size", ErrInvalidManifest, e.Path)
+			}
+		default:
+			return "", fmt.Errorf("%w: %q is neither a directory nor a regular file", ErrInvalidManifest, e.Path)
+		}
+	}
+	return root, nil
+}
+
+// PutDirManifest starts receiving the directory tree described by man from
+// the given client id. It creates the directories of the tree, and returns
+// the paths of the files that were already received, with the same size and
+// modification time, which the client doesn't need to send again.
+//
+// The client then sends the other files of the tree with [manager.PutFile],
+// with the same dir. Calling PutDirManifest again for the same tree, such as
+// to resume an interrupted transfer, replaces the manifest.
+func (m *manager) PutDirManifest(id clientID, dir string, man *apitype.TaildropManifest) (have []string, err error) {
+	switch {
+	case m == nil || m.opts.fileOps == nil:
+		return nil, ErrNoTaildrop
+	case !envknob.CanTaildrop():
+		return nil, ErrNoTaildrop
+	case distro.Get() == distro.Unraid && !m.opts.DirectFileMode:
+		return nil, ErrNotAccessible
+	}
+
+	fops, ok := m.opts.fileOps.(DirFileOps)
+	if !ok {
+		return nil, ErrNoDirSupport
+	}
+	if dir != "" {
+		if err := validateBaseName(dir); err != nil {
+			return nil, err
+		}
+	}
+	root, err := validateManifest(man)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &incomingDir{
+		dir:       dir,
+		entries:   make(map[string]apitype.TaildropEntry, len(man.Entries)),
+		remaining: make(set.Set[string]),
+	}
+	for _, e := range man.Entries {
+		d.entries[e.Path] = e
+		if e.Mode.IsDir() {
+			if err := fops.MkdirAll(path.Join(dir, e.Path)); err != nil {
+				return nil, m.redactAndLogError("Mkdir", err)
+			}
+			d.dirs = append(d.dirs, e)
+			continue
+		}
+		if fi, err := m.opts.fileOps.Stat(path.Join(dir, e.Path)); err == nil && fi.Mode().IsRegular() &&
+			fi.Size() == e.Size && fi.ModTime().Unix() == e.ModTime.Unix() {
+			have = append(have, e.Path)
+			continue
+		}
+		d.remaining.Add(e.Path)
+	}
+
+	key := incomingFileKey{id, path.Join(dir, root)}
+	if len(d.remaining) == 0 {
+		m.incomingDirs.Delete(key)
+		m.finishDir(d)
+		return have, nil
+	}
+	m.incomingDirs.Store(key, d)
+	return have, nil
+}
+
+// incomingDirFile returns the directory tree being received from id into dir
+// that contains the regular file at the slash-separated path name, and the
+// entry of the file.
+func (m *manager) incomingDirFile(id clientID, dir, name string) (d *incomingDir, e apitype.TaildropEntry, ok bool) {
+	root, _, _ := strings.Cut(name, "/")
+	d, ok = m.incomingDirs.Load(incomingFileKey{id, path.Join(dir, root)})
+	if !ok {
+		return nil, e, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok = d.entries[name]
+	if !ok || !e.Mode.IsRegular() {
+		return nil, e, false
+	}
+	return d, e, true
+}
+
+// dirFileDone notes that the file at path name of the directory tree d,
+// being received from id, was received. Once all the files of d are, it
+// sets the modes and modification times of its directories.
+func (m *manager) dirFileDone(id clientID, d *incomingDir, name string) {
+	d.mu.Lock()
+	d.remaining.Delete(name)
+	done := len(d.remaining) == 0
+	d.mu.Unlock()
+	if !done {
+		return
+	}
+	root, _, _ := strings.Cut(name, "/")
+	key := incomingFileKey{id, path.Join(d.dir, root)}
+	m.incomingDirs.WithLock(func(dirs map[incomingFileKey]*incomingDir) {
+		if dirs[key] != d {
+			done = false // replaced by a newer manifest
+			return
+		}
+		delete(dirs, key)
+	})
+	if done {
+		m.finishDir(d)
+	}
+}
+
+// finishDir sets the modes and modification times of the directories of d.
+// Directories are modified after their contents, so that their modification
+// times aren't changed by their contents.
+func (m *manager) finishDir(d *incomingDir) {
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		e := d.dirs[i]
+		// Keep the directory writable by the owner, so that its
+		// contents can be moved out of the inbox.
+		m.setAttrs(path.Join(d.dir, e.Path), e.Mode.Perm()&permMask|0o700, e.ModTime)
+	}
+}
+
+// setAttrs sets the permission bits and modification time of the file or
+// directory name, logging any error.
+func (m *manager) setAttrs(name string, perm fs.FileMode, mtime time.Time) {
+	fops, ok := m.opts.fileOps.(DirFileOps)
+	if !ok {
+		return
+	}
+	if err := fops.Chmod(name, perm); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		m.opts.Logf("chmod error: %v", redactError(err))
+	}
+	if mtime.IsZero() {
+		return
+	}
+	if err := fops.Chtimes(name, mtime); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		m.opts.Logf("chtimes error: %v", redactError(err))
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tstime"
+	"tailscale.com/util/must"
+)
+
+func TestValidateManifest(t *testing.T) {
+	dir := func(p string) apitype.TaildropEntry {
+		return apitype.TaildropEntry{Path: p, Mode: fs.ModeDir | 0o755}
+	}
+	file := func(p string, size int64) apitype.TaildropEntry {
+		return apitype.TaildropEntry{Path: p, Mode: 0o644, Size: size}
+	}
+	tests := []struct {
+		name    string
+		entries []apitype.TaildropEntry
+		wantErr error
+	}{
+		{"empty", nil, ErrInvalidManifest},
+		{"only-root", []apitype.TaildropEntry{dir("root")}, nil},
+		{"tree", []apitype.TaildropEntry{dir("root"), file("root/a", 1), dir("root/sub"), file("root/sub/b", 0)}, nil},
+		{"root-is-file", []apitype.TaildropEntry{file("root", 1)}, ErrInvalidManifest},
+		{"root-is-path", []apitype.TaildropEntry{dir("root/sub")}, ErrInvalidFileName},
+		{"duplicate", []apitype.TaildropEntry{dir("root"), file("root/a", 1), file("root/a", 1)}, ErrInvalidManifest},
+		{"second-root", []apitype.TaildropEntry{dir("root"), dir("other")}, ErrInvalidManifest},
+		{"dir-after-contents", []apitype.TaildropEntry{dir("root"), file("root/sub/b", 1), dir("root/sub")}, ErrInvalidManifest},
+		{"file-as-parent", []apitype.TaildropEntry{dir("root"), file("root/a", 1), file("root/a/b", 1)}, ErrInvalidManifest},
+		{"negative-size", []apitype.TaildropEntry{dir("root"), file("root/a", -1)}, ErrInvalidManifest},
+		{"symlink", []apitype.TaildropEntry{dir("root"), {Path: "root/l", Mode: fs.ModeSymlink | 0o777}}, ErrInvalidManifest},
+		{"dot-dot", []apitype.TaildropEntry{dir("root"), file("root/../a", 1)}, ErrInvalidFileName},
+		{"dot", []apitype.TaildropEntry{dir("root"), file("root/./a", 1)}, ErrInvalidFileName},
+		{"absolute", []apitype.TaildropEntry{dir("root"), file("/root/a", 1)}, ErrInvalidFileName},
+		{"backslash", []apitype.TaildropEntry{dir("root"), file(`root/..\a`, 1)}, ErrInvalidFileName},
+		{"empty-elem", []apitype.TaildropEntry{dir("root"), file("root//a", 1)}, ErrInvalidFileName},
+		{"partial-suffix", []apitype.TaildropEntry{dir("root"), file("root/a.partial", 1)}, ErrInvalidFileName},
+		{"too-deep", []apitype.TaildropEntry{dir("root"), file("root"+strings.Repeat("/a", maxPathDepth), 1)}, ErrInvalidFileName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateManifest(&apitype.TaildropManifest{Entries: tt.entries})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateManifest = %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// noDirFileOps is a FileOps that doesn't implement DirFileOps.
+type noDirFileOps struct{ FileOps }
+
+func TestPutDirUnsupported(t *testing.T) {
+	m := managerOptions{
+		Logf:    t.Logf,
+		fileOps: noDirFileOps{must.Get(newFileOps(t.TempDir()))},
+	}.New()
+	defer m.Shutdown()
+
+	man := &apitype.TaildropManifest{Entries: []apitype.TaildropEntry{
+		{Path: "root", Mode: fs.ModeDir | 0o755},
+	}}
+	if _, err := m.PutDirManifest("0", "", man); err != ErrNoDirSupport {
+		t.Errorf("PutDirManifest = %v; want %v", err, ErrNoDirSupport)
+	}
+}
+
+func TestPutDir(t *testing.T) {
+	dir := t.TempDir()
+	m := managerOptions{
+		Logf:           t.Logf,
+		Clock:          tstime.DefaultClock{},
+		fileOps:        must.Get(newFileOps(dir)),
+		SendFileNotify: func() {},
+	}.New()
+	defer m.Shutdown()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	man := &apitype.TaildropManifest{Entries: []apitype.TaildropEntry{
+		{Path: "root", Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		{Path: "root/a.txt", Mode: 0o600, ModTime: mtime.Add(time.Hour), Size: 1},
+		{Path: "root/sub", Mode: fs.ModeDir | 0o750, ModTime: mtime.Add(2 * time.Hour)},
+		{Path: "root/sub/b.sh", Mode: 0o777, ModTime: mtime.Add(3 * time.Hour), Size: 2},
+		{Path: "root/empty", Mode: fs.ModeDir | 0o755, ModTime: mtime},
+	}}
+	contents := map[string]string{"root/a.txt": "a", "root/sub/b.sh": "bb"}
+
+	id := clientID("0")
+	have, err := m.PutDirManifest(id, "", man)
+	if err != nil {
+		t.Fatalf("PutDirManifest: %v", err)
+	}
+	if len(have) != 0 {
+		t.Errorf("have = %q; want none", have)
+	}
+	if _, err := m.PutFile(clientID("1"), "", "root/a.txt", strings.NewReader("a"), 0, 1); !errors.Is(err, ErrInvalidFileName) {
+		t.Errorf("PutFile from other client = %v; want %v", err, ErrInvalidFileName)
+	}
+	if _, err := m.PutFile(id, "", "root/other.txt", strings.NewReader("a"), 0, 1); !errors.Is(err, ErrInvalidFileName) {
+		t.Errorf("PutFile of unannounced file = %v; want %v", err, ErrInvalidFileName)
+	}
+	for _, e := range man.Entries {
+		if !e.Mode.IsRegular() {
+			continue
+		}
+		if _, err := m.PutFile(id, "", e.Path, strings.NewReader(contents[e.Path]), 0, e.Size); err != nil {
+			t.Fatalf("PutFile(%q): %v", e.Path, err)
+		}
+	}
+
+	for _, e := range man.Entries {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.IsDir() != e.Mode.IsDir() {
+			t.Errorf("%s: IsDir = %v; want %v", e.Path, fi.IsDir(), e.Mode.IsDir())
+		}
+		if !fi.ModTime().Equal(e.ModTime) {
+			t.Errorf("%s: ModTime = %v; want %v", e.Path, fi.ModTime(), e.ModTime)
+		}
+		if runtime.GOOS == "windows" {
+			continue
+		}
+		wantPerm := e.Mode.Perm() & permMask
+		if e.Mode.IsDir() {
+			wantPerm |= 0o700
+		}
+		if got := fi.Mode().Perm(); got != wantPerm {
+			t.Errorf("%s: Perm = %v; want %v", e.Path, got, wantPerm)
+		}
+		if e.Mode.IsRegular() {
+			if got := string(must.Get(os.ReadFile(filepath.Join(dir, filepath.FromSlash(e.Path))))); got != contents[e.Path] {
+				t.Errorf("%s: contents = %q; want %q", e.Path, got, contents[e.Path])
+			}
+		}
+	}
+
+	wfs := must.Get(m.WaitingFiles())
+	var names []string
+	for _, wf := range wfs {
+		names = append(names, wf.Name)
+	}
+	if want := []string{"root/a.txt", "root/sub/b.sh"}; !slices.Equal(names, want) {
+		t.Errorf("WaitingFiles = %q; want %q", names, want)
+	}
+
+	// Sending the same manifest again needs no files to be sent.
+	have, err = m.PutDirManifest(id, "", man)
+	if err != nil {
+		t.Fatalf("PutDirManifest again: %v", err)
+	}
+	slices.Sort(have)
+	if want := []string{"root/a.txt", "root/sub/b.sh"}; !slices.Equal(have, want) {
+		t.Errorf("have = %q; want %q", have, want)
+	}
+
+	// Deleting the files removes the directories they leave empty.
+	must.Do(m.DeleteFile("root/sub/b.sh"))
+	if _, err := os.Stat(filepath.Join(dir, "root", "sub")); !os.IsNotExist(err) {
+		t.Errorf("root/sub after deleting its contents: %v; want not exist", err)
+	}
+	must.Do(m.DeleteFile("root/a.txt"))
+	if _, err := os.Stat(filepath.Join(dir, "root")); err != nil {
+		t.Errorf("root with an empty directory: %v; want it to exist", err)
+	}
+}
+
+func TestPutDirSymlinkEscape(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "photos")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	m := managerOptions{
+		Logf:           t.Logf,
+		Clock:          tstime.DefaultClock{},
+		fileOps:        must.Get(newFileOps(dir)),
+		SendFileNotify: func() {},
+	}.New()
+	defer m.Shutdown()
+
+	man := &apitype.TaildropManifest{Entries: []apitype.TaildropEntry{
+		{Path: "photos", Mode: fs.ModeDir | 0o755},
+		{Path: "photos/sub", Mode: fs.ModeDir | 0o755},
+		{Path: "photos/a.txt", Mode: 0o644, Size: 1},
+	}}
+	if _, err := m.PutDirManifest("0", "", man); err == nil {
+		t.Error("PutDirManifest into a symlink to outside the inbox succeeded")
+	}
+	if _, err := m.PutFile("0", "", "photos/a.txt", strings.NewReader("a"), 0, 1); err == nil {
+		t.Error("PutFile into a symlink to outside the inbox succeeded")
+	}
+	if ents := must.Get(os.ReadDir(outside)); len(ents) != 0 {
+		t.Errorf("files written outside the inbox: %v", ents)
+	}
+}
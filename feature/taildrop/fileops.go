@@ -7,9 +7,14 @@
 	"io"
 	"io/fs"
 	"os"
+	"time"
 )
 
 // FileOps abstracts over both local‐FS paths and Android SAF URIs.
+//
+// Names are relative to the receiver's root. They're usually base names, but
+// files and directories of directory transfers are named by slash-separated
+// paths, such as "photos/2024/beach.jpg".
 type FileOps interface {
 	// OpenWriter creates or truncates a file named relative to the receiver's root,
 	// seeking to the specified offset. If the file does not exist, it is created with mode perm
@@ -27,8 +32,8 @@ type FileOps interface {
 	// returning the full new path or an error.
 	Rename(oldPath, newName string) (newPath string, err error)
 
-	// ListFiles returns just the basenames of all regular files
-	// in the root directory.
+	// ListFiles returns the names of all regular files in the root
+	// directory and its subdirectories.
 	ListFiles() ([]string, error)
 
 	// Stat returns the FileInfo for the given name or an error.
@@ -38,4 +43,23 @@ type FileOps interface {
 	OpenReader(name string) (io.ReadCloser, error)
 }
 
+// DirFileOps is implemented by [FileOps] implementations that support
+// receiving directory trees. Directory transfers are rejected if the
+// FileOps in use doesn't implement it.
+type DirFileOps interface {
+	FileOps
+
+	// MkdirAll creates a directory named relative to the receiver's root,
+	// along with any parents. It does nothing if the directory exists.
+	MkdirAll(name string) error
+
+	// Chmod sets the permission bits of a file or directory named
+	// relative to the receiver's root, on platforms that support it.
+	Chmod(name string, perm os.FileMode) error
+
+	// Chtimes sets the modification time of a file or directory named
+	// relative to the receiver's root, on platforms that support it.
+	Chtimes(name string, mtime time.Time) error
+}
+
 var newFileOps func(dir string) (FileOps, error)
@@ -16,6 +16,7 @@
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -23,8 +24,14 @@
 
 // fsFileOps implements FileOps using the local filesystem rooted at a directory.
 // It is used on non-Android platforms.
+//
+// All operations go through an [os.Root] for rootDir, so that symlinks in
+// the directory, which may be writable by users in DirectFileMode, can't
+// make it read or write files outside of it.
 type fsFileOps struct{ rootDir string }
 
+var _ DirFileOps = fsFileOps{}
+
 func init() {
 	newFileOps = func(dir string) (FileOps, error) {
 		if dir == "" {
@@ -37,15 +44,31 @@ func init() {
 	}
 }
 
+// openRoot opens the root directory, and returns the local name for name
+// within it.
+// The caller must close the returned root.
+func (f fsFileOps) openRoot(name string) (root *os.Root, localName string, err error) {
+	localName, err = localFileName(name)
+	if err != nil {
+		return nil, "", err
+	}
+	root, err = os.OpenRoot(f.rootDir)
+	if err != nil {
+		return nil, "", err
+	}
+	return root, localName, nil
+}
+
 func (f fsFileOps) OpenWriter(name string, offset int64, perm os.FileMode) (io.WriteCloser, string, error) {
-	path, err := joinDir(f.rootDir, name)
+	root, name, err := f.openRoot(name)
 	if err != nil {
 		return nil, "", err
 	}
-	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+	defer root.Close()
+	if err = root.MkdirAll(filepath.Dir(name), 0o700); err != nil {
 		return nil, "", err
 	}
-	fi, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, perm)
+	fi, err := root.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
 	if err != nil {
 		return nil, "", err
 	}
@@ -68,33 +91,39 @@ func (f fsFileOps) OpenWriter(name string, offset int64, perm os.FileMode) (io.W
 			return nil, "", err
 		}
 	}
-	return fi, path, nil
+	return fi, filepath.Join(f.rootDir, name), nil
 }
 
 func (f fsFileOps) Remove(name string) error {
-	path, err := joinDir(f.rootDir, name)
+	root, name, err := f.openRoot(name)
 	if err != nil {
 		return err
 	}
-	return os.Remove(path)
+	defer root.Close()
+	return root.Remove(name)
 }
 
 // Rename moves the partial file into its final name.
-// newName must be a base name (not absolute or containing path separators).
+// oldPath must be a path returned by OpenWriter.
+// newName must be a base name or, for directory transfers, a relative
+// slash-separated path.
 // It will retry up to 10 times, de-dup same-checksum files, etc.
 func (f fsFileOps) Rename(oldPath, newName string) (newPath string, err error) {
-	var dst string
-	if filepath.IsAbs(newName) || strings.ContainsRune(newName, os.PathSeparator) {
-		return "", fmt.Errorf("invalid newName %q: must not be an absolute path or contain path separators", newName)
+	root, dst, err := f.openRoot(newName)
+	if err != nil {
+		return "", fmt.Errorf("invalid newName %q: %w", newName, err)
+	}
+	defer root.Close()
+	src, err := filepath.Rel(f.rootDir, oldPath)
+	if err != nil || !filepath.IsLocal(src) {
+		return "", fmt.Errorf("invalid oldPath %q: not in %q", oldPath, f.rootDir)
 	}
 
-	dst = filepath.Join(f.rootDir, newName)
-
-	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+	if err := root.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
 		return "", err
 	}
 
-	st, err := os.Stat(oldPath)
+	st, err := root.Stat(src)
 	if err != nil {
 		return "", err
 	}
@@ -103,17 +132,17 @@ func (f fsFileOps) Rename(oldPath, newName string) (newPath string, err error) {
 	const maxRetries = 10
 	for i := 0; i < maxRetries; i++ {
 		renameMu.Lock()
-		fi, statErr := os.Stat(dst)
+		fi, statErr := root.Stat(dst)
 		// Atomically rename the partial file as the destination file if it doesn't exist.
 		// Otherwise, it returns the length of the current destination file.
 		// The operation is atomic.
 		if os.IsNotExist(statErr) {
-			err = os.Rename(oldPath, dst)
+			err = root.Rename(src, dst)
 			renameMu.Unlock()
 			if err != nil {
 				return "", err
 			}
-			return dst, nil
+			return filepath.Join(f.rootDir, dst), nil
 		}
 		if statErr != nil {
 			renameMu.Unlock()
@@ -128,19 +157,19 @@ func (f fsFileOps) Rename(oldPath, newName string) (newPath string, err error) {
 		// results in processing on the iOS side which means the size and shas of the
 		// same file can be different.
 		if gotSize == wantSize {
-			sumP, err := sha256File(oldPath)
+			sumP, err := sha256File(root, src)
 			if err != nil {
 				return "", err
 			}
-			sumD, err := sha256File(dst)
+			sumD, err := sha256File(root, dst)
 			if err != nil {
 				return "", err
 			}
 			if bytes.Equal(sumP[:], sumD[:]) {
-				if err := os.Remove(oldPath); err != nil {
+				if err := root.Remove(src); err != nil {
 					return "", err
 				}
-				return dst, nil
+				return filepath.Join(f.rootDir, dst), nil
 			}
 		}
 
@@ -151,9 +180,9 @@ func (f fsFileOps) Rename(oldPath, newName string) (newPath string, err error) {
 	return "", fmt.Errorf("too many retries trying to rename %q to %q", oldPath, newName)
 }
 
-// sha256File computes the SHA‑256 of a file.
-func sha256File(path string) (sum [sha256.Size]byte, _ error) {
-	f, err := os.Open(path)
+// sha256File computes the SHA‑256 of the file name in root.
+func sha256File(root *os.Root, name string) (sum [sha256.Size]byte, _ error) {
+	f, err := root.Open(name)
 	if err != nil {
 		return sum, err
 	}
@@ -167,55 +196,100 @@ func sha256File(path string) (sum [sha256.Size]byte, _ error) {
 }
 
 func (f fsFileOps) ListFiles() ([]string, error) {
-	entries, err := os.ReadDir(f.rootDir)
+	root, err := os.OpenRoot(f.rootDir)
 	if err != nil {
 		return nil, err
 	}
+	defer root.Close()
 	var names []string
-	for _, e := range entries {
-		if e.Type().IsRegular() {
-			names = append(names, e.Name())
+	err = fs.WalkDir(root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == "." {
+				return err
+			}
+			return nil // skip unreadable subdirectories
 		}
+		if d.Type().IsRegular() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return names, nil
 }
 
 func (f fsFileOps) Stat(name string) (fs.FileInfo, error) {
-	path, err := joinDir(f.rootDir, name)
+	root, name, err := f.openRoot(name)
 	if err != nil {
 		return nil, err
 	}
-	return os.Stat(path)
+	defer root.Close()
+	return root.Stat(name)
 }
 
 func (f fsFileOps) OpenReader(name string) (io.ReadCloser, error) {
-	path, err := joinDir(f.rootDir, name)
+	root, name, err := f.openRoot(name)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(path)
+	defer root.Close()
+	return root.Open(name)
 }
 
-// joinDir is like [filepath.Join] but returns an error if baseName is too long,
-// is a relative path instead of a basename, or is otherwise invalid or unsafe for incoming files.
-func joinDir(dir, baseName string) (string, error) {
-	if !utf8.ValidString(baseName) ||
-		strings.TrimSpace(baseName) != baseName ||
-		len(baseName) > 255 {
-		return "", ErrInvalidFileName
+func (f fsFileOps) MkdirAll(name string) error {
+	root, name, err := f.openRoot(name)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.MkdirAll(name, 0o700)
+}
+
+func (f fsFileOps) Chmod(name string, perm os.FileMode) error {
+	root, name, err := f.openRoot(name)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Chmod(name, perm)
+}
+
+func (f fsFileOps) Chtimes(name string, mtime time.Time) error {
+	root, name, err := f.openRoot(name)
+	if err != nil {
+		return err
 	}
-	// TODO: validate unicode normalization form too? Varies by platform.
-	clean := path.Clean(baseName)
-	if clean != baseName || clean == "." || clean == ".." {
+	defer root.Close()
+	return root.Chtimes(name, time.Time{}, mtime)
+}
+
+// localFileName returns name as a local file path, or an error if name is
+// too long, is not a basename or a slash-separated relative path of
+// basenames, or is otherwise invalid or unsafe for incoming files.
+func localFileName(name string) (string, error) {
+	if !utf8.ValidString(name) || len(name) > maxPathLen {
 		return "", ErrInvalidFileName
 	}
-	for _, r := range baseName {
-		if !validFilenameRune(r) {
+	for elem := range strings.SplitSeq(name, "/") {
+		if strings.TrimSpace(elem) != elem || len(elem) > 255 {
 			return "", ErrInvalidFileName
 		}
+		// TODO: validate unicode normalization form too? Varies by platform.
+		clean := path.Clean(elem)
+		if clean != elem || clean == "." || clean == ".." {
+			return "", ErrInvalidFileName
+		}
+		for _, r := range elem {
+			if !validFilenameRune(r) {
+				return "", ErrInvalidFileName
+			}
+		}
 	}
-	if !filepath.IsLocal(baseName) {
+	name = filepath.FromSlash(name)
+	if !filepath.IsLocal(name) {
 		return "", ErrInvalidFileName
 	}
-	return filepath.Join(dir, baseName), nil
+	return name, nil
 }
@@ -7,6 +7,7 @@
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"maps"
@@ -29,16 +30,19 @@
 	"tailscale.com/util/mak"
 	"tailscale.com/util/progresstracking"
 	"tailscale.com/util/rands"
+	"tailscale.com/util/set"
 )
 
 func init() {
 	localapi.Register("file-put/", serveFilePut)
+	localapi.Register("file-put-dir/", serveFilePutDir)
 	localapi.Register("files/", serveFiles)
 	localapi.Register("file-targets", serveFileTargets)
 }
 
 var (
-	metricFilePutCalls = clientmetric.NewCounter("localapi_file_put")
+	metricFilePutCalls    = clientmetric.NewCounter("localapi_file_put")
+	metricFilePutDirCalls = clientmetric.NewCounter("localapi_file_put_dir")
 )
 
 // serveFilePut sends a file to another node.
@@ -86,12 +90,6 @@ func serveFilePut(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fts, err := ext.FileTargets()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	upath, ok := strings.CutPrefix(r.URL.EscapedPath(), "/localapi/v0/file-put/")
 	if !ok {
 		http.Error(w, "misconfigured", http.StatusInternalServerError)
@@ -110,6 +108,215 @@ func serveFilePut(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 	}
 	peerID := tailcfg.StableNodeID(peerIDStr)
 
+	dstURL, ok := filePeerAPIURL(w, ext, peerID)
+	if !ok {
+		return
+	}
+
+	progressUpdates := reportOutgoingFiles(ext)
+	defer close(progressUpdates)
+
+	switch r.Method {
+	case "PUT":
+		file := ipn.OutgoingFile{
+			ID:           rands.HexString(30),
+			PeerID:       peerID,
+			Name:         filenameEscaped,
+			DeclaredSize: r.ContentLength,
+		}
+		singleFilePut(h, r.Context(), progressUpdates, w, r.Body, dstURL, file)
+	case "POST":
+		multiFilePost(h, progressUpdates, w, r, peerID, dstURL)
+	default:
+		http.Error(w, "want PUT to put file", http.StatusBadRequest)
+		return
+	}
+}
+
+// serveFilePutDir sends a directory tree to another node.
+//
+// The body is multipart/form-data. The first part is an application/json
+// [apitype.TaildropManifest] of the tree, followed by a part for each
+// regular file in the manifest, in order, with the path of the file as its
+// form name.
+//
+// The manifest is sent to the peer first, and the files that the peer
+// already has are skipped. The progress of the whole transfer is reported
+// as a single [ipn.OutgoingFile] named after the root directory.
+//
+// URL format:
+//
+//   - POST /localapi/v0/file-put-dir/:stableID
+func serveFilePutDir(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
+	metricFilePutDirCalls.Add(1)
+
+	if !h.PermitWrite {
+		http.Error(w, "file access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST to put directory", http.StatusBadRequest)
+		return
+	}
+	ext, ok := ipnlocal.GetExt[*Extension](h.LocalBackend())
+	if !ok {
+		http.Error(w, "misconfigured taildrop extension", http.StatusInternalServerError)
+		return
+	}
+	peerIDStr, ok := strings.CutPrefix(r.URL.EscapedPath(), "/localapi/v0/file-put-dir/")
+	if !ok {
+		http.Error(w, "misconfigured", http.StatusInternalServerError)
+		return
+	}
+	peerID := tailcfg.StableNodeID(peerIDStr)
+	dstURL, ok := filePeerAPIURL(w, ext, peerID)
+	if !ok {
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid Content-Type for multipart POST: %s", err), http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode multipart/form-data: %s", err), http.StatusBadRequest)
+		return
+	}
+	if part.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "first MIME part must be a JSON manifest", http.StatusBadRequest)
+		return
+	}
+	var man apitype.TaildropManifest
+	if err := json.NewDecoder(io.LimitReader(part, maxManifestSize)).Decode(&man); err != nil {
+		http.Error(w, fmt.Sprintf("invalid manifest: %s", err), http.StatusBadRequest)
+		return
+	}
+	root, err := validateManifest(&man)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	progressUpdates := reportOutgoingFiles(ext)
+	defer close(progressUpdates)
+	out := ipn.OutgoingFile{
+		ID:      rands.HexString(30),
+		PeerID:  peerID,
+		Name:    root,
+		Started: time.Now(),
+	}
+	for _, e := range man.Entries {
+		out.DeclaredSize += e.Size
+	}
+	progressUpdates <- out
+	finish := func(succeeded bool) {
+		out.Finished = true
+		out.Succeeded = succeeded
+		progressUpdates <- out
+	}
+
+	have, err := peerPutDirManifest(r.Context(), h, dstURL, root, &man)
+	if err != nil {
+		h.Logf("put-dir manifest: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		finish(false)
+		return
+	}
+
+	ww := &multiFilePostResponseWriter{}
+	defer func() {
+		if err := ww.Flush(w); err != nil {
+			h.Logf("error: multiFilePostResponseWriter.Flush(): %s", err)
+		}
+	}()
+	for _, e := range man.Entries {
+		if !e.Mode.IsRegular() {
+			continue
+		}
+		part, err := mr.NextPart()
+		if err != nil {
+			http.Error(ww, fmt.Sprintf("failed to read file %q: %s", e.Path, err), http.StatusBadRequest)
+			finish(false)
+			return
+		}
+		if part.FormName() != e.Path {
+			http.Error(ww, fmt.Sprintf("got MIME part %q; want %q", part.FormName(), e.Path), http.StatusBadRequest)
+			finish(false)
+			return
+		}
+		if have.Contains(e.Path) {
+			// The peer already has it. The contents are still sent to us by
+			// the client, as they precede the next file.
+			io.Copy(io.Discard, part)
+			out.Sent += e.Size
+			continue
+		}
+		sent := out.Sent
+		body := progresstracking.NewReader(io.LimitReader(part, e.Size), 1*time.Second, func(n int, err error) {
+			u := out
+			u.Sent = sent + int64(n)
+			progressUpdates <- u
+		})
+		if !peerPutFile(h, r.Context(), ww, body, dstURL, url.PathEscape(e.Path), e.Size) || ww.statusCode >= 400 {
+			h.Logf("error: put-dir: failed to put file with status %d", ww.statusCode)
+			finish(false)
+			return
+		}
+		out.Sent = sent + e.Size
+	}
+	finish(true)
+}
+
+// peerPutDirManifest POSTs the manifest man of the directory tree root to
+// the PeerAPI at dstURL, and returns the paths of the files the peer already
+// has.
+func peerPutDirManifest(ctx context.Context, h *localapi.Handler, dstURL *url.URL, root string, man *apitype.TaildropManifest) (have set.Set[string], _ error) {
+	j, err := json.Marshal(man)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", dstURL.String()+"/v0/put-dir/"+url.PathEscape(root), bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{
+		Transport: h.LocalBackend().Dialer().PeerAPITransport(),
+		Timeout:   time.Minute,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, errors.New("peer does not support receiving directories; it may need to update Tailscale")
+	case http.StatusNotImplemented:
+		return nil, errors.New("peer does not support receiving directories on its platform")
+	default:
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+		return nil, fmt.Errorf("peer rejected directory: %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	var pdr putDirResponse
+	if err := json.NewDecoder(res.Body).Decode(&pdr); err != nil {
+		return nil, fmt.Errorf("invalid response from peer: %w", err)
+	}
+	return set.Of(pdr.Have...), nil
+}
+
+// filePeerAPIURL returns the PeerAPI URL of the file target peerID. If
+// there's no such target, it writes an error to w and returns false.
+func filePeerAPIURL(w http.ResponseWriter, ext *Extension, peerID tailcfg.StableNodeID) (_ *url.URL, ok bool) {
+	fts, err := ext.FileTargets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
 	var ft *apitype.FileTarget
 	for _, x := range fts {
 		if x.Node.StableID == peerID {
@@ -119,19 +326,22 @@ func serveFilePut(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 	}
 	if ft == nil {
 		http.Error(w, "node not found", http.StatusNotFound)
-		return
+		return nil, false
 	}
 	dstURL, err := url.Parse(ft.PeerAPIURL)
 	if err != nil {
 		http.Error(w, "bogus peer URL", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
+	return dstURL, true
+}
 
-	// Periodically report progress of outgoing files.
+// reportOutgoingFiles periodically reports the progress of the outgoing
+// files sent on the returned channel to ext, until the channel is closed.
+func reportOutgoingFiles(ext *Extension) chan<- ipn.OutgoingFile {
 	outgoingFiles := make(map[string]*ipn.OutgoingFile)
 	t := time.NewTicker(1 * time.Second)
 	progressUpdates := make(chan ipn.OutgoingFile)
-	defer close(progressUpdates)
 
 	go func() {
 		defer t.Stop()
@@ -148,25 +358,10 @@ func serveFilePut(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}()
-
-	switch r.Method {
-	case "PUT":
-		file := ipn.OutgoingFile{
-			ID:           rands.HexString(30),
-			PeerID:       peerID,
-			Name:         filenameEscaped,
-			DeclaredSize: r.ContentLength,
-		}
-		singleFilePut(h, r.Context(), progressUpdates, w, r.Body, dstURL, file)
-	case "POST":
-		multiFilePost(h, progressUpdates, w, r, peerID, dstURL)
-	default:
-		http.Error(w, "want PUT to put file", http.StatusBadRequest)
-		return
-	}
+	return progressUpdates
 }
 
-func multiFilePost(h *localapi.Handler, progressUpdates chan (ipn.OutgoingFile), w http.ResponseWriter, r *http.Request, peerID tailcfg.StableNodeID, dstURL *url.URL) {
+func multiFilePost(h *localapi.Handler, progressUpdates chan<- ipn.OutgoingFile, w http.ResponseWriter, r *http.Request, peerID tailcfg.StableNodeID, dstURL *url.URL) {
 	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("invalid Content-Type for multipart POST: %s", err), http.StatusBadRequest)
@@ -271,7 +466,7 @@ func (ww *multiFilePostResponseWriter) Flush(w http.ResponseWriter) error {
 func singleFilePut(
 	h *localapi.Handler,
 	ctx context.Context,
-	progressUpdates chan (ipn.OutgoingFile),
+	progressUpdates chan<- ipn.OutgoingFile,
 	w http.ResponseWriter,
 	body io.Reader,
 	dstURL *url.URL,
@@ -283,12 +478,28 @@ func singleFilePut(
 		progressUpdates <- outgoingFile
 	})
 
-	fail := func() {
-		outgoingFile.Finished = true
-		outgoingFile.Succeeded = false
-		progressUpdates <- outgoingFile
-	}
+	ok := peerPutFile(h, ctx, w, body, dstURL, outgoingFile.Name, outgoingFile.DeclaredSize)
+
+	outgoingFile.Finished = true
+	outgoingFile.Succeeded = ok
+	progressUpdates <- outgoingFile
 
+	return ok
+}
+
+// peerPutFile PUTs the file escapedName, of the given size or -1 if unknown,
+// with the contents read from body to the PeerAPI at dstURL, resuming any
+// partial file the peer has, and copies the response to w. It reports
+// whether the request could be made.
+func peerPutFile(
+	h *localapi.Handler,
+	ctx context.Context,
+	w http.ResponseWriter,
+	body io.Reader,
+	dstURL *url.URL,
+	escapedName string,
+	size int64,
+) bool {
 	// Before we PUT a file we check to see if there are any existing partial file and if so,
 	// we resume the upload from where we left off by sending the remaining file instead of
 	// the full file.
@@ -299,10 +510,9 @@ func singleFilePut(
 		Transport: h.LocalBackend().Dialer().PeerAPITransport(),
 		Timeout:   10 * time.Second,
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", dstURL.String()+"/v0/put/"+outgoingFile.Name, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", dstURL.String()+"/v0/put/"+escapedName, nil)
 	if err != nil {
 		http.Error(w, "bogus peer URL", http.StatusInternalServerError)
-		fail()
 		return false
 	}
 	resp, err := client.Do(req)
@@ -329,13 +539,12 @@ func singleFilePut(
 		resumeDuration = time.Since(resumeStart).Round(time.Millisecond)
 	}
 
-	outReq, err := http.NewRequestWithContext(ctx, "PUT", "http://peer/v0/put/"+outgoingFile.Name, remainingBody)
+	outReq, err := http.NewRequestWithContext(ctx, "PUT", "http://peer/v0/put/"+escapedName, remainingBody)
 	if err != nil {
 		http.Error(w, "bogus outreq", http.StatusInternalServerError)
-		fail()
 		return false
 	}
-	outReq.ContentLength = outgoingFile.DeclaredSize
+	outReq.ContentLength = size
 	if offset > 0 {
 		h.Logf("resuming put at offset %d after %v", offset, resumeDuration)
 		rangeHdr, _ := httphdr.FormatRange([]httphdr.Range{{Start: offset, Length: 0}})
@@ -348,11 +557,6 @@ func singleFilePut(
 	rp := httputil.NewSingleHostReverseProxy(dstURL)
 	rp.Transport = h.LocalBackend().Dialer().PeerAPITransport()
 	rp.ServeHTTP(w, outReq)
-
-	outgoingFile.Finished = true
-	outgoingFile.Succeeded = true
-	progressUpdates <- outgoingFile
-
 	return true
 }
 
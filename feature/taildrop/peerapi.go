@@ -5,6 +5,7 @@
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +13,7 @@
 	"strings"
 	"time"
 
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime"
@@ -21,10 +23,12 @@
 
 func init() {
 	ipnlocal.RegisterPeerAPIHandler("/v0/put/", handlePeerPut)
+	ipnlocal.RegisterPeerAPIHandler("/v0/put-dir/", handlePeerPutDir)
 }
 
 var (
-	metricPutCalls = clientmetric.NewCounter("peerapi_put")
+	metricPutCalls    = clientmetric.NewCounter("peerapi_put")
+	metricPutDirCalls = clientmetric.NewCounter("peerapi_put_dir")
 )
 
 // canPutFile reports whether h can put a file ("Taildrop") to this node.
@@ -51,6 +55,52 @@ type extensionForPut interface {
 	manager() *manager
 	hasCapFileSharing() bool
 	Clock() tstime.Clock
+	inboxPolicy() *inboxPolicy
+	senderOf(ipnlocal.PeerAPIHandler) sender
+}
+
+// checkInboxPolicy returns the inbox policy for files from the peer of h and
+// their sender, or nil if there's no policy. If the policy doesn't allow
+// the peer to send files, it writes an HTTP error and returns ok false.
+func checkInboxPolicy(h ipnlocal.PeerAPIHandler, ext extensionForPut, w http.ResponseWriter) (p *inboxPolicy, s sender, ok bool) {
+	p = ext.inboxPolicy()
+	if p == nil {
+		return nil, s, true
+	}
+	s = ext.senderOf(h)
+	if !p.allows(s) {
+		h.Logf("rejected %v/%v: %v", h.RemoteAddr().Addr(), h.Peer().ComputedName(), ErrSenderNotAllowed)
+		httpErrorForPolicy(w, ErrSenderNotAllowed)
+		return nil, s, false
+	}
+	return p, s, true
+}
+
+// httpErrorForPolicy writes the HTTP error for err, an error from
+// [manager.admitFile] or [manager.admitDir].
+func httpErrorForPolicy(w http.ResponseWriter, err error) {
+	code := http.StatusForbidden
+	switch err {
+	case ErrFileTooLarge:
+		code = http.StatusRequestEntityTooLarge
+	case ErrQuotaExceeded:
+		code = http.StatusTooManyRequests
+	case ErrLengthRequired:
+		code = http.StatusLengthRequired
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// countingReader is an io.Reader that counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
 }
 
 func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w http.ResponseWriter, r *http.Request) {
@@ -84,6 +134,10 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 		http.Error(w, ErrInvalidFileName.Error(), http.StatusBadRequest)
 		return
 	}
+	policy, from, ok := checkInboxPolicy(h, ext, w)
+	if !ok {
+		return
+	}
 	enc := json.NewEncoder(w)
 	switch r.Method {
 	case "GET":
@@ -102,7 +156,11 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 			}
 		} else {
 			// Stream all the block hashes for the specified file.
-			next, close, err := taildropMgr.HashPartialFile(id, baseName)
+			var dir string
+			if policy != nil && policy.perSenderDirs {
+				dir = from.dir()
+			}
+			next, close, err := taildropMgr.HashPartialFile(id, dir, baseName)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -138,7 +196,26 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 			}
 			offset = ranges[0].Start
 		}
-		n, err := taildropMgr.PutFile(clientID(fmt.Sprint(id)), baseName, r.Body, offset, r.ContentLength)
+
+		// Enforce the inbox policy, if any, before writing anything.
+		var dir string
+		body := &countingReader{Reader: r.Body}
+		if policy != nil {
+			size := r.ContentLength
+			if size >= 0 {
+				size += offset
+			}
+			var refund func(received int64)
+			dir, refund, err = taildropMgr.admitFile(policy, from, size, r.ContentLength)
+			if err != nil {
+				h.Logf("rejected put from %v/%v: %v", h.RemoteAddr().Addr(), h.Peer().ComputedName(), err)
+				httpErrorForPolicy(w, err)
+				return
+			}
+			defer func() { refund(body.n) }()
+		}
+
+		n, err := taildropMgr.PutFile(clientID(fmt.Sprint(id)), dir, baseName, body, offset, r.ContentLength)
 		switch err {
 		case nil:
 			d := ext.Clock().Since(t0).Round(time.Second / 10)
@@ -158,6 +235,93 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 	}
 }
 
+func handlePeerPutDir(h ipnlocal.PeerAPIHandler, w http.ResponseWriter, r *http.Request) {
+	ext, ok := ipnlocal.GetExt[*Extension](h.LocalBackend())
+	if !ok {
+		http.Error(w, "miswired", http.StatusInternalServerError)
+		return
+	}
+	handlePeerPutDirWithBackend(h, ext, w, r)
+}
+
+// putDirResponse is the JSON response to a POST of a directory manifest to
+// /v0/put-dir/.
+type putDirResponse struct {
+	// Have are the paths of the files that the receiver already has, which
+	// don't need to be sent.
+	Have []string `json:"have,omitempty"`
+}
+
+// handlePeerPutDirWithBackend handles a POST of the
+// [apitype.TaildropManifest] of a directory tree to /v0/put-dir/:root, before
+// the files of the tree are PUT to /v0/put/.
+func handlePeerPutDirWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "expected method POST", http.StatusMethodNotAllowed)
+		return
+	}
+	metricPutDirCalls.Add(1)
+
+	taildropMgr := ext.manager()
+	if taildropMgr == nil {
+		h.Logf("taildrop: no taildrop manager")
+		http.Error(w, "failed to get taildrop manager", http.StatusInternalServerError)
+		return
+	}
+	if !canPutFile(h) || !ext.hasCapFileSharing() {
+		http.Error(w, ErrNoTaildrop.Error(), http.StatusForbidden)
+		return
+	}
+	prefix, ok := strings.CutPrefix(r.URL.EscapedPath(), "/v0/put-dir/")
+	if !ok {
+		http.Error(w, "misconfigured internals", http.StatusForbidden)
+		return
+	}
+	root, err := url.PathUnescape(prefix)
+	if err != nil {
+		http.Error(w, ErrInvalidFileName.Error(), http.StatusBadRequest)
+		return
+	}
+	policy, from, ok := checkInboxPolicy(h, ext, w)
+	if !ok {
+		return
+	}
+	var man apitype.TaildropManifest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxManifestSize)).Decode(&man); err != nil {
+		http.Error(w, fmt.Sprintf("%v: %v", ErrInvalidManifest, err), http.StatusBadRequest)
+		return
+	}
+	if len(man.Entries) == 0 || man.Entries[0].Path != root {
+		http.Error(w, fmt.Sprintf("%v: root directory does not match URL", ErrInvalidManifest), http.StatusBadRequest)
+		return
+	}
+
+	var dir string
+	if policy != nil {
+		if dir, err = taildropMgr.admitDir(policy, from, &man); err != nil {
+			h.Logf("rejected manifest from %v/%v: %v", h.RemoteAddr().Addr(), h.Peer().ComputedName(), err)
+			httpErrorForPolicy(w, err)
+			return
+		}
+	}
+
+	have, err := taildropMgr.PutDirManifest(clientID(h.Peer().StableID()), dir, &man)
+	switch {
+	case err == nil:
+		h.Logf("got manifest of %d entries from %v/%v", len(man.Entries), h.RemoteAddr().Addr(), h.Peer().ComputedName())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(putDirResponse{Have: have})
+	case err == ErrNoTaildrop:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case err == ErrInvalidFileName, errors.Is(err, ErrInvalidManifest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err == ErrNoDirSupport:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func approxSize(n int64) string {
 	if n <= 1<<10 {
 		return "<=1KB"
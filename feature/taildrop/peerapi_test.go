@@ -16,6 +16,7 @@
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/google/go-cmp/cmp"
 	"tailscale.com/client/tailscale/apitype"
@@ -57,6 +58,7 @@ type fakeExtension struct {
 	capFileSharing bool
 	clock          tstime.Clock
 	taildrop       *manager
+	policy         *inboxPolicy
 }
 
 func (lb *fakeExtension) manager() *manager {
@@ -66,6 +68,14 @@ func (lb *fakeExtension) Clock() tstime.Clock { return lb.clock }
 func (lb *fakeExtension) hasCapFileSharing() bool {
 	return lb.capFileSharing
 }
+func (lb *fakeExtension) inboxPolicy() *inboxPolicy { return lb.policy }
+func (lb *fakeExtension) senderOf(h ipnlocal.PeerAPIHandler) sender {
+	return sender{
+		id:    clientID(h.Peer().StableID()),
+		login: "peer@example.com",
+		name:  h.Peer().ComputedName(),
+	}
+}
 
 type peerAPITestEnv struct {
 	taildrop *manager
@@ -138,6 +148,20 @@ func fileHasContents(name string, want string) check {
 	}
 }
 
+func fileNotExist(name string) check {
+	return func(t *testing.T, e *peerAPITestEnv) {
+		fsImpl, ok := e.taildrop.opts.fileOps.(fsFileOps)
+		if !ok {
+			t.Skip("fileNotExist only supported on fsFileOps backend")
+			return
+		}
+		path := filepath.Join(fsImpl.rootDir, filepath.FromSlash(name))
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("fileNotExist(%q): Stat error = %v", name, err)
+		}
+	}
+}
+
 func hexAll(v string) string {
 	var sb strings.Builder
 	for i := range len(v) {
@@ -153,6 +177,7 @@ func TestHandlePeerAPI(t *testing.T) {
 		capSharing bool // self node has file sharing capability
 		debugCap   bool // self node has debug capability
 		omitRoot   bool // don't configure
+		policy     *inboxPolicy
 		reqs       []*http.Request
 		checks     []check
 	}{
@@ -472,6 +497,114 @@ func(t *testing.T, env *peerAPITestEnv) {
 				},
 			),
 		},
+		{
+			name:       "policy_file_too_large",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &inboxPolicy{maxFileSize: 3},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("hello"))},
+			checks: checks(
+				httpStatus(http.StatusRequestEntityTooLarge),
+				bodyContains("file too large"),
+				fileNotExist("foo"),
+			),
+		},
+		{
+			name:       "policy_length_required",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &inboxPolicy{maxFileSize: 10},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", iotest.OneByteReader(strings.NewReader("hello")))},
+			checks: checks(
+				httpStatus(http.StatusLengthRequired),
+				fileNotExist("foo"),
+			),
+		},
+		{
+			name:       "policy_denied_sender",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &inboxPolicy{deniedSenders: []string{"peer@example.com"}},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("hello"))},
+			checks: checks(
+				httpStatus(http.StatusForbidden),
+				bodyContains("sender not allowed"),
+				fileNotExist("foo"),
+			),
+		},
+		{
+			name:       "policy_denied_sender_resume",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &inboxPolicy{deniedSenders: []string{"peer@example.com"}},
+			reqs: []*http.Request{
+				httptest.NewRequest("GET", "/v0/put/", nil),
+				httptest.NewRequest("GET", "/v0/put/foo", nil),
+			},
+			checks: checks(
+				httpStatus(http.StatusForbidden),
+				bodyContains("sender not allowed"),
+			),
+		},
+		{
+			name:       "policy_sender_not_in_allowlist",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &inboxPolicy{allowedSenders: []string{"other@example.com", "tag:ci"}},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("hello"))},
+			checks: checks(
+				httpStatus(http.StatusForbidden),
+				fileNotExist("foo"),
+			),
+		},
+		{
+			name:       "policy_sender_in_allowlist",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &inboxPolicy{allowedSenders: []string{"peer@example.com"}},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("hello"))},
+			checks: checks(
+				httpStatus(http.StatusOK),
+				func(t *testing.T, e *peerAPITestEnv) {
+					wfs := must.Get(e.taildrop.WaitingFiles())
+					if len(wfs) != 1 || wfs[0].Name != "foo" {
+						t.Errorf("WaitingFiles = %+v; want foo", wfs)
+					}
+				},
+			),
+		},
+		{
+			name:       "policy_quota_exceeded",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &inboxPolicy{dailyQuota: 8},
+			reqs: []*http.Request{
+				httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("hello")),
+				httptest.NewRequest("PUT", "/v0/put/bar", strings.NewReader("world")),
+			},
+			checks: checks(
+				httpStatus(http.StatusTooManyRequests),
+				bodyContains("quota"),
+				fileNotExist("bar"),
+			),
+		},
+		{
+			name:       "policy_per_sender_dir",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &inboxPolicy{perSenderDirs: true},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("hello"))},
+			checks: checks(
+				httpStatus(http.StatusOK),
+				fileNotExist("foo"),
+				func(t *testing.T, e *peerAPITestEnv) {
+					wfs := must.Get(e.taildrop.WaitingFiles())
+					if len(wfs) != 1 || wfs[0].Name != "peer@example.com/foo" {
+						t.Errorf("WaitingFiles = %+v; want peer@example.com/foo", wfs)
+					}
+				},
+			),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -503,6 +636,7 @@ func(t *testing.T, env *peerAPITestEnv) {
 				capFileSharing: tt.capSharing,
 				clock:          &tstest.Clock{},
 				taildrop:       e.taildrop,
+				policy:         tt.policy,
 			}
 			e.ph = &peerAPIHandler{
 				isSelf:   tt.isSelf,
@@ -0,0 +1,271 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"slices"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/syspolicy/pkey"
+)
+
+// inboxPolicy is the policy for files received by this node, from the
+// Taildrop system policy settings.
+type inboxPolicy struct {
+	maxFileSize    int64    // maximum size of each file; or 0 for no limit
+	dailyQuota     int64    // maximum bytes per sender per day; or 0 for no limit
+	allowedSenders []string // logins and tags; if non-empty, only these may send
+	deniedSenders  []string // logins and tags that may not send
+	perSenderDirs  bool     // whether to store files in per-sender directories
+}
+
+// inboxPolicy returns the current policy for received files, or nil if no
+// policy is configured.
+func (e *Extension) inboxPolicy() *inboxPolicy {
+	polc := e.sb.Sys().PolicyClientOrDefault()
+	var p inboxPolicy
+	if v, err := polc.GetUint64(pkey.TaildropMaxFileSize, 0); err != nil {
+		e.logf("reading %s policy: %v", pkey.TaildropMaxFileSize, err)
+	} else {
+		p.maxFileSize = int64(min(v, math.MaxInt64))
+	}
+	if v, err := polc.GetUint64(pkey.TaildropDailyQuotaPerSender, 0); err != nil {
+		e.logf("reading %s policy: %v", pkey.TaildropDailyQuotaPerSender, err)
+	} else {
+		p.dailyQuota = int64(min(v, math.MaxInt64))
+	}
+	if v, err := polc.GetStringArray(pkey.TaildropAllowedSenders, nil); err != nil {
+		e.logf("reading %s policy: %v", pkey.TaildropAllowedSenders, err)
+	} else {
+		p.allowedSenders = v
+	}
+	if v, err := polc.GetStringArray(pkey.TaildropDeniedSenders, nil); err != nil {
+		e.logf("reading %s policy: %v", pkey.TaildropDeniedSenders, err)
+	} else {
+		p.deniedSenders = v
+	}
+	if v, err := polc.GetBoolean(pkey.TaildropPerSenderDirectories, false); err != nil {
+		e.logf("reading %s policy: %v", pkey.TaildropPerSenderDirectories, err)
+	} else {
+		p.perSenderDirs = v
+	}
+	if p.maxFileSize == 0 && p.dailyQuota == 0 && len(p.allowedSenders) == 0 && len(p.deniedSenders) == 0 && !p.perSenderDirs {
+		return nil
+	}
+	return &p
+}
+
+// sender is the identity of the sender of files that inbox policies apply
+// to.
+type sender struct {
+	id    clientID // stable ID of the sending node
+	login string   // login name of the user, or empty for tagged nodes
+	tags  []string // tags of tagged nodes
+	name  string   // computed name of the node
+}
+
+// senderOf returns the sender of the files received through h.
+func (e *Extension) senderOf(h ipnlocal.PeerAPIHandler) sender {
+	peer := h.Peer()
+	s := sender{
+		id:   clientID(peer.StableID()),
+		name: peer.ComputedName(),
+	}
+	if peer.IsTagged() {
+		s.tags = peer.Tags().AsSlice()
+		return s
+	}
+	if _, up, ok := h.LocalBackend().WhoIs("tcp", h.RemoteAddr()); ok {
+		s.login = up.LoginName
+	}
+	return s
+}
+
+// quotaKey returns the identity that daily quotas apply to: the login name
+// of the user, or the stable ID of a tagged node.
+func (s sender) quotaKey() string {
+	if s.login != "" {
+		return s.login
+	}
+	return "node:" + string(s.id)
+}
+
+// dir returns the name of the inbox subdirectory for files from s: the login
+// name of the user, or the name of a tagged node.
+func (s sender) dir() string {
+	for _, name := range []string{s.login, s.name, string(s.id)} {
+		if name != "" && validateBaseName(name) == nil {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// matches reports whether s is one of the users or has one of the tags in
+// list.
+func (s sender) matches(list []string) bool {
+	for _, v := range list {
+		if (s.login != "" && v == s.login) || slices.Contains(s.tags, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether p allows s to send files.
+func (p *inboxPolicy) allows(s sender) bool {
+	if s.matches(p.deniedSenders) {
+		return false
+	}
+	return len(p.allowedSenders) == 0 || s.matches(p.allowedSenders)
+}
+
+// senderUsage tracks the number of bytes received from each sender on the
+// current day, for [inboxPolicy.dailyQuota].
+// It is persisted in the state store, so that restarts don't reset quotas.
+type senderUsage struct {
+	Day   string           `json:"day"`   // in "2006-01-02" form, in local time
+	Bytes map[string]int64 `json:"bytes"` // by [sender.quotaKey]
+}
+
+// quotaDay returns the day that t is in, for daily quotas.
+func quotaDay(t time.Time) string {
+	return t.Local().Format(time.DateOnly)
+}
+
+// usedQuotaLocked returns the number of bytes received from s today.
+// m.usageMu must be held.
+func (m *manager) usedQuotaLocked(s sender) int64 {
+	if !m.usageLoaded {
+		m.usageLoaded = true
+		m.loadUsageLocked()
+	}
+	if today := quotaDay(m.opts.Clock.Now()); m.usage.Day != today {
+		m.usage = senderUsage{Day: today}
+	}
+	return m.usage.Bytes[s.quotaKey()]
+}
+
+// loadUsageLocked reads m.usage from the state store, if any.
+// m.usageMu must be held.
+func (m *manager) loadUsageLocked() {
+	if m.opts.State == nil {
+		return
+	}
+	b, err := m.opts.State.ReadState(ipn.TaildropQuotaUsageKey)
+	if err != nil {
+		if !errors.Is(err, ipn.ErrStateNotExist) {
+			m.opts.Logf("reading quota usage: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(b, &m.usage); err != nil {
+		m.opts.Logf("decoding quota usage: %v", err)
+		m.usage = senderUsage{}
+	}
+}
+
+// saveUsageLocked writes m.usage to the state store, if any.
+// m.usageMu must be held.
+func (m *manager) saveUsageLocked() {
+	if m.opts.State == nil {
+		return
+	}
+	b, err := json.Marshal(m.usage)
+	if err != nil {
+		m.opts.Logf("encoding quota usage: %v", err)
+		return
+	}
+	if err := m.opts.State.WriteState(ipn.TaildropQuotaUsageKey, b); err != nil {
+		m.opts.Logf("writing quota usage: %v", err) // non-fatal error
+	}
+}
+
+// admitFile checks whether p allows a file of the given size to be received
+// from s, before any of it is written. The length is the number of bytes of
+// the file to receive, which is less than size when resuming a transfer, or
+// negative if unknown.
+//
+// If p limits the daily bytes from s, the length is counted in advance
+// towards the quota. The returned refund func must then be called with the
+// number of bytes actually received, to uncount the rest.
+//
+// It returns the inbox subdirectory to store the file in, if any.
+func (m *manager) admitFile(p *inboxPolicy, s sender, size, length int64) (dir string, refund func(received int64), err error) {
+	refund = func(int64) {}
+	if !p.allows(s) {
+		return "", refund, ErrSenderNotAllowed
+	}
+	if length < 0 && (p.maxFileSize > 0 || p.dailyQuota > 0) {
+		return "", refund, ErrLengthRequired
+	}
+	if p.maxFileSize > 0 && size > p.maxFileSize {
+		return "", refund, ErrFileTooLarge
+	}
+	if p.perSenderDirs {
+		dir = s.dir()
+	}
+	if p.dailyQuota <= 0 {
+		return dir, refund, nil
+	}
+
+	m.usageMu.Lock()
+	defer m.usageMu.Unlock()
+	used := m.usedQuotaLocked(s)
+	if length > p.dailyQuota-used {
+		return "", refund, ErrQuotaExceeded
+	}
+	mak.Set(&m.usage.Bytes, s.quotaKey(), used+length)
+	m.saveUsageLocked()
+	today := m.usage.Day
+	refund = func(received int64) {
+		m.usageMu.Lock()
+		defer m.usageMu.Unlock()
+		if m.usage.Day == today && received < length {
+			m.usage.Bytes[s.quotaKey()] -= length - received
+			m.saveUsageLocked()
+		}
+	}
+	return dir, refund, nil
+}
+
+// admitDir checks whether p allows the directory tree of man to be received
+// from s, like [manager.admitFile] for each of its files. Its files count
+// towards the daily quota of s as they're received, rather than in advance.
+//
+// It returns the inbox subdirectory to store the tree in, if any.
+func (m *manager) admitDir(p *inboxPolicy, s sender, man *apitype.TaildropManifest) (dir string, err error) {
+	if !p.allows(s) {
+		return "", ErrSenderNotAllowed
+	}
+	var remaining int64 = math.MaxInt64 // of the daily quota
+	if p.dailyQuota > 0 {
+		m.usageMu.Lock()
+		remaining = p.dailyQuota - m.usedQuotaLocked(s)
+		m.usageMu.Unlock()
+	}
+	for _, e := range man.Entries {
+		if e.Size <= 0 {
+			continue
+		}
+		if p.maxFileSize > 0 && e.Size > p.maxFileSize {
+			return "", ErrFileTooLarge
+		}
+		if e.Size > remaining {
+			return "", ErrQuotaExceeded
+		}
+		remaining -= e.Size
+	}
+	if p.perSenderDirs {
+		dir = s.dir()
+	}
+	return dir, nil
+}
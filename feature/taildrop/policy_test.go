@@ -0,0 +1,188 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tstest"
+	"tailscale.com/tstime"
+	"tailscale.com/util/must"
+)
+
+func TestInboxPolicyAllows(t *testing.T) {
+	alice := sender{id: "n1", login: "alice@example.com", name: "laptop"}
+	ci := sender{id: "n2", tags: []string{"tag:ci", "tag:server"}, name: "builder"}
+	tests := []struct {
+		name      string
+		p         inboxPolicy
+		wantAlice bool
+		wantCI    bool
+	}{
+		{"none", inboxPolicy{}, true, true},
+		{"allow-user", inboxPolicy{allowedSenders: []string{"alice@example.com"}}, true, false},
+		{"allow-tag", inboxPolicy{allowedSenders: []string{"tag:server"}}, false, true},
+		{"deny-user", inboxPolicy{deniedSenders: []string{"alice@example.com"}}, false, true},
+		{"deny-tag", inboxPolicy{deniedSenders: []string{"tag:ci"}}, true, false},
+		{"deny-over-allow", inboxPolicy{
+			allowedSenders: []string{"alice@example.com", "tag:ci"},
+			deniedSenders:  []string{"tag:server"},
+		}, true, false},
+		{"empty-login-not-matched", inboxPolicy{allowedSenders: []string{""}}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.allows(alice); got != tt.wantAlice {
+				t.Errorf("allows(alice) = %v; want %v", got, tt.wantAlice)
+			}
+			if got := tt.p.allows(ci); got != tt.wantCI {
+				t.Errorf("allows(ci) = %v; want %v", got, tt.wantCI)
+			}
+		})
+	}
+}
+
+func TestSenderDir(t *testing.T) {
+	tests := []struct {
+		s    sender
+		want string
+	}{
+		{sender{id: "n1", login: "alice@example.com", name: "laptop"}, "alice@example.com"},
+		{sender{id: "n2", tags: []string{"tag:ci"}, name: "builder"}, "builder"},
+		{sender{id: "n3", login: "bad/login", name: "laptop"}, "laptop"},
+		{sender{id: "n4"}, "n4"},
+		{sender{}, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.dir(); got != tt.want {
+			t.Errorf("%+v.dir() = %q; want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestAdmitFile(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2025, 1, 2, 12, 0, 0, 0, time.Local)})
+	m := managerOptions{Logf: t.Logf, Clock: tstime.DefaultClock{Clock: clock}}.New()
+	defer m.Shutdown()
+
+	alice := sender{id: "n1", login: "alice@example.com"}
+	alice2 := sender{id: "n2", login: "alice@example.com"}
+	bob := sender{id: "n3", login: "bob@example.com"}
+	p := &inboxPolicy{maxFileSize: 100, dailyQuota: 150, perSenderDirs: true}
+
+	if _, _, err := m.admitFile(p, alice, 101, 101); err != ErrFileTooLarge {
+		t.Errorf("too large file: err = %v; want %v", err, ErrFileTooLarge)
+	}
+	if _, _, err := m.admitFile(p, alice, 100, 20); err != nil {
+		t.Errorf("resumed file: %v", err)
+	}
+	if _, _, err := m.admitFile(p, alice, -1, -1); err != ErrLengthRequired {
+		t.Errorf("unknown length: err = %v; want %v", err, ErrLengthRequired)
+	}
+
+	dir, refund, err := m.admitFile(p, alice, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != "alice@example.com" {
+		t.Errorf("dir = %q; want %q", dir, "alice@example.com")
+	}
+	refund(100)
+
+	// Alice has used 120 bytes from her nodes, so can't send 40 more
+	// from any of them, but Bob can.
+	if _, _, err := m.admitFile(p, alice2, 40, 40); err != ErrQuotaExceeded {
+		t.Errorf("over quota: err = %v; want %v", err, ErrQuotaExceeded)
+	}
+	if _, _, err := m.admitFile(p, bob, 40, 40); err != nil {
+		t.Errorf("other sender: %v", err)
+	}
+
+	// Bytes that aren't received are refunded.
+	_, refund, err = m.admitFile(p, alice2, 30, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund(10)
+	if _, _, err := m.admitFile(p, alice, 20, 20); err != nil {
+		t.Errorf("after refund: %v", err)
+	}
+	if _, _, err := m.admitFile(p, alice, 1, 1); err != ErrQuotaExceeded {
+		t.Errorf("quota used up: err = %v; want %v", err, ErrQuotaExceeded)
+	}
+
+	// The quota resets the next day.
+	clock.Advance(24 * time.Hour)
+	if _, _, err := m.admitFile(p, alice, 100, 100); err != nil {
+		t.Errorf("next day: %v", err)
+	}
+}
+
+func TestAdmitDir(t *testing.T) {
+	m := managerOptions{Logf: t.Logf}.New()
+	defer m.Shutdown()
+
+	alice := sender{id: "n1", login: "alice@example.com"}
+	man := &apitype.TaildropManifest{Entries: []apitype.TaildropEntry{
+		{Path: "root", Mode: fs.ModeDir | 0o755},
+		{Path: "root/a", Mode: 0o644, Size: 60},
+		{Path: "root/b", Mode: 0o644, Size: 50},
+	}}
+	tests := []struct {
+		name    string
+		p       inboxPolicy
+		wantDir string
+		wantErr error
+	}{
+		{"allowed", inboxPolicy{maxFileSize: 60, dailyQuota: 110}, "", nil},
+		{"per-sender-dir", inboxPolicy{perSenderDirs: true}, "alice@example.com", nil},
+		{"file-too-large", inboxPolicy{maxFileSize: 59}, "", ErrFileTooLarge},
+		{"over-quota", inboxPolicy{dailyQuota: 109}, "", ErrQuotaExceeded},
+		{"denied", inboxPolicy{deniedSenders: []string{"alice@example.com"}}, "", ErrSenderNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := m.admitDir(&tt.p, alice, man)
+			if err != tt.wantErr {
+				t.Errorf("err = %v; want %v", err, tt.wantErr)
+			}
+			if dir != tt.wantDir {
+				t.Errorf("dir = %q; want %q", dir, tt.wantDir)
+			}
+		})
+	}
+}
+
+func TestQuotaPersisted(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2025, 1, 2, 12, 0, 0, 0, time.Local)})
+	opts := managerOptions{
+		Logf:  t.Logf,
+		Clock: tstime.DefaultClock{Clock: clock},
+		State: must.Get(mem.New(nil, "")),
+	}
+	alice := sender{id: "n1", login: "alice@example.com"}
+	p := &inboxPolicy{dailyQuota: 100}
+
+	m := opts.New()
+	_, refund, err := m.admitFile(p, alice, 80, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund(70)
+	m.Shutdown()
+
+	// A new manager, as after a restart, still counts the bytes received.
+	m = opts.New()
+	defer m.Shutdown()
+	if _, _, err := m.admitFile(p, alice, 40, 40); err != ErrQuotaExceeded {
+		t.Errorf("after restart: err = %v; want %v", err, ErrQuotaExceeded)
+	}
+	if _, _, err := m.admitFile(p, alice, 30, 30); err != nil {
+		t.Errorf("after restart: %v", err)
+	}
+}
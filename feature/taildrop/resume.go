@@ -10,6 +10,7 @@
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"strings"
 )
 
@@ -69,17 +70,18 @@ func (m *manager) PartialFiles(id clientID) ([]string, error) {
 }
 
 // HashPartialFile returns a function that hashes the next block in the file,
-// starting from the beginning of the file.
+// starting from the beginning of the file. The dir is the subdirectory that
+// the file is being stored in, as passed to [manager.PutFile].
 // It returns (BlockChecksum{}, io.EOF) when the stream is complete.
 // It is the caller's responsibility to call close.
-func (m *manager) HashPartialFile(id clientID, baseName string) (next func() (blockChecksum, error), close func() error, err error) {
+func (m *manager) HashPartialFile(id clientID, dir, baseName string) (next func() (blockChecksum, error), close func() error, err error) {
 	if m == nil || m.opts.fileOps == nil {
 		return nil, nil, ErrNoTaildrop
 	}
 	noopNext := func() (blockChecksum, error) { return blockChecksum{}, io.EOF }
 	noopClose := func() error { return nil }
 
-	f, err := m.opts.fileOps.OpenReader(baseName + id.partialSuffix())
+	f, err := m.opts.fileOps.OpenReader(path.Join(dir, baseName) + id.partialSuffix())
 	if err != nil {
 		if os.IsNotExist(err) {
 			return noopNext, noopClose, nil
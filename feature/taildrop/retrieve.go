@@ -9,6 +9,7 @@
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"runtime"
 	"sort"
 	"time"
@@ -137,10 +138,21 @@ func (m *manager) DeleteFile(baseName string) error {
 			logf("peerapi: failed to DeleteFile: %v", err)
 			return err
 		}
+		m.removeEmptyDirs(path.Dir(baseName))
 		return nil
 	}
 }
 
+// removeEmptyDirs removes dir, a slash-separated path of a directory of a
+// received directory tree, and then its parents, until one isn't empty.
+func (m *manager) removeEmptyDirs(dir string) {
+	for ; dir != "."; dir = path.Dir(dir) {
+		if err := m.opts.fileOps.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
 func (m *manager) touchFile(name string) error {
 	wc, _, err := m.opts.fileOps.OpenWriter(name /* offset= */, 0, 0666)
 	if err != nil {
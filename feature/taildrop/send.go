@@ -6,9 +6,12 @@
 import (
 	"fmt"
 	"io"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/tstime"
@@ -59,7 +62,12 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 }
 
 // PutFile stores a file into [manager.Dir] from a given client id.
-// The baseName must be a base filename without any slashes.
+// The baseName must be a base filename without any slashes, or the
+// slash-separated path of a file in a directory tree announced by the client
+// with [manager.PutDirManifest].
+// If dir is non-empty, it is the base name of the subdirectory of
+// [manager.Dir] to store the file in, such as the sender's directory of
+// [inboxPolicy.perSenderDirs].
 // The length is the expected length of content to read from r,
 // it may be negative to indicate that it is unknown.
 // It returns the length of the entire file.
@@ -70,7 +78,7 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 // specific partial file. This allows the client to determine whether to resume
 // a partial file. While resuming, PutFile may be called again with a non-zero
 // offset to specify where to resume receiving data at.
-func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, length int64) (fileLength int64, err error) {
+func (m *manager) PutFile(id clientID, dir, baseName string, r io.Reader, offset, length int64) (fileLength int64, err error) {
 
 	switch {
 	case m == nil || m.opts.fileOps == nil:
@@ -81,15 +89,30 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 		return 0, ErrNotAccessible
 	}
 
-	if err := validateBaseName(baseName); err != nil {
+	if dir != "" {
+		if err := validateBaseName(dir); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		inDir    *incomingDir // or nil if not part of a directory transfer
+		dirEntry apitype.TaildropEntry
+	)
+	if strings.Contains(baseName, "/") {
+		var ok bool
+		if inDir, dirEntry, ok = m.incomingDirFile(id, dir, baseName); !ok {
+			return 0, ErrInvalidFileName
+		}
+	} else if err := validateBaseName(baseName); err != nil {
 		return 0, err
 	}
+	name := path.Join(dir, baseName)
 
 	// and make sure we don't delete it while uploading:
-	m.deleter.Remove(baseName)
+	m.deleter.Remove(name)
 
 	// Create (if not already) the partial file with read-write permissions.
-	partialName := baseName + id.partialSuffix()
+	partialName := name + id.partialSuffix()
 	wc, partialPath, err := m.opts.fileOps.OpenWriter(partialName, offset, 0o666)
 	if err != nil {
 		return 0, m.redactAndLogError("Create", err)
@@ -102,7 +125,7 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 	}()
 
 	// Check whether there is an in-progress transfer for the file.
-	inFileKey := incomingFileKey{id, baseName}
+	inFileKey := incomingFileKey{id, name}
 	inFile, loaded := m.incomingFiles.LoadOrInit(inFileKey, func() *incomingFile {
 		inFile := &incomingFile{
 			clock:          m.opts.Clock,
@@ -152,12 +175,19 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 	inFile.done = true
 	inFile.mu.Unlock()
 
+	if inDir != nil {
+		m.setAttrs(partialName, dirEntry.Mode.Perm()&permMask, dirEntry.ModTime)
+	}
+
 	// 6) Finalize (rename/move) the partial into place via FileOps.Rename
-	finalPath, err := m.opts.fileOps.Rename(partialPath, baseName)
+	finalPath, err := m.opts.fileOps.Rename(partialPath, name)
 	if err != nil {
 		return 0, m.redactAndLogError("Rename", err)
 	}
 	inFile.finalPath = finalPath
+	if inDir != nil {
+		m.dirFileDone(id, inDir, baseName)
+	}
 
 	m.totalReceived.Add(1)
 	m.opts.SendFileNotify()
@@ -19,6 +19,7 @@
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
@@ -35,6 +36,13 @@
 	ErrInvalidFileName = errors.New("invalid filename")
 	ErrFileExists      = errors.New("file already exists")
 	ErrNotAccessible   = errors.New("Taildrop folder not configured or accessible")
+	ErrInvalidManifest = errors.New("invalid directory manifest")
+	ErrNoDirSupport    = errors.New("receiving directories not supported")
+
+	ErrSenderNotAllowed = errors.New("sender not allowed to send files to this node")
+	ErrFileTooLarge     = errors.New("file too large")
+	ErrQuotaExceeded    = errors.New("daily quota for sender exceeded")
+	ErrLengthRequired   = errors.New("file size must be known in advance")
 )
 
 const (
@@ -101,9 +109,16 @@ type manager struct {
 
 	// incomingFiles is a map of files actively being received.
 	incomingFiles syncs.Map[incomingFileKey, *incomingFile]
+	// incomingDirs is a map of directory trees being received, keyed by
+	// the name of their root directory.
+	incomingDirs syncs.Map[incomingFileKey, *incomingDir]
 	// deleter managers asynchronous deletion of files.
 	deleter fileDeleter
 
+	usageMu     sync.Mutex
+	usage       senderUsage // bytes received from each sender today
+	usageLoaded bool        // whether usage has been read from opts.State
+
 	// totalReceived counts the cumulative total of received files.
 	totalReceived atomic.Int64
 	// emptySince specifies that there were no waiting files
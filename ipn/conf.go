@@ -50,6 +50,13 @@ type ConfigVAlpha struct {
 	// should advertise amongst its wireguard endpoints.
 	StaticEndpoints []netip.AddrPort `json:",omitempty"`
 
+	// DNSZones are the paths of files of local DNS zones for MagicDNS to
+	// answer, to this node and to peers using it as an exit node, before
+	// forwarding. Relative paths are relative to the config file. Files
+	// named *.json or *.hujson are in HuJSON; others are in the zone file
+	// format. See package tailscale.com/net/dns/localzone.
+	DNSZones []string `json:",omitempty"`
+
 	// TODO(bradfitz,maisem): future something like:
 	// Profile map[string]*Config // keyed by alice@gmail.com, corp.com (TailnetSID)
 }
@@ -23,6 +23,7 @@
 	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"slices"
@@ -55,6 +56,7 @@
 	"tailscale.com/log/sockstatlog"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/localzone"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/dnsfallback"
 	"tailscale.com/net/ipset"
@@ -265,6 +267,7 @@ type LocalBackend struct {
 	currentNodeAtomic atomic.Pointer[nodeBackend]
 
 	conf             *conffile.Config // latest parsed config, or nil if not in declarative mode
+	localDNSZones    *localzone.Zones // local DNS zones from conf, or nil; mu guards access
 	pm               *profileManager  // mu guards access
 	lastFilterInputs *filterInputs
 	httpTestClient   *http.Client       // for controlclient. nil by default, used by tests.
@@ -840,6 +843,51 @@ func (b *LocalBackend) QueryDNS(name string, queryType dnsmessage.Type) (res []b
 	return res, rr, nil
 }
 
+// FlushDNSCache removes all responses of upstream resolvers cached by the
+// built-in DNS resolver.
+func (b *LocalBackend) FlushDNSCache() error {
+	if !buildfeatures.HasDNS {
+		return feature.ErrUnavailable
+	}
+	manager, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return errors.New("DNS manager not available")
+	}
+	manager.Resolver().FlushCache()
+	return nil
+}
+
+// DNSQueryStats returns the statistics of the queries of each client of the
+// built-in DNS resolver, with the n names each queried most. They're only
+// kept while DNS query logging is enabled.
+func (b *LocalBackend) DNSQueryStats(n int) ([]apitype.ClientQueryStats, error) {
+	if !buildfeatures.HasDNS {
+		return nil, feature.ErrUnavailable
+	}
+	manager, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, errors.New("DNS manager not available")
+	}
+	stats, ok := manager.Resolver().QueryStats(n)
+	if !ok {
+		return nil, errors.New("DNS query logging is disabled")
+	}
+	for i := range stats {
+		stats[i].Node, _ = b.DNSQueryNodeName(stats[i].Client)
+	}
+	return stats, nil
+}
+
+// DNSQueryNodeName returns the name of the node with the Tailscale IP ip,
+// to identify the clients of the built-in DNS resolver.
+func (b *LocalBackend) DNSQueryNodeName(ip netip.Addr) (name string, ok bool) {
+	n, _, ok := b.WhoIs("", netip.AddrPortFrom(ip, 0))
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(n.Name(), "."), true
+}
+
 // GetComponentDebugLogging gets the time that component's debug logging is
 // enabled until, or the zero time if component's time is not currently
 // enabled.
@@ -899,14 +947,42 @@ func (b *LocalBackend) initPrefsFromConfig(conf *conffile.Config) error {
 		return fmt.Errorf("error parsing config to prefs: %w", err)
 	}
 	p.ApplyEdits(&mp)
+	zones, err := loadLocalDNSZones(conf)
+	if err != nil {
+		return err
+	}
 	if err := b.pm.SetPrefs(p.View(), ipn.NetworkProfile{}); err != nil {
 		return err
 	}
 	b.setStaticEndpointsFromConfigLocked(conf)
+	b.localDNSZones = zones
 	b.conf = conf
 	return nil
 }
 
+// loadLocalDNSZones loads the local DNS zones listed in conf, if any.
+func loadLocalDNSZones(conf *conffile.Config) (*localzone.Zones, error) {
+	if !buildfeatures.HasDNS || len(conf.Parsed.DNSZones) == 0 {
+		return nil, nil
+	}
+	var zones []*localzone.Zone
+	for _, path := range conf.Parsed.DNSZones {
+		if !filepath.IsAbs(path) && conf.Path != conffile.VMUserDataPath {
+			path = filepath.Join(filepath.Dir(conf.Path), path)
+		}
+		zs, err := localzone.LoadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error loading DNS zones: %w", err)
+		}
+		zones = append(zones, zs...)
+	}
+	zs, err := localzone.New(zones...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading DNS zones: %w", err)
+	}
+	return zs, nil
+}
+
 func (b *LocalBackend) setStaticEndpointsFromConfigLocked(conf *conffile.Config) {
 	if conf.Parsed.StaticEndpoints == nil && (b.conf == nil || b.conf.Parsed.StaticEndpoints == nil) {
 		return
@@ -945,10 +1021,19 @@ func (b *LocalBackend) setConfigLockedOnEntry(conf *conffile.Config, unlock unlo
 		return fmt.Errorf("error parsing config to prefs: %w", err)
 	}
 	p.ApplyEdits(&mp)
+	zones, err := loadLocalDNSZones(conf)
+	if err != nil {
+		return err
+	}
+	zonesChanged := zones != nil || b.localDNSZones != nil
+	b.localDNSZones = zones
 	b.setStaticEndpointsFromConfigLocked(conf)
 	b.setPrefsLockedOnEntry(p, unlock)
 
 	b.conf = conf
+	if zonesChanged {
+		b.authReconfig()
+	}
 	return nil
 }
 
@@ -5031,6 +5116,7 @@ func (b *LocalBackend) authReconfig() {
 	disableSubnetsIfPAC := cn.SelfHasCap(tailcfg.NodeAttrDisableSubnetsIfPAC)
 	dohURL, dohURLOK := cn.exitNodeCanProxyDNS(prefs.ExitNodeID())
 	dcfg := cn.dnsConfigForNetmap(prefs, b.keyExpired, version.OS())
+	localDNSZones := b.localDNSZones
 	// If the current node is an app connector, ensure the app connector machine is started
 	b.reconfigAppConnectorLocked(nm, prefs)
 	closing := b.shutdownCalled
@@ -5085,6 +5171,10 @@ func (b *LocalBackend) authReconfig() {
 	oneCGNATRoute := shouldUseOneCGNATRoute(b.logf, b.sys.NetMon.Get(), b.sys.ControlKnobs(), version.OS())
 	rcfg := b.routerConfig(cfg, prefs, oneCGNATRoute)
 
+	if buildfeatures.HasDNS {
+		b.applyLocalDNSZones(dcfg, localDNSZones, prefs.CorpDNS())
+	}
+
 	err = b.e.Reconfig(cfg, rcfg, dcfg)
 	if err == wgengine.ErrNoChanges {
 		return
@@ -5097,6 +5187,23 @@ func (b *LocalBackend) authReconfig() {
 	}
 }
 
+// applyLocalDNSZones makes quad-100 answer the local DNS zones from the
+// config file. If the OS uses our DNS config, the zones are also routed to
+// quad-100, like the MagicDNS domains.
+func (b *LocalBackend) applyLocalDNSZones(dcfg *dns.Config, zones *localzone.Zones, corpDNS bool) {
+	if dm, ok := b.sys.DNSManager.GetOK(); ok {
+		dm.Resolver().SetLocalZones(zones)
+	}
+	if !corpDNS || dcfg == nil || dcfg.Routes == nil {
+		return
+	}
+	for _, origin := range zones.Origins() {
+		if _, ok := dcfg.Routes[origin]; !ok {
+			dcfg.Routes[origin] = nil // resolve internally with the zones
+		}
+	}
+}
+
 // shouldUseOneCGNATRoute reports whether we should prefer to make one big
 // CGNAT /10 route rather than a /32 per peer.
 //
@@ -122,6 +122,8 @@ func init() {
 	if buildfeatures.HasDNS {
 		Register("dns-osconfig", (*Handler).serveDNSOSConfig)
 		Register("dns-query", (*Handler).serveDNSQuery)
+		Register("dns-flush", (*Handler).serveDNSFlush)
+		Register("dns-queries", (*Handler).serveDNSQueries)
 	}
 	if buildfeatures.HasUserMetrics {
 		Register("usermetrics", (*Handler).serveUserMetrics)
@@ -1613,6 +1615,62 @@ func (h *Handler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// serveDNSFlush removes all responses cached by the internal DNS forwarder.
+func (h *Handler) serveDNSFlush(w http.ResponseWriter, r *http.Request) {
+	if !buildfeatures.HasDNS {
+		http.Error(w, feature.ErrUnavailable.Error(), http.StatusNotImplemented)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.PermitWrite {
+		http.Error(w, "dns-flush access denied", http.StatusForbidden)
+		return
+	}
+	if err := h.b.FlushDNSCache(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDNSQueries returns the statistics of the queries of each client of
+// the internal DNS resolver, as a JSON array of apitype.ClientQueryStats.
+// The optional "n" parameter is the number of names to return per client,
+// 10 by default.
+func (h *Handler) serveDNSQueries(w http.ResponseWriter, r *http.Request) {
+	if !buildfeatures.HasDNS {
+		http.Error(w, feature.ErrUnavailable.Error(), http.StatusNotImplemented)
+		return
+	}
+	if r.Method != httpm.GET {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Require write access for privacy reasons.
+	if !h.PermitWrite {
+		http.Error(w, "dns-queries access denied", http.StatusForbidden)
+		return
+	}
+	n := 10
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	stats, err := h.b.DNSQueryStats(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 // dnsMessageTypeForString returns the dnsmessage.Type for the given string.
 // For example, DNSMessageTypeForString("A") returns dnsmessage.TypeA.
 func dnsMessageTypeForString(s string) (t dnsmessage.Type, err error) {
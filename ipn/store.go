@@ -58,6 +58,11 @@
 	// has ever been received (even if partially).
 	// Any non-empty value indicates that at least one file has been received.
 	TaildropReceivedKey = StateKey("_taildrop-received")
+
+	// TaildropQuotaUsageKey is the key for the JSON number of bytes
+	// received by Taildrop from each sender on the current day, for the
+	// daily quota of the Taildrop inbox policy.
+	TaildropQuotaUsageKey = StateKey("_taildrop-quota-usage")
 )
 
 // CurrentProfileID returns the StateKey that stores the
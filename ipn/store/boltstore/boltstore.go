@@ -0,0 +1,154 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package boltstore contains an ipn.StateStore implementation backed by a
+// bbolt database.
+//
+// Unlike store.FileStore, which rewrites the whole state file on every
+// write, each WriteState is its own transaction that only touches the key
+// being written. This matters on hosts with many login profiles, where the
+// state grows large and is written often.
+package boltstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+	"tailscale.com/paths"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	store.Register(Prefix, New)
+}
+
+// Prefix is the store.New path prefix for a bbolt-backed store.
+// The rest of the argument is the path of the database file, as in
+// "bolt:/var/lib/tailscale/tailscaled.db".
+const Prefix = "bolt:"
+
+// stateBucket is the name of the bucket holding the state keys.
+var stateBucket = []byte("state")
+
+// openTimeout is how long New waits for the database file lock, which is
+// held by any other process (such as another tailscaled) that has it open.
+// It's a var for testing.
+var openTimeout = 5 * time.Second
+
+// Store is an ipn.StateStore that persists state to a bbolt database.
+type Store struct {
+	path string
+	db   *bbolt.DB
+}
+
+// Ensure Store implements store.ExportableStore for migration to/from other
+// store formats.
+var _ store.ExportableStore = (*Store)(nil)
+
+// New returns a new Store for the database file named by arg, which may have
+// the [Prefix]. The file is created if it doesn't exist.
+func New(_ logger.Logf, arg string) (ipn.StateStore, error) {
+	path := strings.TrimPrefix(arg, Prefix)
+	if path == "" {
+		return nil, errors.New("boltstore: missing database path")
+	}
+	if err := paths.MkStateDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("creating state directory: %w", err)
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		if errors.Is(err, bbolt.ErrTimeout) {
+			return nil, fmt.Errorf("state database %q is in use by another process", path)
+		}
+		return nil, fmt.Errorf("opening state database %q: %w", path, err)
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing state database %q: %w", path, err)
+	}
+	return &Store{path: path, db: db}, nil
+}
+
+// Path returns the path of the database file.
+func (s *Store) Path() string { return s.path }
+
+func (s *Store) String() string { return fmt.Sprintf("boltstore.Store(%q)", s.path) }
+
+// Close closes the database, releasing its file lock.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// ReadState implements the ipn.StateStore interface.
+func (s *Store) ReadState(id ipn.StateKey) ([]byte, error) {
+	var bs []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(stateBucket).Get([]byte(id))
+		if v == nil {
+			return ipn.ErrStateNotExist
+		}
+		// v is only valid for the duration of the transaction.
+		bs = bytes.Clone(v)
+		return nil
+	})
+	return bs, err
+}
+
+// WriteState implements the ipn.StateStore interface. Each call is committed
+// in its own transaction and is durable once it returns.
+func (s *Store) WriteState(id ipn.StateKey, bs []byte) error {
+	if id == "" {
+		return errors.New("boltstore: empty state key")
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(stateBucket)
+		if old := b.Get([]byte(id)); old != nil && bytes.Equal(old, bs) {
+			return nil
+		}
+		// bbolt treats a nil value as absent, so store empty values as an
+		// empty, non-nil slice.
+		if bs == nil {
+			bs = []byte{}
+		}
+		return b.Put([]byte(id), bs)
+	})
+}
+
+// All implements store.ExportableStore. Keys are returned in lexical order.
+//
+// The keys and values are read in a single transaction, so they're a
+// consistent snapshot of the store.
+func (s *Store) All() iter.Seq2[ipn.StateKey, []byte] {
+	return func(yield func(ipn.StateKey, []byte) bool) {
+		type kv struct {
+			k ipn.StateKey
+			v []byte
+		}
+		var all []kv
+		// Collect everything before yielding, so that a slow consumer
+		// doesn't hold a read transaction open, which would block bbolt
+		// from growing the database file on write.
+		s.db.View(func(tx *bbolt.Tx) error {
+			return tx.Bucket(stateBucket).ForEach(func(k, v []byte) error {
+				all = append(all, kv{ipn.StateKey(k), bytes.Clone(v)})
+				return nil
+			})
+		})
+		for _, e := range all {
+			if !yield(e.k, e.v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package boltstore
+
+import (
+	"errors"
+	"maps"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+	"tailscale.com/tstest"
+)
+
+func mustNew(t *testing.T, arg string) *Store {
+	t.Helper()
+	s, err := New(t.Logf, arg)
+	if err != nil {
+		t.Fatalf("New(%q): %v", arg, err)
+	}
+	return s.(*Store)
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s := mustNew(t, Prefix+path)
+
+	if _, err := s.ReadState("foo"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Fatalf("ReadState of missing key: %v", err)
+	}
+	for k, v := range map[ipn.StateKey]string{"foo": "bar", "baz": "quux", "empty": ""} {
+		if err := s.WriteState(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.WriteState("foo", []byte("bar2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = mustNew(t, Prefix+path)
+	defer s.Close()
+	want := map[ipn.StateKey][]byte{
+		"baz":   []byte("quux"),
+		"empty": {},
+		"foo":   []byte("bar2"),
+	}
+	got := maps.Collect(s.All())
+	if len(got) != len(want) {
+		t.Fatalf("All() = %q; want %q", got, want)
+	}
+	for k, v := range want {
+		if string(got[k]) != string(v) {
+			t.Errorf("All()[%q] = %q; want %q", k, got[k], v)
+		}
+		if rv, err := s.ReadState(k); err != nil || string(rv) != string(v) {
+			t.Errorf("ReadState(%q) = %q, %v; want %q", k, rv, err, v)
+		}
+	}
+}
+
+func TestStoreInUse(t *testing.T) {
+	tstest.Replace(t, &openTimeout, 10*time.Millisecond)
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	s := mustNew(t, Prefix+path)
+	defer s.Close()
+	if _, err := New(t.Logf, Prefix+path); err == nil {
+		t.Fatal("second New of open database succeeded; want error")
+	}
+}
+
+func TestMigrateFromFileStore(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := store.NewFileStore(t.Logf, filepath.Join(dir, "tailscaled.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[ipn.StateKey]string{
+		ipn.MachineKeyStateKey:     "privkey:abcd",
+		ipn.CurrentProfileStateKey: "1234",
+		"profile-1234":             `{"Config":{}}`,
+	}
+	for k, v := range want {
+		if err := fs.WriteState(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bs := mustNew(t, Prefix+filepath.Join(dir, "tailscaled.db"))
+	defer bs.Close()
+	if n, err := store.CopyAll(bs, fs.(store.ExportableStore)); err != nil || n != len(want) {
+		t.Fatalf("CopyAll to bolt = %d, %v; want %d, nil", n, err, len(want))
+	}
+
+	back, err := store.NewFileStore(t.Logf, filepath.Join(dir, "back.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.CopyAll(back, bs); err != nil || n != len(want) {
+		t.Fatalf("CopyAll from bolt = %d, %v; want %d, nil", n, err, len(want))
+	}
+	for k, v := range want {
+		if got, err := back.ReadState(k); err != nil || string(got) != v {
+			t.Errorf("ReadState(%q) after round trip = %q, %v; want %q", k, got, err, v)
+		}
+	}
+}
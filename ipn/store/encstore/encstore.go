@@ -0,0 +1,404 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package encstore contains an ipn.StateStore implementation that keeps
+// state in a local file, encrypted at rest with a key that is not stored
+// alongside it.
+//
+// It's meant for machines without a TPM (see the tpmseal: store), where the
+// key is instead provided by a key file, a systemd credential, or derived
+// from a passphrase.
+package encstore
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+	"tailscale.com/paths"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	store.Register(Prefix, New)
+}
+
+// Prefix is the store.New path prefix for an encrypted file store.
+//
+// The full form is "file+enc:<path>?<key-source>", where key-source is
+// exactly one of:
+//
+//   - keyfile=<path>: a file containing a 32-byte key, either raw or
+//     encoded as hex or base64.
+//   - credential=<name>: a systemd credential (see systemd.exec(5),
+//     LoadCredential=) containing a key in the same format as keyfile.
+//   - passphrase-file=<path>: a file containing a passphrase from which
+//     the key is derived with PBKDF2.
+//
+// For example:
+//
+//	file+enc:/var/lib/tailscale/tailscaled.state?credential=tailscaled-state-key
+const Prefix = "file+enc:"
+
+// fileFormat identifies the encrypted state file format.
+const fileFormat = "tailscale-encrypted-state-v1"
+
+// keyCheckPlaintext is sealed into every encrypted state file, so that a
+// wrong key is detected even if the store has no values yet.
+const keyCheckPlaintext = "tailscale-encrypted-state-key-check"
+
+// pbkdf2Iterations is the PBKDF2-HMAC-SHA256 iteration count used for new
+// passphrase-protected state files. It's a var for testing.
+var pbkdf2Iterations = 600_000
+
+// ErrWrongKey is returned by New when the key does not decrypt
+// the existing state file.
+var ErrWrongKey = errors.New("encstore: wrong key for encrypted state file")
+
+// encryptedFile is the on-disk JSON representation of an encrypted state file.
+// Each value is sealed separately with XChaCha20-Poly1305, with its state
+// key as additional data, so values can't be swapped between keys.
+type encryptedFile struct {
+	Format string                  `json:"format"`
+	KDF    *kdfParams              `json:"kdf,omitempty"` // only for passphrase-derived keys
+	Check  []byte                  `json:"check"`         // sealed keyCheckPlaintext
+	Values map[ipn.StateKey][]byte `json:"values"`        // sealed values
+}
+
+// kdfParams are the parameters used to derive a key from a passphrase.
+type kdfParams struct {
+	Alg        string `json:"alg"` // "pbkdf2-sha256"
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+}
+
+// keySource describes where the encryption key comes from.
+type keySource struct {
+	keyFile        string
+	credential     string
+	passphraseFile string
+}
+
+// Store is an ipn.StateStore that persists state to an encrypted file.
+type Store struct {
+	ipn.EncryptedStateStore
+
+	logf logger.Logf
+	path string
+	aead cipher.AEAD
+	kdf  *kdfParams
+	chk  []byte // sealed keyCheckPlaintext
+
+	mu     sync.RWMutex
+	cache  map[ipn.StateKey][]byte // plaintext values
+	sealed map[ipn.StateKey][]byte // sealed values, as written to disk
+}
+
+// Ensure Store implements store.ExportableStore for migration to other
+// store formats.
+var _ store.ExportableStore = (*Store)(nil)
+
+// New returns a new Store for arg, which must be of the form documented at
+// [Prefix].
+//
+// If the file at the path exists and is a plaintext state file written by
+// store.FileStore, it's encrypted in place. If it's already encrypted and
+// the key doesn't decrypt it, New returns an error wrapping [ErrWrongKey].
+func New(logf logger.Logf, arg string) (ipn.StateStore, error) {
+	path, ks, err := parseArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	if err := paths.MkStateDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("creating state directory: %w", err)
+	}
+
+	s := &Store{
+		logf:   logf,
+		path:   path,
+		cache:  make(map[ipn.StateKey][]byte),
+		sealed: make(map[ipn.StateKey][]byte),
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bs) == 0 {
+		// Missing or empty file: start afresh.
+		if err := s.initKey(ks, nil); err != nil {
+			return nil, err
+		}
+		if err := s.writeLocked(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &top); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %q: %w", path, err)
+	}
+	if _, ok := top["format"]; !ok {
+		if err := s.migrateFromPlaintext(ks, top); err != nil {
+			return nil, fmt.Errorf("failed to encrypt existing state file %q: %w", path, err)
+		}
+		return s, nil
+	}
+
+	var ef encryptedFile
+	if err := json.Unmarshal(bs, &ef); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted state file %q: %w", path, err)
+	}
+	if ef.Format != fileFormat {
+		return nil, fmt.Errorf("state file %q has unsupported format %q", path, ef.Format)
+	}
+	if err := s.initKey(ks, ef.KDF); err != nil {
+		return nil, err
+	}
+	if check, err := s.open("", ef.Check); err != nil || string(check) != keyCheckPlaintext {
+		return nil, fmt.Errorf("%w %q", ErrWrongKey, path)
+	}
+	s.chk = ef.Check
+	for k, v := range ef.Values {
+		pt, err := s.open(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt state key %q in %q: %w", k, path, err)
+		}
+		s.cache[k] = pt
+		s.sealed[k] = v
+	}
+	return s, nil
+}
+
+// migrateFromPlaintext initializes s from the contents of a plaintext
+// store.FileStore file, and replaces the file with its encrypted form.
+func (s *Store) migrateFromPlaintext(ks keySource, top map[string]json.RawMessage) error {
+	if len(top) == 3 && top["key"] != nil && top["nonce"] != nil && top["data"] != nil {
+		return errors.New("state file is TPM-sealed; migrate it to plaintext first by starting without " + store.TPMPrefix)
+	}
+	if err := s.initKey(ks, nil); err != nil {
+		return err
+	}
+	for k, raw := range top {
+		var v []byte
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("state key %q: %w", k, err)
+		}
+		s.setLocked(ipn.StateKey(k), v)
+	}
+	if err := s.writeLocked(); err != nil {
+		return err
+	}
+	s.logf("encstore: migrated %q from plaintext to encrypted format", s.path)
+	return nil
+}
+
+// parseArg parses a store argument of the form documented at [Prefix].
+func parseArg(arg string) (path string, ks keySource, err error) {
+	arg = strings.TrimPrefix(arg, Prefix)
+	path, query, _ := strings.Cut(arg, "?")
+	if path == "" {
+		return "", ks, errors.New("encstore: missing state file path")
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return "", ks, fmt.Errorf("encstore: invalid options: %w", err)
+	}
+	var n int
+	for k := range q {
+		switch k {
+		case "keyfile":
+			ks.keyFile = q.Get(k)
+		case "credential":
+			ks.credential = q.Get(k)
+		case "passphrase-file":
+			ks.passphraseFile = q.Get(k)
+		default:
+			return "", ks, fmt.Errorf("encstore: unknown option %q", k)
+		}
+		n++
+	}
+	if n != 1 {
+		return "", keySource{}, errors.New("encstore: exactly one of keyfile, credential or passphrase-file must be specified")
+	}
+	return path, ks, nil
+}
+
+// initKey loads or derives the key described by ks and sets up s.aead.
+// If kdf is nil and ks is a passphrase, new KDF parameters are generated.
+func (s *Store) initKey(ks keySource, kdf *kdfParams) error {
+	var key []byte
+	switch {
+	case ks.keyFile != "":
+		bs, err := os.ReadFile(ks.keyFile)
+		if err != nil {
+			return fmt.Errorf("encstore: reading key file: %w", err)
+		}
+		if key, err = parseKey(bs); err != nil {
+			return fmt.Errorf("encstore: key file %q: %w", ks.keyFile, err)
+		}
+	case ks.credential != "":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return fmt.Errorf("encstore: credential %q requested but $CREDENTIALS_DIRECTORY is not set", ks.credential)
+		}
+		bs, err := os.ReadFile(filepath.Join(dir, ks.credential))
+		if err != nil {
+			return fmt.Errorf("encstore: reading credential: %w", err)
+		}
+		if key, err = parseKey(bs); err != nil {
+			return fmt.Errorf("encstore: credential %q: %w", ks.credential, err)
+		}
+	case ks.passphraseFile != "":
+		bs, err := os.ReadFile(ks.passphraseFile)
+		if err != nil {
+			return fmt.Errorf("encstore: reading passphrase file: %w", err)
+		}
+		passphrase := strings.TrimRight(string(bs), "\r\n")
+		if passphrase == "" {
+			return fmt.Errorf("encstore: passphrase file %q is empty", ks.passphraseFile)
+		}
+		if kdf == nil {
+			kdf = &kdfParams{
+				Alg:        "pbkdf2-sha256",
+				Salt:       make([]byte, 16),
+				Iterations: pbkdf2Iterations,
+			}
+			rand.Read(kdf.Salt)
+		}
+		if kdf.Alg != "pbkdf2-sha256" {
+			return fmt.Errorf("encstore: unsupported KDF %q", kdf.Alg)
+		}
+		if key, err = pbkdf2.Key(sha256.New, passphrase, kdf.Salt, kdf.Iterations, chacha20poly1305.KeySize); err != nil {
+			return fmt.Errorf("encstore: deriving key: %w", err)
+		}
+		s.kdf = kdf
+	}
+	if kdf != nil && s.kdf == nil {
+		return errors.New("encstore: state file is protected by a passphrase; use passphrase-file")
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	s.aead = aead
+	if s.chk == nil {
+		s.chk = s.seal("", []byte(keyCheckPlaintext))
+	}
+	return nil
+}
+
+// parseKey parses a 32-byte key that's either raw, hex-encoded or
+// base64-encoded.
+func parseKey(bs []byte) ([]byte, error) {
+	if len(bs) == chacha20poly1305.KeySize {
+		return bs, nil
+	}
+	s := strings.TrimSpace(string(bs))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == chacha20poly1305.KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == chacha20poly1305.KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("want a %d-byte key, either raw, hex or base64", chacha20poly1305.KeySize)
+}
+
+// seal encrypts v, binding it to the state key k.
+func (s *Store) seal(k ipn.StateKey, v []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(v)+s.aead.Overhead())
+	rand.Read(nonce)
+	return s.aead.Seal(nonce, nonce, v, []byte(k))
+}
+
+// open decrypts a value sealed for the state key k.
+func (s *Store) open(k ipn.StateKey, sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	nonce, ct := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ct, []byte(k))
+}
+
+// Path returns the path of the encrypted state file.
+func (s *Store) Path() string { return s.path }
+
+func (s *Store) String() string { return fmt.Sprintf("encstore.Store(%q)", s.path) }
+
+// ReadState implements the ipn.StateStore interface.
+func (s *Store) ReadState(k ipn.StateKey) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.cache[k]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bytes.Clone(v), nil
+}
+
+// WriteState implements the ipn.StateStore interface.
+func (s *Store) WriteState(k ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.cache[k]; ok && bytes.Equal(old, bs) {
+		return nil
+	}
+	s.setLocked(k, bs)
+	return s.writeLocked()
+}
+
+// setLocked sets the plaintext and sealed values of k.
+// s.mu must be held.
+func (s *Store) setLocked(k ipn.StateKey, v []byte) {
+	s.cache[k] = bytes.Clone(v)
+	s.sealed[k] = s.seal(k, v)
+}
+
+// writeLocked writes the encrypted state file.
+// s.mu must be held.
+func (s *Store) writeLocked() error {
+	bs, err := json.MarshalIndent(encryptedFile{
+		Format: fileFormat,
+		KDF:    s.kdf,
+		Check:  s.chk,
+		Values: s.sealed,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, bs, 0600)
+}
+
+// All implements store.ExportableStore.
+func (s *Store) All() iter.Seq2[ipn.StateKey, []byte] {
+	return func(yield func(ipn.StateKey, []byte) bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for _, k := range slices.Sorted(maps.Keys(s.cache)) {
+			if !yield(k, s.cache[k]) {
+				break
+			}
+		}
+	}
+}
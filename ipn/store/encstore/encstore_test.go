@@ -0,0 +1,176 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package encstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+	"tailscale.com/tstest"
+)
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustNew(t *testing.T, arg string) *Store {
+	t.Helper()
+	s, err := New(t.Logf, arg)
+	if err != nil {
+		t.Fatalf("New(%q): %v", arg, err)
+	}
+	return s.(*Store)
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	writeFile(t, keyFile, hex.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n")
+	statePath := filepath.Join(dir, "tailscaled.state")
+	arg := Prefix + statePath + "?keyfile=" + keyFile
+
+	s := mustNew(t, arg)
+	if _, ok := any(s).(ipn.EncryptedStateStore); !ok {
+		t.Fatal("Store does not implement ipn.EncryptedStateStore")
+	}
+	if _, err := s.ReadState("foo"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Fatalf("ReadState of missing key: %v", err)
+	}
+	if err := s.WriteState("foo", []byte("secret-bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret-bar")) || bytes.Contains(raw, []byte("c2VjcmV0LWJhcg")) {
+		t.Fatalf("state file contains plaintext value:\n%s", raw)
+	}
+
+	s = mustNew(t, arg)
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "secret-bar" {
+		t.Fatalf("ReadState after reopen = %q, %v; want %q", got, err, "secret-bar")
+	}
+}
+
+func TestStoreWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	key1 := filepath.Join(dir, "key1")
+	key2 := filepath.Join(dir, "key2")
+	writeFile(t, key1, string(bytes.Repeat([]byte{1}, 32)))
+	writeFile(t, key2, string(bytes.Repeat([]byte{2}, 32)))
+	statePath := filepath.Join(dir, "tailscaled.state")
+
+	// The key check catches a wrong key even with no values stored.
+	mustNew(t, Prefix+statePath+"?keyfile="+key1)
+	if _, err := New(t.Logf, Prefix+statePath+"?keyfile="+key2); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("New with wrong key: %v; want %v", err, ErrWrongKey)
+	}
+}
+
+func TestStorePassphrase(t *testing.T) {
+	tstest.Replace(t, &pbkdf2Iterations, 1000)
+
+	dir := t.TempDir()
+	pass := filepath.Join(dir, "pass")
+	writeFile(t, pass, "correct horse battery staple\n")
+	statePath := filepath.Join(dir, "tailscaled.state")
+	arg := Prefix + statePath + "?passphrase-file=" + pass
+
+	s := mustNew(t, arg)
+	if err := s.WriteState("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	s = mustNew(t, arg)
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "bar" {
+		t.Fatalf("ReadState after reopen = %q, %v; want %q", got, err, "bar")
+	}
+
+	writeFile(t, pass, "wrong passphrase\n")
+	if _, err := New(t.Logf, arg); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("New with wrong passphrase: %v; want %v", err, ErrWrongKey)
+	}
+}
+
+func TestStoreCredential(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "state-key"), string(bytes.Repeat([]byte{3}, 32)))
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	s := mustNew(t, Prefix+filepath.Join(dir, "tailscaled.state")+"?credential=state-key")
+	if err := s.WriteState("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreMigratesPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "tailscaled.state")
+	plain, err := store.NewFileStore(t.Logf, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.WriteState("_machinekey", []byte("privkey:abcd")); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "key")
+	writeFile(t, keyFile, string(bytes.Repeat([]byte{4}, 32)))
+	arg := Prefix + statePath + "?keyfile=" + keyFile
+	s := mustNew(t, arg)
+	if got, err := s.ReadState("_machinekey"); err != nil || string(got) != "privkey:abcd" {
+		t.Fatalf("ReadState after migration = %q, %v", got, err)
+	}
+	raw, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), fileFormat) || strings.Contains(string(raw), "cHJpdmtleTphYmNk") {
+		t.Fatalf("state file not encrypted after migration:\n%s", raw)
+	}
+
+	// Reopening doesn't migrate again.
+	s = mustNew(t, arg)
+	if got, err := s.ReadState("_machinekey"); err != nil || string(got) != "privkey:abcd" {
+		t.Fatalf("ReadState after reopen = %q, %v", got, err)
+	}
+}
+
+func TestParseArg(t *testing.T) {
+	tests := []struct {
+		arg     string
+		path    string
+		ks      keySource
+		wantErr bool
+	}{
+		{arg: "file+enc:/a/b?keyfile=/k", path: "/a/b", ks: keySource{keyFile: "/k"}},
+		{arg: "file+enc:/a/b?credential=c", path: "/a/b", ks: keySource{credential: "c"}},
+		{arg: "file+enc:/a/b?passphrase-file=/p", path: "/a/b", ks: keySource{passphraseFile: "/p"}},
+		{arg: "file+enc:/a/b", wantErr: true},
+		{arg: "file+enc:?keyfile=/k", wantErr: true},
+		{arg: "file+enc:/a/b?keyfile=/k&credential=c", wantErr: true},
+		{arg: "file+enc:/a/b?bogus=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		path, ks, err := parseArg(tt.arg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseArg(%q) error = %v; wantErr %v", tt.arg, err, tt.wantErr)
+			continue
+		}
+		if path != tt.path || ks != tt.ks {
+			t.Errorf("parseArg(%q) = %q, %+v; want %q, %+v", tt.arg, path, ks, tt.path, tt.ks)
+		}
+	}
+}
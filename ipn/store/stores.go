@@ -55,6 +55,11 @@ func init() {
 //     the suffix is a Kubernetes secret name
 //   - (Linux or Windows) if the string begins with "tpmseal:", the suffix is
 //     filepath that is sealed with the local TPM device.
+//   - if the string begins with "file+enc:", the suffix is a filepath
+//     and key source; the file is encrypted with a key from a key file,
+//     systemd credential or passphrase. See package encstore.
+//   - (Linux-only) if the string begins with "bolt:", the suffix is the
+//     filepath of a bbolt database.
 //   - In all other cases, the path is treated as a filepath.
 func New(logf logger.Logf, path string) (ipn.StateStore, error) {
 	for prefix, sf := range knownStores {
@@ -252,6 +257,27 @@ type ExportableStore interface {
 	All() iter.Seq2[ipn.StateKey, []byte]
 }
 
+// CopyAll writes every key in src to dst, overwriting any existing values,
+// and returns the number of keys copied.
+func CopyAll(dst ipn.StateStore, src ExportableStore) (int, error) {
+	// Collect the keys first: ReadState and WriteState aren't safe to use
+	// while iterating, and dst may be the same underlying storage as src.
+	type kv struct {
+		k ipn.StateKey
+		v []byte
+	}
+	var all []kv
+	for k, v := range src.All() {
+		all = append(all, kv{k, v})
+	}
+	for _, e := range all {
+		if err := dst.WriteState(e.k, e.v); err != nil {
+			return 0, fmt.Errorf("writing %q: %w", e.k, err)
+		}
+	}
+	return len(all), nil
+}
+
 func maybeMigrateLocalStateFile(logf logger.Logf, path string) error {
 	path, toTPM := strings.CutPrefix(path, TPMPrefix)
 
@@ -322,10 +348,8 @@ func maybeMigrateLocalStateFile(logf logger.Logf, path string) error {
 	// Copy all the items. This is pretty inefficient, because both stores
 	// write the file to disk for each WriteState, but that's ok for a one-time
 	// migration.
-	for k, v := range fromExp.All() {
-		if err := to.WriteState(k, v); err != nil {
-			return err
-		}
+	if _, err := CopyAll(to, fromExp); err != nil {
+		return err
 	}
 
 	// Finally, overwrite the state file with the new one we created at
@@ -0,0 +1,15 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ios && !android && !ts_omit_hujsonconf
+
+package localzone
+
+import "github.com/tailscale/hujson"
+
+// Like ipn/conffile, only link the hujson package on platforms with
+// config files.
+
+func init() {
+	hujsonStandardize = hujson.Standardize
+}
@@ -0,0 +1,253 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package localzone contains local DNS zones, loaded from files on disk,
+// which MagicDNS answers authoritatively for split-horizon DNS.
+package localzone
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+// defaultTTL is the TTL of records whose file doesn't specify one.
+const defaultTTL = 300
+
+// maxCNAMEChain is the longest chain of CNAMEs that Lookup follows.
+const maxCNAMEChain = 8
+
+// Zone is a DNS zone: the records of the names at or below its origin.
+type Zone struct {
+	Origin  dnsname.FQDN
+	Records []Record
+}
+
+// Record is a DNS record in a Zone.
+type Record struct {
+	// Name is the owner name of the record. Its first label may be "*",
+	// to make it a wildcard record.
+	Name dnsname.FQDN
+	Type dns.Type // A, AAAA, CNAME, TXT or SRV
+	TTL  uint32
+
+	Addr   netip.Addr   // for A and AAAA
+	Target dnsname.FQDN // for CNAME and SRV
+	TXT    []string     // for TXT
+
+	// Priority, Weight and Port are for SRV.
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+}
+
+// isWildcard reports whether r is a wildcard record.
+func (r *Record) isWildcard() bool {
+	return strings.HasPrefix(string(r.Name), "*.")
+}
+
+// resource returns r as a DNS resource with the owner name.
+func (r *Record) resource(name dns.Name) (dns.Resource, error) {
+	rr := dns.Resource{
+		Header: dns.ResourceHeader{
+			Name:  name,
+			Type:  r.Type,
+			Class: dns.ClassINET,
+			TTL:   r.TTL,
+		},
+	}
+	switch r.Type {
+	case dns.TypeA:
+		rr.Body = &dns.AResource{A: r.Addr.As4()}
+	case dns.TypeAAAA:
+		rr.Body = &dns.AAAAResource{AAAA: r.Addr.As16()}
+	case dns.TypeCNAME:
+		target, err := dns.NewName(r.Target.WithTrailingDot())
+		if err != nil {
+			return dns.Resource{}, err
+		}
+		rr.Body = &dns.CNAMEResource{CNAME: target}
+	case dns.TypeTXT:
+		rr.Body = &dns.TXTResource{TXT: r.TXT}
+	case dns.TypeSRV:
+		target, err := dns.NewName(r.Target.WithTrailingDot())
+		if err != nil {
+			return dns.Resource{}, err
+		}
+		rr.Body = &dns.SRVResource{Priority: r.Priority, Weight: r.Weight, Port: r.Port, Target: target}
+	default:
+		return dns.Resource{}, fmt.Errorf("unsupported record type %v", r.Type)
+	}
+	return rr, nil
+}
+
+// Zones is a set of zones to answer queries from. It is immutable once
+// created with New.
+type Zones struct {
+	origins []dnsname.FQDN // longest first
+
+	// records are the records of each name, including wildcards.
+	records map[dnsname.FQDN][]Record
+
+	// names are the names that exist: the names with records, other
+	// than wildcards, and their ancestors within their zones, which
+	// may be empty non-terminals (RFC 8020).
+	names map[dnsname.FQDN]bool
+}
+
+// New returns the set of the provided zones, checking that they're valid.
+// Zones may be nested, in which case names are looked up in the zone with
+// the longest matching origin.
+func New(zones ...*Zone) (*Zones, error) {
+	zs := &Zones{
+		records: map[dnsname.FQDN][]Record{},
+		names:   map[dnsname.FQDN]bool{},
+	}
+	for _, z := range zones {
+		if slices.Contains(zs.origins, z.Origin) {
+			return nil, fmt.Errorf("duplicate zone %q", z.Origin)
+		}
+		zs.origins = append(zs.origins, z.Origin)
+	}
+	slices.SortFunc(zs.origins, func(a, b dnsname.FQDN) int {
+		return b.NumLabels() - a.NumLabels()
+	})
+
+	for _, z := range zones {
+		for _, r := range z.Records {
+			if origin, ok := zs.originFor(r.Name); !ok || origin != z.Origin {
+				return nil, fmt.Errorf("record %q is not in zone %q", r.Name, z.Origin)
+			}
+			if strings.Contains(strings.TrimPrefix(string(r.Name), "*."), "*") {
+				return nil, fmt.Errorf("record %q: wildcards are only allowed as the first label", r.Name)
+			}
+			zs.records[r.Name] = append(zs.records[r.Name], r)
+
+			name := r.Name
+			if r.isWildcard() {
+				name = parent(name)
+			}
+			for ; ; name = parent(name) {
+				zs.names[name] = true
+				if name == z.Origin {
+					break
+				}
+			}
+		}
+		zs.names[z.Origin] = true
+	}
+
+	for name, rrs := range zs.records {
+		if len(rrs) > 1 && slices.ContainsFunc(rrs, func(r Record) bool { return r.Type == dns.TypeCNAME }) {
+			return nil, fmt.Errorf("%q: a CNAME record can't be combined with other records", name)
+		}
+	}
+	return zs, nil
+}
+
+// parent returns the parent domain of name, which mustn't be the root.
+func parent(name dnsname.FQDN) dnsname.FQDN {
+	_, p, _ := strings.Cut(string(name), ".")
+	return dnsname.FQDN(p)
+}
+
+// Origins returns the origins of the zones.
+func (zs *Zones) Origins() []dnsname.FQDN {
+	if zs == nil {
+		return nil
+	}
+	return slices.Clone(zs.origins)
+}
+
+// originFor returns the origin of the zone that name is in.
+func (zs *Zones) originFor(name dnsname.FQDN) (dnsname.FQDN, bool) {
+	for _, origin := range zs.origins {
+		if origin.Contains(name) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// find returns the records of name, which is in the zone with origin,
+// including those of a matching wildcard (RFC 4592), and reports whether
+// the name exists.
+func (zs *Zones) find(name, origin dnsname.FQDN) (_ []Record, exists bool) {
+	if zs.names[name] {
+		return zs.records[name], true
+	}
+	// The wildcard at the closest existing ancestor of name, if any,
+	// matches it.
+	for a := name; a != origin; {
+		a = parent(a)
+		if rrs, ok := zs.records["*."+a]; ok {
+			return rrs, true
+		}
+		if zs.names[a] {
+			break
+		}
+	}
+	return nil, false
+}
+
+// Lookup returns the answers to a query for name and typ (which may be
+// TypeALL), and the response code. It reports false if name isn't in any
+// of the zones, in which case the query should be answered elsewhere.
+//
+// CNAMEs are followed within the zones. A CNAME pointing outside of them
+// is returned as is, without its target's records.
+func (zs *Zones) Lookup(name dnsname.FQDN, typ dns.Type) (answers []dns.Resource, rcode dns.RCode, ok bool) {
+	if zs == nil {
+		return nil, 0, false
+	}
+	name = dnsname.FQDN(strings.ToLower(string(name)))
+	origin, ok := zs.originFor(name)
+	if !ok {
+		return nil, 0, false
+	}
+
+	for range maxCNAMEChain {
+		rrs, exists := zs.find(name, origin)
+		if !exists {
+			return answers, dns.RCodeNameError, true
+		}
+		owner, err := dns.NewName(name.WithTrailingDot())
+		if err != nil {
+			return nil, dns.RCodeServerFailure, true
+		}
+
+		var cname *Record
+		for i, r := range rrs {
+			if r.Type == dns.TypeCNAME && typ != dns.TypeCNAME {
+				cname = &rrs[i]
+				break
+			}
+			if r.Type == typ || typ == dns.TypeALL {
+				rr, err := r.resource(owner)
+				if err != nil {
+					return nil, dns.RCodeServerFailure, true
+				}
+				answers = append(answers, rr)
+			}
+		}
+		if cname == nil {
+			return answers, dns.RCodeSuccess, true
+		}
+
+		rr, err := cname.resource(owner)
+		if err != nil {
+			return nil, dns.RCodeServerFailure, true
+		}
+		answers = append(answers, rr)
+		name = cname.Target
+		if origin, ok = zs.originFor(name); !ok {
+			return answers, dns.RCodeSuccess, true
+		}
+	}
+	// The chain is too long, or a loop. Like other servers, fail.
+	return nil, dns.RCodeServerFailure, true
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package localzone
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+const testZoneFile = `
+; Office zone.
+$ORIGIN Office.Example.com.
+$TTL 600
+@            IN SOA   ns hostmaster 1 3600 600 86400 60
+@            IN NS    ns
+@               TXT   "v=spf1 -all"
+nas          IN A     192.168.1.10
+             IN AAAA  fd00::10     ; same owner
+printer   60    A     192.168.1.20
+*.dev        IN CNAME devbox
+devbox       IN A     192.168.1.30
+_smb._tcp.nas   SRV   0 5 445 nas
+www             CNAME www.example.net.
+loop1           CNAME loop2
+loop2           CNAME loop1
+`
+
+const testHuJSON = `{
+	// Office zone.
+	"zones": [{
+		"origin": "office.example.com",
+		"ttl": 600,
+		"records": [
+			{"name": "@", "type": "TXT", "value": "v=spf1 -all"},
+			{"name": "nas", "type": "A", "value": "192.168.1.10"},
+			{"name": "nas", "type": "AAAA", "value": "fd00::10"},
+			{"name": "printer", "type": "A", "value": "192.168.1.20", "ttl": 60},
+			{"name": "*.dev", "type": "CNAME", "value": "devbox"},
+			{"name": "devbox", "type": "A", "value": "192.168.1.30"},
+			{"name": "_smb._tcp.nas", "type": "SRV", "value": "0 5 445 nas"},
+			{"name": "www", "type": "CNAME", "value": "www.example.net."},
+			{"name": "loop1", "type": "CNAME", "value": "loop2"},
+			{"name": "loop2", "type": "CNAME", "value": "loop1"},
+		],
+	}],
+}`
+
+func loadTestZones(t *testing.T, name, contents string) *Zones {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	zones, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs, err := New(zones...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zs
+}
+
+// answerStrings returns the answers as strings like "name TTL TYPE data".
+func answerStrings(answers []dns.Resource) []string {
+	var ret []string
+	for _, rr := range answers {
+		var data string
+		switch b := rr.Body.(type) {
+		case *dns.AResource:
+			data = netip.AddrFrom4(b.A).String()
+		case *dns.AAAAResource:
+			data = netip.AddrFrom16(b.AAAA).String()
+		case *dns.CNAMEResource:
+			data = b.CNAME.String()
+		case *dns.TXTResource:
+			data = strings.Join(b.TXT, "|")
+		case *dns.SRVResource:
+			data = b.Target.String()
+		}
+		ret = append(ret, fmt.Sprintf("%s %d %v %s", rr.Header.Name, rr.Header.TTL, rr.Header.Type, data))
+	}
+	return ret
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name      string
+		typ       dns.Type
+		wantRCode dns.RCode
+		want      []string
+		notOurs   bool
+	}{
+		{name: "nas.office.example.com.", typ: dns.TypeA, want: []string{"nas.office.example.com. 600 TypeA 192.168.1.10"}},
+		{name: "NAS.Office.example.com.", typ: dns.TypeAAAA, want: []string{"nas.office.example.com. 600 TypeAAAA fd00::10"}},
+		{name: "nas.office.example.com.", typ: dns.TypeALL, want: []string{
+			"nas.office.example.com. 600 TypeA 192.168.1.10",
+			"nas.office.example.com. 600 TypeAAAA fd00::10",
+		}},
+		{name: "printer.office.example.com.", typ: dns.TypeA, want: []string{"printer.office.example.com. 60 TypeA 192.168.1.20"}},
+		{name: "office.example.com.", typ: dns.TypeTXT, want: []string{"office.example.com. 600 TypeTXT v=spf1 -all"}},
+		{name: "_smb._tcp.nas.office.example.com.", typ: dns.TypeSRV, want: []string{"_smb._tcp.nas.office.example.com. 600 TypeSRV nas.office.example.com."}},
+
+		// NODATA, including for the origin and empty non-terminals.
+		{name: "printer.office.example.com.", typ: dns.TypeAAAA},
+		{name: "office.example.com.", typ: dns.TypeA},
+		{name: "_tcp.nas.office.example.com.", typ: dns.TypeSRV},
+		{name: "dev.office.example.com.", typ: dns.TypeA},
+
+		// NXDOMAIN.
+		{name: "missing.office.example.com.", typ: dns.TypeA, wantRCode: dns.RCodeNameError},
+		{name: "a.printer.office.example.com.", typ: dns.TypeA, wantRCode: dns.RCodeNameError},
+
+		// Wildcards, followed through the CNAME.
+		{name: "foo.dev.office.example.com.", typ: dns.TypeA, want: []string{
+			"foo.dev.office.example.com. 600 TypeCNAME devbox.office.example.com.",
+			"devbox.office.example.com. 600 TypeA 192.168.1.30",
+		}},
+		{name: "a.b.dev.office.example.com.", typ: dns.TypeCNAME, want: []string{
+			"a.b.dev.office.example.com. 600 TypeCNAME devbox.office.example.com.",
+		}},
+
+		// CNAMEs out of the zone aren't followed, and loops fail.
+		{name: "www.office.example.com.", typ: dns.TypeA, want: []string{"www.office.example.com. 600 TypeCNAME www.example.net."}},
+		{name: "loop1.office.example.com.", typ: dns.TypeA, wantRCode: dns.RCodeServerFailure},
+
+		// Not ours.
+		{name: "example.com.", typ: dns.TypeA, notOurs: true},
+		{name: "nas.office.example.org.", typ: dns.TypeA, notOurs: true},
+	}
+
+	for _, file := range []struct{ name, contents string }{
+		{"office.zone", testZoneFile},
+		{"zones.hujson", testHuJSON},
+	} {
+		zs := loadTestZones(t, file.name, file.contents)
+		if got, want := zs.Origins(), []dnsname.FQDN{"office.example.com."}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Origins = %v, want %v", file.name, got, want)
+		}
+		for _, tt := range tests {
+			answers, rcode, ok := zs.Lookup(dnsname.FQDN(tt.name), tt.typ)
+			if ok != !tt.notOurs {
+				t.Errorf("%s: Lookup(%q, %v) ok = %v", file.name, tt.name, tt.typ, ok)
+				continue
+			}
+			if rcode != tt.wantRCode {
+				t.Errorf("%s: Lookup(%q, %v) rcode = %v, want %v", file.name, tt.name, tt.typ, rcode, tt.wantRCode)
+			}
+			if got := answerStrings(answers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: Lookup(%q, %v) = %q, want %q", file.name, tt.name, tt.typ, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestZoneFileTXT(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	zs := loadTestZones(t, "txt.zone", "$ORIGIN txt.example.\n@ TXT \"one\" \"two \\\"quoted\\\"\" "+long+"\n")
+	answers, _, _ := zs.Lookup("txt.example.", dns.TypeTXT)
+	want := []string{"txt.example. 300 TypeTXT one|two \"quoted\"|" + long[:255] + "|" + long[255:]}
+	if got := answerStrings(answers); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNestedZones(t *testing.T) {
+	outer := &Zone{Origin: "example.com.", Records: []Record{
+		{Name: "a.example.com.", Type: dns.TypeCNAME, TTL: 60, Target: "b.lab.example.com."},
+	}}
+	inner := &Zone{Origin: "lab.example.com.", Records: []Record{
+		{Name: "b.lab.example.com.", Type: dns.TypeTXT, TTL: 60, TXT: []string{"inner"}},
+	}}
+	zs, err := New(outer, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, rcode, ok := zs.Lookup("a.example.com.", dns.TypeTXT)
+	want := []string{
+		"a.example.com. 60 TypeCNAME b.lab.example.com.",
+		"b.lab.example.com. 60 TypeTXT inner",
+	}
+	if got := answerStrings(answers); !ok || rcode != dns.RCodeSuccess || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, %v, %v; want %q", got, rcode, ok, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	zoneFiles := map[string]string{
+		"no-origin":      "nas A 192.168.1.10\n",
+		"two-origins":    "$ORIGIN a.example.\n$ORIGIN b.example.\n",
+		"include":        "$ORIGIN a.example.\n$INCLUDE other.zone\n",
+		"multi-line":     "$ORIGIN a.example.\n@ SOA ns hostmaster (\n 1 2 3 4 5 )\n",
+		"bad-type":       "$ORIGIN a.example.\nmail MX 10 mx\n",
+		"bad-a":          "$ORIGIN a.example.\nnas A fd00::1\n",
+		"bad-srv":        "$ORIGIN a.example.\n_x._tcp SRV 0 0 nas\n",
+		"unterminated":   "$ORIGIN a.example.\n@ TXT \"oops\n",
+		"out-of-zone":    "$ORIGIN a.example.\nnas.b.example. A 192.168.1.10\n",
+		"cname-and-a":    "$ORIGIN a.example.\nnas CNAME x\nnas A 192.168.1.10\n",
+		"inner-wildcard": "$ORIGIN a.example.\nfoo.*.bar A 192.168.1.10\n",
+		"root-origin":    "$ORIGIN .\n",
+	}
+	for name, contents := range zoneFiles {
+		z, err := ParseZoneFile([]byte(contents))
+		if err == nil {
+			_, err = New(z)
+		}
+		if err == nil {
+			t.Errorf("%s: unexpected success", name)
+		}
+	}
+
+	if _, err := ParseHuJSON([]byte(`{"zones": [{"origin": "a.example", "unknown": 1}]}`)); err == nil {
+		t.Error("HuJSON with unknown field: unexpected success")
+	}
+	a, _ := ParseZoneFile([]byte("$ORIGIN a.example.\n"))
+	if _, err := New(a, a); err == nil {
+		t.Error("duplicate zones: unexpected success")
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package localzone
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+// hujsonStandardize is set to hujson.Standardize by hujson.go on platforms
+// that support config files.
+var hujsonStandardize func([]byte) ([]byte, error)
+
+// LoadFile reads and parses the zones in the file at path. Files named
+// *.json or *.hujson are parsed with ParseHuJSON, and all others with
+// ParseZoneFile.
+func LoadFile(path string) ([]*Zone, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var zones []*Zone
+	switch filepath.Ext(path) {
+	case ".json", ".hujson":
+		zones, err = ParseHuJSON(b)
+	default:
+		var z *Zone
+		z, err = ParseZoneFile(b)
+		zones = []*Zone{z}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return zones, nil
+}
+
+// ParseHuJSON parses zones in HuJSON, like:
+//
+//	{
+//		"zones": [{
+//			"origin": "office.example.com",
+//			"ttl": 300, // optional
+//			"records": [
+//				{"name": "nas", "type": "A", "value": "192.168.1.10"},
+//				{"name": "*.dev", "type": "CNAME", "value": "devbox"},
+//				{"name": "_smb._tcp", "type": "SRV", "value": "0 0 445 nas"},
+//				{"name": "@", "type": "TXT", "value": "hello, world", "ttl": 60},
+//			],
+//		}],
+//	}
+//
+// Names are relative to the origin unless they end in a dot, and "@" is
+// the origin itself. Values are in zone file syntax, other than those of
+// TXT records, which are the text.
+func ParseHuJSON(b []byte) ([]*Zone, error) {
+	if hujsonStandardize != nil {
+		var err error
+		b, err = hujsonStandardize(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var file struct {
+		Zones []struct {
+			Origin  string
+			TTL     uint32
+			Records []struct {
+				Name  string
+				Type  string
+				TTL   uint32
+				Value string
+			}
+		}
+	}
+	jd := json.NewDecoder(bytes.NewReader(b))
+	jd.DisallowUnknownFields()
+	if err := jd.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	var zones []*Zone
+	for _, jz := range file.Zones {
+		origin, err := parseOrigin(jz.Origin)
+		if err != nil {
+			return nil, err
+		}
+		z := &Zone{Origin: origin}
+		for _, jr := range jz.Records {
+			name, err := qualify(jr.Name, origin)
+			if err != nil {
+				return nil, err
+			}
+			ttl := cmp.Or(jr.TTL, jz.TTL, defaultTTL)
+			rdata := strings.Fields(jr.Value)
+			if strings.EqualFold(jr.Type, "TXT") {
+				rdata = []string{jr.Value}
+			}
+			r, ok, err := parseRecord(name, jr.Type, ttl, rdata, origin)
+			if err != nil {
+				return nil, fmt.Errorf("zone %q: %w", origin, err)
+			}
+			if ok {
+				z.Records = append(z.Records, r)
+			}
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// ParseZoneFile parses a zone in the RFC 1035 zone file format, like:
+//
+//	$ORIGIN office.example.com.
+//	$TTL 300
+//	nas          IN A     192.168.1.10
+//	*.dev        IN CNAME devbox
+//	_smb._tcp    IN SRV   0 0 445 nas
+//	@         60 IN TXT   "hello, world"
+//
+// The file must start with an $ORIGIN directive. Records can't span
+// lines, and $INCLUDE isn't supported. SOA and NS records are ignored.
+func ParseZoneFile(b []byte) (*Zone, error) {
+	var (
+		z     *Zone
+		ttl   uint32 = defaultTTL
+		owner dnsname.FQDN
+	)
+	for i, line := range strings.Split(string(b), "\n") {
+		errorf := func(format string, args ...any) error {
+			return fmt.Errorf("line %d: %s", i+1, fmt.Sprintf(format, args...))
+		}
+		fields, err := tokenize(line)
+		if err != nil {
+			return nil, errorf("%v", err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "$ORIGIN":
+			if z != nil {
+				return nil, errorf("only one $ORIGIN is supported")
+			}
+			if len(fields) != 2 {
+				return nil, errorf("bad $ORIGIN")
+			}
+			origin, err := parseOrigin(fields[1])
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			z = &Zone{Origin: origin}
+			continue
+		case "$TTL":
+			if len(fields) != 2 {
+				return nil, errorf("bad $TTL")
+			}
+			v, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, errorf("bad $TTL: %v", err)
+			}
+			ttl = uint32(v)
+			continue
+		}
+		if strings.HasPrefix(fields[0], "$") {
+			return nil, errorf("unsupported directive %s", fields[0])
+		}
+		if z == nil {
+			return nil, errorf("record before $ORIGIN")
+		}
+
+		// A line starting with whitespace is for the previous owner.
+		if line[0] != ' ' && line[0] != '\t' {
+			owner, err = qualify(fields[0], z.Origin)
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			fields = fields[1:]
+		} else if owner == "" {
+			return nil, errorf("no owner name")
+		}
+
+		// The TTL and class are optional, in either order.
+		rttl := ttl
+		for len(fields) > 0 {
+			if v, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				rttl = uint32(v)
+			} else if !strings.EqualFold(fields[0], "IN") {
+				break
+			}
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			return nil, errorf("no record type")
+		}
+		r, ok, err := parseRecord(owner, fields[0], rttl, fields[1:], z.Origin)
+		if err != nil {
+			return nil, errorf("%v", err)
+		}
+		if ok {
+			z.Records = append(z.Records, r)
+		}
+	}
+	if z == nil {
+		return nil, errors.New("no $ORIGIN")
+	}
+	return z, nil
+}
+
+// tokenize splits a zone file line into fields, removing comments and the
+// quotes around quoted strings.
+func tokenize(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t\r")
+		if line == "" || line[0] == ';' {
+			return fields, nil
+		}
+		switch line[0] {
+		case '(', ')':
+			return nil, errors.New("multi-line records are not supported")
+		case '"':
+			var sb strings.Builder
+			i := 1
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				sb.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, errors.New("unterminated string")
+			}
+			fields = append(fields, sb.String())
+			line = line[i+1:]
+		default:
+			end := strings.IndexAny(line, " \t\r;")
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+		}
+	}
+}
+
+// parseOrigin parses the origin of a zone.
+func parseOrigin(s string) (dnsname.FQDN, error) {
+	origin, err := dnsname.ToFQDN(strings.ToLower(s))
+	if err != nil {
+		return "", err
+	}
+	if origin == "." || strings.Contains(string(origin), "*") {
+		return "", fmt.Errorf("invalid zone origin %q", s)
+	}
+	return origin, nil
+}
+
+// qualify returns the FQDN of name, which is relative to origin unless
+// it ends in a dot.
+func qualify(name string, origin dnsname.FQDN) (dnsname.FQDN, error) {
+	switch {
+	case name == "@":
+		return origin, nil
+	case name == "":
+		return "", errors.New("empty name")
+	case !strings.HasSuffix(name, "."):
+		name += "." + origin.WithTrailingDot()
+	}
+	return dnsname.ToFQDN(strings.ToLower(name))
+}
+
+// parseRecord parses a record of the given type, with its data in zone
+// file syntax. It reports false if the record is of a type that's
+// ignored.
+func parseRecord(name dnsname.FQDN, typ string, ttl uint32, rdata []string, origin dnsname.FQDN) (_ Record, ok bool, _ error) {
+	r := Record{Name: name, TTL: ttl}
+	wantFields := 1
+	switch strings.ToUpper(typ) {
+	case "A":
+		r.Type = dns.TypeA
+	case "AAAA":
+		r.Type = dns.TypeAAAA
+	case "CNAME":
+		r.Type = dns.TypeCNAME
+	case "TXT":
+		r.Type = dns.TypeTXT
+		wantFields = len(rdata)
+	case "SRV":
+		r.Type = dns.TypeSRV
+		wantFields = 4
+	case "SOA", "NS":
+		// Only meaningful for delegation, which there isn't any of.
+		return Record{}, false, nil
+	default:
+		return Record{}, false, fmt.Errorf("%s: unsupported record type %q", name, typ)
+	}
+	if len(rdata) != wantFields || len(rdata) == 0 {
+		return Record{}, false, fmt.Errorf("%s: bad %s record data %q", name, typ, strings.Join(rdata, " "))
+	}
+
+	var err error
+	switch r.Type {
+	case dns.TypeA, dns.TypeAAAA:
+		r.Addr, err = netip.ParseAddr(rdata[0])
+		if err == nil && r.Addr.Is4() != (r.Type == dns.TypeA) {
+			err = fmt.Errorf("%v is not an %s address", r.Addr, typ)
+		}
+	case dns.TypeCNAME:
+		r.Target, err = qualify(rdata[0], origin)
+	case dns.TypeTXT:
+		for _, s := range rdata {
+			// Each string is at most 255 bytes; split longer ones.
+			for len(s) > 255 {
+				r.TXT = append(r.TXT, s[:255])
+				s = s[255:]
+			}
+			r.TXT = append(r.TXT, s)
+		}
+	case dns.TypeSRV:
+		var nums [3]uint64
+		for i := range nums {
+			if nums[i], err = strconv.ParseUint(rdata[i], 10, 16); err != nil {
+				break
+			}
+		}
+		r.Priority, r.Weight, r.Port = uint16(nums[0]), uint16(nums[1]), uint16(nums[2])
+		if err == nil {
+			r.Target, err = qualify(rdata[3], origin)
+		}
+	}
+	if err != nil {
+		return Record{}, false, fmt.Errorf("%s: bad %s record: %w", name, typ, err)
+	}
+	return r, true, nil
+}
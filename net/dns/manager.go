@@ -96,6 +96,11 @@ func NewManager(logf logger.Logf, oscfg OSConfigurator, health *health.Tracker,
 		goos:     goos,
 	}
 
+	m.resolver.SetBaseNameserversFunc(func() ([]netip.Addr, error) {
+		cfg, err := m.os.GetBaseConfig()
+		return cfg.Nameservers, err
+	})
+
 	m.ctx, m.ctxCancel = context.WithCancel(context.Background())
 	m.logf("using %T", m.os)
 	return m
@@ -15,6 +15,7 @@
 	"github.com/godbus/dbus/v5"
 	"golang.org/x/sys/unix"
 	"tailscale.com/health"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/backoff"
 	"tailscale.com/util/dnsname"
@@ -47,6 +48,14 @@ type resolvedLinkNameserver struct {
 	Address []byte
 }
 
+// resolvedNameserver is a nameserver of the systemd-resolved Manager's DNS
+// property.
+type resolvedNameserver struct {
+	Ifindex int32 // or 0 if global
+	Family  int32
+	Address []byte
+}
+
 type resolvedLinkDomain struct {
 	Domain      string
 	RoutingOnly bool
@@ -72,6 +81,7 @@ type resolvedManager struct {
 
 func init() {
 	optNewResolvedManager.Set(newResolvedManager)
+	resolver.HookResolvedNeedsStub.Set(resolvedNeedsStub)
 }
 
 func newResolvedManager(logf logger.Logf, health *health.Tracker, interfaceName string) (OSConfigurator, error) {
@@ -399,3 +409,45 @@ func linkDomainsWithoutReverseDNS(v []resolvedLinkDomain) (ret []resolvedLinkDom
 	}
 	return ret
 }
+
+// resolvedNeedsStub reports whether systemd-resolved needs its stub resolver
+// to be used, rather than the nameservers it forwards to: whether it has
+// nameservers for more than one link (including global ones), and so routes
+// domains between them, or uses DNSSEC or DNS-over-TLS.
+func resolvedNeedsStub() (bool, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reconfigTimeout)
+	defer cancel()
+	rManager := conn.Object(dbusResolvedObject, dbusResolvedPath)
+	get := func(member string, v any) error {
+		var res dbus.Variant
+		if err := rManager.CallWithContext(ctx, "org.freedesktop.DBus.Properties.Get", 0, dbusResolvedInterface, member).Store(&res); err != nil {
+			return fmt.Errorf("getting %s: %w", member, err)
+		}
+		return res.Store(v)
+	}
+
+	var dnssec, dot string
+	if err := get("DNSSEC", &dnssec); err != nil {
+		return false, err
+	}
+	if err := get("DNSOverTLS", &dot); err != nil {
+		return false, err
+	}
+	if dnssec != "no" || dot != "no" {
+		return true, nil
+	}
+	var nameservers []resolvedNameserver
+	if err := get("DNS", &nameservers); err != nil {
+		return false, err
+	}
+	for _, ns := range nameservers {
+		if ns.Ifindex != nameservers[0].Ifindex {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,270 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/lru"
+	"tailscale.com/version"
+)
+
+const (
+	// maxCacheTTL is the longest that a response is cached for,
+	// regardless of its TTLs.
+	maxCacheTTL = time.Hour
+
+	// maxNegativeCacheTTL is the longest that a negative (NXDOMAIN or
+	// NODATA) response is cached for. RFC 2308 suggests up to 3 hours,
+	// but names are often created shortly after they're found missing.
+	maxNegativeCacheTTL = 5 * time.Minute
+
+	// maxStaleAge is how long past its expiry a response may be served,
+	// when the upstream resolvers fail (RFC 8767).
+	maxStaleAge = 5 * time.Minute
+
+	// staleTTL is the TTL of the records in stale responses, as
+	// recommended by RFC 8767, section 4.
+	staleTTL = 30 * time.Second
+)
+
+// maxCacheEntries returns the number of responses to cache.
+func maxCacheEntries() int {
+	if version.IsMobile() {
+		// Memory is tight on iOS, and mobile devices aren't usually
+		// resolving for other devices.
+		return 256
+	}
+	return 4096
+}
+
+// responseCache caches the responses of upstream resolvers, by question,
+// respecting their TTLs. Negative responses are cached per RFC 2308, and
+// expired responses may be served for a while if the upstreams are failing,
+// per RFC 8767.
+type responseCache struct {
+	mu      sync.Mutex
+	entries lru.Cache[cacheKey, *cacheEntry]
+}
+
+func newResponseCache() *responseCache {
+	c := &responseCache{}
+	c.entries.MaxEntries = maxCacheEntries()
+	return c
+}
+
+// cacheKey is the key of a cached response: the question, and the query
+// flags that affect the answer.
+type cacheKey struct {
+	name  string // lowercase
+	typ   dns.Type
+	class dns.Class
+	do    bool // DNSSEC OK bit of the EDNS OPT record
+	cd    bool // checking disabled bit
+}
+
+type cacheEntry struct {
+	msg      dns.Message
+	stored   time.Time
+	expires  time.Time
+	negative bool
+}
+
+// parseCacheKey returns the cache key of query, reporting whether it's
+// cacheable: a standard query with a single question.
+func parseCacheKey(query []byte) (_ cacheKey, id uint16, _ dns.Question, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return cacheKey{}, 0, dns.Question{}, false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 {
+		return cacheKey{}, 0, dns.Question{}, false
+	}
+	k := cacheKey{
+		name:  strings.ToLower(qs[0].Name.String()),
+		typ:   qs[0].Type,
+		class: qs[0].Class,
+		cd:    h.CheckingDisabled,
+	}
+	if p.SkipAllAnswers() == nil && p.SkipAllAuthorities() == nil {
+		for {
+			rh, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type == dns.TypeOPT {
+				k.do = rh.DNSSECAllowed()
+				break
+			}
+			if p.SkipAdditional() != nil {
+				break
+			}
+		}
+	}
+	return k, h.ID, qs[0], true
+}
+
+// get returns a response to query from the cache, if there's a fresh one,
+// or if stale is true, one that expired less than maxStaleAge ago.
+// It also reports whether the response is negative.
+func (c *responseCache) get(query []byte, now time.Time, stale bool) (res []byte, negative, ok bool) {
+	k, id, q, ok := parseCacheKey(query)
+	if !ok {
+		return nil, false, false
+	}
+	c.mu.Lock()
+	e, ok := c.entries.GetOk(k)
+	c.mu.Unlock()
+	if !ok {
+		return nil, false, false
+	}
+	var ttl func(uint32) uint32
+	switch {
+	case now.Before(e.expires):
+		age := uint32(now.Sub(e.stored) / time.Second)
+		ttl = func(t uint32) uint32 { return t - min(t, age) }
+	case stale && now.Sub(e.expires) < maxStaleAge:
+		ttl = func(uint32) uint32 { return uint32(staleTTL / time.Second) }
+	default:
+		return nil, false, false
+	}
+
+	msg := e.msg
+	msg.Header.ID = id
+	msg.Questions = []dns.Question{q} // in the query's case
+	msg.Answers = adjustTTLs(msg.Answers, ttl)
+	msg.Authorities = adjustTTLs(msg.Authorities, ttl)
+	msg.Additionals = adjustTTLs(msg.Additionals, ttl)
+	res, err := msg.Pack()
+	if err != nil {
+		return nil, false, false
+	}
+	return res, e.negative, true
+}
+
+// adjustTTLs returns a copy of rrs with their TTLs adjusted by ttl,
+// other than that of any OPT record, whose TTL field holds flags.
+func adjustTTLs(rrs []dns.Resource, ttl func(uint32) uint32) []dns.Resource {
+	rrs = slices.Clone(rrs)
+	for i := range rrs {
+		if rrs[i].Header.Type != dns.TypeOPT {
+			rrs[i].Header.TTL = ttl(rrs[i].Header.TTL)
+		}
+	}
+	return rrs
+}
+
+// set caches the response res to query, if it's cacheable, and reports
+// whether it was cached.
+func (c *responseCache) set(query, res []byte, now time.Time) bool {
+	k, _, q, ok := parseCacheKey(query)
+	if !ok {
+		return false
+	}
+	e := &cacheEntry{stored: now}
+	if err := e.msg.Unpack(res); err != nil {
+		return false
+	}
+	h := e.msg.Header
+	if !h.Response || h.Truncated || len(e.msg.Questions) != 1 ||
+		!strings.EqualFold(e.msg.Questions[0].Name.String(), q.Name.String()) ||
+		e.msg.Questions[0].Type != q.Type || e.msg.Questions[0].Class != q.Class {
+		return false
+	}
+	ttl, ok := cacheTTL(&e.msg)
+	if !ok || ttl == 0 {
+		return false
+	}
+	e.negative = h.RCode == dns.RCodeNameError || len(e.msg.Answers) == 0
+	e.expires = now.Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Set(k, e)
+	metricDNSCacheEntries.Set(int64(c.entries.Len()))
+	return true
+}
+
+// cacheTTL returns how long msg may be cached for, reporting whether it
+// may be cached at all.
+func cacheTTL(msg *dns.Message) (_ time.Duration, ok bool) {
+	switch msg.Header.RCode {
+	case dns.RCodeSuccess:
+		if len(msg.Answers) > 0 {
+			ttl, ok := minTTL(msg)
+			return min(ttl, maxCacheTTL), ok
+		}
+		// NODATA; negative.
+	case dns.RCodeNameError:
+		// Negative.
+	default:
+		return 0, false
+	}
+
+	// Per RFC 2308, section 5, negative responses are cached for the
+	// lesser of the TTL of the SOA record in the authority section and its
+	// MINIMUM field. Those without an SOA record aren't cached.
+	for _, rr := range msg.Authorities {
+		if soa, ok := rr.Body.(*dns.SOAResource); ok {
+			ttl := time.Duration(min(rr.Header.TTL, soa.MinTTL)) * time.Second
+			return min(ttl, maxNegativeCacheTTL), true
+		}
+	}
+	return 0, false
+}
+
+// minTTL returns the smallest TTL of the records in msg, other than OPT
+// records.
+func minTTL(msg *dns.Message) (_ time.Duration, ok bool) {
+	var ttl uint32
+	for _, rrs := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range rrs {
+			if rr.Header.Type == dns.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header.TTL < ttl {
+				ttl, ok = rr.Header.TTL, true
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second, ok
+}
+
+// flush removes all cached responses.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Clear()
+	metricDNSCacheFlush.Add(1)
+	metricDNSCacheEntries.Set(0)
+}
+
+// len returns the number of cached responses, including expired ones.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+// routesEqual reports whether the DNS routes a and b are equal.
+func routesEqual(a, b map[dnsname.FQDN][]*dnstype.Resolver) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for suffix, ra := range a {
+		rb, ok := b[suffix]
+		if !ok || !slices.EqualFunc(ra, rb, (*dnstype.Resolver).Equal) {
+			return false
+		}
+	}
+	return true
+}
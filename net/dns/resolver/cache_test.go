@@ -0,0 +1,299 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tstest"
+	"tailscale.com/tstime"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// makeCacheTestResponse returns a response for domain with the given
+// status code, an A record with answerTTL if answerTTL is non-negative, and
+// an SOA record with soaTTL and soaMinTTL if soaTTL is non-negative.
+func makeCacheTestResponse(tb testing.TB, domain string, code dns.RCode, answerTTL, soaTTL int, soaMinTTL uint32) []byte {
+	tb.Helper()
+	name := dns.MustNewName(domain)
+	b := dns.NewBuilder(nil, dns.Header{Response: true, RCode: code})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: name, Type: dns.TypeA, Class: dns.ClassINET})
+	if answerTTL >= 0 {
+		b.StartAnswers()
+		b.AResource(dns.ResourceHeader{Name: name, Class: dns.ClassINET, TTL: uint32(answerTTL)}, dns.AResource{A: [4]byte{1, 2, 3, 4}})
+	}
+	if soaTTL >= 0 {
+		b.StartAuthorities()
+		b.SOAResource(dns.ResourceHeader{Name: dns.MustNewName("example.com."), Class: dns.ClassINET, TTL: uint32(soaTTL)}, dns.SOAResource{
+			NS:     dns.MustNewName("ns.example.com."),
+			MBox:   dns.MustNewName("hostmaster.example.com."),
+			MinTTL: soaMinTTL,
+		})
+	}
+	res, err := b.Finish()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return res
+}
+
+// cachedTTLs returns the ID, question name and the TTLs of the records of
+// the response res.
+func cachedTTLs(tb testing.TB, res []byte) (id uint16, name string, ttls []uint32) {
+	tb.Helper()
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		tb.Fatal(err)
+	}
+	for _, rr := range append(msg.Answers, msg.Authorities...) {
+		ttls = append(ttls, rr.Header.TTL)
+	}
+	return msg.Header.ID, msg.Questions[0].Name.String(), ttls
+}
+
+func TestResponseCache(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	query := makeTestRequestWithID(t, "host.example.com.", 1)
+
+	c := newResponseCache()
+	if !c.set(query, makeCacheTestResponse(t, "host.example.com.", dns.RCodeSuccess, 120, -1, 0), t0) {
+		t.Fatal("response not cached")
+	}
+
+	// The cached response gets the query's ID and case, and its TTLs are
+	// reduced by its age.
+	res, negative, ok := c.get(makeTestRequestWithID(t, "HOST.example.com.", 2), t0.Add(30*time.Second), false)
+	if !ok || negative {
+		t.Fatalf("get = %v, %v; want positive hit", ok, negative)
+	}
+	id, name, ttls := cachedTTLs(t, res)
+	if id != 2 || name != "HOST.example.com." || len(ttls) != 1 || ttls[0] != 90 {
+		t.Errorf("got ID %d, name %q, TTLs %v; want 2, %q, [90]", id, name, ttls, "HOST.example.com.")
+	}
+
+	// Expired responses are only served when asked for stale ones, with
+	// the stale TTL, and only for a while.
+	expired := t0.Add(121 * time.Second)
+	if _, _, ok := c.get(query, expired, false); ok {
+		t.Error("got expired response")
+	}
+	res, _, ok = c.get(query, expired, true)
+	if !ok {
+		t.Fatal("didn't get stale response")
+	}
+	if _, _, ttls := cachedTTLs(t, res); ttls[0] != uint32(staleTTL/time.Second) {
+		t.Errorf("stale TTL = %d, want %v", ttls[0], staleTTL)
+	}
+	if _, _, ok := c.get(query, expired.Add(maxStaleAge), true); ok {
+		t.Error("got response past maxStaleAge")
+	}
+
+	c.flush()
+	if _, _, ok := c.get(query, t0, false); ok || c.len() != 0 {
+		t.Error("got response after flush")
+	}
+}
+
+func TestResponseCacheTTLs(t *testing.T) {
+	tests := []struct {
+		name         string
+		res          []byte
+		wantCached   bool
+		wantNegative bool
+		wantTTL      time.Duration
+	}{
+		{
+			name:       "positive",
+			res:        makeCacheTestResponse(t, "a.example.com.", dns.RCodeSuccess, 300, -1, 0),
+			wantCached: true,
+			wantTTL:    300 * time.Second,
+		},
+		{
+			name:       "positive-min-ttl",
+			res:        makeCacheTestResponse(t, "a.example.com.", dns.RCodeSuccess, 300, 100, 600),
+			wantCached: true,
+			wantTTL:    100 * time.Second,
+		},
+		{
+			name:       "positive-capped",
+			res:        makeCacheTestResponse(t, "a.example.com.", dns.RCodeSuccess, 86400, -1, 0),
+			wantCached: true,
+			wantTTL:    maxCacheTTL,
+		},
+		{
+			name: "zero-ttl",
+			res:  makeCacheTestResponse(t, "a.example.com.", dns.RCodeSuccess, 0, -1, 0),
+		},
+		{
+			name:         "nxdomain-soa-minimum",
+			res:          makeCacheTestResponse(t, "a.example.com.", dns.RCodeNameError, -1, 600, 60),
+			wantCached:   true,
+			wantNegative: true,
+			wantTTL:      60 * time.Second,
+		},
+		{
+			name:         "nodata-soa-ttl",
+			res:          makeCacheTestResponse(t, "a.example.com.", dns.RCodeSuccess, -1, 30, 60),
+			wantCached:   true,
+			wantNegative: true,
+			wantTTL:      30 * time.Second,
+		},
+		{
+			name:         "nxdomain-capped",
+			res:          makeCacheTestResponse(t, "a.example.com.", dns.RCodeNameError, -1, 86400, 86400),
+			wantCached:   true,
+			wantNegative: true,
+			wantTTL:      maxNegativeCacheTTL,
+		},
+		{
+			name: "nxdomain-no-soa",
+			res:  makeCacheTestResponse(t, "a.example.com.", dns.RCodeNameError, -1, -1, 0),
+		},
+		{
+			name: "servfail",
+			res:  makeCacheTestResponse(t, "a.example.com.", dns.RCodeServerFailure, -1, 600, 60),
+		},
+		{
+			name: "other-question",
+			res:  makeCacheTestResponse(t, "b.example.com.", dns.RCodeSuccess, 300, -1, 0),
+		},
+	}
+	t0 := time.Unix(1700000000, 0)
+	query := makeTestRequest(t, "a.example.com.")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newResponseCache()
+			if got := c.set(query, tt.res, t0); got != tt.wantCached {
+				t.Fatalf("set = %v, want %v", got, tt.wantCached)
+			}
+			if !tt.wantCached {
+				return
+			}
+			_, negative, ok := c.get(query, t0.Add(tt.wantTTL-time.Second), false)
+			if !ok || negative != tt.wantNegative {
+				t.Errorf("before expiry: get = %v, negative %v; want hit, negative %v", ok, negative, tt.wantNegative)
+			}
+			if _, _, ok := c.get(query, t0.Add(tt.wantTTL), false); ok {
+				t.Error("got response at expiry")
+			}
+		})
+	}
+}
+
+func TestResponseCacheTruncated(t *testing.T) {
+	res := makeCacheTestResponse(t, "a.example.com.", dns.RCodeSuccess, 300, -1, 0)
+	res[2] |= 0x02 // TC bit
+	c := newResponseCache()
+	if c.set(makeTestRequest(t, "a.example.com."), res, time.Now()) {
+		t.Error("truncated response cached")
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	var requests atomic.Int32
+	port := runDNSServer(t, nil, makeCacheTestResponse(t, "host.example.com.", dns.RCodeSuccess, 300, -1, 0), func(isTCP bool, req []byte) {
+		requests.Add(1)
+	})
+	upstream := &dnstype.Resolver{Addr: fmt.Sprintf("127.0.0.1:%d", port)}
+
+	r := newResolver(t)
+	defer r.Close()
+	if r.cache == nil {
+		t.Skip("cache disabled")
+	}
+	setRoutes := func(routes map[dnsname.FQDN][]*dnstype.Resolver) {
+		t.Helper()
+		if err := r.SetConfig(Config{Routes: routes}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query := func() {
+		t.Helper()
+		res, err := r.Query(context.Background(), makeTestRequest(t, "host.example.com."), "udp", netip.MustParseAddrPort("127.0.0.1:1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rcode := getRCode(res); rcode != dns.RCodeSuccess {
+			t.Fatalf("rcode = %v", rcode)
+		}
+	}
+	wantRequests := func(want int32) {
+		t.Helper()
+		if got := requests.Load(); got != want {
+			t.Errorf("upstream got %d requests, want %d", got, want)
+		}
+	}
+
+	setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{".": {upstream}})
+	query()
+	query()
+	wantRequests(1)
+
+	// Equal routes keep the cache.
+	setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{".": {{Addr: upstream.Addr}}})
+	query()
+	wantRequests(1)
+
+	// Changed routes flush it.
+	setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		".":            {upstream},
+		"example.org.": {upstream},
+	})
+	query()
+	wantRequests(2)
+
+	r.FlushCache()
+	query()
+	wantRequests(3)
+}
+
+func TestResolverCacheServeStale(t *testing.T) {
+	port := runDNSServer(t, nil, makeCacheTestResponse(t, "host.example.com.", dns.RCodeServerFailure, -1, -1, 0), func(bool, []byte) {})
+
+	r := newResolver(t)
+	defer r.Close()
+	if r.cache == nil {
+		t.Skip("cache disabled")
+	}
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	r.clock = tstime.DefaultClock{Clock: clock}
+	if err := r.SetConfig(Config{Routes: map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: fmt.Sprintf("127.0.0.1:%d", port)}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := makeTestRequest(t, "host.example.com.")
+	r.cache.set(req, makeCacheTestResponse(t, "host.example.com.", dns.RCodeSuccess, 60, -1, 0), clock.Now())
+	clock.Advance(2 * time.Minute)
+
+	res, err := r.Query(context.Background(), req, "udp", netip.MustParseAddrPort("127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode := getRCode(res); rcode != dns.RCodeSuccess {
+		t.Fatalf("rcode = %v, want stale success", rcode)
+	}
+	if _, _, ttls := cachedTTLs(t, res); len(ttls) != 1 || ttls[0] != uint32(staleTTL/time.Second) {
+		t.Errorf("TTLs = %v, want [%d]", ttls, staleTTL/time.Second)
+	}
+
+	// Past maxStaleAge, the upstream's failure is returned.
+	clock.Advance(maxStaleAge)
+	res, err = r.Query(context.Background(), req, "udp", netip.MustParseAddrPort("127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode := getRCode(res); rcode != dns.RCodeServerFailure {
+		t.Errorf("rcode = %v, want SERVFAIL", rcode)
+	}
+}
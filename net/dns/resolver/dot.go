@@ -0,0 +1,511 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/health"
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/sockstats"
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// dotDefaultPort is the port of DNS-over-TLS servers (RFC 7858).
+	dotDefaultPort = "853"
+
+	// dotIdleConnTimeout is how long to keep idle connections to
+	// DNS-over-TLS servers open, for the same reasons as
+	// dohIdleConnTimeout.
+	dotIdleConnTimeout = dohIdleConnTimeout
+
+	// dotQueryTimeout is the timeout for a DNS-over-TLS query, including
+	// connecting to the server if needed. It matches the time DoH queries
+	// are given to respond.
+	dotQueryTimeout = 10 * time.Second
+
+	// dotMaxInFlight is the maximum number of queries pipelined on a
+	// single DNS-over-TLS connection.
+	dotMaxInFlight = 1024
+)
+
+// dnsTLSHandshakeFailing is raised when the TLS handshake with any
+// DNS-over-TLS upstream fails, such as due to an invalid certificate.
+// It's cleared once handshakes with all of them succeed again, or they're
+// no longer configured.
+var dnsTLSHandshakeFailing = health.Register(&health.Warnable{
+	Code:      "dns-tls-handshake-failing",
+	Title:     "DNS-over-TLS unavailable",
+	Severity:  health.SeverityMedium,
+	DependsOn: []*health.Warnable{health.NetworkStatusWarnable},
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("Tailscale can't establish a secure connection to the DNS-over-TLS servers %s: %s", args[health.ArgDNSServers], args[health.ArgError])
+	},
+	ImpactsConnectivity: true,
+	TimeToVisible:       15 * time.Second,
+})
+
+// errDoTConnBroken is returned for queries on a DNS-over-TLS connection
+// that failed or was closed before their response was read.
+var errDoTConnBroken = errors.New("DNS-over-TLS connection broken")
+
+// dotClient is a client for a DNS-over-TLS upstream ("tls://host[:port]"),
+// which pipelines queries on a single connection that's reused until it's
+// idle for dotIdleConnTimeout.
+type dotClient struct {
+	f         *forwarder
+	addr      string // the resolver's Addr, like "tls://dns.example.com"
+	host      string // for SNI and certificate verification
+	port      string
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex // held while dialing, to share one connection
+	conn   *dotConn   // or nil
+	closed bool
+}
+
+// dotConn is a DNS-over-TLS connection. To pipeline queries, each query's
+// DNS ID is rewritten to one that's unique on the connection, and restored
+// in its response.
+type dotConn struct {
+	c  *dotClient
+	tc *tls.Conn
+
+	wmu sync.Mutex // serializes writes to tc
+
+	mu        sync.Mutex
+	pending   map[uint16]chan<- []byte // by rewritten DNS ID
+	nextID    uint16
+	err       error // non-nil once broken
+	idleTimer *time.Timer
+}
+
+// dotClientKey returns the key of the dotClient for r in forwarder.dotClients.
+func dotClientKey(r *dnstype.Resolver) string {
+	var sb strings.Builder
+	sb.WriteString(r.Addr)
+	for _, ip := range r.BootstrapResolution {
+		sb.WriteByte(' ')
+		sb.WriteString(ip.String())
+	}
+	return sb.String()
+}
+
+// getDoTClient returns the client for the DNS-over-TLS resolver r,
+// creating it if needed.
+func (f *forwarder) getDoTClient(r *dnstype.Resolver) (*dotClient, error) {
+	key := dotClientKey(r)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.dotClients[key]; ok {
+		return c, nil
+	}
+	c, err := f.newDoTClient(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.dotClients == nil {
+		f.dotClients = make(map[string]*dotClient)
+	}
+	f.dotClients[key] = c
+	return c, nil
+}
+
+// parseDoTResolver parses the Addr of the DNS-over-TLS resolver r, and
+// returns the IPs to dial it at.
+//
+// The host must be an IP address or have BootstrapResolution IPs: it's not
+// looked up with the system resolver, which can be MagicDNS itself.
+func parseDoTResolver(r *dnstype.Resolver) (*url.URL, []netip.Addr, error) {
+	u, err := url.Parse(r.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "tls" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return nil, nil, fmt.Errorf("invalid DNS-over-TLS resolver %q; want tls://host[:port]", r.Addr)
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return u, []netip.Addr{ip}, nil
+	}
+	if len(r.BootstrapResolution) == 0 {
+		return nil, nil, fmt.Errorf("DNS-over-TLS resolver %q has no BootstrapResolution IPs", r.Addr)
+	}
+	return u, r.BootstrapResolution, nil
+}
+
+// checkDoTResolvers reports an error for each DNS-over-TLS resolver in
+// routes that parseDoTResolver rejects.
+func checkDoTResolvers(routes map[dnsname.FQDN][]*dnstype.Resolver) error {
+	var errs []error
+	for _, rs := range routes {
+		for _, r := range rs {
+			if !strings.HasPrefix(r.Addr, "tls://") {
+				continue
+			}
+			if _, _, err := parseDoTResolver(r); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *forwarder) newDoTClient(r *dnstype.Resolver) (*dotClient, error) {
+	u, ips, err := parseDoTResolver(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &dotClient{
+		f:    f,
+		addr: r.Addr,
+		host: u.Hostname(),
+		port: u.Port(),
+	}
+	if c.port == "" {
+		c.port = dotDefaultPort
+	}
+
+	// Dial the host's IPs, racing them.
+	c.dial = dnscache.Dialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return f.getDialerType()(ctx, network, address)
+	}, &dnscache.Resolver{
+		SingleHost:             c.host,
+		SingleHostStaticResult: ips,
+		Logf:                   f.logf,
+	})
+
+	base := &tls.Config{
+		ServerName: c.host,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"dot"},
+	}
+	if f.dotRootCAs != nil {
+		base.RootCAs = f.dotRootCAs
+		c.tlsConfig = base
+		return c, nil
+	}
+	c.tlsConfig = tlsdial.Config(f.health, base)
+	// crypto/tls doesn't report a ServerName for IP addresses, as they're
+	// not sent in SNI. Verify those against the certificate's IP SANs,
+	// rather than skipping the name check.
+	verify := c.tlsConfig.VerifyConnection
+	c.tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate")
+		}
+		cs.ServerName = c.host
+		return verify(cs)
+	}
+	return c, nil
+}
+
+// closeDoTClients closes the DNS-over-TLS clients whose keys aren't in
+// keep (or all of them, if keep is nil), and forgets their handshake errors.
+func (f *forwarder) closeDoTClients(keep map[string]bool) {
+	var closing []*dotClient
+	f.mu.Lock()
+	for key, c := range f.dotClients {
+		if keep[key] {
+			continue
+		}
+		delete(f.dotClients, key)
+		closing = append(closing, c)
+		if _, ok := f.dotHandshakeErr[c.addr]; ok {
+			delete(f.dotHandshakeErr, c.addr)
+			f.updateDoTHealthLocked()
+		}
+	}
+	f.mu.Unlock()
+
+	for _, c := range closing {
+		c.close()
+	}
+}
+
+// setDoTHandshakeErr records the result of a TLS handshake with the
+// DNS-over-TLS resolver addr, updating the health warning as needed.
+func (f *forwarder) setDoTHandshakeErr(addr string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, had := f.dotHandshakeErr[addr]
+	switch {
+	case err != nil:
+		if f.dotHandshakeErr == nil {
+			f.dotHandshakeErr = make(map[string]error)
+		}
+		f.dotHandshakeErr[addr] = err
+	case had:
+		delete(f.dotHandshakeErr, addr)
+	default:
+		return
+	}
+	f.updateDoTHealthLocked()
+}
+
+func (f *forwarder) updateDoTHealthLocked() {
+	if len(f.dotHandshakeErr) == 0 {
+		f.health.SetHealthy(dnsTLSHandshakeFailing)
+		return
+	}
+	addrs := slices.Sorted(maps.Keys(f.dotHandshakeErr))
+	f.health.SetUnhealthy(dnsTLSHandshakeFailing, health.Args{
+		health.ArgDNSServers: strings.Join(addrs, ","),
+		health.ArgError:      f.dotHandshakeErr[addrs[0]].Error(),
+	})
+}
+
+// sendDoT sends the query in fq to the DNS-over-TLS resolver rr.
+func (f *forwarder) sendDoT(ctx context.Context, fq *forwardQuery, rr resolverAndDelay) ([]byte, error) {
+	metricDNSFwdDoT.Add(1)
+	c, err := f.getDoTClient(rr.name)
+	if err != nil {
+		metricDNSFwdErrorType.Add(1)
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dotQueryTimeout)
+	defer cancel()
+
+	res, err := c.exchange(ctx, fq.packet)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	if truncatedFlagSet(res) {
+		metricDNSFwdTruncated.Add(1)
+	}
+	// Don't forward transient errors back to the client when the server
+	// fails, as for other transports.
+	if getRCode(res) == dns.RCodeServerFailure {
+		metricDNSFwdDoTErrorServer.Add(1)
+		return nil, errServerFailure
+	}
+	metricDNSFwdDoTSuccess.Add(1)
+	return res, nil
+}
+
+// exchange sends the DNS query packet and returns the response.
+func (c *dotClient) exchange(ctx context.Context, packet []byte) ([]byte, error) {
+	if len(packet) < headerBytes || len(packet) > 0xffff {
+		return nil, fmt.Errorf("invalid DNS query length %d", len(packet))
+	}
+	for attempt := 0; ; attempt++ {
+		dc, reused, err := c.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, err := dc.roundTrip(ctx, packet)
+		if err != nil && reused && attempt == 0 && errors.Is(err, errDoTConnBroken) && ctx.Err() == nil {
+			// Servers may close idle connections at any time (RFC 7766,
+			// section 6.2.3), so retry once on a new connection, as
+			// net/http does.
+			metricDNSFwdDoTRetry.Add(1)
+			continue
+		}
+		return res, err
+	}
+}
+
+// getConn returns the current connection, dialing one if needed.
+// It reports whether the connection was reused.
+func (c *dotClient) getConn(ctx context.Context) (_ *dotConn, reused bool, _ error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, false, net.ErrClosed
+	}
+	if c.conn != nil && c.conn.usable() {
+		return c.conn, true, nil
+	}
+	c.conn = nil
+
+	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDNSForwarderDoT, c.f.logf)
+	conn, err := c.dial(ctx, "tcp", net.JoinHostPort(c.host, c.port))
+	if err != nil {
+		metricDNSFwdDoTErrorDial.Add(1)
+		return nil, false, err
+	}
+	tc := tls.Client(conn, c.tlsConfig)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		if ctx.Err() == nil {
+			metricDNSFwdDoTErrorHandshake.Add(1)
+			c.f.logf("DNS-over-TLS handshake with %s: %v", c.addr, err)
+			c.f.setDoTHandshakeErr(c.addr, err)
+		}
+		return nil, false, err
+	}
+	c.f.setDoTHandshakeErr(c.addr, nil)
+	metricDNSFwdDoTConns.Add(1)
+
+	dc := &dotConn{
+		c:       c,
+		tc:      tc,
+		pending: make(map[uint16]chan<- []byte),
+	}
+	dc.idleTimer = time.AfterFunc(dotIdleConnTimeout, dc.closeIfIdle)
+	go dc.readLoop()
+	c.conn = dc
+	return dc, false, nil
+}
+
+func (c *dotClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.fail(net.ErrClosed)
+		c.conn = nil
+	}
+}
+
+func (dc *dotConn) usable() bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.err == nil && len(dc.pending) < dotMaxInFlight
+}
+
+// roundTrip sends packet on dc and waits for its response.
+func (dc *dotConn) roundTrip(ctx context.Context, packet []byte) ([]byte, error) {
+	resc := make(chan []byte, 1)
+	dc.mu.Lock()
+	if dc.err != nil {
+		err := dc.err
+		dc.mu.Unlock()
+		return nil, err
+	}
+	id := dc.nextID
+	for dc.pending[id] != nil {
+		id++
+	}
+	dc.nextID = id + 1
+	dc.pending[id] = resc
+	dc.idleTimer.Stop()
+	dc.mu.Unlock()
+	defer dc.forget(id, resc)
+
+	msg := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(msg, uint16(len(packet)))
+	copy(msg[2:], packet)
+	binary.BigEndian.PutUint16(msg[2:], id)
+
+	dc.wmu.Lock()
+	deadline, _ := ctx.Deadline()
+	dc.tc.SetWriteDeadline(deadline)
+	_, err := dc.tc.Write(msg)
+	dc.wmu.Unlock()
+	if err != nil {
+		metricDNSFwdDoTErrorWrite.Add(1)
+		dc.fail(err)
+		return nil, fmt.Errorf("%w: %w", errDoTConnBroken, err)
+	}
+
+	select {
+	case res, ok := <-resc:
+		if !ok {
+			dc.mu.Lock()
+			err := dc.err
+			dc.mu.Unlock()
+			return nil, err
+		}
+		copy(res[:2], packet[:2]) // restore the query's DNS ID
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// forget removes the pending query with the given rewritten ID and
+// response channel, if it's still pending, and starts the idle timer if
+// there are no more.
+func (dc *dotConn) forget(id uint16, resc chan<- []byte) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.pending[id] == resc {
+		delete(dc.pending, id)
+	}
+	if len(dc.pending) == 0 && dc.err == nil {
+		dc.idleTimer.Reset(dotIdleConnTimeout)
+	}
+}
+
+func (dc *dotConn) closeIfIdle() {
+	dc.mu.Lock()
+	idle := len(dc.pending) == 0
+	dc.mu.Unlock()
+	if idle {
+		dc.fail(errors.New("idle"))
+	}
+}
+
+// readLoop reads responses from dc until it fails, delivering them to the
+// pending queries.
+func (dc *dotConn) readLoop() {
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(dc.tc, hdr[:]); err != nil {
+			dc.fail(err)
+			return
+		}
+		res := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(dc.tc, res); err != nil {
+			metricDNSFwdDoTErrorRead.Add(1)
+			dc.fail(err)
+			return
+		}
+		if len(res) < headerBytes {
+			metricDNSFwdDoTErrorRead.Add(1)
+			dc.fail(fmt.Errorf("short response (%d bytes)", len(res)))
+			return
+		}
+		id := binary.BigEndian.Uint16(res)
+		dc.mu.Lock()
+		resc := dc.pending[id]
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+		if resc == nil {
+			// Its query timed out or was canceled, or the server's
+			// confused.
+			metricDNSFwdDoTErrorTxID.Add(1)
+			continue
+		}
+		resc <- res
+	}
+}
+
+// fail marks dc as broken due to err, if it isn't already, closing it and
+// failing any pending queries.
+func (dc *dotConn) fail(err error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.err != nil {
+		return
+	}
+	dc.err = fmt.Errorf("%w: %w", errDoTConnBroken, err)
+	dc.idleTimer.Stop()
+	dc.tc.Close()
+	for id, resc := range dc.pending {
+		close(resc)
+		delete(dc.pending, id)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/health"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/tstest"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/eventbus/eventbustest"
+)
+
+// testDoTCert returns a self-signed certificate for "dot.test" and
+// 127.0.0.1, and a pool containing it.
+func testDoTCert(t testing.TB) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dot.test"},
+		DNSNames:              []string{"dot.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// testDoTServer is a DNS-over-TLS server that answers each query with an
+// A record, after a delay of a few milliseconds so that pipelined queries
+// are answered out of order.
+type testDoTServer struct {
+	port  uint16
+	pool  *x509.CertPool
+	conns atomic.Int32
+
+	// closeAfterResponse is whether to close each connection after its
+	// first response.
+	closeAfterResponse bool
+}
+
+func runDoTServer(t testing.TB, closeAfterResponse bool) *testDoTServer {
+	cert, pool := testDoTCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &testDoTServer{
+		port:               uint16(ln.Addr().(*net.TCPAddr).Port),
+		pool:               pool,
+		closeAfterResponse: closeAfterResponse,
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serveConn(t, c)
+		}
+	}()
+	return s
+}
+
+func (s *testDoTServer) serveConn(t testing.TB, c net.Conn) {
+	defer c.Close()
+	var wmu sync.Mutex
+	for i := 0; ; i++ {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c, hdr[:]); err != nil {
+			return
+		}
+		q := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(c, q); err != nil {
+			return
+		}
+		var p dns.Parser
+		h, err := p.Start(q)
+		if err != nil {
+			t.Errorf("parsing query: %v", err)
+			return
+		}
+		question, err := p.Question()
+		if err != nil {
+			t.Errorf("parsing question: %v", err)
+			return
+		}
+		res := makeTestResponse(t, question.Name.String(), dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1"))
+		binary.BigEndian.PutUint16(res, h.ID)
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(res)))
+		msg = append(msg, res...)
+
+		if s.closeAfterResponse {
+			c.Write(msg)
+			return
+		}
+		go func() {
+			time.Sleep(time.Duration(5-i%5) * time.Millisecond)
+			wmu.Lock()
+			defer wmu.Unlock()
+			c.Write(msg)
+		}()
+	}
+}
+
+func newDoTTestForwarder(t testing.TB, roots *x509.CertPool) *forwarder {
+	logf := tstest.WhileTestRunningLogger(t)
+	bus := eventbustest.NewBus(t)
+	netMon, err := netmon.New(bus, logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialer tsdial.Dialer
+	dialer.SetNetMon(netMon)
+	dialer.SetBus(bus)
+	f := newForwarder(logf, netMon, nil, &dialer, health.NewTracker(bus), nil)
+	f.dotRootCAs = roots
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// makeTestRequestWithID returns a new TypeA request for domain with the
+// given DNS ID.
+func makeTestRequestWithID(t testing.TB, domain string, id uint16) []byte {
+	req := makeTestRequest(t, domain)
+	binary.BigEndian.PutUint16(req, id)
+	return req
+}
+
+func sendTestDoT(f *forwarder, r *dnstype.Resolver, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fq := &forwardQuery{
+		txid:           getTxID(req),
+		packet:         req,
+		family:         "udp",
+		closeOnCtxDone: new(closePool),
+	}
+	defer fq.closeOnCtxDone.Close()
+	return f.send(ctx, fq, resolverAndDelay{name: r})
+}
+
+func TestDoT(t *testing.T) {
+	s := runDoTServer(t, false)
+	f := newDoTTestForwarder(t, s.pool)
+	r := &dnstype.Resolver{Addr: fmt.Sprintf("tls://127.0.0.1:%d", s.port)}
+
+	// Send concurrent queries, some with the same DNS ID, which must be
+	// pipelined on one connection, and get their own responses.
+	const n = 20
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			domain := fmt.Sprintf("host%d.example.com.", i)
+			id := uint16(i % 3)
+			res, err := sendTestDoT(f, r, makeTestRequestWithID(t, domain, id))
+			if err != nil {
+				t.Errorf("query %d: %v", i, err)
+				return
+			}
+			var p dns.Parser
+			h, err := p.Start(res)
+			if err != nil {
+				t.Errorf("query %d: parsing response: %v", i, err)
+				return
+			}
+			if h.ID != id {
+				t.Errorf("query %d: response ID = %d, want %d", i, h.ID, id)
+			}
+			q, err := p.Question()
+			if err != nil {
+				t.Errorf("query %d: parsing question: %v", i, err)
+				return
+			}
+			if got := q.Name.String(); got != domain {
+				t.Errorf("query %d: response for %q, want %q", i, got, domain)
+			}
+		})
+	}
+	wg.Wait()
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("got %d connections, want 1", got)
+	}
+
+	// The connection is reused for later queries too.
+	if _, err := sendTestDoT(f, r, makeTestRequest(t, "again.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("got %d connections, want 1", got)
+	}
+}
+
+func TestDoTBootstrapResolution(t *testing.T) {
+	s := runDoTServer(t, false)
+	f := newDoTTestForwarder(t, s.pool)
+	r := &dnstype.Resolver{
+		Addr:                fmt.Sprintf("tls://dot.test:%d", s.port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}
+	if _, err := sendTestDoT(f, r, makeTestRequest(t, "example.com.")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDoTReconnect(t *testing.T) {
+	s := runDoTServer(t, true)
+	f := newDoTTestForwarder(t, s.pool)
+	r := &dnstype.Resolver{Addr: fmt.Sprintf("tls://127.0.0.1:%d", s.port)}
+	for i := range 3 {
+		if _, err := sendTestDoT(f, r, makeTestRequest(t, "example.com.")); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if got := s.conns.Load(); got != 3 {
+		t.Errorf("got %d connections, want 3", got)
+	}
+}
+
+func TestDoTHandshakeFailure(t *testing.T) {
+	s := runDoTServer(t, false)
+	_, otherRoots := testDoTCert(t)
+	f := newDoTTestForwarder(t, otherRoots)
+	r := &dnstype.Resolver{Addr: fmt.Sprintf("tls://127.0.0.1:%d", s.port)}
+	if _, err := sendTestDoT(f, r, makeTestRequest(t, "example.com.")); err == nil {
+		t.Fatal("query succeeded with an untrusted certificate")
+	}
+	if !f.health.IsUnhealthy(dnsTLSHandshakeFailing) {
+		t.Error("handshake failure not reported to health")
+	}
+
+	// Removing the resolver clears the warning.
+	f.setRoutes(nil)
+	if f.health.IsUnhealthy(dnsTLSHandshakeFailing) {
+		t.Error("handshake failure still reported after removing resolver")
+	}
+}
+
+func TestDoTInvalidAddr(t *testing.T) {
+	f := newDoTTestForwarder(t, nil)
+	for _, addr := range []string{"tls://", "tls://dns.example.com/path", "tls://user@dns.example.com", "tls://dns.example.com"} {
+		if _, err := sendTestDoT(f, &dnstype.Resolver{Addr: addr}, makeTestRequest(t, "example.com.")); err == nil {
+			t.Errorf("%q: unexpected success", addr)
+		}
+	}
+}
+
+func TestSetConfigDoTWithoutBootstrap(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	cfg := Config{Routes: map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: "tls://dns.example.com"}},
+	}}
+	if err := r.SetConfig(cfg); err == nil {
+		t.Error("SetConfig accepted a DNS-over-TLS hostname without BootstrapResolution")
+	}
+	cfg.Routes["."][0].BootstrapResolution = []netip.Addr{netip.MustParseAddr("192.0.2.1")}
+	if err := r.SetConfig(cfg); err != nil {
+		t.Errorf("SetConfig with BootstrapResolution: %v", err)
+	}
+	cfg.Routes["."] = []*dnstype.Resolver{{Addr: "tls://192.0.2.1"}}
+	if err := r.SetConfig(cfg); err != nil {
+		t.Errorf("SetConfig with an IP address: %v", err)
+	}
+}
@@ -8,6 +8,7 @@
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -235,6 +236,16 @@ type forwarder struct {
 
 	dohClient map[string]*http.Client // urlBase -> client
 
+	// dotClients are the clients of DNS-over-TLS resolvers, keyed by
+	// dotClientKey. Those no longer configured are closed by setRoutes.
+	dotClients map[string]*dotClient
+	// dotHandshakeErr is the last TLS handshake error of each
+	// DNS-over-TLS resolver, by its Addr, while it's failing.
+	dotHandshakeErr map[string]error
+	// dotRootCAs, if non-nil, are the roots that DNS-over-TLS servers are
+	// verified against instead of using tlsdial, for tests.
+	dotRootCAs *x509.CertPool
+
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
 	routes []route
@@ -272,6 +283,7 @@ func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkS
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	f.closeDoTClients(nil)
 	return nil
 }
 
@@ -392,9 +404,21 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 	})
 
 	f.mu.Lock()
-	defer f.mu.Unlock()
 	f.routes = routes
 	f.cloudHostFallback = cloudHostFallback
+	f.mu.Unlock()
+
+	// Close the connections to any DNS-over-TLS resolvers that are no
+	// longer in use.
+	keepDoT := map[string]bool{}
+	for _, rs := range routesBySuffix {
+		for _, r := range rs {
+			if strings.HasPrefix(r.Addr, "tls://") {
+				keepDoT[dotClientKey(r)] = true
+			}
+		}
+	}
+	f.closeDoTClients(keepDoT)
 }
 
 var stdNetPacketListener nettype.PacketListenerWithNetIP = nettype.MakePacketListenerWithNetIP(new(net.ListenConfig))
@@ -551,8 +575,7 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 		return nil, fmt.Errorf("arbitrary https:// resolvers not supported yet")
 	}
 	if strings.HasPrefix(rr.name.Addr, "tls://") {
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("tls:// resolvers not supported yet")
+		return f.sendDoT(ctx, fq, rr)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -997,7 +1020,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 		f.logf("request(%d, %v, %d, %s) %d...", fq.txid, typ, len(domain), domainSig, len(fq.packet))
 	}
 
-	resc := make(chan []byte, 1) // it's fine buffered or not
+	resc := make(chan packet, 1) // it's fine buffered or not
 	errc := make(chan error, 1)  // it's fine buffered or not too
 	for i := range resolvers {
 		go func(rr *resolverAndDelay) {
@@ -1020,7 +1043,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- packet{bs: resb, upstream: rr.name.Addr}:
 			case <-ctx.Done():
 			}
 		}(&resolvers[i])
@@ -1035,9 +1058,9 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 			case <-ctx.Done():
 				metricDNSFwdErrorContext.Add(1)
 				return fmt.Errorf("waiting to send response: %w", ctx.Err())
-			case responseChan <- packet{v, query.family, query.addr}:
+			case responseChan <- packet{v.bs, query.family, query.addr, v.upstream}:
 				if f.verboseFwd {
-					f.logf("response(%d, %v, %d) = %d, nil", fq.txid, typ, len(domain), len(v))
+					f.logf("response(%d, %v, %d) = %d, nil", fq.txid, typ, len(domain), len(v.bs))
 				}
 				metricDNSFwdSuccess.Add(1)
 				f.health.SetHealthy(dnsForwarderFailing)
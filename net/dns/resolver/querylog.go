@@ -0,0 +1,390 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/feature"
+	"tailscale.com/feature/buildfeatures"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/eventbus"
+	"tailscale.com/util/lru"
+	"tailscale.com/version"
+)
+
+// QueryLogEntry is a DNS query answered by the Resolver, as logged when
+// query logging is enabled with SetQueryLog. It's also published on the
+// event bus given in QueryLogConfig.
+type QueryLogEntry struct {
+	Time time.Time      // when the query arrived
+	From netip.AddrPort // the client's address
+
+	// Node is the name of the Tailscale node at the From address,
+	// if known.
+	Node string `json:",omitempty"`
+
+	Name  string // the question name, lowercase and without a trailing dot
+	Type  string // the question type, like "AAAA"
+	RCode string `json:",omitempty"` // the response code, like "NameError"
+	Err   string `json:",omitempty"` // the error, if there was no response
+
+	// Upstream is the address of the upstream resolver that answered
+	// the query. It's empty if the query was answered locally or from
+	// the cache.
+	Upstream string `json:",omitempty"`
+	// Cached is whether the query was answered from the cache, including
+	// with a stale response.
+	Cached bool `json:",omitempty"`
+
+	Latency time.Duration
+}
+
+// QueryLogConfig configures query logging. See Resolver.SetQueryLog.
+//
+// While query logging is enabled, the resolver also keeps statistics of the
+// queries of each client, returned by Resolver.QueryStats, even with no
+// Path or Bus to log entries to.
+type QueryLogConfig struct {
+	// SampleRate is the fraction of queries to log, from 0 to 1.
+	// All queries are counted in the statistics regardless.
+	SampleRate float64
+
+	// Path, if non-empty, is the path of a file to append entries to,
+	// as lines of JSON. The file is rotated to <path>.1 once it's
+	// larger than 16MiB.
+	Path string
+
+	// Bus, if non-nil, is an event bus to publish entries on.
+	Bus *eventbus.Bus
+
+	// WhoIs, if non-nil, returns the name of the Tailscale node with the
+	// IP address ip, for the Node field of entries.
+	WhoIs func(ip netip.Addr) (node string, ok bool)
+}
+
+// maxQueryLogSize is the size after which a query log file is rotated.
+const maxQueryLogSize = 16 << 20
+
+// queryLogQueueSize is the number of sampled entries that can wait to be
+// logged. Entries beyond that are dropped, rather than slow down queries.
+const queryLogQueueSize = 256
+
+// queryLogger counts queries in its statistics, and logs sampled query log
+// entries to their destinations from a goroutine, so that resolving node
+// names and writing entries doesn't delay queries.
+type queryLogger struct {
+	logf       logger.Logf
+	sampleRate float64
+	whoIs      func(netip.Addr) (string, bool) // or nil
+	client     *eventbus.Client                // or nil
+	pub        *eventbus.Publisher[QueryLogEntry]
+	stats      queryStats
+
+	queue   chan *QueryLogEntry // sampled entries to log
+	closing chan struct{}       // closed by close to stop run
+	done    chan struct{}       // closed when run returns
+	dropped atomic.Int64        // entries dropped since the last report
+
+	// The following are only used by run.
+	path    string
+	f       *os.File // or nil
+	size    int64
+	failing bool // whether the last write failed
+}
+
+func newQueryLogger(logf logger.Logf, cfg QueryLogConfig) (*queryLogger, error) {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("query log sample rate %v is not between 0 and 1", cfg.SampleRate)
+	}
+	ql := &queryLogger{
+		logf:       logf,
+		sampleRate: cfg.SampleRate,
+		whoIs:      cfg.WhoIs,
+		path:       cfg.Path,
+		queue:      make(chan *QueryLogEntry, queryLogQueueSize),
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if ql.path != "" {
+		if err := ql.open(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Bus != nil {
+		ql.client = cfg.Bus.Client("dns.resolver.querylog")
+		ql.pub = eventbus.Publish[QueryLogEntry](ql.client)
+	}
+	go ql.run()
+	return ql, nil
+}
+
+func (ql *queryLogger) open() error {
+	f, err := os.OpenFile(ql.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ql.f, ql.size = f, fi.Size()
+	return nil
+}
+
+// log counts e in the statistics, and queues it to be logged if it's
+// sampled. It doesn't block.
+func (ql *queryLogger) log(e *QueryLogEntry) {
+	ql.stats.add(e.From.Addr(), e.Name, e.Time)
+	if ql.sampleRate < 1 && rand.Float64() >= ql.sampleRate {
+		return
+	}
+	select {
+	case ql.queue <- e:
+	default:
+		ql.dropped.Add(1)
+	}
+}
+
+// run logs queued entries until close is called, and then the entries
+// still queued.
+func (ql *queryLogger) run() {
+	defer close(ql.done)
+	for {
+		select {
+		case e := <-ql.queue:
+			ql.logEntry(e)
+		case <-ql.closing:
+			for {
+				select {
+				case e := <-ql.queue:
+					ql.logEntry(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// logEntry logs e to its destinations. It's only called by run.
+func (ql *queryLogger) logEntry(e *QueryLogEntry) {
+	if n := ql.dropped.Swap(0); n > 0 {
+		ql.logf("query log: dropped %d entries", n)
+	}
+	if ql.whoIs != nil {
+		e.Node, _ = ql.whoIs(e.From.Addr())
+	}
+	if ql.pub != nil {
+		ql.pub.Publish(*e)
+	}
+	if ql.path != "" {
+		err := ql.write(e)
+		if err != nil && !ql.failing {
+			ql.logf("writing query log: %v", err)
+		}
+		ql.failing = err != nil
+	}
+}
+
+func (ql *queryLogger) write(e *QueryLogEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if ql.f == nil {
+		return errors.New("closed")
+	}
+	if ql.size > 0 && ql.size+int64(len(b)) > maxQueryLogSize {
+		ql.f.Close()
+		ql.f = nil
+		err := os.Rename(ql.path, ql.path+".1")
+		if err := errors.Join(err, ql.open()); err != nil {
+			return err
+		}
+	}
+	n, err := ql.f.Write(b)
+	ql.size += int64(n)
+	return err
+}
+
+// close stops logging, after logging the entries still queued.
+func (ql *queryLogger) close() {
+	close(ql.closing)
+	<-ql.done
+	if ql.client != nil {
+		ql.client.Close()
+	}
+	if ql.f != nil {
+		ql.f.Close()
+		ql.f = nil
+	}
+}
+
+// SetQueryLog enables logging of the queries the resolver answers, both
+// its own and those of peers (see HandlePeerDNSQuery), as configured by
+// cfg. A nil cfg disables query logging, and discards the statistics.
+func (r *Resolver) SetQueryLog(cfg *QueryLogConfig) error {
+	if !buildfeatures.HasDNS {
+		return feature.ErrUnavailable
+	}
+	var ql *queryLogger
+	if cfg != nil {
+		var err error
+		if ql, err = newQueryLogger(r.logf, *cfg); err != nil {
+			return err
+		}
+	}
+	if old := r.queryLog.Swap(ql); old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// newQueryLogEntry returns a new log entry for the query q from the
+// client at from, or nil if query logging is disabled or q can't be parsed.
+func (r *Resolver) newQueryLogEntry(q []byte, from netip.AddrPort) *QueryLogEntry {
+	if r.queryLog.Load() == nil {
+		return nil
+	}
+	name, typ, err := nameFromQuery(q)
+	if err != nil {
+		return nil
+	}
+	return &QueryLogEntry{
+		Time: r.clock.Now(),
+		From: from,
+		Name: name.WithoutTrailingDot(),
+		Type: strings.TrimPrefix(typ.String(), "Type"),
+	}
+}
+
+// finishQuery completes e, which may be nil, with the response res to its
+// query or the error err, and logs it if query logging is still enabled.
+func (r *Resolver) finishQuery(e *QueryLogEntry, res []byte, err error) {
+	if e == nil {
+		return
+	}
+	e.Latency = r.clock.Since(e.Time)
+	if err != nil {
+		e.Err = err.Error()
+	} else {
+		e.RCode = strings.TrimPrefix(getRCode(res).String(), "RCode")
+	}
+	if ql := r.queryLog.Load(); ql != nil {
+		ql.log(e)
+	}
+}
+
+// QueryStats returns the statistics of the queries of each client of the
+// resolver, most recently active first, with the n names each queried most.
+// It reports false if query logging is disabled.
+func (r *Resolver) QueryStats(n int) (_ []apitype.ClientQueryStats, ok bool) {
+	if !buildfeatures.HasDNS {
+		return nil, false
+	}
+	ql := r.queryLog.Load()
+	if ql == nil {
+		return nil, false
+	}
+	return ql.stats.get(n), true
+}
+
+// maxStatsClients returns the number of clients to keep query statistics
+// for, and maxStatsNames the number of names to count per client.
+func maxStatsClients() int {
+	if version.IsMobile() {
+		return 16
+	}
+	return 256
+}
+
+func maxStatsNames() int {
+	if version.IsMobile() {
+		return 32
+	}
+	return 256
+}
+
+// queryStats counts the queries of the most recently active clients, and
+// of the names each of them queried most.
+type queryStats struct {
+	mu      sync.Mutex
+	clients lru.Cache[netip.Addr, *clientQueryStats]
+}
+
+type clientQueryStats struct {
+	queries int64
+	last    time.Time
+	names   map[string]int64
+}
+
+func (s *queryStats) add(client netip.Addr, name string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients.MaxEntries = maxStatsClients()
+	cs, ok := s.clients.GetOk(client)
+	if !ok {
+		cs = &clientQueryStats{names: map[string]int64{}}
+		s.clients.Set(client, cs)
+	}
+	cs.queries++
+	cs.last = now
+
+	if _, ok := cs.names[name]; ok || len(cs.names) < maxStatsNames() {
+		cs.names[name]++
+		return
+	}
+	// The table is full. Like the Space-Saving algorithm (Metwally et
+	// al., 2005), replace the least queried name, with its count plus
+	// one, so that names queried often eventually make it in.
+	var minName string
+	var minCount int64
+	for n, c := range cs.names {
+		if minName == "" || c < minCount {
+			minName, minCount = n, c
+		}
+	}
+	delete(cs.names, minName)
+	cs.names[name] = minCount + 1
+}
+
+func (s *queryStats) get(n int) []apitype.ClientQueryStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []apitype.ClientQueryStats
+	s.clients.ForEach(func(client netip.Addr, cs *clientQueryStats) {
+		st := apitype.ClientQueryStats{
+			Client:    client,
+			Queries:   cs.queries,
+			LastQuery: cs.last,
+		}
+		for name, count := range cs.names {
+			st.TopNames = append(st.TopNames, apitype.NameCount{Name: name, Count: count})
+		}
+		slices.SortFunc(st.TopNames, func(a, b apitype.NameCount) int {
+			return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Name, b.Name))
+		})
+		if len(st.TopNames) > n {
+			st.TopNames = st.TopNames[:n]
+		}
+		ret = append(ret, st)
+	})
+	return ret
+}
@@ -0,0 +1,217 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/eventbus/eventbustest"
+)
+
+func TestQueryStats(t *testing.T) {
+	var s queryStats
+	a := netip.MustParseAddr("100.64.0.1")
+	b := netip.MustParseAddr("100.64.0.2")
+	t0 := time.Unix(1700000000, 0)
+
+	for range 3 {
+		s.add(a, "often.example.com", t0)
+	}
+	s.add(a, "rarely.example.com", t0)
+	s.add(b, "other.example.com", t0.Add(time.Second))
+
+	got := s.get(1)
+	want := []apitype.ClientQueryStats{
+		{Client: b, Queries: 1, LastQuery: t0.Add(time.Second), TopNames: []apitype.NameCount{{Name: "other.example.com", Count: 1}}},
+		{Client: a, Queries: 4, LastQuery: t0, TopNames: []apitype.NameCount{{Name: "often.example.com", Count: 3}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestQueryStatsManyNames(t *testing.T) {
+	var s queryStats
+	a := netip.MustParseAddr("100.64.0.1")
+	for range 5 {
+		s.add(a, "popular.example.com", time.Now())
+	}
+	// Fill the table with names queried once, and then some, so that
+	// names are replaced. The popular one must stay.
+	for i := range 2 * maxStatsNames() {
+		s.add(a, fmt.Sprintf("host%d.example.com", i), time.Now())
+	}
+	stats := s.get(1)
+	if len(stats) != 1 || len(stats[0].TopNames) != 1 || stats[0].TopNames[0].Name != "popular.example.com" {
+		t.Fatalf("got %+v, want popular.example.com on top", stats)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.clients.Get(a).names); n != maxStatsNames() {
+		t.Errorf("counted %d names, want %d", n, maxStatsNames())
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	port := runDNSServer(t, nil, makeTestResponse(t, "upstream.example.com.", dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1")), func(bool, []byte) {})
+	upstream := fmt.Sprintf("127.0.0.1:%d", port)
+
+	r := newResolver(t)
+	defer r.Close()
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{".": {{Addr: upstream}}}
+	if err := r.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := eventbustest.NewBus(t)
+	tw := eventbustest.NewWatcher(t, bus)
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	if err := r.SetQueryLog(&QueryLogConfig{
+		SampleRate: 1,
+		Path:       path,
+		Bus:        bus,
+		WhoIs: func(ip netip.Addr) (string, bool) {
+			return "client.tailnet.ts.net", ip == netip.MustParseAddr("100.64.0.1")
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	from := netip.MustParseAddrPort("100.64.0.1:5353")
+	for _, q := range [][]byte{
+		dnspacket("test1.ipn.dev.", dns.TypeA, noEdns),
+		dnspacket("missing.ipn.dev.", dns.TypeAAAA, noEdns),
+		dnspacket("upstream.example.com.", dns.TypeA, noEdns),
+	} {
+		if _, err := r.Query(context.Background(), q, "udp", from); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type logged struct{ Name, Type, RCode, Upstream, Node string }
+	want := []logged{
+		{"test1.ipn.dev", "A", "Success", "", "client.tailnet.ts.net"},
+		{"missing.ipn.dev", "AAAA", "NameError", "", "client.tailnet.ts.net"},
+		{"upstream.example.com", "A", "Success", upstream, "client.tailnet.ts.net"},
+	}
+	var filters []any
+	for _, w := range want {
+		filters = append(filters, func(e QueryLogEntry) error {
+			if got := (logged{e.Name, e.Type, e.RCode, e.Upstream, e.Node}); got != w {
+				return fmt.Errorf("published %+v, want %+v", got, w)
+			}
+			return nil
+		})
+	}
+	if err := eventbustest.Expect(tw, filters...); err != nil {
+		t.Error(err)
+	}
+
+	stats, _ := r.QueryStats(10)
+	if len(stats) != 1 || stats[0].Client != from.Addr() || stats[0].Queries != 3 {
+		t.Errorf("QueryStats = %+v, want 3 queries from %v", stats, from.Addr())
+	}
+
+	// The same entries are written to the file, by the time query
+	// logging is disabled.
+	if err := r.SetQueryLog(nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var fromFile []logged
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e QueryLogEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.From != from || e.Time.IsZero() {
+			t.Errorf("entry %+v: bad From or Time", e)
+		}
+		fromFile = append(fromFile, logged{e.Name, e.Type, e.RCode, e.Upstream, e.Node})
+	}
+	if !reflect.DeepEqual(fromFile, want) {
+		t.Errorf("file has %+v\nwant %+v", fromFile, want)
+	}
+}
+
+// TestQueryLogDoesNotBlock tests that queries aren't delayed by logging,
+// even if it's stuck.
+func TestQueryLogDoesNotBlock(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	r.SetConfig(dnsCfg)
+	unblock := make(chan struct{})
+	if err := r.SetQueryLog(&QueryLogConfig{
+		SampleRate: 1,
+		WhoIs: func(netip.Addr) (string, bool) {
+			<-unblock
+			return "", false
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	from := netip.MustParseAddrPort("100.64.0.1:5353")
+	for range 2 * queryLogQueueSize {
+		if _, err := r.Query(context.Background(), dnspacket("test1.ipn.dev.", dns.TypeA, noEdns), "udp", from); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats, ok := r.QueryStats(1); !ok || len(stats) != 1 || stats[0].Queries != 2*queryLogQueueSize {
+		t.Errorf("QueryStats = %+v, %v; want %d queries", stats, ok, 2*queryLogQueueSize)
+	}
+	close(unblock)
+}
+
+func TestQueryLogSampling(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	r.SetConfig(dnsCfg)
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	if err := r.SetQueryLog(&QueryLogConfig{SampleRate: 0, Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	from := netip.MustParseAddrPort("100.64.0.1:5353")
+	for range 10 {
+		if _, err := r.Query(context.Background(), dnspacket("test1.ipn.dev.", dns.TypeA, noEdns), "udp", from); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, err := os.ReadFile(path); err != nil || len(b) != 0 {
+		t.Errorf("query log has %q (err %v), want nothing", b, err)
+	}
+	// All the queries are counted regardless.
+	if stats, ok := r.QueryStats(1); !ok || len(stats) != 1 || stats[0].Queries != 10 {
+		t.Errorf("QueryStats = %+v, %v; want 10 queries", stats, ok)
+	}
+
+	// Disabling query logging discards the statistics.
+	if err := r.SetQueryLog(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.QueryStats(1); ok {
+		t.Error("QueryStats ok with query logging disabled")
+	}
+
+	if err := r.SetQueryLog(&QueryLogConfig{SampleRate: 1.5}); err == nil {
+		t.Error("sample rate 1.5: unexpected success")
+	}
+}
@@ -16,10 +16,12 @@
 	"net/netip"
 	"os"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	dns "golang.org/x/net/dns/dnsmessage"
@@ -28,12 +30,14 @@
 	"tailscale.com/feature"
 	"tailscale.com/feature/buildfeatures"
 	"tailscale.com/health"
+	"tailscale.com/net/dns/localzone"
 	"tailscale.com/net/dns/resolvconffile"
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/syncs"
+	"tailscale.com/tstime"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
@@ -60,11 +64,16 @@ type packet struct {
 	bs     []byte
 	family string         // either "tcp" or "udp"
 	addr   netip.AddrPort // src for a request, dst for a response
+
+	// upstream is, for a forwarded response, the address of the
+	// upstream resolver that sent it.
+	upstream string
 }
 
 // Config is a resolver configuration.
 // Given a Config, queries are resolved in the following order:
-// If the query is an exact match for an entry in LocalHosts, return that.
+// If the query is in one of the local zones (see SetLocalZones), answer from that.
+// Else if the query is an exact match for an entry in LocalHosts, return that.
 // Else if the query suffix matches an entry in LocalDomains, return NXDOMAIN.
 // Else forward the query to the most specific matching entry in Routes.
 // Else return SERVFAIL.
@@ -209,6 +218,15 @@ type Resolver struct {
 	saveConfigForTests func(cfg Config) // used in tests to capture resolver config
 	// forwarder forwards requests to upstream nameservers.
 	forwarder *forwarder
+	// cache caches the responses of the forwarder, or is nil if disabled.
+	cache *responseCache
+	clock tstime.DefaultClock
+
+	queryLog atomic.Pointer[queryLogger] // or nil if disabled
+
+	// baseNameservers, if non-nil, returns the OS's nameservers on
+	// platforms without a resolv.conf.
+	baseNameservers syncs.AtomicValue[func() ([]netip.Addr, error)]
 
 	// closed signals all goroutines to stop.
 	closed chan struct{}
@@ -218,6 +236,8 @@ type Resolver struct {
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netip.Addr
 	ipToHost     map[netip.Addr]dnsname.FQDN
+	routes       map[dnsname.FQDN][]*dnstype.Resolver // from the last SetConfig
+	localZones   *localzone.Zones                     // or nil
 }
 
 type ForwardLinkSelector interface {
@@ -250,11 +270,23 @@ func New(logf logger.Logf, linkSel ForwardLinkSelector, dialer *tsdial.Dialer, h
 		health:   health,
 	}
 	r.forwarder = newForwarder(r.logf, netMon, linkSel, dialer, health, knobs)
+	if !disableCache() {
+		r.cache = newResponseCache()
+	}
 	return r
 }
 
+var disableCache = envknob.RegisterBool("TS_DNS_DISABLE_CACHE")
+
 func (r *Resolver) TestOnlySetHook(hook func(Config)) { r.saveConfigForTests = hook }
 
+// SetBaseNameserversFunc sets the func that returns the OS's own nameservers
+// on platforms without a resolv.conf (Windows and Android), to forward exit
+// node DNS queries to.
+func (r *Resolver) SetBaseNameserversFunc(f func() ([]netip.Addr, error)) {
+	r.baseNameservers.Store(f)
+}
+
 func (r *Resolver) SetConfig(cfg Config) error {
 	if !buildfeatures.HasDNS {
 		return nil
@@ -262,6 +294,9 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	if r.saveConfigForTests != nil {
 		r.saveConfigForTests(cfg)
 	}
+	if err := checkDoTResolvers(cfg.Routes); err != nil {
+		return err
+	}
 
 	reverse := make(map[netip.Addr]dnsname.FQDN, len(cfg.Hosts))
 
@@ -274,13 +309,41 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	r.forwarder.setRoutes(cfg.Routes)
 
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	routesChanged := !routesEqual(r.routes, cfg.Routes)
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.routes = cfg.Routes
+	r.mu.Unlock()
+
+	// Cached responses may be from upstreams that are no longer used, or
+	// for names that are now routed elsewhere. (Names answered locally
+	// are never cached, so changes to them don't matter.)
+	if routesChanged {
+		r.FlushCache()
+	}
 	return nil
 }
 
+// SetLocalZones sets the local zones to answer queries from, in preference
+// to MagicDNS names and forwarding. zones may be nil.
+func (r *Resolver) SetLocalZones(zones *localzone.Zones) {
+	if !buildfeatures.HasDNS {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.localZones = zones
+}
+
+// FlushCache removes all cached responses of upstream resolvers.
+func (r *Resolver) FlushCache() {
+	if !buildfeatures.HasDNS || r.cache == nil {
+		return
+	}
+	r.cache.flush()
+}
+
 // Close shuts down the resolver and ensures poll goroutines have exited.
 // The Resolver cannot be used again after Close is called.
 func (r *Resolver) Close() {
@@ -296,6 +359,9 @@ func (r *Resolver) Close() {
 	close(r.closed)
 
 	r.forwarder.Close()
+	if ql := r.queryLog.Swap(nil); ql != nil {
+		ql.close()
+	}
 }
 
 // dnsQueryTimeout is not intended to be user-visible (the users
@@ -303,7 +369,7 @@ func (r *Resolver) Close() {
 // bound on per-query resource usage.
 const dnsQueryTimeout = 10 * time.Second
 
-func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
+func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) (out []byte, err error) {
 	if !buildfeatures.HasDNS {
 		return nil, feature.ErrUnavailable
 	}
@@ -315,22 +381,67 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from net
 	default:
 	}
 
-	out, err := r.respond(bs)
+	qe := r.newQueryLogEntry(bs, from)
+	defer func() { r.finishQuery(qe, out, err) }()
+
+	out, err = r.respond(bs)
 	if err == errNotOurName {
-		responses := make(chan packet, 1)
 		ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
-		defer close(responses)
 		defer cancel()
-		err = r.forwarder.forwardWithDestChan(ctx, packet{bs, family, from}, responses)
-		if err != nil {
-			return nil, err
-		}
-		return (<-responses).bs, nil
+		return r.forward(ctx, packet{bs: bs, family: family, addr: from}, qe)
 	}
 
 	return out, err
 }
 
+// forward forwards the query to the upstream resolvers for its name, and
+// returns the response. It answers from the cache if it can, and caches
+// the response. If the upstream resolvers fail, a recently expired cached
+// response is returned instead, if there's one.
+//
+// If qe is non-nil, it's updated with how the query was answered.
+func (r *Resolver) forward(ctx context.Context, query packet, qe *QueryLogEntry) ([]byte, error) {
+	if r.cache != nil {
+		if res, negative, ok := r.cache.get(query.bs, r.clock.Now(), false); ok {
+			metricDNSCacheHit.Add(1)
+			if negative {
+				metricDNSCacheHitNegative.Add(1)
+			}
+			if qe != nil {
+				qe.Cached = true
+			}
+			return res, nil
+		}
+		metricDNSCacheMiss.Add(1)
+	}
+
+	responses := make(chan packet, 1)
+	err := r.forwarder.forwardWithDestChan(ctx, query, responses)
+	var res []byte
+	if err == nil {
+		p := <-responses
+		res = p.bs
+		if qe != nil {
+			qe.Upstream = p.upstream
+		}
+	}
+	if r.cache == nil {
+		return res, err
+	}
+	if err == nil && getRCode(res) != dns.RCodeServerFailure {
+		r.cache.set(query.bs, res, r.clock.Now())
+		return res, nil
+	}
+	if stale, _, ok := r.cache.get(query.bs, r.clock.Now(), true); ok {
+		metricDNSCacheStale.Add(1)
+		if qe != nil {
+			qe.Upstream, qe.Cached = "", true
+		}
+		return stale, nil
+	}
+	return res, err
+}
+
 // GetUpstreamResolvers returns the resolvers that would be used to resolve
 // the given FQDN.
 func (r *Resolver) GetUpstreamResolvers(name dnsname.FQDN) []*dnstype.Resolver {
@@ -371,6 +482,9 @@ func (r *Resolver) HandlePeerDNSQuery(ctx context.Context, q []byte, from netip.
 	metricDNSExitProxyQuery.Add(1)
 	ch := make(chan packet, 1)
 
+	qe := r.newQueryLogEntry(q, from)
+	defer func() { r.finishQuery(qe, res, err) }()
+
 	resp := parseExitNodeQuery(q)
 	if resp == nil {
 		return nil, errors.New("bad query")
@@ -381,50 +495,71 @@ func (r *Resolver) HandlePeerDNSQuery(ctx context.Context, q []byte, from netip.
 		resp.Header.RCode = dns.RCodeRefused
 		return marshalResponse(resp)
 	}
+	if fqdn, err := dnsname.ToFQDN(name); err == nil {
+		if res, ok := r.respondLocalZone(resp.Header, resp.Question, fqdn); ok {
+			return res, nil
+		}
+	}
 
+	// Forward the query as is, so that all record types, EDNS options and
+	// flags work.
+	var resolvers []resolverAndDelay
 	switch runtime.GOOS {
 	default:
 		return nil, errors.New("unsupported exit node OS")
 	case "windows", "android":
-		return handleExitNodeDNSQueryWithNetPkg(ctx, r.logf, nil, resp)
+		// There's no resolv.conf to find the OS's nameservers in, so
+		// get them from the OS configurator.
+		var nameservers []netip.Addr
+		if f := r.baseNameservers.Load(); f != nil {
+			var err error
+			nameservers, err = f()
+			if err != nil {
+				r.logf("getting OS nameservers: %v", err)
+			}
+		}
+		resolvers = exitNodeResolvers(nameservers)
+		if len(resolvers) == 0 {
+			// Use the OS's resolver through the net package
+			// instead, which only supports some record types.
+			return handleExitNodeDNSQueryWithNetPkg(ctx, r.logf, nil, resp)
+		}
 	case "darwin":
 		// /etc/resolv.conf is a lie and only says one upstream DNS
 		// but for now that's probably good enough. Later we'll
 		// want to blend in everything from scutil --dns.
 		fallthrough
 	case "linux", "freebsd", "openbsd", "illumos", "solaris", "ios":
-		nameserver, err := stubResolverForOS()
+		nameservers, err := osNameservers()
 		if err != nil {
-			r.logf("stubResolverForOS: %v", err)
+			r.logf("osNameservers: %v", err)
 			metricDNSExitProxyErrorResolvConf.Add(1)
 			return nil, err
 		}
-		// TODO: more than 1 resolver from /etc/resolv.conf?
-
-		var resolvers []resolverAndDelay
-		switch nameserver {
-		case tsaddr.TailscaleServiceIP(), tsaddr.TailscaleServiceIPv6():
-			// If resolv.conf says 100.100.100.100, it's coming right back to us anyway
-			// so avoid the loop through the kernel and just do what we
-			// would've done anyway. By not passing any resolvers, the forwarder
-			// will use its default ones from our DNS config.
-		case netip.Addr{}:
-			// Likewise, if the platform has no resolv.conf, just use our defaults.
-		default:
-			resolvers = []resolverAndDelay{{
-				name: &dnstype.Resolver{Addr: net.JoinHostPort(nameserver.String(), "53")},
-			}}
-		}
-
-		err = r.forwarder.forwardWithDestChan(ctx, packet{q, "tcp", from}, ch, resolvers...)
-		if err != nil {
-			metricDNSExitProxyErrorForward.Add(1)
-			return nil, err
+		resolvers = exitNodeResolvers(nameservers)
+		if len(resolvers) == 0 {
+			// If the OS's only nameserver is 100.100.100.100, it's
+			// coming right back to us anyway so avoid the loop
+			// through the kernel and just do what we would've done
+			// anyway. Likewise if the platform has no resolv.conf.
+			res, err := r.forward(ctx, packet{bs: q, family: "tcp", addr: from}, qe)
+			if err != nil {
+				metricDNSExitProxyErrorForward.Add(1)
+			}
+			return res, err
 		}
 	}
+	err = r.forwarder.forwardWithDestChan(ctx, packet{bs: q, family: "tcp", addr: from}, ch, resolvers...)
+	if err != nil {
+		metricDNSExitProxyErrorForward.Add(1)
+		return nil, err
+	}
 	select {
 	case p, ok := <-ch:
 		if ok {
+			if qe != nil {
+				qe.Upstream = p.upstream
+			}
 			return p.bs, nil
 		}
 		panic("unexpected close chan")
@@ -564,50 +699,164 @@ func isGoNoSuchHostError(err error) bool {
 	return false
 }
 
+// exitNodeResolverPort is the port of the OS's nameservers. It's only
+// changed by tests.
+var exitNodeResolverPort uint16 = 53
+
+// exitNodeResolverDelay is how long to wait for each of the OS's
+// nameservers before also querying the next one. The OS's own stub
+// resolver would wait for a full timeout instead.
+const exitNodeResolverDelay = 200 * time.Millisecond
+
+// exitNodeResolvers returns the resolvers to forward peers' DNS queries to,
+// for the OS's nameservers. Our own service IPs are skipped, as queries to
+// them would loop back to us.
+func exitNodeResolvers(nameservers []netip.Addr) []resolverAndDelay {
+	var resolvers []resolverAndDelay
+	for _, ip := range nameservers {
+		if ip == tsaddr.TailscaleServiceIP() || ip == tsaddr.TailscaleServiceIPv6() {
+			continue
+		}
+		resolvers = append(resolvers, resolverAndDelay{
+			name:       &dnstype.Resolver{Addr: netip.AddrPortFrom(ip, exitNodeResolverPort).String()},
+			startDelay: time.Duration(len(resolvers)) * exitNodeResolverDelay,
+		})
+	}
+	return resolvers
+}
+
 type resolvConfCache struct {
-	mod  time.Time
-	size int64
-	ip   netip.Addr
+	mod         time.Time
+	size        int64
+	nameservers []netip.Addr
 	// TODO: inode/dev?
 }
 
-// resolvConfCacheValue contains the most recent stat metadata and parsed
-// version of /etc/resolv.conf.
-var resolvConfCacheValue syncs.AtomicValue[resolvConfCache]
+// resolvConfCacheValues contains the most recent stat metadata and parsed
+// nameservers of each resolv.conf file read, keyed by path.
+var resolvConfCacheValues syncs.Map[string, resolvConfCache]
 
 var errEmptyResolvConf = errors.New("resolv.conf has no nameservers")
 
-// stubResolverForOS returns the IP address of the first nameserver in
-// /etc/resolv.conf.
+var (
+	// resolvConfPath is the path of the OS's resolv.conf.
+	resolvConfPath = resolvconffile.Path
+
+	// resolvedResolvConfPath is where systemd-resolved writes the
+	// nameservers it forwards to, in resolv.conf format.
+	resolvedResolvConfPath = "/run/systemd/resolve/resolv.conf"
+)
+
+// HookResolvedNeedsStub, if set, reports whether systemd-resolved does more
+// than forward all queries to the same nameservers: whether it routes
+// domains to different nameservers (split DNS), or uses DNSSEC or
+// DNS-over-TLS. If so, its stub resolver must be used to keep that.
+//
+// It's set unless ts_omit_resolved.
+var HookResolvedNeedsStub feature.Hook[func() (bool, error)]
+
+// resolvedModeCache is the result of [HookResolvedNeedsStub], along with the
+// stat metadata of systemd-resolved's resolv.conf when it was called.
+type resolvedModeCache struct {
+	mod       time.Time
+	size      int64
+	needsStub bool
+}
+
+// resolvedModeCacheValue caches [HookResolvedNeedsStub] until
+// systemd-resolved's resolv.conf changes, as it does when its
+// configuration does.
+var resolvedModeCacheValue syncs.AtomicValue[resolvedModeCache]
+
+// resolvedNeedsStub reports whether systemd-resolved's stub resolver must be
+// used, rather than the nameservers it forwards to. If unsure, it reports
+// true.
+func resolvedNeedsStub() bool {
+	f, ok := HookResolvedNeedsStub.GetOk()
+	if !ok {
+		return true
+	}
+	fi, err := os.Stat(resolvedResolvConfPath)
+	if err != nil {
+		return true
+	}
+	if c := resolvedModeCacheValue.Load(); c.mod == fi.ModTime() && c.size == fi.Size() {
+		return c.needsStub
+	}
+	needsStub, err := f()
+	if err != nil {
+		return true // don't cache; it might be restarting
+	}
+	resolvedModeCacheValue.Store(resolvedModeCache{
+		mod:       fi.ModTime(),
+		size:      fi.Size(),
+		needsStub: needsStub,
+	})
+	return needsStub
+}
+
+// isResolvedStub reports whether ip is the address of one of
+// systemd-resolved's stub resolvers.
+func isResolvedStub(ip netip.Addr) bool {
+	return ip == netip.AddrFrom4([4]byte{127, 0, 0, 53}) || ip == netip.AddrFrom4([4]byte{127, 0, 0, 54})
+}
+
+// osNameservers returns the OS's nameservers, in order of preference.
 //
-// It may also return the netip.Addr zero value and a nil error to mean
-// that the platform has no resolv.conf.
-func stubResolverForOS() (ip netip.Addr, err error) {
+// They're read from /etc/resolv.conf, unless it only points at
+// systemd-resolved's stub resolver, in which case they're the nameservers
+// that systemd-resolved itself uses. The stub answers from its own cache
+// and strips EDNS options, so it's bypassed if possible: that is, unless
+// the host uses split DNS, DNSSEC or DNS-over-TLS, which only the stub
+// knows how to do.
+//
+// It may also return nil and a nil error to mean that the platform has no
+// resolv.conf.
+func osNameservers() ([]netip.Addr, error) {
 	if runtime.GOOS == "ios" {
-		return netip.Addr{}, nil // no resolv.conf on iOS
+		return nil, nil // no resolv.conf on iOS
+	}
+	nameservers, err := readResolvConfNameservers(resolvConfPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(nameservers) == 0 {
+		return nil, errEmptyResolvConf
+	}
+	if runtime.GOOS != "linux" || !slices.ContainsFunc(nameservers, isResolvedStub) {
+		return nameservers, nil
+	}
+	upstreams, err := readResolvConfNameservers(resolvedResolvConfPath)
+	if err != nil || len(exitNodeResolvers(upstreams)) == 0 || resolvedNeedsStub() {
+		// Either systemd-resolved isn't running after all, it only
+		// knows about us, or it does more than forwarding. Use the
+		// stub.
+		return nameservers, nil
 	}
-	fi, err := os.Stat(resolvconffile.Path)
+	return upstreams, nil
+}
+
+// readResolvConfNameservers returns the nameservers in the resolv.conf file
+// at path, caching them until the file changes.
+func readResolvConfNameservers(path string) ([]netip.Addr, error) {
+	fi, err := os.Stat(path)
 	if err != nil {
-		return netip.Addr{}, err
+		return nil, err
 	}
 	cur := resolvConfCache{
 		mod:  fi.ModTime(),
 		size: fi.Size(),
 	}
-	if c, ok := resolvConfCacheValue.LoadOk(); ok && c.mod == cur.mod && c.size == cur.size {
-		return c.ip, nil
+	if c, ok := resolvConfCacheValues.Load(path); ok && c.mod == cur.mod && c.size == cur.size {
+		return c.nameservers, nil
 	}
-	conf, err := resolvconffile.ParseFile(resolvconffile.Path)
+	conf, err := resolvconffile.ParseFile(path)
 	if err != nil {
-		return netip.Addr{}, err
-	}
-	if len(conf.Nameservers) == 0 {
-		return netip.Addr{}, errEmptyResolvConf
+		return nil, err
 	}
-	ip = conf.Nameservers[0]
-	cur.ip = ip
-	resolvConfCacheValue.Store(cur)
-	return ip, nil
+	cur.nameservers = conf.Nameservers
+	resolvConfCacheValues.Store(path, cur)
+	return cur.nameservers, nil
 }
 
 // resolveLocal returns an IP for the given domain, if domain is in
@@ -1307,6 +1556,10 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return r.respondReverse(query, name, parser.response())
 	}
 
+	if res, ok := r.respondLocalZone(parser.Header, parser.Question, name); ok {
+		return res, nil
+	}
+
 	ip, rcode := r.resolveLocal(name, parser.Question.Type)
 	if rcode == dns.RCodeRefused {
 		return nil, errNotOurName // sentinel error return value: it requests forwarding
@@ -1319,6 +1572,41 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 	return marshalResponse(resp)
 }
 
+// respondLocalZone returns a response to the query with header h and
+// question q for name from the local zones, reporting whether name is in
+// one of them.
+func (r *Resolver) respondLocalZone(h dns.Header, q dns.Question, name dnsname.FQDN) ([]byte, bool) {
+	r.mu.Lock()
+	zones := r.localZones
+	r.mu.Unlock()
+
+	answers, rcode, ok := zones.Lookup(name, q.Type)
+	if !ok {
+		return nil, false
+	}
+	metricDNSLocalZone.Add(1)
+	msg := dns.Message{
+		Header: dns.Header{
+			ID:                 h.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: h.RecursionDesired,
+			RCode:              rcode,
+		},
+		Questions: []dns.Question{q},
+		Answers:   answers,
+	}
+	res, err := msg.Pack()
+	if err != nil {
+		r.logf("packing local zone response for %q: %v", name, err)
+		msg.Header.RCode = dns.RCodeServerFailure
+		msg.Answers = nil
+		res, _ = msg.Pack()
+	}
+	return res, true
+}
+
 // unARPA maps from "4.4.8.8.in-addr.arpa." to "8.8.4.4", etc.
 func unARPA(a string) (ipStr string, ok bool) {
 	const suf4 = ".in-addr.arpa."
@@ -1398,6 +1686,26 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdDoHErrorTransport = clientmetric.NewCounter("dns_query_fwd_doh_error_transport")
 	metricDNSFwdDoHErrorBody      = clientmetric.NewCounter("dns_query_fwd_doh_error_body")
 
+	metricDNSFwdDoT               = clientmetric.NewCounter("dns_query_fwd_dot")       // on entry
+	metricDNSFwdDoTConns          = clientmetric.NewCounter("dns_query_fwd_dot_conns") // TLS connections established
+	metricDNSFwdDoTRetry          = clientmetric.NewCounter("dns_query_fwd_dot_retry") // retried on a new connection
+	metricDNSFwdDoTErrorDial      = clientmetric.NewCounter("dns_query_fwd_dot_error_dial")
+	metricDNSFwdDoTErrorHandshake = clientmetric.NewCounter("dns_query_fwd_dot_error_handshake")
+	metricDNSFwdDoTErrorWrite     = clientmetric.NewCounter("dns_query_fwd_dot_error_write")
+	metricDNSFwdDoTErrorRead      = clientmetric.NewCounter("dns_query_fwd_dot_error_read")
+	metricDNSFwdDoTErrorTxID      = clientmetric.NewCounter("dns_query_fwd_dot_error_txid")
+	metricDNSFwdDoTErrorServer    = clientmetric.NewCounter("dns_query_fwd_dot_error_server")
+	metricDNSFwdDoTSuccess        = clientmetric.NewCounter("dns_query_fwd_dot_success")
+
+	metricDNSCacheHit         = clientmetric.NewCounter("dns_cache_hit")
+	metricDNSCacheHitNegative = clientmetric.NewCounter("dns_cache_hit_negative") // NXDOMAIN or NODATA
+	metricDNSCacheMiss        = clientmetric.NewCounter("dns_cache_miss")
+	metricDNSCacheStale       = clientmetric.NewCounter("dns_cache_stale") // served after upstreams failed
+	metricDNSCacheFlush       = clientmetric.NewCounter("dns_cache_flush")
+	metricDNSCacheEntries     = clientmetric.NewGauge("dns_cache_entries")
+
+	metricDNSLocalZone = clientmetric.NewCounter("dns_local_zone")
+
 	metricDNSResolveLocal             = clientmetric.NewCounter("dns_resolve_local")
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
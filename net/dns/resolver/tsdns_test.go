@@ -14,22 +14,28 @@
 	"math/rand"
 	"net"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	miekdns "github.com/miekg/dns"
 	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/feature"
 	"tailscale.com/health"
+	"tailscale.com/net/dns/localzone"
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/tstest"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/ptr"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/eventbus/eventbustest"
 )
@@ -1521,3 +1527,248 @@ func TestServfail(t *testing.T) {
 		t.Errorf("response was %X, want %X", pkt, wantPkt)
 	}
 }
+
+func TestOSNameservers(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("systemd-resolved is only used on Linux")
+	}
+	dir := t.TempDir()
+	writeConf := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	stub := "nameserver 127.0.0.53\noptions edns0 trust-ad\n"
+
+	tests := []struct {
+		name     string
+		conf     string
+		resolved string // contents of systemd-resolved's resolv.conf, if non-empty
+		// needsStub, if non-nil, is what HookResolvedNeedsStub returns.
+		needsStub *bool
+		want      []netip.Addr
+		wantErr   error
+	}{
+		{
+			name: "plain",
+			conf: "nameserver 192.168.1.1\nnameserver 2001:db8::1\n",
+			want: []netip.Addr{mustIP("192.168.1.1"), mustIP("2001:db8::1")},
+		},
+		{
+			name:    "empty",
+			conf:    "search example.com\n",
+			wantErr: errEmptyResolvConf,
+		},
+		{
+			name:      "resolved-upstreams",
+			conf:      stub,
+			resolved:  "nameserver 100.100.100.100\nnameserver 10.0.0.1\nnameserver 10.0.0.2\n",
+			needsStub: ptr.To(false),
+			want:      []netip.Addr{mustIP("100.100.100.100"), mustIP("10.0.0.1"), mustIP("10.0.0.2")},
+		},
+		{
+			name:      "resolved-split",
+			conf:      stub,
+			resolved:  "nameserver 10.0.0.1\nnameserver 10.0.0.2\n",
+			needsStub: ptr.To(true),
+			want:      []netip.Addr{mustIP("127.0.0.53")},
+		},
+		{
+			name:     "resolved-mode-unknown",
+			conf:     stub,
+			resolved: "nameserver 10.0.0.1\nnameserver 10.0.0.2\n",
+			want:     []netip.Addr{mustIP("127.0.0.53")},
+		},
+		{
+			name:     "resolved-only-us",
+			conf:     stub,
+			resolved: "nameserver 100.100.100.100\n",
+			want:     []netip.Addr{mustIP("127.0.0.53")},
+		},
+		{
+			name: "resolved-not-running",
+			conf: stub,
+			want: []netip.Addr{mustIP("127.0.0.53")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tstest.Replace(t, &resolvConfPath, writeConf(tt.name+".conf", tt.conf))
+			resolvedPath := filepath.Join(dir, tt.name+".resolved")
+			if tt.resolved != "" {
+				writeConf(tt.name+".resolved", tt.resolved)
+			}
+			tstest.Replace(t, &resolvedResolvConfPath, resolvedPath)
+			var hook feature.Hook[func() (bool, error)]
+			if tt.needsStub != nil {
+				hook.Set(func() (bool, error) { return *tt.needsStub, nil })
+			}
+			tstest.Replace(t, &HookResolvedNeedsStub, hook)
+			resolvedModeCacheValue.Store(resolvedModeCache{})
+
+			got, err := osNameservers()
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitNodeResolvers(t *testing.T) {
+	got := exitNodeResolvers([]netip.Addr{
+		mustIP("10.0.0.1"),
+		mustIP("100.100.100.100"),
+		mustIP("fd7a:115c:a1e0::53"),
+		mustIP("2001:db8::1"),
+	})
+	want := []resolverAndDelay{
+		{name: &dnstype.Resolver{Addr: "10.0.0.1:53"}},
+		{name: &dnstype.Resolver{Addr: "[2001:db8::1]:53"}, startDelay: exitNodeResolverDelay},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestHandlePeerDNSQueryForwardsRaw tests that peers' queries are forwarded
+// as is to the OS's nameservers, so that record types the net package
+// can't look up work.
+func TestHandlePeerDNSQueryForwardsRaw(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "windows", "android":
+	default:
+		t.Skip("test sets nameservers through resolv.conf or SetBaseNameserversFunc")
+	}
+	name := dns.MustNewName("example.com.")
+	b := dns.NewBuilder(nil, dns.Header{Response: true, RecursionAvailable: true})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: name, Type: dns.TypeMX, Class: dns.ClassINET})
+	b.StartAnswers()
+	b.MXResource(dns.ResourceHeader{Name: name, Class: dns.ClassINET, TTL: 300}, dns.MXResource{
+		Pref: 10,
+		MX:   dns.MustNewName("mail.example.com."),
+	})
+	response, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := make(chan []byte, 1)
+	port := runDNSServer(t, nil, response, func(_ bool, req []byte) {
+		select {
+		case queries <- bytes.Clone(req):
+		default:
+		}
+	})
+
+	conf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(conf, []byte("nameserver 127.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tstest.Replace(t, &resolvConfPath, conf)
+	tstest.Replace(t, &exitNodeResolverPort, port)
+
+	r := newResolver(t)
+	defer r.Close()
+	r.SetBaseNameserversFunc(func() ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	})
+
+	q := dns.NewBuilder(nil, dns.Header{RecursionDesired: true})
+	q.StartQuestions()
+	q.Question(dns.Question{Name: name, Type: dns.TypeMX, Class: dns.ClassINET})
+	query, err := q.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := netip.MustParseAddrPort("100.64.0.1:1234")
+	res, err := r.HandlePeerDNSQuery(context.Background(), query, from, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, response) {
+		t.Errorf("got response %x, want %x", res, response)
+	}
+	if got := <-queries; !bytes.Equal(got, query) {
+		t.Errorf("upstream got query %x, want %x", got, query)
+	}
+
+	// Names that aren't allowed are still refused.
+	res, err = r.HandlePeerDNSQuery(context.Background(), query, from, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode := getRCode(res); rcode != dns.RCodeRefused {
+		t.Errorf("rcode = %v, want REFUSED", rcode)
+	}
+}
+
+func TestLocalZones(t *testing.T) {
+	var upstreamQueries atomic.Int32
+	port := runDNSServer(t, nil, makeTestResponse(t, "other.example.com.", dns.RCodeSuccess, netip.MustParseAddr("1.1.1.1")), func(bool, []byte) {
+		upstreamQueries.Add(1)
+	})
+
+	r := newResolver(t)
+	defer r.Close()
+	if err := r.SetConfig(Config{
+		Hosts: map[dnsname.FQDN][]netip.Addr{"nas.office.example.com.": {netip.MustParseAddr("100.64.0.1")}},
+		Routes: map[dnsname.FQDN][]*dnstype.Resolver{
+			".": {{Addr: fmt.Sprintf("127.0.0.1:%d", port)}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	zones, err := localzone.New(&localzone.Zone{
+		Origin: "office.example.com.",
+		Records: []localzone.Record{
+			{Name: "nas.office.example.com.", Type: dns.TypeA, TTL: 60, Addr: netip.MustParseAddr("192.168.1.10")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetLocalZones(zones)
+
+	from := netip.MustParseAddrPort("127.0.0.1:1")
+	query := func(name string) dnsResponse {
+		t.Helper()
+		res, err := r.Query(context.Background(), dnspacket(dnsname.FQDN(name), dns.TypeA, noEdns), "udp", from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := unpackResponse(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Local zones are answered before MagicDNS names and forwarding.
+	if resp := query("nas.office.example.com."); resp.rcode != dns.RCodeSuccess || resp.ip != netip.MustParseAddr("192.168.1.10") {
+		t.Errorf("nas: got %v %v, want 192.168.1.10", resp.rcode, resp.ip)
+	}
+	if resp := query("missing.office.example.com."); resp.rcode != dns.RCodeNameError {
+		t.Errorf("missing: got %v, want NXDOMAIN", resp.rcode)
+	}
+	if n := upstreamQueries.Load(); n != 0 {
+		t.Errorf("%d queries forwarded, want 0", n)
+	}
+	if resp := query("other.example.com."); resp.ip != netip.MustParseAddr("1.1.1.1") {
+		t.Errorf("other: got %v, want forwarded 1.1.1.1", resp.ip)
+	}
+
+	// Peers get them too.
+	res, err := r.HandlePeerDNSQuery(context.Background(), dnspacket("nas.office.example.com.", dns.TypeA, noEdns), from, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := unpackResponse(res); err != nil || resp.ip != netip.MustParseAddr("192.168.1.10") {
+		t.Errorf("peer query: got %v, %v; want 192.168.1.10", resp.ip, err)
+	}
+}
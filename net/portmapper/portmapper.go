@@ -251,6 +251,18 @@ type Config struct {
 	// OnChange is called to run in a new goroutine whenever the port mapping
 	// status has changed. If nil, no callback is issued.
 	OnChange func()
+
+	// GatewayLookup, if non-nil, returns the machine's default gateway IP
+	// and its primary IP address for that gateway, instead of
+	// netmon.LikelyHomeRouterIP. See [Client.SetGatewayLookupFunc].
+	GatewayLookup func() (gw, myIP netip.Addr, ok bool)
+
+	// PxPPort and UPnPPort, if non-zero, are the gateway's NAT-PMP/PCP and
+	// UPnP discovery ports, instead of the standard 5351 and 1900. They're
+	// for tests against simulated gateways (see package portmappertest),
+	// and setting either one makes the client bypass netns for its sockets.
+	PxPPort  uint16
+	UPnPPort uint16
 }
 
 // NewClient constructs a new portmapping [Client] from c. It will panic if any
@@ -263,11 +275,14 @@ func NewClient(c Config) *Client {
 		panic("nil EventBus")
 	}
 	ret := &Client{
-		logf:     c.Logf,
-		netMon:   c.NetMon,
-		onChange: c.OnChange,
+		logf:         c.Logf,
+		netMon:       c.NetMon,
+		onChange:     c.OnChange,
+		ipAndGateway: c.GatewayLookup,
+		testPxPPort:  c.PxPPort,
+		testUPnPPort: c.UPnPPort,
 	}
-	if buildfeatures.HasPortMapper {
+	if buildfeatures.HasPortMapper && ret.ipAndGateway == nil {
 		// TODO(bradfitz): move this to method on netMon
 		ret.ipAndGateway = netmon.LikelyHomeRouterIP
 	}
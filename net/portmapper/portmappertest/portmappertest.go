@@ -0,0 +1,345 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package portmappertest provides a simulated port mapping gateway for
+// tests: an Internet Gateway Device that speaks NAT-PMP, PCP and UPnP,
+// with failure modes that tests can script, such as lease expiry, epoch
+// resets, a wrong external IP, refused mappings and router reboots.
+//
+// A [Gateway] is transport independent. [NewServer] serves one on
+// loopback, for a portmapper.Client whose Config uses the [Server]'s
+// GatewayLookup, PxPPort and UPnPPort, and natlab/vnet networks can use
+// one as the port mapping service of their router.
+package portmappertest
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
+)
+
+// DefaultExternalIP is the external IP of a Gateway without a NAT.
+var DefaultExternalIP = netip.MustParseAddr("203.0.113.1")
+
+// Options are the options of a Gateway.
+type Options struct {
+	// PMP, PCP and UPnP are the protocols the gateway answers. Requests
+	// of other protocols are ignored.
+	PMP  bool
+	PCP  bool
+	UPnP bool
+
+	// NAT, if non-nil, is the NAT that the gateway's mappings take
+	// effect in. If nil, mappings are only recorded by the gateway,
+	// whose external IP is DefaultExternalIP.
+	NAT NAT
+
+	// MaxLifetime, if non-zero, caps the lifetime of mappings, including
+	// permanent UPnP leases.
+	MaxLifetime time.Duration
+
+	// Clock, if non-nil, is the clock used for lifetimes and epochs.
+	Clock tstime.Clock
+
+	// Logf, if non-nil, logs the requests the gateway handles.
+	Logf logger.Logf
+}
+
+// A NAT is a network address translator whose port mappings a Gateway
+// manages.
+type NAT interface {
+	// WANIP returns the external IPv4 address of the NAT.
+	WANIP() netip.Addr
+
+	// MapPort maps an external port to internal for d, or extends the
+	// existing mapping of internal, and returns the external port. It
+	// prefers the port want, if non-zero.
+	MapPort(internal netip.AddrPort, want uint16, d time.Duration) (port uint16, ok bool)
+
+	// UnmapPort removes the mapping of the external port to internal.
+	UnmapPort(internal netip.AddrPort, port uint16)
+}
+
+// Mapping is a port mapping of a Gateway.
+type Mapping struct {
+	Protocol string // "pmp", "pcp" or "upnp"
+	Internal netip.AddrPort
+	External netip.AddrPort
+	Expires  time.Time
+}
+
+// initialUptime is how long ago a new Gateway's mapping table was reset,
+// so that its epoch goes back after ResetEpoch or Reboot.
+const initialUptime = time.Hour
+
+// permanentLease is how long a mapping of a permanent UPnP lease lasts
+// in the NAT.
+const permanentLease = 7 * 24 * time.Hour
+
+// Gateway is a simulated port mapping gateway.
+type Gateway struct {
+	opts  Options
+	clock tstime.Clock
+	logf  logger.Logf
+
+	mu           sync.Mutex
+	nat          NAT
+	externalIP   netip.Addr // overrides nat.WANIP if valid
+	boot         time.Time  // when the mapping table was last reset
+	refuse       bool
+	unresponsive bool
+	mappings     map[netip.AddrPort]*Mapping // by internal ip:port
+	requests     map[string]int              // by protocol
+}
+
+// NewGateway returns a new Gateway.
+func NewGateway(opts Options) *Gateway {
+	g := &Gateway{
+		opts:     opts,
+		clock:    opts.Clock,
+		logf:     opts.Logf,
+		nat:      opts.NAT,
+		mappings: map[netip.AddrPort]*Mapping{},
+		requests: map[string]int{},
+	}
+	if g.clock == nil {
+		g.clock = tstime.StdClock{}
+	}
+	if g.logf == nil {
+		g.logf = logger.Discard
+	}
+	if g.nat == nil {
+		g.nat = &memNAT{ports: map[uint16]netip.AddrPort{}}
+	}
+	g.boot = g.clock.Now().Add(-initialUptime)
+	return g
+}
+
+// SetNAT sets the NAT of the gateway, replacing Options.NAT. It must be
+// called before the gateway handles requests.
+func (g *Gateway) SetNAT(nat NAT) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.nat = nat
+}
+
+// ExternalIP returns the external IP that the gateway reports.
+func (g *Gateway) ExternalIP() netip.Addr {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.externalIPLocked()
+}
+
+func (g *Gateway) externalIPLocked() netip.Addr {
+	if g.externalIP.IsValid() {
+		return g.externalIP
+	}
+	return g.nat.WANIP()
+}
+
+// SetExternalIP makes the gateway report ip as its external IP, whether
+// or not it's that of the NAT, as a gateway behind another NAT or with a
+// stale WAN address does. The zero value reverts to the NAT's WAN IP.
+func (g *Gateway) SetExternalIP(ip netip.Addr) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.externalIP = ip
+}
+
+// SetRefuseMappings sets whether the gateway refuses new mappings and
+// renewals, as a gateway with port mapping turned off or out of
+// resources does. It still answers other requests.
+func (g *Gateway) SetRefuseMappings(refuse bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.refuse = refuse
+}
+
+// SetUnresponsive sets whether the gateway ignores all requests.
+func (g *Gateway) SetUnresponsive(unresponsive bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.unresponsive = unresponsive
+}
+
+// ExpireMappings expires all mappings now, as if their leases ran out,
+// without telling their clients.
+func (g *Gateway) ExpireMappings() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.deleteMappingsLocked()
+}
+
+// ResetEpoch restarts the epoch of the gateway at one second, as a
+// gateway that lost its mappings reports, but keeps the mappings.
+func (g *Gateway) ResetEpoch() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.boot = g.clock.Now().Add(-time.Second)
+}
+
+// Reboot simulates a restart of the gateway: its mappings are lost and
+// its epoch restarts.
+func (g *Gateway) Reboot() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.deleteMappingsLocked()
+	g.boot = g.clock.Now().Add(-time.Second)
+}
+
+// Epoch returns the epoch that the gateway reports: the number of
+// seconds since its mapping table was reset.
+func (g *Gateway) Epoch() uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.epochLocked()
+}
+
+func (g *Gateway) epochLocked() uint32 {
+	return uint32(g.clock.Since(g.boot) / time.Second)
+}
+
+// Mappings returns the current mappings of the gateway, ordered by
+// internal address.
+func (g *Gateway) Mappings() []Mapping {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expireLocked()
+	var ms []Mapping
+	for _, k := range slices.SortedFunc(maps.Keys(g.mappings), netip.AddrPort.Compare) {
+		ms = append(ms, *g.mappings[k])
+	}
+	return ms
+}
+
+// Requests returns the number of requests the gateway received of
+// protocol: "pmp", "pcp", "ssdp" or "upnp".
+func (g *Gateway) Requests(protocol string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests[protocol]
+}
+
+// noteRequest counts a request of protocol and reports whether the
+// gateway answers it.
+func (g *Gateway) noteRequest(protocol string, enabled bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests[protocol]++
+	return enabled && !g.unresponsive
+}
+
+// expireLocked deletes expired mappings.
+func (g *Gateway) expireLocked() {
+	now := g.clock.Now()
+	for k, m := range g.mappings {
+		if !now.Before(m.Expires) {
+			g.logf("portmappertest: %s mapping %v => %v expired", m.Protocol, m.External, m.Internal)
+			g.nat.UnmapPort(m.Internal, m.External.Port())
+			delete(g.mappings, k)
+		}
+	}
+}
+
+func (g *Gateway) deleteMappingsLocked() {
+	for k, m := range g.mappings {
+		g.nat.UnmapPort(m.Internal, m.External.Port())
+		delete(g.mappings, k)
+	}
+}
+
+// errRefused is returned by mapLocked when the gateway refuses mappings.
+var errRefused = errors.New("mapping refused")
+
+// mapLocked creates or renews the mapping of internal for d, preferring
+// the external port want if non-zero. If exact, the mapping must use the
+// external port want.
+func (g *Gateway) mapLocked(protocol string, internal netip.AddrPort, want uint16, d time.Duration, exact bool) (*Mapping, error) {
+	g.expireLocked()
+	if g.refuse {
+		return nil, errRefused
+	}
+	if g.opts.MaxLifetime != 0 {
+		d = min(d, g.opts.MaxLifetime)
+	}
+	if m, ok := g.mappings[internal]; ok {
+		if exact && m.External.Port() != want {
+			// A mapping to another external port; replace it.
+			g.unmapLocked(internal)
+		} else {
+			want = m.External.Port()
+		}
+	}
+	port, ok := g.nat.MapPort(internal, want, d)
+	if !ok {
+		return nil, fmt.Errorf("no port available for %v", internal)
+	}
+	if exact && port != want {
+		g.nat.UnmapPort(internal, port)
+		return nil, fmt.Errorf("port %d is in use", want)
+	}
+	m := &Mapping{
+		Protocol: protocol,
+		Internal: internal,
+		External: netip.AddrPortFrom(g.externalIPLocked(), port),
+		Expires:  g.clock.Now().Add(d),
+	}
+	g.mappings[internal] = m
+	g.logf("portmappertest: %s mapped %v => %v for %v", protocol, m.External, internal, d)
+	return m, nil
+}
+
+// unmapLocked deletes the mapping of internal, if any.
+func (g *Gateway) unmapLocked(internal netip.AddrPort) {
+	if m, ok := g.mappings[internal]; ok {
+		g.logf("portmappertest: %s unmapped %v => %v", m.Protocol, m.External, internal)
+		g.nat.UnmapPort(internal, m.External.Port())
+		delete(g.mappings, internal)
+	}
+}
+
+// memNAT is the NAT of a Gateway without one.
+type memNAT struct {
+	ports map[uint16]netip.AddrPort // external port to internal ip:port; guarded by Gateway.mu
+	next  uint16                    // last allocated port
+}
+
+func (n *memNAT) WANIP() netip.Addr { return DefaultExternalIP }
+
+func (n *memNAT) MapPort(internal netip.AddrPort, want uint16, d time.Duration) (uint16, bool) {
+	for port, ap := range n.ports {
+		if ap == internal {
+			return port, true
+		}
+	}
+	if want >= 1024 {
+		if _, ok := n.ports[want]; !ok {
+			n.ports[want] = internal
+			return want, true
+		}
+	}
+	for range 1 << 15 {
+		n.next++
+		if n.next < 1<<15 {
+			n.next = 1 << 15
+		}
+		if _, ok := n.ports[n.next]; !ok {
+			n.ports[n.next] = internal
+			return n.next, true
+		}
+	}
+	return 0, false
+}
+
+func (n *memNAT) UnmapPort(internal netip.AddrPort, port uint16) {
+	if n.ports[port] == internal {
+		delete(n.ports, port)
+	}
+}
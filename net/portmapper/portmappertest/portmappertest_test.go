@@ -0,0 +1,269 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package portmappertest
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/portmapper"
+	"tailscale.com/net/portmapper/portmappertype"
+	"tailscale.com/tstest"
+	"tailscale.com/util/eventbus"
+	"tailscale.com/util/eventbus/eventbustest"
+)
+
+func TestClient(t *testing.T) {
+	wrongIP := netip.MustParseAddr("198.51.100.7")
+	tests := []struct {
+		name    string
+		opts    Options
+		wrongIP bool
+		want    string // mapping type
+	}{
+		{name: "pmp", opts: Options{PMP: true}, want: "pmp"},
+		{name: "pcp", opts: Options{PCP: true}, want: "pcp"},
+		{name: "upnp", opts: Options{UPnP: true}, want: "upnp"},
+		{name: "all", opts: Options{PMP: true, PCP: true, UPnP: true}, want: "pmp"},
+		{name: "pmp-wrong-ip", opts: Options{PMP: true}, wrongIP: true, want: "pmp"},
+		{name: "upnp-wrong-ip", opts: Options{UPnP: true}, wrongIP: true, want: "upnp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Logf = t.Logf
+			gw := NewGateway(tt.opts)
+			if tt.wrongIP {
+				gw.SetExternalIP(wrongIP)
+			}
+			s, err := NewServer(gw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			bus := eventbustest.NewBus(t)
+			mappings := eventbus.Subscribe[portmappertype.Mapping](bus.Client("test"))
+			c := portmapper.NewClient(portmapper.Config{
+				EventBus:      bus,
+				Logf:          tstest.WhileTestRunningLogger(t),
+				NetMon:        netmon.NewStatic(),
+				GatewayLookup: s.GatewayLookup,
+				PxPPort:       s.PxPPort(),
+				UPnPPort:      s.UPnPPort(),
+			})
+			defer c.Close()
+			c.SetLocalPort(41641)
+
+			res, err := c.Probe(context.Background())
+			if err != nil {
+				t.Fatalf("Probe: %v", err)
+			}
+			if res.PMP != tt.opts.PMP || res.PCP != tt.opts.PCP || res.UPnP != tt.opts.UPnP {
+				t.Errorf("Probe = %+v, want %+v", res, tt.opts)
+			}
+
+			c.GetCachedMappingOrStartCreatingOne()
+			var m portmappertype.Mapping
+			select {
+			case m = <-mappings.Events():
+			case <-time.After(10 * time.Second):
+				t.Fatal("timeout waiting for a mapping")
+			}
+			if m.Type != tt.want {
+				t.Errorf("mapping type = %q, want %q", m.Type, tt.want)
+			}
+			wantIP := DefaultExternalIP
+			if tt.wrongIP {
+				wantIP = wrongIP
+			}
+			gms := gw.Mappings()
+			if len(gms) != 1 {
+				t.Fatalf("gateway mappings = %+v, want 1", gms)
+			}
+			gm := gms[0]
+			if want := netip.AddrPortFrom(loopback, 41641); gm.Internal != want {
+				t.Errorf("internal = %v, want %v", gm.Internal, want)
+			}
+			if want := netip.AddrPortFrom(wantIP, gm.External.Port()); m.External != want {
+				t.Errorf("external = %v, want %v", m.External, want)
+			}
+
+			c.Close()
+			if tt.want != "upnp" {
+				// UPnP mappings are released asynchronously.
+				waitFor(t, func() bool { return len(gw.Mappings()) == 0 })
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for range 100 {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+var (
+	testClient   = netip.MustParseAddrPort("192.168.1.10:41641")
+	testClientIP = testClient.Addr().As16()
+)
+
+func pmpMapRequest(port uint16, lifetime uint32) []byte {
+	pkt := make([]byte, 12)
+	pkt[1] = pmpOpMapUDP
+	binary.BigEndian.PutUint16(pkt[4:], port)
+	binary.BigEndian.PutUint32(pkt[8:], lifetime)
+	return pkt
+}
+
+func pcpMapRequest(port uint16, lifetime uint32) []byte {
+	pkt := make([]byte, pcpHeaderLen+pcpMapLen)
+	pkt[0] = pcpVersion
+	pkt[1] = pcpOpMap
+	binary.BigEndian.PutUint32(pkt[4:], lifetime)
+	copy(pkt[8:], testClientIP[:])
+	binary.BigEndian.PutUint16(pkt[pcpHeaderLen+16:], port)
+	return pkt
+}
+
+// pxpResult returns the result code, epoch and external port of a
+// NAT-PMP or PCP map response.
+func pxpResult(t *testing.T, res []byte) (code int, epoch uint32, port uint16) {
+	t.Helper()
+	switch {
+	case len(res) == 16 && res[0] == pmpVersion:
+		return int(binary.BigEndian.Uint16(res[2:])), binary.BigEndian.Uint32(res[4:]), binary.BigEndian.Uint16(res[10:])
+	case len(res) == pcpHeaderLen+pcpMapLen && res[0] == pcpVersion:
+		return int(res[3]), binary.BigEndian.Uint32(res[8:]), binary.BigEndian.Uint16(res[pcpHeaderLen+18:])
+	}
+	t.Fatalf("bad response % 02x", res)
+	return
+}
+
+func TestFailureModes(t *testing.T) {
+	for _, proto := range []string{"pmp", "pcp"} {
+		t.Run(proto, func(t *testing.T) {
+			clock := tstest.NewClock(tstest.ClockOpts{})
+			gw := NewGateway(Options{PMP: true, PCP: true, MaxLifetime: time.Minute, Clock: clock, Logf: t.Logf})
+			mapReq := pmpMapRequest
+			refused := pmpCodeNotAuthorized
+			if proto == "pcp" {
+				mapReq = pcpMapRequest
+				refused = pcpCodeNotAuthorized
+			}
+			mapPort := func(wantCode int) (epoch uint32, port uint16) {
+				t.Helper()
+				code, epoch, port := pxpResult(t, gw.HandlePxP(mapReq(testClient.Port(), 7200), testClient))
+				if code != wantCode {
+					t.Fatalf("result code %d, want %d", code, wantCode)
+				}
+				return epoch, port
+			}
+			wantMappings := func(n int) {
+				t.Helper()
+				if ms := gw.Mappings(); len(ms) != n {
+					t.Fatalf("mappings = %+v, want %d", ms, n)
+				}
+			}
+
+			epoch, port := mapPort(0)
+			if epoch != uint32(initialUptime/time.Second) {
+				t.Errorf("epoch = %d, want %d", epoch, initialUptime/time.Second)
+			}
+			wantMappings(1)
+			if ms := gw.Mappings(); ms[0].Protocol != proto || ms[0].Expires != clock.Now().Add(time.Minute) {
+				t.Errorf("mapping = %+v", ms[0])
+			}
+
+			// Renewals keep the port, and leases expire.
+			clock.Advance(30 * time.Second)
+			if _, got := mapPort(0); got != port {
+				t.Errorf("renewed port = %d, want %d", got, port)
+			}
+			clock.Advance(time.Minute)
+			wantMappings(0)
+
+			mapPort(0)
+			gw.ExpireMappings()
+			wantMappings(0)
+
+			mapPort(0)
+			gw.ResetEpoch()
+			if epoch, _ := mapPort(0); epoch != 1 {
+				t.Errorf("epoch after reset = %d, want 1", epoch)
+			}
+			wantMappings(1)
+
+			clock.Advance(10 * time.Second)
+			gw.Reboot()
+			wantMappings(0)
+			if epoch, _ := mapPort(0); epoch != 1 {
+				t.Errorf("epoch after reboot = %d, want 1", epoch)
+			}
+
+			gw.SetRefuseMappings(true)
+			mapPort(refused)
+			gw.SetRefuseMappings(false)
+
+			// Deletion.
+			code, _, _ := pxpResult(t, gw.HandlePxP(mapReq(testClient.Port(), 0), testClient))
+			if code != 0 {
+				t.Errorf("delete result code %d", code)
+			}
+			wantMappings(0)
+
+			gw.SetUnresponsive(true)
+			if res := gw.HandlePxP(mapReq(testClient.Port(), 7200), testClient); res != nil {
+				t.Errorf("unresponsive gateway responded % 02x", res)
+			}
+			if got := gw.Requests(proto); got != 9 {
+				t.Errorf("%d %s requests, want 9", got, proto)
+			}
+		})
+	}
+}
+
+func TestPCPAddressMismatch(t *testing.T) {
+	gw := NewGateway(Options{PCP: true})
+	res := gw.HandlePxP(pcpMapRequest(41641, 7200), netip.MustParseAddrPort("192.168.1.11:41641"))
+	if code, _, _ := pxpResult(t, res); code != pcpCodeAddressMismatch {
+		t.Errorf("result code %d, want %d", code, pcpCodeAddressMismatch)
+	}
+}
+
+// testNAT is a NAT that records its mappings.
+type testNAT map[uint16]netip.AddrPort
+
+func (n testNAT) WANIP() netip.Addr { return netip.MustParseAddr("2.1.1.1") }
+
+func (n testNAT) MapPort(internal netip.AddrPort, want uint16, d time.Duration) (uint16, bool) {
+	n[4242] = internal
+	return 4242, true
+}
+
+func (n testNAT) UnmapPort(internal netip.AddrPort, port uint16) { delete(n, port) }
+
+func TestNAT(t *testing.T) {
+	nat := testNAT{}
+	gw := NewGateway(Options{PMP: true, NAT: nat})
+	if got := gw.ExternalIP(); got != nat.WANIP() {
+		t.Errorf("external IP = %v, want %v", got, nat.WANIP())
+	}
+	if _, _, port := pxpResult(t, gw.HandlePxP(pmpMapRequest(41641, 7200), testClient)); port != 4242 || nat[4242] != testClient {
+		t.Errorf("port = %d, NAT = %v", port, nat)
+	}
+	gw.Reboot()
+	if len(nat) != 0 {
+		t.Errorf("NAT after reboot = %v", nat)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package portmappertest
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// References:
+//
+// NAT-PMP: https://www.rfc-editor.org/rfc/rfc6886
+// PCP: https://www.rfc-editor.org/rfc/rfc6887
+
+// PxPPort is the standard port of NAT-PMP and PCP.
+const PxPPort = 5351
+
+const (
+	pmpVersion         = 0
+	pmpOpMapPublicAddr = 0
+	pmpOpMapUDP        = 1
+	pmpOpMapTCP        = 2
+	pmpOpReply         = 0x80
+
+	pmpCodeNotAuthorized     = 2
+	pmpCodeOutOfResources    = 4
+	pmpCodeUnsupportedOpcode = 5
+
+	pcpVersion    = 2
+	pcpOpReply    = 0x80
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	pcpCodeNotAuthorized     = 2
+	pcpCodeMalformedRequest  = 3
+	pcpCodeUnsupportedOpcode = 4
+	pcpCodeNoResources       = 8
+	pcpCodeAddressMismatch   = 12
+
+	pcpHeaderLen = 24
+	pcpMapLen    = 36
+)
+
+// HandlePxP handles the NAT-PMP or PCP request pkt from src, and returns
+// the response to send back to src, or nil for none.
+func (g *Gateway) HandlePxP(pkt []byte, src netip.AddrPort) []byte {
+	if len(pkt) < 2 {
+		return nil
+	}
+	switch pkt[0] {
+	case pmpVersion:
+		if !g.noteRequest("pmp", g.opts.PMP) {
+			return nil
+		}
+		return g.handlePMP(pkt, src)
+	case pcpVersion:
+		if !g.noteRequest("pcp", g.opts.PCP) {
+			return nil
+		}
+		return g.handlePCP(pkt, src)
+	}
+	return nil
+}
+
+func (g *Gateway) handlePMP(pkt []byte, src netip.AddrPort) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	op := pkt[1]
+	res := make([]byte, 8, 16)
+	res[1] = op | pmpOpReply
+	binary.BigEndian.PutUint32(res[4:], g.epochLocked())
+	setCode := func(code uint16) []byte {
+		binary.BigEndian.PutUint16(res[2:], code)
+		return res
+	}
+
+	switch op {
+	case pmpOpMapPublicAddr:
+		ip := g.externalIPLocked().As4()
+		return append(res, ip[:]...)
+	case pmpOpMapUDP, pmpOpMapTCP:
+		if len(pkt) != 12 {
+			return nil
+		}
+		res = append(res, pkt[4:12]...) // internal port, external port, lifetime
+		internal := netip.AddrPortFrom(src.Addr(), binary.BigEndian.Uint16(pkt[4:]))
+		want := binary.BigEndian.Uint16(pkt[6:])
+		lifetime := binary.BigEndian.Uint32(pkt[8:])
+		if lifetime == 0 {
+			g.unmapLocked(internal)
+			binary.BigEndian.PutUint16(res[10:], 0)
+			return res
+		}
+		m, err := g.mapLocked("pmp", internal, want, time.Duration(lifetime)*time.Second, false)
+		if err != nil {
+			g.logf("portmappertest: NAT-PMP map of %v: %v", internal, err)
+			clear(res[10:])
+			if errors.Is(err, errRefused) {
+				return setCode(pmpCodeNotAuthorized)
+			}
+			return setCode(pmpCodeOutOfResources)
+		}
+		binary.BigEndian.PutUint16(res[10:], m.External.Port())
+		binary.BigEndian.PutUint32(res[12:], lifetimeSeconds(m, g.clock.Now()))
+		return res
+	}
+	return setCode(pmpCodeUnsupportedOpcode)
+}
+
+func (g *Gateway) handlePCP(pkt []byte, src netip.AddrPort) []byte {
+	if len(pkt) < pcpHeaderLen {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	op := pkt[1]
+	res := make([]byte, pcpHeaderLen, pcpHeaderLen+pcpMapLen)
+	res[0] = pcpVersion
+	res[1] = op | pcpOpReply
+	binary.BigEndian.PutUint32(res[8:], g.epochLocked())
+	setCode := func(code uint8) []byte {
+		res[3] = code
+		return res
+	}
+
+	if op == pcpOpMap && len(pkt) >= pcpHeaderLen+pcpMapLen {
+		// Responses, including errors, repeat the MAP data of the
+		// request, with the assigned external port and IP on success.
+		res = append(res, pkt[pcpHeaderLen:pcpHeaderLen+pcpMapLen]...)
+	}
+	clientIP := netip.AddrFrom16([16]byte(pkt[8:24])).Unmap()
+	if clientIP != src.Addr() {
+		return setCode(pcpCodeAddressMismatch)
+	}
+	switch op {
+	case pcpOpAnnounce:
+		return res
+	case pcpOpMap:
+		if len(pkt) < pcpHeaderLen+pcpMapLen {
+			return setCode(pcpCodeMalformedRequest)
+		}
+		req := pkt[pcpHeaderLen:]
+		mapRes := res[pcpHeaderLen:]
+		internal := netip.AddrPortFrom(clientIP, binary.BigEndian.Uint16(req[16:]))
+		want := binary.BigEndian.Uint16(req[18:])
+		lifetime := binary.BigEndian.Uint32(pkt[4:])
+		if lifetime == 0 {
+			g.unmapLocked(internal)
+			return res
+		}
+		m, err := g.mapLocked("pcp", internal, want, time.Duration(lifetime)*time.Second, false)
+		if err != nil {
+			g.logf("portmappertest: PCP map of %v: %v", internal, err)
+			if errors.Is(err, errRefused) {
+				return setCode(pcpCodeNotAuthorized)
+			}
+			return setCode(pcpCodeNoResources)
+		}
+		binary.BigEndian.PutUint32(res[4:], lifetimeSeconds(m, g.clock.Now()))
+		binary.BigEndian.PutUint16(mapRes[18:], m.External.Port())
+		ip := m.External.Addr().As16()
+		copy(mapRes[20:], ip[:])
+		return res
+	}
+	return setCode(pcpCodeUnsupportedOpcode)
+}
+
+// lifetimeSeconds returns the remaining lifetime of m at now, in seconds,
+// rounded up.
+func lifetimeSeconds(m *Mapping, now time.Time) uint32 {
+	return uint32((m.Expires.Sub(now) + time.Second - 1) / time.Second)
+}
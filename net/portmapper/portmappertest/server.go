@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package portmappertest
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+)
+
+// loopback is the gateway and client IP of a Server.
+var loopback = netip.MustParseAddr("127.0.0.1")
+
+// Server serves a Gateway on loopback: NAT-PMP and PCP, and UPnP
+// discovery on UDP ports, and UPnP over HTTP.
+//
+// A portmapper.Client uses it with a portmapper.Config whose
+// GatewayLookup, PxPPort and UPnPPort are the Server's.
+type Server struct {
+	gw   *Gateway
+	pxp  *net.UDPConn
+	ssdp *net.UDPConn
+	http *httptest.Server
+	wg   sync.WaitGroup
+}
+
+// NewServer starts serving gw on loopback. The caller must Close the
+// Server.
+func NewServer(gw *Gateway) (*Server, error) {
+	s := &Server{gw: gw}
+	var err error
+	if s.pxp, err = net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.AddrPortFrom(loopback, 0))); err != nil {
+		return nil, err
+	}
+	if s.ssdp, err = net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.AddrPortFrom(loopback, 0))); err != nil {
+		s.pxp.Close()
+		return nil, err
+	}
+	s.http = httptest.NewServer(gw.UPnPHandler())
+	descURL := s.http.URL + upnpDescPath
+	s.wg.Add(2)
+	go s.serveUDP(s.pxp, gw.HandlePxP)
+	go s.serveUDP(s.ssdp, func(pkt []byte, _ netip.AddrPort) []byte {
+		return gw.HandleSSDP(pkt, descURL)
+	})
+	return s, nil
+}
+
+// Gateway returns the gateway that s serves.
+func (s *Server) Gateway() *Gateway { return s.gw }
+
+// GatewayLookup returns the gateway and client IPs of s, as returned by a
+// portmapper.Config.GatewayLookup func.
+func (s *Server) GatewayLookup() (gw, myIP netip.Addr, ok bool) {
+	return loopback, loopback, true
+}
+
+// PxPPort returns the NAT-PMP and PCP port of s.
+func (s *Server) PxPPort() uint16 { return s.pxp.LocalAddr().(*net.UDPAddr).AddrPort().Port() }
+
+// UPnPPort returns the UPnP discovery port of s.
+func (s *Server) UPnPPort() uint16 { return s.ssdp.LocalAddr().(*net.UDPAddr).AddrPort().Port() }
+
+// Close stops serving.
+func (s *Server) Close() error {
+	s.http.Close()
+	err := errors.Join(s.pxp.Close(), s.ssdp.Close())
+	s.wg.Wait()
+	return err
+}
+
+// serveUDP answers the requests on uc with handle until uc is closed.
+func (s *Server) serveUDP(uc *net.UDPConn, handle func(pkt []byte, src netip.AddrPort) []byte) {
+	defer s.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := uc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		if res := handle(buf[:n], src); res != nil {
+			uc.WriteToUDPAddrPort(res, src)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package portmappertest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSDPPort is the standard port of UPnP discovery.
+const SSDPPort = 1900
+
+const (
+	upnpService     = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	upnpDescPath    = "/rootDesc.xml"
+	upnpControlPath = "/ctl/IPConn"
+
+	// UPnP error codes, from the WANIPConnection spec.
+	upnpCodeInvalidAction = 401
+	upnpCodeInvalidArgs   = 402
+	upnpCodeNotAuthorized = 606
+	upnpCodeNoSuchEntry   = 714
+	upnpCodeConflict      = 718
+)
+
+// HandleSSDP handles the SSDP discovery request pkt, and returns the
+// response to send back, or nil for none. descURL is the URL of the
+// device description, served by the gateway's UPnPHandler.
+func (g *Gateway) HandleSSDP(pkt []byte, descURL string) []byte {
+	if !bytes.HasPrefix(pkt, []byte("M-SEARCH ")) || !bytes.Contains(pkt, []byte("ssdp:discover")) {
+		return nil
+	}
+	if !g.noteRequest("ssdp", g.opts.UPnP) {
+		return nil
+	}
+	return fmt.Appendf(nil, "HTTP/1.1 200 OK\r\n"+
+		"CACHE-CONTROL: max-age=120\r\n"+
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n"+
+		"USN: uuid:1974e83b-6dc7-4635-92b3-6a85a4037294::urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n"+
+		"EXT:\r\n"+
+		"SERVER: Tailscale-Test/1.0 UPnP/1.1 MiniUPnPd/2.2.1\r\n"+
+		"LOCATION: %s\r\n"+
+		"\r\n", descURL)
+}
+
+// UPnPHandler returns the HTTP handler of the gateway's UPnP device
+// description and its WANIPConnection:1 service.
+func (g *Gateway) UPnPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+upnpDescPath, func(w http.ResponseWriter, r *http.Request) {
+		if !g.noteRequest("upnp", g.opts.UPnP) {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, rootDesc)
+	})
+	mux.HandleFunc("POST "+upnpControlPath, g.serveUPnPControl)
+	return mux
+}
+
+func (g *Gateway) serveUPnPControl(w http.ResponseWriter, r *http.Request) {
+	if !g.noteRequest("upnp", g.opts.UPnP) {
+		panic(http.ErrAbortHandler)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action, args, err := parseSOAPRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var remoteIP netip.Addr
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		remoteIP = ap.Addr().Unmap()
+	}
+	res, code := g.handleUPnPAction(action, args, remoteIP)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	if code != 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, soapFault, code)
+		return
+	}
+	fmt.Fprintf(w, soapResponse, action, upnpService, res, action)
+}
+
+// handleUPnPAction handles the SOAP action with args from remoteIP, and
+// returns the response arguments as XML, or a UPnP error code.
+func (g *Gateway) handleUPnPAction(action string, args map[string]string, remoteIP netip.Addr) (res string, code int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch action {
+	case "GetStatusInfo":
+		uptime := g.clock.Since(g.boot) / time.Second
+		return fmt.Sprintf("<NewConnectionStatus>Connected</NewConnectionStatus>"+
+			"<NewLastConnectionError>ERROR_NONE</NewLastConnectionError>"+
+			"<NewUptime>%d</NewUptime>", uptime), 0
+	case "GetExternalIPAddress":
+		return fmt.Sprintf("<NewExternalIPAddress>%v</NewExternalIPAddress>", g.externalIPLocked()), 0
+	case "AddPortMapping":
+		if !strings.EqualFold(args["NewProtocol"], "UDP") && !strings.EqualFold(args["NewProtocol"], "TCP") {
+			return "", upnpCodeInvalidArgs
+		}
+		ip, err := netip.ParseAddr(args["NewInternalClient"])
+		if err != nil {
+			return "", upnpCodeInvalidArgs
+		}
+		internalPort, err1 := strconv.ParseUint(args["NewInternalPort"], 10, 16)
+		externalPort, err2 := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		lease, err3 := strconv.ParseUint(args["NewLeaseDuration"], 10, 32)
+		if err := errors.Join(err1, err2, err3); err != nil || externalPort == 0 {
+			return "", upnpCodeInvalidArgs
+		}
+		if remoteIP.IsValid() && !remoteIP.IsLoopback() && ip != remoteIP {
+			// Like miniupnpd, only allow clients to map ports to themselves.
+			return "", upnpCodeNotAuthorized
+		}
+		d := time.Duration(lease) * time.Second
+		if lease == 0 {
+			d = permanentLease
+		}
+		internal := netip.AddrPortFrom(ip, uint16(internalPort))
+		if _, err := g.mapLocked("upnp", internal, uint16(externalPort), d, true); err != nil {
+			g.logf("portmappertest: UPnP map of %v: %v", internal, err)
+			if errors.Is(err, errRefused) {
+				return "", upnpCodeNotAuthorized
+			}
+			return "", upnpCodeConflict
+		}
+		return "", 0
+	case "DeletePortMapping":
+		externalPort, err := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		if err != nil {
+			return "", upnpCodeInvalidArgs
+		}
+		for internal, m := range g.mappings {
+			if m.Protocol == "upnp" && m.External.Port() == uint16(externalPort) {
+				g.unmapLocked(internal)
+				return "", 0
+			}
+		}
+		return "", upnpCodeNoSuchEntry
+	}
+	return "", upnpCodeInvalidAction
+}
+
+// parseSOAPRequest returns the action and arguments of a SOAP request.
+func parseSOAPRequest(body []byte) (action string, args map[string]string, err error) {
+	var env struct {
+		Body struct {
+			Action struct {
+				XMLName xml.Name
+				Args    []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return "", nil, err
+	}
+	if env.Body.Action.XMLName.Local == "" {
+		return "", nil, errors.New("no SOAP action")
+	}
+	args = map[string]string{}
+	for _, a := range env.Body.Action.Args {
+		args[a.XMLName.Local] = strings.TrimSpace(a.Value)
+	}
+	return env.Body.Action.XMLName.Local, args, nil
+}
+
+const soapResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+  <s:Body>
+    <u:%sResponse xmlns:u="%s">%s</u:%sResponse>
+  </s:Body>
+</s:Envelope>
+`
+
+const soapFault = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+  <s:Body>
+    <s:Fault>
+      <faultcode>s:Client</faultcode>
+      <faultstring>UPnPError</faultstring>
+      <detail>
+        <UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+          <errorCode>%d</errorCode>
+        </UPnPError>
+      </detail>
+    </s:Fault>
+  </s:Body>
+</s:Envelope>
+`
+
+const rootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion>
+    <major>1</major>
+    <minor>1</minor>
+  </specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <friendlyName>Tailscale Test Gateway</friendlyName>
+    <manufacturer>Tailscale</manufacturer>
+    <modelName>portmappertest</modelName>
+    <UDN>uuid:1974e83b-6dc7-4635-92b3-6a85a4037294</UDN>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <friendlyName>WANDevice</friendlyName>
+        <UDN>uuid:1974e83b-6dc7-4635-92b3-6a85a4037295</UDN>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <friendlyName>WANConnectionDevice</friendlyName>
+            <UDN>uuid:1974e83b-6dc7-4635-92b3-6a85a4037296</UDN>
+            <serviceList>
+              <service>
+                <serviceType>` + upnpService + `</serviceType>
+                <serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+                <SCPDURL>/WANIPCn.xml</SCPDURL>
+                <controlURL>` + upnpControlPath + `</controlURL>
+                <eventSubURL>/evt/IPConn</eventSubURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>
+`
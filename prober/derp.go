@@ -34,6 +34,7 @@
 	"tailscale.com/client/local"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	_ "tailscale.com/feature/derpquic" // for QUIC probes
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/stun"
 	"tailscale.com/net/tstun"
@@ -52,6 +53,7 @@ type derpProber struct {
 	udpInterval  time.Duration
 	meshInterval time.Duration
 	tlsInterval  time.Duration
+	quicInterval time.Duration
 
 	// Optional bandwidth probing.
 	bwInterval      time.Duration
@@ -72,6 +74,7 @@ type derpProber struct {
 	tlsProbeFn  func(string, *tls.Config) ProbeClass
 	udpProbeFn  func(string, int) ProbeClass
 	meshProbeFn func(string, string) ProbeClass
+	quicProbeFn func(string) ProbeClass
 	bwProbeFn   func(string, string, int64) ProbeClass
 	qdProbeFn   func(string, string, int, time.Duration, key.DERPMesh) ProbeClass
 
@@ -137,6 +140,15 @@ func WithTLSProbing(interval time.Duration) DERPOpt {
 	}
 }
 
+// WithQUICProbing enables QUIC probing, which connects to each DERP server
+// that has a QUIC port over QUIC, without falling back to TCP, every
+// `interval`.
+func WithQUICProbing(interval time.Duration) DERPOpt {
+	return func(d *derpProber) {
+		d.quicInterval = interval
+	}
+}
+
 // WithRegionCodeOrID restricts probing to the specified region identified by its code
 // (e.g. "lax") or its id (e.g. "17"). This is case sensitive.
 func WithRegionCodeOrID(regionCode string) DERPOpt {
@@ -172,6 +184,7 @@ func DERP(p *Prober, derpMapURL string, opts ...DERPOpt) (*derpProber, error) {
 	}
 	d.udpProbeFn = d.ProbeUDP
 	d.meshProbeFn = d.probeMesh
+	d.quicProbeFn = d.probeQUIC
 	d.bwProbeFn = d.probeBandwidth
 	d.qdProbeFn = d.probeQueuingDelay
 	return d, nil
@@ -211,6 +224,15 @@ func (d *derpProber) probeMapFn(ctx context.Context) error {
 				}
 			}
 
+			if d.quicInterval > 0 && server.QUICPort > 0 && !server.STUNOnly {
+				n := fmt.Sprintf("derp/%s/%s/quic", region.RegionCode, server.Name)
+				wantProbes[n] = true
+				if d.probes[n] == nil {
+					log.Printf("adding DERP QUIC probe for %s (%s) every %v", server.Name, region.RegionName, d.quicInterval)
+					d.probes[n] = d.p.Run(n, d.quicInterval, labels, d.quicProbeFn(server.Name))
+				}
+			}
+
 			if d.udpInterval > 0 {
 				for idx, ipStr := range []string{server.IPv6, server.IPv4} {
 					n := fmt.Sprintf("derp/%s/%s/udp", region.RegionCode, server.Name)
@@ -299,6 +321,29 @@ func (d *derpProber) probeMesh(from, to string) ProbeClass {
 	}
 }
 
+// probeQUIC returns a probe class that connects to the DERP server named
+// name (DERPNode.Name) over QUIC, without falling back to TCP.
+func (d *derpProber) probeQUIC(name string) ProbeClass {
+	return ProbeClass{
+		Probe: func(ctx context.Context) error {
+			n, _, err := d.getNodePair(name, name)
+			if err != nil {
+				return err
+			}
+			dc, err := newConnOpts(ctx, d.lastDERPMap, n, true, d.meshKey, true)
+			if err != nil {
+				return err
+			}
+			defer dc.Close()
+			if !dc.UsingQUIC() {
+				return errors.New("not connected over QUIC")
+			}
+			return nil
+		},
+		Class: "derp_quic",
+	}
+}
+
 // probeBandwidth returns a probe class that sends a payload of a given size
 // through a pair of DERP servers (or just one server, if 'from' and 'to' are
 // the same). 'from' and 'to' are expected to be names (DERPNode.Name) of two
@@ -1145,6 +1190,12 @@ func derpProbeBandwidthTUN(ctx context.Context, transferTimeSeconds, totalBytesT
 }
 
 func newConn(ctx context.Context, dm *tailcfg.DERPMap, n *tailcfg.DERPNode, isProber bool, meshKey key.DERPMesh) (*derphttp.Client, error) {
+	return newConnOpts(ctx, dm, n, isProber, meshKey, false)
+}
+
+// newConnOpts is like newConn, but if forceQUIC is set, it connects to n
+// over QUIC only.
+func newConnOpts(ctx context.Context, dm *tailcfg.DERPMap, n *tailcfg.DERPNode, isProber bool, meshKey key.DERPMesh, forceQUIC bool) (*derphttp.Client, error) {
 	// To avoid spamming the log with regular connection messages.
 	l := logger.Filtered(log.Printf, func(s string) bool {
 		return !strings.Contains(s, "derphttp.Client.Connect: connecting to")
@@ -1161,6 +1212,7 @@ func newConn(ctx context.Context, dm *tailcfg.DERPMap, n *tailcfg.DERPNode, isPr
 	})
 	dc.IsProber = isProber
 	dc.MeshKey = meshKey
+	dc.ForceQUIC = forceQUIC
 	err := dc.Connect(ctx)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,196 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package cast reads asciinema v2 session recordings, as written by
+// Tailscale SSH and the Kubernetes API server proxy, and provides playback,
+// text search and indexing of them.
+//
+// See https://docs.asciinema.org/manual/asciicast/v2/ for the file format.
+package cast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"tailscale.com/sessionrecording"
+)
+
+// Event types, as defined by the asciinema v2 format.
+const (
+	EventOutput = "o" // data written to the terminal
+	EventInput  = "i" // data read from the terminal, such as keystrokes
+	EventResize = "r" // terminal resize, with data "COLSxROWS"
+	EventMarker = "m" // marker, with an optional label as data
+)
+
+// Event is an event in a recording.
+type Event struct {
+	// Time is the time of the event since the start of the recording.
+	Time time.Duration
+	// Type is the event type, such as EventOutput.
+	Type string
+	// Data is the event data, such as the output text for EventOutput.
+	Data string
+}
+
+// Reader reads the events of a recording.
+type Reader struct {
+	br     *bufio.Reader
+	header sessionrecording.CastHeader
+	line   int // number of the last line read
+}
+
+// NewReader returns a Reader for the recording in r, after reading its
+// header. It returns an error if the recording isn't in asciinema v2
+// format.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{br: bufio.NewReader(r)}
+	line, err := cr.readLine()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("empty recording")
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(line, &cr.header); err != nil {
+		return nil, fmt.Errorf("parsing header: %w", err)
+	}
+	if cr.header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciinema version %d", cr.header.Version)
+	}
+	return cr, nil
+}
+
+// Header returns the header of the recording.
+func (r *Reader) Header() *sessionrecording.CastHeader {
+	return &r.header
+}
+
+// readLine returns the next non-empty line. It returns io.EOF at the end of
+// the recording, or io.ErrUnexpectedEOF if the last line is incomplete, as
+// happens when a recording was cut short.
+func (r *Reader) readLine() ([]byte, error) {
+	for {
+		line, err := r.br.ReadBytes('\n')
+		if len(line) > 0 && err == io.EOF {
+			// A line without a newline is complete if it parses;
+			// let the caller decide.
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.line++
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// Next returns the next event of the recording. It returns io.EOF at the
+// end of the recording, and io.ErrUnexpectedEOF if the recording ends with
+// an incomplete event, as happens when a session's connection to the
+// recorder was lost.
+func (r *Reader) Next() (Event, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Event{}, err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(line, &raw); err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) && r.atEOF() {
+			return Event{}, io.ErrUnexpectedEOF
+		}
+		return Event{}, fmt.Errorf("line %d: %w", r.line, err)
+	}
+	if len(raw) != 3 {
+		return Event{}, fmt.Errorf("line %d: event has %d elements, want 3", r.line, len(raw))
+	}
+	var (
+		secs float64
+		ev   Event
+	)
+	if err := json.Unmarshal(raw[0], &secs); err != nil {
+		return Event{}, fmt.Errorf("line %d: event time: %w", r.line, err)
+	}
+	if err := json.Unmarshal(raw[1], &ev.Type); err != nil {
+		return Event{}, fmt.Errorf("line %d: event type: %w", r.line, err)
+	}
+	if err := json.Unmarshal(raw[2], &ev.Data); err != nil {
+		return Event{}, fmt.Errorf("line %d: event data: %w", r.line, err)
+	}
+	ev.Time = time.Duration(secs * float64(time.Second))
+	return ev, nil
+}
+
+// atEOF reports whether all of the recording has been read.
+func (r *Reader) atEOF() bool {
+	_, err := r.br.Peek(1)
+	return err == io.EOF
+}
+
+// Recording is a recording read into memory.
+type Recording struct {
+	Header sessionrecording.CastHeader
+	Events []Event
+
+	// Truncated is whether the recording ends with an incomplete event,
+	// which was dropped.
+	Truncated bool
+}
+
+// Duration returns the time of the last event of the recording.
+func (rec *Recording) Duration() time.Duration {
+	if len(rec.Events) == 0 {
+		return 0
+	}
+	return rec.Events[len(rec.Events)-1].Time
+}
+
+// Start returns the time the recording started.
+func (rec *Recording) Start() time.Time {
+	return time.Unix(rec.Header.Timestamp, 0)
+}
+
+// Read reads all of the recording in r.
+func Read(r io.Reader) (*Recording, error) {
+	cr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recording{Header: *cr.Header()}
+	for {
+		ev, err := cr.Next()
+		switch {
+		case err == io.EOF:
+			return rec, nil
+		case err == io.ErrUnexpectedEOF:
+			rec.Truncated = true
+			return rec, nil
+		case err != nil:
+			return nil, err
+		}
+		rec.Events = append(rec.Events, ev)
+	}
+}
+
+// ReadFile reads the recording in the named file.
+func ReadFile(name string) (*Recording, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rec, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return rec, nil
+}
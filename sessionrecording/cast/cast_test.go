@@ -0,0 +1,320 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cast
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tstest"
+	"tailscale.com/tstime"
+)
+
+// writeCast returns a recording with header h and events, in the format
+// written by Tailscale SSH and the Kubernetes API server proxy.
+func writeCast(t *testing.T, h sessionrecording.CastHeader, events ...Event) string {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(h); err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range events {
+		if err := enc.Encode([]any{ev.Time.Seconds(), ev.Type, ev.Data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+var sshHeader = sessionrecording.CastHeader{
+	Version:      2,
+	Width:        80,
+	Height:       24,
+	Timestamp:    1700000000,
+	SrcNode:      "laptop.tail-scale.ts.net",
+	SrcNodeID:    "nLaptop",
+	SrcNodeUser:  "alice@example.com",
+	SSHUser:      "root",
+	LocalUser:    "root",
+	ConnectionID: "conn-1",
+	Env:          map[string]string{"TERM": "xterm-256color"},
+}
+
+func TestRead(t *testing.T) {
+	events := []Event{
+		{Time: 100 * time.Millisecond, Type: EventOutput, Data: "$ "},
+		{Time: 1500 * time.Millisecond, Type: EventInput, Data: "l"},
+		{Time: 2 * time.Second, Type: EventResize, Data: "100x30"},
+	}
+	rec, err := Read(strings.NewReader(writeCast(t, sshHeader, events...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(sshHeader, rec.Header); diff != "" {
+		t.Errorf("header mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(events, rec.Events); diff != "" {
+		t.Errorf("events mismatch (-want +got):\n%s", diff)
+	}
+	if rec.Truncated {
+		t.Error("recording is truncated")
+	}
+	if got, want := rec.Duration(), 2*time.Second; got != want {
+		t.Errorf("Duration = %v; want %v", got, want)
+	}
+	if got, want := rec.Start(), time.Unix(1700000000, 0); !got.Equal(want) {
+		t.Errorf("Start = %v; want %v", got, want)
+	}
+}
+
+func TestReadKubernetes(t *testing.T) {
+	// As written by the Kubernetes API server proxy, whose Kubernetes
+	// metadata has no JSON tags.
+	const recording = `{"version":2,"width":0,"height":0,"timestamp":1700000000,"srcNode":"dev.tail-scale.ts.net","srcNodeID":"nDev","env":null,"sshUser":"","localUser":"","connectionID":"","kubernetes":{"PodName":"web-0","Namespace":"prod","Container":"app","SessionType":"exec"}}
+[0.5,"o","hello\r\n"]
+`
+	rec, err := Read(strings.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &sessionrecording.Kubernetes{PodName: "web-0", Namespace: "prod", Container: "app", SessionType: "exec"}
+	if diff := cmp.Diff(want, rec.Header.Kubernetes); diff != "" {
+		t.Errorf("Kubernetes mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            string
+		wantErr       string
+		wantTruncated bool
+	}{
+		{name: "empty", in: "", wantErr: "empty recording"},
+		{name: "bad header", in: "not json\n", wantErr: "parsing header"},
+		{name: "v1", in: `{"version":1}` + "\n", wantErr: "unsupported asciinema version 1"},
+		{name: "bad event", in: `{"version":2}` + "\n[1,\"o\"]\n", wantErr: "line 2: event has 2 elements"},
+		{name: "bad event in middle", in: `{"version":2}` + "\n[1,\"o\",\n[2,\"o\",\"x\"]\n", wantErr: "line 2"},
+		{name: "truncated", in: `{"version":2}` + "\n[1,\"o\",\"x\"]\n[2,\"o\",\"hel", wantTruncated: true},
+		{name: "no final newline", in: `{"version":2}` + "\n[1,\"o\",\"x\"]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := Read(strings.NewReader(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Truncated != tt.wantTruncated {
+				t.Errorf("Truncated = %v; want %v", rec.Truncated, tt.wantTruncated)
+			}
+			if len(rec.Events) != 1 {
+				t.Errorf("got %d events, want 1", len(rec.Events))
+			}
+		})
+	}
+}
+
+func TestReaderNext(t *testing.T) {
+	r, err := NewReader(strings.NewReader(writeCast(t, sshHeader, Event{Time: time.Second, Type: EventMarker, Data: "x"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header().ConnectionID != "conn-1" {
+		t.Errorf("Header().ConnectionID = %q", r.Header().ConnectionID)
+	}
+	if ev, err := r.Next(); err != nil || ev.Type != EventMarker {
+		t.Errorf("Next = %+v, %v", ev, err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next at end = %v; want io.EOF", err)
+	}
+}
+
+func TestLines(t *testing.T) {
+	rec := &Recording{Events: []Event{
+		// Prompt with colors and a window title.
+		{Time: 0, Type: EventOutput, Data: "\x1b]0;root@host\x07\x1b[01;32mroot@host\x1b[00m:~# "},
+		// Typing "ls -la" with a typo fixed, echoed back.
+		{Time: 1 * time.Second, Type: EventInput, Data: "l"},
+		{Time: 1 * time.Second, Type: EventOutput, Data: "l"},
+		{Time: 2 * time.Second, Type: EventInput, Data: "x"},
+		{Time: 2 * time.Second, Type: EventOutput, Data: "x"},
+		{Time: 3 * time.Second, Type: EventInput, Data: "\x7f"},
+		{Time: 3 * time.Second, Type: EventOutput, Data: "\b\x1b[K"},
+		{Time: 4 * time.Second, Type: EventInput, Data: "s -la\r"},
+		{Time: 4 * time.Second, Type: EventOutput, Data: "s -la\r\n"},
+		{Time: 5 * time.Second, Type: EventOutput, Data: "total 0\r\nsecret.txt\r\n"},
+		// An abandoned command and a killed line.
+		{Time: 6 * time.Second, Type: EventInput, Data: "rm -rf /\x03"},
+		{Time: 7 * time.Second, Type: EventInput, Data: "oops\x15cat secret.txt\r"},
+		// A command recalled with the up arrow key.
+		{Time: 8 * time.Second, Type: EventInput, Data: "\x1b[A\x1bOA\r"},
+		// A progress bar, overwritten with carriage returns.
+		{Time: 9 * time.Second, Type: EventOutput, Data: "10%\r50%\r\x1b[K100%\r\n"},
+	}}
+
+	wantInput := []Line{
+		{Time: 1 * time.Second, Type: EventInput, Text: "ls -la"},
+		{Time: 7 * time.Second, Type: EventInput, Text: "cat secret.txt"},
+	}
+	if diff := cmp.Diff(wantInput, rec.Lines(EventInput)); diff != "" {
+		t.Errorf("input lines mismatch (-want +got):\n%s", diff)
+	}
+	wantOutput := []Line{
+		{Time: 0, Type: EventOutput, Text: "root@host:~# ls -la"},
+		{Time: 5 * time.Second, Type: EventOutput, Text: "total 0"},
+		{Time: 5 * time.Second, Type: EventOutput, Text: "secret.txt"},
+		{Time: 9 * time.Second, Type: EventOutput, Text: "100%"},
+	}
+	if diff := cmp.Diff(wantOutput, rec.Lines(EventOutput)); diff != "" {
+		t.Errorf("output lines mismatch (-want +got):\n%s", diff)
+	}
+
+	got := rec.Search(regexp.MustCompile(`secret`))
+	want := []Line{
+		{Time: 5 * time.Second, Type: EventOutput, Text: "secret.txt"},
+		{Time: 7 * time.Second, Type: EventInput, Text: "cat secret.txt"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Search mismatch (-want +got):\n%s", diff)
+	}
+	if got := rec.Search(regexp.MustCompile(`secret`), EventInput); len(got) != 1 {
+		t.Errorf("Search of input = %v; want 1 match", got)
+	}
+}
+
+// timerClock is a tstest.Clock that reports the duration of each timer
+// created.
+type timerClock struct {
+	*tstest.Clock
+	timers chan time.Duration
+}
+
+func (c timerClock) NewTimer(d time.Duration) (tstime.TimerController, <-chan time.Time) {
+	t, ch := c.Clock.NewTimer(d)
+	c.timers <- d
+	return t, ch
+}
+
+func TestPlay(t *testing.T) {
+	rec := &Recording{Events: []Event{
+		{Time: 1 * time.Second, Type: EventOutput, Data: "a"},
+		{Time: 1 * time.Second, Type: EventInput, Data: "ignored"},
+		{Time: 3 * time.Second, Type: EventOutput, Data: "b"},
+		{Time: 103 * time.Second, Type: EventOutput, Data: "c"},
+	}}
+	clock := timerClock{
+		Clock:  tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)}),
+		timers: make(chan time.Duration),
+	}
+
+	var (
+		buf  bytes.Buffer
+		done = make(chan error, 1)
+	)
+	go func() {
+		done <- Play(context.Background(), &buf, rec, PlayOptions{
+			Speed:   2,
+			MaxIdle: 10 * time.Second,
+			Clock:   clock,
+		})
+	}()
+
+	// At 2x with idle time capped at 10s, "a" is written after 0.5s, "b"
+	// after 1.5s and "c" after 6.5s.
+	for _, step := range []struct {
+		wait       time.Duration
+		wantBefore string
+	}{
+		{500 * time.Millisecond, ""},
+		{1 * time.Second, "a"},
+		{5 * time.Second, "ab"},
+	} {
+		if d := <-clock.timers; d != step.wait {
+			t.Fatalf("waiting %v; want %v", d, step.wait)
+		}
+		if got := buf.String(); got != step.wantBefore {
+			t.Fatalf("output before waiting %v = %q; want %q", step.wait, got, step.wantBefore)
+		}
+		clock.Advance(step.wait)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "abc" {
+		t.Errorf("output = %q; want %q", got, "abc")
+	}
+}
+
+func TestPlayCanceled(t *testing.T) {
+	rec := &Recording{Events: []Event{{Time: time.Hour, Type: EventOutput, Data: "x"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Play(ctx, io.Discard, rec, PlayOptions{}); err != context.Canceled {
+		t.Errorf("Play = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	var ix Index
+	ix.Add("a.cast", &Recording{Header: sshHeader, Events: []Event{{Time: 5 * time.Second, Type: EventOutput}}})
+	h2 := sshHeader
+	h2.SSHUser, h2.LocalUser = "bob", "bob"
+	ix.Add("b.cast", &Recording{Header: h2, Truncated: true})
+	ix.Add("k.cast", &Recording{Header: sessionrecording.CastHeader{
+		Version:    2,
+		Timestamp:  1700000100,
+		SrcNode:    "dev.tail-scale.ts.net",
+		Kubernetes: &sessionrecording.Kubernetes{PodName: "web-0", Namespace: "prod"},
+	}})
+
+	b, err := json.Marshal(ix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"bySrcNode": map[string]any{
+			"laptop.tail-scale.ts.net": []any{"a.cast", "b.cast"},
+			"dev.tail-scale.ts.net":    []any{"k.cast"},
+		},
+		"bySSHUser":      map[string]any{"root": []any{"a.cast"}, "bob": []any{"b.cast"}},
+		"byLocalUser":    map[string]any{"root": []any{"a.cast"}, "bob": []any{"b.cast"}},
+		"byConnectionID": map[string]any{"conn-1": []any{"a.cast", "b.cast"}},
+	}
+	for k, v := range want {
+		if diff := cmp.Diff(v, got[k]); diff != "" {
+			t.Errorf("%s mismatch (-want +got):\n%s", k, diff)
+		}
+	}
+
+	a := ix.Recordings[0]
+	if a.Duration != 5 || a.Start != time.Unix(1700000000, 0).UTC() || a.SrcNodeUser != "alice@example.com" {
+		t.Errorf("a.cast entry = %+v", a)
+	}
+	if !ix.Recordings[1].Truncated {
+		t.Error("b.cast entry not truncated")
+	}
+	if k := ix.Recordings[2].Kubernetes; k == nil || k.PodName != "web-0" {
+		t.Errorf("k.cast entry Kubernetes = %+v", k)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cast
+
+import (
+	"time"
+
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
+)
+
+// IndexEntry describes a recording in an Index.
+type IndexEntry struct {
+	// Path is the path of the recording file.
+	Path string `json:"path"`
+
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"durationSeconds"`
+
+	SrcNode     string               `json:"srcNode"`
+	SrcNodeID   tailcfg.StableNodeID `json:"srcNodeID"`
+	SrcNodeUser string               `json:"srcNodeUser,omitempty"`
+	SrcNodeTags []string             `json:"srcNodeTags,omitempty"`
+
+	// Tailscale SSH sessions only.
+	SSHUser      string `json:"sshUser,omitempty"`
+	LocalUser    string `json:"localUser,omitempty"`
+	ConnectionID string `json:"connectionID,omitempty"`
+	Command      string `json:"command,omitempty"`
+
+	// Kubernetes API server proxy sessions only.
+	Kubernetes *sessionrecording.Kubernetes `json:"kubernetes,omitempty"`
+
+	// Truncated is whether the recording was cut short.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Index is an index of recordings, for finding the sessions of a node, user
+// or SSH connection. Its JSON form is meant for use by other tools, such as
+// for compliance reviews.
+type Index struct {
+	// Recordings are the indexed recordings, in the order added.
+	Recordings []IndexEntry `json:"recordings"`
+
+	// The maps below map keys to the paths of the recordings with that
+	// key, in the order added. Recordings without a key, such as
+	// Kubernetes sessions without SSHUser, aren't in that key's map.
+	BySrcNode      map[string][]string `json:"bySrcNode"`
+	BySSHUser      map[string][]string `json:"bySSHUser"`
+	ByLocalUser    map[string][]string `json:"byLocalUser"`
+	ByConnectionID map[string][]string `json:"byConnectionID"`
+}
+
+// Add adds the recording rec, read from path, to the index.
+func (ix *Index) Add(path string, rec *Recording) {
+	h := rec.Header
+	ix.Recordings = append(ix.Recordings, IndexEntry{
+		Path:         path,
+		Start:        rec.Start().UTC(),
+		Duration:     rec.Duration().Seconds(),
+		SrcNode:      h.SrcNode,
+		SrcNodeID:    h.SrcNodeID,
+		SrcNodeUser:  h.SrcNodeUser,
+		SrcNodeTags:  h.SrcNodeTags,
+		SSHUser:      h.SSHUser,
+		LocalUser:    h.LocalUser,
+		ConnectionID: h.ConnectionID,
+		Command:      h.Command,
+		Kubernetes:   h.Kubernetes,
+		Truncated:    rec.Truncated,
+	})
+	addKey(&ix.BySrcNode, h.SrcNode, path)
+	addKey(&ix.BySSHUser, h.SSHUser, path)
+	addKey(&ix.ByLocalUser, h.LocalUser, path)
+	addKey(&ix.ByConnectionID, h.ConnectionID, path)
+}
+
+func addKey(m *map[string][]string, key, path string) {
+	if key == "" {
+		return
+	}
+	mak.Set(m, key, append((*m)[key], path))
+}
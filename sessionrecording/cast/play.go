@@ -0,0 +1,66 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cast
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"tailscale.com/tstime"
+)
+
+// PlayOptions are options for Play.
+type PlayOptions struct {
+	// Speed is the playback speed, relative to the original. Zero means 1.
+	Speed float64
+
+	// MaxIdle, if non-zero, is the longest pause between events during
+	// playback, before scaling by Speed.
+	MaxIdle time.Duration
+
+	// Clock, if non-nil, is the clock used for timing playback.
+	Clock tstime.Clock
+}
+
+// Play writes the output of the recording rec to w with the timing of the
+// original session, as adjusted by opts. It returns when all of the output
+// has been written, or ctx is done.
+func Play(ctx context.Context, w io.Writer, rec *Recording, opts PlayOptions) error {
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	clock := tstime.DefaultClock{Clock: opts.Clock}
+
+	var (
+		start   = clock.Now()
+		elapsed time.Duration // playback time of the previous event
+		last    time.Duration // recording time of the previous event
+	)
+	for _, ev := range rec.Events {
+		if ev.Type != EventOutput {
+			continue
+		}
+		gap := ev.Time - last
+		if opts.MaxIdle > 0 && gap > opts.MaxIdle {
+			gap = opts.MaxIdle
+		}
+		last = ev.Time
+		elapsed += time.Duration(float64(gap) / speed)
+		if d := elapsed - clock.Since(start); d > 0 {
+			t, c := clock.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-c:
+			}
+		}
+		if _, err := io.WriteString(w, ev.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cast
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Line is a line of text typed into or written to the terminal during a
+// recorded session, with terminal control sequences removed.
+type Line struct {
+	// Time is the time of the event that started the line, since the
+	// start of the recording.
+	Time time.Duration
+	// Type is EventInput for typed lines, such as commands entered at a
+	// shell prompt, or EventOutput for output.
+	Type string
+	Text string
+}
+
+// Lines returns the non-empty lines of text of the given event type,
+// EventInput or EventOutput, in rec.
+//
+// Typed lines are reconstructed from keystrokes, applying backspace and
+// line kill (^U), and dropping lines abandoned with ^C. Output lines are
+// as they would appear on a terminal for line-oriented output; the output
+// of full-screen programs such as editors is approximate.
+func (rec *Recording) Lines(typ string) []Line {
+	b := &lineBuilder{typ: typ}
+	for _, ev := range rec.Events {
+		if ev.Type == typ {
+			b.write(ev.Time, ev.Data)
+		}
+	}
+	b.endLine()
+	return b.lines
+}
+
+// Search returns the lines of rec that match re, of the given event types
+// (EventInput or EventOutput). If no types are given, both are searched.
+// The lines are in order of time.
+func (rec *Recording) Search(re *regexp.Regexp, types ...string) []Line {
+	if len(types) == 0 {
+		types = []string{EventInput, EventOutput}
+	}
+	var matches []Line
+	for _, typ := range types {
+		for _, l := range rec.Lines(typ) {
+			if re.MatchString(l.Text) {
+				matches = append(matches, l)
+			}
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b Line) int {
+		return cmp.Compare(a.Time, b.Time)
+	})
+	return matches
+}
+
+// escState is the state of parsing a terminal escape sequence.
+type escState int
+
+const (
+	escNone   escState = iota // not in an escape sequence
+	escStart                  // after ESC
+	escCSI                    // in a control sequence (ESC [)
+	escOSC                    // in an operating system command (ESC ])
+	escOSCEnd                 // after ESC in an operating system command
+	escSS3                    // after ESC O, such as in arrow keys
+)
+
+// lineBuilder splits terminal input or output into lines of text.
+type lineBuilder struct {
+	typ   string
+	esc   escState
+	cr    bool // last character was a carriage return (output only)
+	buf   []rune
+	start time.Duration // time of the first character of buf
+	lines []Line
+}
+
+func (b *lineBuilder) write(t time.Duration, data string) {
+	for _, r := range data {
+		if b.escape(r) {
+			continue
+		}
+		cr := b.cr
+		b.cr = false
+		switch {
+		case r == '\n':
+			b.endLine()
+		case r == '\r' && b.typ == EventInput:
+			b.endLine()
+		case r == '\r':
+			b.cr = true
+		case r == '\b' || r == 0x7f:
+			if len(b.buf) > 0 {
+				b.buf = b.buf[:len(b.buf)-1]
+			}
+		case r == 0x15 && b.typ == EventInput: // ^U
+			b.buf = b.buf[:0]
+		case r == 0x03 && b.typ == EventInput: // ^C
+			b.buf = b.buf[:0]
+		case r < ' ' && r != '\t':
+			// Other control characters don't print.
+		default:
+			if cr {
+				// A carriage return not followed by a newline
+				// overwrites the line, as progress bars do.
+				b.buf = b.buf[:0]
+			}
+			if len(b.buf) == 0 {
+				b.start = t
+			}
+			b.buf = append(b.buf, r)
+		}
+	}
+}
+
+// escape reports whether r is part of a terminal escape sequence, and
+// advances the escape sequence state.
+func (b *lineBuilder) escape(r rune) bool {
+	switch b.esc {
+	case escNone:
+		if r == 0x1b {
+			b.esc = escStart
+			return true
+		}
+		return false
+	case escStart:
+		switch r {
+		case '[':
+			b.esc = escCSI
+		case ']':
+			b.esc = escOSC
+		case 'O':
+			b.esc = escSS3
+		default:
+			// A two character escape sequence.
+			b.esc = escNone
+		}
+	case escCSI:
+		// Parameter and intermediate bytes are 0x20-0x3f; the
+		// final byte is 0x40-0x7e.
+		if r >= 0x40 && r <= 0x7e {
+			b.esc = escNone
+		}
+	case escOSC:
+		switch r {
+		case 0x07: // BEL
+			b.esc = escNone
+		case 0x1b:
+			b.esc = escOSCEnd
+		}
+	case escOSCEnd:
+		// ESC \ ends the sequence.
+		b.esc = escNone
+	case escSS3:
+		b.esc = escNone
+	}
+	return true
+}
+
+func (b *lineBuilder) endLine() {
+	if len(b.buf) > 0 {
+		b.lines = append(b.lines, Line{Time: b.start, Type: b.typ, Text: string(b.buf)})
+	}
+	b.buf = b.buf[:0]
+	b.cr = false
+}
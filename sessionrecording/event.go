@@ -10,7 +10,8 @@
 )
 
 const (
-	KubernetesAPIEventType = "kubernetes-api-request"
+	KubernetesAPIEventType    = "kubernetes-api-request"
+	SSHAuthorizationEventType = "ssh-authorization"
 )
 
 // Event represents the top-level structure of a tsrecorder event.
@@ -40,6 +41,51 @@ type Event struct {
 
 	// Destination provides details about the node receiving the request.
 	Destination Destination `json:"destination"`
+
+	// SSHAuthorization contains the decision of a Tailscale SSH local
+	// authorization hook (if the type is `ssh-authorization`).
+	SSHAuthorization *SSHAuthorization `json:"sshAuthorization,omitempty"`
+}
+
+// SSHAuthorization is the decision of a local authorization hook of a
+// Tailscale SSH server on a connection, session or forwarding request.
+type SSHAuthorization struct {
+	// Request is the kind of request that was authorized: "connect",
+	// "session" or "forward".
+	Request string `json:"request"`
+
+	// ConnectionID uniquely identifies the SSH connection of the request.
+	ConnectionID string `json:"connectionID"`
+
+	// SessionID identifies the session of a "session" request.
+	SessionID string `json:"sessionID,omitempty"`
+
+	// SSHUser is the username as presented by the client.
+	SSHUser string `json:"sshUser"`
+
+	// LocalUser is the effective username on the server.
+	LocalUser string `json:"localUser"`
+
+	// Command is the command requested for a "session" request, if any.
+	Command string `json:"command,omitempty"`
+
+	// Forward describes a "forward" request, such as
+	// "local-port example.com:80".
+	Forward string `json:"forward,omitempty"`
+
+	// Allowed is whether the request was allowed.
+	Allowed bool `json:"allowed"`
+
+	// Message is the message from the hook, if any.
+	Message string `json:"message,omitempty"`
+
+	// ForcedCommand is the command that the hook forced the session to
+	// run instead of Command, if any.
+	ForcedCommand string `json:"forcedCommand,omitempty"`
+
+	// Error is why the hook failed, if it did. The request is then
+	// allowed only if the server is configured to fail open.
+	Error string `json:"error,omitempty"`
 }
 
 // copied from https://github.com/kubernetes/kubernetes/blob/11ade2f7dd264c2f52a4a1342458abbbaa3cb2b1/staging/src/k8s.io/apiserver/pkg/endpoints/request/requestinfo.go#L44
@@ -0,0 +1,467 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package recorder implements a session recorder: the receiving end of the
+// protocol that Tailscale SSH and the Kubernetes API server proxy use to
+// upload session recordings and events, as spoken by
+// sessionrecording.ConnectToRecorder and sessionrecording.SendEvent.
+//
+// It accepts recordings on both the legacy /record endpoint and the
+// acknowledged /v2/record endpoint, and events on /v2/event, and stores them
+// in a Store. Stored files can be listed and fetched with a small HTTP API.
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// recordingsPrefix and eventsPrefix are the Store name prefixes under
+	// which recordings and events are stored. Below them, files are
+	// rotated into a directory per day, such as
+	// "recordings/2006-01-02/1136214245-nXXXXXCNTRL-1a2b3c4d.cast".
+	recordingsPrefix = "recordings/"
+	eventsPrefix     = "events/"
+
+	// maxHeaderSize is the largest recording header line accepted.
+	maxHeaderSize = 1 << 20
+	// maxEventSize is the largest event accepted.
+	maxEventSize = 1 << 20
+
+	// retentionInterval is how often expired files are deleted.
+	retentionInterval = time.Hour
+)
+
+// ackInterval is how often acks are sent to /v2/record clients, including
+// when no new data has been received, so that clients can tell that the
+// recorder is still there. It is a variable to allow overriding it in tests.
+var ackInterval = time.Second
+
+// Server is a session recorder. Its Handler serves the recorder protocol to
+// clients, and its APIHandler serves the API for listing and fetching what
+// was recorded.
+type Server struct {
+	// Store is where recordings and events are stored. It must be non-nil.
+	Store Store
+
+	// MaxAge, if non-zero, is how long recordings and events are kept
+	// before RunRetention deletes them.
+	MaxAge time.Duration
+
+	// Logf, if non-nil, is the logger to use. If nil, log.Printf is used.
+	Logf logger.Logf
+
+	// Clock, if non-nil, is the clock to use.
+	Clock tstime.Clock
+}
+
+func (s *Server) logf(format string, args ...any) {
+	logf := s.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	logf("recorder: "+format, args...)
+}
+
+func (s *Server) clock() tstime.DefaultClock {
+	return tstime.DefaultClock{Clock: s.Clock}
+}
+
+// Handler returns the HTTP handler for the recorder protocol.
+//
+// The /v2 endpoints require HTTP/2 without TLS (h2c); see Serve.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /record", s.serveRecordV1)
+	mux.HandleFunc("HEAD /v2/record", s.serveProbe)
+	mux.HandleFunc("POST /v2/record", s.serveRecordV2)
+	mux.HandleFunc("HEAD /v2/event", s.serveProbe)
+	mux.HandleFunc("POST /v2/event", s.serveEvent)
+	return mux
+}
+
+// APIHandler returns the HTTP handler for the API for listing and fetching
+// recordings and events:
+//
+//   - GET /api/recordings lists recordings, as a JSON array of Object.
+//   - GET /api/events lists events, likewise.
+//   - GET /api/files/<name> returns the contents of a listed file.
+//
+// It is separate from Handler as the clients that upload recordings should
+// generally not be able to read them.
+func (s *Server) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/recordings", s.serveList(recordingsPrefix))
+	mux.HandleFunc("GET /api/events", s.serveList(eventsPrefix))
+	mux.HandleFunc("GET /api/files/{name...}", s.serveFile)
+	return mux
+}
+
+// Serve serves the recorder on ln, with both HTTP/1 and unencrypted HTTP/2
+// as clients expect. It returns when ln is closed or accepting fails.
+func (s *Server) Serve(ln net.Listener) error {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	hs := &http.Server{
+		Handler:   s.Handler(),
+		Protocols: &p,
+	}
+	return hs.Serve(ln)
+}
+
+// serveProbe answers the HEAD requests clients use to check for support of
+// the /v2 endpoints. Clients only use /v2/record over HTTP/2, which they
+// check from the response.
+func (s *Server) serveProbe(w http.ResponseWriter, r *http.Request) {}
+
+// serveRecordV1 serves the legacy /record endpoint: the recording is the
+// request body, and the response status reports whether it was stored.
+func (s *Server) serveRecordV1(w http.ResponseWriter, r *http.Request) {
+	name, err := s.record(r.Context(), r.Body, nil)
+	if err != nil {
+		s.logf("recording %q from %v: %v", name, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logf("stored recording %q from %v", name, r.RemoteAddr)
+}
+
+// ackFrame is a frame of a /v2/record response. It is the same as
+// sessionrecording's v2ResponseFrame.
+type ackFrame struct {
+	// Ack is the number of bytes of the recording stored so far.
+	Ack int64 `json:"ack,omitempty"`
+	// Error, if set, is the last frame, and reports why the recording
+	// could not be stored.
+	Error string `json:"error,omitempty"`
+}
+
+// serveRecordV2 serves the /v2/record endpoint. The recording is streamed in
+// the request body, and the response streams back acks of the number of bytes
+// stored every ackInterval, ending with an error frame if storing fails.
+func (s *Server) serveRecordV2(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor < 2 {
+		http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	// Send the status now, as the client waits for it before uploading.
+	w.WriteHeader(http.StatusOK)
+	f, _ := w.(http.Flusher)
+	if f != nil {
+		f.Flush()
+	}
+
+	var stored atomic.Int64
+	type result struct {
+		name string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		name, err := s.record(r.Context(), r.Body, func(n int) {
+			stored.Add(int64(n))
+		})
+		done <- result{name, err}
+	}()
+
+	enc := json.NewEncoder(w)
+	send := func(fr ackFrame) error {
+		if err := enc.Encode(fr); err != nil {
+			return err
+		}
+		if f != nil {
+			f.Flush()
+		}
+		return nil
+	}
+	t, tc := s.clock().NewTicker(ackInterval)
+	defer t.Stop()
+	for {
+		select {
+		case res := <-done:
+			if res.err != nil {
+				s.logf("recording %q from %v: %v", res.name, r.RemoteAddr, res.err)
+				send(ackFrame{Error: res.err.Error()})
+				return
+			}
+			send(ackFrame{Ack: stored.Load()})
+			s.logf("stored recording %q from %v", res.name, r.RemoteAddr)
+			return
+		case <-tc:
+			if err := send(ackFrame{Ack: stored.Load()}); err != nil {
+				// The client is gone; record will see the body fail.
+				continue
+			}
+		}
+	}
+}
+
+// record stores the recording read from body. If non-nil, onWrite is called
+// with the number of bytes of each write to the store. It returns the name
+// the recording was stored as, if it got that far.
+//
+// If reading body fails partway, such as when the client goes away, what
+// was received is kept, and the error is returned.
+func (s *Server) record(ctx context.Context, body io.Reader, onWrite func(int)) (name string, err error) {
+	br := bufio.NewReaderSize(body, 64<<10)
+	line, err := readLine(br, maxHeaderSize)
+	if err != nil {
+		return "", fmt.Errorf("reading header: %w", err)
+	}
+	var h sessionrecording.CastHeader
+	if err := json.Unmarshal(line, &h); err != nil {
+		return "", fmt.Errorf("parsing header: %w", err)
+	}
+
+	name = s.recordingName(&h)
+	sw, err := s.Store.Create(ctx, name)
+	if err != nil {
+		return name, err
+	}
+	w := &writeCounter{w: sw, onWrite: onWrite}
+	_, err = w.Write(line)
+	if err == nil {
+		_, err = br.WriteTo(w)
+	}
+	if cerr := sw.Close(); err == nil {
+		err = cerr
+	}
+	return name, err
+}
+
+// readLine reads a line, including its newline, of at most max bytes.
+func readLine(br *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := br.ReadSlice('\n')
+		line = append(line, frag...)
+		if len(line) > max {
+			return nil, errors.New("line too long")
+		}
+		switch {
+		case err == nil:
+			return line, nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(line) > 0:
+			return line, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// writeCounter is an io.Writer that reports the number of bytes written.
+type writeCounter struct {
+	w       io.Writer
+	onWrite func(int)
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if c.onWrite != nil {
+		c.onWrite(n)
+	}
+	return n, err
+}
+
+// serveEvent serves the /v2/event endpoint, storing the event in the body.
+func (s *Server) serveEvent(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ev sessionrecording.Event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := s.eventName(&ev)
+	if err := s.put(r.Context(), name, body); err != nil {
+		s.logf("event %q from %v: %v", name, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) put(ctx context.Context, name string, data []byte) error {
+	w, err := s.Store.Create(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// unsafeNameChars matches the characters not kept in file names made from
+// client-provided values.
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func (s *Server) recordingName(h *sessionrecording.CastHeader) string {
+	src := string(h.SrcNodeID)
+	if src == "" && h.Kubernetes != nil {
+		src = h.Kubernetes.PodName
+	}
+	return s.fileName(recordingsPrefix, h.Timestamp, src, ".cast")
+}
+
+func (s *Server) eventName(ev *sessionrecording.Event) string {
+	return s.fileName(eventsPrefix, ev.Timestamp, string(ev.Source.NodeID), ".json")
+}
+
+// fileName returns a new, unique, Store name under prefix for a file from
+// src (which may be empty) that started at the unix time ts.
+//
+// Files are put in a directory for the day they were received.
+func (s *Server) fileName(prefix string, ts int64, src, ext string) string {
+	now := s.clock().Now().UTC()
+	if ts <= 0 {
+		ts = now.Unix()
+	}
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(now.Format(time.DateOnly))
+	fmt.Fprintf(&b, "/%d-", ts)
+	if src = strings.Trim(unsafeNameChars.ReplaceAllString(src, "_"), "._"); src != "" {
+		b.WriteString(src)
+		b.WriteByte('-')
+	}
+	b.WriteString(randHex(4))
+	b.WriteString(ext)
+	return b.String()
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// serveList returns a handler that lists the files under prefix, as a JSON
+// array of Object, oldest first. The optional "since" query parameter, an
+// RFC 3339 time, limits the list to files modified since then.
+func (s *Server) serveList(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since time.Time
+		if v := r.FormValue("since"); v != "" {
+			var err error
+			since, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		objs, err := s.Store.List(r.Context(), prefix)
+		if err != nil {
+			s.logf("listing %q: %v", prefix, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ret := make([]Object, 0, len(objs))
+		for _, o := range objs {
+			if !o.ModTime.Before(since) {
+				ret = append(ret, o)
+			}
+		}
+		sortObjects(ret)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ret)
+	}
+}
+
+// serveFile serves the contents of a file listed by serveList.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !validName(name) || !(strings.HasPrefix(name, recordingsPrefix) || strings.HasPrefix(name, eventsPrefix)) {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	rc, err := s.Store.Open(r.Context(), name)
+	if errors.Is(err, ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.logf("opening %q: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	switch {
+	case strings.HasSuffix(name, ".cast"):
+		w.Header().Set("Content-Type", "application/x-asciicast")
+	case strings.HasSuffix(name, ".json"):
+		w.Header().Set("Content-Type", "application/json")
+	}
+	io.Copy(w, rc)
+}
+
+// DeleteExpired deletes the recordings and events last modified more than
+// MaxAge ago. It does nothing if MaxAge is zero.
+func (s *Server) DeleteExpired(ctx context.Context) error {
+	if s.MaxAge <= 0 {
+		return nil
+	}
+	cutoff := s.clock().Now().Add(-s.MaxAge)
+	var errs []error
+	for _, prefix := range []string{recordingsPrefix, eventsPrefix} {
+		objs, err := s.Store.List(ctx, prefix)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, o := range objs {
+			if !o.ModTime.Before(cutoff) {
+				continue
+			}
+			if err := s.Store.Delete(ctx, o.Name); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			s.logf("deleted expired %q", o.Name)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunRetention runs DeleteExpired periodically until ctx is done.
+func (s *Server) RunRetention(ctx context.Context) {
+	if s.MaxAge <= 0 {
+		return
+	}
+	t, tc := s.clock().NewTicker(retentionInterval)
+	defer t.Stop()
+	for {
+		if err := s.DeleteExpired(ctx); err != nil {
+			s.logf("deleting expired files: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tc:
+		}
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"tailscale.com/net/memnet"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tstest"
+)
+
+var testStart = time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+// startServer starts s on an in-memory network, and returns the address to
+// connect to, and an HTTP client for it.
+func startServer(t *testing.T, s *Server) (netip.AddrPort, *memnet.Network, *http.Client) {
+	t.Helper()
+	if s.Logf == nil {
+		s.Logf = t.Logf
+	}
+	var mn memnet.Network
+	ln := mn.NewLocalTCPListener()
+	go s.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	hc := &http.Client{Transport: &http.Transport{DialContext: mn.Dial}}
+	return netip.MustParseAddrPort(ln.Addr().String()), &mn, hc
+}
+
+const testHeader = `{"version":2,"width":80,"height":24,"timestamp":1760702400,"srcNode":"laptop.example.ts.net","srcNodeID":"nLAPTOP","env":{"TERM":"xterm"},"sshUser":"root","localUser":"root","connectionID":"c1"}` + "\n"
+
+func TestRecordV2(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: testStart})
+	st := &DirStore{Dir: t.TempDir()}
+	ap, mn, _ := startServer(t, &Server{Store: st, Clock: clock})
+
+	w, attempts, errc, err := sessionrecording.ConnectToRecorder(context.Background(), []netip.AddrPort{ap}, mn.Dial)
+	if err != nil {
+		t.Fatalf("ConnectToRecorder: %v", err)
+	}
+	if len(attempts) != 1 || attempts[0].FailureMessage != "" {
+		t.Errorf("attempts = %+v", attempts)
+	}
+	want := testHeader + `[0.5,"o","$ "]` + "\n" + strings.Repeat(`[1,"o","output"]`+"\n", 10000)
+	if _, err := io.WriteString(w, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	objs, err := st.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("got %d files, want 1: %+v", len(objs), objs)
+	}
+	name := objs[0].Name
+	if !strings.HasPrefix(name, "recordings/2026-10-17/1760702400-nLAPTOP-") || !strings.HasSuffix(name, ".cast") {
+		t.Errorf("name = %q", name)
+	}
+	got, err := os.ReadFile(filepath.Join(st.Dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("stored recording differs from upload: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestRecordV1(t *testing.T) {
+	st := &DirStore{Dir: t.TempDir()}
+	ap, _, hc := startServer(t, &Server{Store: st})
+
+	body := testHeader + `[0.5,"o","$ "]` + "\n"
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/record", ap), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Expect", "100-continue")
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v", res.Status)
+	}
+	objs, err := st.List(context.Background(), "recordings/")
+	if err != nil || len(objs) != 1 {
+		t.Fatalf("List = %+v, %v", objs, err)
+	}
+	if objs[0].Size != int64(len(body)) {
+		t.Errorf("size = %d, want %d", objs[0].Size, len(body))
+	}
+
+	// A body that isn't a recording is rejected.
+	res, err = hc.Post(fmt.Sprintf("http://%s/record", ap), "", strings.NewReader("not a recording\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status for bad recording = %v", res.Status)
+	}
+}
+
+// failStore is a Store whose files fail to be written.
+type failStore struct {
+	Store
+}
+
+func (failStore) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	return nil, errors.New("disk full")
+}
+
+func TestRecordV2StoreError(t *testing.T) {
+	ap, mn, _ := startServer(t, &Server{Store: failStore{}})
+
+	w, _, errc, err := sessionrecording.ConnectToRecorder(context.Background(), []netip.AddrPort{ap}, mn.Dial)
+	if err != nil {
+		t.Fatalf("ConnectToRecorder: %v", err)
+	}
+	io.WriteString(w, testHeader)
+	err = <-errc
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("upload error = %v, want error from recorder", err)
+	}
+	w.Close()
+}
+
+func TestEvent(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: testStart})
+	st := &DirStore{Dir: t.TempDir()}
+	ap, mn, hc := startServer(t, &Server{Store: st, Clock: clock})
+
+	ev := sessionrecording.Event{
+		Type:      sessionrecording.KubernetesAPIEventType,
+		Timestamp: 1760702400,
+		Source:    sessionrecording.Source{Node: "laptop.example.ts.net", NodeID: "nLAPTOP"},
+	}
+	j, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionrecording.SendEvent(ap, bytes.NewReader(j), mn.Dial); err != nil {
+		t.Fatalf("SendEvent: %v", err)
+	}
+	objs, err := st.List(context.Background(), "events/")
+	if err != nil || len(objs) != 1 {
+		t.Fatalf("List = %+v, %v", objs, err)
+	}
+	if name := objs[0].Name; !strings.HasPrefix(name, "events/2026-10-17/1760702400-nLAPTOP-") || !strings.HasSuffix(name, ".json") {
+		t.Errorf("name = %q", name)
+	}
+
+	res, err := hc.Post(fmt.Sprintf("http://%s/v2/event", ap), "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status for bad event = %v", res.Status)
+	}
+}
+
+func TestListAndFetch(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: testStart})
+	st := &DirStore{Dir: t.TempDir()}
+	s := &Server{Store: st, Clock: clock}
+	srv := httptest.NewServer(s.APIHandler())
+	defer srv.Close()
+	hc := srv.Client()
+
+	put := func(name, data string, mtime time.Time) {
+		t.Helper()
+		if err := s.put(context.Background(), name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(st.Dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("recordings/2026-10-16/b.cast", testHeader, testStart.Add(-24*time.Hour))
+	put("recordings/2026-10-17/a.cast", testHeader, testStart)
+	put("events/2026-10-17/c.json", "{}", testStart)
+
+	get := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		res, err := hc.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, b
+	}
+	list := func(path string) []string {
+		t.Helper()
+		res, b := get(path)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %v", path, res.Status)
+		}
+		var objs []Object
+		if err := json.Unmarshal(b, &objs); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, o := range objs {
+			names = append(names, o.Name)
+		}
+		return names
+	}
+
+	if got, want := list("/api/recordings"), []string{"recordings/2026-10-16/b.cast", "recordings/2026-10-17/a.cast"}; !slices.Equal(got, want) {
+		t.Errorf("recordings = %q, want %q", got, want)
+	}
+	if got, want := list("/api/recordings?since=2026-10-17T00:00:00Z"), []string{"recordings/2026-10-17/a.cast"}; !slices.Equal(got, want) {
+		t.Errorf("recordings since = %q, want %q", got, want)
+	}
+	if got, want := list("/api/events"), []string{"events/2026-10-17/c.json"}; !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+
+	res, b := get("/api/files/recordings/2026-10-17/a.cast")
+	if res.StatusCode != http.StatusOK || string(b) != testHeader {
+		t.Errorf("fetching recording: %v, %q", res.Status, b)
+	}
+	if res, _ := get("/api/files/recordings/2026-10-17/missing.cast"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("fetching missing recording: %v", res.Status)
+	}
+	if res, _ := get("/api/files/other"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("fetching file outside recordings: %v", res.Status)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: testStart})
+	st := &DirStore{Dir: t.TempDir()}
+	s := &Server{Store: st, Clock: clock, MaxAge: 7 * 24 * time.Hour, Logf: t.Logf}
+
+	files := map[string]time.Time{
+		"recordings/2026-10-01/old.cast": testStart.Add(-16 * 24 * time.Hour),
+		"recordings/2026-10-16/new.cast": testStart.Add(-24 * time.Hour),
+		"events/2026-10-01/old.json":     testStart.Add(-16 * 24 * time.Hour),
+	}
+	for name, mtime := range files {
+		if err := s.put(context.Background(), name, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(st.Dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteExpired(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	objs, err := st.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].Name != "recordings/2026-10-16/new.cast" {
+		t.Errorf("after DeleteExpired, files = %+v", objs)
+	}
+	// Empty day directories are removed too.
+	for _, dir := range []string{"recordings/2026-10-01", "events"} {
+		if _, err := os.Stat(filepath.Join(st.Dir, dir)); !os.IsNotExist(err) {
+			t.Errorf("directory %q not removed: %v", dir, err)
+		}
+	}
+}
+
+func TestDirStoreInvalidName(t *testing.T) {
+	st := &DirStore{Dir: t.TempDir()}
+	for _, name := range []string{"../x", "/x", "a/../../x", `a\b`, ""} {
+		if _, err := st.Create(context.Background(), name); err == nil {
+			t.Errorf("Create(%q) succeeded", name)
+		}
+	}
+}
+
+// fakeS3 is a minimal S3-compatible object store.
+type fakeS3 struct {
+	t      *testing.T
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") {
+		f.t.Errorf("%s %s: missing or bad Authorization %q", r.Method, r.URL, auth)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code><Message>no bucket</Message></Error>", http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == "GET" && key == "":
+		type content struct {
+			Key          string
+			LastModified time.Time
+			Size         int64
+		}
+		var res struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		prefix := r.FormValue("prefix")
+		for k, v := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				res.Contents = append(res.Contents, content{k, testStart, int64(len(v))})
+			}
+		}
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == "PUT":
+		if r.ContentLength < 0 {
+			http.Error(w, "missing Content-Length", http.StatusLengthRequired)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		f.objects[key] = b
+	case r.Method == "GET":
+		b, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code><Message>no key</Message></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	fake := &fakeS3{t: t, bucket: "recs", objects: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	st := &S3Store{
+		Endpoint:    srv.URL,
+		Bucket:      "recs",
+		Prefix:      "tailnet/",
+		Credentials: aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	}
+	ctx := context.Background()
+
+	w, err := st.Create(ctx, "recordings/2026-10-17/a.cast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testHeader)
+	if got := len(fake.objects); got != 0 {
+		t.Errorf("%d objects stored before Close, want 0", got)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fake.objects["tailnet/recordings/2026-10-17/a.cast"]); got != testHeader {
+		t.Errorf("stored object = %q", got)
+	}
+
+	objs, err := st.List(ctx, "recordings/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].Name != "recordings/2026-10-17/a.cast" || objs[0].Size != int64(len(testHeader)) || !objs[0].ModTime.Equal(testStart) {
+		t.Errorf("List = %+v", objs)
+	}
+
+	rc, err := st.Open(ctx, "recordings/2026-10-17/a.cast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != testHeader {
+		t.Errorf("Open read %q", b)
+	}
+	if _, err := st.Open(ctx, "recordings/missing.cast"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Open of missing object: %v, want ErrNotExist", err)
+	}
+
+	if err := st.Delete(ctx, "recordings/2026-10-17/a.cast"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("objects left after Delete: %v", fake.objects)
+	}
+
+	st.Bucket = "other"
+	if _, err := st.List(ctx, ""); err == nil || !strings.Contains(err.Error(), "NoSuchBucket") {
+		t.Errorf("List of missing bucket: %v", err)
+	}
+}
+
+// Check that the names the server makes are valid and unique.
+func TestFileName(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: testStart})
+	s := &Server{Clock: clock}
+	seen := map[string]bool{}
+	for _, src := range []string{"nLAPTOP", "../../etc", "", "pod/with spaces"} {
+		name := s.fileName(recordingsPrefix, 0, src, ".cast")
+		if !validName(name) || path.Dir(name) != "recordings/2026-10-17" {
+			t.Errorf("fileName(%q) = %q", src, name)
+		}
+		if seen[name] {
+			t.Errorf("duplicate name %q", name)
+		}
+		seen[name] = true
+	}
+}
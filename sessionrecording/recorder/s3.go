@@ -0,0 +1,240 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recorder
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"tailscale.com/util/httpm"
+)
+
+// unsignedPayload is the SigV4 payload hash for requests whose body isn't
+// signed.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Store is a Store of objects in a bucket of an S3-compatible object
+// store, such as MinIO, addressed with path-style URLs.
+//
+// Files are spooled to a temporary file while they are written, and
+// uploaded when closed.
+type S3Store struct {
+	// Endpoint is the base URL of the object store, such as
+	// "https://minio.example.com:9000".
+	Endpoint string
+	// Bucket is the name of the bucket.
+	Bucket string
+	// Prefix, if non-empty, is prepended to object keys, such as
+	// "tsrecorder/".
+	Prefix string
+	// Region is the region to sign requests for. Empty means "us-east-1".
+	Region string
+	// Credentials are the credentials to sign requests with.
+	Credentials aws.Credentials
+
+	// HTTPClient, if non-nil, is the client to use. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+func (s *S3Store) httpClient() *http.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// objectURL returns the URL of the object with the given key, or of the
+// bucket if key is empty.
+func (s *S3Store) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", s.Endpoint)
+	}
+	u = u.JoinPath(s.Bucket)
+	if key != "" {
+		u = u.JoinPath(key)
+	}
+	return u, nil
+}
+
+// do sends a signed request for the object key (or the bucket, if empty),
+// with the given query and body, and returns the response if it has a 2xx
+// status.
+func (s *S3Store) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	if err := v4.NewSigner().SignHTTP(ctx, s.Credentials, req, unsignedPayload, "s3", region, time.Now()); err != nil {
+		return nil, err
+	}
+	res, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+		err := &s3Error{status: res.StatusCode}
+		xml.Unmarshal(msg, err)
+		return nil, fmt.Errorf("S3 %s %s: %w", method, u.Path, err)
+	}
+	return res, nil
+}
+
+// s3Error is an S3 error response.
+type s3Error struct {
+	status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%d %s", e.status, http.StatusText(e.status))
+	}
+	return fmt.Sprintf("%d %s: %s", e.status, e.Code, e.Message)
+}
+
+func (s *S3Store) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	f, err := os.CreateTemp("", "tsrecorder-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	// Upload even if ctx is canceled, such as when a client disconnects
+	// partway through a recording, so that what was received is kept.
+	ctx = context.WithoutCancel(ctx)
+	return &s3Upload{ctx: ctx, s: s, key: s.Prefix + name, f: f}, nil
+}
+
+// s3Upload is a file being written to an S3Store.
+type s3Upload struct {
+	ctx context.Context
+	s   *S3Store
+	key string
+	f   *os.File
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	return u.f.Write(p)
+}
+
+func (u *s3Upload) Close() error {
+	defer func() {
+		// The temporary file is only needed until it's uploaded.
+		u.f.Close()
+		os.Remove(u.f.Name())
+	}()
+	size, err := u.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := u.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	res, err := u.s.do(u.ctx, httpm.PUT, u.key, nil, io.NopCloser(u.f), size)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	res, err := s.do(ctx, httpm.GET, s.Prefix+name, nil, nil, 0)
+	if se := (*s3Error)(nil); errors.As(err, &se) && se.status == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// listBucketResult is a ListObjectsV2 response.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objs []Object
+	q := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s.Prefix + prefix},
+	}
+	for {
+		res, err := s.do(ctx, httpm.GET, "", q, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var lr listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&lr)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding S3 object list: %w", err)
+		}
+		for _, c := range lr.Contents {
+			name, ok := strings.CutPrefix(c.Key, s.Prefix)
+			if !ok || !validName(name) {
+				continue
+			}
+			objs = append(objs, Object{Name: name, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !lr.IsTruncated || lr.NextContinuationToken == "" {
+			return objs, nil
+		}
+		q.Set("continuation-token", lr.NextContinuationToken)
+	}
+}
+
+func (s *S3Store) Delete(ctx context.Context, name string) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	res, err := s.do(ctx, httpm.DELETE, s.Prefix+name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recorder
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned by Store.Open for files that don't exist.
+var ErrNotExist = errors.New("file does not exist")
+
+// Store stores the files of a recorder.
+//
+// Names are slash-separated paths, as accepted by fs.ValidPath.
+type Store interface {
+	// Create returns a writer for the new file name. The file is complete
+	// when the writer is closed, but may be visible before that.
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+
+	// Open opens the file name for reading. It returns ErrNotExist if the
+	// file does not exist.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// List lists the files with names starting with prefix, in no
+	// particular order.
+	List(ctx context.Context, prefix string) ([]Object, error)
+
+	// Delete deletes the file name.
+	Delete(ctx context.Context, name string) error
+}
+
+// Object describes a file in a Store.
+type Object struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func sortObjects(objs []Object) {
+	slices.SortFunc(objs, func(a, b Object) int {
+		return cmp.Or(a.ModTime.Compare(b.ModTime), cmp.Compare(a.Name, b.Name))
+	})
+}
+
+func validName(name string) bool {
+	return fs.ValidPath(name) && name != "." && !strings.Contains(name, `\`)
+}
+
+// DirStore is a Store of files in a local directory.
+type DirStore struct {
+	// Dir is the directory files are stored in. It is created as needed.
+	Dir string
+}
+
+func (s *DirStore) path(name string) (string, error) {
+	if !validName(name) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(name)), nil
+}
+
+func (s *DirStore) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (s *DirStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (s *DirStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objs []Object
+	err := filepath.WalkDir(s.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == s.Dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			// Skip directories that can't contain matches.
+			if name != "." && !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // deleted since listed
+			}
+			return err
+		}
+		objs = append(objs, Object{Name: name, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	return objs, err
+}
+
+// Delete deletes the file name, and its directory if it is left empty, as
+// happens when the last file of a day expires.
+func (s *DirStore) Delete(ctx context.Context, name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(p); dir != filepath.Clean(s.Dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty
+		}
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// This file contains the local authorization hook, which lets the host
+// further restrict the connections, sessions and forwarding requests that
+// the SSH policy of the tailnet accepts.
+
+//go:build (linux && !android) || (darwin && !ios) || freebsd || openbsd || plan9
+
+package tailssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+)
+
+// AuthzHookConfig configures the local authorization hook.
+type AuthzHookConfig struct {
+	// Hook is either the absolute path of an executable, or an http:// or
+	// https:// URL. If empty, there is no hook and all requests that the SSH
+	// policy accepts are allowed.
+	Hook string
+	// Timeout is how long the hook may take to decide, or zero for
+	// defaultAuthzHookTimeout.
+	Timeout time.Duration
+	// FailOpen is whether requests are allowed if the hook fails, rather
+	// than denied.
+	FailOpen bool
+}
+
+// authzHookConfig is the configuration set by SetAuthzHookConfig.
+var authzHookConfig AuthzHookConfig
+
+// SetAuthzHookConfig sets the configuration of the local authorization hook,
+// as given by the tailscaled flags. It must be called before the SSH server
+// is created. The TS_SSH_AUTHZ_HOOK, TS_SSH_AUTHZ_HOOK_TIMEOUT and
+// TS_SSH_AUTHZ_HOOK_FAIL_OPEN environment variables, if set, override it.
+func SetAuthzHookConfig(cfg AuthzHookConfig) {
+	authzHookConfig = cfg
+}
+
+// Environment variables that override the fields of AuthzHookConfig.
+var (
+	sshAuthzHook         = envknob.RegisterString("TS_SSH_AUTHZ_HOOK")
+	sshAuthzHookTimeout  = envknob.RegisterDuration("TS_SSH_AUTHZ_HOOK_TIMEOUT")
+	sshAuthzHookFailOpen = envknob.RegisterOptBool("TS_SSH_AUTHZ_HOOK_FAIL_OPEN")
+)
+
+// effectiveAuthzHook returns the configuration of the hook of srv, with the
+// overrides of the environment applied.
+func (srv *server) effectiveAuthzHook() AuthzHookConfig {
+	cfg := srv.authzHook
+	if v := sshAuthzHook(); v != "" {
+		cfg.Hook = v
+	}
+	if v := sshAuthzHookTimeout(); v > 0 {
+		cfg.Timeout = v
+	}
+	if v, ok := sshAuthzHookFailOpen().Get(); ok {
+		cfg.FailOpen = v
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultAuthzHookTimeout
+	}
+	return cfg
+}
+
+const (
+	defaultAuthzHookTimeout = 5 * time.Second
+
+	// maxAuthzResponseSize is the maximum size of a response of the hook.
+	maxAuthzResponseSize = 1 << 20
+)
+
+// Types of authzRequest.
+const (
+	authzConnect = "connect" // after the SSH policy accepted the connection
+	authzSession = "session" // before a session starts its command
+	authzForward = "forward" // on a port or Unix socket forwarding request
+)
+
+// authzRequest is the JSON request that the authorization hook receives,
+// on the standard input of an executable or in the body of a POST request.
+type authzRequest struct {
+	// Type is the type of request: "connect", "session" or "forward".
+	Type string `json:"type"`
+
+	// ConnectionID identifies the SSH connection. It's shared by all the
+	// requests of the connection.
+	ConnectionID string `json:"connectionID"`
+
+	// SessionID identifies the session of a "session" request.
+	SessionID string `json:"sessionID,omitempty"`
+
+	// WhoIs is the Tailscale identity of the client, like the LocalAPI
+	// whois response.
+	WhoIs *apitype.WhoIsResponse `json:"whois"`
+
+	// SrcAddr is the Tailscale IP and port that the connection came from.
+	SrcAddr string `json:"srcAddr"`
+
+	// SSHUser is the username as presented by the client.
+	SSHUser string `json:"sshUser"`
+
+	// LocalUser is the local user that the SSH policy mapped SSHUser to.
+	LocalUser string `json:"localUser"`
+
+	// The following fields are only set for "session" requests.
+
+	// Command is the command requested by the client, if any. It's empty
+	// for shells and subsystems.
+	Command string `json:"command,omitempty"`
+	// Subsystem is the requested subsystem, such as "sftp", if any.
+	Subsystem string `json:"subsystem,omitempty"`
+	// PTY is whether the client requested a pseudo-terminal.
+	PTY bool `json:"pty,omitempty"`
+	// AgentForwarding is whether the session forwards the SSH agent.
+	AgentForwarding bool `json:"agentForwarding,omitempty"`
+	// X11Forwarding is whether the session forwards X11.
+	X11Forwarding bool `json:"x11Forwarding,omitempty"`
+
+	// Forward is the forwarding request of a "forward" request.
+	Forward *authzForwardRequest `json:"forward,omitempty"`
+}
+
+// authzForwardRequest describes a forwarding request.
+type authzForwardRequest struct {
+	// Type is the type of forwarding: "local-port", "remote-port",
+	// "local-unix" or "remote-unix".
+	Type string `json:"type"`
+	// Host and Port are the address to connect to for "local-port", or to
+	// listen on for "remote-port".
+	Host string `json:"host,omitempty"`
+	Port uint32 `json:"port,omitempty"`
+	// SocketPath is the Unix socket to connect to for "local-unix", or to
+	// listen on for "remote-unix". It's relative to the home directory of
+	// the local user if not absolute.
+	SocketPath string `json:"socketPath,omitempty"`
+}
+
+func (f *authzForwardRequest) String() string {
+	if f.SocketPath != "" {
+		return f.Type + " " + f.SocketPath
+	}
+	return f.Type + " " + net.JoinHostPort(f.Host, strconv.FormatUint(uint64(f.Port), 10))
+}
+
+// authzResponse is the JSON response of the authorization hook.
+type authzResponse struct {
+	// Allow is whether the request is allowed.
+	Allow bool `json:"allow"`
+	// Message, if non-empty, is shown to the user on denial.
+	Message string `json:"message,omitempty"`
+	// Command, if non-empty, is the command that a session must run
+	// instead of the one requested, like OpenSSH's ForceCommand. The
+	// requested command is then in the SSH_ORIGINAL_COMMAND environment
+	// variable. It's ignored for other types of requests.
+	Command string `json:"command,omitempty"`
+}
+
+// denialMessage returns the message to show to the user when r denies a
+// request.
+func (r *authzResponse) denialMessage() string {
+	if r.Message != "" {
+		return r.Message
+	}
+	return "Access denied by local authorization policy."
+}
+
+// authorize runs the authorization hook, if one is configured, on req and
+// returns its decision. It fills in the fields of req that describe the
+// connection.
+//
+// If the hook fails or times out, the request is denied, unless the hook is
+// configured to fail open. Each decision is logged and sent as a
+// session recording event to the recorders of the connection, if any.
+func (c *conn) authorize(req *authzRequest) *authzResponse {
+	cfg := c.srv.effectiveAuthzHook()
+	if cfg.Hook == "" {
+		return &authzResponse{Allow: true}
+	}
+	ci := c.info
+	req.ConnectionID = c.connID
+	req.WhoIs = &apitype.WhoIsResponse{
+		Node:        ci.node.AsStruct(),
+		UserProfile: &ci.uprof,
+	}
+	req.SrcAddr = ci.src.String()
+	req.SSHUser = ci.sshUser
+	req.LocalUser = c.localUser.Username
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	res, err := runAuthzHook(ctx, cfg.Hook, req)
+	if err != nil {
+		metricAuthzHookError.Add(1)
+		c.logf("authorization hook failed on %s request: %v", req.Type, err)
+		res = &authzResponse{Allow: cfg.FailOpen}
+	}
+	if res.Allow {
+		metricAuthzHookAllow.Add(1)
+	} else {
+		metricAuthzHookDeny.Add(1)
+	}
+	if req.Type != authzSession {
+		res.Command = ""
+	}
+	c.auditAuthz(req, res, err)
+	return res
+}
+
+// runAuthzHook runs the hook, an executable path or URL, on req.
+func runAuthzHook(ctx context.Context, hook string, req *authzRequest) (*authzResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	switch {
+	case strings.HasPrefix(hook, "http://"), strings.HasPrefix(hook, "https://"):
+		out, err = postAuthzHook(ctx, hook, body)
+	case filepath.IsAbs(hook):
+		out, err = execAuthzHook(ctx, hook, body)
+	default:
+		err = fmt.Errorf("authorization hook %q is neither an absolute path nor an HTTP URL", hook)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := new(authzResponse)
+	if err := json.Unmarshal(out, res); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return res, nil
+}
+
+// execAuthzHook runs the executable at path with body on its standard input,
+// and returns its standard output.
+func execAuthzHook(ctx context.Context, path string, body []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = "/"
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait for children that keep stdout or stderr open.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() > maxAuthzResponseSize {
+		return nil, errors.New("response too large")
+	}
+	return stdout.Bytes(), nil
+}
+
+// postAuthzHook POSTs body to the url, and returns the response body.
+func postAuthzHook(ctx context.Context, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(res.Body, maxAuthzResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		if len(out) > 1<<10 {
+			out = out[:1<<10]
+		}
+		return nil, fmt.Errorf("unexpected status %v: %s", res.Status, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// auditAuthz logs the decision res of the authorization hook on req, which
+// failed with hookErr if non-nil, and sends it in the background as a
+// session recording event to the first recorder of the connection that
+// accepts it.
+func (c *conn) auditAuthz(req *authzRequest, res *authzResponse, hookErr error) {
+	a := &sessionrecording.SSHAuthorization{
+		Request:       req.Type,
+		ConnectionID:  req.ConnectionID,
+		SessionID:     req.SessionID,
+		SSHUser:       req.SSHUser,
+		LocalUser:     req.LocalUser,
+		Command:       req.Command,
+		Allowed:       res.Allow,
+		Message:       res.Message,
+		ForcedCommand: res.Command,
+	}
+	if req.Forward != nil {
+		a.Forward = req.Forward.String()
+	}
+	if hookErr != nil {
+		a.Error = hookErr.Error()
+	}
+	c.logf("authorization hook: %s request allowed=%v forward=%q forced-command=%q message=%q err=%v", a.Request, a.Allowed, a.Forward, a.ForcedCommand, a.Message, hookErr)
+
+	recorders, _ := c.recorders()
+	if len(recorders) == 0 {
+		return
+	}
+	ci := c.info
+	ev := sessionrecording.Event{
+		Type:      sessionrecording.SSHAuthorizationEventType,
+		Timestamp: c.srv.now().Unix(),
+		Source: sessionrecording.Source{
+			Node:   strings.TrimSuffix(ci.node.Name(), "."),
+			NodeID: ci.node.StableID(),
+		},
+		SSHAuthorization: a,
+	}
+	if !ci.node.IsTagged() {
+		ev.Source.NodeUser = ci.uprof.LoginName
+		ev.Source.NodeUserID = ci.node.User()
+	} else {
+		ev.Source.NodeTags = ci.node.Tags().AsSlice()
+	}
+	if nm := c.srv.lb.NetMap(); nm != nil && nm.SelfNode.Valid() {
+		ev.Destination = sessionrecording.Destination{
+			Node:   strings.TrimSuffix(nm.SelfNode.Name(), "."),
+			NodeID: nm.SelfNode.StableID(),
+		}
+	}
+	j, err := json.Marshal(ev)
+	if err != nil {
+		c.logf("authorization hook: encoding event: %v", err)
+		return
+	}
+	dial := c.srv.lb.Dialer().UserDial
+	go func() {
+		for _, ap := range recorders {
+			err := sessionrecording.SendEvent(ap, bytes.NewReader(j), dial)
+			if err == nil {
+				return
+			}
+			c.logf("authorization hook: sending event to recorder %v: %v", ap, err)
+		}
+	}()
+}
+
+// authorizeSession runs the authorization hook on the session ss, and
+// returns its decision.
+func (ss *sshSession) authorizeSession() *authzResponse {
+	_, _, isPty := ss.Pty()
+	_, x11 := ss.X11()
+	return ss.conn.authorize(&authzRequest{
+		Type:            authzSession,
+		SessionID:       ss.sharedID,
+		Command:         ss.Session.RawCommand(),
+		Subsystem:       ss.Session.Subsystem(),
+		PTY:             isPty,
+		AgentForwarding: ssh.AgentRequested(ss) && ss.conn.finalAction.AllowAgentForwarding,
+		X11Forwarding:   x11,
+	})
+}
+
+// authorizeForward runs the authorization hook on the forwarding request f,
+// and reports whether it's allowed.
+func (c *conn) authorizeForward(f *authzForwardRequest) bool {
+	return c.authorize(&authzRequest{
+		Type:    authzForward,
+		Forward: f,
+	}).Allow
+}
@@ -74,6 +74,15 @@ func init() {
 	return nil
 }
 
+// applyResourceLimits applies the CPU, memory and process limits of ia to
+// the processes of the session, starting with the incubator itself. It may
+// start a login session, in which case it returns a non-nil close func
+// which must be closed to release the session.
+// See applyResourceLimitsLinux.
+var applyResourceLimits = func(dlogf logger.Logf, ia incubatorArgs) (close func() error, err error) {
+	return nil, fmt.Errorf("resource limits are not supported on %s", runtime.GOOS)
+}
+
 // tryExecInDir tries to run a command in dir and returns nil if it succeeds.
 // Otherwise, it returns a filesystem error or a timeout error if the command
 // took too long.
@@ -132,6 +141,10 @@ func (ss *sshSession) newIncubatorCommand(logf logger.Logf) (cmd *exec.Cmd, err
 			return nil, errors.New("no tailscaled found on path, can't serve SFTP")
 		}
 
+		if hasResourceLimits(ss.conn.sessionLimits()) {
+			logf("no tailscaled found on path, can't apply session resource limits")
+		}
+
 		loginShell := ss.conn.localUser.LoginShell()
 		args := shellArgs(isShell, ss.RawCommand())
 		logf("directly running %s %q", loginShell, args)
@@ -206,6 +219,28 @@ func (ss *sshSession) newIncubatorCommand(logf logger.Logf) (cmd *exec.Cmd, err
 		incubatorArgs = append(incubatorArgs, "--debug-test")
 	}
 
+	if ss.x11Listener != nil {
+		_, xauthDisplay := ss.x11DisplayEnv()
+		incubatorArgs = append(incubatorArgs, "--x11-display="+xauthDisplay)
+	}
+
+	if l := ss.conn.sessionLimits(); hasResourceLimits(l) {
+		if runtime.GOOS == linux {
+			incubatorArgs = append(incubatorArgs, "--session-id="+ss.sharedID)
+			if l.CPUQuotaPercent > 0 {
+				incubatorArgs = append(incubatorArgs, fmt.Sprintf("--cpu-quota-percent=%d", l.CPUQuotaPercent))
+			}
+			if l.MemoryMaxBytes > 0 {
+				incubatorArgs = append(incubatorArgs, fmt.Sprintf("--memory-max=%d", l.MemoryMaxBytes))
+			}
+			if l.PidsMax > 0 {
+				incubatorArgs = append(incubatorArgs, fmt.Sprintf("--pids-max=%d", l.PidsMax))
+			}
+		} else {
+			logf("session resource limits are not supported on %s", runtime.GOOS)
+		}
+	}
+
 	switch {
 	case isSFTP:
 		// Note that we include both the `--sftp` flag and a command to launch
@@ -279,6 +314,16 @@ type incubatorArgs struct {
 	debugTest          bool
 	isSELinuxEnforcing bool
 	encodedEnv         string
+	x11Display         string
+	sessionID          string
+	cpuQuotaPercent    int
+	memoryMax          int64
+	pidsMax            int
+}
+
+// hasResourceLimits reports whether ia limits the resources of the session.
+func (ia incubatorArgs) hasResourceLimits() bool {
+	return ia.cpuQuotaPercent > 0 || ia.memoryMax > 0 || ia.pidsMax > 0
 }
 
 func parseIncubatorArgs(args []string) (incubatorArgs, error) {
@@ -303,6 +348,11 @@ func parseIncubatorArgs(args []string) (incubatorArgs, error) {
 	flags.BoolVar(&ia.debugTest, "debug-test", false, "should debug in test mode")
 	flags.BoolVar(&ia.isSELinuxEnforcing, "is-selinux-enforcing", false, "whether SELinux is in enforcing mode")
 	flags.StringVar(&ia.encodedEnv, "encoded-env", "", "JSON encoded array of environment variables in '['key=value']' format")
+	flags.StringVar(&ia.x11Display, "x11-display", "", "the display to add the X11 authentication cookie for with xauth")
+	flags.StringVar(&ia.sessionID, "session-id", "", "the ID of the session, used to name its cgroup")
+	flags.IntVar(&ia.cpuQuotaPercent, "cpu-quota-percent", 0, "the CPU quota of the session as a percentage of one CPU, or 0 for none")
+	flags.Int64Var(&ia.memoryMax, "memory-max", 0, "the maximum memory use of the session in bytes, or 0 for none")
+	flags.IntVar(&ia.pidsMax, "pids-max", 0, "the maximum number of processes in the session, or 0 for none")
 	flags.Parse(args)
 
 	for _, g := range strings.Split(groups, ",") {
@@ -324,12 +374,13 @@ func parseIncubatorArgs(args []string) (incubatorArgs, error) {
 func (ia incubatorArgs) forwardedEnviron() (env, allowedExtraKeys []string, err error) {
 	environ := os.Environ()
 
-	// pass through SSH_AUTH_SOCK environment variable to support ssh agent forwarding
+	// pass through SSH_AUTH_SOCK environment variable to support ssh agent forwarding,
+	// DISPLAY to support X11 forwarding, and SSH_ORIGINAL_COMMAND for forced commands
 	// TODO(bradfitz,percy): why is this listed specially? If the parent wanted to included
 	// it, couldn't it have just passed it to the incubator in encodedEnv?
 	// If it didn't, no reason for us to pass it to "su -w ..." if it's not in our env
 	// anyway? (Surely we don't want to inherit the tailscaled parent SSH_AUTH_SOCK, if any)
-	allowedExtraKeys = []string{"SSH_AUTH_SOCK"}
+	allowedExtraKeys = []string{"SSH_AUTH_SOCK", "DISPLAY", "SSH_ORIGINAL_COMMAND"}
 
 	if ia.encodedEnv != "" {
 		unquoted, err := strconv.Unquote(ia.encodedEnv)
@@ -373,6 +424,10 @@ func beIncubator(args []string) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	// Don't pass the X11 authentication cookie on to the user's processes.
+	x11Auth := os.Getenv(x11AuthEnv)
+	os.Unsetenv(x11AuthEnv)
+
 	ia, err := parseIncubatorArgs(args)
 	if err != nil {
 		return err
@@ -399,6 +454,26 @@ func beIncubator(args []string) error {
 		}
 	}
 
+	if ia.x11Display != "" {
+		// X11 forwarding is best effort, like in OpenSSH: without the
+		// cookie, X11 clients fail to authenticate but the session works.
+		if err := addX11Auth(dlogf, ia, x11Auth); err != nil {
+			dlogf("xauth failed: %v", err)
+		}
+	}
+
+	if ia.hasResourceLimits() {
+		sessionCloser, err := applyResourceLimits(dlogf, ia)
+		if err != nil {
+			// Don't lock users out of the machine if the limits can't be
+			// applied, such as on hosts without cgroup v2, but tell them.
+			dlogf("failed to apply resource limits: %v", err)
+			fmt.Fprintf(os.Stderr, "[tailscale-ssh: session resource limits not applied: %v]\n", err)
+		} else if sessionCloser != nil {
+			defer sessionCloser()
+		}
+	}
+
 	if !shouldAttemptLoginShell(dlogf, ia) {
 		dlogf("not attempting login shell")
 		return handleInProcess(dlogf, ia)
@@ -460,6 +535,52 @@ func serveSFTP() error {
 	return nil
 }
 
+// x11AuthEnv is the environment variable in which tailscaled passes the X11
+// authentication protocol and cookie, separated by a space, to the
+// incubator. It's not passed as a flag, as flags are visible to other users.
+const x11AuthEnv = "TS_SSH_X11_AUTH"
+
+// addX11Auth adds the X11 authentication protocol and cookie in x11Auth for
+// the forwarded display to the user's Xauthority file. It runs xauth as the
+// user, so that the file is created with the user's permissions.
+func addX11Auth(dlogf logger.Logf, ia incubatorArgs, x11Auth string) error {
+	proto, cookie, ok := strings.Cut(x11Auth, " ")
+	if !ok || proto == "" || cookie == "" {
+		return errors.New("no X11 authentication cookie")
+	}
+	xauth, err := exec.LookPath("xauth")
+	if err != nil {
+		return err
+	}
+	dlogf("adding X11 authentication for %s", ia.x11Display)
+	cmd := exec.Command(xauth, "-q", "-")
+	// Write the cookie to stdin rather than pass it as an argument, which
+	// would be visible to other users.
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("remove %s\nadd %s %s %s\n", ia.x11Display, ia.x11Display, proto, cookie))
+	cmd.Env = []string{
+		"HOME=" + ia.homeDir,
+		"PATH=" + os.Getenv("PATH"),
+	}
+	cmd.Dir = "/"
+	if runningAsRoot() {
+		gids := make([]uint32, len(ia.gids))
+		for i, g := range ia.gids {
+			gids[i] = uint32(g)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid:    uint32(ia.uid),
+				Gid:    uint32(ia.gid),
+				Groups: gids,
+			},
+		}
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
+
 // shouldAttemptLoginShell decides whether we should attempt to get a full
 // login shell with the login or su commands. We will attempt a login shell
 // if all of the following conditions are met.
@@ -851,10 +972,21 @@ func (ss *sshSession) launchProcess() error {
 		fmt.Sprintf("SSH_CLIENT=%s %d %d", ci.src.Addr(), ci.src.Port(), ci.dst.Port()),
 		fmt.Sprintf("SSH_CONNECTION=%s %d %s %d", ci.src.Addr(), ci.src.Port(), ci.dst.Addr(), ci.dst.Port()),
 	)
+	if ss.forcedCommand != "" {
+		cmd.Env = append(cmd.Env, "SSH_ORIGINAL_COMMAND="+ss.Session.RawCommand())
+	}
 
 	if ss.agentListener != nil {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", ss.agentListener.Addr()))
 	}
+	if ss.x11Listener != nil {
+		x11, _ := ss.X11()
+		display, _ := ss.x11DisplayEnv()
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("DISPLAY=%s", display),
+			fmt.Sprintf("%s=%s %s", x11AuthEnv, x11.AuthProtocol, x11.AuthCookie),
+		)
+	}
 
 	ptyReq, winCh, isPty := ss.Pty()
 	if !isPty {
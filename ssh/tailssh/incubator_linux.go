@@ -7,19 +7,29 @@
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 )
 
 func init() {
 	ptyName = ptyNameLinux
 	maybeStartLoginSession = maybeStartLoginSessionLinux
+	applyResourceLimits = applyResourceLimitsLinux
+	watchResourceLimits = watchResourceLimitsLinux
 }
 
 func ptyNameLinux(f *os.File) (string, error) {
@@ -34,6 +44,17 @@ func ptyNameLinux(f *os.File) (string, error) {
 // callLogin1 invokes the provided method of the "login1" service over D-Bus.
 // https://www.freedesktop.org/software/systemd/man/org.freedesktop.login1.html
 func callLogin1(method string, flags dbus.Flags, args ...any) (*dbus.Call, error) {
+	return callDBus("org.freedesktop.login1", "/org/freedesktop/login1", method, flags, args...)
+}
+
+// callSystemd1 invokes the provided method of the systemd manager over D-Bus.
+// https://www.freedesktop.org/software/systemd/man/org.freedesktop.systemd1.html
+func callSystemd1(method string, flags dbus.Flags, args ...any) (*dbus.Call, error) {
+	return callDBus("org.freedesktop.systemd1", "/org/freedesktop/systemd1", method, flags, args...)
+}
+
+// callDBus invokes the provided method of the named object on the system bus.
+func callDBus(name, objectPath, method string, flags dbus.Flags, args ...any) (*dbus.Call, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		// DBus probably not running.
@@ -43,7 +64,6 @@ func callLogin1(method string, flags dbus.Flags, args ...any) (*dbus.Call, error
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	name, objectPath := "org.freedesktop.login1", "/org/freedesktop/login1"
 	obj := conn.Object(name, dbus.ObjectPath(objectPath))
 	call := obj.CallWithContext(ctx, method, flags, args...)
 	if call.Err != nil {
@@ -171,3 +191,351 @@ func maybeStartLoginSessionLinux(dlogf logger.Logf, ia incubatorArgs) func() err
 	}
 	return nil
 }
+
+const (
+	// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// sessionCgroupParent is the cgroup, relative to cgroupRoot, in which
+	// the incubator creates the cgroups of sessions with resource limits
+	// on hosts without systemd.
+	sessionCgroupParent = "tailscale-ssh"
+
+	// cpuMaxPeriod is the cgroup cpu.max period, in microseconds.
+	cpuMaxPeriod = 100000
+)
+
+// applyResourceLimitsLinux is the Linux implementation of applyResourceLimits.
+// It applies the limits with the cgroup v2 cpu, memory and pids controllers.
+//
+// On systemd hosts, the processes of a session end up in the scope unit of a
+// logind session, as PAM (pam_systemd) moves login and su there. So the
+// incubator starts the login session itself, before login or su would, and
+// sets the limits as properties of its new scope unit. If there's no new
+// login session, it starts a transient scope unit with the limits for the
+// session, as systemd owns the cgroup hierarchy. Only without systemd does
+// it create a cgroup with the limits for the session and move itself into
+// it.
+func applyResourceLimitsLinux(dlogf logger.Logf, ia incubatorArgs) (close func() error, err error) {
+	if !runningAsRoot() {
+		return nil, errors.New("not running as root")
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("no cgroup v2 hierarchy mounted at %s", cgroupRoot)
+	}
+
+	if close := maybeStartLoginSessionLinux(dlogf, ia); close != nil {
+		// The login session is new, so its scope only has this session.
+		scope, err := ownLoginSessionScope()
+		if err == nil {
+			err = setScopeLimits(scope, ia)
+		}
+		if err != nil {
+			close()
+			return nil, fmt.Errorf("setting limits of login session: %w", err)
+		}
+		dlogf("applied resource limits to %s", scope)
+		return close, nil
+	}
+
+	dir, err := sessionCgroupDir(ia.sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if systemdRunning() {
+		unit, err := startSessionScope(ia)
+		if err != nil {
+			return nil, fmt.Errorf("starting scope for session: %w", err)
+		}
+		dlogf("applied resource limits to %s", unit)
+		return nil, nil
+	}
+	if err := createSessionCgroup(dir, ia); err != nil {
+		return nil, err
+	}
+	dlogf("applied resource limits with cgroup %s", dir)
+	return nil, nil
+}
+
+// ownLoginSessionScope returns the name of the systemd scope unit of the
+// logind session that the current process is in.
+func ownLoginSessionScope() (string, error) {
+	cg, err := procCgroup(os.Getpid())
+	if err != nil {
+		return "", err
+	}
+	unit := path.Base(cg)
+	if !strings.HasPrefix(unit, "session-") || !strings.HasSuffix(unit, ".scope") {
+		return "", fmt.Errorf("cgroup %q is not a login session scope", cg)
+	}
+	return unit, nil
+}
+
+// systemdProperty is a property of a systemd unit, as passed to the
+// org.freedesktop.systemd1.Manager methods.
+type systemdProperty struct {
+	Name  string
+	Value dbus.Variant
+}
+
+// scopeLimitProperties returns the resource limits of ia as properties of a
+// systemd scope unit.
+func scopeLimitProperties(ia incubatorArgs) []systemdProperty {
+	var props []systemdProperty
+	if ia.cpuQuotaPercent > 0 {
+		// CPUQuota=1% is 10ms of CPU time per second.
+		props = append(props, systemdProperty{"CPUQuotaPerSecUSec", dbus.MakeVariant(uint64(ia.cpuQuotaPercent) * 10000)})
+	}
+	if ia.memoryMax > 0 {
+		props = append(props, systemdProperty{"MemoryMax", dbus.MakeVariant(uint64(ia.memoryMax))})
+	}
+	if ia.pidsMax > 0 {
+		props = append(props, systemdProperty{"TasksMax", dbus.MakeVariant(uint64(ia.pidsMax))})
+	}
+	return props
+}
+
+// setScopeLimits sets the resource limits of ia as runtime properties of the
+// systemd scope unit.
+func setScopeLimits(unit string, ia incubatorArgs) error {
+	_, err := callSystemd1("org.freedesktop.systemd1.Manager.SetUnitProperties", 0, unit, true, scopeLimitProperties(ia))
+	return err
+}
+
+// systemdRunning reports whether the system was booted with systemd, like
+// sd_booted(3).
+func systemdRunning() bool {
+	fi, err := os.Lstat("/run/systemd/system")
+	return err == nil && fi.IsDir()
+}
+
+// startSessionScope starts a transient systemd scope unit with the resource
+// limits of ia for the session, with the current process in it, and returns
+// its name. systemd stops the scope once all its processes have exited.
+func startSessionScope(ia incubatorArgs) (unit string, err error) {
+	unit = "tailscale-ssh-" + ia.sessionID + ".scope"
+	props := append(scopeLimitProperties(ia),
+		systemdProperty{"Description", dbus.MakeVariant("Tailscale SSH session " + ia.sessionID)},
+		systemdProperty{"PIDs", dbus.MakeVariant([]uint32{uint32(os.Getpid())})},
+	)
+	var aux []struct {
+		Name  string
+		Props []systemdProperty
+	}
+	// https://www.freedesktop.org/software/systemd/man/org.freedesktop.systemd1.html
+	if _, err := callSystemd1("org.freedesktop.systemd1.Manager.StartTransientUnit", 0, unit, "fail", props, aux); err != nil {
+		return "", err
+	}
+	// The process is moved by the job the call queued, asynchronously.
+	for range 100 {
+		if cg, err := procCgroup(os.Getpid()); err == nil && path.Base(cg) == unit {
+			return unit, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return "", fmt.Errorf("process was not moved to %s", unit)
+}
+
+// sessionCgroupDir returns the directory of the cgroup that the incubator
+// creates for the session with the given ID.
+func sessionCgroupDir(sessionID string) (string, error) {
+	if sessionID == "" || sessionID != filepath.Base(sessionID) || strings.HasPrefix(sessionID, ".") {
+		return "", fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	return filepath.Join(cgroupRoot, sessionCgroupParent, sessionID), nil
+}
+
+// createSessionCgroup creates the cgroup dir with the resource limits of ia
+// and moves the current process into it. It's only for hosts without
+// systemd, which otherwise owns the cgroup hierarchy.
+func createSessionCgroup(dir string, ia incubatorArgs) error {
+	limits := map[string]string{} // cgroup file => value
+	if ia.cpuQuotaPercent > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", ia.cpuQuotaPercent*cpuMaxPeriod/100, cpuMaxPeriod)
+	}
+	if ia.memoryMax > 0 {
+		limits["memory.max"] = strconv.FormatInt(ia.memoryMax, 10)
+	}
+	if ia.pidsMax > 0 {
+		limits["pids.max"] = strconv.Itoa(ia.pidsMax)
+	}
+
+	parent := filepath.Dir(dir)
+	if err := os.Mkdir(parent, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	// Controllers must be enabled in the subtree of every ancestor. The
+	// root cgroup is the only one allowed to have both processes and
+	// controllers enabled for its children.
+	for file := range limits {
+		controller, _, _ := strings.Cut(file, ".")
+		for _, d := range []string{cgroupRoot, parent} {
+			if err := writeCgroupFile(d, "cgroup.subtree_control", "+"+controller); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	for file, v := range limits {
+		if err := writeCgroupFile(dir, file, v); err != nil {
+			os.Remove(dir)
+			return err
+		}
+	}
+	// Writing 0 moves the writing process.
+	if err := writeCgroupFile(dir, "cgroup.procs", "0"); err != nil {
+		os.Remove(dir)
+		return err
+	}
+	return nil
+}
+
+func writeCgroupFile(dir, file, v string) error {
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(v), 0); err != nil {
+		return fmt.Errorf("writing %q to cgroup %s: %w", v, file, err)
+	}
+	return nil
+}
+
+// procCgroup returns the cgroup v2 path of the process pid, relative to
+// cgroupRoot.
+func procCgroup(pid int) (string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for line := range strings.Lines(string(b)) {
+		if cg, ok := strings.CutPrefix(strings.TrimSpace(line), "0::"); ok {
+			return cg, nil
+		}
+	}
+	return "", fmt.Errorf("process %d is not in a cgroup v2 hierarchy", pid)
+}
+
+// resourceLimitsPollInterval is how often watchResourceLimitsLinux checks the
+// cgroup of a session for violations of its limits.
+const resourceLimitsPollInterval = time.Second
+
+// watchResourceLimitsLinux is the Linux implementation of watchResourceLimits.
+// It polls the event counters of the cgroup of the session process.
+func watchResourceLimitsLinux(ss *sshSession) (stop func()) {
+	w := &cgroupWatcher{
+		ss:     ss,
+		pid:    ss.cmd.Process.Pid,
+		limits: *ss.conn.sessionLimits(),
+	}
+	w.ownCgroup, _ = procCgroup(os.Getpid())
+	if dir, err := sessionCgroupDir(ss.sharedID); err == nil {
+		w.sessionCgroup = dir
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(resourceLimitsPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				w.check()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		w.check()
+		if w.sessionCgroup != "" {
+			// Fails if processes of the session outlived it, or if the
+			// session was in a systemd scope instead.
+			os.Remove(w.sessionCgroup)
+		}
+	}
+}
+
+// cgroupWatcher reports violations of the resource limits of a session.
+type cgroupWatcher struct {
+	ss            *sshSession
+	pid           int // of the incubator
+	limits        tailcfg.SSHSessionLimits
+	ownCgroup     string // of tailscaled, relative to cgroupRoot
+	sessionCgroup string // that the incubator creates without systemd
+
+	dir  string // cgroup of the session, once known
+	last cgroupCounters
+}
+
+// cgroupCounters are the event counters of a cgroup that indicate violations
+// of its limits.
+type cgroupCounters struct {
+	oomKills  int64 // "oom_kill" in memory.events
+	pidsMax   int64 // "max" in pids.events
+	throttled int64 // "nr_throttled" in cpu.stat
+}
+
+// cgroupDir returns the cgroup of the session, or "" if it's not known yet.
+func (w *cgroupWatcher) cgroupDir() string {
+	if w.dir != "" {
+		return w.dir
+	}
+	if w.sessionCgroup != "" {
+		if _, err := os.Stat(w.sessionCgroup); err == nil {
+			w.dir = w.sessionCgroup
+			return w.dir
+		}
+	}
+	// Until the incubator has applied the limits, it's in our cgroup.
+	if cg, err := procCgroup(w.pid); err == nil && cg != w.ownCgroup {
+		w.dir = filepath.Join(cgroupRoot, cg)
+	}
+	return w.dir
+}
+
+func (w *cgroupWatcher) check() {
+	dir := w.cgroupDir()
+	if dir == "" {
+		return
+	}
+	c := cgroupCounters{
+		oomKills:  readCgroupCounter(dir, "memory.events", "oom_kill"),
+		pidsMax:   readCgroupCounter(dir, "pids.events", "max"),
+		throttled: readCgroupCounter(dir, "cpu.stat", "nr_throttled"),
+	}
+	if n := c.oomKills - w.last.oomKills; n > 0 && w.limits.MemoryMaxBytes > 0 {
+		metricMemoryLimitOOMKill.Add(n)
+		w.ss.noteLimitViolation(fmt.Sprintf("Memory limit of %d bytes exceeded, %d processes killed.", w.limits.MemoryMaxBytes, n))
+	}
+	if n := c.pidsMax - w.last.pidsMax; n > 0 && w.limits.PidsMax > 0 {
+		metricPidsLimit.Add(n)
+		w.ss.noteLimitViolation(fmt.Sprintf("Process limit of %d reached, %d forks failed.", w.limits.PidsMax, n))
+	}
+	// Throttling is routine for CPU-bound sessions, so only note the first.
+	if c.throttled > 0 && w.last.throttled == 0 && w.limits.CPUQuotaPercent > 0 {
+		metricCPULimitThrottled.Add(1)
+		w.ss.noteLimitViolation(fmt.Sprintf("CPU limit of %d%% reached, processes throttled.", w.limits.CPUQuotaPercent))
+	}
+	w.last = c
+}
+
+// readCgroupCounter returns the value of key in the flat keyed cgroup file,
+// or 0 if it can't be read.
+func readCgroupCounter(dir, file, key string) int64 {
+	b, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	for line := range strings.Lines(string(b)) {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if ok && k == key {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
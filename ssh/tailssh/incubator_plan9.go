@@ -16,6 +16,7 @@
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"runtime"
@@ -365,6 +366,9 @@ func (ss *sshSession) launchProcess() error {
 		fmt.Sprintf("SSH_CLIENT=%s %d %d", ci.src.Addr(), ci.src.Port(), ci.dst.Port()),
 		fmt.Sprintf("SSH_CONNECTION=%s %d %s %d", ci.src.Addr(), ci.src.Port(), ci.dst.Addr(), ci.dst.Port()),
 	)
+	if ss.forcedCommand != "" {
+		cmd.Env = append(cmd.Env, "SSH_ORIGINAL_COMMAND="+ss.Session.RawCommand())
+	}
 
 	if ss.agentListener != nil {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", ss.agentListener.Addr()))
@@ -419,3 +423,13 @@ func acceptEnvPair(kv string) bool {
 	_ = k
 	return true // permit anything on plan9 during bringup, for debugging at least
 }
+
+// dialUnixSocket is not supported on plan9, which has no Unix sockets.
+func (c *conn) dialUnixSocket(path string) (net.Conn, error) {
+	return nil, errors.New("unix sockets not supported on plan9")
+}
+
+// listenUnixSocket is not supported on plan9, which has no Unix sockets.
+func (c *conn) listenUnixSocket(path string) (net.Listener, error) {
+	return nil, errors.New("unix sockets not supported on plan9")
+}
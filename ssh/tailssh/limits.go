@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// This file contains the enforcement of tailcfg.SSHSessionLimits, other than
+// the resource limits, which are applied by the incubator.
+
+//go:build (linux && !android) || (darwin && !ios) || freebsd || openbsd || plan9
+
+package tailssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+)
+
+var errSessionLimit = errors.New("session limit exceeded")
+
+// watchResourceLimits, if non-nil, watches the processes of ss for
+// violations of their resource limits and reports them with
+// ss.noteLimitViolation, until the returned stop func is called after the
+// process exits. It's only called for sessions with resource limits.
+//
+// It's set on Linux, where the incubator applies the limits with cgroup v2.
+var watchResourceLimits func(ss *sshSession) (stop func())
+
+// sessionLimits returns the session limits of the conn, or nil if there are
+// none.
+func (c *conn) sessionLimits() *tailcfg.SSHSessionLimits {
+	if c.finalAction == nil {
+		return nil
+	}
+	return c.finalAction.SessionLimits
+}
+
+// hasResourceLimits reports whether l limits the resources of sessions.
+func hasResourceLimits(l *tailcfg.SSHSessionLimits) bool {
+	return l != nil && (l.CPUQuotaPercent > 0 || l.MemoryMaxBytes > 0 || l.PidsMax > 0)
+}
+
+// tailnetUser returns the identity that MaxSessionsPerUser applies to: the
+// login name of the user, or the stable ID of a tagged node.
+func (ci *sshConnInfo) tailnetUser() string {
+	if ci.node.IsTagged() {
+		return "node:" + string(ci.node.StableID())
+	}
+	return ci.uprof.LoginName
+}
+
+// checkSessionLimits returns an error if ss, which must already be attached
+// to its conn, exceeds the maximum number of concurrent sessions of its
+// tailnet user or local user.
+//
+// Sessions starting at the same time may all count each other and be
+// rejected, but the limits are never exceeded.
+func (srv *server) checkSessionLimits(ss *sshSession) error {
+	l := ss.conn.sessionLimits()
+	if l == nil || (l.MaxSessionsPerUser <= 0 && l.MaxSessionsPerLocalUser <= 0) {
+		return nil
+	}
+	tailnetUser := ss.conn.info.tailnetUser()
+	localUser := ss.conn.localUser.Username
+
+	var userSessions, localUserSessions int
+	srv.mu.Lock()
+	for c := range srv.activeConns {
+		if c.info == nil || c.localUser == nil {
+			continue
+		}
+		c.mu.Lock()
+		n := len(c.sessions)
+		c.mu.Unlock()
+		if c.info.tailnetUser() == tailnetUser {
+			userSessions += n
+		}
+		if c.localUser.Username == localUser {
+			localUserSessions += n
+		}
+	}
+	srv.mu.Unlock()
+
+	if l.MaxSessionsPerUser > 0 && userSessions > l.MaxSessionsPerUser {
+		metricSessionLimitUser.Add(1)
+		return userVisibleError{
+			fmt.Sprintf("Too many concurrent sessions for %s (limit %d).", ss.conn.info.uprof.LoginName, l.MaxSessionsPerUser),
+			errSessionLimit,
+		}
+	}
+	if l.MaxSessionsPerLocalUser > 0 && localUserSessions > l.MaxSessionsPerLocalUser {
+		metricSessionLimitLocalUser.Add(1)
+		return userVisibleError{
+			fmt.Sprintf("Too many concurrent sessions as local user %q (limit %d).", localUser, l.MaxSessionsPerLocalUser),
+			errSessionLimit,
+		}
+	}
+	return nil
+}
+
+// noteLimitViolation logs the violation of a session limit described by msg
+// and notes it in the session recording, if any.
+func (ss *sshSession) noteLimitViolation(msg string) {
+	ss.logf("session limit: %s", msg)
+	ss.rec.mark(msg)
+}
+
+// terminateForLimit notes the violation of a session limit described by
+// msg and terminates the session, showing msg to the user.
+func (ss *sshSession) terminateForLimit(msg string) {
+	ss.noteLimitViolation(msg)
+	ss.cancelCtx(userVisibleError{msg, errSessionLimit})
+}
+
+// startIdleTimer terminates ss once it has had no input or output, as noted
+// by the writers returned by trackActivity, for the duration d. It returns
+// a func to stop the timer.
+func (ss *sshSession) startIdleTimer(d time.Duration) (stop func() bool) {
+	ss.lastActivity.StoreAtomic(mono.Now())
+	// The func uses t, so only start the timer once t is set.
+	var t *time.Timer
+	t = time.AfterFunc(math.MaxInt64, func() {
+		if idle := mono.Since(ss.lastActivity.LoadAtomic()); idle < d {
+			t.Reset(d - idle)
+			return
+		}
+		metricIdleTimeout.Add(1)
+		ss.terminateForLimit(fmt.Sprintf("Session idle timeout of %v elapsed.", d))
+	})
+	t.Reset(d)
+	return t.Stop
+}
+
+// trackActivity returns an io.Writer around w that notes each write as
+// activity for the idle timeout of ss, if it has one. Otherwise, it returns
+// w unchanged.
+func (ss *sshSession) trackActivity(w io.Writer) io.Writer {
+	if l := ss.conn.sessionLimits(); l == nil || l.IdleTimeout <= 0 {
+		return w
+	}
+	return activityWriter{ss, w}
+}
+
+type activityWriter struct {
+	ss *sshSession
+	w  io.Writer
+}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	w.ss.lastActivity.StoreAtomic(mono.Now())
+	return w.w.Write(p)
+}
@@ -0,0 +1,323 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// This file contains the code for Unix socket (OpenSSH "streamlocal")
+// forwarding. Tailscaled usually runs as root, so to open the socket with the
+// permissions of the local user, it launches `tailscaled be-child ssh-unix`,
+// which drops privileges, dials or listens on the socket, and passes the file
+// descriptor back over a socketpair. Sockets listened on are also removed
+// by `tailscaled be-child ssh-unix`, as the path is controlled by the user.
+
+//go:build (linux && !android) || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/cmd/tailscaled/childproc"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	childproc.Add("ssh-unix", beUnixSocket)
+}
+
+// unixSocketOp is an operation on a Unix socket, done as the local user.
+type unixSocketOp string
+
+const (
+	unixSocketDial   unixSocketOp = "dial"
+	unixSocketListen unixSocketOp = "listen"
+	unixSocketRemove unixSocketOp = "remove" // if it's a socket owned by the user
+)
+
+// streamLocalBindMask is the umask for Unix sockets listened on for remote
+// forwarding, like OpenSSH's default StreamLocalBindMask.
+const streamLocalBindMask = 0o177
+
+// dialUnixSocket connects to the Unix socket at path as the local user.
+func (c *conn) dialUnixSocket(path string) (net.Conn, error) {
+	f, err := c.doUnixSocketOp(path, unixSocketDial)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// listenUnixSocket listens on the Unix socket at path as the local user. The
+// socket is removed when the returned listener is closed.
+func (c *conn) listenUnixSocket(path string) (net.Listener, error) {
+	path = c.unixSocketPath(path)
+	f, err := c.doUnixSocketOp(path, unixSocketListen)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	return &unixSocketListener{Listener: ln, c: c, path: path}, nil
+}
+
+// unixSocketListener is a listener on a Unix socket created for remote
+// forwarding.
+type unixSocketListener struct {
+	net.Listener
+	c    *conn
+	path string // absolute
+}
+
+// Close closes the listener and removes its socket, if it's still a socket
+// owned by the local user.
+//
+// The socket is removed as the local user, who controls its path: as root,
+// the user could swap a directory in the path for a symlink between
+// checking the socket and removing it, to remove any file.
+func (ln *unixSocketListener) Close() error {
+	err := ln.Listener.Close()
+	if _, rerr := ln.c.doUnixSocketOp(ln.path, unixSocketRemove); rerr != nil {
+		ln.c.logf("removing Unix socket %q: %v", ln.path, rerr)
+	}
+	return err
+}
+
+// unixSocketPath returns the absolute path of the Unix socket path, which
+// is relative to the local user's home directory if not absolute.
+func (c *conn) unixSocketPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.localUser.HomeDir, path)
+}
+
+// doUnixSocketOp does op on the Unix socket at path as the local user. For
+// unixSocketDial and unixSocketListen, it returns the file of the
+// connection or listener; for unixSocketRemove, it returns a nil file.
+//
+// If tailscaled is running as the local user, it does op itself.
+// Otherwise, it uses `tailscaled be-child ssh-unix`.
+func (c *conn) doUnixSocketOp(path string, op unixSocketOp) (*os.File, error) {
+	lu := c.localUser
+	path = c.unixSocketPath(path)
+	if euid := os.Geteuid(); euid != 0 {
+		if lu.Uid != fmt.Sprint(euid) {
+			return nil, fmt.Errorf("can't switch to user %q from process euid %v", lu.Username, euid)
+		}
+		return unixSocketFileOp(path, op)
+	}
+	if c.srv.tailscaledPath == "" {
+		return nil, errors.New("no tailscaled found on path, can't forward Unix sockets")
+	}
+
+	// Like os/exec, hold ForkLock so that the socketpair isn't inherited by
+	// other children before it's marked close-on-exec.
+	syscall.ForkLock.RLock()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err == nil {
+		unix.CloseOnExec(fds[0])
+		unix.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("socketpair: %w", err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "ssh-unix-parent")
+	child := os.NewFile(uintptr(fds[1]), "ssh-unix-child")
+	defer parent.Close()
+	defer child.Close()
+
+	args := []string{
+		"be-child",
+		"ssh-unix",
+		"--uid=" + lu.Uid,
+		"--gid=" + lu.Gid,
+		"--groups=" + strings.Join(c.userGroupIDs, ","),
+		"--home-dir=" + lu.HomeDir,
+		"--socket=" + path,
+		"--op=" + string(op),
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.srv.tailscaledPath, args...)
+	cmd.Dir = "/"
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{child} // fd 3
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	child.Close()
+
+	if op == unixSocketRemove {
+		// Nothing is sent back.
+		parent.Close()
+		if err := cmd.Wait(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, errors.New(msg)
+			}
+			return nil, err
+		}
+		return nil, nil
+	}
+	f, rerr := receiveFile(parent, path)
+	werr := cmd.Wait()
+	if rerr == nil {
+		return f, nil
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return nil, errors.New(msg)
+	}
+	if werr != nil {
+		return nil, werr
+	}
+	return nil, rerr
+}
+
+// receiveFile receives a file descriptor sent over the Unix socket sock,
+// and returns it as a file named name.
+func receiveFile(sock *os.File, name string) (*os.File, error) {
+	fc, err := net.FileConn(sock)
+	if err != nil {
+		return nil, err
+	}
+	defer fc.Close()
+	uc, ok := fc.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("unexpected conn type %T", fc)
+	}
+	buf := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, errors.New("no file descriptor received")
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, fmt.Errorf("received %d file descriptors, want 1", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), name), nil
+}
+
+// unixSocketFileOp does op on the Unix socket at path as the current user,
+// and returns its file, if any.
+func unixSocketFileOp(path string, op unixSocketOp) (*os.File, error) {
+	switch op {
+	case unixSocketDial:
+	case unixSocketListen:
+		old := unix.Umask(streamLocalBindMask)
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		unix.Umask(old)
+		if err != nil {
+			return nil, err
+		}
+		// The socket outlives ln, and is removed by unixSocketListener.
+		ln.SetUnlinkOnClose(false)
+		defer ln.Close()
+		return ln.File()
+	case unixSocketRemove:
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%q is no longer a socket", path)
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+			return nil, fmt.Errorf("%q is no longer owned by the user", path)
+		}
+		return nil, os.Remove(path)
+	default:
+		return nil, fmt.Errorf("unknown Unix socket operation %q", op)
+	}
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.File()
+}
+
+// beUnixSocket is the entrypoint to the `tailscaled be-child ssh-unix`
+// subcommand. It drops privileges to the specified `--uid`, `--gid` and
+// `--groups`, and does the `--op` on the Unix socket at `--socket`: for
+// "dial" and "listen", it sends the file descriptor of the connection or
+// listener to the parent over fd 3; for "remove", it removes the socket.
+func beUnixSocket(args []string) error {
+	// See beIncubator.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var (
+		uid, gid       int
+		groups, home   string
+		socket, op     string
+		supplementGIDs []int
+	)
+	flags := flag.NewFlagSet("", flag.ExitOnError)
+	flags.IntVar(&uid, "uid", 0, "the uid of the local user")
+	flags.IntVar(&gid, "gid", 0, "the gid of the local user")
+	flags.StringVar(&groups, "groups", "", "comma-separated list of gids of the local user")
+	flags.StringVar(&home, "home-dir", "/", "the user's home directory")
+	flags.StringVar(&socket, "socket", "", "the path of the Unix socket")
+	flags.StringVar(&op, "op", string(unixSocketDial), `what to do with the socket: "dial", "listen" or "remove"`)
+	flags.Parse(args)
+	if socket == "" {
+		return errors.New("no --socket given")
+	}
+	for _, g := range strings.Split(groups, ",") {
+		if g == "" {
+			continue
+		}
+		gid, err := strconv.Atoi(g)
+		if err != nil {
+			return fmt.Errorf("unable to parse group id %q: %w", g, err)
+		}
+		supplementGIDs = append(supplementGIDs, gid)
+	}
+
+	parent := os.NewFile(3, "ssh-unix-parent")
+	defer parent.Close()
+
+	if err := doDropPrivileges(logger.Discard, uid, gid, supplementGIDs, home); err != nil {
+		return err
+	}
+	f, err := unixSocketFileOp(socket, unixSocketOp(op))
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+
+	pc, err := net.FileConn(parent)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	_, _, err = pc.(*net.UnixConn).WriteMsgUnix([]byte{0}, unix.UnixRights(int(f.Fd())), nil)
+	return err
+}
@@ -37,6 +37,7 @@
 	"tailscale.com/sessionrecording"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tempfork/gliderlabs/ssh"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -83,7 +84,8 @@ type server struct {
 	logf           logger.Logf
 	tailscaledPath string
 
-	timeNow func() time.Time // or nil for time.Now
+	timeNow   func() time.Time // or nil for time.Now
+	authzHook AuthzHookConfig  // from SetAuthzHookConfig
 
 	sessionWaitGroup sync.WaitGroup
 
@@ -113,6 +115,7 @@ func init() {
 			timeNow: func() time.Time {
 				return lb.ControlNow(time.Now())
 			},
+			authzHook: authzHookConfig,
 		}
 
 		return srv, nil
@@ -357,13 +360,17 @@ func (c *conn) clientAuth(cm gossh.ConnMetadata) (perms *gossh.Permissions, retE
 	for {
 		switch {
 		case action.Accept:
+			c.finalAction = action
+			if res := c.authorize(&authzRequest{Type: authzConnect}); !res.Allow {
+				metricTerminalReject.Add(1)
+				return nil, c.errDenied(res.denialMessage())
+			}
 			metricTerminalAccept.Add(1)
 			if action.Message != "" {
 				if err := c.spac.SendAuthBanner(action.Message); err != nil {
 					return nil, c.errUnexpected(fmt.Errorf("error sending auth welcome message: %w", err))
 				}
 			}
-			c.finalAction = action
 			return &gossh.Permissions{}, nil
 		case action.Reject:
 			metricTerminalReject.Add(1)
@@ -460,6 +467,7 @@ func (srv *server) newConn() (*conn, error) {
 	now := srv.now()
 	c.connID = fmt.Sprintf("ssh-conn-%s-%02x", now.UTC().Format("20060102T150405"), randBytes(5))
 	fwdHandler := &ssh.ForwardedTCPHandler{}
+	unixFwdHandler := &ssh.ForwardedUnixHandler{}
 	c.Server = &ssh.Server{
 		Version:              "Tailscale",
 		ServerConfigCallback: c.ServerConfig,
@@ -467,6 +475,9 @@ func (srv *server) newConn() (*conn, error) {
 		Handler:                       c.handleSessionPostSSHAuth,
 		LocalPortForwardingCallback:   c.mayForwardLocalPortTo,
 		ReversePortForwardingCallback: c.mayReversePortForwardTo,
+		LocalUnixForwardingCallback:   c.forwardLocalUnixSocket,
+		ReverseUnixForwardingCallback: c.forwardRemoteUnixSocket,
+		X11Callback:                   c.mayForwardX11,
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
 			"sftp": c.handleSessionPostSSHAuth,
 		},
@@ -474,11 +485,14 @@ func (srv *server) newConn() (*conn, error) {
 		// only adds support for forwarding ports from the local machine.
 		// TODO(maisem/bradfitz): add remote port forwarding support.
 		ChannelHandlers: map[string]ssh.ChannelHandler{
-			"direct-tcpip": ssh.DirectTCPIPHandler,
+			"direct-tcpip":                   ssh.DirectTCPIPHandler,
+			"direct-streamlocal@openssh.com": ssh.DirectStreamLocalHandler,
 		},
 		RequestHandlers: map[string]ssh.RequestHandler{
-			"tcpip-forward":        fwdHandler.HandleSSHRequest,
-			"cancel-tcpip-forward": fwdHandler.HandleSSHRequest,
+			"tcpip-forward":                          fwdHandler.HandleSSHRequest,
+			"cancel-tcpip-forward":                   fwdHandler.HandleSSHRequest,
+			"streamlocal-forward@openssh.com":        unixFwdHandler.HandleSSHRequest,
+			"cancel-streamlocal-forward@openssh.com": unixFwdHandler.HandleSSHRequest,
 		},
 	}
 	ss := c.Server
@@ -508,7 +522,8 @@ func (c *conn) mayReversePortForwardTo(ctx ssh.Context, destinationHost string,
 	if sshDisableForwarding() {
 		return false
 	}
-	if c.finalAction != nil && c.finalAction.AllowRemotePortForwarding {
+	if c.finalAction != nil && c.finalAction.AllowRemotePortForwarding &&
+		c.authorizeForward(&authzForwardRequest{Type: "remote-port", Host: destinationHost, Port: destinationPort}) {
 		metricRemotePortForward.Add(1)
 		return true
 	}
@@ -522,13 +537,86 @@ func (c *conn) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, de
 	if sshDisableForwarding() {
 		return false
 	}
-	if c.finalAction != nil && c.finalAction.AllowLocalPortForwarding {
+	if c.finalAction != nil && c.finalAction.AllowLocalPortForwarding &&
+		c.authorizeForward(&authzForwardRequest{Type: "local-port", Host: destinationHost, Port: destinationPort}) {
 		metricLocalPortForward.Add(1)
 		return true
 	}
 	return false
 }
 
+// forwardLocalUnixSocket returns a connection to the Unix socket at
+// socketPath, opened as the local user, if the ctx is allowed to forward
+// connections to it.
+func (c *conn) forwardLocalUnixSocket(ctx ssh.Context, socketPath string) (net.Conn, error) {
+	if sshDisableForwarding() || c.finalAction == nil || !c.finalAction.AllowLocalUnixForwarding {
+		return nil, ssh.ErrRejected
+	}
+	if !c.authorizeForward(&authzForwardRequest{Type: "local-unix", SocketPath: socketPath}) {
+		return nil, ssh.ErrRejected
+	}
+	metricLocalUnixForward.Add(1)
+	return c.dialUnixSocket(socketPath)
+}
+
+// forwardRemoteUnixSocket returns a listener on the Unix socket at
+// socketPath, created as the local user, if the ctx is allowed to forward
+// connections from it.
+func (c *conn) forwardRemoteUnixSocket(ctx ssh.Context, socketPath string) (net.Listener, error) {
+	if sshDisableForwarding() || c.finalAction == nil || !c.finalAction.AllowRemoteUnixForwarding {
+		return nil, ssh.ErrRejected
+	}
+	if !c.authorizeForward(&authzForwardRequest{Type: "remote-unix", SocketPath: socketPath}) {
+		return nil, ssh.ErrRejected
+	}
+	metricRemoteUnixForward.Add(1)
+	ln, err := c.listenUnixSocket(socketPath)
+	if err != nil {
+		c.logf("remote unix forwarding of %q: %v", socketPath, err)
+	}
+	return ln, err
+}
+
+// mayForwardX11 reports whether the ctx should be allowed to forward X11.
+func (c *conn) mayForwardX11(ctx ssh.Context, x11 ssh.X11) bool {
+	if sshDisableForwarding() || runtime.GOOS == "plan9" {
+		return false
+	}
+	if c.srv.tailscaledPath == "" {
+		// The incubator adds the X11 authentication cookie with xauth.
+		return false
+	}
+	if !validX11Auth(x11) {
+		c.logf("rejecting X11 forwarding with malformed authentication data")
+		return false
+	}
+	if c.finalAction != nil && c.finalAction.AllowX11Forwarding {
+		metricX11Forward.Add(1)
+		return true
+	}
+	return false
+}
+
+// validX11Auth reports whether the X11 authentication protocol and cookie of
+// x11 are well-formed: a protocol name without spaces and a hex cookie, which
+// are safe to pass to xauth.
+func validX11Auth(x11 ssh.X11) bool {
+	if x11.AuthProtocol == "" || x11.AuthCookie == "" || len(x11.AuthCookie)%2 != 0 {
+		return false
+	}
+	for _, r := range x11.AuthProtocol {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	for _, r := range x11.AuthCookie {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
 // sshPolicy returns the SSHPolicy for current node.
 // If there is no SSHPolicy in the netmap, it returns a debugPolicy
 // if one is defined.
@@ -678,6 +766,17 @@ type sshSession struct {
 	cancelCtx     context.CancelCauseFunc
 	conn          *conn
 	agentListener net.Listener // non-nil if agent-forwarding requested+allowed
+	x11Listener   net.Listener // non-nil if X11 forwarding requested+allowed
+	x11Display    int          // display number of x11Listener
+	rec           *recording   // or nil if disabled; set by run
+
+	// forcedCommand, if non-empty, is the command that the authorization
+	// hook forced the session to run instead of the requested one.
+	forcedCommand string
+
+	// lastActivity is when the session last had input or output, if it
+	// has an idle timeout.
+	lastActivity mono.Time
 
 	// initialized by launchProcess:
 	cmd      *exec.Cmd
@@ -696,6 +795,24 @@ type sshSession struct {
 	exitOnce sync.Once
 }
 
+// RawCommand returns the command that the session runs: the forced command
+// if there is one, or else the command requested by the client.
+func (ss *sshSession) RawCommand() string {
+	if ss.forcedCommand != "" {
+		return ss.forcedCommand
+	}
+	return ss.Session.RawCommand()
+}
+
+// Subsystem returns the subsystem requested by the client, or empty if the
+// session runs a forced command instead.
+func (ss *sshSession) Subsystem() string {
+	if ss.forcedCommand != "" {
+		return ""
+	}
+	return ss.Session.Subsystem()
+}
+
 func (ss *sshSession) vlogf(format string, args ...any) {
 	if sshVerboseLogging() {
 		ss.logf(format, args...)
@@ -886,6 +1003,46 @@ func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *userMeta) erro
 	return nil
 }
 
+const (
+	// x11DisplayOffset is the first X11 display number used for X11
+	// forwarding, like OpenSSH's default X11DisplayOffset.
+	x11DisplayOffset = 10
+	// x11MaxDisplays is the number of X11 display numbers to try.
+	x11MaxDisplays = 1000
+	// x11BasePort is the TCP port of X11 display 0.
+	x11BasePort = 6000
+)
+
+// handleX11Forwarding starts a TCP listener on localhost for the first free
+// X11 display and in the background forwards its connections to the
+// ssh.Session. On success, it assigns ss.x11Listener and ss.x11Display.
+func (ss *sshSession) handleX11Forwarding(s ssh.Session) error {
+	if _, ok := s.X11(); !ok {
+		return nil
+	}
+	ss.logf("ssh: X11 forwarding requested")
+	for display := x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(x11BasePort+display)))
+		if err != nil {
+			// Most likely in use by another session or X server.
+			continue
+		}
+		go ssh.ForwardX11Connections(ln, s)
+		ss.x11Listener = ln
+		ss.x11Display = display
+		return nil
+	}
+	return errors.New("no free X11 display")
+}
+
+// x11DisplayEnv returns the DISPLAY environment variable value for the
+// forwarded X11 display of ss, and the display name to use with xauth.
+func (ss *sshSession) x11DisplayEnv() (display, xauthDisplay string) {
+	x11, _ := ss.X11()
+	return fmt.Sprintf("localhost:%d.%d", ss.x11Display, x11.ScreenNumber),
+		fmt.Sprintf("unix:%d.%d", ss.x11Display, x11.ScreenNumber)
+}
+
 // run is the entrypoint for a newly accepted SSH session.
 //
 // It handles ss once it's been accepted and determined
@@ -924,6 +1081,14 @@ func (ss *sshSession) run() {
 		}
 	}
 
+	res := ss.authorizeSession()
+	if !res.Allow {
+		fmt.Fprintf(ss, "%s\r\n", res.denialMessage())
+		ss.Exit(1)
+		return
+	}
+	ss.forcedCommand = res.Command
+
 	// Take control of the PTY so that we can configure it below.
 	// See https://github.com/tailscale/tailscale/issues/4146
 	ss.DisablePTYEmulation()
@@ -936,6 +1101,11 @@ func (ss *sshSession) run() {
 			// TODO(maisem/bradfitz): add a way to close all session resources
 			defer ss.agentListener.Close()
 		}
+		if err := ss.handleX11Forwarding(ss); err != nil {
+			ss.logf("X11 forwarding failed: %v", err)
+		} else if ss.x11Listener != nil {
+			defer ss.x11Listener.Close()
+		}
 
 		if ss.shouldRecord() {
 			var err error
@@ -958,6 +1128,24 @@ func (ss *sshSession) run() {
 		}
 	}
 
+	ss.rec = rec
+
+	if err := ss.conn.srv.checkSessionLimits(ss); err != nil {
+		msg := err.Error()
+		var uve userVisibleError
+		if errors.As(err, &uve) {
+			msg = uve.SSHTerminationMessage()
+		}
+		ss.noteLimitViolation(msg)
+		fmt.Fprintf(ss, "%s\r\n", msg)
+		ss.Exit(1)
+		return
+	}
+	if l := ss.conn.sessionLimits(); l != nil && l.IdleTimeout > 0 {
+		stop := ss.startIdleTimer(l.IdleTimeout)
+		defer stop()
+	}
+
 	err := ss.launchProcess()
 	if err != nil {
 		logf("start failed: %v", err.Error())
@@ -973,10 +1161,15 @@ func (ss *sshSession) run() {
 	}
 	go ss.killProcessOnContextDone()
 
+	stopWatchingLimits := func() {}
+	if watchResourceLimits != nil && hasResourceLimits(ss.conn.sessionLimits()) {
+		stopWatchingLimits = watchResourceLimits(ss)
+	}
+
 	var processDone atomic.Bool
 	go func() {
 		defer ss.wrStdin.Close()
-		if _, err := io.Copy(rec.writer("i", ss.wrStdin), ss); err != nil {
+		if _, err := io.Copy(rec.writer("i", ss.trackActivity(ss.wrStdin)), ss); err != nil {
 			logf("stdin copy: %v", err)
 			ss.cancelCtx(err)
 		}
@@ -990,7 +1183,7 @@ func (ss *sshSession) run() {
 	}
 	go func() {
 		defer ss.rdStdout.Close()
-		_, err := io.Copy(rec.writer("o", ss), ss.rdStdout)
+		_, err := io.Copy(rec.writer("o", ss.trackActivity(ss)), ss.rdStdout)
 		if err != nil && !errors.Is(err, io.EOF) {
 			isErrBecauseProcessExited := processDone.Load() && errors.Is(err, syscall.EIO)
 			if !isErrBecauseProcessExited {
@@ -1007,7 +1200,7 @@ func (ss *sshSession) run() {
 	if ss.rdStderr != nil {
 		go func() {
 			defer ss.rdStderr.Close()
-			_, err := io.Copy(ss.Stderr(), ss.rdStderr)
+			_, err := io.Copy(ss.trackActivity(ss.Stderr()), ss.rdStderr)
 			if err != nil {
 				logf("stderr copy: %v", err)
 			}
@@ -1020,6 +1213,7 @@ func (ss *sshSession) run() {
 
 	err = ss.cmd.Wait()
 	processDone.Store(true)
+	stopWatchingLimits()
 
 	// This will either make the SSH Termination goroutine be a no-op,
 	// or itself will be a no-op because the process was killed by the
@@ -1062,10 +1256,19 @@ func (ss *sshSession) run() {
 // returned. Otherwise, the list of recorders from the initial action
 // is returned.
 func (ss *sshSession) recorders() ([]netip.AddrPort, *tailcfg.SSHRecorderFailureAction) {
-	if len(ss.conn.finalAction.Recorders) > 0 {
-		return ss.conn.finalAction.Recorders, ss.conn.finalAction.OnRecordingFailure
+	return ss.conn.recorders()
+}
+
+// recorders returns the list of recorders to use for sessions of c, like
+// sshSession.recorders.
+func (c *conn) recorders() ([]netip.AddrPort, *tailcfg.SSHRecorderFailureAction) {
+	if c.finalAction != nil && len(c.finalAction.Recorders) > 0 {
+		return c.finalAction.Recorders, c.finalAction.OnRecordingFailure
 	}
-	return ss.conn.action0.Recorders, ss.conn.action0.OnRecordingFailure
+	if c.action0 == nil {
+		return nil, nil
+	}
+	return c.action0.Recorders, c.action0.OnRecordingFailure
 }
 
 func (ss *sshSession) shouldRecord() bool {
@@ -1335,12 +1538,16 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 		}()
 	}
 
+	command := strings.Join(ss.Command(), " ")
+	if ss.forcedCommand != "" {
+		command = ss.forcedCommand
+	}
 	ch := sessionrecording.CastHeader{
 		Version:   2,
 		Width:     w.Width,
 		Height:    w.Height,
 		Timestamp: now.Unix(),
-		Command:   strings.Join(ss.Command(), " "),
+		Command:   command,
 		Env: map[string]string{
 			"TERM": term,
 			// TODO(bradfitz): anything else important?
@@ -1497,6 +1704,33 @@ func (w *loggingWriter) Write(p []byte) (n int, err error) {
 	return w.w.Write(p)
 }
 
+// mark writes a marker event with the given label to the recording, such as
+// to note why the session was terminated.
+//
+// If r is nil, it does nothing.
+func (r *recording) mark(label string) {
+	if r == nil {
+		return
+	}
+	j, err := json.Marshal([]any{
+		time.Since(r.start).Seconds(),
+		"m",
+		label,
+	})
+	if err != nil {
+		return
+	}
+	j = append(j, '\n')
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.out == nil {
+		return
+	}
+	if _, err := r.out.Write(j); err != nil {
+		r.ss.logf("recording: failed to write marker: %v", err)
+	}
+}
+
 func (w loggingWriter) writeCastLine(j []byte) error {
 	w.r.mu.Lock()
 	defer w.r.mu.Unlock()
@@ -1541,6 +1775,20 @@ func envEq(a, b string) bool {
 	metricSFTP                = clientmetric.NewCounter("ssh_sftp_sessions")
 	metricLocalPortForward    = clientmetric.NewCounter("ssh_local_port_forward_requests")
 	metricRemotePortForward   = clientmetric.NewCounter("ssh_remote_port_forward_requests")
+	metricLocalUnixForward    = clientmetric.NewCounter("ssh_local_unix_forward_requests")
+	metricRemoteUnixForward   = clientmetric.NewCounter("ssh_remote_unix_forward_requests")
+	metricX11Forward          = clientmetric.NewCounter("ssh_x11_forward_requests")
+
+	metricIdleTimeout           = clientmetric.NewCounter("ssh_session_idle_timeouts")
+	metricSessionLimitUser      = clientmetric.NewCounter("ssh_session_limit_user_rejects")
+	metricSessionLimitLocalUser = clientmetric.NewCounter("ssh_session_limit_local_user_rejects")
+	metricMemoryLimitOOMKill    = clientmetric.NewCounter("ssh_session_memory_limit_oom_kills")
+	metricPidsLimit             = clientmetric.NewCounter("ssh_session_pids_limit_hits")
+	metricCPULimitThrottled     = clientmetric.NewCounter("ssh_session_cpu_limit_throttled")
+
+	metricAuthzHookAllow = clientmetric.NewCounter("ssh_authz_hook_allow")
+	metricAuthzHookDeny  = clientmetric.NewCounter("ssh_authz_hook_deny")
+	metricAuthzHookError = clientmetric.NewCounter("ssh_authz_hook_errors")
 )
 
 // userVisibleError is a wrapper around an error that implements
@@ -22,9 +22,11 @@
 	"net/netip"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -409,6 +411,209 @@ func TestSSHAgentForwarding(t *testing.T) {
 	}
 }
 
+// TestIntegrationUnixForwarding tests local and remote Unix socket
+// forwarding, and that the sockets are dialed and created as the local user.
+func TestIntegrationUnixForwarding(t *testing.T) {
+	debugTest.Store(true)
+	t.Cleanup(func() {
+		debugTest.Store(false)
+	})
+
+	tu, err := user.Lookup("testuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asRoot := os.Geteuid() == 0
+
+	// Make a directory that the local user can use.
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	listenUnix := func(t *testing.T, name string, mode os.FileMode) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				io.WriteString(c, "hello from "+name)
+				c.Close()
+			}
+		}()
+		return path
+	}
+
+	cl := testClient(t, false, false)
+
+	t.Run("local", func(t *testing.T) {
+		path := listenUnix(t, "public.sock", 0666)
+		c, err := cl.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		got, err := io.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "hello from public.sock"; string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("local_denied", func(t *testing.T) {
+		if !asRoot {
+			t.Skip("requires root")
+		}
+		// Only root may connect to this socket, so connecting as testuser
+		// must fail.
+		path := listenUnix(t, "private.sock", 0600)
+		if c, err := cl.Dial("unix", path); err == nil {
+			c.Close()
+			t.Fatal("unexpectedly connected to a socket accessible only by root")
+		}
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		path := filepath.Join(dir, "remote.sock")
+		ln, err := cl.ListenUnix(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				io.WriteString(c, "hello from client")
+				c.Close()
+			}
+		}()
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != 0600 {
+			t.Errorf("socket mode = %v, want 0600", got)
+		}
+		if got := fmt.Sprint(fi.Sys().(*syscall.Stat_t).Uid); got != tu.Uid {
+			t.Errorf("socket owner = %s, want %s", got, tu.Uid)
+		}
+
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "hello from client"; string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+
+		// Canceling the forwarding removes the socket.
+		if err := ln.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			if i == 50 {
+				t.Fatal("socket not removed after canceling forwarding")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+}
+
+// TestIntegrationX11Forwarding tests that X11 forwarding sets DISPLAY, adds
+// the authentication cookie with xauth as the local user, and forwards
+// connections to the display.
+func TestIntegrationX11Forwarding(t *testing.T) {
+	debugTest.Store(true)
+	t.Cleanup(func() {
+		debugTest.Store(false)
+	})
+
+	const cookie = "0123456789abcdef0123456789abcdef"
+	cl := testClient(t, false, false)
+
+	// Act as the X server on the client side.
+	x11Chans := cl.HandleChannelOpen("x11")
+	go func() {
+		for nc := range x11Chans {
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			io.WriteString(ch, "hello from X11")
+			ch.Close()
+		}
+	}()
+
+	s, err := cl.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ok, err := s.SendRequest("x11-req", true, ssh.Marshal(&struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}{
+		AuthProtocol: "MIT-MAGIC-COOKIE-1",
+		AuthCookie:   cookie,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("x11-req rejected")
+	}
+
+	out, err := s.CombinedOutput(`echo "DISPLAY=$DISPLAY"; xauth list; python3 -c '
+import os, socket
+n = int(os.environ["DISPLAY"].split(":")[1].split(".")[0])
+s = socket.create_connection(("127.0.0.1", 6000 + n))
+print(s.recv(100).decode())
+'`)
+	if err != nil {
+		t.Fatalf("command failed: %s\n%s", err, out)
+	}
+	got := string(out)
+	for _, want := range []string{"DISPLAY=localhost:", "MIT-MAGIC-COOKIE-1  " + cookie, "hello from X11"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q does not contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, x11AuthEnv) {
+		t.Errorf("%q leaks %s", got, x11AuthEnv)
+	}
+}
+
 // TestIntegrationParamiko attempts to connect to Tailscale SSH using the
 // paramiko Python library. This library does not request 'none' auth. This
 // test ensures that Tailscale SSH can correctly handle clients that don't
@@ -670,9 +875,15 @@ func (tb *testBackend) NetMap() *netmap.NetworkMap {
 			Rules: []*tailcfg.SSHRule{
 				{
 					Principals: []*tailcfg.SSHPrincipal{{Any: true}},
-					Action:     &tailcfg.SSHAction{Accept: true, AllowAgentForwarding: true},
-					SSHUsers:   map[string]string{"*": tb.localUser},
-					AcceptEnv:  []string{"GIT_*", "EXACT_MATCH", "TEST?NG"},
+					Action: &tailcfg.SSHAction{
+						Accept:                    true,
+						AllowAgentForwarding:      true,
+						AllowLocalUnixForwarding:  true,
+						AllowRemoteUnixForwarding: true,
+						AllowX11Forwarding:        true,
+					},
+					SSHUsers:  map[string]string{"*": tb.localUser},
+					AcceptEnv: []string{"GIT_*", "EXACT_MATCH", "TEST?NG"},
 				},
 			},
 		},
@@ -23,6 +23,7 @@
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"slices"
@@ -53,6 +54,7 @@
 	"tailscale.com/types/ptr"
 	"tailscale.com/util/cibuild"
 	"tailscale.com/util/lineiter"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
@@ -1231,6 +1233,365 @@ func parseEnv(out []byte) map[string]string {
 	return e
 }
 
+func TestCheckSessionLimits(t *testing.T) {
+	srv := &server{logf: t.Logf}
+	addConn := func(login, localUser string, tagged bool, sessions int) *conn {
+		n := &tailcfg.Node{StableID: tailcfg.StableNodeID(fmt.Sprintf("node-%d", len(srv.activeConns)))}
+		if tagged {
+			n.Tags = []string{"tag:server"}
+		}
+		c := &conn{
+			srv:         srv,
+			info:        &sshConnInfo{node: n.View(), uprof: tailcfg.UserProfile{LoginName: login}},
+			localUser:   &userMeta{User: user.User{Username: localUser}},
+			finalAction: &tailcfg.SSHAction{Accept: true},
+		}
+		for range sessions {
+			c.sessions = append(c.sessions, &sshSession{conn: c})
+		}
+		mak.Set(&srv.activeConns, c, true)
+		return c
+	}
+	addConn("alice@example.com", "alice", false, 1)
+	addConn("alice@example.com", "root", false, 1)
+	addConn("bob@example.com", "root", false, 1)
+	addConn("tagged-devices", "root", true, 2)
+
+	tests := []struct {
+		name      string
+		login     string
+		localUser string
+		tagged    bool
+		limits    tailcfg.SSHSessionLimits
+		wantErr   string
+	}{
+		{
+			name:      "no_limits",
+			login:     "alice@example.com",
+			localUser: "alice",
+		},
+		{
+			name:      "user_under_limit",
+			login:     "alice@example.com",
+			localUser: "alice",
+			limits:    tailcfg.SSHSessionLimits{MaxSessionsPerUser: 3},
+		},
+		{
+			name:      "user_over_limit",
+			login:     "alice@example.com",
+			localUser: "alice",
+			limits:    tailcfg.SSHSessionLimits{MaxSessionsPerUser: 2},
+			wantErr:   "Too many concurrent sessions for alice@example.com (limit 2).",
+		},
+		{
+			name:      "local_user_over_limit",
+			login:     "carol@example.com",
+			localUser: "root",
+			limits:    tailcfg.SSHSessionLimits{MaxSessionsPerUser: 1, MaxSessionsPerLocalUser: 4},
+			wantErr:   `Too many concurrent sessions as local user "root" (limit 4).`,
+		},
+		{
+			// Tagged nodes are limited per node, not per tagged-devices user.
+			name:      "tagged_node",
+			login:     "tagged-devices",
+			localUser: "nobody",
+			tagged:    true,
+			limits:    tailcfg.SSHSessionLimits{MaxSessionsPerUser: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := addConn(tt.login, tt.localUser, tt.tagged, 1)
+			defer delete(srv.activeConns, c)
+			c.finalAction.SessionLimits = &tt.limits
+
+			err := srv.checkSessionLimits(c.sessions[0])
+			var uve userVisibleError
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("checkSessionLimits: %v", err)
+			case tt.wantErr == "":
+			case !errors.As(err, &uve):
+				t.Fatalf("checkSessionLimits = %v; want userVisibleError", err)
+			case uve.SSHTerminationMessage() != tt.wantErr:
+				t.Fatalf("message = %q; want %q", uve.SSHTerminationMessage(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSSHIdleTimeout(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	s := &server{
+		logf: tstest.WhileTestRunningLogger(t),
+		lb: &localState{
+			sshEnabled: true,
+			matchingRule: newSSHRule(
+				&tailcfg.SSHAction{
+					Accept: true,
+					SessionLimits: &tailcfg.SSHSessionLimits{
+						IdleTimeout: time.Second,
+					},
+				},
+			),
+		},
+	}
+	defer s.Shutdown()
+
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+
+	cfg := &testssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: testssh.InsecureIgnoreHostKey(),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c, chans, reqs, err := testssh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		client := testssh.NewClient(c, chans, reqs)
+		defer client.Close()
+
+		// Output resets the idle timer.
+		session, err := client.NewSession()
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		out, err := session.CombinedOutput("for i in 1 2 3 4 5 6; do echo $i; sleep 0.3; done")
+		session.Close()
+		if err != nil {
+			t.Errorf("active session: %v, %q", err, out)
+		}
+
+		session, err = client.NewSession()
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		defer session.Close()
+		start := time.Now()
+		out, err = session.CombinedOutput("sleep 10")
+		if err == nil {
+			t.Errorf("idle session succeeded")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("idle session ran for %v", d)
+		}
+		if want := "Session idle timeout of 1s elapsed."; !strings.Contains(string(out), want) {
+			t.Errorf("output = %q; want %q", out, want)
+		}
+	}()
+	if err := s.HandleSSHConn(dc); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	wg.Wait()
+}
+
+func TestRunAuthzHook(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	script := func(body string) string {
+		path := filepath.Join(t.TempDir(), "hook")
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	handler := func(res string, code int) string {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req authzRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LocalUser != "alice" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(code)
+			io.WriteString(w, res)
+		}))
+		t.Cleanup(ts.Close)
+		return ts.URL
+	}
+
+	tests := []struct {
+		name    string
+		hook    string
+		want    *authzResponse
+		wantErr string
+	}{
+		{
+			name: "script-allow",
+			hook: script(`grep -q '"localUser":"alice"' && echo '{"allow":true}'`),
+			want: &authzResponse{Allow: true},
+		},
+		{
+			name: "script-deny",
+			hook: script(`echo '{"allow":false,"message":"not today"}'`),
+			want: &authzResponse{Message: "not today"},
+		},
+		{
+			name: "script-forced-command",
+			hook: script(`echo '{"allow":true,"command":"uptime"}'`),
+			want: &authzResponse{Allow: true, Command: "uptime"},
+		},
+		{
+			name:    "script-failure",
+			hook:    script(`echo oops >&2; exit 1`),
+			wantErr: "oops",
+		},
+		{
+			name:    "script-invalid-response",
+			hook:    script(`echo yes`),
+			wantErr: "invalid response",
+		},
+		{
+			name:    "script-timeout",
+			hook:    script(`sleep 10`),
+			wantErr: context.DeadlineExceeded.Error(),
+		},
+		{
+			name: "http-allow",
+			hook: handler(`{"allow":true}`, http.StatusOK),
+			want: &authzResponse{Allow: true},
+		},
+		{
+			name:    "http-error",
+			hook:    handler(`{"allow":true}`, http.StatusInternalServerError),
+			wantErr: "unexpected status",
+		},
+		{
+			name:    "relative-path",
+			hook:    "hook",
+			wantErr: "neither an absolute path nor an HTTP URL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			got, err := runAuthzHook(ctx, tt.hook, &authzRequest{Type: authzConnect, LocalUser: "alice"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHAuthzHook(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, req.Type+" "+req.Command)
+		mu.Unlock()
+		var res authzResponse
+		switch req.Command {
+		case "echo denied":
+			res.Message = "denied by hook"
+		case "echo original":
+			res.Allow = true
+			res.Command = `echo "forced, was $SSH_ORIGINAL_COMMAND"`
+		default:
+			res.Allow = true
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer hook.Close()
+
+	s := &server{
+		logf:      tstest.WhileTestRunningLogger(t),
+		authzHook: AuthzHookConfig{Hook: hook.URL},
+		lb: &localState{
+			sshEnabled:   true,
+			matchingRule: newSSHRule(&tailcfg.SSHAction{Accept: true}),
+		},
+	}
+	defer s.Shutdown()
+
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+
+	cfg := &testssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: testssh.InsecureIgnoreHostKey(),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c, chans, reqs, err := testssh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		client := testssh.NewClient(c, chans, reqs)
+		defer client.Close()
+
+		for _, tt := range []struct {
+			cmd     string
+			want    string
+			wantErr bool
+		}{
+			{cmd: "echo allowed", want: "allowed\n"},
+			{cmd: "echo denied", want: "denied by hook\r\n", wantErr: true},
+			{cmd: "echo original", want: "forced, was echo original\n"},
+		} {
+			session, err := client.NewSession()
+			if err != nil {
+				t.Errorf("client: %v", err)
+				return
+			}
+			out, err := session.CombinedOutput(tt.cmd)
+			session.Close()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%q: err = %v; want error %v", tt.cmd, err, tt.wantErr)
+			}
+			if string(out) != tt.want {
+				t.Errorf("%q: output = %q; want %q", tt.cmd, out, tt.want)
+			}
+		}
+	}()
+	if err := s.HandleSSHConn(dc); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"connect ", "session echo allowed", "session echo denied", "session echo original"}
+	if !slices.Equal(requests, want) {
+		t.Errorf("hook requests = %q; want %q", requests, want)
+	}
+}
+
 func TestAcceptEnvPair(t *testing.T) {
 	tests := []struct {
 		in   string
@@ -1250,6 +1611,26 @@ func TestAcceptEnvPair(t *testing.T) {
 	}
 }
 
+func TestValidX11Auth(t *testing.T) {
+	tests := []struct {
+		proto, cookie string
+		want          bool
+	}{
+		{"MIT-MAGIC-COOKIE-1", "0123456789abcdefABCDEF0123456789", true},
+		{"MIT-MAGIC-COOKIE-1", "", false},
+		{"", "00", false},
+		{"MIT-MAGIC-COOKIE-1", "012", false},
+		{"MIT-MAGIC-COOKIE-1", "00\nsource /etc/shadow", false},
+		{"MIT MAGIC", "00", false},
+		{"MIT-MAGIC-COOKIE-1\nremove", "00", false},
+	}
+	for _, tt := range tests {
+		if got := validX11Auth(ssh.X11{AuthProtocol: tt.proto, AuthCookie: tt.cookie}); got != tt.want {
+			t.Errorf("validX11Auth(%q, %q) = %v; want %v", tt.proto, tt.cookie, got, tt.want)
+		}
+	}
+}
+
 func TestPathFromPAMEnvLine(t *testing.T) {
 	u := &user.User{Username: "foo", HomeDir: "/Homes/Foo"}
 	tests := []struct {
@@ -196,6 +196,13 @@ type DERPNode struct {
 	// If zero, 443 is used.
 	DERPPort int `json:",omitempty"`
 
+	// QUICPort optionally provides a UDP port number on which the
+	// DERP server accepts DERP connections over QUIC, which clients
+	// try before falling back to TLS over TCP.
+	//
+	// If zero, the node doesn't support QUIC.
+	QUICPort int `json:",omitempty"`
+
 	// InsecureForTests is used by unit tests to disable TLS verification.
 	// It should not be set by users.
 	InsecureForTests bool `json:",omitempty"`
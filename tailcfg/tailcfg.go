@@ -177,7 +177,10 @@
 //   - 128: 2025-10-02: can handle C2N /debug/health.
 //   - 129: 2025-10-04: Fixed sleep/wake deadlock in magicsock when using peer relay (PR #17449)
 //   - 130: 2025-10-06: client can send key.HardwareAttestationPublic and key.HardwareAttestationKeySignature in MapRequest
-const CurrentCapabilityVersion CapabilityVersion = 130
+//   - 131: 2026-10-17: client can connect to DERP servers over QUIC (DERPNode.QUICPort)
+//   - 132: 2026-10-17: Client understands SSHAction.AllowLocalUnixForwarding, AllowRemoteUnixForwarding and AllowX11Forwarding
+//   - 133: 2026-10-17: Client understands SSHAction.SessionLimits
+const CurrentCapabilityVersion CapabilityVersion = 133
 
 // ID is an integer ID for a user, node, or login allocated by the
 // control plane.
@@ -2945,6 +2948,21 @@ type SSHAction struct {
 	// to use remote port forwarding if requested.
 	AllowRemotePortForwarding bool `json:"allowRemotePortForwarding,omitempty"`
 
+	// AllowLocalUnixForwarding, if true, allows accepted connections
+	// to forward connections to Unix sockets on the destination
+	// (OpenSSH's direct-streamlocal@openssh.com) if requested.
+	AllowLocalUnixForwarding bool `json:"allowLocalUnixForwarding,omitempty"`
+
+	// AllowRemoteUnixForwarding, if true, allows accepted connections
+	// to listen on Unix sockets on the destination and forward their
+	// connections back (OpenSSH's streamlocal-forward@openssh.com) if
+	// requested.
+	AllowRemoteUnixForwarding bool `json:"allowRemoteUnixForwarding,omitempty"`
+
+	// AllowX11Forwarding, if true, allows accepted connections to
+	// forward X11 if requested.
+	AllowX11Forwarding bool `json:"allowX11Forwarding,omitempty"`
+
 	// Recorders defines the destinations of the SSH session recorders.
 	// The recording will be uploaded to http://addr:port/record.
 	Recorders []netip.AddrPort `json:"recorders,omitempty"`
@@ -2952,6 +2970,40 @@ type SSHAction struct {
 	// OnRecorderFailure is the action to take if recording fails.
 	// If nil, the default action is to fail open.
 	OnRecordingFailure *SSHRecorderFailureAction `json:"onRecordingFailure,omitempty"`
+
+	// SessionLimits, if non-nil, are the limits on the sessions of
+	// accepted connections.
+	SessionLimits *SSHSessionLimits `json:"sessionLimits,omitempty"`
+}
+
+// SSHSessionLimits are limits on the sessions of accepted SSH connections.
+// Zero values mean no limit.
+type SSHSessionLimits struct {
+	// IdleTimeout, if non-zero, is how long a session can go without any
+	// input or output before being terminated.
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty,format:nano"`
+
+	// MaxSessionsPerUser is the maximum number of concurrent sessions of
+	// the tailnet user (or, for tagged nodes, the node) on this node.
+	MaxSessionsPerUser int `json:"maxSessionsPerUser,omitempty"`
+
+	// MaxSessionsPerLocalUser is the maximum number of concurrent sessions
+	// as the local user, across all tailnet users.
+	MaxSessionsPerLocalUser int `json:"maxSessionsPerLocalUser,omitempty"`
+
+	// CPUQuotaPercent is the maximum CPU time that the processes of a
+	// session can use, as a percentage of one CPU. For example, 200 allows
+	// using two CPUs. It is only enforced on Linux, with cgroup v2.
+	CPUQuotaPercent int `json:"cpuQuotaPercent,omitempty"`
+
+	// MemoryMaxBytes is the maximum memory use of the processes of a
+	// session, after which they are killed. It is only enforced on Linux,
+	// with cgroup v2.
+	MemoryMaxBytes int64 `json:"memoryMaxBytes,omitempty"`
+
+	// PidsMax is the maximum number of processes and threads in a session.
+	// It is only enforced on Linux, with cgroup v2.
+	PidsMax int `json:"pidsMax,omitempty"`
 }
 
 // SSHRecorderFailureAction is the action to take if recording fails.
@@ -483,6 +483,7 @@ func (src *DERPNode) Clone() *DERPNode {
 	STUNPort         int
 	STUNOnly         bool
 	DERPPort         int
+	QUICPort         int
 	InsecureForTests bool
 	STUNTestIP       string
 	CanPort80        bool
@@ -536,6 +537,9 @@ func (src *SSHAction) Clone() *SSHAction {
 	if dst.OnRecordingFailure != nil {
 		dst.OnRecordingFailure = ptr.To(*src.OnRecordingFailure)
 	}
+	if dst.SessionLimits != nil {
+		dst.SessionLimits = ptr.To(*src.SessionLimits)
+	}
 	return dst
 }
 
@@ -549,8 +553,12 @@ func (src *SSHAction) Clone() *SSHAction {
 	HoldAndDelegate           string
 	AllowLocalPortForwarding  bool
 	AllowRemotePortForwarding bool
+	AllowLocalUnixForwarding  bool
+	AllowRemoteUnixForwarding bool
+	AllowX11Forwarding        bool
 	Recorders                 []netip.AddrPort
 	OnRecordingFailure        *SSHRecorderFailureAction
+	SessionLimits             *SSHSessionLimits
 }{})
 
 // Clone makes a deep copy of SSHPrincipal.
@@ -1865,6 +1865,13 @@ func (v DERPNodeView) STUNOnly() bool { return v.ж.STUNOnly }
 // If zero, 443 is used.
 func (v DERPNodeView) DERPPort() int { return v.ж.DERPPort }
 
+// QUICPort optionally provides a UDP port number on which the
+// DERP server accepts DERP connections over QUIC, which clients
+// that have QUIC enabled try before falling back to TLS over TCP.
+//
+// If zero, the node doesn't support QUIC.
+func (v DERPNodeView) QUICPort() int { return v.ж.QUICPort }
+
 // InsecureForTests is used by unit tests to disable TLS verification.
 // It should not be set by users.
 func (v DERPNodeView) InsecureForTests() bool { return v.ж.InsecureForTests }
@@ -1888,6 +1895,7 @@ func (v DERPNodeView) CanPort80() bool { return v.ж.CanPort80 }
 	STUNPort         int
 	STUNOnly         bool
 	DERPPort         int
+	QUICPort         int
 	InsecureForTests bool
 	STUNTestIP       string
 	CanPort80        bool
@@ -2129,6 +2137,21 @@ func (v SSHActionView) AllowLocalPortForwarding() bool { return v.ж.AllowLocalP
 // to use remote port forwarding if requested.
 func (v SSHActionView) AllowRemotePortForwarding() bool { return v.ж.AllowRemotePortForwarding }
 
+// AllowLocalUnixForwarding, if true, allows accepted connections
+// to forward connections to Unix sockets on the destination
+// (OpenSSH's direct-streamlocal@openssh.com) if requested.
+func (v SSHActionView) AllowLocalUnixForwarding() bool { return v.ж.AllowLocalUnixForwarding }
+
+// AllowRemoteUnixForwarding, if true, allows accepted connections
+// to listen on Unix sockets on the destination and forward their
+// connections back (OpenSSH's streamlocal-forward@openssh.com) if
+// requested.
+func (v SSHActionView) AllowRemoteUnixForwarding() bool { return v.ж.AllowRemoteUnixForwarding }
+
+// AllowX11Forwarding, if true, allows accepted connections to
+// forward X11 if requested.
+func (v SSHActionView) AllowX11Forwarding() bool { return v.ж.AllowX11Forwarding }
+
 // Recorders defines the destinations of the SSH session recorders.
 // The recording will be uploaded to http://addr:port/record.
 func (v SSHActionView) Recorders() views.Slice[netip.AddrPort] { return views.SliceOf(v.ж.Recorders) }
@@ -2139,6 +2162,12 @@ func (v SSHActionView) OnRecordingFailure() views.ValuePointer[SSHRecorderFailur
 	return views.ValuePointerOf(v.ж.OnRecordingFailure)
 }
 
+// SessionLimits, if non-nil, are the limits on the sessions of
+// accepted connections.
+func (v SSHActionView) SessionLimits() views.ValuePointer[SSHSessionLimits] {
+	return views.ValuePointerOf(v.ж.SessionLimits)
+}
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _SSHActionViewNeedsRegeneration = SSHAction(struct {
 	Message                   string
@@ -2149,8 +2178,12 @@ func (v SSHActionView) OnRecordingFailure() views.ValuePointer[SSHRecorderFailur
 	HoldAndDelegate           string
 	AllowLocalPortForwarding  bool
 	AllowRemotePortForwarding bool
+	AllowLocalUnixForwarding  bool
+	AllowRemoteUnixForwarding bool
+	AllowX11Forwarding        bool
 	Recorders                 []netip.AddrPort
 	OnRecordingFailure        *SSHRecorderFailureAction
+	SessionLimits             *SSHSessionLimits
 }{})
 
 // View returns a read-only view of SSHPrincipal.
@@ -65,6 +65,20 @@
 // ReversePortForwardingCallback is a hook for allowing reverse port forwarding
 type ReversePortForwardingCallback func(ctx Context, bindHost string, bindPort uint32) bool
 
+// LocalUnixForwardingCallback is a hook for allowing Unix socket forwarding
+// from the client to the server. It returns a connection to the socket at
+// socketPath, or an error wrapping ErrRejected if forwarding is not allowed.
+type LocalUnixForwardingCallback func(ctx Context, socketPath string) (net.Conn, error)
+
+// ReverseUnixForwardingCallback is a hook for allowing Unix socket forwarding
+// from the server to the client. It returns a listener on the socket at
+// socketPath, or an error wrapping ErrRejected if forwarding is not allowed.
+// Closing the listener must remove the socket, if required.
+type ReverseUnixForwardingCallback func(ctx Context, socketPath string) (net.Listener, error)
+
+// X11Callback is a hook for allowing X11 forwarding.
+type X11Callback func(ctx Context, x11 X11) bool
+
 // ServerConfigCallback is a hook for creating custom default server configs
 type ServerConfigCallback func(ctx Context) *gossh.ServerConfig
 
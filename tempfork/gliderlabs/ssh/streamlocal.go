@@ -0,0 +1,179 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	forwardedUnixChannelType = "forwarded-streamlocal@openssh.com"
+)
+
+// ErrRejected is returned, possibly wrapped, by the Unix forwarding callbacks
+// when forwarding is not allowed.
+var ErrRejected = errors.New("unix forwarding is disabled")
+
+// direct-streamlocal data struct as specified in OpenSSH's PROTOCOL,
+// Section 2.4
+type localUnixForwardChannelData struct {
+	SocketPath string
+
+	Reserved0 string
+	Reserved1 uint32
+}
+
+// DirectStreamLocalHandler can be enabled by adding it to the server's
+// ChannelHandlers under direct-streamlocal@openssh.com.
+func DirectStreamLocalHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx Context) {
+	d := localUnixForwardChannelData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	if srv.LocalUnixForwardingCallback == nil {
+		newChan.Reject(gossh.Prohibited, ErrRejected.Error())
+		return
+	}
+	dconn, err := srv.LocalUnixForwardingCallback(ctx, d.SocketPath)
+	if err != nil {
+		if errors.Is(err, ErrRejected) {
+			newChan.Reject(gossh.Prohibited, ErrRejected.Error())
+		} else {
+			newChan.Reject(gossh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	go proxyChannel(ch, dconn)
+}
+
+type remoteUnixForwardRequest struct {
+	SocketPath string
+}
+
+type remoteUnixForwardChannelData struct {
+	SocketPath string
+	Reserved   string
+}
+
+// ForwardedUnixHandler can be enabled by creating a ForwardedUnixHandler and
+// adding the HandleSSHRequest callback to the server's RequestHandlers under
+// streamlocal-forward@openssh.com and cancel-streamlocal-forward@openssh.com.
+type ForwardedUnixHandler struct {
+	forwards map[string]net.Listener
+	sync.Mutex
+}
+
+func (h *ForwardedUnixHandler) HandleSSHRequest(ctx Context, srv *Server, req *gossh.Request) (bool, []byte) {
+	h.Lock()
+	if h.forwards == nil {
+		h.forwards = make(map[string]net.Listener)
+	}
+	h.Unlock()
+	conn := ctx.Value(ContextKeyConn).(*gossh.ServerConn)
+	switch req.Type {
+	case "streamlocal-forward@openssh.com":
+		var reqPayload remoteUnixForwardRequest
+		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			return false, []byte{}
+		}
+		if srv.ReverseUnixForwardingCallback == nil {
+			return false, []byte(ErrRejected.Error())
+		}
+		addr := reqPayload.SocketPath
+		h.Lock()
+		_, dup := h.forwards[addr]
+		h.Unlock()
+		if dup {
+			return false, []byte{}
+		}
+		ln, err := srv.ReverseUnixForwardingCallback(ctx, addr)
+		if err != nil {
+			return false, []byte{}
+		}
+		h.Lock()
+		h.forwards[addr] = ln
+		h.Unlock()
+		go func() {
+			<-ctx.Done()
+			h.Lock()
+			ln, ok := h.forwards[addr]
+			h.Unlock()
+			if ok {
+				ln.Close()
+			}
+		}()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					break
+				}
+				payload := gossh.Marshal(&remoteUnixForwardChannelData{
+					SocketPath: addr,
+				})
+				go func() {
+					ch, reqs, err := conn.OpenChannel(forwardedUnixChannelType, payload)
+					if err != nil {
+						c.Close()
+						return
+					}
+					go gossh.DiscardRequests(reqs)
+					proxyChannel(ch, c)
+				}()
+			}
+			h.Lock()
+			if h.forwards[addr] == ln {
+				delete(h.forwards, addr)
+			}
+			h.Unlock()
+		}()
+		return true, nil
+
+	case "cancel-streamlocal-forward@openssh.com":
+		var reqPayload remoteUnixForwardRequest
+		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			return false, []byte{}
+		}
+		h.Lock()
+		ln, ok := h.forwards[reqPayload.SocketPath]
+		h.Unlock()
+		if ok {
+			ln.Close()
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// proxyChannel copies data between ch and c until either side is done, then
+// closes both.
+func proxyChannel(ch gossh.Channel, c net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer ch.Close()
+		defer c.Close()
+		io.Copy(ch, c)
+	}()
+	go func() {
+		defer wg.Done()
+		defer ch.Close()
+		defer c.Close()
+		io.Copy(c, ch)
+	}()
+	wg.Wait()
+}
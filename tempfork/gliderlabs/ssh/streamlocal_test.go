@@ -0,0 +1,225 @@
+//go:build glidertests
+
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func sampleUnixSocketServer(t *testing.T) (net.Listener, string) {
+	path := filepath.Join(t.TempDir(), "sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+	return l, path
+}
+
+func TestLocalUnixForwardingWorks(t *testing.T) {
+	t.Parallel()
+
+	l, path := sampleUnixSocketServer(t)
+	defer l.Close()
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {},
+		LocalUnixForwardingCallback: func(ctx Context, socketPath string) (net.Conn, error) {
+			if socketPath != path {
+				panic("unexpected socketPath: " + socketPath)
+			}
+			return net.Dial("unix", socketPath)
+		},
+	}, nil)
+	defer cleanup()
+
+	conn, err := client.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Error connecting to %v: %v", path, err)
+	}
+	result, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+}
+
+func TestLocalUnixForwardingRespectsCallback(t *testing.T) {
+	t.Parallel()
+
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {},
+		LocalUnixForwardingCallback: func(ctx Context, socketPath string) (net.Conn, error) {
+			return nil, fmt.Errorf("no: %w", ErrRejected)
+		},
+	}, nil)
+	defer cleanup()
+
+	_, err := client.Dial("unix", "/nonexistent")
+	if err == nil {
+		t.Fatal("Expected error but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "unix forwarding is disabled") {
+		t.Fatalf("Expected permission error but got %#v", err)
+	}
+}
+
+func TestReverseUnixForwardingWorks(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "sock")
+	forwardHandler := &ForwardedUnixHandler{}
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {},
+		ReverseUnixForwardingCallback: func(ctx Context, socketPath string) (net.Listener, error) {
+			return net.Listen("unix", socketPath)
+		},
+		RequestHandlers: map[string]RequestHandler{
+			"streamlocal-forward@openssh.com":        forwardHandler.HandleSSHRequest,
+			"cancel-streamlocal-forward@openssh.com": forwardHandler.HandleSSHRequest,
+		},
+	}, nil)
+	defer cleanup()
+
+	ln, err := client.ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReverseUnixForwardingRespectsCallback(t *testing.T) {
+	t.Parallel()
+
+	forwardHandler := &ForwardedUnixHandler{}
+	_, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {},
+		RequestHandlers: map[string]RequestHandler{
+			"streamlocal-forward@openssh.com": forwardHandler.HandleSSHRequest,
+		},
+	}, nil)
+	defer cleanup()
+
+	if _, err := client.ListenUnix(filepath.Join(t.TempDir(), "sock")); err == nil {
+		t.Fatal("Expected error but it succeeded")
+	}
+}
+
+func TestX11Forwarding(t *testing.T) {
+	t.Parallel()
+
+	want := X11{AuthProtocol: "MIT-MAGIC-COOKIE-1", AuthCookie: "00112233", ScreenNumber: 2}
+	done := make(chan struct{})
+	session, client, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			defer close(done)
+			x11, ok := s.X11()
+			if !ok || x11 != want {
+				t.Errorf("X11() = %+v, %v; want %+v, true", x11, ok, want)
+				return
+			}
+			l := newLocalListener()
+			go ForwardX11Connections(l, s)
+			defer l.Close()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			result, err := io.ReadAll(conn)
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(result, sampleServerResponse) {
+				t.Errorf("result = %#v; want %#v", result, sampleServerResponse)
+			}
+		},
+		X11Callback: func(ctx Context, x11 X11) bool {
+			return x11.AuthProtocol == "MIT-MAGIC-COOKIE-1"
+		},
+	}, nil)
+	defer cleanup()
+
+	chans := client.HandleChannelOpen(x11ChannelType)
+	go func() {
+		for nc := range chans {
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				return
+			}
+			go gossh.DiscardRequests(reqs)
+			ch.Write(sampleServerResponse)
+			ch.Close()
+		}
+	}()
+
+	ok, err := session.SendRequest(x11RequestType, true, gossh.Marshal(&want))
+	if err != nil || !ok {
+		t.Fatalf("x11-req = %v, %v; want true", ok, err)
+	}
+	if err := session.Run(""); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestX11ForwardingRespectsCallback(t *testing.T) {
+	t.Parallel()
+
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			if _, ok := s.X11(); ok {
+				t.Error("X11 forwarding unexpectedly accepted")
+			}
+		},
+	}, nil)
+	defer cleanup()
+
+	ok, err := session.SendRequest(x11RequestType, true, gossh.Marshal(&X11{AuthProtocol: "MIT-MAGIC-COOKIE-1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("x11-req accepted without a callback")
+	}
+}
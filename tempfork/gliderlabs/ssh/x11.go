@@ -0,0 +1,74 @@
+package ssh
+
+import (
+	"net"
+	"strconv"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	x11RequestType = "x11-req"
+	x11ChannelType = "x11"
+)
+
+// X11 represents an X11 forwarding request of a session.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4254#section-6.3.1
+type X11 struct {
+	// SingleConnection is whether only one connection should be forwarded.
+	SingleConnection bool
+	// AuthProtocol is the X11 authentication protocol, such as
+	// MIT-MAGIC-COOKIE-1.
+	AuthProtocol string
+	// AuthCookie is the hex-encoded X11 authentication cookie.
+	AuthCookie string
+	// ScreenNumber is the X11 screen number.
+	ScreenNumber uint32
+}
+
+// x11ChannelData is the payload of an x11 channel open request.
+type x11ChannelData struct {
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+func parseX11Request(payload []byte) (X11, bool) {
+	var x X11
+	if err := gossh.Unmarshal(payload, &x); err != nil {
+		return X11{}, false
+	}
+	return x, true
+}
+
+// ForwardX11Connections takes connections from a listener to proxy into the
+// session on X11 channels. It blocks and services connections until the
+// listener stops accepting. If the session requested a single connection,
+// it closes the listener after the first one.
+func ForwardX11Connections(l net.Listener, s Session) {
+	sshConn := s.Context().Value(ContextKeyConn).(gossh.Conn)
+	x11, _ := s.X11()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if x11.SingleConnection {
+			l.Close()
+		}
+		go func(conn net.Conn) {
+			var payload x11ChannelData
+			if host, port, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+				p, _ := strconv.ParseUint(port, 10, 32)
+				payload = x11ChannelData{host, uint32(p)}
+			}
+			channel, reqs, err := sshConn.OpenChannel(x11ChannelType, gossh.Marshal(&payload))
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go gossh.DiscardRequests(reqs)
+			proxyChannel(channel, conn)
+		}(conn)
+	}
+}
@@ -1923,6 +1923,46 @@ func TestEncryptStateMigration(t *testing.T) {
 	})
 }
 
+// TestPolicyBlocksNodeWithoutRules tests that a node that no rule of the
+// testcontrol policy applies to drops incoming traffic, rather than keeping
+// the allow-all packet filter it had before the policy was set.
+func TestPolicyBlocksNodeWithoutRules(t *testing.T) {
+	tstest.Shard(t)
+	tstest.Parallel(t)
+	env := NewTestEnv(t)
+
+	n1 := NewTestNode(t, env)
+	n2 := NewTestNode(t, env)
+	for _, n := range []*TestNode{n1, n2} {
+		n.StartDaemon()
+		n.AwaitResponding()
+		n.MustUp()
+		n.AwaitRunning()
+	}
+
+	// ICMP pings go through the packet filter of n2, unlike disco pings.
+	ping := func() error {
+		return n1.Tailscale("ping", "--icmp", "--c=1", "--timeout=1s", n2.AwaitIP4().String()).Run()
+	}
+	if err := tstest.WaitFor(20*time.Second, ping); err != nil {
+		t.Fatalf("ping before setting the policy: %v", err)
+	}
+
+	// Only n1 is a destination, so no rule applies to n2.
+	pol := fmt.Sprintf(`{"acls": [{"action": "accept", "src": ["*"], "dst": ["%v:*"]}]}`, n1.AwaitIP4())
+	if err := env.Control.SetPolicy([]byte(pol)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if ping() == nil {
+			return errors.New("n2 still accepts pings from n1")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // TestPeerRelayPing creates three nodes with one acting as a peer relay.
 // The test succeeds when "tailscale ping" flows through the peer
 // relay between all 3 nodes, and "tailscale debug peer-relay-sessions" returns
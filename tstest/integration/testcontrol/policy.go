@@ -0,0 +1,644 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package testcontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+)
+
+// policy is a tailnet policy document, as accepted by Server.SetPolicy.
+//
+// It supports a subset of the real policy file syntax: groups, tagOwners,
+// hosts, acls, grants (including app capabilities), nodeAttrs, ssh rules and
+// autoApprovers. Users are referred to by their testcontrol login names, such
+// as "user-1@fake-control.example.net".
+type policy struct {
+	Groups        map[string][]string  `json:"groups,omitempty"`
+	TagOwners     map[string][]string  `json:"tagOwners,omitempty"`
+	Hosts         map[string]string    `json:"hosts,omitempty"`
+	ACLs          []policyACL          `json:"acls,omitempty"`
+	Grants        []policyGrant        `json:"grants,omitempty"`
+	NodeAttrs     []policyNodeAttr     `json:"nodeAttrs,omitempty"`
+	SSH           []policySSH          `json:"ssh,omitempty"`
+	AutoApprovers *policyAutoApprovers `json:"autoApprovers,omitempty"`
+}
+
+// policyACL is a legacy "acls" rule.
+type policyACL struct {
+	Action string   `json:"action"`          // only "accept" is supported
+	Proto  string   `json:"proto,omitempty"` // empty means TCP, UDP and ICMP
+	Src    []string `json:"src"`
+	Dst    []string `json:"dst"` // "alias:ports", e.g. "tag:web:80,443"
+}
+
+// policyGrant is a "grants" rule.
+type policyGrant struct {
+	Src []string           `json:"src"`
+	Dst []string           `json:"dst"`
+	IP  []string           `json:"ip,omitempty"` // "*", "443", "tcp:443", "udp:1000-2000"
+	App tailcfg.PeerCapMap `json:"app,omitempty"`
+}
+
+// policyNodeAttr is a "nodeAttrs" entry, granting node capabilities.
+type policyNodeAttr struct {
+	Target []string           `json:"target"`
+	Attr   []string           `json:"attr,omitempty"`
+	App    tailcfg.NodeCapMap `json:"app,omitempty"`
+}
+
+// policySSH is an "ssh" rule.
+type policySSH struct {
+	Action    string   `json:"action"` // "accept" or "check"
+	Src       []string `json:"src"`
+	Dst       []string `json:"dst"`
+	Users     []string `json:"users"`
+	AcceptEnv []string `json:"acceptEnv,omitempty"`
+
+	// CheckPeriod is accepted for compatibility with real policy files,
+	// but ignored: every "check" is sent to Server.SSHCheck.
+	CheckPeriod string `json:"checkPeriod,omitempty"`
+}
+
+// policyAutoApprovers is the "autoApprovers" section.
+type policyAutoApprovers struct {
+	Routes   map[string][]string `json:"routes,omitempty"` // prefix => approvers
+	ExitNode []string            `json:"exitNode,omitempty"`
+}
+
+// parsePolicy parses and validates a HuJSON policy document.
+func parsePolicy(huj []byte) (*policy, error) {
+	b, err := hujson.Standardize(huj)
+	if err != nil {
+		return nil, fmt.Errorf("parsing policy: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	p := new(policy)
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("decoding policy: %w", err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *policy) validate() error {
+	var errs []error
+	checkAliases := func(where string, aliases []string) {
+		for _, a := range aliases {
+			if err := p.checkAlias(a); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", where, err))
+			}
+		}
+	}
+	for name, members := range p.Groups {
+		if !strings.HasPrefix(name, "group:") {
+			errs = append(errs, fmt.Errorf("groups: %q does not start with \"group:\"", name))
+		}
+		checkAliases("groups", members)
+	}
+	for tag := range p.TagOwners {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			errs = append(errs, fmt.Errorf("tagOwners: %w", err))
+		}
+	}
+	for name, h := range p.Hosts {
+		if _, err := parsePrefix(h); err != nil {
+			errs = append(errs, fmt.Errorf("hosts[%q]: %w", name, err))
+		}
+	}
+	for i, r := range p.ACLs {
+		where := fmt.Sprintf("acls[%d]", i)
+		if r.Action != "accept" {
+			errs = append(errs, fmt.Errorf("%s: unsupported action %q", where, r.Action))
+		}
+		if _, err := parseProto(r.Proto); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", where, err))
+		}
+		checkAliases(where, r.Src)
+		for _, d := range r.Dst {
+			alias, ports, ok := cutAliasPorts(d)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: dst %q has no ports", where, d))
+				continue
+			}
+			checkAliases(where, []string{alias})
+			if _, err := parsePorts(ports); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", where, err))
+			}
+		}
+	}
+	for i, g := range p.Grants {
+		where := fmt.Sprintf("grants[%d]", i)
+		if len(g.IP) == 0 && len(g.App) == 0 {
+			errs = append(errs, fmt.Errorf("%s: one of ip or app is required", where))
+		}
+		checkAliases(where, g.Src)
+		checkAliases(where, g.Dst)
+		for _, ip := range g.IP {
+			if _, _, err := parseGrantIP(ip); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", where, err))
+			}
+		}
+	}
+	for i, a := range p.NodeAttrs {
+		checkAliases(fmt.Sprintf("nodeAttrs[%d]", i), a.Target)
+	}
+	for i, r := range p.SSH {
+		where := fmt.Sprintf("ssh[%d]", i)
+		if r.Action != "accept" && r.Action != "check" {
+			errs = append(errs, fmt.Errorf("%s: unsupported action %q", where, r.Action))
+		}
+		if len(r.Users) == 0 {
+			errs = append(errs, fmt.Errorf("%s: users is required", where))
+		}
+		checkAliases(where, r.Src)
+		checkAliases(where, r.Dst)
+	}
+	if aa := p.AutoApprovers; aa != nil {
+		for route, approvers := range aa.Routes {
+			if _, err := netip.ParsePrefix(route); err != nil {
+				errs = append(errs, fmt.Errorf("autoApprovers.routes: %w", err))
+			}
+			checkAliases("autoApprovers.routes", approvers)
+		}
+		checkAliases("autoApprovers.exitNode", aa.ExitNode)
+	}
+	return errors.Join(errs...)
+}
+
+// checkAlias reports an error if alias can't be resolved by the policy.
+func (p *policy) checkAlias(alias string) error {
+	switch {
+	case alias == "*",
+		alias == "autogroup:member",
+		alias == "autogroup:tagged",
+		alias == "autogroup:self":
+		return nil
+	case strings.HasPrefix(alias, "autogroup:"):
+		return fmt.Errorf("unsupported autogroup %q", alias)
+	case strings.HasPrefix(alias, "group:"):
+		if _, ok := p.Groups[alias]; !ok {
+			return fmt.Errorf("undefined group %q", alias)
+		}
+		return nil
+	case strings.HasPrefix(alias, "tag:"):
+		if _, ok := p.TagOwners[alias]; !ok {
+			return fmt.Errorf("tag %q not in tagOwners", alias)
+		}
+		return nil
+	case strings.Contains(alias, "@"):
+		return nil
+	}
+	if _, ok := p.Hosts[alias]; ok {
+		return nil
+	}
+	if _, err := parsePrefix(alias); err != nil {
+		return fmt.Errorf("unknown alias %q", alias)
+	}
+	return nil
+}
+
+// policyNode is a node as seen by the policy compiler.
+type policyNode struct {
+	n         *tailcfg.Node  // Tags must be populated
+	loginName string         // login name of the owning user
+	routes    []netip.Prefix // approved subnet routes, including exit routes
+}
+
+func (pn *policyNode) tagged() bool { return len(pn.n.Tags) > 0 }
+
+// allowedTags returns the subset of requested tags that loginName is
+// permitted to apply according to tagOwners.
+func (p *policy) allowedTags(requested []string, loginName string) []string {
+	var tags []string
+	for _, tag := range requested {
+		for _, owner := range p.TagOwners[tag] {
+			if owner == "autogroup:admin" || owner == "autogroup:member" ||
+				owner == loginName ||
+				strings.HasPrefix(owner, "group:") && slices.Contains(p.Groups[owner], loginName) {
+				tags = append(tags, tag)
+				break
+			}
+		}
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// approvedRoutes returns the subset of advertised routes that pn may serve
+// without manual approval, according to autoApprovers.
+func (p *policy) approvedRoutes(pn *policyNode, advertised []netip.Prefix) []netip.Prefix {
+	aa := p.AutoApprovers
+	if aa == nil {
+		return nil
+	}
+	var ret []netip.Prefix
+	for _, r := range advertised {
+		if tsaddr.IsExitRoute(r) {
+			if p.anyNodeMatches(aa.ExitNode, pn) {
+				ret = append(ret, r)
+			}
+			continue
+		}
+		for route, approvers := range aa.Routes {
+			pfx, err := netip.ParsePrefix(route)
+			if err != nil || pfx.Bits() > r.Bits() || !pfx.Contains(r.Addr()) {
+				continue
+			}
+			if p.anyNodeMatches(approvers, pn) {
+				ret = append(ret, r)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// nodeMatches reports whether alias selects pn. IP and host aliases never
+// match nodes; see aliasPrefixes.
+func (p *policy) nodeMatches(alias string, pn *policyNode) bool {
+	switch {
+	case alias == "*":
+		return true
+	case alias == "autogroup:member":
+		return !pn.tagged()
+	case alias == "autogroup:tagged":
+		return pn.tagged()
+	case strings.HasPrefix(alias, "tag:"):
+		return slices.Contains(pn.n.Tags, alias)
+	case strings.HasPrefix(alias, "group:"):
+		return !pn.tagged() && slices.Contains(p.Groups[alias], pn.loginName)
+	case strings.Contains(alias, "@"):
+		return !pn.tagged() && alias == pn.loginName
+	}
+	return false
+}
+
+func (p *policy) anyNodeMatches(aliases []string, pn *policyNode) bool {
+	return slices.ContainsFunc(aliases, func(a string) bool { return p.nodeMatches(a, pn) })
+}
+
+// aliasPrefixes returns the IP prefixes that alias refers to among nodes.
+// It does not handle "*" or "autogroup:self".
+func (p *policy) aliasPrefixes(alias string, nodes []*policyNode) []netip.Prefix {
+	if h, ok := p.Hosts[alias]; ok {
+		alias = h
+	}
+	if pfx, err := parsePrefix(alias); err == nil {
+		return []netip.Prefix{pfx}
+	}
+	var ret []netip.Prefix
+	for _, pn := range nodes {
+		if p.nodeMatches(alias, pn) {
+			ret = append(ret, pn.n.Addresses...)
+		}
+	}
+	return ret
+}
+
+// srcIPs resolves srcs to the FilterRule.SrcIPs form. If sameUser is non-nil,
+// only untagged nodes owned by the same user as sameUser are included, as
+// needed for "autogroup:self" destinations.
+func (p *policy) srcIPs(srcs []string, nodes []*policyNode, sameUser *policyNode) []string {
+	if sameUser != nil {
+		var ret []string
+		for _, pn := range nodes {
+			if pn.tagged() || pn.loginName != sameUser.loginName || !p.anyNodeMatches(srcs, pn) {
+				continue
+			}
+			for _, a := range pn.n.Addresses {
+				ret = append(ret, a.String())
+			}
+		}
+		return ret
+	}
+	if slices.Contains(srcs, "*") {
+		return []string{"*"}
+	}
+	var ret []string
+	for _, src := range srcs {
+		for _, pfx := range p.aliasPrefixes(src, nodes) {
+			ret = append(ret, pfx.String())
+		}
+	}
+	slices.Sort(ret)
+	return slices.Compact(ret)
+}
+
+// dstPrefixes returns the prefixes of self selected by the destination
+// alias dst, and whether dst is "autogroup:self".
+func (p *policy) dstPrefixes(dst string, self *policyNode, nodes []*policyNode) (_ []netip.Prefix, isSelf bool) {
+	switch dst {
+	case "*":
+		return []netip.Prefix{tsaddr.AllIPv4(), tsaddr.AllIPv6()}, false
+	case "autogroup:self":
+		if self.tagged() {
+			return nil, true
+		}
+		return self.n.Addresses, true
+	}
+	// Exit routes are deliberately left out: only "*" grants access to
+	// the internet via an exit node.
+	owned := slices.Clone(self.n.Addresses)
+	for _, r := range self.routes {
+		if !tsaddr.IsExitRoute(r) {
+			owned = append(owned, r)
+		}
+	}
+	var ret []netip.Prefix
+	for _, pfx := range p.aliasPrefixes(dst, nodes) {
+		if slices.ContainsFunc(owned, pfx.Overlaps) {
+			ret = append(ret, pfx)
+		}
+	}
+	return ret, false
+}
+
+// packetFilter compiles the acls and grants of p into the packet filter
+// for self.
+func (p *policy) packetFilter(self *policyNode, nodes []*policyNode) []tailcfg.FilterRule {
+	var rules []tailcfg.FilterRule
+
+	// addRules appends rules from srcs to each of dsts, calling mk to build
+	// the rule for a set of source IPs and destination prefixes.
+	addRules := func(srcs, dsts []string, mk func(srcIPs []string, dsts []netip.Prefix) tailcfg.FilterRule) {
+		var plain []netip.Prefix
+		for _, dst := range dsts {
+			pfxs, isSelf := p.dstPrefixes(dst, self, nodes)
+			if len(pfxs) == 0 {
+				continue
+			}
+			if !isSelf {
+				plain = append(plain, pfxs...)
+				continue
+			}
+			if srcIPs := p.srcIPs(srcs, nodes, self); len(srcIPs) > 0 {
+				rules = append(rules, mk(srcIPs, pfxs))
+			}
+		}
+		if len(plain) > 0 {
+			if srcIPs := p.srcIPs(srcs, nodes, nil); len(srcIPs) > 0 {
+				rules = append(rules, mk(srcIPs, plain))
+			}
+		}
+	}
+
+	for _, r := range p.ACLs {
+		protos, _ := parseProto(r.Proto)
+		for _, d := range r.Dst {
+			alias, portSpec, _ := cutAliasPorts(d)
+			ports, _ := parsePorts(portSpec)
+			addRules(r.Src, []string{alias}, func(srcIPs []string, dsts []netip.Prefix) tailcfg.FilterRule {
+				return tailcfg.FilterRule{
+					SrcIPs:   srcIPs,
+					DstPorts: netPortRanges(dsts, ports),
+					IPProto:  protos,
+				}
+			})
+		}
+	}
+	for _, g := range p.Grants {
+		for _, ip := range g.IP {
+			protos, ports, _ := parseGrantIP(ip)
+			addRules(g.Src, g.Dst, func(srcIPs []string, dsts []netip.Prefix) tailcfg.FilterRule {
+				return tailcfg.FilterRule{
+					SrcIPs:   srcIPs,
+					DstPorts: netPortRanges(dsts, ports),
+					IPProto:  protos,
+				}
+			})
+		}
+		if len(g.App) > 0 {
+			addRules(g.Src, g.Dst, func(srcIPs []string, dsts []netip.Prefix) tailcfg.FilterRule {
+				return tailcfg.FilterRule{
+					SrcIPs: srcIPs,
+					CapGrant: []tailcfg.CapGrant{{
+						Dsts:   dsts,
+						CapMap: g.App,
+					}},
+				}
+			})
+		}
+	}
+	return rules
+}
+
+// nodeCapMap returns the node capabilities granted to self by nodeAttrs,
+// merged on top of base.
+func (p *policy) nodeCapMap(self *policyNode, base tailcfg.NodeCapMap) tailcfg.NodeCapMap {
+	ret := make(tailcfg.NodeCapMap)
+	for c, v := range base {
+		ret[c] = slices.Clone(v)
+	}
+	for _, a := range p.NodeAttrs {
+		if !p.anyNodeMatches(a.Target, self) {
+			continue
+		}
+		for _, attr := range a.Attr {
+			if _, ok := ret[tailcfg.NodeCapability(attr)]; !ok {
+				ret[tailcfg.NodeCapability(attr)] = []tailcfg.RawMessage{}
+			}
+		}
+		for c, v := range a.App {
+			ret[c] = append(ret[c], v...)
+		}
+	}
+	return ret
+}
+
+// sshPolicy compiles the ssh rules of p into the SSH policy for self.
+// checkURL is the HoldAndDelegate URL used for "check" rules.
+func (p *policy) sshPolicy(self *policyNode, nodes []*policyNode, checkURL string) *tailcfg.SSHPolicy {
+	pol := &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{}}
+	for _, r := range p.SSH {
+		var principals []*tailcfg.SSHPrincipal
+		addNode := func(pn *policyNode) {
+			for _, a := range pn.n.Addresses {
+				principals = append(principals, &tailcfg.SSHPrincipal{NodeIP: a.Addr().String()})
+			}
+		}
+		for _, dst := range r.Dst {
+			switch {
+			case dst == "autogroup:self":
+				if self.tagged() {
+					continue
+				}
+				for _, pn := range nodes {
+					if !pn.tagged() && pn.loginName == self.loginName && p.anyNodeMatches(r.Src, pn) {
+						addNode(pn)
+					}
+				}
+			case p.nodeMatches(dst, self):
+				if slices.Contains(r.Src, "*") {
+					principals = append(principals, &tailcfg.SSHPrincipal{Any: true})
+					continue
+				}
+				for _, pn := range nodes {
+					if p.anyNodeMatches(r.Src, pn) {
+						addNode(pn)
+					}
+				}
+			}
+		}
+		if len(principals) == 0 {
+			continue
+		}
+		action := &tailcfg.SSHAction{
+			Accept:                    r.Action == "accept",
+			AllowAgentForwarding:      true,
+			AllowLocalPortForwarding:  true,
+			AllowRemotePortForwarding: true,
+		}
+		if r.Action == "check" {
+			action = &tailcfg.SSHAction{HoldAndDelegate: checkURL}
+		}
+		pol.Rules = append(pol.Rules, &tailcfg.SSHRule{
+			Principals: principals,
+			SSHUsers:   sshUsers(r.Users),
+			Action:     action,
+			AcceptEnv:  r.AcceptEnv,
+		})
+	}
+	return pol
+}
+
+// sshCheckMatches reports whether a "check" ssh rule of p lets src connect
+// to dst as sshUser.
+func (p *policy) sshCheckMatches(src, dst *policyNode, nodes []*policyNode, sshUser string) bool {
+	for _, r := range p.sshPolicy(dst, nodes, "check").Rules {
+		if r.Action.HoldAndDelegate == "" {
+			continue
+		}
+		localUser, ok := r.SSHUsers[sshUser]
+		if !ok {
+			localUser, ok = r.SSHUsers["*"]
+		}
+		if !ok || localUser == "" {
+			continue
+		}
+		if slices.ContainsFunc(r.Principals, func(pr *tailcfg.SSHPrincipal) bool {
+			return pr.Any || slices.ContainsFunc(src.n.Addresses, func(a netip.Prefix) bool {
+				return a.Addr().String() == pr.NodeIP
+			})
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshUsers converts the users of an ssh rule to the SSHRule.SSHUsers form.
+func sshUsers(users []string) map[string]string {
+	m := make(map[string]string)
+	for _, u := range users {
+		if u == "autogroup:nonroot" {
+			m["*"] = "="
+			if _, ok := m["root"]; !ok {
+				m["root"] = ""
+			}
+			continue
+		}
+		m[u] = u
+	}
+	return m
+}
+
+// cutAliasPorts splits an acls destination like "tag:web:80,443" into its
+// alias and port parts.
+func cutAliasPorts(dst string) (alias, ports string, ok bool) {
+	i := strings.LastIndexByte(dst, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return dst[:i], dst[i+1:], true
+}
+
+// parsePorts parses a comma-separated list of ports or port ranges, or "*".
+func parsePorts(s string) ([]tailcfg.PortRange, error) {
+	if s == "*" {
+		return []tailcfg.PortRange{tailcfg.PortRangeAny}, nil
+	}
+	var ret []tailcfg.PortRange
+	for _, f := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(f, "-")
+		first, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", f)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.ParseUint(hi, 10, 16); err != nil || last < first {
+				return nil, fmt.Errorf("invalid port range %q", f)
+			}
+		}
+		ret = append(ret, tailcfg.PortRange{First: uint16(first), Last: uint16(last)})
+	}
+	return ret, nil
+}
+
+// parseProto parses an acls proto field. The empty string means the
+// default protocols and returns nil.
+func parseProto(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var p ipproto.Proto
+	if err := p.UnmarshalText([]byte(s)); err != nil {
+		return nil, err
+	}
+	return []int{int(p)}, nil
+}
+
+// parseGrantIP parses an entry of a grant's ip field, such as "*", "443" or
+// "tcp:8000-8080".
+func parseGrantIP(s string) (protos []int, ports []tailcfg.PortRange, err error) {
+	if s == "*" {
+		return nil, []tailcfg.PortRange{tailcfg.PortRangeAny}, nil
+	}
+	portSpec := s
+	if proto, rest, ok := strings.Cut(s, ":"); ok {
+		if protos, err = parseProto(proto); err != nil {
+			return nil, nil, err
+		}
+		portSpec = rest
+	}
+	ports, err = parsePorts(portSpec)
+	return protos, ports, err
+}
+
+// parsePrefix parses s as either a CIDR prefix or a single IP address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func netPortRanges(dsts []netip.Prefix, ports []tailcfg.PortRange) []tailcfg.NetPortRange {
+	var ret []tailcfg.NetPortRange
+	for _, dst := range dsts {
+		for _, pr := range ports {
+			ret = append(ret, tailcfg.NetPortRange{IP: dst.String(), Ports: pr})
+		}
+	}
+	return ret
+}
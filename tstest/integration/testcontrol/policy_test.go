@@ -0,0 +1,478 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package testcontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+const testPolicy = `{
+	// Comments and trailing commas are allowed.
+	"groups": {
+		"group:admins": ["user-1@fake-control.example.net"],
+	},
+	"tagOwners": {
+		"tag:web":    ["group:admins"],
+		"tag:router": ["autogroup:admin"],
+	},
+	"hosts": {
+		"lan": "10.0.0.0/24",
+	},
+	"acls": [
+		{"action": "accept", "src": ["group:admins"], "dst": ["tag:web:80,443"]},
+		{"action": "accept", "src": ["autogroup:member"], "dst": ["autogroup:self:*"]},
+		{"action": "accept", "proto": "udp", "src": ["*"], "dst": ["lan:53"]},
+	],
+	"grants": [
+		{
+			"src": ["autogroup:member"],
+			"dst": ["tag:web"],
+			"app": {"example.com/cap/web": [{"role": "viewer"}]},
+		},
+	],
+	"nodeAttrs": [
+		{"target": ["tag:web"], "attr": ["funnel"]},
+	],
+	"ssh": [
+		{"action": "check", "src": ["autogroup:member"], "dst": ["autogroup:self"], "users": ["autogroup:nonroot"]},
+		{"action": "accept", "src": ["group:admins"], "dst": ["tag:web"], "users": ["root"]},
+	],
+	"autoApprovers": {
+		"routes":   {"10.0.0.0/16": ["tag:router"]},
+		"exitNode": ["tag:router"],
+	},
+}`
+
+func testPolicyNodes(pol *policy) (alice, bob, web, router *policyNode) {
+	mk := func(id int, login string, requestTags []string, routes ...netip.Prefix) *policyNode {
+		addr := netip.PrefixFrom(netip.AddrFrom4([4]byte{100, 64, 0, byte(id)}), 32)
+		pn := &policyNode{
+			n: &tailcfg.Node{
+				ID:        tailcfg.NodeID(id),
+				Addresses: []netip.Prefix{addr},
+			},
+			loginName: login,
+		}
+		pn.n.Tags = pol.allowedTags(requestTags, login)
+		pn.routes = pol.approvedRoutes(pn, routes)
+		return pn
+	}
+	alice = mk(1, "user-1@fake-control.example.net", nil)
+	bob = mk(2, "user-2@fake-control.example.net", []string{"tag:web"}) // not an owner
+	web = mk(3, "user-1@fake-control.example.net", []string{"tag:web"})
+	router = mk(4, "user-2@fake-control.example.net", []string{"tag:router"},
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	)
+	return
+}
+
+func TestPolicyTagsAndRoutes(t *testing.T) {
+	pol, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bob, web, router := testPolicyNodes(pol)
+	if len(bob.n.Tags) != 0 {
+		t.Errorf("bob tags = %v; want none", bob.n.Tags)
+	}
+	if want := []string{"tag:web"}; !reflect.DeepEqual(web.n.Tags, want) {
+		t.Errorf("web tags = %v; want %v", web.n.Tags, want)
+	}
+	wantRoutes := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	}
+	if !reflect.DeepEqual(router.routes, wantRoutes) {
+		t.Errorf("router routes = %v; want %v", router.routes, wantRoutes)
+	}
+}
+
+func TestPolicyPacketFilter(t *testing.T) {
+	pol, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob, web, router := testPolicyNodes(pol)
+	all := []*policyNode{alice, bob, web, router}
+
+	got := pol.packetFilter(web, all)
+	want := []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.1/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.3/32", Ports: tailcfg.PortRange{First: 80, Last: 80}},
+				{IP: "100.64.0.3/32", Ports: tailcfg.PortRange{First: 443, Last: 443}},
+			},
+		},
+		{
+			SrcIPs: []string{"100.64.0.1/32", "100.64.0.2/32"},
+			CapGrant: []tailcfg.CapGrant{{
+				Dsts:   []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+				CapMap: tailcfg.PeerCapMap{"example.com/cap/web": {`{"role": "viewer"}`}},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("web packet filter:\n got: %+v\nwant: %+v", got, want)
+	}
+
+	got = pol.packetFilter(alice, all)
+	want = []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.1/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("alice packet filter:\n got: %+v\nwant: %+v", got, want)
+	}
+
+	got = pol.packetFilter(router, all)
+	want = []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"*"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "10.0.0.0/24", Ports: tailcfg.PortRange{First: 53, Last: 53}},
+			},
+			IPProto: []int{17},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("router packet filter:\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestPolicySSHAndNodeAttrs(t *testing.T) {
+	pol, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob, web, router := testPolicyNodes(pol)
+	all := []*policyNode{alice, bob, web, router}
+
+	got := pol.sshPolicy(alice, all, "https://control/check")
+	want := &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{{
+		Principals: []*tailcfg.SSHPrincipal{{NodeIP: "100.64.0.1"}},
+		SSHUsers:   map[string]string{"*": "=", "root": ""},
+		Action:     &tailcfg.SSHAction{HoldAndDelegate: "https://control/check"},
+	}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("alice SSH policy = %+v; want %+v", got, want)
+	}
+
+	got = pol.sshPolicy(web, all, "https://control/check")
+	want = &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{{
+		Principals: []*tailcfg.SSHPrincipal{{NodeIP: "100.64.0.1"}},
+		SSHUsers:   map[string]string{"root": "root"},
+		Action: &tailcfg.SSHAction{
+			Accept:                    true,
+			AllowAgentForwarding:      true,
+			AllowLocalPortForwarding:  true,
+			AllowRemotePortForwarding: true,
+		},
+	}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("web SSH policy = %+v; want %+v", got, want)
+	}
+
+	capMap := pol.nodeCapMap(web, tailcfg.NodeCapMap{tailcfg.CapabilityHTTPS: nil})
+	if _, ok := capMap[tailcfg.NodeAttrFunnel]; !ok {
+		t.Errorf("web CapMap = %v; missing funnel", capMap)
+	}
+	if _, ok := capMap[tailcfg.CapabilityHTTPS]; !ok {
+		t.Errorf("web CapMap = %v; missing base capability", capMap)
+	}
+	if capMap := pol.nodeCapMap(alice, nil); len(capMap) != 0 {
+		t.Errorf("alice CapMap = %v; want empty", capMap)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{"unknown-field", `{"aclz": []}`},
+		{"bad-action", `{"acls": [{"action": "deny", "src": ["*"], "dst": ["*:*"]}]}`},
+		{"no-ports", `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*"]}]}`},
+		{"undefined-group", `{"acls": [{"action": "accept", "src": ["group:nope"], "dst": ["*:*"]}]}`},
+		{"undefined-tag", `{"grants": [{"src": ["*"], "dst": ["tag:nope"], "ip": ["*"]}]}`},
+		{"bad-grant-ip", `{"grants": [{"src": ["*"], "dst": ["*"], "ip": ["tcp:http"]}]}`},
+		{"bad-ssh-action", `{"ssh": [{"action": "allow", "src": ["*"], "dst": ["*"], "users": ["root"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePolicy([]byte(tt.policy)); err == nil {
+				t.Errorf("parsePolicy succeeded; want error")
+			}
+		})
+	}
+}
+
+// newPolicyTestServer returns a Server with the nodes of testPolicyNodes,
+// in the order alice, bob, web and router, with node IDs 1 to 4.
+func newPolicyTestServer() (*Server, []key.NodePublic) {
+	s := &Server{
+		ExplicitBaseURL: "https://control.example",
+		nodes:           make(map[key.NodePublic]*tailcfg.Node),
+		users:           make(map[key.NodePublic]*tailcfg.User),
+		logins:          make(map[key.NodePublic]*tailcfg.Login),
+		updates:         make(map[tailcfg.NodeID]chan updateType),
+	}
+	var keys []key.NodePublic
+	add := func(user tailcfg.UserID, requestTags []string, routes ...netip.Prefix) {
+		id := tailcfg.NodeID(len(keys) + 1)
+		nk := key.NewNode().Public()
+		addr := netip.PrefixFrom(netip.AddrFrom4([4]byte{100, 64, 0, byte(id)}), 32)
+		s.nodes[nk] = &tailcfg.Node{
+			ID:         id,
+			StableID:   tailcfg.StableNodeID(fmt.Sprintf("TESTCTRL%08x", id)),
+			User:       user,
+			Key:        nk,
+			Addresses:  []netip.Prefix{addr},
+			AllowedIPs: []netip.Prefix{addr},
+			Hostinfo: (&tailcfg.Hostinfo{
+				RequestTags: requestTags,
+				RoutableIPs: routes,
+			}).View(),
+		}
+		s.users[nk] = &tailcfg.User{ID: user}
+		s.logins[nk] = &tailcfg.Login{
+			ID:        tailcfg.LoginID(user),
+			LoginName: fmt.Sprintf("user-%d@%s", user, domain),
+		}
+		s.updates[id] = make(chan updateType, 1)
+		keys = append(keys, nk)
+	}
+	add(1, nil)
+	add(2, []string{"tag:web"})
+	add(1, []string{"tag:web"})
+	add(2, []string{"tag:router"},
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	)
+	return s, keys
+}
+
+func TestSetPolicyMapResponse(t *testing.T) {
+	s, keys := newPolicyTestServer()
+	alice, web := keys[0], keys[2]
+
+	mapResponse := func(nk key.NodePublic) *tailcfg.MapResponse {
+		t.Helper()
+		res, err := s.MapResponse(&tailcfg.MapRequest{NodeKey: nk})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := mapResponse(alice)
+	if want := packetFilterWithIngress(false); !reflect.DeepEqual(res.PacketFilter, want) {
+		t.Errorf("packet filter without policy = %+v; want %+v", res.PacketFilter, want)
+	}
+	if want := (&tailcfg.SSHPolicy{}); !reflect.DeepEqual(res.SSHPolicy, want) {
+		t.Errorf("SSH policy without policy = %+v; want %+v", res.SSHPolicy, want)
+	}
+
+	if err := s.SetPolicy([]byte(testPolicy)); err != nil {
+		t.Fatal(err)
+	}
+	for id, c := range s.updates {
+		select {
+		case <-c:
+		default:
+			t.Errorf("node %v got no update from SetPolicy", id)
+		}
+	}
+
+	res = mapResponse(alice)
+	wantFilter := []tailcfg.FilterRule{{
+		SrcIPs: []string{"100.64.0.1/32"},
+		DstPorts: []tailcfg.NetPortRange{
+			{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+		},
+	}}
+	if !reflect.DeepEqual(res.PacketFilter, wantFilter) {
+		t.Errorf("alice packet filter:\n got: %+v\nwant: %+v", res.PacketFilter, wantFilter)
+	}
+	wantSSH := &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{{
+		Principals: []*tailcfg.SSHPrincipal{{NodeIP: "100.64.0.1"}},
+		SSHUsers:   map[string]string{"*": "=", "root": ""},
+		Action: &tailcfg.SSHAction{
+			HoldAndDelegate: "https://control.example/machine/ssh/action/from/$SRC_NODE_ID/to/$DST_NODE_ID?ssh_user=$SSH_USER&local_user=$LOCAL_USER",
+		},
+	}}}
+	if !reflect.DeepEqual(res.SSHPolicy, wantSSH) {
+		t.Errorf("alice SSH policy = %+v; want %+v", res.SSHPolicy, wantSSH)
+	}
+
+	res = mapResponse(web)
+	if want := []string{"tag:web"}; !reflect.DeepEqual(res.Node.Tags, want) {
+		t.Errorf("web tags = %v; want %v", res.Node.Tags, want)
+	}
+	if _, ok := res.Node.CapMap[tailcfg.NodeAttrFunnel]; !ok {
+		t.Errorf("web CapMap = %v; missing funnel", res.Node.CapMap)
+	}
+	if len(res.SSHPolicy.Rules) != 1 || !res.SSHPolicy.Rules[0].Action.Accept {
+		t.Errorf("web SSH policy = %+v; want one accept rule", res.SSHPolicy)
+	}
+
+	// A node that no rule applies to must get an explicitly empty packet
+	// filter, as a nil one means that the previous filter stays.
+	if err := s.SetPolicy([]byte(`{"acls": [{"action": "accept", "src": ["*"], "dst": ["100.64.0.3:*"]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	res = mapResponse(alice)
+	j, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded tailcfg.MapResponse
+	if err := json.Unmarshal(j, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.PacketFilter != nil || decoded.PacketFilters["base"] == nil || len(decoded.PacketFilters["base"]) != 0 {
+		t.Errorf("alice packet filters without matching rules = %+v, %+v; want an empty base filter", decoded.PacketFilter, decoded.PacketFilters)
+	}
+	if decoded.SSHPolicy == nil || len(decoded.SSHPolicy.Rules) != 0 {
+		t.Errorf("alice SSH policy without ssh rules = %+v; want empty", decoded.SSHPolicy)
+	}
+
+	if err := s.SetPolicy(nil); err != nil {
+		t.Fatal(err)
+	}
+	res = mapResponse(alice)
+	if want := packetFilterWithIngress(false); !reflect.DeepEqual(res.PacketFilter, want) {
+		t.Errorf("packet filter after removing policy = %+v; want %+v", res.PacketFilter, want)
+	}
+	if want := (&tailcfg.SSHPolicy{}); !reflect.DeepEqual(res.SSHPolicy, want) {
+		t.Errorf("SSH policy after removing policy = %+v; want %+v", res.SSHPolicy, want)
+	}
+}
+
+func TestServeSSHAction(t *testing.T) {
+	s, _ := newPolicyTestServer()
+	if err := s.SetPolicy([]byte(testPolicy)); err != nil {
+		t.Fatal(err)
+	}
+	checkOK := true
+	var checked []string
+	s.SSHCheck = func(src, dst *tailcfg.Node, sshUser, localUser string) bool {
+		checked = append(checked, fmt.Sprintf("%d->%d %s/%s", src.ID, dst.ID, sshUser, localUser))
+		return checkOK
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		checkFails  bool
+		wantCode    int
+		wantAccept  bool
+		wantChecked string // SSHCheck call, or empty if not called
+		wantMessage string // substring of the reject message
+	}{
+		{
+			name:        "self-nonroot",
+			path:        "/from/1/to/1?ssh_user=alice&local_user=alice",
+			wantCode:    200,
+			wantAccept:  true,
+			wantChecked: "1->1 alice/alice",
+		},
+		{
+			name:        "check-fails",
+			path:        "/from/1/to/1?ssh_user=alice&local_user=alice",
+			checkFails:  true,
+			wantCode:    200,
+			wantChecked: "1->1 alice/alice",
+			wantMessage: "SSH check failed",
+		},
+		{
+			name:        "self-root",
+			path:        "/from/1/to/1?ssh_user=root&local_user=root",
+			wantCode:    200,
+			wantMessage: "no SSH check rule",
+		},
+		{
+			name:        "other-user",
+			path:        "/from/2/to/1?ssh_user=alice&local_user=alice",
+			wantCode:    200,
+			wantMessage: "no SSH check rule",
+		},
+		{
+			name:        "tagged-src",
+			path:        "/from/3/to/1?ssh_user=alice&local_user=alice",
+			wantCode:    200,
+			wantMessage: "no SSH check rule",
+		},
+		{
+			name:        "accept-rule",
+			path:        "/from/1/to/3?ssh_user=root&local_user=root",
+			wantCode:    200,
+			wantMessage: "no SSH check rule",
+		},
+		{
+			name:     "unknown-node",
+			path:     "/from/1/to/99?ssh_user=alice&local_user=alice",
+			wantCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkOK = !tt.checkFails
+			checked = nil
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "/machine/ssh/action"+tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %v; want %v", rec.Code, tt.wantCode)
+			}
+			if want := []string{tt.wantChecked}; tt.wantChecked != "" && !reflect.DeepEqual(checked, want) ||
+				tt.wantChecked == "" && len(checked) > 0 {
+				t.Errorf("SSHCheck calls = %q; want %q", checked, tt.wantChecked)
+			}
+			if rec.Code != 200 {
+				return
+			}
+			var action tailcfg.SSHAction
+			if err := json.Unmarshal(rec.Body.Bytes(), &action); err != nil {
+				t.Fatal(err)
+			}
+			if action.Accept != tt.wantAccept || action.Reject == tt.wantAccept {
+				t.Errorf("action = %+v; want accept=%v", action, tt.wantAccept)
+			}
+			if !strings.Contains(action.Message, tt.wantMessage) {
+				t.Errorf("message = %q; want it to contain %q", action.Message, tt.wantMessage)
+			}
+		})
+	}
+
+	t.Run("no-policy", func(t *testing.T) {
+		if err := s.SetPolicy(nil); err != nil {
+			t.Fatal(err)
+		}
+		checked = nil
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", "/machine/ssh/action/from/1/to/1?ssh_user=alice&local_user=alice", nil))
+		var action tailcfg.SSHAction
+		if err := json.Unmarshal(rec.Body.Bytes(), &action); err != nil {
+			t.Fatal(err)
+		}
+		if !action.Reject || len(checked) > 0 {
+			t.Errorf("action = %+v, SSHCheck calls = %q; want reject without check", action, checked)
+		}
+	})
+}
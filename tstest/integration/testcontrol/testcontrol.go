@@ -61,7 +61,7 @@ type Server struct {
 	C2NResponses       syncs.Map[string, func(*http.Response)] // token => onResponse func
 
 	// PeerRelayGrants, if true, inserts relay capabilities into the wildcard
-	// grants rules.
+	// grants rules. It has no effect once a policy is set with SetPolicy.
 	PeerRelayGrants bool
 
 	// AllNodesSameUser, if true, makes all created nodes
@@ -71,6 +71,12 @@ type Server struct {
 	// DefaultNodeCapabilities overrides the capability map sent to each client.
 	DefaultNodeCapabilities *tailcfg.NodeCapMap
 
+	// SSHCheck, if non-nil, is called when a node asks whether an SSH
+	// connection matching a "check" rule of the policy (see SetPolicy) may
+	// proceed. It may block to simulate a user completing the check. If nil,
+	// all checks succeed.
+	SSHCheck func(src, dst *tailcfg.Node, sshUser, localUser string) bool
+
 	// CollectServices, if non-empty, sets whether the control server asks
 	// for service updates. If empty, the default is "true".
 	CollectServices opt.Bool
@@ -104,6 +110,11 @@ type Server struct {
 	// nodeCapMaps overrides the capability map sent down to a client.
 	nodeCapMaps map[key.NodePublic]tailcfg.NodeCapMap
 
+	// policy, if non-nil, is the tailnet policy set by SetPolicy. It's
+	// compiled per node into the packet filter, SSH policy and capability
+	// map in each MapResponse.
+	policy *policy
+
 	// suppressAutoMapResponses is the set of nodes that should not be sent
 	// automatic map responses from serveMap. (They should only get manually sent ones)
 	suppressAutoMapResponses set.Set[key.NodePublic]
@@ -326,6 +337,7 @@ func (s *Server) initMux() {
 	})
 	s.mux.HandleFunc("/key", s.serveKey)
 	s.mux.HandleFunc("/machine/", s.serveMachine)
+	s.mux.HandleFunc("/machine/ssh/action/", s.serveSSHAction)
 	s.mux.HandleFunc("/ts2021", s.serveNoiseUpgrade)
 	s.mux.HandleFunc("/c2n/", s.serveC2N)
 }
@@ -517,6 +529,114 @@ func (s *Server) SetNodeCapMap(nodeKey key.NodePublic, capMap tailcfg.NodeCapMap
 	s.updateLocked("SetNodeCapMap", s.nodeIDsLocked(0))
 }
 
+// SetPolicy replaces the tailnet policy with the HuJSON policy document huj
+// and sends new netmaps to all connected nodes.
+//
+// The policy's acls and grants replace the default allow-all packet filter,
+// its ssh rules are sent as the SSHPolicy and its nodeAttrs are merged into
+// each node's CapMap. Nodes get the tags they request via Hostinfo.RequestTags
+// if tagOwners permits, and advertised routes matching autoApprovers are
+// approved. An empty huj removes the policy.
+func (s *Server) SetPolicy(huj []byte) error {
+	var pol *policy
+	if len(bytes.TrimSpace(huj)) > 0 {
+		var err error
+		pol, err = parsePolicy(huj)
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = pol
+	s.updateLocked("SetPolicy", s.nodeIDsLocked(0))
+	return nil
+}
+
+// policyNodesLocked returns all nodes as seen by pol, with their tags and
+// auto-approved routes populated.
+//
+// s.mu must be held.
+func (s *Server) policyNodesLocked(pol *policy) map[key.NodePublic]*policyNode {
+	ret := make(map[key.NodePublic]*policyNode, len(s.nodes))
+	for nk, n := range s.nodes {
+		pn := &policyNode{n: n.Clone()}
+		if login, ok := s.logins[nk]; ok {
+			pn.loginName = login.LoginName
+		}
+		if hi := n.Hostinfo; hi.Valid() {
+			pn.n.Tags = pol.allowedTags(hi.RequestTags().AsSlice(), pn.loginName)
+			pn.routes = pol.approvedRoutes(pn, hi.RoutableIPs().AsSlice())
+		}
+		ret[nk] = pn
+	}
+	return ret
+}
+
+// sortedPolicyNodes returns the values of polNodes sorted by node ID.
+func sortedPolicyNodes(polNodes map[key.NodePublic]*policyNode) []*policyNode {
+	return slices.SortedFunc(maps.Values(polNodes), func(a, b *policyNode) int {
+		return cmp.Compare(a.n.ID, b.n.ID)
+	})
+}
+
+// serveSSHAction serves the HoldAndDelegate URL of "check" SSH rules.
+//
+// The connection is rejected unless a "check" rule of the current policy
+// lets the source node connect to the destination node as ssh_user, in
+// which case SSHCheck decides.
+func (s *Server) serveSSHAction(w http.ResponseWriter, r *http.Request) {
+	var srcID, dstID tailcfg.NodeID
+	if _, err := fmt.Sscanf(r.URL.Path, "/machine/ssh/action/from/%d/to/%d", &srcID, &dstID); err != nil {
+		http.Error(w, "bad SSH action path", 400)
+		return
+	}
+	sshUser, localUser := r.FormValue("ssh_user"), r.FormValue("local_user")
+
+	s.mu.Lock()
+	pol := s.policy
+	var nodes []*policyNode
+	if pol != nil {
+		nodes = sortedPolicyNodes(s.policyNodesLocked(pol))
+	} else {
+		for _, n := range s.nodes {
+			nodes = append(nodes, &policyNode{n: n.Clone()})
+		}
+	}
+	s.mu.Unlock()
+
+	var src, dst *policyNode
+	for _, pn := range nodes {
+		if pn.n.ID == srcID {
+			src = pn
+		}
+		if pn.n.ID == dstID {
+			dst = pn
+		}
+	}
+	if src == nil || dst == nil {
+		http.Error(w, "unknown node", 404)
+		return
+	}
+	action := &tailcfg.SSHAction{
+		Reject:  true,
+		Message: "testcontrol: SSH check failed\n",
+	}
+	switch {
+	case pol == nil || !pol.sshCheckMatches(src, dst, nodes, sshUser):
+		action.Message = "testcontrol: no SSH check rule matches\n"
+	case s.SSHCheck == nil || s.SSHCheck(src.n, dst.n, sshUser, localUser):
+		action = &tailcfg.SSHAction{
+			Accept:                    true,
+			AllowAgentForwarding:      true,
+			AllowLocalPortForwarding:  true,
+			AllowRemotePortForwarding: true,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(action)
+}
+
 // nodeIDsLocked returns the node IDs of all nodes in the server, except
 // for the node with the given ID.
 func (s *Server) nodeIDsLocked(except tailcfg.NodeID) []tailcfg.NodeID {
@@ -1107,8 +1227,26 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 
 	s.mu.Lock()
 	nodeCapMap := maps.Clone(s.nodeCapMaps[nk])
+	pol := s.policy
+	var polNodes map[key.NodePublic]*policyNode
+	if pol != nil {
+		polNodes = s.policyNodesLocked(pol)
+	}
 	s.mu.Unlock()
 
+	packetFilter := packetFilterWithIngress(s.PeerRelayGrants)
+	// A nil SSHPolicy means unchanged to clients, so always send one, to
+	// drop the rules of a previous policy.
+	sshPolicy := &tailcfg.SSHPolicy{}
+	self := polNodes[nk]
+	if self != nil {
+		all := sortedPolicyNodes(polNodes)
+		packetFilter = pol.packetFilter(self, all)
+		sshPolicy = pol.sshPolicy(self, all, s.BaseURL()+"/machine/ssh/action/from/$SRC_NODE_ID/to/$DST_NODE_ID?ssh_user=$SSH_USER&local_user=$LOCAL_USER")
+		nodeCapMap = pol.nodeCapMap(self, nodeCapMap)
+		node.Tags = self.n.Tags
+	}
+
 	node.CapMap = nodeCapMap
 	node.Capabilities = append(node.Capabilities, tailcfg.NodeAttrDisableUPnP)
 
@@ -1126,10 +1264,17 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 		DERPMap:         s.DERPMap,
 		Domain:          domain,
 		CollectServices: cmp.Or(s.CollectServices, opt.True),
-		PacketFilter:    packetFilterWithIngress(s.PeerRelayGrants),
+		PacketFilter:    packetFilter,
+		SSHPolicy:       sshPolicy,
 		DNSConfig:       dns,
 		ControlTime:     &t,
 	}
+	if len(packetFilter) == 0 {
+		// An empty PacketFilter is omitted from the JSON and then means
+		// unchanged, so send an empty base filter to block everything.
+		res.PacketFilter = nil
+		res.PacketFilters = map[string][]tailcfg.FilterRule{"base": {}}
+	}
 
 	s.mu.Lock()
 	nodeMasqs := s.masquerades[node.Key]
@@ -1169,6 +1314,10 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 			p.PrimaryRoutes = routes
 			p.AllowedIPs = append(p.AllowedIPs, routes...)
 		}
+		if pn := polNodes[p.Key]; pn != nil {
+			p.Tags = pn.n.Tags
+			addApprovedRoutes(p, pn.routes)
+		}
 		res.Peers = append(res.Peers, p)
 	}
 
@@ -1189,6 +1338,9 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 	defer s.mu.Unlock()
 	res.Node.PrimaryRoutes = s.nodeSubnetRoutes[nk]
 	res.Node.AllowedIPs = append(res.Node.Addresses, s.nodeSubnetRoutes[nk]...)
+	if self != nil {
+		addApprovedRoutes(res.Node, self.routes)
+	}
 
 	// Consume a PingRequest while protected by mutex if it exists
 	switch m := s.msgToSend[nk].(type) {
@@ -1199,6 +1351,21 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 	return res, nil
 }
 
+// addApprovedRoutes adds the policy-approved routes to n's AllowedIPs and,
+// except for exit routes, to its PrimaryRoutes.
+func addApprovedRoutes(n *tailcfg.Node, routes []netip.Prefix) {
+	n.AllowedIPs = slices.Clip(n.AllowedIPs)
+	n.PrimaryRoutes = slices.Clip(n.PrimaryRoutes)
+	for _, r := range routes {
+		if !slices.Contains(n.AllowedIPs, r) {
+			n.AllowedIPs = append(n.AllowedIPs, r)
+		}
+		if !tsaddr.IsExitRoute(r) && !slices.Contains(n.PrimaryRoutes, r) {
+			n.PrimaryRoutes = append(n.PrimaryRoutes, r)
+		}
+	}
+}
+
 func (s *Server) canGenerateAutomaticMapResponseFor(nk key.NodePublic) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
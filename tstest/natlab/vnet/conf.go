@@ -14,6 +14,7 @@
 
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"tailscale.com/net/portmapper/portmappertest"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/must"
 	"tailscale.com/util/set"
@@ -280,7 +281,8 @@ type Network struct {
 	nodes     []*Node
 	breakWAN4 bool // whether to break WAN IPv4 connectivity
 
-	svcs set.Set[NetworkService]
+	svcs      set.Set[NetworkService]
+	pmGateway *portmappertest.Gateway // or nil
 
 	latency  time.Duration // latency applied to interface writes
 	lossRate float64       // chance of packet loss (0.0 to 1.0)
@@ -310,6 +312,14 @@ func (n *Network) SetBlackholedIPv4(v bool) {
 	n.breakWAN4 = v
 }
 
+// SetPortMapGateway makes the network's router answer NAT-PMP and PCP
+// requests with gw, whose failure modes tests can script, instead of its
+// built-in NAT-PMP service. The mappings of gw take effect in the
+// network's NAT.
+func (n *Network) SetPortMapGateway(gw *portmappertest.Gateway) {
+	n.pmGateway = gw
+}
+
 func (n *Network) CanV4() bool {
 	return n.lanIP4.IsValid() || n.wanIP4.IsValid()
 }
@@ -375,7 +385,8 @@ func (s *Server) initFromConfig(c *Config) error {
 			num:        conf.num,
 			s:          s,
 			mac:        conf.mac,
-			portmap:    conf.svcs.Contains(NATPMP), // TODO: expand network.portmap
+			portmap:    conf.svcs.Contains(NATPMP) || conf.pmGateway != nil, // TODO: expand network.portmap
+			pmGateway:  conf.pmGateway,
 			wanIP6:     conf.wanIP6,
 			v4:         conf.lanIP4.IsValid(),
 			v6:         conf.wanIP6.IsValid(),
@@ -390,6 +401,9 @@ func (s *Server) initFromConfig(c *Config) error {
 		}
 		netOfConf[conf] = n
 		s.networks.Add(n)
+		if conf.pmGateway != nil {
+			conf.pmGateway.SetNAT(n)
+		}
 		if conf.wanIP4.IsValid() {
 			if conf.wanIP4.Is6() {
 				return fmt.Errorf("invalid IPv6 address in wanIP")
@@ -54,6 +54,7 @@
 	"tailscale.com/derp/derpserver"
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/netx"
+	"tailscale.com/net/portmapper/portmappertest"
 	"tailscale.com/net/stun"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
@@ -510,6 +511,7 @@ type network struct {
 	num            int // 1-based
 	mac            MAC // of router
 	portmap        bool
+	pmGateway      *portmappertest.Gateway // if non-nil, answers NAT-PMP and PCP
 	lanInterfaceID int
 	wanInterfaceID int
 	v4             bool                 // network supports IPv4
@@ -1342,6 +1344,22 @@ func (n *network) handleUDPPacketForRouter(ep EthernetPacket, udp *layers.UDP, t
 		return
 	}
 
+	if dstIP == n.lanIP4.Addr() && udp.DstPort == pcpPort && n.pmGateway != nil {
+		req := UDPPacket{
+			Src:     netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)),
+			Dst:     netip.AddrPortFrom(dstIP, uint16(udp.DstPort)),
+			Payload: udp.Payload,
+		}
+		if res := n.pmGateway.HandlePxP(req.Payload, req.Src); res != nil {
+			n.WriteUDPPacketNoNAT(UDPPacket{
+				Src:     req.Dst,
+				Dst:     req.Src,
+				Payload: res,
+			})
+		}
+		return
+	}
+
 	if dstIP == n.lanIP4.Addr() && isNATPMP(udp) {
 		n.handleNATPMPRequest(UDPPacket{
 			Src:     netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)),
@@ -1924,6 +1942,17 @@ func (n *network) doPortMap(src netip.Addr, dstLANPort, wantExtPort uint16, sec
 	return 0, false
 }
 
+// MapPort implements portmappertest.NAT, for the network's port mapping
+// gateway.
+func (n *network) MapPort(internal netip.AddrPort, want uint16, d time.Duration) (port uint16, ok bool) {
+	return n.doPortMap(internal.Addr(), internal.Port(), want, max(int(d/time.Second), 1))
+}
+
+// UnmapPort implements portmappertest.NAT.
+func (n *network) UnmapPort(internal netip.AddrPort, port uint16) {
+	n.doPortMap(internal.Addr(), internal.Port(), port, 0)
+}
+
 func (n *network) createARPResponse(pkt gopacket.Packet) ([]byte, error) {
 	ethLayer, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
 	if !ok {
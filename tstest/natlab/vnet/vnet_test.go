@@ -18,6 +18,7 @@
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"tailscale.com/net/portmapper/portmappertest"
 	"tailscale.com/util/must"
 )
 
@@ -662,3 +663,54 @@ func awaitCond(t testing.TB, timeout time.Duration, cond func() error) {
 		time.Sleep(10 * time.Millisecond)
 	}
 }
+
+func TestPortMapGateway(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	gw := portmappertest.NewGateway(portmappertest.Options{PMP: true, PCP: true, Logf: t.Logf})
+	nw.SetPortMapGateway(gw)
+	c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	se := newSideEffects(s)
+
+	// A NAT-PMP request to map UDP port 41641 for 2 hours.
+	req := []byte{0, 1, 0, 0, 0xa2, 0xa9, 0, 0, 0, 0, 0x1c, 0x20}
+	eth := &layers.Ethernet{
+		SrcMAC: nodeMac(1).HWAddr(),
+		DstMAC: routerMac(1).HWAddr(),
+	}
+	ip := mkIPLayer(layers.IPProtocolUDP, clientIPv4(1), netip.MustParseAddr("192.168.0.1"))
+	udp := &layers.UDP{SrcPort: 41641, DstPort: 5351}
+	if err := s.handleEthernetFrameFromVM(mustPacket(eth, ip, udp, gopacket.Payload(req))); err != nil {
+		t.Fatal(err)
+	}
+	if err := all(numPkts(1), pktSubstr("DstIP=192.168.0.101"), pktSubstr("SrcPort=5351("))(se); err != nil {
+		t.Error(err)
+	}
+
+	ms := gw.Mappings()
+	if len(ms) != 1 {
+		t.Fatalf("gateway mappings = %+v, want 1", ms)
+	}
+	if want := netip.AddrPortFrom(clientIPv4(1), 41641); ms[0].Internal != want {
+		t.Errorf("internal = %v, want %v", ms[0].Internal, want)
+	}
+	n, _ := s.networkByWAN.Lookup(netip.MustParseAddr("2.1.1.1"))
+	n.natMu.Lock()
+	pm, ok := n.portMap[ms[0].External]
+	n.natMu.Unlock()
+	if !ok || pm.dst != ms[0].Internal {
+		t.Errorf("NAT port map of %v = %+v, %v", ms[0].External, pm, ok)
+	}
+
+	gw.Reboot()
+	n.natMu.Lock()
+	defer n.natMu.Unlock()
+	if len(n.portMap) != 0 {
+		t.Errorf("NAT port map after reboot = %v", n.portMap)
+	}
+}
@@ -23,7 +23,8 @@ type Resolver struct {
 	//    known ahead of time, so bootstrap DNS resolution is not required.
 	//  - "http://node-address:port/path" for DNS over HTTP over WireGuard. This
 	//    is implemented in the PeerAPI for exit nodes and app connectors.
-	//  - [TODO] "tls://resolver.com" for DNS over TCP+TLS
+	//  - "tls://resolver.com[:port]" for DNS over TLS (RFC 7858), on port
+	//    853 by default.
 	Addr string `json:",omitempty"`
 
 	// BootstrapResolution is an optional suggested resolution for the
@@ -33,7 +34,9 @@ type Resolver struct {
 	// look up the DoT/DoH server using their local "classic" DNS
 	// resolver.
 	//
-	// As of 2022-09-08, BootstrapResolution is not yet used.
+	// As of 2026-10, BootstrapResolution is only used for DoT resolvers,
+	// for which it's required if the URL has a hostname: they're never
+	// looked up with the local resolver, which may be MagicDNS itself.
 	BootstrapResolution []netip.Addr `json:",omitempty"`
 
 	// UseWithExitNode designates that this resolver should continue to be used when an
@@ -183,8 +183,33 @@
 	// would otherwise obtain from the OS, e.g. by calling os.Hostname().
 	Hostname Key = "Hostname"
 
+	// TaildropMaxFileSize is an integer key that limits the size, in bytes,
+	// of each file this device receives with Taildrop.
+	// The default is 0, which means no limit.
+	TaildropMaxFileSize Key = "Taildrop.MaxFileSize"
+	// TaildropDailyQuotaPerSender is an integer key that limits the number of
+	// bytes this device receives with Taildrop from each sender per day.
+	// A sender is a user, or a tagged device.
+	// The default is 0, which means no limit.
+	TaildropDailyQuotaPerSender Key = "Taildrop.DailyQuotaPerSender"
+	// TaildropPerSenderDirectories is a boolean key that controls whether
+	// files received with Taildrop are stored in a subdirectory of the inbox
+	// named after their sender: the login name of the user, or the name of a
+	// tagged device.
+	TaildropPerSenderDirectories Key = "Taildrop.PerSenderDirectories"
+
 	// Keys with a string array value.
 
 	// AllowedSuggestedExitNodes's string array value is a list of exit node IDs that restricts which exit nodes are considered when generating suggestions for exit nodes.
 	AllowedSuggestedExitNodes Key = "AllowedSuggestedExitNodes"
+
+	// TaildropAllowedSenders's string array value is a list of user login
+	// names and tags (such as "tag:ci"). If non-empty, this device only
+	// receives files with Taildrop from the listed users and from tagged
+	// devices with any of the listed tags.
+	TaildropAllowedSenders Key = "Taildrop.AllowedSenders"
+	// TaildropDeniedSenders's string array value is a list of user login names
+	// and tags from which this device never receives files with Taildrop.
+	// It takes precedence over [TaildropAllowedSenders].
+	TaildropDeniedSenders Key = "Taildrop.DeniedSenders"
 )
@@ -44,6 +44,11 @@
 	setting.NewDefinition(pkey.ReconnectAfter, setting.DeviceSetting, setting.DurationValue),
 	setting.NewDefinition(pkey.Tailnet, setting.DeviceSetting, setting.StringValue),
 	setting.NewDefinition(pkey.HardwareAttestation, setting.DeviceSetting, setting.BooleanValue),
+	setting.NewDefinition(pkey.TaildropAllowedSenders, setting.DeviceSetting, setting.StringListValue),
+	setting.NewDefinition(pkey.TaildropDailyQuotaPerSender, setting.DeviceSetting, setting.IntegerValue),
+	setting.NewDefinition(pkey.TaildropDeniedSenders, setting.DeviceSetting, setting.StringListValue),
+	setting.NewDefinition(pkey.TaildropMaxFileSize, setting.DeviceSetting, setting.IntegerValue),
+	setting.NewDefinition(pkey.TaildropPerSenderDirectories, setting.DeviceSetting, setting.BooleanValue),
 
 	// User policy settings (can be configured on a user- or device-basis):
 	setting.NewDefinition(pkey.AdminConsoleVisibility, setting.UserSetting, setting.VisibilityValue),
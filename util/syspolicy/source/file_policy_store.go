@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package source
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/util/set"
+	"tailscale.com/util/syspolicy/internal/loggerx"
+	"tailscale.com/util/syspolicy/pkey"
+	"tailscale.com/util/syspolicy/setting"
+)
+
+var (
+	_ Store      = (*FilePolicyStore)(nil)
+	_ Lockable   = (*FilePolicyStore)(nil)
+	_ Changeable = (*FilePolicyStore)(nil)
+	_ Expirable  = (*FilePolicyStore)(nil)
+)
+
+// filePolicyPollInterval is how often a [FilePolicyStore] checks
+// its file for changes. It's a var for testing.
+var filePolicyPollInterval = 5 * time.Second
+
+// FilePolicyStore is a [Store] that reads policy settings from a JSON or HuJSON
+// file, such as /etc/tailscale/policy.json. The file contains a single object
+// whose member names are policy setting keys, and whose values are strings,
+// non-negative integers, booleans or arrays of strings:
+//
+//	{
+//		"ExitNodeID": "auto:any",
+//		"AllowedSuggestedExitNodes": ["nXXXXXXCNTRL", "nYYYYYYCNTRL"],
+//		"ApplyUpdates": "always",
+//	}
+//
+// A missing file is equivalent to an empty one. The file is watched for changes,
+// and registered change callbacks are invoked whenever its contents change.
+type FilePolicyStore struct {
+	path string
+	done chan struct{} // closed by Close
+
+	mu       sync.Mutex
+	stat     fileStat                     // of the last read file; zero if it did not exist
+	settings map[pkey.Key]json.RawMessage // or nil if the file is missing or was never read
+	readErr  error                        // non-nil if the file has never been read successfully
+	lockCnt  int
+	locked   *filePolicySnapshot   // or nil if not locked
+	cbs      set.HandleSet[func()] // policy change callbacks
+	closed   bool
+}
+
+// fileStat is the subset of [fs.FileInfo] used to detect file changes.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// filePolicySnapshot is an immutable view of a [FilePolicyStore]'s settings.
+type filePolicySnapshot struct {
+	settings map[pkey.Key]json.RawMessage
+	err      error
+}
+
+// NewFilePolicyStore returns a new [FilePolicyStore] that reads policy settings
+// from the file at the specified path. The file does not need to exist.
+// The returned store must be closed when no longer needed.
+func NewFilePolicyStore(path string) *FilePolicyStore {
+	s := &FilePolicyStore{path: path, done: make(chan struct{})}
+	s.mu.Lock()
+	s.reloadLocked()
+	s.mu.Unlock()
+	go s.watch(filePolicyPollInterval)
+	return s
+}
+
+// Path returns the path of the file the store reads policy settings from.
+func (s *FilePolicyStore) Path() string {
+	return s.path
+}
+
+// watch polls the file for changes every interval until s is closed.
+func (s *FilePolicyStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.checkForChanges()
+		}
+	}
+}
+
+// checkForChanges re-reads the file if it has changed since it was last read,
+// and invokes the change callbacks if it has.
+func (s *FilePolicyStore) checkForChanges() {
+	s.mu.Lock()
+	if s.closed || statFile(s.path) == s.stat {
+		s.mu.Unlock()
+		return
+	}
+	s.reloadLocked()
+	cbs := make([]func(), 0, len(s.cbs))
+	for _, cb := range s.cbs {
+		cbs = append(cbs, cb)
+	}
+	s.mu.Unlock()
+
+	for _, cb := range cbs {
+		cb()
+	}
+}
+
+// reloadLocked reads and parses the policy file. If the file cannot be read
+// or parsed, the previously read settings, if any, remain in effect so that
+// a typo in the file does not lift any restrictions it imposes.
+// s.mu must be held.
+func (s *FilePolicyStore) reloadLocked() {
+	s.stat = statFile(s.path)
+	settings, err := readPolicyFile(s.path)
+	if err != nil {
+		loggerx.Errorf("failed to read policy file %s: %v", s.path, err)
+		if s.settings == nil {
+			s.readErr = err
+		}
+		return
+	}
+	s.settings, s.readErr = settings, nil
+}
+
+func statFile(path string) fileStat {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStat{}
+	}
+	return fileStat{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// readPolicyFile reads and parses the policy file at path.
+// It returns nil, nil if the file does not exist.
+func readPolicyFile(path string) (map[pkey.Key]json.RawMessage, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b, err = hujson.Standardize(b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var settings map[pkey.Key]json.RawMessage
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// Lock implements [Lockable]. While the store is locked, reads return the
+// policy settings as they were when the store was first locked, even if the
+// file changes in the meantime.
+func (s *FilePolicyStore) Lock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.lockCnt++
+	if s.lockCnt == 1 {
+		s.locked = s.snapshotLocked()
+	}
+	return nil
+}
+
+// Unlock implements [Lockable].
+func (s *FilePolicyStore) Unlock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockCnt--
+	if s.lockCnt < 0 {
+		panic("negative lockCnt")
+	}
+	if s.lockCnt == 0 {
+		s.locked = nil
+	}
+}
+
+// RegisterChangeCallback implements [Changeable].
+func (s *FilePolicyStore) RegisterChangeCallback(callback func()) (unregister func(), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	handle := s.cbs.Add(callback)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.cbs, handle)
+	}, nil
+}
+
+// Done implements [Expirable].
+func (s *FilePolicyStore) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops watching the policy file and closes the store.
+func (s *FilePolicyStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	return nil
+}
+
+func (s *FilePolicyStore) snapshotLocked() *filePolicySnapshot {
+	return &filePolicySnapshot{settings: s.settings, err: s.readErr}
+}
+
+// lookup returns the raw value of the setting with the specified key,
+// or an error if the setting is not configured or the file is malformed.
+func (s *FilePolicyStore) lookup(key pkey.Key) (json.RawMessage, error) {
+	s.mu.Lock()
+	snap := s.locked
+	if snap == nil {
+		snap = s.snapshotLocked()
+	}
+	s.mu.Unlock()
+
+	if snap.err != nil {
+		return nil, snap.err
+	}
+	v, ok := snap.settings[key]
+	if !ok || bytes.Equal(v, []byte("null")) {
+		return nil, setting.ErrNotConfigured
+	}
+	return v, nil
+}
+
+// readFileSetting reads the setting with the specified key from s into a
+// value of type T.
+func readFileSetting[T any](s *FilePolicyStore, key pkey.Key) (T, error) {
+	var value T
+	raw, err := s.lookup(key)
+	if err != nil {
+		return value, err
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return value, fmt.Errorf("%s: %w: %s is not a valid %T", key, setting.ErrTypeMismatch, raw, value)
+	}
+	return value, nil
+}
+
+// ReadString implements [Store].
+func (s *FilePolicyStore) ReadString(key pkey.Key) (string, error) {
+	return readFileSetting[string](s, key)
+}
+
+// ReadUInt64 implements [Store].
+func (s *FilePolicyStore) ReadUInt64(key pkey.Key) (uint64, error) {
+	return readFileSetting[uint64](s, key)
+}
+
+// ReadBoolean implements [Store].
+func (s *FilePolicyStore) ReadBoolean(key pkey.Key) (bool, error) {
+	return readFileSetting[bool](s, key)
+}
+
+// ReadStringArray implements [Store].
+func (s *FilePolicyStore) ReadStringArray(key pkey.Key) ([]string, error) {
+	return readFileSetting[[]string](s, key)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package source
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tstest"
+	"tailscale.com/util/syspolicy/setting"
+)
+
+func writePolicyFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is detected even on file systems
+	// with coarse modification times.
+	mtime := time.Now().Add(time.Duration(len(contents)) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilePolicyStoreRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicyFile(t, path, `{
+		// HuJSON comments are allowed.
+		"ExitNodeID": "auto:any",
+		"AllowedSuggestedExitNodes": ["n1", "n2"],
+		"KeyExpirationNotice": "24h",
+		"LogSCMInteractions": true,
+		"MaxValue": 42,
+		"NullValue": null,
+	}`)
+	s := NewFilePolicyStore(path)
+	defer s.Close()
+
+	if got, err := s.ReadString("ExitNodeID"); err != nil || got != "auto:any" {
+		t.Errorf("ReadString = %q, %v; want %q, nil", got, err, "auto:any")
+	}
+	if got, err := s.ReadStringArray("AllowedSuggestedExitNodes"); err != nil || !reflect.DeepEqual(got, []string{"n1", "n2"}) {
+		t.Errorf("ReadStringArray = %q, %v; want [n1 n2], nil", got, err)
+	}
+	if got, err := s.ReadBoolean("LogSCMInteractions"); err != nil || !got {
+		t.Errorf("ReadBoolean = %v, %v; want true, nil", got, err)
+	}
+	if got, err := s.ReadUInt64("MaxValue"); err != nil || got != 42 {
+		t.Errorf("ReadUInt64 = %v, %v; want 42, nil", got, err)
+	}
+	if _, err := s.ReadString("NotConfigured"); !errors.Is(err, setting.ErrNotConfigured) {
+		t.Errorf("ReadString(NotConfigured) error = %v; want %v", err, setting.ErrNotConfigured)
+	}
+	if _, err := s.ReadString("NullValue"); !errors.Is(err, setting.ErrNotConfigured) {
+		t.Errorf("ReadString(NullValue) error = %v; want %v", err, setting.ErrNotConfigured)
+	}
+	if _, err := s.ReadBoolean("ExitNodeID"); !errors.Is(err, setting.ErrTypeMismatch) {
+		t.Errorf("ReadBoolean(ExitNodeID) error = %v; want %v", err, setting.ErrTypeMismatch)
+	}
+	if _, err := s.ReadUInt64("ExitNodeID"); !errors.Is(err, setting.ErrTypeMismatch) {
+		t.Errorf("ReadUInt64(ExitNodeID) error = %v; want %v", err, setting.ErrTypeMismatch)
+	}
+}
+
+func TestFilePolicyStoreMissingFile(t *testing.T) {
+	s := NewFilePolicyStore(filepath.Join(t.TempDir(), "policy.json"))
+	defer s.Close()
+	if _, err := s.ReadString("ExitNodeID"); !errors.Is(err, setting.ErrNotConfigured) {
+		t.Errorf("ReadString error = %v; want %v", err, setting.ErrNotConfigured)
+	}
+}
+
+func TestFilePolicyStoreMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicyFile(t, path, `{"ExitNodeID": `)
+	s := NewFilePolicyStore(path)
+	defer s.Close()
+	if _, err := s.ReadString("ExitNodeID"); err == nil || errors.Is(err, setting.ErrNotConfigured) {
+		t.Errorf("ReadString error = %v; want a parse error", err)
+	}
+}
+
+func TestFilePolicyStoreChanges(t *testing.T) {
+	tstest.Replace(t, &filePolicyPollInterval, 10*time.Millisecond)
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicyFile(t, path, `{"ExitNodeID": "n1"}`)
+	s := NewFilePolicyStore(path)
+	defer s.Close()
+
+	changed := make(chan struct{}, 1)
+	unregister, err := s.RegisterChangeCallback(func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unregister()
+
+	waitChange := func() {
+		t.Helper()
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for change callback")
+		}
+	}
+
+	// While locked, reads are consistent with the file as of the Lock call.
+	if err := s.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	writePolicyFile(t, path, `{"ExitNodeID": "n2"}`)
+	waitChange()
+	if got, _ := s.ReadString("ExitNodeID"); got != "n1" {
+		t.Errorf("ReadString while locked = %q; want %q", got, "n1")
+	}
+	s.Unlock()
+	if got, _ := s.ReadString("ExitNodeID"); got != "n2" {
+		t.Errorf("ReadString after change = %q; want %q", got, "n2")
+	}
+
+	// A malformed file does not discard the previous settings.
+	writePolicyFile(t, path, `{"ExitNodeID": `)
+	waitChange()
+	if got, err := s.ReadString("ExitNodeID"); err != nil || got != "n2" {
+		t.Errorf("ReadString after malformed change = %q, %v; want %q, nil", got, err, "n2")
+	}
+
+	// Removing the file removes the settings.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	waitChange()
+	if _, err := s.ReadString("ExitNodeID"); !errors.Is(err, setting.ErrNotConfigured) {
+		t.Errorf("ReadString after removal error = %v; want %v", err, setting.ErrNotConfigured)
+	}
+}
+
+func TestFilePolicyStoreClose(t *testing.T) {
+	s := NewFilePolicyStore(filepath.Join(t.TempDir(), "policy.json"))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Done channel not closed after Close")
+	}
+	if err := s.Lock(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Lock after Close = %v; want %v", err, ErrStoreClosed)
+	}
+	if _, err := s.RegisterChangeCallback(func() {}); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("RegisterChangeCallback after Close = %v; want %v", err, ErrStoreClosed)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_netlog && !ts_omit_logtail
+
+package netlog
+
+import "tailscale.com/types/netlogtype"
+
+// Exporter exports network logs locally, such as to a file or a flow
+// collector, in addition to or instead of uploading them to Tailscale's
+// log service.
+type Exporter interface {
+	// Export exports a log message. It is called from a single goroutine
+	// for each Logger, and must not retain m after it returns.
+	Export(m *netlogtype.Message) error
+
+	// Close releases the resources of the exporter.
+	Close() error
+}
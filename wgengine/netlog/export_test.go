@@ -0,0 +1,311 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+var testMessage = &netlogtype.Message{
+	NodeID: "n123456CNTRL",
+	Start:  time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	End:    time.Date(2025, 1, 2, 3, 4, 10, 0, time.UTC),
+	VirtualTraffic: []netlogtype.ConnectionCounts{{
+		Connection: netlogtype.Connection{
+			Proto: ipproto.TCP,
+			Src:   netip.MustParseAddrPort("100.64.0.1:41000"),
+			Dst:   netip.MustParseAddrPort("100.64.0.2:22"),
+		},
+		Counts: netlogtype.Counts{TxPackets: 10, TxBytes: 1000, RxPackets: 8, RxBytes: 4000},
+	}, {
+		Connection: netlogtype.Connection{
+			Proto: ipproto.UDP,
+			Src:   netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:5000"),
+			Dst:   netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:53"),
+		},
+		Counts: netlogtype.Counts{TxPackets: 1, TxBytes: 60},
+	}},
+	ExitTraffic: []netlogtype.ConnectionCounts{{
+		Connection: netlogtype.Connection{Src: netip.MustParseAddrPort("100.64.0.1:0")},
+		Counts:     netlogtype.Counts{TxPackets: 3, TxBytes: 300, RxPackets: 2, RxBytes: 200},
+	}},
+}
+
+var cmpAddrPort = cmp.Comparer(func(a, b netip.AddrPort) bool { return a == b })
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog.jsonl")
+	line, err := json.Marshal(fileMessage{Message: testMessage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotate after every two messages, leaving room for the logged times,
+	// which are longer than the zero time in line.
+	e, err := NewFileExporter(path, int64(2*(len(line)+1)+40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	for range 9 {
+		if err := e.Export(testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readMessages := func(path string) []netlogtype.Message {
+		t.Helper()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var msgs []netlogtype.Message
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var m struct {
+				Logged time.Time `json:"logged"`
+				netlogtype.Message
+			}
+			if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+				t.Fatalf("line %q: %v", sc.Bytes(), err)
+			}
+			if m.Logged.IsZero() {
+				t.Errorf("line %q: missing logged time", sc.Bytes())
+			}
+			msgs = append(msgs, m.Message)
+		}
+		return msgs
+	}
+	for _, p := range []string{path, path + ".1", path + ".2", path + ".3"} {
+		msgs := readMessages(p)
+		if len(msgs) != 2 && !(p == path && len(msgs) == 1) {
+			t.Errorf("%s has %d messages", p, len(msgs))
+		}
+		for _, m := range msgs {
+			if diff := cmp.Diff(*testMessage, m, cmpAddrPort); diff != "" {
+				t.Errorf("%s: message mismatch (-want +got):\n%s", p, diff)
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".4"); !os.IsNotExist(err) {
+		t.Errorf("more than three rotated files kept: %v", err)
+	}
+}
+
+// flowSet is a decoded set of an IPFIX message or NetFlow v9 packet.
+type flowSet struct {
+	id   uint16
+	data []byte
+}
+
+func decodeFlowPacket(t *testing.T, proto FlowProtocol, pkt []byte) (count uint16, seq uint32, sets []flowSet) {
+	t.Helper()
+	be := binary.BigEndian
+	if got := FlowProtocol(be.Uint16(pkt)); got != proto {
+		t.Fatalf("version = %d, want %d", got, proto)
+	}
+	var rest []byte
+	if proto == FlowNetFlowV9 {
+		count, seq, rest = be.Uint16(pkt[2:]), be.Uint32(pkt[12:]), pkt[20:]
+	} else {
+		if n := be.Uint16(pkt[2:]); int(n) != len(pkt) {
+			t.Fatalf("message length = %d, want %d", n, len(pkt))
+		}
+		seq, rest = be.Uint32(pkt[8:]), pkt[16:]
+	}
+	for len(rest) > 0 {
+		id, n := be.Uint16(rest), int(be.Uint16(rest[2:]))
+		if n < 4 || n > len(rest) || n%4 != 0 {
+			t.Fatalf("bad set length %d", n)
+		}
+		sets = append(sets, flowSet{id, rest[4:n]})
+		rest = rest[n:]
+	}
+	return count, seq, sets
+}
+
+type testFlow struct {
+	Src, Dst       netip.AddrPort
+	Proto          ipproto.Proto
+	Dir            byte
+	Bytes, Packets uint64
+}
+
+func TestFlowExporter(t *testing.T) {
+	for _, proto := range []FlowProtocol{FlowIPFIX, FlowNetFlowV9} {
+		t.Run(proto.String(), func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			e, err := NewFlowExporter(pc.LocalAddr().String(), proto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+
+			if err := e.Export(testMessage); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 65536)
+			pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, seq, sets := decodeFlowPacket(t, proto, buf[:n])
+			if seq != 0 {
+				t.Errorf("sequence = %d, want 0", seq)
+			}
+
+			tmplSet := uint16(2)
+			if proto == FlowNetFlowV9 {
+				tmplSet = 0
+			}
+			if len(sets) != 3 || sets[0].id != tmplSet || sets[1].id != templateIPv4 || sets[2].id != templateIPv6 {
+				t.Fatalf("got sets %v, want templates, IPv4 and IPv6 data", sets)
+			}
+			recLen := func(addrLen int) int {
+				n := 2*addrLen + 2 + 2 + 1 + 1 + 8 + 8 + 16
+				if proto == FlowNetFlowV9 {
+					n -= 8
+				}
+				return n
+			}
+			be := binary.BigEndian
+			var flows []testFlow
+			for _, set := range sets[1:] {
+				addrLen := 4
+				if set.id == templateIPv6 {
+					addrLen = 16
+				}
+				for d := set.data; len(d) >= recLen(addrLen); d = d[recLen(addrLen):] {
+					src, _ := netip.AddrFromSlice(d[:addrLen])
+					dst, _ := netip.AddrFromSlice(d[addrLen : 2*addrLen])
+					o := 2 * addrLen
+					flows = append(flows, testFlow{
+						Src:     netip.AddrPortFrom(src, be.Uint16(d[o:])),
+						Dst:     netip.AddrPortFrom(dst, be.Uint16(d[o+2:])),
+						Proto:   ipproto.Proto(d[o+4]),
+						Dir:     d[o+5],
+						Bytes:   be.Uint64(d[o+6:]),
+						Packets: be.Uint64(d[o+14:]),
+					})
+					if proto == FlowIPFIX {
+						if start := be.Uint64(d[o+22:]); start != uint64(testMessage.Start.UnixMilli()) {
+							t.Errorf("flowStartMilliseconds = %d", start)
+						}
+					}
+				}
+			}
+			want := []testFlow{
+				{netip.MustParseAddrPort("100.64.0.1:41000"), netip.MustParseAddrPort("100.64.0.2:22"), ipproto.TCP, 1, 1000, 10},
+				{netip.MustParseAddrPort("100.64.0.2:22"), netip.MustParseAddrPort("100.64.0.1:41000"), ipproto.TCP, 0, 4000, 8},
+				{netip.MustParseAddrPort("100.64.0.1:0"), netip.MustParseAddrPort("0.0.0.0:0"), 0, 1, 300, 3},
+				{netip.MustParseAddrPort("0.0.0.0:0"), netip.MustParseAddrPort("100.64.0.1:0"), 0, 0, 200, 2},
+				{netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:5000"), netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:53"), ipproto.UDP, 1, 60, 1},
+			}
+			if diff := cmp.Diff(want, flows, cmpAddrPort); diff != "" {
+				t.Errorf("flows mismatch (-want +got):\n%s", diff)
+			}
+			if proto == FlowNetFlowV9 && count != 2+5 {
+				t.Errorf("count = %d, want 7", count)
+			}
+		})
+	}
+}
+
+func TestFlowExporterSplitsPackets(t *testing.T) {
+	e := &FlowExporter{proto: FlowIPFIX, start: time.Now()}
+	m := &netlogtype.Message{Start: testMessage.Start, End: testMessage.End}
+	for i := range 100 {
+		m.VirtualTraffic = append(m.VirtualTraffic, netlogtype.ConnectionCounts{
+			Connection: netlogtype.Connection{
+				Proto: ipproto.TCP,
+				Src:   netip.AddrPortFrom(netip.MustParseAddr("100.64.0.1"), uint16(1000+i)),
+				Dst:   netip.MustParseAddrPort("100.64.0.2:443"),
+			},
+			Counts: netlogtype.Counts{TxPackets: 1, TxBytes: 100},
+		})
+	}
+	pkts := e.appendPackets(nil, m, time.Now())
+	if len(pkts) < 2 {
+		t.Fatalf("got %d packets, want several", len(pkts))
+	}
+	var seq uint32
+	for _, p := range pkts {
+		if len(p) > maxFlowPacketSize {
+			t.Errorf("packet of %d bytes exceeds %d", len(p), maxFlowPacketSize)
+		}
+		_, gotSeq, sets := decodeFlowPacket(t, FlowIPFIX, p)
+		if gotSeq != seq {
+			t.Errorf("sequence = %d, want %d", gotSeq, seq)
+		}
+		seq += uint32(len(sets[1].data) / 46)
+	}
+	if seq != 100 {
+		t.Errorf("exported %d records, want 100", seq)
+	}
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	e, err := NewPrometheusExporter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := e.Export(testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sb strings.Builder
+	if err := e.WritePrometheus(&sb); err != nil {
+		t.Fatal(err)
+	}
+	got := sb.String()
+	for _, want := range []string{
+		"# TYPE tailscaled_netlog_bytes_total counter\n",
+		`tailscaled_netlog_bytes_total{traffic="virtual",proto="tcp",src="100.64.0.1",dst="100.64.0.2",direction="tx"} 2000` + "\n",
+		`tailscaled_netlog_bytes_total{traffic="virtual",proto="tcp",src="100.64.0.1",dst="100.64.0.2",direction="rx"} 8000` + "\n",
+		`tailscaled_netlog_packets_total{traffic="exit",proto="",src="100.64.0.1",dst="",direction="rx"} 4` + "\n",
+		"tailscaled_netlog_last_export_timestamp_seconds 1735787050\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q; got:\n%s", want, got)
+		}
+	}
+}
+
+func TestParseExporters(t *testing.T) {
+	dir := t.TempDir()
+	exps, err := ParseExporters("jsonl:" + filepath.Join(dir, "a.jsonl") + ", ipfix:127.0.0.1:4739,netflow9:127.0.0.1:2055")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range exps {
+		e.Close()
+	}
+	if len(exps) != 3 {
+		t.Errorf("got %d exporters, want 3", len(exps))
+	}
+	for _, bad := range []string{"", "jsonl", "bogus:x", "jsonl:" + filepath.Join(dir, "missing", "a.jsonl")} {
+		if _, err := ParseExporters(bad); err == nil {
+			t.Errorf("ParseExporters(%q) succeeded", bad)
+		}
+	}
+}
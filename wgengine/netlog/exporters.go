@@ -0,0 +1,170 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_netlog && !ts_omit_logtail
+
+package netlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/netlogtype"
+)
+
+// ParseExporters parses a comma-separated list of exporters, as given to
+// tailscaled's --netlog-export flag, and returns them. Each exporter is
+// one of:
+//
+//   - "jsonl:<path>" writes JSON lines to a file; see FileExporter.
+//   - "ipfix:<host>:<port>" sends IPFIX messages over UDP; see FlowExporter.
+//   - "netflow9:<host>:<port>" sends NetFlow v9 packets over UDP.
+//   - "prometheus:<ip>:<port>" serves a summary in the Prometheus text
+//     format on /metrics; see PrometheusExporter.
+func ParseExporters(spec string) (_ []Exporter, err error) {
+	var exps []Exporter
+	defer func() {
+		if err != nil {
+			for _, e := range exps {
+				e.Close()
+			}
+		}
+	}()
+	for s := range strings.SplitSeq(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		typ, arg, ok := strings.Cut(s, ":")
+		if !ok || arg == "" {
+			return nil, fmt.Errorf("invalid network log exporter %q; want <type>:<arg>", s)
+		}
+		var e Exporter
+		switch typ {
+		case "jsonl":
+			e, err = NewFileExporter(arg, defaultMaxFileSize)
+		case "ipfix":
+			e, err = NewFlowExporter(arg, FlowIPFIX)
+		case "netflow9":
+			e, err = NewFlowExporter(arg, FlowNetFlowV9)
+		case "prometheus":
+			e, err = NewPrometheusExporter(arg)
+		default:
+			return nil, fmt.Errorf("unknown network log exporter type %q", typ)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("network log exporter %q: %w", s, err)
+		}
+		exps = append(exps, e)
+	}
+	if len(exps) == 0 {
+		return nil, errors.New("no network log exporters")
+	}
+	return exps, nil
+}
+
+const (
+	// defaultMaxFileSize is the size after which the file of a FileExporter
+	// is rotated.
+	defaultMaxFileSize = 64 << 20
+	// maxFileBackups is the number of rotated files of a FileExporter that
+	// are kept, as <path>.1 (the newest) through <path>.<maxFileBackups>.
+	maxFileBackups = 3
+)
+
+// FileExporter is an Exporter that appends each message to a file as a line
+// of JSON: a netlogtype.Message with an additional "logged" field for the
+// time it was written. This is the format that cmd/netlogfmt reads.
+//
+// Once the file grows past its maximum size, it is rotated to <path>.1, and
+// any older rotated files are shifted up, keeping at most three.
+type FileExporter struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewFileExporter returns a FileExporter that writes to the file at path,
+// which is created if needed, and rotated after maxSize bytes.
+func NewFileExporter(path string, maxSize int64) (*FileExporter, error) {
+	e := &FileExporter{path: path, maxSize: maxSize}
+	if err := e.open(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *FileExporter) String() string { return "jsonl:" + e.path }
+
+func (e *FileExporter) open() error {
+	f, err := os.OpenFile(e.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	e.f, e.size = f, fi.Size()
+	return nil
+}
+
+// fileMessage is a line of a FileExporter file.
+type fileMessage struct {
+	Logged time.Time `json:"logged"`
+	*netlogtype.Message
+}
+
+func (e *FileExporter) Export(m *netlogtype.Message) error {
+	b, err := json.Marshal(fileMessage{time.Now().UTC(), m})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.f == nil {
+		return errors.New("closed")
+	}
+	if e.size > 0 && e.size+int64(len(b)) > e.maxSize {
+		if err := e.rotateLocked(); err != nil {
+			return fmt.Errorf("rotating: %w", err)
+		}
+	}
+	n, err := e.f.Write(b)
+	e.size += int64(n)
+	return err
+}
+
+// rotateLocked rotates the file. If rotating fails, the file is reopened to
+// keep appending to it, if possible.
+func (e *FileExporter) rotateLocked() error {
+	e.f.Close()
+	e.f = nil
+	for i := maxFileBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", e.path, i), fmt.Sprintf("%s.%d", e.path, i+1))
+	}
+	err := os.Rename(e.path, e.path+".1")
+	return errors.Join(err, e.open())
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.f == nil {
+		return nil
+	}
+	err := e.f.Close()
+	e.f = nil
+	return err
+}
@@ -0,0 +1,305 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_netlog && !ts_omit_logtail
+
+package netlog
+
+import (
+	"cmp"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"tailscale.com/types/netlogtype"
+)
+
+// FlowProtocol is a flow export protocol of a FlowExporter.
+type FlowProtocol uint16
+
+const (
+	FlowNetFlowV9 FlowProtocol = 9  // NetFlow version 9 (RFC 3954)
+	FlowIPFIX     FlowProtocol = 10 // IPFIX (RFC 7011)
+)
+
+func (p FlowProtocol) String() string {
+	switch p {
+	case FlowNetFlowV9:
+		return "netflow9"
+	case FlowIPFIX:
+		return "ipfix"
+	}
+	return "unknown"
+}
+
+// Information elements exported by FlowExporter. IPFIX and NetFlow v9 share
+// the numbering of these, other than for flow start and end times.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieLastSwitched             = 21 // NetFlow v9, milliseconds of sysUptime
+	ieFirstSwitched            = 22 // NetFlow v9, milliseconds of sysUptime
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowDirection            = 61 // 0 is ingress, 1 is egress
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+)
+
+// Template IDs of the flow records, for IPv4 and IPv6 flows.
+const (
+	templateIPv4 = 256
+	templateIPv6 = 257
+)
+
+// maxFlowPacketSize is the largest UDP payload sent by a FlowExporter, to
+// stay clear of fragmentation.
+const maxFlowPacketSize = 1400
+
+// FlowExporter is an Exporter that sends flow records to a collector as
+// IPFIX messages or NetFlow v9 packets over UDP.
+//
+// Each connection in a message is exported as up to two unidirectional
+// flows: one for the transmitted counts, from the connection's source to
+// its destination with a flowDirection of egress, and one for the received
+// counts, in the other direction with a flowDirection of ingress.
+// Templates are included in every packet, so that collectors can decode
+// them no matter when they start.
+type FlowExporter struct {
+	proto FlowProtocol
+	conn  net.Conn
+	start time.Time // for NetFlow v9's sysUptime
+
+	seq uint32 // packets sent for NetFlow v9; data records sent for IPFIX
+}
+
+// NewFlowExporter returns a FlowExporter that sends flows to the collector
+// at addr ("host:port"), using the given protocol.
+func NewFlowExporter(addr string, proto FlowProtocol) (*FlowExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &FlowExporter{proto: proto, conn: conn, start: time.Now()}, nil
+}
+
+func (e *FlowExporter) String() string {
+	return e.proto.String() + ":" + e.conn.RemoteAddr().String()
+}
+
+func (e *FlowExporter) Close() error {
+	return e.conn.Close()
+}
+
+func (e *FlowExporter) Export(m *netlogtype.Message) error {
+	now := time.Now()
+	for _, p := range e.appendPackets(nil, m, now) {
+		if _, err := e.conn.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flowRecord is an encoded data record, and its template.
+type flowRecord struct {
+	template uint16
+	data     []byte
+}
+
+// appendPackets appends the packets that export m at time now to pkts.
+func (e *FlowExporter) appendPackets(pkts [][]byte, m *netlogtype.Message, now time.Time) [][]byte {
+	var recs []flowRecord
+	for _, traffic := range [][]netlogtype.ConnectionCounts{m.VirtualTraffic, m.SubnetTraffic, m.ExitTraffic, m.PhysicalTraffic} {
+		for _, cc := range traffic {
+			if cc.TxPackets > 0 || cc.TxBytes > 0 {
+				recs = append(recs, e.record(cc.Connection, cc.TxPackets, cc.TxBytes, 1, m))
+			}
+			if cc.RxPackets > 0 || cc.RxBytes > 0 {
+				c := netlogtype.Connection{Proto: cc.Proto, Src: cc.Dst, Dst: cc.Src}
+				recs = append(recs, e.record(c, cc.RxPackets, cc.RxBytes, 0, m))
+			}
+		}
+	}
+	// Group the records by template, for fewer sets.
+	slices.SortStableFunc(recs, func(a, b flowRecord) int {
+		return cmp.Compare(a.template, b.template)
+	})
+
+	var (
+		pkt      []byte
+		nrecs    int // records in pkt, including templates for NetFlow v9
+		ndata    int // data records in pkt
+		setStart int // offset of the current data set in pkt
+		setTmpl  uint16
+	)
+	flush := func() {
+		if ndata == 0 {
+			return
+		}
+		pkt = e.endSet(pkt, setStart)
+		e.finishPacket(pkt, nrecs, ndata, now)
+		pkts = append(pkts, pkt)
+		pkt, nrecs, ndata, setTmpl = nil, 0, 0, 0
+	}
+	for _, r := range recs {
+		if pkt != nil && len(pkt)+4+len(r.data)+3 > maxFlowPacketSize {
+			flush()
+		}
+		if pkt == nil {
+			pkt = e.appendHeader(nil)
+			pkt = e.appendTemplates(pkt)
+			nrecs = 2
+		}
+		if setTmpl != r.template {
+			if setTmpl != 0 {
+				pkt = e.endSet(pkt, setStart)
+			}
+			setStart = len(pkt)
+			setTmpl = r.template
+			pkt = binary.BigEndian.AppendUint16(pkt, r.template)
+			pkt = binary.BigEndian.AppendUint16(pkt, 0) // length, set by endSet
+		}
+		pkt = append(pkt, r.data...)
+		nrecs++
+		ndata++
+	}
+	flush()
+	return pkts
+}
+
+// record encodes a flow record for the connection c with the given counts
+// and flowDirection, during the period of m.
+func (e *FlowExporter) record(c netlogtype.Connection, packets, bytes uint64, dir byte, m *netlogtype.Message) flowRecord {
+	src, dst := c.Src.Addr(), c.Dst.Addr()
+	v6 := src.Is6() && !src.Is4In6() || dst.Is6() && !dst.Is4In6()
+	addr := func(a netip.Addr) []byte {
+		switch {
+		case v6 && a.IsValid():
+			b := a.As16()
+			return b[:]
+		case v6:
+			return make([]byte, 16)
+		case a.IsValid():
+			b := a.Unmap().As4()
+			return b[:]
+		default:
+			return make([]byte, 4) // scrubbed exit traffic
+		}
+	}
+	r := flowRecord{template: templateIPv4}
+	if v6 {
+		r.template = templateIPv6
+	}
+	b := make([]byte, 0, 64)
+	b = append(b, addr(src)...)
+	b = append(b, addr(dst)...)
+	b = binary.BigEndian.AppendUint16(b, c.Src.Port())
+	b = binary.BigEndian.AppendUint16(b, c.Dst.Port())
+	b = append(b, byte(c.Proto), dir)
+	b = binary.BigEndian.AppendUint64(b, bytes)
+	b = binary.BigEndian.AppendUint64(b, packets)
+	if e.proto == FlowNetFlowV9 {
+		b = binary.BigEndian.AppendUint32(b, e.uptime(m.Start))
+		b = binary.BigEndian.AppendUint32(b, e.uptime(m.End))
+	} else {
+		b = binary.BigEndian.AppendUint64(b, uint64(m.Start.UnixMilli()))
+		b = binary.BigEndian.AppendUint64(b, uint64(m.End.UnixMilli()))
+	}
+	r.data = b
+	return r
+}
+
+// uptime returns t as milliseconds since the exporter started, as NetFlow
+// v9 times are relative to the exporter's sysUptime.
+func (e *FlowExporter) uptime(t time.Time) uint32 {
+	return uint32(max(t.Sub(e.start), 0).Milliseconds())
+}
+
+func (e *FlowExporter) appendHeader(b []byte) []byte {
+	if e.proto == FlowNetFlowV9 {
+		// version, count, sysUptime, unix secs, sequence, source ID,
+		// filled in by finishPacket.
+		return append(b, make([]byte, 20)...)
+	}
+	// version, length, export time, sequence, observation domain ID.
+	return append(b, make([]byte, 16)...)
+}
+
+// appendTemplates appends a template set with the IPv4 and IPv6 templates.
+func (e *FlowExporter) appendTemplates(b []byte) []byte {
+	start := len(b)
+	setID := uint16(2) // IPFIX template set
+	if e.proto == FlowNetFlowV9 {
+		setID = 0 // NetFlow v9 template flowset
+	}
+	b = binary.BigEndian.AppendUint16(b, setID)
+	b = binary.BigEndian.AppendUint16(b, 0) // length, set by endSet
+	for _, v6 := range []bool{false, true} {
+		id, addrIE, addrLen := uint16(templateIPv4), [2]uint16{ieSourceIPv4Address, ieDestinationIPv4Address}, uint16(4)
+		if v6 {
+			id, addrIE, addrLen = templateIPv6, [2]uint16{ieSourceIPv6Address, ieDestinationIPv6Address}, 16
+		}
+		startIE, endIE, timeLen := uint16(ieFlowStartMilliseconds), uint16(ieFlowEndMilliseconds), uint16(8)
+		if e.proto == FlowNetFlowV9 {
+			startIE, endIE, timeLen = ieFirstSwitched, ieLastSwitched, 4
+		}
+		fields := [][2]uint16{
+			{addrIE[0], addrLen},
+			{addrIE[1], addrLen},
+			{ieSourceTransportPort, 2},
+			{ieDestinationTransportPort, 2},
+			{ieProtocolIdentifier, 1},
+			{ieFlowDirection, 1},
+			{ieOctetDeltaCount, 8},
+			{iePacketDeltaCount, 8},
+			{startIE, timeLen},
+			{endIE, timeLen},
+		}
+		b = binary.BigEndian.AppendUint16(b, id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = binary.BigEndian.AppendUint16(b, f[0])
+			b = binary.BigEndian.AppendUint16(b, f[1])
+		}
+	}
+	return e.endSet(b, start)
+}
+
+// endSet pads the set starting at b[start:] to a multiple of four bytes,
+// and sets its length.
+func (e *FlowExporter) endSet(b []byte, start int) []byte {
+	for (len(b)-start)%4 != 0 {
+		b = append(b, 0)
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+// finishPacket fills in the header of pkt, which has nrecs records, of
+// which ndata are data records, and advances the sequence number.
+func (e *FlowExporter) finishPacket(pkt []byte, nrecs, ndata int, now time.Time) {
+	be := binary.BigEndian
+	be.PutUint16(pkt[0:], uint16(e.proto))
+	if e.proto == FlowNetFlowV9 {
+		be.PutUint16(pkt[2:], uint16(nrecs))
+		be.PutUint32(pkt[4:], e.uptime(now))
+		be.PutUint32(pkt[8:], uint32(now.Unix()))
+		be.PutUint32(pkt[12:], e.seq)
+		be.PutUint32(pkt[16:], 0) // source ID
+		e.seq++
+		return
+	}
+	be.PutUint16(pkt[2:], uint16(len(pkt)))
+	be.PutUint32(pkt[4:], uint32(now.Unix()))
+	be.PutUint32(pkt[8:], e.seq)
+	be.PutUint32(pkt[12:], 0) // observation domain ID
+	e.seq += uint32(ndata)
+}
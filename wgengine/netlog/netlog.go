@@ -4,7 +4,8 @@
 //go:build !ts_omit_netlog && !ts_omit_logtail
 
 // Package netlog provides a logger that monitors a TUN device and
-// periodically records any traffic into a log stream.
+// periodically records any traffic into a log stream,
+// and to any local Exporters.
 package netlog
 
 import (
@@ -54,10 +55,11 @@ func (noopDevice) SetConnectionCounter(netlogfunc.ConnectionCounter) {}
 type Logger struct {
 	mu sync.Mutex // protects all fields below
 
-	logger *logtail.Logger
-	stats  *statistics
-	tun    Device
-	sock   Device
+	logger    *logtail.Logger // nil if not uploading
+	exporters []Exporter
+	stats     *statistics
+	tun       Device
+	sock      Device
 
 	addrs    map[netip.Addr]bool
 	prefixes map[netip.Prefix]bool
@@ -65,11 +67,28 @@ type Logger struct {
 
 // Running reports whether the logger is running.
 func (nl *Logger) Running() bool {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	return nl.stats != nil
+}
+
+// Uploading reports whether the logger is running and uploading
+// to Tailscale's log service.
+func (nl *Logger) Uploading() bool {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
 	return nl.logger != nil
 }
 
+// SetExporters sets the exporters that every log message is also
+// exported to, taking effect on the next call to Startup.
+// The exporters are not closed by Shutdown.
+func (nl *Logger) SetExporters(exporters []Exporter) {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	nl.exporters = exporters
+}
+
 var testClient *http.Client
 
 // Startup starts an asynchronous network logger that monitors
@@ -97,34 +116,46 @@ func (nl *Logger) Running() bool {
 // The IP protocol and source port are always zero.
 // The sock is used to populated the PhysicalTraffic field in Message.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
+//
+// If nodeLogID is zero, nothing is uploaded to Tailscale's log service,
+// and traffic is only exported to the exporters set by SetExporters.
 func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor, health *health.Tracker, bus *eventbus.Bus, logExitFlowEnabledEnabled bool) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger != nil {
-		return fmt.Errorf("network logger already running for %v", nl.logger.PrivateID().Public())
+	if nl.stats != nil {
+		if nl.logger != nil {
+			return fmt.Errorf("network logger already running for %v", nl.logger.PrivateID().Public())
+		}
+		return errors.New("network logger already running")
+	}
+	if nodeLogID.IsZero() && len(nl.exporters) == 0 {
+		return errors.New("network logger has no log ID or exporters")
 	}
 
 	// Startup a log stream to Tailscale's logging service.
-	logf := log.Printf
-	httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, health, logf)}
-	if testClient != nil {
-		httpc = testClient
+	if !nodeLogID.IsZero() {
+		logf := log.Printf
+		httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, health, logf)}
+		if testClient != nil {
+			httpc = testClient
+		}
+		nl.logger = logtail.NewLogger(logtail.Config{
+			Collection:    "tailtraffic.log.tailscale.io",
+			PrivateID:     nodeLogID,
+			CopyPrivateID: domainLogID,
+			Bus:           bus,
+			Stderr:        io.Discard,
+			CompressLogs:  true,
+			HTTPC:         httpc,
+			// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
+
+			// Include process sequence numbers to identify missing samples.
+			IncludeProcID:       true,
+			IncludeProcSequence: true,
+		}, logf)
+		nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
 	}
-	nl.logger = logtail.NewLogger(logtail.Config{
-		Collection:    "tailtraffic.log.tailscale.io",
-		PrivateID:     nodeLogID,
-		CopyPrivateID: domainLogID,
-		Bus:           bus,
-		Stderr:        io.Discard,
-		CompressLogs:  true,
-		HTTPC:         httpc,
-		// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
-
-		// Include process sequence numbers to identify missing samples.
-		IncludeProcID:       true,
-		IncludeProcSequence: true,
-	}, logf)
-	nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
+	logger, exporters := nl.logger, nl.exporters
 
 	// Startup a data structure to track per-connection statistics.
 	// There is a maximum size for individual log messages that logtail
@@ -136,7 +167,18 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 		addrs := nl.addrs
 		prefixes := nl.prefixes
 		nl.mu.Unlock()
-		recordStatistics(nl.logger, nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
+		m := makeMessage(nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
+		if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) == 0 {
+			return
+		}
+		if logger != nil {
+			recordMessage(logger, m)
+		}
+		for _, e := range exporters {
+			if err := e.Export(m); err != nil {
+				log.Printf("netlog: exporting to %v: %v", e, err)
+			}
+		}
 	})
 
 	// Register the connection tracker into the TUN device.
@@ -150,8 +192,11 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 	return nil
 }
 
-func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start, end time.Time, connStats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) {
-	m := netlogtype.Message{NodeID: nodeID, Start: start.UTC(), End: end.UTC()}
+// makeMessage makes the log message for the connection statistics over the
+// period from start to end, classifying virtual connections by the routes in
+// addrs and prefixes.
+func makeMessage(nodeID tailcfg.StableNodeID, start, end time.Time, connStats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) *netlogtype.Message {
+	m := &netlogtype.Message{NodeID: nodeID, Start: start.UTC(), End: end.UTC()}
 
 	classifyAddr := func(a netip.Addr) (isTailscale, withinRoute bool) {
 		// NOTE: There could be mis-classifications where an address is treated
@@ -200,12 +245,15 @@ func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start
 		m.PhysicalTraffic = append(m.PhysicalTraffic, netlogtype.ConnectionCounts{Connection: conn, Counts: cnts})
 	}
 
-	if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) > 0 {
-		if b, err := json.Marshal(m); err != nil {
-			logger.Logf("json.Marshal error: %v", err)
-		} else {
-			logger.Logf("%s", b)
-		}
+	return m
+}
+
+// recordMessage records m to the log stream of logger.
+func recordMessage(logger *logtail.Logger, m *netlogtype.Message) {
+	if b, err := json.Marshal(m); err != nil {
+		logger.Logf("json.Marshal error: %v", err)
+	} else {
+		logger.Logf("%s", b)
 	}
 }
 
@@ -248,7 +296,7 @@ func (nl *Logger) ReconfigRoutes(cfg *router.Config) {
 func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger == nil {
+	if nl.stats == nil {
 		return nil
 	}
 
@@ -258,7 +306,10 @@ func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.sock.SetConnectionCounter(nil)
 	nl.tun.SetConnectionCounter(nil)
 	err1 := nl.stats.Shutdown(ctx)
-	err2 := nl.logger.Shutdown(ctx)
+	var err2 error
+	if nl.logger != nil {
+		err2 = nl.logger.Shutdown(ctx)
+	}
 	nl.mu.Lock()
 
 	// Purge state.
@@ -5,9 +5,19 @@
 
 package netlog
 
+import "errors"
+
 type Logger struct{}
 
+type Exporter interface{ Close() error }
+
 func (*Logger) Startup(...any) error { return nil }
 func (*Logger) Running() bool        { return false }
+func (*Logger) Uploading() bool      { return false }
+func (*Logger) SetExporters(any)     {}
 func (*Logger) Shutdown(any) error   { return nil }
 func (*Logger) ReconfigRoutes(any)   {}
+
+func ParseExporters(string) ([]Exporter, error) {
+	return nil, errors.New("network logging not supported in this build")
+}
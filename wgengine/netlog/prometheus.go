@@ -0,0 +1,179 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_netlog && !ts_omit_logtail
+
+package netlog
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+// maxPrometheusSeries is the most address pairs that a PrometheusExporter
+// tracks. Traffic of any further address pairs is counted in a series with
+// empty addresses, to bound the memory used and the size of the output.
+const maxPrometheusSeries = 4096
+
+// PrometheusExporter is an Exporter that keeps a summary of the traffic in
+// the exported messages, as counters of the bytes and packets transmitted
+// and received, by traffic type, protocol, and source and destination
+// address, for serving in the Prometheus text exposition format.
+//
+// Ports are not included, to keep the number of series manageable.
+type PrometheusExporter struct {
+	ln  net.Listener // or nil
+	srv *http.Server // or nil
+
+	mu         sync.Mutex
+	counts     map[promKey]netlogtype.Counts
+	lastExport time.Time
+}
+
+type promKey struct {
+	traffic  string // "virtual", "subnet", "exit" or "physical"
+	proto    ipproto.Proto
+	src, dst netip.Addr
+}
+
+// NewPrometheusExporter returns a new PrometheusExporter. If addr is
+// non-empty, it serves the metrics at http://<addr>/metrics until closed.
+func NewPrometheusExporter(addr string) (*PrometheusExporter, error) {
+	e := &PrometheusExporter{counts: make(map[promKey]netlogtype.Counts)}
+	if addr == "" {
+		return e, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	e.ln = ln
+	e.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go e.srv.Serve(ln)
+	return e, nil
+}
+
+func (e *PrometheusExporter) String() string {
+	if e.ln == nil {
+		return "prometheus"
+	}
+	return "prometheus:" + e.ln.Addr().String()
+}
+
+func (e *PrometheusExporter) Close() error {
+	if e.srv == nil {
+		return nil
+	}
+	return e.srv.Close()
+}
+
+func (e *PrometheusExporter) Export(m *netlogtype.Message) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	add := func(traffic string, ccs []netlogtype.ConnectionCounts) {
+		for _, cc := range ccs {
+			k := promKey{traffic: traffic, proto: cc.Proto, src: cc.Src.Addr(), dst: cc.Dst.Addr()}
+			if _, ok := e.counts[k]; !ok && len(e.counts) >= maxPrometheusSeries {
+				k = promKey{traffic: traffic}
+			}
+			e.counts[k] = e.counts[k].Add(cc.Counts)
+		}
+	}
+	add("virtual", m.VirtualTraffic)
+	add("subnet", m.SubnetTraffic)
+	add("exit", m.ExitTraffic)
+	add("physical", m.PhysicalTraffic)
+	e.lastExport = m.End
+	return nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	e.WritePrometheus(w)
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text exposition
+// format.
+func (e *PrometheusExporter) WritePrometheus(w io.Writer) error {
+	e.mu.Lock()
+	keys := make([]promKey, 0, len(e.counts))
+	counts := make([]netlogtype.Counts, 0, len(e.counts))
+	for k := range e.counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b promKey) int {
+		return cmp.Or(
+			cmp.Compare(a.traffic, b.traffic),
+			cmp.Compare(a.proto, b.proto),
+			a.src.Compare(b.src),
+			a.dst.Compare(b.dst),
+		)
+	})
+	for _, k := range keys {
+		counts = append(counts, e.counts[k])
+	}
+	lastExport := e.lastExport
+	e.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	metric := func(name, help string, val func(netlogtype.Counts, bool) uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for i, k := range keys {
+			for _, rx := range []bool{false, true} {
+				dir := "tx"
+				if rx {
+					dir = "rx"
+				}
+				fmt.Fprintf(bw, "%s{traffic=%q,proto=%q,src=%q,dst=%q,direction=%q} %d\n",
+					name, k.traffic, protoLabel(k.proto), addrLabel(k.src), addrLabel(k.dst), dir, val(counts[i], rx))
+			}
+		}
+	}
+	metric("tailscaled_netlog_bytes_total", "Bytes of network traffic logged, by connection addresses and direction.", func(c netlogtype.Counts, rx bool) uint64 {
+		if rx {
+			return c.RxBytes
+		}
+		return c.TxBytes
+	})
+	metric("tailscaled_netlog_packets_total", "Packets of network traffic logged, by connection addresses and direction.", func(c netlogtype.Counts, rx bool) uint64 {
+		if rx {
+			return c.RxPackets
+		}
+		return c.TxPackets
+	})
+	if !lastExport.IsZero() {
+		const name = "tailscaled_netlog_last_export_timestamp_seconds"
+		fmt.Fprintf(bw, "# HELP %s Unix time of the end of the last logged period.\n# TYPE %s gauge\n", name, name)
+		fmt.Fprintf(bw, "%s %d\n", name, lastExport.Unix())
+	}
+	return bw.Flush()
+}
+
+func protoLabel(p ipproto.Proto) string {
+	if p == 0 {
+		return ""
+	}
+	return strings.ToLower(p.String())
+}
+
+func addrLabel(a netip.Addr) string {
+	if !a.IsValid() {
+		return ""
+	}
+	return a.String()
+}
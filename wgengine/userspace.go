@@ -45,6 +45,7 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/views"
 	"tailscale.com/util/checkchange"
@@ -159,6 +160,9 @@ type userspaceEngine struct {
 
 	// networkLogger logs statistics about network connections.
 	networkLogger netlog.Logger
+	// netLogExporters are the local exporters of networkLogger,
+	// which are closed with the engine.
+	netLogExporters []netlog.Exporter
 
 	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
 }
@@ -242,6 +246,11 @@ type Config struct {
 	// TODO(creachadair): As of 2025-03-19 this is optional, but is intended to
 	// become required non-nil.
 	EventBus *eventbus.Bus
+
+	// NetLogExporters, if non-empty, are local exporters that network flow
+	// logs are exported to, even if the control plane has not enabled
+	// network logging. The engine closes them when it is closed.
+	NetLogExporters []netlog.Exporter
 }
 
 // NewFakeUserspaceEngine returns a new userspace engine for testing.
@@ -357,6 +366,10 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		reconfigureVPN: conf.ReconfigureVPN,
 		health:         conf.HealthTracker,
 	}
+	if buildfeatures.HasNetLog && len(conf.NetLogExporters) > 0 {
+		e.netLogExporters = conf.NetLogExporters
+		e.networkLogger.SetExporters(conf.NetLogExporters)
+	}
 
 	if e.birdClient != nil {
 		// Disable the protocol at start time.
@@ -981,8 +994,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	netLogIDsNowValid := !newLogIDs.NodeID.IsZero() && !newLogIDs.DomainID.IsZero()
 	netLogIDsWasValid := !oldLogIDs.NodeID.IsZero() && !oldLogIDs.DomainID.IsZero()
 	netLogIDsChanged := netLogIDsNowValid && netLogIDsWasValid && newLogIDs != oldLogIDs
-	netLogRunning := netLogIDsNowValid && !routerCfg.Equal(&router.Config{})
-	if !buildfeatures.HasNetLog || envknob.NoLogsNoSupport() {
+	netLogUpload := netLogIDsNowValid && !envknob.NoLogsNoSupport()
+	netLogRunning := (netLogUpload || len(e.netLogExporters) > 0) && !routerCfg.Equal(&router.Config{})
+	if !buildfeatures.HasNetLog {
 		netLogRunning = false
 	}
 
@@ -1037,9 +1051,10 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		return err
 	}
 
-	// Shutdown the network logger because the IDs changed.
+	// Shutdown the network logger because the IDs changed,
+	// or because uploading was enabled or disabled while exporting locally.
 	// Let it be started back up by subsequent logic.
-	if buildfeatures.HasNetLog && netLogIDsChanged && e.networkLogger.Running() {
+	if buildfeatures.HasNetLog && e.networkLogger.Running() && (netLogIDsChanged || netLogRunning && e.networkLogger.Uploading() != netLogUpload) {
 		e.logf("wgengine: Reconfig: shutting down network logger")
 		ctx, cancel := context.WithTimeout(context.Background(), networkLoggerUploadTimeout)
 		defer cancel()
@@ -1051,10 +1066,15 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	// Startup the network logger.
 	// Do this before configuring the router so that we capture initial packets.
 	if buildfeatures.HasNetLog && netLogRunning && !e.networkLogger.Running() {
-		nid := cfg.NetworkLogging.NodeID
-		tid := cfg.NetworkLogging.DomainID
+		var nid, tid logid.PrivateID
+		if netLogUpload {
+			nid = cfg.NetworkLogging.NodeID
+			tid = cfg.NetworkLogging.DomainID
+			e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
+		} else {
+			e.logf("wgengine: Reconfig: starting up network logger (local exporters only)")
+		}
 		logExitFlowEnabled := cfg.NetworkLogging.LogExitFlowEnabled
-		e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
 		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.tundev, e.magicConn, e.netMon, e.health, e.eventBus, logExitFlowEnabled); err != nil {
 			e.logf("wgengine: Reconfig: error starting up network logger: %v", err)
 		}
@@ -1287,6 +1307,9 @@ func (e *userspaceEngine) Close() {
 	if err := e.networkLogger.Shutdown(ctx); err != nil {
 		e.logf("wgengine: Close: error shutting down network logger: %v", err)
 	}
+	for _, ex := range e.netLogExporters {
+		ex.Close()
+	}
 }
 
 func (e *userspaceEngine) Done() <-chan struct{} {